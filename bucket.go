@@ -15,25 +15,95 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/googlecloudplatform/gcsfuse/internal/canned"
 	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/monitor"
+	"github.com/googlecloudplatform/gcsfuse/internal/profile"
+	"github.com/googlecloudplatform/gcsfuse/internal/pubsub"
+	"github.com/googlecloudplatform/gcsfuse/internal/tracing"
 	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/gcloud/gcs/gcscaching"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
 	"github.com/jacobsa/ratelimit"
 	"github.com/jacobsa/timeutil"
 )
 
+// Rate limits are enforced over the window given by --limit-window. Very low
+// rates need a longer window to give a token bucket capacity of at least one
+// token, so we double the window as necessary up to this maximum.
+const maxRateLimitWindow = 8 * time.Hour
+
+// How often a request is let through to check whether GCS has recovered, once
+// --circuit-breaker-threshold has been reached.
+const circuitBreakerProbeInterval = 5 * time.Second
+
+// The number of workers copying changes to the --mirror-bucket, and the number
+// of changes each may have queued before more are dropped.
+const (
+	mirrorWorkers       = 8
+	mirrorQueueCapacity = 1024
+)
+
+// The fields of objects that gcsfuse uses, which are all that's asked for when
+// statting and listing: everything but the ACLs, the owner, and the links and
+// IDs that GCS adds to the object resource, which make up much of
+// each record.
+var objectFields = []string{
+	"name",
+	"size",
+	"generation",
+	"metageneration",
+	"timeCreated",
+	"timeDeleted",
+	"updated",
+	"metadata",
+	"contentType",
+	"contentLanguage",
+	"contentEncoding",
+	"cacheControl",
+	"componentCount",
+	"md5Hash",
+	"crc32c",
+	"storageClass",
+	"kmsKeyName",
+	"customerEncryption",
+}
+
+// The names matched by --editor-temp-files unless --editor-temp-patterns is
+// given: vim's swap files, backups ending in a tilde, emacs's lock files, and
+// the files in which macOS's Finder keeps its view settings.
+var defaultEditorTempPatterns = []string{"*.swp", "*~", ".#*", ".DS_Store"}
+
+// Choose a token bucket capacity for the given rate, using the shortest
+// workable window no shorter than the one given. Capacities scale with the
+// window, so this is also roughly how much of a burst is allowed.
+func chooseTokenBucketCapacity(
+	rateHz float64,
+	minWindow time.Duration) (capacity uint64, err error) {
+	for window := minWindow; ; window *= 2 {
+		capacity, err = ratelimit.ChooseTokenBucketCapacity(rateHz, window)
+		if err == nil || window >= maxRateLimitWindow {
+			return
+		}
+	}
+}
+
 func setUpRateLimiting(
 	in gcs.Bucket,
 	opRateLimitHz float64,
-	egressBandwidthLimit float64) (out gcs.Bucket, err error) {
+	egressBandwidthLimit float64,
+	window time.Duration) (out gcs.Bucket, err error) {
 	// If no rate limiting has been requested, just return the bucket.
 	if !(opRateLimitHz > 0 || egressBandwidthLimit > 0) {
 		out = in
@@ -50,22 +120,14 @@ func setUpRateLimiting(
 	}
 
 	// Choose token bucket capacities, targeting only a few percent error in each
-	// window of the given size.
-	const window = 8 * time.Hour
-
-	opCapacity, err := ratelimit.ChooseTokenBucketCapacity(
-		opRateLimitHz,
-		window)
-
+	// window.
+	opCapacity, err := chooseTokenBucketCapacity(opRateLimitHz, window)
 	if err != nil {
 		err = fmt.Errorf("Choosing operation token bucket capacity: %v", err)
 		return
 	}
 
-	egressCapacity, err := ratelimit.ChooseTokenBucketCapacity(
-		egressBandwidthLimit,
-		window)
-
+	egressCapacity, err := chooseTokenBucketCapacity(egressBandwidthLimit, window)
 	if err != nil {
 		err = fmt.Errorf("Choosing egress bandwidth token bucket capacity: %v", err)
 		return
@@ -84,54 +146,512 @@ func setUpRateLimiting(
 	return
 }
 
-// Configure a bucket based on the supplied flags.
+// Wrap a bucket with rate limiting and stat caching according to the supplied
+// settings. Each call creates a fresh stat cache, which is returned so that
+// entries may be erased from it, or nil if stat caching is disabled.
+func setUpTunedBucket(
+	in gcs.Bucket,
+	s profile.Settings) (
+	out gcs.Bucket,
+	cache *gcsx.ErasableStatCache,
+	err error) {
+	// Enable rate limiting, if requested.
+	out, err = setUpRateLimiting(
+		in,
+		s.OpRateLimitHz,
+		s.EgressBandwidthLimitBytesPerSecond,
+		s.RateLimitWindow)
+
+	if err != nil {
+		err = fmt.Errorf("setUpRateLimiting: %v", err)
+		return
+	}
+
+	// Enable cached StatObject results, if appropriate.
+	if s.StatCacheTTL != 0 {
+		cache = gcsx.NewErasableStatCache(
+			gcscaching.NewStatCache(s.StatCacheCapacity))
+
+		out = gcscaching.NewFastStatBucket(
+			s.StatCacheTTL,
+			cache,
+			timeutil.RealClock(),
+			out)
+	}
+
+	return
+}
+
+// Open a lower layer for --lower-layer, given as a bucket name optionally
+// followed by a slash and the prefix of the bucket to use.
+func openLowerLayer(
+	ctx context.Context,
+	flags *flagStorage,
+	conn gcs.Conn,
+	layer string,
+	timeouts gcsx.Timeouts) (b gcs.Bucket, err error) {
+	name := layer
+	var prefix string
+	if i := strings.Index(layer, "/"); i >= 0 {
+		name, prefix = layer[:i], layer[i+1:]
+	}
+
+	b, err = conn.OpenBucket(
+		ctx,
+		&gcs.OpenBucketOptions{
+			Name:           name,
+			BillingProject: flags.BillingProject,
+			ObjectFields:   objectFields,
+		})
+
+	if err != nil {
+		err = fmt.Errorf("OpenBucket: %v", err)
+		return
+	}
+
+	b = gcsx.NewTimeoutBucket(b, timeouts)
+
+	if prefix != "" {
+		b, err = gcsx.NewPrefixBucket(path.Clean(prefix)+"/", b)
+		if err != nil {
+			err = fmt.Errorf("NewPrefixBucket: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
+// Configure a bucket based on the supplied flags, with rate limiting and stat
+// caching that follow the active profile.
+//
+// If changes is non-nil, the stat cache entries for objects it reports as
+// changed are erased.
+//
+// If folders is non-nil, the bucket has a hierarchical namespace and its
+// folders stand in for directory placeholder objects. In that case the
+// returned Folders is a view of them limited to the same prefix as the bucket,
+// whose renames keep the stat cache up to date. Likewise for deleted, which
+// is non-nil if the soft-deleted objects of the bucket are to be served.
+//
+// If objects are deleted in the background, deletes is the layer doing so,
+// whose deletions must be waited for before exiting. Otherwise it is nil.
 //
 // Special case: if the bucket name is canned.FakeBucketName, set up a fake
-// bucket as described in that package.
+// bucket as described in that package. With --offline, serve the objects of
+// contentCache instead, and leave conn unused.
 func setUpBucket(
 	ctx context.Context,
 	flags *flagStorage,
+	profiles *profile.Manager,
+	changes *pubsub.Subscriber,
+	contentCache *gcsx.BlockCache,
 	conn gcs.Conn,
-	name string) (b gcs.Bucket, err error) {
+	folders gcsx.Folders,
+	deleted gcsx.SoftDeletedObjects,
+	name string) (
+	b gcs.Bucket,
+	fsFolders gcsx.Folders,
+	fsDeleted gcsx.SoftDeletedObjects,
+	deletes gcsx.BackgroundDeleteBucket,
+	err error) {
 	// Set up the appropriate backing bucket.
-	if name == canned.FakeBucketName {
+	switch {
+	case flags.Offline:
+		b = gcsx.NewOfflineBucket(name, contentCache.Objects())
+
+	case name == canned.FakeBucketName:
 		b = canned.MakeFakeBucket(ctx)
-	} else {
-		b, err = conn.OpenBucket(ctx, &gcs.OpenBucketOptions{Name: name, BillingProject: flags.BillingProject})
+
+	default:
+		b, err = conn.OpenBucket(
+			ctx,
+			&gcs.OpenBucketOptions{
+				Name:           name,
+				BillingProject: flags.BillingProject,
+				ObjectFields:   objectFields,
+			})
+
 		if err != nil {
 			err = fmt.Errorf("OpenBucket: %v", err)
 			return
 		}
+
+		if flags.ListPageSize != 0 {
+			if flags.ListPageSize < 0 || flags.ListPageSize > gcsx.MaxListPageSize {
+				err = fmt.Errorf("Invalid --list-page-size: %d", flags.ListPageSize)
+				return
+			}
+
+			b = gcsx.NewPageSizeBucket(b, flags.ListPageSize)
+		}
+	}
+
+	if folders != nil {
+		b = gcsx.NewFolderBucket(b, folders)
 	}
 
-	// Limit to a requested prefix of the bucket, if any.
-	if flags.OnlyDir != "" {
-		b, err = gcsx.NewPrefixBucket(path.Clean(flags.OnlyDir)+"/", b)
+	// Show the bucket as it was at a point in time, if requested.
+	if flags.SnapshotTime != "" {
+		var t time.Time
+		t, err = time.Parse(time.RFC3339, flags.SnapshotTime)
+		if err != nil {
+			err = fmt.Errorf("Invalid --snapshot-time: %v", err)
+			return
+		}
+
+		b = gcsx.NewSnapshotBucket(b, t)
+	}
+
+	// Fail requests that hang rather than blocking the file system forever.
+	timeouts := gcsx.Timeouts{
+		Metadata: flags.MetadataTimeout,
+		Read:     flags.ReadTimeout,
+		Upload:   flags.UploadTimeout,
+	}
+
+	b = gcsx.NewTimeoutBucket(b, timeouts)
+
+	// Log those that are slow, if requested.
+	if flags.SlowOpThreshold > 0 {
+		b = gcsx.NewSlowLoggingBucket(
+			b,
+			flags.SlowOpThreshold,
+			log.New(os.Stderr, "", log.LstdFlags))
+	}
+
+	// Record the requests we send to GCS, if tracing is enabled.
+	if tracing.Enabled() {
+		b = gcsx.NewTracingBucket(b)
+	}
+
+	// Count them, if monitoring is enabled.
+	if monitor.Enabled() {
+		b = gcsx.NewMonitoringBucket(
+			b,
+			monitor.GCSRequests,
+			monitor.GCSRequestErrors,
+			monitor.GCSRequestLatency,
+			monitor.GCSRequestsByProcess)
+	}
+
+	// Duplicate reads that are slow to start, if requested. The duplicates are
+	// counted and traced like any other request.
+	if flags.HedgeReadsPercentile != 0 {
+		p := flags.HedgeReadsPercentile
+		if p < 0 || p >= 100 {
+			err = fmt.Errorf("Invalid --hedge-reads-percentile: %v", p)
+			return
+		}
+
+		var hedges *monitor.Counter
+		if monitor.Enabled() {
+			hedges = monitor.GCSHedgedReads
+		}
+
+		b = gcsx.NewHedgingBucket(b, p, hedges)
+	}
+
+	// Stop sending requests while GCS appears to be down, if requested. This is
+	// below the stat cache, so that fresh entries are still served.
+	if flags.CircuitBreakerThreshold != 0 {
+		if flags.CircuitBreakerThreshold < 0 {
+			err = fmt.Errorf(
+				"Invalid --circuit-breaker-threshold: %d",
+				flags.CircuitBreakerThreshold)
+			return
+		}
+
+		b = gcsx.NewCircuitBreakerBucket(
+			b,
+			flags.CircuitBreakerThreshold,
+			circuitBreakerProbeInterval,
+			timeutil.RealClock(),
+			log.New(os.Stderr, "", log.LstdFlags))
+	}
+
+	// Read from a replica of the bucket when it can't be read, if requested.
+	// The replica gets the same timeouts, but goes unmonitored and untraced.
+	if flags.ReplicaBucket != "" {
+		if flags.Offline {
+			err = errors.New("--replica-bucket can't be used with --offline")
+			return
+		}
+
+		var replica gcs.Bucket
+		replica, err = conn.OpenBucket(
+			ctx,
+			&gcs.OpenBucketOptions{
+				Name:           flags.ReplicaBucket,
+				BillingProject: flags.BillingProject,
+				ObjectFields:   objectFields,
+			})
+
+		if err != nil {
+			err = fmt.Errorf("OpenBucket(%q): %v", flags.ReplicaBucket, err)
+			return
+		}
+
+		replica = gcsx.NewTimeoutBucket(replica, timeouts)
+
+		var replicaReads *monitor.Counter
+		if monitor.Enabled() {
+			replicaReads = monitor.GCSReplicaReads
+		}
+
+		b = gcsx.NewReplicaBucket(b, replica, replicaReads)
+	}
+
+	// Copy changes to a mirror of the bucket in the background, if requested.
+	// Like the replica, the mirror goes unmonitored and untraced. A local
+	// overlay would leave it nothing to copy.
+	if flags.MirrorBucket != "" {
+		if flags.Offline || flags.LocalOverlay != "" {
+			err = errors.New(
+				"--mirror-bucket can't be used with --offline or --local-overlay")
+			return
+		}
+
+		var mirror gcs.Bucket
+		mirror, err = conn.OpenBucket(
+			ctx,
+			&gcs.OpenBucketOptions{
+				Name:           flags.MirrorBucket,
+				BillingProject: flags.BillingProject,
+				ObjectFields:   objectFields,
+			})
+
+		if err != nil {
+			err = fmt.Errorf("OpenBucket(%q): %v", flags.MirrorBucket, err)
+			return
+		}
+
+		mirror = gcsx.NewTimeoutBucket(mirror, timeouts)
+
+		var mirrored *monitor.Counter
+		if monitor.Enabled() {
+			mirrored = monitor.GCSMirrorChanges
+		}
+
+		// Names are mirrored in full, so the temporary objects are below any
+		// --only-dir.
+		skipPrefix := tmpObjectPrefix
+		if flags.OnlyDir != "" {
+			skipPrefix = path.Clean(flags.OnlyDir) + "/" + tmpObjectPrefix
+		}
+
+		b = gcsx.NewMirrorBucket(
+			b,
+			mirror,
+			skipPrefix,
+			mirrorWorkers,
+			mirrorQueueCapacity,
+			mirrored,
+			log.New(os.Stderr, "", log.LstdFlags))
+	}
+
+	// Limit to a requested prefix of the bucket, if any. The names of cached
+	// objects are already relative to it.
+	if flags.OnlyDir != "" && !flags.Offline {
+		prefix := path.Clean(flags.OnlyDir) + "/"
+		b, err = gcsx.NewPrefixBucket(prefix, b)
 		if err != nil {
 			err = fmt.Errorf("NewPrefixBucket: %v", err)
 			return
 		}
+
+		if folders != nil {
+			folders = gcsx.NewPrefixFolders(prefix, folders)
+		}
+
+		if deleted != nil {
+			deleted = gcsx.NewPrefixSoftDeletedObjects(prefix, deleted)
+		}
 	}
 
-	// Enable rate limiting, if requested.
-	b, err = setUpRateLimiting(
-		b,
-		flags.OpRateLimitHz,
-		flags.EgressBandwidthLimitBytesPerSecond)
+	// Layer the bucket over read-only buckets, and a local directory over
+	// that, if requested. Folders can't be renamed without renaming their
+	// contents in every layer, and restoring objects from the trash would
+	// change the bucket behind the overlay's back.
+	if len(flags.LowerLayers) != 0 || flags.LocalOverlay != "" {
+		switch {
+		case flags.Offline:
+			err = errors.New(
+				"--lower-layer and --local-overlay can't be used with --offline")
+			return
+
+		case folders != nil:
+			err = errors.New(
+				"--lower-layer and --local-overlay can't be used with a " +
+					"hierarchical namespace bucket")
+			return
 
+		case flags.LocalOverlay != "" && deleted != nil:
+			err = errors.New("--local-overlay can't be used with --trash-dir")
+			return
+		}
+
+		upper := b
+		var lowers []gcs.Bucket
+		if flags.LocalOverlay != "" {
+			upper, err = gcsx.OpenDirBucket(
+				name,
+				flags.LocalOverlay,
+				timeutil.RealClock())
+
+			if err != nil {
+				err = fmt.Errorf("OpenDirBucket: %v", err)
+				return
+			}
+
+			lowers = append(lowers, b)
+		}
+
+		for _, layer := range flags.LowerLayers {
+			var lower gcs.Bucket
+			lower, err = openLowerLayer(ctx, flags, conn, layer, timeouts)
+			if err != nil {
+				err = fmt.Errorf("openLowerLayer(%q): %v", layer, err)
+				return
+			}
+
+			lowers = append(lowers, lower)
+		}
+
+		b = gcsx.NewUnionBucket(upper, lowers)
+	}
+
+	// Hide the names the user isn't interested in, if requested, sparing the
+	// requests to look them up.
+	if len(flags.OnlyPatterns) != 0 || len(flags.IgnorePatterns) != 0 {
+		b, err = gcsx.NewFilterBucket(
+			b,
+			flags.OnlyPatterns,
+			flags.IgnorePatterns,
+			tmpObjectPrefix)
+
+		if err != nil {
+			err = fmt.Errorf("NewFilterBucket: %v", err)
+			return
+		}
+	}
+
+	// Keep editors' temporary files out of the bucket, if requested.
+	if flags.EditorTempFiles != "keep" {
+		var local gcs.Bucket
+		switch flags.EditorTempFiles {
+		case "deny":
+		case "local":
+			local = gcsfake.NewFakeBucket(timeutil.RealClock(), name)
+
+		default:
+			err = fmt.Errorf(
+				"Unknown --editor-temp-files mode: %q",
+				flags.EditorTempFiles)
+			return
+		}
+
+		patterns := flags.EditorTempPatterns
+		if len(patterns) == 0 {
+			patterns = defaultEditorTempPatterns
+		}
+
+		b, err = gcsx.NewDivertingBucket(b, local, patterns)
+		if err != nil {
+			err = fmt.Errorf("NewDivertingBucket: %v", err)
+			return
+		}
+	}
+
+	// Delete objects in the background, if requested, so that the deletions
+	// of `rm -r` run concurrently. This is below the stat cache, which must
+	// forget the objects as soon as their deletions return.
+	if flags.DeleteWorkers > 0 {
+		deletes = gcsx.NewBackgroundDeleteBucket(
+			b,
+			flags.DeleteWorkers,
+			log.New(os.Stderr, "", log.LstdFlags))
+
+		b = deletes
+	}
+
+	// Add the layers whose settings may be changed by switching profiles,
+	// rebuilding them on each switch. With close-to-open consistency, lookups
+	// must not be served from the stat cache, so leave it out.
+	inner := b
+
+	// The stat cache of the current tuned bucket, if any.
+	var mu sync.Mutex
+	var cache *gcsx.ErasableStatCache // GUARDED_BY(mu)
+
+	tune := func(s profile.Settings) (tuned gcs.Bucket, err error) {
+		if flags.Consistency == "close-to-open" {
+			s.StatCacheTTL = 0
+		}
+
+		tuned, c, err := setUpTunedBucket(inner, s)
+		if err != nil {
+			return
+		}
+
+		mu.Lock()
+		cache = c
+		mu.Unlock()
+
+		return
+	}
+
+	b, err = tune(profiles.Current())
 	if err != nil {
-		err = fmt.Errorf("setUpRateLimiting: %v", err)
 		return
 	}
 
-	// Enable cached StatObject results, if appropriate.
-	if flags.StatCacheTTL != 0 {
-		cacheCapacity := flags.StatCacheCapacity
-		b = gcscaching.NewFastStatBucket(
-			flags.StatCacheTTL,
-			gcscaching.NewStatCache(cacheCapacity),
-			timeutil.RealClock(),
-			b)
+	erase := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if cache != nil {
+			cache.Erase(name)
+		}
+	}
+
+	if changes != nil {
+		changes.Subscribe(func(c pubsub.Change) {
+			erase(c.Name)
+		})
+	}
+
+	if folders != nil {
+		fsFolders = &erasingFolders{
+			Folders: folders,
+			erase:   erase,
+		}
+	}
+
+	if deleted != nil {
+		fsDeleted = &erasingSoftDeletedObjects{
+			SoftDeletedObjects: deleted,
+			erase:              erase,
+		}
+	}
+
+	sb := gcsx.NewSwitchableBucket(b)
+	b = sb
+
+	profiles.Subscribe(func(s profile.Settings) {
+		tuned, err := tune(s)
+		if err != nil {
+			log.Printf("Keeping previous bucket settings: %v", err)
+			return
+		}
+
+		sb.Switch(tuned)
+	})
+
+	// Count the requests made by the file system, so that the difference from
+	// the requests that make it to GCS shows the effect of caching.
+	if monitor.Enabled() {
+		b = gcsx.NewMonitoringBucket(b, monitor.BucketRequests, nil, nil, nil)
 	}
 
 	// Check whether this bucket works, giving the user a warning early if there
@@ -145,3 +665,39 @@ func setUpBucket(
 
 	return
 }
+
+// A Folders that erases the names of renamed folders from the stat cache, as
+// the bucket does for the objects it modifies. What the cache holds about
+// their contents is left to expire, since nothing is looked up within a
+// folder whose name isn't found first.
+type erasingFolders struct {
+	gcsx.Folders
+	erase func(name string)
+}
+
+func (f *erasingFolders) RenameFolder(
+	ctx context.Context,
+	src string,
+	dst string) (err error) {
+	err = f.Folders.RenameFolder(ctx, src, dst)
+	f.erase(src)
+	f.erase(dst)
+	return
+}
+
+// A SoftDeletedObjects that erases the names of restored objects from the
+// stat cache, which may hold their absence.
+type erasingSoftDeletedObjects struct {
+	gcsx.SoftDeletedObjects
+	erase func(name string)
+}
+
+func (s *erasingSoftDeletedObjects) RestoreObject(
+	ctx context.Context,
+	name string,
+	generation int64,
+	mustNotExist bool) (err error) {
+	err = s.SoftDeletedObjects.RestoreObject(ctx, name, generation, mustNotExist)
+	s.erase(name)
+	return
+}
@@ -0,0 +1,68 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Rate limiting
+////////////////////////////////////////////////////////////////////////
+
+type RateLimitingTest struct {
+}
+
+func init() { RegisterTestSuite(&RateLimitingTest{}) }
+
+func (t *RateLimitingTest) DefaultMount() {
+	// 5 Hz over 8 hours, allowing 2% error. A default mount must allow a
+	// generous burst, so that listing a modest directory isn't throttled.
+	f := parseArgs(nil)
+	capacity, err := chooseTokenBucketCapacity(f.OpRateLimitHz, f.RateLimitWindow)
+	AssertEq(nil, err)
+	ExpectEq(2880, capacity)
+}
+
+func (t *RateLimitingTest) ShortWindow() {
+	// 5 Hz over 30 seconds, allowing 2% error.
+	capacity, err := chooseTokenBucketCapacity(5, 30*time.Second)
+	AssertEq(nil, err)
+	ExpectEq(3, capacity)
+}
+
+func (t *RateLimitingTest) LowRate() {
+	// Too low for a 30-second window, so a longer one should be used.
+	capacity, err := chooseTokenBucketCapacity(0.1, 30*time.Second)
+	AssertEq(nil, err)
+	ExpectEq(1, capacity)
+}
+
+func (t *RateLimitingTest) RateTooLow() {
+	_, err := chooseTokenBucketCapacity(1e-6, 30*time.Second)
+	ExpectThat(err, Error(HasSubstr("Can't use a token bucket")))
+}
+
+func (t *RateLimitingTest) Disabled() {
+	capacity, err := chooseTokenBucketCapacity(1e15, 30*time.Second)
+	AssertEq(nil, err)
+	ExpectEq(uint64(6e14), capacity)
+}
@@ -0,0 +1,524 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/control"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/monitor"
+	"github.com/googlecloudplatform/gcsfuse/internal/profile"
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+// Read the config file given by the flags. cfg is nil if there is none.
+func readConfig(flags *flagStorage) (cfg *profile.Config, err error) {
+	if flags.ConfigFile == "" {
+		return
+	}
+
+	cfg, err = profile.ReadConfig(flags.ConfigFile)
+	if err != nil {
+		err = fmt.Errorf("ReadConfig: %v", err)
+		return
+	}
+
+	return
+}
+
+// Create a profile manager whose default profile is given by the flags, with
+// the additional profiles from the config, which may be nil.
+func newProfileManager(
+	flags *flagStorage,
+	cfg *profile.Config) (m *profile.Manager, err error) {
+	base := profile.Settings{
+		StatCacheTTL:                       flags.StatCacheTTL,
+		StatCacheCapacity:                  flags.StatCacheCapacity,
+		TypeCacheTTL:                       flags.TypeCacheTTL,
+		OpRateLimitHz:                      flags.OpRateLimitHz,
+		EgressBandwidthLimitBytesPerSecond: flags.EgressBandwidthLimitBytesPerSecond,
+		RateLimitWindow:                    flags.RateLimitWindow,
+	}
+
+	m, err = profile.NewManager(base, cfg)
+	if err != nil {
+		err = fmt.Errorf("NewManager: %v", err)
+		return
+	}
+
+	return
+}
+
+// Start serving administrative commands on the socket at the given path. The
+// content cache may be nil.
+func startControlServer(
+	path string,
+	flags *flagStorage,
+	profiles *profile.Manager,
+	bucket gcs.Bucket,
+	contentCache *gcsx.BlockCache,
+	admin *fs.Admin) (s *control.Server, err error) {
+	s, err = control.Listen(path, log.New(os.Stderr, "control: ", log.Flags()))
+	if err != nil {
+		err = fmt.Errorf("control.Listen: %v", err)
+		return
+	}
+
+	s.Handle("profile", func(args []string) (string, error) {
+		return profileCommand(profiles, args)
+	})
+
+	s.Handle("reload", func(args []string) (string, error) {
+		return reloadCommand(flags, profiles, args)
+	})
+
+	s.Handle("cp", func(args []string) (string, error) {
+		return cpCommand(bucket, args)
+	})
+
+	s.Handle("warm", func(args []string) (string, error) {
+		return warmCommand(bucket, contentCache, args)
+	})
+
+	s.Handle("drop-caches", func(args []string) (string, error) {
+		return dropCachesCommand(profiles, contentCache, args)
+	})
+
+	s.Handle("stats", func(args []string) (string, error) {
+		return statsCommand(profiles, contentCache, admin, args)
+	})
+
+	s.Handle("debug", debugCommand)
+
+	s.Handle("handles", func(args []string) (string, error) {
+		return handlesCommand(admin, args)
+	})
+
+	s.Handle("dirty", func(args []string) (string, error) {
+		return dirtyCommand(admin, args)
+	})
+
+	s.Handle("flush", func(args []string) (string, error) {
+		return flushCommand(admin, args)
+	})
+
+	go s.Serve()
+	return
+}
+
+// The "profile" command. With no arguments, list the profiles, marking the
+// active one. With a profile name, make that profile active.
+func profileCommand(
+	profiles *profile.Manager,
+	args []string) (output string, err error) {
+	switch len(args) {
+	case 0:
+		active := profiles.Active()
+		var lines []string
+		for _, name := range profiles.Names() {
+			if name == active {
+				lines = append(lines, "* "+name)
+			} else {
+				lines = append(lines, "  "+name)
+			}
+		}
+
+		output = strings.Join(lines, "\n")
+
+	case 1:
+		err = profiles.Switch(args[0])
+		if err != nil {
+			return
+		}
+
+		log.Printf("Switched to profile %q.", args[0])
+
+	default:
+		err = errors.New("Usage: profile [name]")
+	}
+
+	return
+}
+
+// Read the config file given by the flags again, replacing the profiles and
+// making active the one it names, and applying its debug logging settings.
+// Other settings can't be changed without remounting. On error, nothing
+// changes.
+func reloadConfig(
+	flags *flagStorage,
+	profiles *profile.Manager) (err error) {
+	cfg, err := readConfig(flags)
+	if err != nil {
+		return
+	}
+
+	if cfg == nil {
+		err = errors.New("There is no config file; see --config-file")
+		return
+	}
+
+	// Check everything before changing anything.
+	err = checkDebugLogging(cfg.Debug)
+	if err != nil {
+		return
+	}
+
+	err = profiles.Reload(cfg)
+	if err != nil {
+		err = fmt.Errorf("Reload: %v", err)
+		return
+	}
+
+	if cfg.Debug != nil {
+		err = setEnabledDebugLogging(cfg.Debug)
+		if err != nil {
+			return
+		}
+	}
+
+	log.Printf(
+		"Reloaded %s; profile %q is active.",
+		flags.ConfigFile,
+		profiles.Active())
+
+	return
+}
+
+// The "reload" command, which does the same as SIGHUP.
+func reloadCommand(
+	flags *flagStorage,
+	profiles *profile.Manager,
+	args []string) (output string, err error) {
+	if len(args) != 0 {
+		err = errors.New("Usage: reload")
+		return
+	}
+
+	err = reloadConfig(flags, profiles)
+	return
+}
+
+// How many objects "cp -r" copies at once.
+const copyParallelism = 32
+
+// The "cp" command. Copy the file src, or with -r the directory src and
+// everything beneath it, to the new name dst. Both are relative to the mount
+// point. The copies are made by GCS, without contents passing through us.
+func cpCommand(
+	bucket gcs.Bucket,
+	args []string) (output string, err error) {
+	recursive := len(args) > 0 && args[0] == "-r"
+	if recursive {
+		args = args[1:]
+	}
+
+	if len(args) != 2 {
+		err = errors.New("Usage: cp [-r] src dst")
+		return
+	}
+
+	src := cleanObjectName(args[0])
+	dst := cleanObjectName(args[1])
+	if src == "" || dst == "" {
+		err = errors.New("Can't copy to or from the root directory")
+		return
+	}
+
+	ctx := context.Background()
+
+	// A single file.
+	if !recursive {
+		_, err = bucket.CopyObject(
+			ctx,
+			&gcs.CopyObjectRequest{
+				SrcName: src,
+				DstName: dst,
+			})
+
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			err = fmt.Errorf("No such file %q", src)
+			return
+		}
+
+		if err != nil {
+			err = fmt.Errorf("CopyObject: %v", err)
+			return
+		}
+
+		return
+	}
+
+	// A directory.
+	n, err := gcsx.CopyTree(ctx, bucket, src+"/", dst+"/", copyParallelism)
+	log.Printf("Copied %d objects from %q to %q.", n, src, dst)
+
+	if err != nil {
+		err = fmt.Errorf("Copied %d objects before failing: %v", n, err)
+		return
+	}
+
+	if n == 0 {
+		err = fmt.Errorf("No such directory %q", src)
+		return
+	}
+
+	output = fmt.Sprintf("Copied %d objects.", n)
+	return
+}
+
+// How many objects "warm" reads at once by default.
+const defaultWarmParallelism = 16
+
+// The "warm" command. Read every file whose path relative to the mount point
+// begins with prefix into the content cache, with up to the given number of
+// files (by default defaultWarmParallelism) being read at once.
+func warmCommand(
+	bucket gcs.Bucket,
+	contentCache *gcsx.BlockCache,
+	args []string) (output string, err error) {
+	const usage = "Usage: warm [-j parallelism] prefix"
+
+	parallelism := defaultWarmParallelism
+	if len(args) > 0 && args[0] == "-j" {
+		if len(args) < 2 {
+			err = errors.New(usage)
+			return
+		}
+
+		parallelism, err = strconv.Atoi(args[1])
+		if err != nil || parallelism < 1 {
+			err = fmt.Errorf("Illegal parallelism %q", args[1])
+			return
+		}
+
+		args = args[2:]
+	}
+
+	if len(args) != 1 {
+		err = errors.New(usage)
+		return
+	}
+
+	if contentCache == nil {
+		err = errors.New("There is no content cache; see --content-cache-mb")
+		return
+	}
+
+	// Keep any trailing slash, which limits the prefix to a directory.
+	prefix := strings.TrimPrefix(args[0], "/")
+
+	n, bytes, err := gcsx.Warm(
+		context.Background(),
+		bucket,
+		contentCache,
+		prefix,
+		parallelism)
+
+	log.Printf("Warmed %d objects under %q, reading %d bytes.", n, prefix, bytes)
+
+	if err != nil {
+		err = fmt.Errorf("Warmed %d objects before failing: %v", n, err)
+		return
+	}
+
+	output = fmt.Sprintf("Warmed %d objects, reading %d bytes.", n, bytes)
+	return
+}
+
+// The "drop-caches" command. Forget everything cached about objects: their
+// records in the stat cache, the types of directories' children, and their
+// contents in the content cache, if any.
+func dropCachesCommand(
+	profiles *profile.Manager,
+	contentCache *gcsx.BlockCache,
+	args []string) (output string, err error) {
+	if len(args) != 0 {
+		err = errors.New("Usage: drop-caches")
+		return
+	}
+
+	// Switching to a profile, even the active one, starts a fresh stat cache
+	// and makes each directory forget the types of its children.
+	err = profiles.Switch(profiles.Active())
+	if err != nil {
+		return
+	}
+
+	if contentCache != nil {
+		contentCache.Clear()
+	}
+
+	log.Printf("Dropped caches.")
+	return
+}
+
+// The "stats" command. Print a line for each of a few figures about the
+// mount, as a name and a value separated by a space.
+func statsCommand(
+	profiles *profile.Manager,
+	contentCache *gcsx.BlockCache,
+	admin *fs.Admin,
+	args []string) (output string, err error) {
+	if len(args) != 0 {
+		err = errors.New("Usage: stats")
+		return
+	}
+
+	handles, err := admin.Handles()
+	if err != nil {
+		return
+	}
+
+	dirty, err := admin.DirtyFiles()
+	if err != nil {
+		return
+	}
+
+	var contentCacheBytes int64
+	if contentCache != nil {
+		contentCacheBytes = contentCache.Size()
+	}
+
+	lines := []string{
+		fmt.Sprintf("profile %s", profiles.Active()),
+		fmt.Sprintf("open_handles %d", len(handles)),
+		fmt.Sprintf("dirty_files %d", len(dirty)),
+		fmt.Sprintf("content_cache_bytes %d", contentCacheBytes),
+		fmt.Sprintf("fs_ops %d", monitor.FSOps.Total()),
+		fmt.Sprintf("fs_op_errors %d", monitor.FSOpErrors.Total()),
+		fmt.Sprintf("gcs_requests %d", monitor.GCSRequests.Total()),
+		fmt.Sprintf("gcs_request_errors %d", monitor.GCSRequestErrors.Total()),
+		fmt.Sprintf("stat_cache_hits %d", monitor.StatCacheHits()),
+	}
+
+	output = strings.Join(lines, "\n")
+	return
+}
+
+// The "debug" command. With no arguments, list the debug loggers that are on.
+// Otherwise turn the named one ("fuse" or "gcs") on or off, as if by
+// --debug_fuse or --debug_gcs.
+func debugCommand(args []string) (output string, err error) {
+	switch len(args) {
+	case 0:
+		output = strings.Join(enabledDebugLogging(), "\n")
+
+	case 2:
+		var on bool
+		switch args[1] {
+		case "on":
+			on = true
+
+		case "off":
+			on = false
+
+		default:
+			err = fmt.Errorf("Expected on or off, not %q", args[1])
+			return
+		}
+
+		err = setDebugLogging(args[0], on)
+		if err != nil {
+			return
+		}
+
+		log.Printf("Turned %s debug logging %s.", args[0], args[1])
+
+	default:
+		err = errors.New("Usage: debug [fuse|gcs on|off]")
+	}
+
+	return
+}
+
+// The "handles" command. List the open handles, one per line, as the handle
+// ID, its kind, and the path it was opened on.
+func handlesCommand(
+	admin *fs.Admin,
+	args []string) (output string, err error) {
+	if len(args) != 0 {
+		err = errors.New("Usage: handles")
+		return
+	}
+
+	handles, err := admin.Handles()
+	if err != nil {
+		return
+	}
+
+	var lines []string
+	for _, h := range handles {
+		lines = append(lines, fmt.Sprintf("%d %s %s", h.ID, h.Kind, h.Path))
+	}
+
+	output = strings.Join(lines, "\n")
+	return
+}
+
+// The "dirty" command. List the files with modifications not yet written to
+// GCS, one per line.
+func dirtyCommand(
+	admin *fs.Admin,
+	args []string) (output string, err error) {
+	if len(args) != 0 {
+		err = errors.New("Usage: dirty")
+		return
+	}
+
+	paths, err := admin.DirtyFiles()
+	if err != nil {
+		return
+	}
+
+	output = strings.Join(paths, "\n")
+	return
+}
+
+// The "flush" command. Write every file with modifications out to GCS.
+func flushCommand(
+	admin *fs.Admin,
+	args []string) (output string, err error) {
+	if len(args) != 0 {
+		err = errors.New("Usage: flush")
+		return
+	}
+
+	n, err := admin.FlushAll(context.Background())
+	log.Printf("Flushed %d files.", n)
+
+	if err != nil {
+		err = fmt.Errorf("Flushed %d files before failing: %v", n, err)
+		return
+	}
+
+	output = fmt.Sprintf("Flushed %d files.", n)
+	return
+}
+
+// Convert a path relative to the mount point into an object name, without any
+// trailing slash. The root directory is the empty string.
+func cleanObjectName(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
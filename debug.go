@@ -0,0 +1,134 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"sort"
+	"sync"
+)
+
+// The loggers for the debug output that --debug_fuse and --debug_gcs turn
+// on, by the name used for them by the control socket's "debug" command and
+// the config file, with which they can be turned on and off while mounted.
+// They are always handed to the fuse and gcs packages, writing to
+// ioutil.Discard while off.
+//
+// --debug_http isn't among them, since dumping requests is costly whether or
+// not anyone reads the result.
+var debugLoggers = map[string]*log.Logger{
+	"fuse": log.New(ioutil.Discard, "fuse_debug: ", log.LstdFlags),
+	"gcs":  log.New(ioutil.Discard, "gcs: ", log.LstdFlags),
+}
+
+var debugLoggingMu sync.Mutex
+
+// The names of the debug loggers that are on.
+//
+// GUARDED_BY(debugLoggingMu)
+var debugLoggingOn = make(map[string]bool)
+
+// Turn the named debug logger on or off.
+func setDebugLogging(name string, on bool) (err error) {
+	l := debugLoggers[name]
+	if l == nil {
+		err = fmt.Errorf("Unknown debug logger %q", name)
+		return
+	}
+
+	debugLoggingMu.Lock()
+	defer debugLoggingMu.Unlock()
+
+	if on {
+		l.SetOutput(os.Stdout)
+	} else {
+		l.SetOutput(ioutil.Discard)
+	}
+
+	debugLoggingOn[name] = on
+	return
+}
+
+// Return an error if any of the names isn't that of a debug logger.
+func checkDebugLogging(names []string) (err error) {
+	for _, name := range names {
+		if debugLoggers[name] == nil {
+			err = fmt.Errorf("Unknown debug logger %q", name)
+			return
+		}
+	}
+
+	return
+}
+
+// Turn on the named debug loggers and turn off the rest. On error, nothing
+// changes.
+func setEnabledDebugLogging(names []string) (err error) {
+	err = checkDebugLogging(names)
+	if err != nil {
+		return
+	}
+
+	on := make(map[string]bool)
+	for _, name := range names {
+		on[name] = true
+	}
+
+	for name := range debugLoggers {
+		setDebugLogging(name, on[name])
+	}
+
+	return
+}
+
+// Return the names of the debug loggers that are on, in sorted order.
+func enabledDebugLogging() (names []string) {
+	debugLoggingMu.Lock()
+	defer debugLoggingMu.Unlock()
+
+	for name, on := range debugLoggingOn {
+		if on {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return
+}
+
+// Serve the profiles registered by package net/http/pprof on the loopback
+// interface at the given port, in the background. Binding to the loopback
+// interface keeps them from other machines, since profiles are costly to take
+// and goroutine stacks may reveal object names.
+func startPprofServer(port int) (err error) {
+	l, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		err = fmt.Errorf("Listen: %v", err)
+		return
+	}
+
+	go func() {
+		err := http.Serve(l, http.DefaultServeMux)
+		log.Printf("Serving profiles: %v", err)
+	}()
+
+	return
+}
@@ -0,0 +1,95 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/profile"
+)
+
+// The contents of the "config" file in the debug directory.
+type debugConfig struct {
+	Version  string           `json:"version"`
+	Bucket   string           `json:"bucket"`
+	Profile  string           `json:"profile"`
+	Settings profile.Settings `json:"settings"`
+	Flags    *flagStorage     `json:"flags"`
+}
+
+// Return the files to serve in the debug directory (see --debug-dir), by name.
+// Those that have a counterpart among the control socket's commands give the
+// same output. The content cache may be nil.
+func debugDirFiles(
+	bucketName string,
+	flags *flagStorage,
+	profiles *profile.Manager,
+	contentCache *gcsx.BlockCache,
+	admin *fs.Admin) (files map[string]func() ([]byte, error)) {
+	// Turn the output of a command into file contents.
+	command := func(f func() (string, error)) func() ([]byte, error) {
+		return func() (contents []byte, err error) {
+			output, err := f()
+			if err != nil {
+				return
+			}
+
+			if output != "" {
+				output += "\n"
+			}
+
+			contents = []byte(output)
+			return
+		}
+	}
+
+	files = map[string]func() ([]byte, error){
+		"stats": command(func() (string, error) {
+			return statsCommand(profiles, contentCache, admin, nil)
+		}),
+
+		"open_handles": command(func() (string, error) {
+			return handlesCommand(admin, nil)
+		}),
+
+		"dirty_files": command(func() (string, error) {
+			return dirtyCommand(admin, nil)
+		}),
+
+		"config": func() (contents []byte, err error) {
+			c := debugConfig{
+				Version:  getVersion(),
+				Bucket:   bucketName,
+				Profile:  profiles.Active(),
+				Settings: profiles.Current(),
+				Flags:    flags,
+			}
+
+			contents, err = json.MarshalIndent(c, "", "  ")
+			if err != nil {
+				err = fmt.Errorf("MarshalIndent: %v", err)
+				return
+			}
+
+			contents = append(contents, '\n')
+			return
+		},
+	}
+
+	return
+}
@@ -99,6 +99,13 @@ func newApp() (app *cli.App) {
 				Usage: "GID owner of all inodes.",
 			},
 
+			cli.BoolFlag{
+				Name: "persist-permissions",
+				Usage: "Record chmod and chown in object metadata, overriding " +
+					"the mode and owner flags for those inodes. See " +
+					"docs/semantics.md.",
+			},
+
 			cli.BoolFlag{
 				Name: "implicit-dirs",
 				Usage: "Implicitly define directories based on content. See " +
@@ -110,6 +117,118 @@ func newApp() (app *cli.App) {
 				Usage: "Mount only the given directory, relative to the bucket root.",
 			},
 
+			cli.StringSliceFlag{
+				Name: "lower-layer",
+				Usage: "A bucket, or a bucket followed by a slash and a directory " +
+					"within it, whose files show through the mounted bucket " +
+					"without ever being changed. May be repeated, the first " +
+					"taking precedence. See docs/semantics.md.",
+			},
+
+			cli.StringFlag{
+				Name: "local-overlay",
+				Usage: "A local directory in which to make every change, leaving " +
+					"the bucket untouched. See docs/semantics.md.",
+			},
+
+			cli.StringSliceFlag{
+				Name: "only-patterns",
+				Usage: "A glob pattern such as '*.parquet' or 'data/**'. If given, " +
+					"only files matching one of the patterns can be seen. May be " +
+					"repeated. See docs/semantics.md.",
+			},
+
+			cli.StringSliceFlag{
+				Name: "ignore-patterns",
+				Usage: "A glob pattern such as 'logs/**'. Files matching any of " +
+					"the patterns can't be seen. May be repeated. " +
+					"See docs/semantics.md.",
+			},
+
+			cli.StringFlag{
+				Name:  "editor-temp-files",
+				Value: "keep",
+				Usage: "What to do with editors' temporary files, such as swap " +
+					"files: keep them in the bucket, deny their creation, or keep " +
+					"them in memory (local). See docs/semantics.md.",
+			},
+
+			cli.StringSliceFlag{
+				Name: "editor-temp-patterns",
+				Usage: "A glob pattern for --editor-temp-files to match, replacing " +
+					"the defaults of '*.swp', '*~', '.#*', and '.DS_Store'. May be " +
+					"repeated.",
+			},
+
+			cli.StringFlag{
+				Name: "conflict-suffix",
+				Usage: "Suffix added to the name of a file that has the same name " +
+					"as a directory, so that both are shown. See " +
+					"docs/semantics.md. (default: a line feed)",
+			},
+
+			cli.StringFlag{
+				Name:  "normalize-names",
+				Value: "off",
+				Usage: "Unicode normalization for listed and created names: nfc, " +
+					"nfd (as macOS expects), or off. Lookups find objects " +
+					"named in either form. See docs/semantics.md.",
+			},
+
+			cli.StringFlag{
+				Name:  "dir-nlink",
+				Value: "unknown",
+				Usage: "Link count to report for directories: unknown (always 1) " +
+					"or count (2 plus the number of subdirectories, listing " +
+					"each directory whose attributes are read). See " +
+					"docs/semantics.md.",
+			},
+
+			cli.BoolFlag{
+				Name: "versions-dir",
+				Usage: "Serve every generation of each object in a versioned " +
+					"bucket as a read-only file in a hidden directory named " +
+					".versions in the root. See docs/semantics.md.",
+			},
+
+			cli.StringFlag{
+				Name:  "snapshot-time",
+				Value: "",
+				Usage: "Mount a read-only view of a versioned bucket as it was " +
+					"at the given RFC 3339 time, e.g. 2016-01-02T15:04:05Z. " +
+					"See docs/semantics.md.",
+			},
+
+			cli.BoolFlag{
+				Name: "trash-dir",
+				Usage: "Serve the soft-deleted objects of the bucket in a hidden " +
+					"directory named .trash in the root, from which renaming " +
+					"them restores them. See docs/semantics.md.",
+			},
+
+			cli.BoolFlag{
+				Name: "link-copies",
+				Usage: "Make link(2) copy the file's object to the new name in " +
+					"GCS, rather than failing. The two names are independent " +
+					"files afterward. See docs/semantics.md.",
+			},
+
+			cli.DurationFlag{
+				Name:  "idle-timeout",
+				Value: 0,
+				Usage: "Unmount and exit once no file system ops have been handled " +
+					"for this long and no files are open, e.g. for use with " +
+					"systemd automount. See docs/mounting.md. (default: never)",
+			},
+
+			cli.DurationFlag{
+				Name:  "shutdown-grace-period",
+				Value: 30 * time.Second,
+				Usage: "On SIGINT or SIGTERM, how long to spend writing out files " +
+					"with modifications and finishing background deletions before " +
+					"unmounting. See docs/mounting.md.",
+			},
+
 			/////////////////////////
 			// GCS
 			/////////////////////////
@@ -128,20 +247,164 @@ func newApp() (app *cli.App) {
 					"(default: none, Google application default credentials used)",
 			},
 
+			cli.StringFlag{
+				Name:  "impersonate-service-account",
+				Value: "",
+				Usage: "Email of a service account to act as, using short-lived " +
+					"tokens minted with the IAM Credentials API from the key file " +
+					"or default credentials. (default: none)",
+			},
+
+			cli.BoolFlag{
+				Name: "anonymous-access",
+				Usage: "Send requests without credentials, for mounting public " +
+					"buckets on machines that have none. Consider also mounting " +
+					"read-only.",
+			},
+
 			cli.Float64Flag{
 				Name:  "limit-bytes-per-sec",
 				Value: -1,
-				Usage: "Bandwidth limit for reading data, measured over a 30-second " +
-					"window. (use -1 for no limit)",
+				Usage: "Bandwidth limit for reading data, measured over " +
+					"--limit-window. (use -1 for no limit)",
 			},
 
 			cli.Float64Flag{
 				Name:  "limit-ops-per-sec",
 				Value: 5.0,
-				Usage: "Operations per second limit, measured over a 30-second window " +
+				Usage: "Operations per second limit, measured over --limit-window " +
 					"(use -1 for no limit)",
 			},
 
+			cli.DurationFlag{
+				Name:  "limit-window",
+				Value: 8 * time.Hour,
+				Usage: "The window over which rate limits are enforced. The burst " +
+					"allowed above the limits grows with it, so a short window " +
+					"such as 30s keeps a runaway process from getting far ahead.",
+			},
+
+			cli.StringFlag{
+				Name:  "endpoint",
+				Value: "",
+				Usage: "Send GCS requests to this URL instead of " +
+					"https://www.googleapis.com, e.g. " +
+					"https://restricted.googleapis.com. (default: the " +
+					"STORAGE_EMULATOR_HOST environment variable if set, for " +
+					"which no credentials are used)",
+			},
+
+			cli.IntFlag{
+				Name:  "http-clients",
+				Value: 1,
+				Usage: "Number of independent HTTP clients, each with its own " +
+					"connection pool, across which to spread GCS requests. Raise " +
+					"this if a single client's connections limit throughput.",
+			},
+
+			cli.IntFlag{
+				Name:  "max-conns-per-host",
+				Value: 0,
+				Usage: "The maximum number of connections each HTTP client may have " +
+					"open to GCS, including those in use. (use 0 for no limit)",
+			},
+
+			cli.IntFlag{
+				Name:  "max-idle-conns-per-host",
+				Value: 100,
+				Usage: "The maximum number of idle connections each HTTP client " +
+					"keeps open to GCS for reuse. Raise this if many parallel " +
+					"reads cause connections to be repeatedly closed and reopened.",
+			},
+
+			cli.DurationFlag{
+				Name:  "http-idle-conn-timeout",
+				Value: 90 * time.Second,
+				Usage: "How long an idle connection to GCS is kept open for reuse.",
+			},
+
+			cli.StringFlag{
+				Name:  "http-protocol",
+				Value: "http2",
+				Usage: "The HTTP version with which to talk to GCS: \"http2\" to " +
+					"multiplex each client's requests over one connection where " +
+					"possible, or \"http1\" to use a connection per concurrent " +
+					"request, avoiding head-of-line blocking between them.",
+			},
+
+			cli.DurationFlag{
+				Name:  "max-retry-sleep",
+				Value: time.Minute,
+				Usage: "The maximum total time to spend sleeping between retries of a " +
+					"GCS request that fails with a 429, 5xx, or network error, " +
+					"using randomized exponential backoff. (use 0 to disable retries)",
+			},
+
+			cli.DurationFlag{
+				Name:  "metadata-timeout",
+				Value: 0,
+				Usage: "How long to wait for a GCS request other than a read or " +
+					"upload, including retries, before failing it. See " +
+					"docs/semantics.md. (default: no timeout)",
+			},
+
+			cli.DurationFlag{
+				Name:  "read-timeout",
+				Value: 0,
+				Usage: "How long a read from GCS may go without returning before it " +
+					"is failed. (default: no timeout)",
+			},
+
+			cli.DurationFlag{
+				Name:  "read-stall-timeout",
+				Value: 0,
+				Usage: "How long a download from GCS may go without receiving any " +
+					"bytes before its connection is dropped and the rest is " +
+					"requested again. (default: stalls not detected)",
+			},
+
+			cli.DurationFlag{
+				Name:  "upload-timeout",
+				Value: 0,
+				Usage: "How long an upload to GCS may go without making progress " +
+					"before it is failed. (default: no timeout)",
+			},
+
+			cli.Float64Flag{
+				Name:  "hedge-reads-percentile",
+				Value: 0,
+				Usage: "Send a second request for a read from GCS that hasn't " +
+					"started returning contents within this percentile of recent " +
+					"reads' latencies, e.g. 95, and use whichever is first. " +
+					"(default: reads not hedged)",
+			},
+
+			cli.IntFlag{
+				Name:  "circuit-breaker-threshold",
+				Value: 0,
+				Usage: "After this many GCS requests in a row fail with server or " +
+					"network errors, fail requests without sending them, apart " +
+					"from periodic probes, until GCS recovers. " +
+					"(default: requests always sent)",
+			},
+
+			cli.StringFlag{
+				Name:  "replica-bucket",
+				Value: "",
+				Usage: "A bucket holding a replica of the mounted bucket's " +
+					"objects, from which to read those that can't be read from " +
+					"the mounted bucket because it is unavailable. " +
+					"(default: none)",
+			},
+
+			cli.StringFlag{
+				Name:  "mirror-bucket",
+				Value: "",
+				Usage: "A bucket to which every change to the mounted bucket " +
+					"is copied in the background, as a backup. " +
+					"(default: none)",
+			},
+
 			/////////////////////////
 			// Tuning
 			/////////////////////////
@@ -152,6 +415,14 @@ func newApp() (app *cli.App) {
 				Usage: "How many entries can the stat cache hold (impacts memory consumption)",
 			},
 
+			cli.IntFlag{
+				Name:  "list-page-size",
+				Value: 0,
+				Usage: "The number of entries to ask GCS for in each page of a " +
+					"directory listing, at most 1000. Smaller pages return sooner. " +
+					"(default: 0, GCS's default of 1000)",
+			},
+
 			cli.DurationFlag{
 				Name:  "stat-cache-ttl",
 				Value: time.Minute,
@@ -165,6 +436,76 @@ func newApp() (app *cli.App) {
 					"inodes.",
 			},
 
+			cli.IntFlag{
+				Name:  "lookup-burst",
+				Value: 0,
+				Usage: "If set, list a directory to fill the type cache once this " +
+					"many names within it that the cache can't answer are looked " +
+					"up in a second, as by shell globbing or find, rather than " +
+					"statting each name. (default: 0, disabled)",
+			},
+
+			cli.DurationFlag{
+				Name:  "kernel-entry-ttl",
+				Value: 0,
+				Usage: "How long to let the kernel cache the results of looking up " +
+					"names, rather than asking gcsfuse again each time. See " +
+					"docs/semantics.md. (default: no caching)",
+			},
+
+			cli.DurationFlag{
+				Name:  "kernel-list-cache-ttl",
+				Value: 0,
+				Usage: "How long to let the kernel cache directory listings, rather " +
+					"than asking gcsfuse again each time a directory is read. See " +
+					"docs/semantics.md. (default: no caching)",
+			},
+
+			cli.DurationFlag{
+				Name: "kernel-attr-ttl",
+				Usage: "How long to let the kernel cache inode attributes. " +
+					"(default: the stat cache TTL of the active profile)",
+			},
+
+			cli.BoolFlag{
+				Name: "disable-writeback-cache",
+				Usage: "Send each write(2) to gcsfuse as it happens, rather than " +
+					"letting the kernel collect written pages and send them in " +
+					"batches. Slower for small writes. See docs/semantics.md.",
+			},
+
+			cli.IntFlag{
+				Name:  "max-read-kb",
+				Value: 128,
+				Usage: "The largest read in kilobytes that the kernel may send to " +
+					"gcsfuse at once, up to 1024. Larger reads make for fewer " +
+					"round trips. Linux 4.20 and later only. See docs/semantics.md.",
+			},
+
+			cli.IntFlag{
+				Name:  "max-write-kb",
+				Value: 128,
+				Usage: "The largest write in kilobytes that the kernel may send to " +
+					"gcsfuse at once, up to 1024. Linux 4.20 and later only. See " +
+					"docs/semantics.md.",
+			},
+
+			cli.BoolFlag{
+				Name: "async-read",
+				Usage: "Let the kernel send several reads of the same file at " +
+					"once, e.g. to read ahead, rather than waiting for each " +
+					"before sending the next.",
+			},
+
+			cli.DurationFlag{
+				Name:  "bucket-size-ttl",
+				Value: 0,
+				Usage: "If set, report the total size of the bucket's objects as " +
+					"used space to df and statfs(2), measuring it by listing the " +
+					"whole bucket at most this often. (default: report no space " +
+					"used)",
+			},
+
 			cli.StringFlag{
 				Name:  "temp-dir",
 				Value: "",
@@ -172,6 +513,283 @@ func newApp() (app *cli.App) {
 					"copies. (default: system default, likely /tmp)",
 			},
 
+			cli.IntFlag{
+				Name:  "max-temp-usage-mb",
+				Value: 0,
+				Usage: "The most space in megabytes that local copies of files may " +
+					"take up in the temporary directory. Writes past it fail with " +
+					"ENOSPC, as do writes that would nearly fill the disk. " +
+					"(default: 0, no limit)",
+			},
+
+			cli.IntFlag{
+				Name:  "memory-staging-kb",
+				Value: 0,
+				Usage: "Keep local copies of files no larger than this many " +
+					"kilobytes in memory rather than in the temporary directory, " +
+					"until they grow larger. Saves disk I/O when writing many " +
+					"small files. (default: 0, always use the temporary directory)",
+			},
+
+			cli.IntFlag{
+				Name:  "max-dirty-mb",
+				Value: 0,
+				Usage: "Hold back writes while files that have been written but " +
+					"not yet flushed to GCS hold more than this many megabytes in " +
+					"total. See docs/semantics.md. (default: 0, no limit)",
+			},
+
+			cli.IntFlag{
+				Name:  "upload-workers",
+				Value: 0,
+				Usage: "Write out files to GCS with this many background workers, " +
+					"taking files being fsync'd or closed ahead of those written " +
+					"back to stay under --max-dirty-mb. (default: 0, write out " +
+					"each file in the call that asks for it)",
+			},
+
+			cli.IntFlag{
+				Name:  "delete-workers",
+				Value: 0,
+				Usage: "Delete objects in the background with this many workers, " +
+					"so that recursive removals run concurrently. See " +
+					"docs/semantics.md. (default: 0, delete each object in the " +
+					"call that asks for it)",
+			},
+
+			cli.IntFlag{
+				Name:  "parallel-uploads",
+				Value: 0,
+				Usage: "Write out large files by uploading this many parts of " +
+					"each concurrently and composing them, at most 32. See " +
+					"docs/semantics.md. (default: 0, upload each file whole)",
+			},
+
+			cli.IntFlag{
+				Name:  "parallel-upload-threshold-mb",
+				Value: 64,
+				Usage: "The smallest file in megabytes that --parallel-uploads " +
+					"applies to.",
+			},
+
+			cli.IntFlag{
+				Name:  "content-cache-mb",
+				Value: 0,
+				Usage: "Keep up to this many megabytes of file contents read " +
+					"from GCS in memory, shared by every open file, so that " +
+					"reading them again doesn't go back to GCS. See " +
+					"docs/semantics.md. (default: 0, don't cache contents)",
+			},
+
+			cli.StringFlag{
+				Name:  "content-cache-dir",
+				Value: "",
+				Usage: "Keep the content cache in files in this directory, " +
+					"which gcsfuse must have to itself, rather than in memory, " +
+					"so that the next mount of the same bucket can reuse it. " +
+					"(default: none, keep it in memory)",
+			},
+
+			cli.BoolFlag{
+				Name: "offline",
+				Usage: "Serve a read-only view of what --content-cache-dir holds " +
+					"from earlier mounts, without contacting GCS at all.",
+			},
+
+			cli.StringFlag{
+				Name:  "config-file",
+				Value: "",
+				Usage: "Absolute path to a JSON file defining named profiles that " +
+					"override the stat cache, type cache, and rate limit flags, " +
+					"and which profile is active. See docs/semantics.md. " +
+					"(default: none)",
+			},
+
+			cli.StringFlag{
+				Name:  "page-cache",
+				Value: "keep",
+				Usage: "How the kernel may cache file contents: \"keep\" to keep " +
+					"them across opens of an unchanged object generation, " +
+					"\"drop\" to discard them each time a file is opened, or " +
+					"\"direct\" to bypass the page cache entirely. See " +
+					"docs/semantics.md.",
+			},
+
+			cli.StringFlag{
+				Name:  "consistency",
+				Value: "ttl",
+				Usage: "How up to date files must be when opened: \"ttl\" to " +
+					"trust the stat cache, or \"close-to-open\" to check each " +
+					"open against GCS and bypass the stat cache, seeing whatever " +
+					"other machines had closed by then. See docs/semantics.md.",
+			},
+
+			cli.StringFlag{
+				Name:  "file-locks",
+				Value: "local",
+				Usage: "How to serve fcntl(2) and flock(2) locks: \"local\" to " +
+					"hold them within this mount, so that they aren't seen by " +
+					"other machines, \"lease\" to also hold a lease object in " +
+					"GCS while a file is write locked, so that write locks " +
+					"exclude those of other mounts doing the same, or " +
+					"\"reject\" to fail them with ENOLCK. See docs/semantics.md.",
+			},
+
+			cli.DurationFlag{
+				Name:  "lock-lease-ttl",
+				Value: 30 * time.Second,
+				Usage: "With --file-locks=lease, how long a lease may go without " +
+					"being renewed before another mount may take it over. " +
+					"Leases are renewed every third of this.",
+			},
+
+			cli.BoolFlag{
+				Name: "stale-errors",
+				Usage: "Fail reads and flushes of a file whose object has been " +
+					"replaced or deleted in GCS since it was looked up with " +
+					"ESTALE, rather than failing reads with EIO and quietly " +
+					"dropping unflushed writes. See docs/semantics.md.",
+			},
+
+			cli.StringFlag{
+				Name:  "write-conflict-policy",
+				Value: "fail",
+				Usage: "What a flush does when the file's object has been " +
+					"replaced in GCS since it was looked up: fail, writing " +
+					"nothing; overwrite, replacing the new generation; or " +
+					"newest-wins, replacing it only if the file was modified " +
+					"more recently. See docs/semantics.md.",
+			},
+
+			cli.StringFlag{
+				Name:  "notification-subscription",
+				Value: "",
+				Usage: "A Cloud Pub/Sub subscription of the form " +
+					"projects/<project>/subscriptions/<name>, to a topic to which " +
+					"the bucket publishes object change notifications. Cached " +
+					"information about changed objects is forgotten as they " +
+					"arrive. See docs/semantics.md. (default: none)",
+			},
+
+			cli.BoolFlag{
+				Name: "sparse-files",
+				Usage: "Record long runs of zeros in files written in full, so that " +
+					"they are neither downloaded nor stored locally when the files " +
+					"are read back. See docs/semantics.md.",
+			},
+
+			cli.BoolFlag{
+				Name: "append-writes",
+				Usage: "Upload writes to the end of an existing file as a separate " +
+					"object and compose it onto the file's object when flushing, " +
+					"without downloading the file's contents first. Suits log " +
+					"files. See docs/semantics.md.",
+			},
+
+			cli.BoolFlag{
+				Name: "sniff-content-types",
+				Usage: "When a new file's name has no known extension, set its " +
+					"object's content type based on its first few bytes.",
+			},
+
+			cli.StringFlag{
+				Name: "storage-class",
+				Usage: "Storage class for new objects, e.g. NEARLINE. The config " +
+					"file may override it for some prefixes. See " +
+					"docs/semantics.md. (default: the bucket's)",
+			},
+
+			cli.StringFlag{
+				Name: "kms-key",
+				Usage: "Cloud KMS key with which to encrypt new objects, of the " +
+					"form projects/p/locations/l/keyRings/r/cryptoKeys/k. " +
+					"(default: the bucket's encryption)",
+			},
+
+			cli.StringFlag{
+				Name: "encryption-key-file",
+				Usage: "Absolute path to a file containing a base64-encoded " +
+					"AES-256 customer-supplied encryption key with which to read " +
+					"and write objects. (default: $GCSFUSE_ENCRYPTION_KEY, if set)",
+			},
+
+			cli.StringFlag{
+				Name:  "gzip-objects",
+				Value: "raw",
+				Usage: "How to present objects stored with gzip content encoding: " +
+					"\"raw\" to serve the compressed bytes as stored, or " +
+					"\"decompress\" to decompress them on read and report their " +
+					"decompressed size. See docs/semantics.md.",
+			},
+
+			/////////////////////////
+			// Monitoring
+			/////////////////////////
+
+			cli.StringFlag{
+				Name:  "otlp-endpoint",
+				Value: "",
+				Usage: "Export traces of file system operations and the GCS requests " +
+					"they cause to the OTLP/HTTP collector at this URL, e.g. " +
+					"http://localhost:4318. (default: tracing disabled)",
+			},
+
+			cli.StringFlag{
+				Name:  "monitoring-project",
+				Value: "",
+				Usage: "Export metrics about file system operations, GCS requests, " +
+					"and caching to Cloud Monitoring in this project. " +
+					"(default: metrics disabled)",
+			},
+
+			cli.StringFlag{
+				Name:  "status-file",
+				Value: "",
+				Usage: "Absolute path to a file to which to periodically write the " +
+					"state of the mount as JSON, for monitoring agents. " +
+					"(default: none)",
+			},
+
+			cli.StringFlag{
+				Name:  "audit-log",
+				Value: "",
+				Usage: "Path to a file to which to append a line of JSON for each " +
+					"create, write, delete, or rename of an object, with the " +
+					"uid and pid that asked for it. See docs/semantics.md. " +
+					"(default: none)",
+			},
+
+			cli.StringFlag{
+				Name:  "audit-log-project",
+				Value: "",
+				Usage: "Write the records described for --audit-log to Cloud " +
+					"Logging in this project, as the log gcsfuse_audit. " +
+					"(default: none)",
+			},
+
+			cli.StringFlag{
+				Name:  "control-socket",
+				Value: "",
+				Usage: "Absolute path at which to create a Unix domain socket " +
+					"accepting administrative commands, such as switching " +
+					"profiles. (default: none)",
+			},
+
+			cli.BoolFlag{
+				Name: "debug-dir",
+				Usage: "Serve read-only files describing the state of the mount, " +
+					"such as stats and open handles, in a hidden directory named " +
+					".gcsfuse in its root. See docs/semantics.md.",
+			},
+
+			cli.DurationFlag{
+				Name:  "slow-op-threshold",
+				Value: 0,
+				Usage: "Log each file system operation and GCS request that takes " +
+					"longer than this, with the files, byte ranges, and retries " +
+					"involved. (default: none logged)",
+			},
+
 			/////////////////////////
 			// Debugging
 			/////////////////////////
@@ -195,6 +813,14 @@ func newApp() (app *cli.App) {
 				Name:  "debug_invariants",
 				Usage: "Panic when internal invariants are violated.",
 			},
+
+			cli.IntFlag{
+				Name:  "debug-pprof-port",
+				Value: 0,
+				Usage: "Serve Go runtime profiles, such as goroutine stacks, heap, " +
+					"and CPU, over HTTP at localhost on this port, under " +
+					"/debug/pprof/. (default: not served)",
+			},
 		},
 	}
 
@@ -212,24 +838,108 @@ type flagStorage struct {
 	Gid          int64
 	ImplicitDirs bool
 	OnlyDir      string
+	LowerLayers  []string
+	LocalOverlay string
+	IdleTimeout  time.Duration
+
+	ShutdownGracePeriod time.Duration
+	PersistPermissions  bool
+	ConflictSuffix      string
+	NormalizeNames      string
+	OnlyPatterns        []string
+	IgnorePatterns      []string
+	EditorTempFiles     string
+	EditorTempPatterns  []string
+	DirNlink            string
+	VersionsDir         bool
+	TrashDir            bool
+	LinkCopies          bool
+	SnapshotTime        string
 
 	// GCS
 	BillingProject                     string
 	KeyFile                            string
+	ImpersonateServiceAccount          string
+	AnonymousAccess                    bool
 	EgressBandwidthLimitBytesPerSecond float64
 	OpRateLimitHz                      float64
+	RateLimitWindow                    time.Duration
+	Endpoint                           string
+	HTTPClients                        int
+	MaxConnsPerHost                    int
+	MaxIdleConnsPerHost                int
+	HTTPIdleConnTimeout                time.Duration
+	HTTPProtocol                       string
+	MaxRetrySleep                      time.Duration
+	MetadataTimeout                    time.Duration
+	ReadTimeout                        time.Duration
+	ReadStallTimeout                   time.Duration
+	UploadTimeout                      time.Duration
+	HedgeReadsPercentile               float64
+	CircuitBreakerThreshold            int
+	ReplicaBucket                      string
+	MirrorBucket                       string
 
 	// Tuning
-	StatCacheCapacity int
-	StatCacheTTL      time.Duration
-	TypeCacheTTL      time.Duration
-	TempDir           string
+	StatCacheCapacity        int
+	ListPageSize             int
+	StatCacheTTL             time.Duration
+	TypeCacheTTL             time.Duration
+	LookupBurst              int
+	KernelEntryTTL           time.Duration
+	KernelListCacheTTL       time.Duration
+	PageCache                string
+	Consistency              string
+	FileLocks                string
+	LockLeaseTTL             time.Duration
+	StaleErrors              bool
+	WriteConflictPolicy      string
+	NotificationSubscription string
+	DisableWritebackCache    bool
+	MaxReadKB                int
+	MaxWriteKB               int
+	AsyncRead                bool
+	BucketSizeTTL            time.Duration
+	TempDir                  string
+	MaxTempUsageMB           int
+	MemoryStagingKB          int
+	MaxDirtyMB               int
+	UploadWorkers            int
+	DeleteWorkers            int
+	ParallelUploads          int
+	ParallelThresholdMB      int
+	ContentCacheMB           int
+	ContentCacheDir          string
+	Offline                  bool
+	ConfigFile               string
+	SparseFiles              bool
+	AppendWrites             bool
+	SniffContentTypes        bool
+	StorageClass             string
+	KMSKey                   string
+	EncryptionKeyFile        string
+	GzipObjects              string
+
+	// Negative if --kernel-attr-ttl wasn't given, in which case the stat cache
+	// TTL applies.
+	KernelAttrTTL time.Duration
+
+	// Monitoring
+	OTLPEndpoint      string
+	MonitoringProject string
+	StatusFile        string
+	AuditLog          string
+	AuditLogProject   string
+	ControlSocket     string
+	SlowOpThreshold   time.Duration
+	DebugDir          bool
 
 	// Debugging
 	DebugFuse       bool
 	DebugGCS        bool
 	DebugHTTP       bool
 	DebugInvariants bool
+	DebugPprofPort  int
 }
 
 // Add the flags accepted by run to the supplied flag set, returning the
@@ -246,24 +956,109 @@ func populateFlags(c *cli.Context) (flags *flagStorage) {
 		Gid:          int64(c.Int("gid")),
 		ImplicitDirs: c.Bool("implicit-dirs"),
 		OnlyDir:      c.String("only-dir"),
+		LowerLayers:  c.StringSlice("lower-layer"),
+		LocalOverlay: c.String("local-overlay"),
+		IdleTimeout:  c.Duration("idle-timeout"),
+
+		ShutdownGracePeriod: c.Duration("shutdown-grace-period"),
+		PersistPermissions:  c.Bool("persist-permissions"),
+		ConflictSuffix:      c.String("conflict-suffix"),
+		NormalizeNames:      c.String("normalize-names"),
+		OnlyPatterns:        c.StringSlice("only-patterns"),
+		IgnorePatterns:      c.StringSlice("ignore-patterns"),
+		EditorTempFiles:     c.String("editor-temp-files"),
+		EditorTempPatterns:  c.StringSlice("editor-temp-patterns"),
+		DirNlink:            c.String("dir-nlink"),
+		VersionsDir:         c.Bool("versions-dir"),
+		TrashDir:            c.Bool("trash-dir"),
+		LinkCopies:          c.Bool("link-copies"),
+		SnapshotTime:        c.String("snapshot-time"),
 
 		// GCS,
 		BillingProject:                     c.String("billing-project"),
 		KeyFile:                            c.String("key-file"),
+		ImpersonateServiceAccount:          c.String("impersonate-service-account"),
+		AnonymousAccess:                    c.Bool("anonymous-access"),
 		EgressBandwidthLimitBytesPerSecond: c.Float64("limit-bytes-per-sec"),
 		OpRateLimitHz:                      c.Float64("limit-ops-per-sec"),
+		RateLimitWindow:                    c.Duration("limit-window"),
+		Endpoint:                           c.String("endpoint"),
+		HTTPClients:                        c.Int("http-clients"),
+		MaxConnsPerHost:                    c.Int("max-conns-per-host"),
+		MaxIdleConnsPerHost:                c.Int("max-idle-conns-per-host"),
+		HTTPIdleConnTimeout:                c.Duration("http-idle-conn-timeout"),
+		HTTPProtocol:                       c.String("http-protocol"),
+		MaxRetrySleep:                      c.Duration("max-retry-sleep"),
+		MetadataTimeout:                    c.Duration("metadata-timeout"),
+		ReadTimeout:                        c.Duration("read-timeout"),
+		ReadStallTimeout:                   c.Duration("read-stall-timeout"),
+		UploadTimeout:                      c.Duration("upload-timeout"),
+		HedgeReadsPercentile:               c.Float64("hedge-reads-percentile"),
+		CircuitBreakerThreshold:            c.Int("circuit-breaker-threshold"),
+		ReplicaBucket:                      c.String("replica-bucket"),
+		MirrorBucket:                       c.String("mirror-bucket"),
 
 		// Tuning,
-		StatCacheCapacity: c.Int("stat-cache-capacity"),
-		StatCacheTTL:      c.Duration("stat-cache-ttl"),
-		TypeCacheTTL:      c.Duration("type-cache-ttl"),
-		TempDir:           c.String("temp-dir"),
+		StatCacheCapacity:        c.Int("stat-cache-capacity"),
+		ListPageSize:             c.Int("list-page-size"),
+		StatCacheTTL:             c.Duration("stat-cache-ttl"),
+		TypeCacheTTL:             c.Duration("type-cache-ttl"),
+		LookupBurst:              c.Int("lookup-burst"),
+		KernelEntryTTL:           c.Duration("kernel-entry-ttl"),
+		KernelListCacheTTL:       c.Duration("kernel-list-cache-ttl"),
+		PageCache:                c.String("page-cache"),
+		Consistency:              c.String("consistency"),
+		FileLocks:                c.String("file-locks"),
+		LockLeaseTTL:             c.Duration("lock-lease-ttl"),
+		StaleErrors:              c.Bool("stale-errors"),
+		WriteConflictPolicy:      c.String("write-conflict-policy"),
+		NotificationSubscription: c.String("notification-subscription"),
+		DisableWritebackCache:    c.Bool("disable-writeback-cache"),
+		MaxReadKB:                c.Int("max-read-kb"),
+		MaxWriteKB:               c.Int("max-write-kb"),
+		AsyncRead:                c.Bool("async-read"),
+		BucketSizeTTL:            c.Duration("bucket-size-ttl"),
+		TempDir:                  c.String("temp-dir"),
+		MaxTempUsageMB:           c.Int("max-temp-usage-mb"),
+		MemoryStagingKB:          c.Int("memory-staging-kb"),
+		MaxDirtyMB:               c.Int("max-dirty-mb"),
+		UploadWorkers:            c.Int("upload-workers"),
+		DeleteWorkers:            c.Int("delete-workers"),
+		ParallelUploads:          c.Int("parallel-uploads"),
+		ParallelThresholdMB:      c.Int("parallel-upload-threshold-mb"),
+		ContentCacheMB:           c.Int("content-cache-mb"),
+		ContentCacheDir:          c.String("content-cache-dir"),
+		Offline:                  c.Bool("offline"),
+		ConfigFile:               c.String("config-file"),
+		SparseFiles:              c.Bool("sparse-files"),
+		AppendWrites:             c.Bool("append-writes"),
+		SniffContentTypes:        c.Bool("sniff-content-types"),
+		StorageClass:             c.String("storage-class"),
+		KMSKey:                   c.String("kms-key"),
+		EncryptionKeyFile:        c.String("encryption-key-file"),
+		GzipObjects:              c.String("gzip-objects"),
+		KernelAttrTTL:            -1,
+
+		// Monitoring,
+		OTLPEndpoint:      c.String("otlp-endpoint"),
+		MonitoringProject: c.String("monitoring-project"),
+		StatusFile:        c.String("status-file"),
+		AuditLog:          c.String("audit-log"),
+		AuditLogProject:   c.String("audit-log-project"),
+		ControlSocket:     c.String("control-socket"),
+		SlowOpThreshold:   c.Duration("slow-op-threshold"),
+		DebugDir:          c.Bool("debug-dir"),
 
 		// Debugging,
 		DebugFuse:       c.Bool("debug_fuse"),
 		DebugGCS:        c.Bool("debug_gcs"),
 		DebugHTTP:       c.Bool("debug_http"),
 		DebugInvariants: c.Bool("debug_invariants"),
+		DebugPprofPort:  c.Int("debug-pprof-port"),
+	}
+
+	if c.IsSet("kernel-attr-ttl") {
+		flags.KernelAttrTTL = c.Duration("kernel-attr-ttl")
 	}
 
 	// Handle the repeated "-o" flag.
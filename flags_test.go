@@ -69,28 +69,121 @@ func (t *FlagsTest) Defaults() {
 	ExpectEq(-1, f.Uid)
 	ExpectEq(-1, f.Gid)
 	ExpectFalse(f.ImplicitDirs)
+	ExpectEq(0, len(f.LowerLayers))
+	ExpectEq("", f.LocalOverlay)
+	ExpectEq(0, len(f.OnlyPatterns))
+	ExpectEq(0, len(f.IgnorePatterns))
+	ExpectEq("keep", f.EditorTempFiles)
+	ExpectEq(0, len(f.EditorTempPatterns))
+	ExpectEq(0, f.IdleTimeout)
+	ExpectEq(30*time.Second, f.ShutdownGracePeriod)
+	ExpectFalse(f.PersistPermissions)
+	ExpectFalse(f.VersionsDir)
+	ExpectFalse(f.TrashDir)
+	ExpectFalse(f.LinkCopies)
 
 	// GCS
 	ExpectEq("", f.KeyFile)
+	ExpectEq("", f.ImpersonateServiceAccount)
+	ExpectFalse(f.AnonymousAccess)
 	ExpectEq(-1, f.EgressBandwidthLimitBytesPerSecond)
 	ExpectEq(5, f.OpRateLimitHz)
+	ExpectEq(8*time.Hour, f.RateLimitWindow)
+	ExpectEq("", f.Endpoint)
+	ExpectEq(1, f.HTTPClients)
+	ExpectEq(0, f.MaxConnsPerHost)
+	ExpectEq(100, f.MaxIdleConnsPerHost)
+	ExpectEq(90*time.Second, f.HTTPIdleConnTimeout)
+	ExpectEq("http2", f.HTTPProtocol)
+	ExpectEq(time.Minute, f.MaxRetrySleep)
+	ExpectEq(0, f.MetadataTimeout)
+	ExpectEq(0, f.ReadTimeout)
+	ExpectEq(0, f.ReadStallTimeout)
+	ExpectEq(0, f.UploadTimeout)
+	ExpectEq(0, f.HedgeReadsPercentile)
+	ExpectEq(0, f.CircuitBreakerThreshold)
+	ExpectEq("", f.ReplicaBucket)
+	ExpectEq("", f.MirrorBucket)
 
 	// Tuning
 	ExpectEq(4096, f.StatCacheCapacity)
+	ExpectEq(0, f.ListPageSize)
 	ExpectEq(time.Minute, f.StatCacheTTL)
 	ExpectEq(time.Minute, f.TypeCacheTTL)
+	ExpectEq(0, f.LookupBurst)
+	ExpectEq(0, f.KernelEntryTTL)
+	ExpectEq(0, f.KernelListCacheTTL)
+	ExpectEq("", f.ConflictSuffix)
+	ExpectEq("off", f.NormalizeNames)
+	ExpectEq("unknown", f.DirNlink)
+	ExpectEq("", f.SnapshotTime)
+	ExpectLt(f.KernelAttrTTL, 0)
+	ExpectEq("keep", f.PageCache)
+	ExpectEq("ttl", f.Consistency)
+	ExpectEq("local", f.FileLocks)
+	ExpectEq(30*time.Second, f.LockLeaseTTL)
+	ExpectFalse(f.DisableWritebackCache)
+	ExpectEq(128, f.MaxReadKB)
+	ExpectEq(128, f.MaxWriteKB)
+	ExpectFalse(f.AsyncRead)
+	ExpectEq(0, f.BucketSizeTTL)
 	ExpectEq("", f.TempDir)
+	ExpectEq(0, f.MaxTempUsageMB)
+	ExpectEq(0, f.MemoryStagingKB)
+	ExpectEq(0, f.MaxDirtyMB)
+	ExpectEq(0, f.UploadWorkers)
+	ExpectEq(0, f.DeleteWorkers)
+	ExpectEq(0, f.ParallelUploads)
+	ExpectEq(64, f.ParallelThresholdMB)
+	ExpectEq(0, f.ContentCacheMB)
+	ExpectEq("", f.ContentCacheDir)
+	ExpectFalse(f.Offline)
+	ExpectEq("", f.ConfigFile)
+	ExpectFalse(f.SparseFiles)
+	ExpectFalse(f.AppendWrites)
+	ExpectFalse(f.SniffContentTypes)
+	ExpectEq("", f.StorageClass)
+	ExpectEq("", f.KMSKey)
+	ExpectEq("", f.EncryptionKeyFile)
+	ExpectFalse(f.StaleErrors)
+	ExpectEq("fail", f.WriteConflictPolicy)
+	ExpectEq("", f.NotificationSubscription)
+	ExpectEq("raw", f.GzipObjects)
+
+	// Monitoring
+	ExpectEq("", f.OTLPEndpoint)
+	ExpectEq("", f.MonitoringProject)
+	ExpectEq("", f.StatusFile)
+	ExpectEq("", f.AuditLog)
+	ExpectEq("", f.AuditLogProject)
+	ExpectEq("", f.ControlSocket)
+	ExpectEq(0, f.SlowOpThreshold)
+	ExpectFalse(f.DebugDir)
 
 	// Debugging
 	ExpectFalse(f.DebugFuse)
 	ExpectFalse(f.DebugGCS)
 	ExpectFalse(f.DebugHTTP)
 	ExpectFalse(f.DebugInvariants)
+	ExpectEq(0, f.DebugPprofPort)
 }
 
 func (t *FlagsTest) Bools() {
 	names := []string{
 		"implicit-dirs",
+		"persist-permissions",
+		"versions-dir",
+		"trash-dir",
+		"link-copies",
+		"sparse-files",
+		"append-writes",
+		"sniff-content-types",
+		"stale-errors",
+		"anonymous-access",
+		"disable-writeback-cache",
+		"async-read",
+		"offline",
+		"debug-dir",
 		"debug_fuse",
 		"debug_gcs",
 		"debug_http",
@@ -108,6 +201,19 @@ func (t *FlagsTest) Bools() {
 
 	f = parseArgs(args)
 	ExpectTrue(f.ImplicitDirs)
+	ExpectTrue(f.PersistPermissions)
+	ExpectTrue(f.VersionsDir)
+	ExpectTrue(f.TrashDir)
+	ExpectTrue(f.LinkCopies)
+	ExpectTrue(f.SparseFiles)
+	ExpectTrue(f.AppendWrites)
+	ExpectTrue(f.SniffContentTypes)
+	ExpectTrue(f.StaleErrors)
+	ExpectTrue(f.AnonymousAccess)
+	ExpectTrue(f.DisableWritebackCache)
+	ExpectTrue(f.AsyncRead)
+	ExpectTrue(f.Offline)
+	ExpectTrue(f.DebugDir)
 	ExpectTrue(f.DebugFuse)
 	ExpectTrue(f.DebugGCS)
 	ExpectTrue(f.DebugHTTP)
@@ -121,6 +227,20 @@ func (t *FlagsTest) Bools() {
 
 	f = parseArgs(args)
 	ExpectFalse(f.ImplicitDirs)
+	ExpectFalse(f.PersistPermissions)
+	ExpectFalse(f.VersionsDir)
+	ExpectFalse(f.TrashDir)
+	ExpectFalse(f.LinkCopies)
+	ExpectFalse(f.SparseFiles)
+	ExpectFalse(f.AppendWrites)
+	ExpectFalse(f.SniffContentTypes)
+	ExpectFalse(f.StaleErrors)
+	ExpectEq("", f.NotificationSubscription)
+	ExpectFalse(f.AnonymousAccess)
+	ExpectFalse(f.DisableWritebackCache)
+	ExpectFalse(f.AsyncRead)
+	ExpectFalse(f.Offline)
+	ExpectFalse(f.DebugDir)
 	ExpectFalse(f.DebugFuse)
 	ExpectFalse(f.DebugGCS)
 	ExpectFalse(f.DebugHTTP)
@@ -134,6 +254,19 @@ func (t *FlagsTest) Bools() {
 
 	f = parseArgs(args)
 	ExpectTrue(f.ImplicitDirs)
+	ExpectTrue(f.PersistPermissions)
+	ExpectTrue(f.VersionsDir)
+	ExpectTrue(f.TrashDir)
+	ExpectTrue(f.LinkCopies)
+	ExpectTrue(f.SparseFiles)
+	ExpectTrue(f.AppendWrites)
+	ExpectTrue(f.SniffContentTypes)
+	ExpectTrue(f.StaleErrors)
+	ExpectTrue(f.AnonymousAccess)
+	ExpectTrue(f.DisableWritebackCache)
+	ExpectTrue(f.AsyncRead)
+	ExpectTrue(f.Offline)
+	ExpectTrue(f.DebugDir)
 	ExpectTrue(f.DebugFuse)
 	ExpectTrue(f.DebugGCS)
 	ExpectTrue(f.DebugHTTP)
@@ -146,7 +279,25 @@ func (t *FlagsTest) DecimalNumbers() {
 		"--gid=19",
 		"--limit-bytes-per-sec=123.4",
 		"--limit-ops-per-sec=56.78",
+		"--hedge-reads-percentile=99.5",
+		"--circuit-breaker-threshold=5",
 		"--stat-cache-capacity=8192",
+		"--list-page-size=250",
+		"--lookup-burst", "8",
+		"--http-clients=4",
+		"--max-conns-per-host=32",
+		"--max-idle-conns-per-host", "16",
+		"--max-read-kb=1024",
+		"--max-write-kb", "512",
+		"--max-temp-usage-mb=2048",
+		"--memory-staging-kb", "64",
+		"--max-dirty-mb=512",
+		"--upload-workers=8",
+		"--delete-workers", "32",
+		"--parallel-uploads=16",
+		"--parallel-upload-threshold-mb", "1024",
+		"--content-cache-mb=256",
+		"--debug-pprof-port=6060",
 	}
 
 	f := parseArgs(args)
@@ -154,7 +305,25 @@ func (t *FlagsTest) DecimalNumbers() {
 	ExpectEq(19, f.Gid)
 	ExpectEq(123.4, f.EgressBandwidthLimitBytesPerSecond)
 	ExpectEq(56.78, f.OpRateLimitHz)
+	ExpectEq(99.5, f.HedgeReadsPercentile)
+	ExpectEq(5, f.CircuitBreakerThreshold)
 	ExpectEq(8192, f.StatCacheCapacity)
+	ExpectEq(250, f.ListPageSize)
+	ExpectEq(8, f.LookupBurst)
+	ExpectEq(4, f.HTTPClients)
+	ExpectEq(32, f.MaxConnsPerHost)
+	ExpectEq(16, f.MaxIdleConnsPerHost)
+	ExpectEq(1024, f.MaxReadKB)
+	ExpectEq(512, f.MaxWriteKB)
+	ExpectEq(2048, f.MaxTempUsageMB)
+	ExpectEq(64, f.MemoryStagingKB)
+	ExpectEq(512, f.MaxDirtyMB)
+	ExpectEq(8, f.UploadWorkers)
+	ExpectEq(32, f.DeleteWorkers)
+	ExpectEq(16, f.ParallelUploads)
+	ExpectEq(1024, f.ParallelThresholdMB)
+	ExpectEq(256, f.ContentCacheMB)
+	ExpectEq(6060, f.DebugPprofPort)
 }
 
 func (t *FlagsTest) OctalNumbers() {
@@ -173,23 +342,119 @@ func (t *FlagsTest) Strings() {
 		"--key-file", "-asdf",
 		"--temp-dir=foobar",
 		"--only-dir=baz",
+		"--conflict-suffix", ".file",
+		"--normalize-names=nfd",
+		"--dir-nlink", "count",
+		"--snapshot-time=2016-01-02T15:04:05Z",
+		"--storage-class=NEARLINE",
+		"--kms-key", "projects/p/locations/l/keyRings/r/cryptoKeys/k",
+		"--encryption-key-file", "/etc/gcsfuse/key",
+		"--otlp-endpoint=http://localhost:4318",
+		"--monitoring-project", "my-project",
+		"--status-file=/var/run/gcsfuse.json",
+		"--audit-log", "/var/log/gcsfuse_audit.log",
+		"--audit-log-project=audit-project",
+		"--config-file=/etc/gcsfuse.json",
+		"--control-socket", "/var/run/gcsfuse.sock",
+		"--endpoint=http://localhost:4443",
+		"--impersonate-service-account=sa@my-project.iam.gserviceaccount.com",
+		"--gzip-objects=decompress",
+		"--http-protocol=http1",
+		"--page-cache", "direct",
+		"--consistency=close-to-open",
+		"--file-locks", "reject",
+		"--write-conflict-policy=newest-wins",
+		"--notification-subscription=projects/p/subscriptions/s",
+		"--content-cache-dir=/var/cache/gcsfuse",
+		"--replica-bucket", "my-bucket-replica",
+		"--mirror-bucket=my-bucket-backup",
+		"--lower-layer=datasets/v1",
+		"--lower-layer", "models",
+		"--local-overlay=/var/lib/gcsfuse/overlay",
+		"--only-patterns=*.parquet",
+		"--only-patterns", "meta/**",
+		"--ignore-patterns=logs/**",
+		"--editor-temp-files=local",
+		"--editor-temp-patterns", "*.tmp",
 	}
 
 	f := parseArgs(args)
 	ExpectEq("-asdf", f.KeyFile)
 	ExpectEq("foobar", f.TempDir)
 	ExpectEq("baz", f.OnlyDir)
+	ExpectEq(".file", f.ConflictSuffix)
+	ExpectEq("nfd", f.NormalizeNames)
+	ExpectEq("count", f.DirNlink)
+	ExpectEq("2016-01-02T15:04:05Z", f.SnapshotTime)
+	ExpectEq("NEARLINE", f.StorageClass)
+	ExpectEq("projects/p/locations/l/keyRings/r/cryptoKeys/k", f.KMSKey)
+	ExpectEq("/etc/gcsfuse/key", f.EncryptionKeyFile)
+	ExpectEq("http://localhost:4318", f.OTLPEndpoint)
+	ExpectEq("my-project", f.MonitoringProject)
+	ExpectEq("/var/run/gcsfuse.json", f.StatusFile)
+	ExpectEq("/var/log/gcsfuse_audit.log", f.AuditLog)
+	ExpectEq("audit-project", f.AuditLogProject)
+	ExpectEq("/etc/gcsfuse.json", f.ConfigFile)
+	ExpectEq("/var/run/gcsfuse.sock", f.ControlSocket)
+	ExpectEq("http://localhost:4443", f.Endpoint)
+	ExpectEq("sa@my-project.iam.gserviceaccount.com", f.ImpersonateServiceAccount)
+	ExpectEq("decompress", f.GzipObjects)
+	ExpectEq("http1", f.HTTPProtocol)
+	ExpectEq("direct", f.PageCache)
+	ExpectEq("close-to-open", f.Consistency)
+	ExpectEq("reject", f.FileLocks)
+	ExpectEq("newest-wins", f.WriteConflictPolicy)
+	ExpectEq("/var/cache/gcsfuse", f.ContentCacheDir)
+	ExpectEq("my-bucket-replica", f.ReplicaBucket)
+	ExpectEq("my-bucket-backup", f.MirrorBucket)
+	ExpectThat(f.LowerLayers, ElementsAre("datasets/v1", "models"))
+	ExpectEq("/var/lib/gcsfuse/overlay", f.LocalOverlay)
+	ExpectThat(f.OnlyPatterns, ElementsAre("*.parquet", "meta/**"))
+	ExpectThat(f.IgnorePatterns, ElementsAre("logs/**"))
+	ExpectEq("local", f.EditorTempFiles)
+	ExpectThat(f.EditorTempPatterns, ElementsAre("*.tmp"))
+	ExpectEq("projects/p/subscriptions/s", f.NotificationSubscription)
 }
 
 func (t *FlagsTest) Durations() {
 	args := []string{
 		"--stat-cache-ttl", "1m17s",
 		"--type-cache-ttl", "19ns",
+		"--max-retry-sleep", "30s",
+		"--idle-timeout", "10m",
+		"--shutdown-grace-period=2m",
+		"--http-idle-conn-timeout=5m",
+		"--metadata-timeout=2m",
+		"--read-timeout", "45s",
+		"--read-stall-timeout=10s",
+		"--upload-timeout=1m30s",
+		"--kernel-entry-ttl=5s",
+		"--kernel-list-cache-ttl", "1m",
+		"--kernel-attr-ttl", "0",
+		"--bucket-size-ttl=1h",
+		"--slow-op-threshold", "500ms",
+		"--lock-lease-ttl=1m",
+		"--limit-window", "30s",
 	}
 
 	f := parseArgs(args)
 	ExpectEq(77*time.Second, f.StatCacheTTL)
 	ExpectEq(19*time.Nanosecond, f.TypeCacheTTL)
+	ExpectEq(30*time.Second, f.MaxRetrySleep)
+	ExpectEq(10*time.Minute, f.IdleTimeout)
+	ExpectEq(2*time.Minute, f.ShutdownGracePeriod)
+	ExpectEq(5*time.Minute, f.HTTPIdleConnTimeout)
+	ExpectEq(2*time.Minute, f.MetadataTimeout)
+	ExpectEq(45*time.Second, f.ReadTimeout)
+	ExpectEq(10*time.Second, f.ReadStallTimeout)
+	ExpectEq(90*time.Second, f.UploadTimeout)
+	ExpectEq(5*time.Second, f.KernelEntryTTL)
+	ExpectEq(time.Minute, f.KernelListCacheTTL)
+	ExpectEq(0, f.KernelAttrTTL)
+	ExpectEq(time.Hour, f.BucketSizeTTL)
+	ExpectEq(500*time.Millisecond, f.SlowOpThreshold)
+	ExpectEq(time.Minute, f.LockLeaseTTL)
+	ExpectEq(30*time.Second, f.RateLimitWindow)
 }
 
 func (t *FlagsTest) Maps() {
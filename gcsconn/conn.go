@@ -0,0 +1,376 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gcsconn creates connections to GCS set up the way gcsfuse sets up its
+// own, for programs that embed gcsfuse or drive it from tests and want to
+// supply explicit credentials rather than rely on ambient gcloud or
+// application default credentials.
+package gcsconn
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/http2"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/httputil"
+)
+
+// Config contains options accepted by NewConn.
+type Config struct {
+	// The source of OAuth 2.0 tokens with which to authorize requests, e.g. from
+	// KeyFileTokenSource or google.DefaultTokenSource. Required unless Anonymous
+	// is set. Tokens need the
+	// scope gcs.Scope_FullControl unless the file system is mounted read-only.
+	TokenSource oauth2.TokenSource
+
+	// If set, requests are sent without credentials, as for public buckets, and
+	// TokenSource is ignored.
+	Anonymous bool
+
+	// The endpoint to which to send requests, such as the result of
+	// ParseEndpoint. If nil, requests go to GCS as usual.
+	Endpoint *url.URL
+
+	// The number of independent HTTP clients across which to stripe requests,
+	// each with its own connection pool. If zero, one is used.
+	HTTPClients int
+
+	// Limits on each HTTP client's connections to GCS, in total and idle, and
+	// how long idle connections are kept. Zero values mean no limit, the
+	// net/http default of two idle connections, and 90 seconds respectively.
+	MaxConnsPerHost     int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+
+	// If set, speak only HTTP/1.1 to GCS, so that parallel requests use
+	// separate connections rather than being multiplexed over one HTTP/2
+	// connection.
+	DisableHTTP2 bool
+
+	// The maximum time to sleep between retries of a failed request. If zero,
+	// requests aren't retried. See gcs.ConnConfig.
+	MaxBackoffSleep time.Duration
+
+	// If non-zero, a response that yields no bytes for this long while being
+	// read has its connection torn down, and a read of an object carries on
+	// from where it stopped with a new request, if retries are enabled. See
+	// gcsx.NewStallDetectingTransport.
+	StallTimeout time.Duration
+
+	// The value to send in User-Agent headers. If empty, a default is used.
+	UserAgent string
+
+	// Loggers for GCS requests and (much more verbose) HTTP requests and
+	// responses. If nil, no logging is performed.
+	GCSDebugLogger  *log.Logger
+	HTTPDebugLogger *log.Logger
+}
+
+// NewConn opens a connection to GCS according to the supplied config.
+func NewConn(cfg *Config) (c gcs.Conn, err error) {
+	// Package gcs insists on a token source, so give it one whose tokens we
+	// remove again below.
+	tokenSrc := cfg.TokenSource
+	if cfg.Anonymous {
+		tokenSrc = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "anonymous"})
+	}
+
+	if tokenSrc == nil {
+		err = fmt.Errorf("A token source is required")
+		return
+	}
+
+	n := cfg.HTTPClients
+	switch {
+	case n < 0:
+		err = fmt.Errorf("Illegal number of HTTP clients: %d", n)
+		return
+
+	case n == 0:
+		n = 1
+	}
+
+	if cfg.MaxConnsPerHost < 0 || cfg.MaxIdleConnsPerHost < 0 ||
+		cfg.IdleConnTimeout < 0 {
+		err = fmt.Errorf("Connection limits and timeouts may not be negative")
+		return
+	}
+
+	// Create a connection for each HTTP client, sharing the token source, and
+	// stripe requests across them.
+	var conns []gcs.Conn
+	for i := 0; i < n; i++ {
+		var transport httputil.CancellableRoundTripper
+		transport, err = newRoundTripper(cfg)
+		if err != nil {
+			return
+		}
+
+		var conn gcs.Conn
+		conn, err = gcs.NewConn(&gcs.ConnConfig{
+			TokenSource:     tokenSrc,
+			UserAgent:       cfg.UserAgent,
+			Transport:       transport,
+			MaxBackoffSleep: cfg.MaxBackoffSleep,
+			GCSDebugLogger:  cfg.GCSDebugLogger,
+		})
+
+		if err != nil {
+			err = fmt.Errorf("NewConn: %v", err)
+			return
+		}
+
+		conns = append(conns, conn)
+	}
+
+	if len(conns) == 1 {
+		c = conns[0]
+		return
+	}
+
+	c, err = gcsx.NewStripedConn(conns)
+	return
+}
+
+// NewHTTPClient creates a client for making GCS JSON API requests that package
+// gcs doesn't, such as those about folders, set up like the connections from
+// NewConn. Requests must be addressed to www.googleapis.com for cfg.Endpoint
+// to apply to them.
+func NewHTTPClient(cfg *Config) (c *http.Client, err error) {
+	if cfg.TokenSource == nil && !cfg.Anonymous {
+		err = fmt.Errorf("A token source is required")
+		return
+	}
+
+	var transport http.RoundTripper
+	transport, err = newRoundTripper(cfg)
+	if err != nil {
+		return
+	}
+
+	if !cfg.Anonymous {
+		transport = &oauth2.Transport{
+			Source: cfg.TokenSource,
+			Base:   transport,
+		}
+	}
+
+	c = &http.Client{Transport: transport}
+	return
+}
+
+// Create the transport for a single HTTP client, without authorization.
+func newRoundTripper(
+	cfg *Config) (t httputil.CancellableRoundTripper, err error) {
+	t, err = newTransport(cfg)
+	if err != nil {
+		return
+	}
+
+	if cfg.StallTimeout > 0 {
+		t = gcsx.NewStallDetectingTransport(t, cfg.StallTimeout)
+	}
+
+	if cfg.Endpoint != nil {
+		t = gcsx.NewEndpointTransport(cfg.Endpoint, t)
+	}
+
+	// Download objects with a Content-Encoding as stored, so that their
+	// contents match their sizes and checksums. The file system decompresses
+	// them itself if asked to.
+	t = gcsx.NewRawEncodingTransport(t)
+
+	// Do HTTP debugging ourselves, since package gcs would otherwise replace
+	// our transport with the default one.
+	if cfg.HTTPDebugLogger != nil {
+		t = httputil.DebuggingRoundTripper(t, cfg.HTTPDebugLogger)
+	}
+
+	if cfg.Anonymous {
+		t = &anonymousTransport{wrapped: t}
+	}
+
+	return
+}
+
+// ParseEndpoint parses a GCS endpoint for Config.Endpoint, such as
+// "https://restricted.googleapis.com" or "localhost:4443". If no scheme is
+// given, defaultScheme is used.
+func ParseEndpoint(s string, defaultScheme string) (u *url.URL, err error) {
+	u, err = gcsx.ParseEndpoint(s, defaultScheme)
+	return
+}
+
+// KeyFileTokenSource returns a token source for the given scope using the
+// service account JSON key file at the supplied path, as downloaded from the
+// Google Developers Console.
+func KeyFileTokenSource(
+	path string,
+	scope string) (ts oauth2.TokenSource, err error) {
+	// Read the file.
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("ReadFile(%q): %v", path, err)
+		return
+	}
+
+	// Create a config struct based on its contents.
+	jwtConfig, err := google.JWTConfigFromJSON(contents, scope)
+	if err != nil {
+		err = fmt.Errorf("JWTConfigFromJSON: %v", err)
+		return
+	}
+
+	// Create the token source.
+	ts = jwtConfig.TokenSource(context.Background())
+
+	return
+}
+
+// A transport that removes the Authorization header from requests.
+type anonymousTransport struct {
+	wrapped httputil.CancellableRoundTripper
+
+	mu sync.Mutex
+
+	// The modified request for each request in flight, so that we can cancel
+	// the right one.
+	//
+	// GUARDED_BY(mu)
+	modified map[*http.Request]*http.Request
+}
+
+func (t *anonymousTransport) RoundTrip(
+	req *http.Request) (resp *http.Response, err error) {
+	// Don't modify the caller's request, per the RoundTripper contract.
+	modified := new(http.Request)
+	*modified = *req
+	modified.Header = make(http.Header)
+	for k, v := range req.Header {
+		modified.Header[k] = v
+	}
+
+	modified.Header.Del("Authorization")
+
+	t.mu.Lock()
+	if t.modified == nil {
+		t.modified = make(map[*http.Request]*http.Request)
+	}
+
+	t.modified[req] = modified
+	t.mu.Unlock()
+
+	resp, err = t.wrapped.RoundTrip(modified)
+	if err != nil {
+		t.forget(req)
+		return
+	}
+
+	resp.Body = &forgettingReadCloser{
+		ReadCloser: resp.Body,
+		forget:     func() { t.forget(req) },
+	}
+
+	return
+}
+
+func (t *anonymousTransport) CancelRequest(req *http.Request) {
+	t.mu.Lock()
+	modified := t.modified[req]
+	t.mu.Unlock()
+
+	if modified == nil {
+		modified = req
+	}
+
+	t.wrapped.CancelRequest(modified)
+}
+
+func (t *anonymousTransport) forget(req *http.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.modified, req)
+}
+
+// A response body that calls a function when it is closed.
+type forgettingReadCloser struct {
+	io.ReadCloser
+	forget func()
+}
+
+func (rc *forgettingReadCloser) Close() (err error) {
+	err = rc.ReadCloser.Close()
+	rc.forget()
+	return
+}
+
+// Create an HTTP transport with its own connection pool, with the same
+// settings as http.DefaultTransport except as tuned by the supplied config.
+func newTransport(cfg *Config) (t *http.Transport, err error) {
+	t = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if cfg.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+
+	if cfg.MaxConnsPerHost > 0 {
+		t.DialContext = newLimitedDialer(t.DialContext, cfg.MaxConnsPerHost)
+	}
+
+	// Don't let a pool allow fewer idle connections in total than per host.
+	if t.MaxIdleConns < t.MaxIdleConnsPerHost {
+		t.MaxIdleConns = t.MaxIdleConnsPerHost
+	}
+
+	// The transport only upgrades to HTTP/2 by itself when it has the default
+	// dialer, so configure it explicitly. A non-nil empty map stops it
+	// upgrading at all.
+	if cfg.DisableHTTP2 {
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	} else {
+		err = http2.ConfigureTransport(t)
+		if err != nil {
+			err = fmt.Errorf("ConfigureTransport: %v", err)
+			return
+		}
+	}
+
+	return
+}
@@ -0,0 +1,318 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsconn_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsconn"
+	"github.com/jacobsa/gcloud/gcs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestConn(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ConnTest struct {
+	ctx    context.Context
+	server *httptest.Server
+
+	mu sync.Mutex
+
+	// The Authorization headers seen by the server.
+	//
+	// GUARDED_BY(mu)
+	authorization []string
+
+	// The query parameters of the requests seen by the server.
+	//
+	// GUARDED_BY(mu)
+	queries []url.Values
+
+	// If set, serves requests for object contents in place of the listing.
+	media func(w http.ResponseWriter, r *http.Request)
+}
+
+var _ SetUpInterface = &ConnTest{}
+var _ TearDownInterface = &ConnTest{}
+
+func init() { RegisterTestSuite(&ConnTest{}) }
+
+func (t *ConnTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+
+	// Serve an empty bucket listing for every request.
+	t.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			t.mu.Lock()
+			t.authorization = append(t.authorization, r.Header.Get("Authorization"))
+			t.queries = append(t.queries, r.URL.Query())
+			t.mu.Unlock()
+
+			if t.media != nil && r.URL.Query().Get("alt") == "media" {
+				t.media(w, r)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"kind": "storage#objects"}`))
+		}))
+}
+
+func (t *ConnTest) TearDown() {
+	t.server.Close()
+}
+
+func (t *ConnTest) newConn(cfg *gcsconn.Config) (c gcs.Conn, err error) {
+	cfg.Endpoint, err = gcsconn.ParseEndpoint(t.server.URL, "http")
+	AssertEq(nil, err)
+
+	c, err = gcsconn.NewConn(cfg)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ConnTest) NoTokenSource() {
+	_, err := t.newConn(&gcsconn.Config{})
+	ExpectThat(err, Error(HasSubstr("token source")))
+}
+
+func (t *ConnTest) NegativeHTTPClients() {
+	_, err := t.newConn(&gcsconn.Config{
+		TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "taco"}),
+		HTTPClients: -1,
+	})
+
+	ExpectThat(err, Error(HasSubstr("HTTP clients")))
+}
+
+func (t *ConnTest) NegativeConnectionLimit() {
+	_, err := t.newConn(&gcsconn.Config{
+		TokenSource:     oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "taco"}),
+		MaxConnsPerHost: -1,
+	})
+
+	ExpectThat(err, Error(HasSubstr("negative")))
+}
+
+func (t *ConnTest) UsesTokenSource() {
+	conn, err := t.newConn(&gcsconn.Config{
+		TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "taco"}),
+	})
+
+	AssertEq(nil, err)
+
+	// Opening the bucket makes a request.
+	_, err = conn.OpenBucket(t.ctx, &gcs.OpenBucketOptions{Name: "some_bucket"})
+	AssertEq(nil, err)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ExpectThat(t.authorization, ElementsAre("Bearer taco"))
+}
+
+func (t *ConnTest) Anonymous() {
+	conn, err := t.newConn(&gcsconn.Config{
+		TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "taco"}),
+		Anonymous:   true,
+	})
+
+	AssertEq(nil, err)
+
+	_, err = conn.OpenBucket(t.ctx, &gcs.OpenBucketOptions{Name: "some_bucket"})
+	AssertEq(nil, err)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ExpectThat(t.authorization, ElementsAre(""))
+}
+
+func (t *ConnTest) ObjectFields() {
+	conn, err := t.newConn(&gcsconn.Config{
+		TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "taco"}),
+	})
+
+	AssertEq(nil, err)
+
+	// Opening the bucket makes a listing.
+	_, err = conn.OpenBucket(
+		t.ctx,
+		&gcs.OpenBucketOptions{
+			Name:         "some_bucket",
+			ObjectFields: []string{"name", "size"},
+		})
+
+	AssertEq(nil, err)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	AssertEq(1, len(t.queries))
+	ExpectEq("noAcl", t.queries[0].Get("projection"))
+	ExpectEq("items(name,size),prefixes,nextPageToken", t.queries[0].Get("fields"))
+}
+
+func (t *ConnTest) AllObjectFieldsByDefault() {
+	conn, err := t.newConn(&gcsconn.Config{
+		TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "taco"}),
+	})
+
+	AssertEq(nil, err)
+
+	_, err = conn.OpenBucket(t.ctx, &gcs.OpenBucketOptions{Name: "some_bucket"})
+	AssertEq(nil, err)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	AssertEq(1, len(t.queries))
+	ExpectEq("full", t.queries[0].Get("projection"))
+	ExpectEq("", t.queries[0].Get("fields"))
+}
+
+func (t *ConnTest) MultipleHTTPClients() {
+	conn, err := t.newConn(&gcsconn.Config{
+		TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "taco"}),
+		HTTPClients: 3,
+	})
+
+	AssertEq(nil, err)
+
+	// Each client's bucket makes a request when opened.
+	_, err = conn.OpenBucket(t.ctx, &gcs.OpenBucketOptions{Name: "some_bucket"})
+	AssertEq(nil, err)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ExpectThat(t.authorization, ElementsAre("Bearer taco", "Bearer taco", "Bearer taco"))
+}
+
+func (t *ConnTest) ResumesStalledRead() {
+	// Send half of the contents, then stall until the client gives up. Serve
+	// the rest when asked for it.
+	var ranges []string
+	t.media = func(w http.ResponseWriter, r *http.Request) {
+		t.mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		first := len(ranges) == 1
+		t.mu.Unlock()
+
+		w.WriteHeader(http.StatusPartialContent)
+		if !first {
+			w.Write([]byte("co"))
+			return
+		}
+
+		w.Write([]byte("ta"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}
+
+	conn, err := t.newConn(&gcsconn.Config{
+		TokenSource:     oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "taco"}),
+		MaxBackoffSleep: time.Second,
+		StallTimeout:    50 * time.Millisecond,
+	})
+
+	AssertEq(nil, err)
+
+	b, err := conn.OpenBucket(t.ctx, &gcs.OpenBucketOptions{Name: "some_bucket"})
+	AssertEq(nil, err)
+
+	rc, err := b.NewReader(
+		t.ctx,
+		&gcs.ReadObjectRequest{
+			Name:       "foo",
+			Generation: 17,
+			Range:      &gcs.ByteRange{Start: 0, Limit: 4},
+		})
+
+	AssertEq(nil, err)
+	defer rc.Close()
+
+	contents, err := ioutil.ReadAll(rc)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ExpectThat(ranges, ElementsAre("bytes=0-4", "bytes=2-4"))
+}
+
+func (t *ConnTest) KeyFileTokenSource_MissingFile() {
+	dir, err := ioutil.TempDir("", "gcsconn_test")
+	AssertEq(nil, err)
+	defer os.RemoveAll(dir)
+
+	_, err = gcsconn.KeyFileTokenSource(path.Join(dir, "foo"), gcs.Scope_FullControl)
+	ExpectThat(err, Error(HasSubstr("ReadFile")))
+}
+
+func (t *ConnTest) KeyFileTokenSource_BadContents() {
+	f, err := ioutil.TempFile("", "gcsconn_test")
+	AssertEq(nil, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.Write([]byte("taco"))
+	AssertEq(nil, err)
+	AssertEq(nil, f.Close())
+
+	_, err = gcsconn.KeyFileTokenSource(f.Name(), gcs.Scope_FullControl)
+	ExpectThat(err, Error(HasSubstr("JWTConfigFromJSON")))
+}
+
+func (t *ConnTest) HTTPClientUsesTokenSource() {
+	endpoint, err := gcsconn.ParseEndpoint(t.server.URL, "http")
+	AssertEq(nil, err)
+
+	client, err := gcsconn.NewHTTPClient(&gcsconn.Config{
+		TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "taco"}),
+		Endpoint:    endpoint,
+	})
+
+	AssertEq(nil, err)
+
+	// Requests addressed to GCS go to the endpoint instead.
+	resp, err := client.Get("https://www.googleapis.com/storage/v1/b/some_bucket")
+	AssertEq(nil, err)
+	resp.Body.Close()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ExpectThat(t.authorization, ElementsAre("Bearer taco"))
+}
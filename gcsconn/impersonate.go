@@ -0,0 +1,141 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsconn
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// ImpersonationScope is the scope that the base credentials given to
+// ImpersonatedTokenSource need.
+const ImpersonationScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// The IAM Credentials API endpoint, and how long minted tokens last.
+const (
+	iamCredentialsEndpoint = "https://iamcredentials.googleapis.com"
+	impersonatedLifetime   = time.Hour
+)
+
+// ImpersonatedTokenSource returns a token source for short-lived access tokens
+// for the given service account and scopes, minted with the IAM Credentials
+// API using tokens from base. The identity behind base needs the Service
+// Account Token Creator role on the service account, and base needs
+// ImpersonationScope. Tokens are reused until shortly before they expire.
+func ImpersonatedTokenSource(
+	base oauth2.TokenSource,
+	serviceAccount string,
+	scopes []string) oauth2.TokenSource {
+	return newImpersonatedTokenSource(
+		iamCredentialsEndpoint,
+		base,
+		serviceAccount,
+		scopes)
+}
+
+func newImpersonatedTokenSource(
+	endpoint string,
+	base oauth2.TokenSource,
+	serviceAccount string,
+	scopes []string) oauth2.TokenSource {
+	ts := &impersonatedTokenSource{
+		client: oauth2.NewClient(context.Background(), base),
+		url: fmt.Sprintf(
+			"%s/v1/projects/-/serviceAccounts/%s:generateAccessToken",
+			endpoint,
+			url.QueryEscape(serviceAccount)),
+		scopes: scopes,
+	}
+
+	return oauth2.ReuseTokenSource(nil, ts)
+}
+
+type impersonatedTokenSource struct {
+	client *http.Client
+	url    string
+	scopes []string
+}
+
+func (ts *impersonatedTokenSource) Token() (t *oauth2.Token, err error) {
+	// Ask for a token.
+	body, err := json.Marshal(&generateAccessTokenRequest{
+		Scope:    ts.scopes,
+		Lifetime: fmt.Sprintf("%ds", int64(impersonatedLifetime/time.Second)),
+	})
+
+	if err != nil {
+		err = fmt.Errorf("Marshal: %v", err)
+		return
+	}
+
+	resp, err := ts.client.Post(ts.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		err = fmt.Errorf("Post: %v", err)
+		return
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		err = fmt.Errorf(
+			"generateAccessToken: %s: %s",
+			resp.Status,
+			strings.TrimSpace(string(msg)))
+
+		return
+	}
+
+	// Parse the response.
+	var r generateAccessTokenResponse
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		err = fmt.Errorf("Decode: %v", err)
+		return
+	}
+
+	if r.AccessToken == "" {
+		err = fmt.Errorf("generateAccessToken: No access token in response")
+		return
+	}
+
+	t = &oauth2.Token{
+		AccessToken: r.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      r.ExpireTime,
+	}
+
+	return
+}
+
+type generateAccessTokenRequest struct {
+	Scope    []string `json:"scope"`
+	Lifetime string   `json:"lifetime"`
+}
+
+type generateAccessTokenResponse struct {
+	AccessToken string    `json:"accessToken"`
+	ExpireTime  time.Time `json:"expireTime"`
+}
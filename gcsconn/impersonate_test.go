@@ -0,0 +1,161 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsconn
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestImpersonate(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const serviceAccount = "target@some-project.iam.gserviceaccount.com"
+
+type ImpersonateTest struct {
+	server *httptest.Server
+	ts     oauth2.TokenSource
+
+	mu sync.Mutex
+
+	// The requests seen by the server.
+	//
+	// GUARDED_BY(mu)
+	paths          []string
+	authorizations []string
+	requests       []generateAccessTokenRequest
+
+	// How to respond.
+	//
+	// GUARDED_BY(mu)
+	status int
+	expiry time.Time
+}
+
+var _ SetUpInterface = &ImpersonateTest{}
+var _ TearDownInterface = &ImpersonateTest{}
+
+func init() { RegisterTestSuite(&ImpersonateTest{}) }
+
+func (t *ImpersonateTest) SetUp(ti *TestInfo) {
+	t.status = http.StatusOK
+	t.expiry = time.Now().Add(time.Hour).UTC()
+
+	t.server = httptest.NewServer(http.HandlerFunc(t.serveHTTP))
+	t.ts = newImpersonatedTokenSource(
+		t.server.URL,
+		oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "base"}),
+		serviceAccount,
+		[]string{"some-scope"})
+}
+
+func (t *ImpersonateTest) TearDown() {
+	t.server.Close()
+}
+
+func (t *ImpersonateTest) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var req generateAccessTokenRequest
+	json.NewDecoder(r.Body).Decode(&req)
+
+	t.paths = append(t.paths, r.URL.Path)
+	t.authorizations = append(t.authorizations, r.Header.Get("Authorization"))
+	t.requests = append(t.requests, req)
+
+	if t.status != http.StatusOK {
+		w.WriteHeader(t.status)
+		fmt.Fprintln(w, "no permission")
+		return
+	}
+
+	json.NewEncoder(w).Encode(&generateAccessTokenResponse{
+		AccessToken: fmt.Sprintf("minted-%d", len(t.paths)),
+		ExpireTime:  t.expiry,
+	})
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ImpersonateTest) MintsToken() {
+	token, err := t.ts.Token()
+	AssertEq(nil, err)
+
+	ExpectEq("minted-1", token.AccessToken)
+	ExpectEq("Bearer", token.TokenType)
+	ExpectTrue(token.Expiry.Equal(t.expiry), "%v", token.Expiry)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ExpectThat(
+		t.paths,
+		ElementsAre(
+			"/v1/projects/-/serviceAccounts/"+serviceAccount+":generateAccessToken"))
+
+	ExpectThat(t.authorizations, ElementsAre("Bearer base"))
+	AssertEq(1, len(t.requests))
+	ExpectThat(t.requests[0].Scope, ElementsAre("some-scope"))
+	ExpectEq("3600s", t.requests[0].Lifetime)
+}
+
+func (t *ImpersonateTest) ReusesToken() {
+	for i := 0; i < 3; i++ {
+		token, err := t.ts.Token()
+		AssertEq(nil, err)
+		ExpectEq("minted-1", token.AccessToken)
+	}
+}
+
+func (t *ImpersonateTest) RefreshesExpiredToken() {
+	// Hand out a token that has already expired.
+	t.mu.Lock()
+	t.expiry = time.Now().Add(-time.Minute)
+	t.mu.Unlock()
+
+	token, err := t.ts.Token()
+	AssertEq(nil, err)
+	ExpectEq("minted-1", token.AccessToken)
+
+	token, err = t.ts.Token()
+	AssertEq(nil, err)
+	ExpectEq("minted-2", token.AccessToken)
+}
+
+func (t *ImpersonateTest) PermissionDenied() {
+	t.mu.Lock()
+	t.status = http.StatusForbidden
+	t.mu.Unlock()
+
+	_, err := t.ts.Token()
+	ExpectThat(err, Error(HasSubstr("403")))
+	ExpectThat(err, Error(HasSubstr("no permission")))
+}
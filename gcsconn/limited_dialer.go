@@ -0,0 +1,124 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsconn
+
+import (
+	"net"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// A dial function, as used by http.Transport.
+type dialFunc func(
+	ctx context.Context,
+	network string,
+	addr string) (net.Conn, error)
+
+// Wrap the supplied dial function so that at most limit connections to each
+// address are open at once, including idle ones. Dialing another waits until
+// one is closed, or until the context is done. This is what
+// http.Transport.MaxConnsPerHost does in newer versions of Go.
+//
+// REQUIRES: limit > 0
+func newLimitedDialer(dial dialFunc, limit int) dialFunc {
+	d := &limitedDialer{
+		dial:  dial,
+		limit: limit,
+		open:  make(map[string]chan struct{}),
+	}
+
+	return d.DialContext
+}
+
+type limitedDialer struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	dial dialFunc
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	limit int
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// A semaphore for each address dialed, holding a value for each connection
+	// to it that is open.
+	//
+	// GUARDED_BY(mu)
+	open map[string]chan struct{}
+}
+
+func (d *limitedDialer) semaphore(addr string) (sem chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sem = d.open[addr]
+	if sem == nil {
+		sem = make(chan struct{}, d.limit)
+		d.open[addr] = sem
+	}
+
+	return
+}
+
+func (d *limitedDialer) DialContext(
+	ctx context.Context,
+	network string,
+	addr string) (c net.Conn, err error) {
+	sem := d.semaphore(addr)
+
+	// Wait for a connection to be free.
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	}
+
+	c, err = d.dial(ctx, network, addr)
+	if err != nil {
+		<-sem
+		return
+	}
+
+	c = &limitedConn{
+		Conn: c,
+		sem:  sem,
+	}
+
+	return
+}
+
+// A connection that frees its place in a semaphore when it is first closed.
+type limitedConn struct {
+	net.Conn
+	sem  chan struct{}
+	once sync.Once
+}
+
+func (c *limitedConn) Close() (err error) {
+	err = c.Conn.Close()
+	c.once.Do(func() { <-c.sem })
+	return
+}
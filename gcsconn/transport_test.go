@@ -0,0 +1,145 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsconn
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestTransport(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type TransportTest struct {
+}
+
+func init() { RegisterTestSuite(&TransportTest{}) }
+
+// A dial function that connects to nothing, recording how often it's called.
+type fakeDialer struct {
+	dials int
+}
+
+func (d *fakeDialer) DialContext(
+	ctx context.Context,
+	network string,
+	addr string) (c net.Conn, err error) {
+	d.dials++
+	c, _ = net.Pipe()
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *TransportTest) Defaults() {
+	transport, err := newTransport(&Config{})
+	AssertEq(nil, err)
+
+	ExpectEq(0, transport.MaxIdleConnsPerHost)
+	ExpectEq(100, transport.MaxIdleConns)
+	ExpectEq(90*time.Second, transport.IdleConnTimeout)
+	ExpectNe(nil, transport.TLSNextProto["h2"])
+}
+
+func (t *TransportTest) Tuned() {
+	transport, err := newTransport(&Config{
+		MaxConnsPerHost:     64,
+		MaxIdleConnsPerHost: 200,
+		IdleConnTimeout:     time.Minute,
+	})
+	AssertEq(nil, err)
+
+	ExpectEq(200, transport.MaxIdleConnsPerHost)
+	ExpectEq(200, transport.MaxIdleConns)
+	ExpectEq(time.Minute, transport.IdleConnTimeout)
+}
+
+func (t *TransportTest) DisableHTTP2() {
+	transport, err := newTransport(&Config{DisableHTTP2: true})
+	AssertEq(nil, err)
+
+	ExpectNe(nil, transport.TLSNextProto)
+	ExpectEq(0, len(transport.TLSNextProto))
+}
+
+func (t *TransportTest) LimitedDialer_LimitsEachAddress() {
+	var fake fakeDialer
+	dial := newLimitedDialer(fake.DialContext, 1)
+	ctx := context.Background()
+
+	// Use up the only connection to one address.
+	c0, err := dial(ctx, "tcp", "a:443")
+	AssertEq(nil, err)
+
+	// Another address is unaffected.
+	c1, err := dial(ctx, "tcp", "b:443")
+	AssertEq(nil, err)
+	defer c1.Close()
+
+	// Dialing the first again waits until the connection is closed.
+	dialed := make(chan net.Conn)
+	go func() {
+		c, _ := dial(ctx, "tcp", "a:443")
+		dialed <- c
+	}()
+
+	select {
+	case <-dialed:
+		AddFailure("Dial didn't wait")
+		AbortTest()
+
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ExpectEq(2, fake.dials)
+
+	// Closing twice frees only one place.
+	AssertEq(nil, c0.Close())
+	c0.Close()
+
+	c2 := <-dialed
+	AssertNe(nil, c2)
+	defer c2.Close()
+
+	ExpectEq(3, fake.dials)
+}
+
+func (t *TransportTest) LimitedDialer_Cancelled() {
+	var fake fakeDialer
+	dial := newLimitedDialer(fake.DialContext, 1)
+
+	c, err := dial(context.Background(), "tcp", "a:443")
+	AssertEq(nil, err)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+
+	_, err = dial(ctx, "tcp", "a:443")
+	ExpectTrue(err == context.DeadlineExceeded, "err: %v", err)
+	ExpectEq(1, fake.dials)
+}
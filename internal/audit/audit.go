@@ -0,0 +1,94 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package audit records the changes made to a bucket through the file system,
+// and who made them, to an append-only log kept in a local file or in Google
+// Cloud Logging.
+package audit
+
+import (
+	"time"
+)
+
+// The kinds of change recorded, as found in Record.Op.
+const (
+	OpCreate = "create"
+	OpWrite  = "write"
+	OpDelete = "delete"
+	OpRename = "rename"
+)
+
+// A Record describes an attempt to change an object in the bucket on behalf
+// of a process using the file system. Field names are part of the format of
+// the log, so should not be changed once released.
+type Record struct {
+	Time time.Time `json:"time"`
+
+	// One of the Op constants above.
+	Op string `json:"op"`
+
+	// The name of the object changed and, for a rename, the name it was given.
+	Name    string `json:"name"`
+	NewName string `json:"new_name,omitempty"`
+
+	// The generation of the object before and after the change, or zero if
+	// there was none or it isn't known. For a rename, the generation after is
+	// that of the object under the new name.
+	GenerationBefore int64 `json:"generation_before"`
+	GenerationAfter  int64 `json:"generation_after"`
+
+	// The process that asked for the change, from the header of the fuse op.
+	// Zero for changes that gcsfuse makes on its own behalf, such as writing
+	// back dirty files in the background.
+	Uid uint32 `json:"uid"`
+	Gid uint32 `json:"gid"`
+	Pid uint32 `json:"pid"`
+
+	// Empty if the change was made, or why it wasn't.
+	Error string `json:"error,omitempty"`
+}
+
+// A Log receives records. Safe for concurrent access.
+type Log interface {
+	// Record the change described by the supplied record, which must not be
+	// modified afterwards. Failing to do so is logged, but doesn't fail the
+	// change.
+	Write(r *Record)
+
+	// Make sure all records have been written out, and release resources.
+	Close() (err error)
+}
+
+// Multi returns a log that writes each record to all of the supplied logs.
+func Multi(logs ...Log) Log {
+	return multiLog(logs)
+}
+
+type multiLog []Log
+
+func (ml multiLog) Write(r *Record) {
+	for _, l := range ml {
+		l.Write(r)
+	}
+}
+
+func (ml multiLog) Close() (err error) {
+	for _, l := range ml {
+		if closeErr := l.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return
+}
@@ -0,0 +1,247 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/audit"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestAudit(t *testing.T) { RunTests(t) }
+
+var someRecord = audit.Record{
+	Time:             time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC),
+	Op:               audit.OpRename,
+	Name:             "foo",
+	NewName:          "bar",
+	GenerationBefore: 17,
+	GenerationAfter:  19,
+	Uid:              1000,
+	Gid:              100,
+	Pid:              4321,
+}
+
+////////////////////////////////////////////////////////////////////////
+// File log
+////////////////////////////////////////////////////////////////////////
+
+type FileLogTest struct {
+	dir string
+}
+
+var _ SetUpInterface = &FileLogTest{}
+var _ TearDownInterface = &FileLogTest{}
+
+func init() { RegisterTestSuite(&FileLogTest{}) }
+
+func (t *FileLogTest) SetUp(ti *TestInfo) {
+	var err error
+	t.dir, err = ioutil.TempDir("", "audit_test")
+	AssertEq(nil, err)
+}
+
+func (t *FileLogTest) TearDown() {
+	os.RemoveAll(t.dir)
+}
+
+func (t *FileLogTest) AppendsLines() {
+	p := path.Join(t.dir, "audit.log")
+	err := ioutil.WriteFile(p, []byte("earlier\n"), 0600)
+	AssertEq(nil, err)
+
+	l, err := audit.NewFileLog(p)
+	AssertEq(nil, err)
+
+	failed := someRecord
+	failed.Error = "taco"
+
+	l.Write(&someRecord)
+	l.Write(&failed)
+	AssertEq(nil, l.Close())
+
+	contents, err := ioutil.ReadFile(p)
+	AssertEq(nil, err)
+
+	lines := strings.Split(string(contents), "\n")
+	AssertEq(4, len(lines))
+	ExpectEq("earlier", lines[0])
+	ExpectEq("", lines[3])
+
+	var r audit.Record
+	AssertEq(nil, json.Unmarshal([]byte(lines[1]), &r))
+	ExpectThat(r, DeepEquals(someRecord))
+	ExpectThat(lines[1], Not(HasSubstr("error")))
+
+	AssertEq(nil, json.Unmarshal([]byte(lines[2]), &r))
+	ExpectThat(r, DeepEquals(failed))
+}
+
+func (t *FileLogTest) UnwritableDir() {
+	_, err := audit.NewFileLog(path.Join(t.dir, "missing", "audit.log"))
+	ExpectThat(err, Error(HasSubstr("OpenFile")))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Cloud log
+////////////////////////////////////////////////////////////////////////
+
+type writeRequest struct {
+	LogName  string `json:"logName"`
+	Resource struct {
+		Type   string            `json:"type"`
+		Labels map[string]string `json:"labels"`
+	} `json:"resource"`
+	Labels  map[string]string `json:"labels"`
+	Entries []struct {
+		Timestamp   string       `json:"timestamp"`
+		Severity    string       `json:"severity"`
+		JSONPayload audit.Record `json:"jsonPayload"`
+	} `json:"entries"`
+}
+
+type CloudLogTest struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	failing  bool
+	paths    []string
+	requests []writeRequest
+}
+
+var _ SetUpInterface = &CloudLogTest{}
+var _ TearDownInterface = &CloudLogTest{}
+
+func init() { RegisterTestSuite(&CloudLogTest{}) }
+
+func (t *CloudLogTest) SetUp(ti *TestInfo) {
+	t.server = httptest.NewServer(http.HandlerFunc(t.handle))
+}
+
+func (t *CloudLogTest) TearDown() {
+	t.server.Close()
+}
+
+func (t *CloudLogTest) handle(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.failing {
+		http.Error(w, "taco", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req writeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t.paths = append(t.paths, r.URL.Path)
+	t.requests = append(t.requests, req)
+}
+
+func (t *CloudLogTest) newLog() (l audit.Log) {
+	l, err := audit.NewCloudLog(audit.CloudConfig{
+		Client:   http.DefaultClient,
+		Project:  "some-project",
+		Labels:   map[string]string{"bucket": "some-bucket"},
+		Interval: time.Hour,
+		Endpoint: t.server.URL + "/v2/",
+	})
+
+	AssertEq(nil, err)
+	return
+}
+
+func (t *CloudLogTest) MissingProject() {
+	_, err := audit.NewCloudLog(audit.CloudConfig{
+		Client: http.DefaultClient,
+	})
+
+	ExpectThat(err, Error(HasSubstr("Project")))
+}
+
+func (t *CloudLogTest) WritesOnClose() {
+	l := t.newLog()
+	l.Write(&someRecord)
+	AssertEq(nil, l.Close())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ExpectThat(t.paths, ElementsAre("/v2/entries:write"))
+	AssertEq(1, len(t.requests))
+	req := t.requests[0]
+
+	ExpectEq("projects/some-project/logs/gcsfuse_audit", req.LogName)
+	ExpectEq("global", req.Resource.Type)
+	ExpectEq("some-project", req.Resource.Labels["project_id"])
+	ExpectEq("some-bucket", req.Labels["bucket"])
+
+	AssertEq(1, len(req.Entries))
+	ExpectEq("2016-01-02T15:04:05Z", req.Entries[0].Timestamp)
+	ExpectEq("NOTICE", req.Entries[0].Severity)
+	ExpectThat(req.Entries[0].JSONPayload, DeepEquals(someRecord))
+}
+
+func (t *CloudLogTest) WritesWhenFull() {
+	l := t.newLog()
+	defer l.Close()
+
+	for i := 0; i < 1000; i++ {
+		l.Write(&someRecord)
+	}
+
+	// The entries should be written without waiting for the interval.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		t.mu.Lock()
+		n := len(t.requests)
+		t.mu.Unlock()
+
+		if n > 0 {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	AddFailure("No entries written")
+}
+
+func (t *CloudLogTest) ReportsUnwrittenOnClose() {
+	t.mu.Lock()
+	t.failing = true
+	t.mu.Unlock()
+
+	l := t.newLog()
+	l.Write(&someRecord)
+	l.Write(&someRecord)
+
+	err := l.Close()
+	ExpectThat(err, Error(HasSubstr("2 audit records")))
+}
@@ -0,0 +1,294 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// The OAuth scope required for writing log entries.
+const LoggingWriteScope = "https://www.googleapis.com/auth/logging.write"
+
+const (
+	// The Cloud Logging API root.
+	defaultEndpoint = "https://logging.googleapis.com/v2/"
+
+	// The log to which entries are written, unless configured otherwise.
+	defaultLogName = "gcsfuse_audit"
+
+	// How often buffered entries are written.
+	defaultWriteInterval = 5 * time.Second
+
+	// The maximum number of entries in a single WriteLogEntries request, and
+	// the number buffered at which they are written without waiting for the
+	// interval to pass.
+	maxEntriesPerRequest = 1000
+
+	// The most entries kept while Cloud Logging can't be reached. Beyond this,
+	// the oldest are dropped.
+	maxBufferedEntries = 100000
+)
+
+type CloudConfig struct {
+	// An HTTP client that adds credentials with LoggingWriteScope to its
+	// requests. Required.
+	Client *http.Client
+
+	// The project to which entries are written. Required.
+	Project string
+
+	// The name of the log within the project. Defaults to "gcsfuse_audit".
+	LogName string
+
+	// Labels attached to every entry, e.g. the bucket name and mount point.
+	Labels map[string]string
+
+	// The period between writes. Defaults to five seconds.
+	Interval time.Duration
+
+	// The API root. Defaults to the public Cloud Logging endpoint.
+	Endpoint string
+
+	// If non-nil, where to log errors writing entries.
+	Logger *log.Logger
+}
+
+// NewCloudLog returns a log that buffers records and writes them to Google
+// Cloud Logging as structured entries in the background, every configured
+// interval or once enough have built up. Records that can't be written are
+// kept for the next attempt, up to a limit. Close writes whatever remains.
+func NewCloudLog(cfg CloudConfig) (l Log, err error) {
+	if cfg.Client == nil {
+		err = errors.New("Client must be set")
+		return
+	}
+
+	if cfg.Project == "" {
+		err = errors.New("Project must be set")
+		return
+	}
+
+	if cfg.LogName == "" {
+		cfg.LogName = defaultLogName
+	}
+
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultWriteInterval
+	}
+
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = defaultEndpoint
+	}
+
+	cl := &cloudLog{
+		cfg:     cfg,
+		full:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	go cl.loop()
+
+	l = cl
+	return
+}
+
+type cloudLog struct {
+	cfg CloudConfig
+
+	// Signalled when enough entries are buffered to write them straight away.
+	full chan struct{}
+
+	stop    chan struct{}
+	stopped chan struct{}
+
+	mu sync.Mutex
+
+	// Entries not yet written, oldest first.
+	//
+	// GUARDED_BY(mu)
+	pending []clEntry
+}
+
+func (cl *cloudLog) Write(r *Record) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	cl.pending = append(cl.pending, clEntry{
+		Timestamp:   r.Time.UTC().Format(time.RFC3339Nano),
+		Severity:    "NOTICE",
+		JSONPayload: r,
+	})
+
+	if len(cl.pending) >= maxEntriesPerRequest {
+		select {
+		case cl.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (cl *cloudLog) Close() (err error) {
+	close(cl.stop)
+	<-cl.stopped
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if len(cl.pending) > 0 {
+		err = fmt.Errorf("%d audit records were not written", len(cl.pending))
+	}
+
+	return
+}
+
+func (cl *cloudLog) loop() {
+	defer close(cl.stopped)
+
+	ticker := time.NewTicker(cl.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			cl.flushAndLog()
+
+		case <-cl.full:
+			cl.flushAndLog()
+
+		case <-cl.stop:
+			cl.flushAndLog()
+			return
+		}
+	}
+}
+
+func (cl *cloudLog) flushAndLog() {
+	err := cl.flush()
+	if err != nil && cl.cfg.Logger != nil {
+		cl.cfg.Logger.Printf("Writing audit records: %v", err)
+	}
+}
+
+// Write out the pending entries, putting back those that couldn't be.
+func (cl *cloudLog) flush() (err error) {
+	cl.mu.Lock()
+	entries := cl.pending
+	cl.pending = nil
+	cl.mu.Unlock()
+
+	for len(entries) > 0 {
+		n := len(entries)
+		if n > maxEntriesPerRequest {
+			n = maxEntriesPerRequest
+		}
+
+		err = cl.write(entries[:n])
+		if err != nil {
+			break
+		}
+
+		entries = entries[n:]
+	}
+
+	if len(entries) == 0 {
+		return
+	}
+
+	// Put back what's left in front of what has arrived meanwhile, dropping
+	// the oldest if there are too many.
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	cl.pending = append(entries, cl.pending...)
+	if dropped := len(cl.pending) - maxBufferedEntries; dropped > 0 {
+		cl.pending = cl.pending[dropped:]
+		err = fmt.Errorf("%v; dropped %d records", err, dropped)
+	}
+
+	return
+}
+
+func (cl *cloudLog) write(entries []clEntry) (err error) {
+	req := &clWriteRequest{
+		LogName: fmt.Sprintf(
+			"projects/%s/logs/%s",
+			cl.cfg.Project,
+			url.PathEscape(cl.cfg.LogName)),
+		Resource: clResource{
+			Type:   "global",
+			Labels: map[string]string{"project_id": cl.cfg.Project},
+		},
+		Labels:  cl.cfg.Labels,
+		Entries: entries,
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		err = fmt.Errorf("Marshal: %v", err)
+		return
+	}
+
+	resp, err := cl.cfg.Client.Post(
+		cl.cfg.Endpoint+"entries:write",
+		"application/json",
+		bytes.NewReader(body))
+
+	if err != nil {
+		err = fmt.Errorf("Post: %v", err)
+		return
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		err = fmt.Errorf("WriteLogEntries returned %s: %s", resp.Status, msg)
+		return
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Cloud Logging JSON encoding
+////////////////////////////////////////////////////////////////////////
+
+type clWriteRequest struct {
+	LogName  string            `json:"logName"`
+	Resource clResource        `json:"resource"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Entries  []clEntry         `json:"entries"`
+}
+
+type clResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels"`
+}
+
+type clEntry struct {
+	Timestamp   string  `json:"timestamp"`
+	Severity    string  `json:"severity"`
+	JSONPayload *Record `json:"jsonPayload"`
+}
@@ -0,0 +1,72 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// NewFileLog opens the file at the given path for appending, creating it if
+// necessary, and returns a log that writes each record to it as a line of
+// JSON before returning.
+func NewFileLog(path string) (l Log, err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		err = fmt.Errorf("OpenFile: %v", err)
+		return
+	}
+
+	l = &fileLog{f: f}
+	return
+}
+
+type fileLog struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	f *os.File
+}
+
+func (fl *fileLog) Write(r *Record) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("Audit log: Marshal: %v", err)
+		return
+	}
+
+	line = append(line, '\n')
+
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	// A single write to a file opened for appending lands at the end in one
+	// piece, even if others are appending too.
+	_, err = fl.f.Write(line)
+	if err != nil {
+		log.Printf("Audit log: Write: %v", err)
+	}
+}
+
+func (fl *fileLog) Close() (err error) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	err = fl.f.Close()
+	return
+}
@@ -0,0 +1,206 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package control implements a simple administrative interface to a running
+// gcsfuse process over a Unix domain socket.
+//
+// Each connection carries a single command: a line of whitespace-separated
+// words, the first of which names the command. The server replies with "OK"
+// followed by any output, or with "ERROR: " followed by a description of the
+// problem, then closes the connection. For example:
+//
+//     $ echo profile training | nc -U /run/gcsfuse/ctl
+//     OK
+//
+package control
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Handler carries out a command, given the words following its name, and
+// returns any output for the client.
+type Handler func(args []string) (output string, err error)
+
+// The longest command line we accept.
+const maxLineLength = 4096
+
+// How long a client has to send its command.
+const readTimeout = 10 * time.Second
+
+// A Server accepts connections on a Unix domain socket and dispatches the
+// commands they carry to registered handlers.
+type Server struct {
+	path     string
+	listener net.Listener
+	logger   *log.Logger
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	handlers map[string]Handler
+}
+
+// Listen creates a socket at the given path, accessible only to the current
+// user. A stale socket left behind by an earlier process is replaced. Commands
+// are not served until Serve is called. Errors handling individual connections
+// are written to the logger, if non-nil.
+func Listen(path string, logger *log.Logger) (s *Server, err error) {
+	// Remove any socket that already exists, but don't clobber other files.
+	if fi, statErr := os.Lstat(path); statErr == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			err = fmt.Errorf("%s exists and is not a socket", path)
+			return
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			err = fmt.Errorf("Remove: %v", err)
+			return
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		err = fmt.Errorf("Listen: %v", err)
+		return
+	}
+
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		l.Close()
+		err = fmt.Errorf("Chmod: %v", err)
+		return
+	}
+
+	s = &Server{
+		path:     path,
+		listener: l,
+		logger:   logger,
+		handlers: make(map[string]Handler),
+	}
+
+	s.Handle("help", s.help)
+	return
+}
+
+// Handle registers a handler for the named command, replacing any existing
+// one.
+func (s *Server) Handle(name string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handlers[name] = h
+}
+
+// Serve accepts connections until Close is called.
+func (s *Server) Serve() {
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			// The listener has been closed.
+			return
+		}
+
+		go s.serveConn(c)
+	}
+}
+
+// Close stops accepting connections and removes the socket.
+func (s *Server) Close() (err error) {
+	err = s.listener.Close()
+
+	// Go removes Unix sockets when closing their listeners, but be sure.
+	os.Remove(s.path)
+	return
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.logger != nil {
+		s.logger.Printf(format, v...)
+	}
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(readTimeout))
+	line, err := bufio.NewReader(io.LimitReader(c, maxLineLength)).ReadString('\n')
+	if err != nil && !(err == io.EOF && line != "") {
+		s.logf("Reading command: %v", err)
+		return
+	}
+
+	output, err := s.dispatch(strings.Fields(line))
+
+	var reply string
+	switch {
+	case err != nil:
+		reply = fmt.Sprintf("ERROR: %v\n", err)
+
+	case output == "":
+		reply = "OK\n"
+
+	default:
+		reply = "OK\n" + strings.TrimSuffix(output, "\n") + "\n"
+	}
+
+	_, err = io.WriteString(c, reply)
+	if err != nil {
+		s.logf("Writing reply: %v", err)
+	}
+}
+
+func (s *Server) dispatch(words []string) (output string, err error) {
+	if len(words) == 0 {
+		err = fmt.Errorf("Empty command")
+		return
+	}
+
+	s.mu.Lock()
+	h := s.handlers[words[0]]
+	s.mu.Unlock()
+
+	if h == nil {
+		err = fmt.Errorf("Unknown command %q; try \"help\"", words[0])
+		return
+	}
+
+	output, err = h(words[1:])
+	return
+}
+
+// The built-in "help" command, which lists the available commands.
+func (s *Server) help(args []string) (output string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	for name := range s.handlers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	output = strings.Join(names, "\n")
+	return
+}
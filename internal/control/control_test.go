@@ -0,0 +1,144 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package control_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/control"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestControl(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ControlTest struct {
+	dir    string
+	path   string
+	server *control.Server
+}
+
+var _ SetUpInterface = &ControlTest{}
+var _ TearDownInterface = &ControlTest{}
+
+func init() { RegisterTestSuite(&ControlTest{}) }
+
+func (t *ControlTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.dir, err = ioutil.TempDir("", "control_test")
+	AssertEq(nil, err)
+
+	t.path = path.Join(t.dir, "ctl")
+	t.server, err = control.Listen(t.path, nil)
+	AssertEq(nil, err)
+
+	t.server.Handle("echo", func(args []string) (string, error) {
+		return strings.Join(args, " "), nil
+	})
+
+	t.server.Handle("fail", func(args []string) (string, error) {
+		return "", errors.New("taco")
+	})
+
+	go t.server.Serve()
+}
+
+func (t *ControlTest) TearDown() {
+	t.server.Close()
+	os.RemoveAll(t.dir)
+}
+
+// Send a command and return the full reply.
+func (t *ControlTest) send(cmd string) (reply string) {
+	c, err := net.Dial("unix", t.path)
+	AssertEq(nil, err)
+	defer c.Close()
+
+	_, err = c.Write([]byte(cmd))
+	AssertEq(nil, err)
+
+	b, err := ioutil.ReadAll(c)
+	AssertEq(nil, err)
+
+	reply = string(b)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ControlTest) SocketPermissions() {
+	fi, err := os.Stat(t.path)
+	AssertEq(nil, err)
+
+	ExpectEq(os.FileMode(0600), fi.Mode()&os.ModePerm)
+}
+
+func (t *ControlTest) Output() {
+	ExpectEq("OK\nfoo bar\n", t.send("echo foo  bar\n"))
+}
+
+func (t *ControlTest) NoOutput() {
+	ExpectEq("OK\n", t.send("echo\n"))
+}
+
+func (t *ControlTest) HandlerError() {
+	ExpectEq("ERROR: taco\n", t.send("fail\n"))
+}
+
+func (t *ControlTest) UnknownCommand() {
+	ExpectThat(t.send("burrito\n"), HasSubstr("ERROR: Unknown command"))
+}
+
+func (t *ControlTest) Help() {
+	ExpectEq("OK\necho\nfail\nhelp\n", t.send("help\n"))
+}
+
+func (t *ControlTest) ReplacesStaleSocket() {
+	t.server.Close()
+
+	// Leave a socket file behind, as a crashed process would.
+	l, err := net.Listen("unix", t.path)
+	AssertEq(nil, err)
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	t.server, err = control.Listen(t.path, nil)
+	AssertEq(nil, err)
+	go t.server.Serve()
+
+	ExpectThat(t.send("help\n"), HasSubstr("OK\n"))
+}
+
+func (t *ControlTest) RefusesToClobberFiles() {
+	p := path.Join(t.dir, "regular")
+	err := ioutil.WriteFile(p, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	_, err = control.Listen(p, nil)
+	ExpectThat(err, Error(HasSubstr("not a socket")))
+}
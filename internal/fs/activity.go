@@ -0,0 +1,81 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jacobsa/timeutil"
+)
+
+// An ActivityTracker records whether the file system is handling any ops, so
+// that an idle mount can be unmounted. Safe for concurrent access.
+type ActivityTracker struct {
+	clock timeutil.Clock
+
+	mu sync.Mutex
+
+	// The number of ops in progress.
+	//
+	// GUARDED_BY(mu)
+	inFlight int
+
+	// When the most recent op finished, or when the tracker was created if none
+	// has.
+	//
+	// GUARDED_BY(mu)
+	lastActive time.Time
+}
+
+// NewActivityTracker creates a tracker that considers the file system to have
+// been idle since now.
+func NewActivityTracker(clock timeutil.Clock) (t *ActivityTracker) {
+	t = &ActivityTracker{
+		clock:      clock,
+		lastActive: clock.Now(),
+	}
+
+	return
+}
+
+// IdleFor returns how long it has been since an op was last in progress, or
+// zero if one is in progress now.
+func (t *ActivityTracker) IdleFor() (d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.inFlight > 0 {
+		return
+	}
+
+	d = t.clock.Now().Sub(t.lastActive)
+	return
+}
+
+func (t *ActivityTracker) startOp() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.inFlight++
+}
+
+func (t *ActivityTracker) finishOp() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.inFlight--
+	t.lastActive = t.clock.Now()
+}
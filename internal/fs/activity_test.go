@@ -0,0 +1,70 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ActivityTest struct {
+	clock    timeutil.SimulatedClock
+	activity *fs.ActivityTracker
+
+	fsTest
+}
+
+func init() { RegisterTestSuite(&ActivityTest{}) }
+
+func (t *ActivityTest) SetUp(ti *TestInfo) {
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.activity = fs.NewActivityTracker(&t.clock)
+	t.serverCfg.Activity = t.activity
+
+	t.fsTest.SetUp(ti)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ActivityTest) Idle() {
+	// Ops made by the kernel while mounting happen at the current time, since
+	// the clock doesn't move on its own.
+	t.clock.AdvanceTime(time.Minute)
+	ExpectEq(time.Minute, t.activity.IdleFor())
+}
+
+func (t *ActivityTest) OpResetsIdleTime() {
+	t.clock.AdvanceTime(time.Minute)
+
+	// Look up a name, which must go to the file system.
+	_, err := os.Stat(path.Join(t.Dir, "foo"))
+	AssertTrue(os.IsNotExist(err), "err: %v", err)
+
+	ExpectEq(0, t.activity.IdleFor())
+
+	t.clock.AdvanceTime(time.Second)
+	ExpectEq(time.Second, t.activity.IdleFor())
+}
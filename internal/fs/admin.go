@@ -0,0 +1,237 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/net/context"
+)
+
+// An Admin carries out administrative operations on a file system while it is
+// mounted, e.g. on behalf of a control socket. Create one with NewAdmin and
+// pass it to NewServer in ServerConfig.Admin; until then its methods fail.
+//
+// Safe for concurrent access.
+type Admin struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	fs *fileSystem
+
+	// Held for reading by each op that modifies the file system while it runs,
+	// and for writing while changing drains, so that draining waits for those
+	// ops to finish.
+	drainMu sync.RWMutex
+
+	// The number of calls to Drain not yet undone by Resume. While positive,
+	// ops that would modify the file system are refused.
+	//
+	// GUARDED_BY(drainMu)
+	drains int
+}
+
+// HandleInfo describes an open handle.
+type HandleInfo struct {
+	ID fuseops.HandleID
+
+	// "dir", "read", or "write".
+	Kind string
+
+	// The path of the file or directory relative to the mount point, beginning
+	// with a slash.
+	Path string
+}
+
+// NewAdmin creates an admin not yet attached to a file system.
+func NewAdmin() (a *Admin) {
+	a = &Admin{}
+	return
+}
+
+func (a *Admin) attach(fs *fileSystem) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.fs = fs
+}
+
+func (a *Admin) fileSystem() (fs *fileSystem, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	fs = a.fs
+	if fs == nil {
+		err = errors.New("The file system isn't mounted yet")
+		return
+	}
+
+	return
+}
+
+// Drain makes the file system refuse ops that would modify it, with EROFS,
+// and waits for those in progress to finish, so that the dirty files found
+// afterward stay that way until written out. If ctx is done first, Drain
+// returns its error and the file system goes on to refuse such ops once they
+// finish.
+//
+// It needn't be mounted yet.
+func (a *Admin) Drain(ctx context.Context) (err error) {
+	done := make(chan struct{})
+	go func() {
+		a.drainMu.Lock()
+		a.drains++
+		a.drainMu.Unlock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	return
+}
+
+// Resume undoes a call to Drain, e.g. when the file system couldn't be
+// unmounted after all. Once every call has been undone, the file system
+// accepts modifications again.
+func (a *Admin) Resume() {
+	a.drainMu.Lock()
+	a.drains--
+	a.drainMu.Unlock()
+}
+
+// If the file system isn't being drained, return true, and the caller must
+// call finishModification once its op is done. Otherwise return false.
+func (a *Admin) startModification() bool {
+	a.drainMu.RLock()
+	if a.drains > 0 {
+		a.drainMu.RUnlock()
+		return false
+	}
+
+	return true
+}
+
+func (a *Admin) finishModification() {
+	a.drainMu.RUnlock()
+}
+
+// Handles returns the open handles, in order of ID.
+func (a *Admin) Handles() (handles []HandleInfo, err error) {
+	fs, err := a.fileSystem()
+	if err != nil {
+		return
+	}
+
+	ids, entries := fs.handles.All()
+	for i, e := range entries {
+		h := HandleInfo{ID: ids[i]}
+		switch e.kind {
+		case dirHandleKind:
+			h.Kind = "dir"
+			h.Path = "/" + e.dir.in.Name()
+
+		case readHandleKind:
+			h.Kind = "read"
+			h.Path = "/" + e.file.Inode().Name()
+
+		case writeHandleKind:
+			h.Kind = "write"
+			h.Path = "/" + e.file.Inode().Name()
+		}
+
+		handles = append(handles, h)
+	}
+
+	sort.Slice(handles, func(i, j int) bool {
+		return handles[i].ID < handles[j].ID
+	})
+
+	return
+}
+
+// DirtyFiles returns the paths of the files with local modifications that
+// have not yet been written to GCS, in sorted order.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (a *Admin) DirtyFiles() (paths []string, err error) {
+	fs, err := a.fileSystem()
+	if err != nil {
+		return
+	}
+
+	for _, f := range fs.dirtyFiles() {
+		paths = append(paths, "/"+f.Name())
+	}
+
+	sort.Strings(paths)
+	return
+}
+
+// FlushAll writes every file with local modifications out to GCS, as if each
+// were fsync'd, returning the number written. On error, the remaining files
+// are still written, and the first error is returned.
+func (a *Admin) FlushAll(ctx context.Context) (n int, err error) {
+	fs, err := a.fileSystem()
+	if err != nil {
+		return
+	}
+
+	for _, f := range fs.dirtyFiles() {
+		flushErr := fs.flushFile(ctx, f)
+		if flushErr != nil {
+			if err == nil {
+				err = flushErr
+			}
+
+			continue
+		}
+
+		n++
+	}
+
+	return
+}
+
+// Return the file inodes that are dirty at the moment of checking each.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) dirtyFiles() (files []*inode.FileInode) {
+	// The inode table doesn't need the file system lock to be read, and we must
+	// not hold it while locking inodes. An inode destroyed meanwhile is clean.
+	for _, in := range fs.inodes.All() {
+		f, ok := in.(*inode.FileInode)
+		if !ok {
+			continue
+		}
+
+		f.Lock()
+		dirty := f.Dirty()
+		f.Unlock()
+
+		if dirty {
+			files = append(files, f)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,593 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"golang.org/x/net/context"
+)
+
+// The name of the directory in the root holding the files given by
+// ServerConfig.DebugFiles.
+const DebugDirName = ".gcsfuse"
+
+// The debug directory and its files, and the handles opened on them, get IDs
+// from the top half of each ID space, which the file system's own IDs, counted
+// up from one, never reach.
+const (
+	debugDirInodeID    = fuseops.InodeID(1 << 63)
+	firstDebugHandleID = fuseops.HandleID(1 << 63)
+)
+
+// Wrap the supplied file system so that its root directory also contains a
+// directory named DebugDirName, which isn't listed. In it are read-only files
+// with the names of the keys of files, whose contents are generated by the
+// corresponding functions each time they are opened. The directory and its
+// files belong to the given user and group.
+//
+// The directory shadows anything of the same name in the bucket.
+func newDebugFileSystem(
+	wrapped fuseutil.FileSystem,
+	files map[string]func() ([]byte, error),
+	uid uint32,
+	gid uint32) fuseutil.FileSystem {
+	fs := &debugFileSystem{
+		FileSystem: wrapped,
+		uid:        uid,
+		gid:        gid,
+		created:    time.Now(),
+		ids:        make(map[string]fuseops.InodeID),
+		files:      make(map[fuseops.InodeID]debugFile),
+		handles:    make(map[fuseops.HandleID][]byte),
+		nextHandle: firstDebugHandleID,
+	}
+
+	for name := range files {
+		fs.names = append(fs.names, name)
+	}
+
+	sort.Strings(fs.names)
+	for i, name := range fs.names {
+		id := debugDirInodeID + 1 + fuseops.InodeID(i)
+		fs.ids[name] = id
+		fs.files[id] = debugFile{name: name, generate: files[name]}
+	}
+
+	return fs
+}
+
+type debugFile struct {
+	name     string
+	generate func() ([]byte, error)
+}
+
+type debugFileSystem struct {
+	fuseutil.FileSystem
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	uid     uint32
+	gid     uint32
+	created time.Time
+
+	// The names of the files, in sorted order, and their inode IDs.
+	names []string
+	ids   map[string]fuseops.InodeID
+	files map[fuseops.InodeID]debugFile
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The contents generated for each open handle on a file.
+	//
+	// GUARDED_BY(mu)
+	handles map[fuseops.HandleID][]byte
+
+	// GUARDED_BY(mu)
+	nextHandle fuseops.HandleID
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func isDebugInode(id fuseops.InodeID) bool {
+	return id >= debugDirInodeID
+}
+
+func isDebugHandle(id fuseops.HandleID) bool {
+	return id >= firstDebugHandleID
+}
+
+// Is the child of the given parent with the given name the debug directory or
+// one of its files?
+func isDebugChild(parent fuseops.InodeID, name string) bool {
+	return isDebugInode(parent) ||
+		(parent == fuseops.RootInodeID && name == DebugDirName)
+}
+
+func (fs *debugFileSystem) attributes(
+	id fuseops.InodeID) (attrs fuseops.InodeAttributes) {
+	attrs = fuseops.InodeAttributes{
+		Nlink:  1,
+		Mode:   0444,
+		Atime:  fs.created,
+		Mtime:  fs.created,
+		Ctime:  fs.created,
+		Crtime: fs.created,
+		Uid:    fs.uid,
+		Gid:    fs.gid,
+	}
+
+	// Files report no size, since their contents are only generated on open;
+	// they are opened for direct I/O so that the kernel reads them regardless.
+	if id == debugDirInodeID {
+		attrs.Nlink = 2
+		attrs.Mode = 0555 | os.ModeDir
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Names
+////////////////////////////////////////////////////////////////////////
+
+func (fs *debugFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	var id fuseops.InodeID
+	switch {
+	case op.Parent == fuseops.RootInodeID && op.Name == DebugDirName:
+		id = debugDirInodeID
+
+	case op.Parent == debugDirInodeID:
+		var ok bool
+		if id, ok = fs.ids[op.Name]; !ok {
+			err = fuse.ENOENT
+			return
+		}
+
+	default:
+		err = fs.FileSystem.LookUpInode(ctx, op)
+		return
+	}
+
+	// Lookups needn't be counted, since there is nothing to forget. Nothing is
+	// cached by the kernel, so that each open sees a fresh listing of names.
+	op.Entry.Child = id
+	op.Entry.Attributes = fs.attributes(id)
+	return
+}
+
+func (fs *debugFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	if !isDebugInode(op.Inode) {
+		err = fs.FileSystem.GetInodeAttributes(ctx, op)
+		return
+	}
+
+	op.Attributes = fs.attributes(op.Inode)
+	return
+}
+
+func (fs *debugFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) (err error) {
+	if !isDebugInode(op.Inode) {
+		err = fs.FileSystem.SetInodeAttributes(ctx, op)
+		return
+	}
+
+	err = syscall.EPERM
+	return
+}
+
+func (fs *debugFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) (err error) {
+	if !isDebugInode(op.Inode) {
+		err = fs.FileSystem.ForgetInode(ctx, op)
+		return
+	}
+
+	return
+}
+
+func (fs *debugFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) (err error) {
+	if isDebugChild(op.Parent, op.Name) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.MkDir(ctx, op)
+	return
+}
+
+func (fs *debugFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) (err error) {
+	if isDebugChild(op.Parent, op.Name) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.MkNode(ctx, op)
+	return
+}
+
+func (fs *debugFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) (err error) {
+	if isDebugChild(op.Parent, op.Name) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.CreateFile(ctx, op)
+	return
+}
+
+func (fs *debugFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) (err error) {
+	if isDebugChild(op.Parent, op.Name) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.CreateSymlink(ctx, op)
+	return
+}
+
+func (fs *debugFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) (err error) {
+	if isDebugChild(op.Parent, op.Name) || isDebugInode(op.Target) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.CreateLink(ctx, op)
+	return
+}
+
+func (fs *debugFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) (err error) {
+	if isDebugChild(op.OldParent, op.OldName) ||
+		isDebugChild(op.NewParent, op.NewName) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.Rename(ctx, op)
+	return
+}
+
+func (fs *debugFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) (err error) {
+	if isDebugChild(op.Parent, op.Name) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.RmDir(ctx, op)
+	return
+}
+
+func (fs *debugFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) (err error) {
+	if isDebugChild(op.Parent, op.Name) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.Unlink(ctx, op)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Directory
+////////////////////////////////////////////////////////////////////////
+
+func (fs *debugFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) (err error) {
+	if !isDebugInode(op.Inode) {
+		err = fs.FileSystem.OpenDir(ctx, op)
+		return
+	}
+
+	// The listing needs no state, so neither does the handle.
+	op.Handle = firstDebugHandleID
+	return
+}
+
+func (fs *debugFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) (err error) {
+	if !isDebugInode(op.Inode) {
+		err = fs.FileSystem.ReadDir(ctx, op)
+		return
+	}
+
+	if int(op.Offset) > len(fs.names) {
+		err = fuse.EINVAL
+		return
+	}
+
+	for i := int(op.Offset); i < len(fs.names); i++ {
+		e := fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  fs.ids[fs.names[i]],
+			Name:   fs.names[i],
+			Type:   fuseutil.DT_File,
+		}
+
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], e)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return
+}
+
+func (fs *debugFileSystem) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) (err error) {
+	if !isDebugHandle(op.Handle) {
+		err = fs.FileSystem.ReleaseDirHandle(ctx, op)
+		return
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Files
+////////////////////////////////////////////////////////////////////////
+
+func (fs *debugFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	f, ok := fs.files[op.Inode]
+	if !ok {
+		err = fs.FileSystem.OpenFile(ctx, op)
+		return
+	}
+
+	if op.Flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		err = syscall.EACCES
+		return
+	}
+
+	contents, err := f.generate()
+	if err != nil {
+		err = fmt.Errorf("Generating %s: %v", f.name, err)
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.nextHandle++
+	op.Handle = fs.nextHandle
+	fs.handles[op.Handle] = contents
+	op.UseDirectIO = true
+
+	return
+}
+
+func (fs *debugFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	if !isDebugHandle(op.Handle) {
+		err = fs.FileSystem.ReadFile(ctx, op)
+		return
+	}
+
+	fs.mu.Lock()
+	contents := fs.handles[op.Handle]
+	fs.mu.Unlock()
+
+	if op.Offset < int64(len(contents)) {
+		op.BytesRead = copy(op.Dst, contents[op.Offset:])
+	}
+
+	return
+}
+
+func (fs *debugFileSystem) SeekFile(
+	ctx context.Context,
+	op *fuseops.SeekFileOp) (err error) {
+	if !isDebugHandle(op.Handle) {
+		err = fs.FileSystem.SeekFile(ctx, op)
+		return
+	}
+
+	fs.mu.Lock()
+	size := int64(len(fs.handles[op.Handle]))
+	fs.mu.Unlock()
+
+	op.NewOffset, err = gcsx.SeekExtents(
+		gcsx.DataExtents(nil, size),
+		size,
+		op.Offset,
+		op.Whence == fuseops.SeekHole)
+
+	return
+}
+
+// Locks on debug files aren't supported.
+func (fs *debugFileSystem) GetFileLock(
+	ctx context.Context,
+	op *fuseops.GetFileLockOp) (err error) {
+	if !isDebugHandle(op.Handle) {
+		err = fs.FileSystem.GetFileLock(ctx, op)
+		return
+	}
+
+	err = syscall.ENOLCK
+	return
+}
+
+func (fs *debugFileSystem) SetFileLock(
+	ctx context.Context,
+	op *fuseops.SetFileLockOp) (err error) {
+	if !isDebugHandle(op.Handle) {
+		err = fs.FileSystem.SetFileLock(ctx, op)
+		return
+	}
+
+	err = syscall.ENOLCK
+	return
+}
+
+func (fs *debugFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) (err error) {
+	if !isDebugHandle(op.Handle) {
+		err = fs.FileSystem.WriteFile(ctx, op)
+		return
+	}
+
+	err = syscall.EBADF
+	return
+}
+
+func (fs *debugFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) (err error) {
+	if !isDebugInode(op.Inode) {
+		err = fs.FileSystem.SyncFile(ctx, op)
+		return
+	}
+
+	return
+}
+
+func (fs *debugFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) (err error) {
+	if !isDebugHandle(op.Handle) {
+		err = fs.FileSystem.FlushFile(ctx, op)
+		return
+	}
+
+	return
+}
+
+func (fs *debugFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) (err error) {
+	if !isDebugHandle(op.Handle) {
+		err = fs.FileSystem.ReleaseFileHandle(ctx, op)
+		return
+	}
+
+	fs.mu.Lock()
+	delete(fs.handles, op.Handle)
+	fs.mu.Unlock()
+
+	return
+}
+
+func (fs *debugFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) (err error) {
+	if !isDebugHandle(op.SrcHandle) && !isDebugHandle(op.DstHandle) {
+		err = fs.FileSystem.CopyFileRange(ctx, op)
+		return
+	}
+
+	// Let the kernel fall back to reading and writing.
+	err = syscall.EOPNOTSUPP
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Extended attributes
+////////////////////////////////////////////////////////////////////////
+
+func (fs *debugFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) (err error) {
+	if !isDebugInode(op.Inode) {
+		err = fs.FileSystem.GetXattr(ctx, op)
+		return
+	}
+
+	err = fuse.ENOATTR
+	return
+}
+
+func (fs *debugFileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) (err error) {
+	if !isDebugInode(op.Inode) {
+		err = fs.FileSystem.ListXattr(ctx, op)
+		return
+	}
+
+	return
+}
+
+func (fs *debugFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) (err error) {
+	if !isDebugInode(op.Inode) {
+		err = fs.FileSystem.SetXattr(ctx, op)
+		return
+	}
+
+	err = syscall.EPERM
+	return
+}
+
+func (fs *debugFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) (err error) {
+	if !isDebugInode(op.Inode) {
+		err = fs.FileSystem.RemoveXattr(ctx, op)
+		return
+	}
+
+	err = syscall.EPERM
+	return
+}
@@ -0,0 +1,270 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestDebugFileSystem(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type DebugFileSystemTest struct {
+	ctx context.Context
+
+	// The number of times the "count" file has been generated.
+	generated int
+
+	fs fuseutil.FileSystem
+}
+
+var _ SetUpInterface = &DebugFileSystemTest{}
+
+func init() { RegisterTestSuite(&DebugFileSystemTest{}) }
+
+func (t *DebugFileSystemTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+
+	files := map[string]func() ([]byte, error){
+		"count": func() ([]byte, error) {
+			t.generated++
+			return []byte(fmt.Sprintf("%d\n", t.generated)), nil
+		},
+
+		"broken": func() ([]byte, error) {
+			return nil, fmt.Errorf("taco")
+		},
+	}
+
+	t.fs = newDebugFileSystem(
+		&fuseutil.NotImplementedFileSystem{},
+		files,
+		123,
+		456)
+}
+
+// Look up the named child of the given parent, returning its inode ID.
+func (t *DebugFileSystemTest) lookUp(
+	parent fuseops.InodeID,
+	name string) (id fuseops.InodeID, err error) {
+	op := &fuseops.LookUpInodeOp{Parent: parent, Name: name}
+	err = t.fs.LookUpInode(t.ctx, op)
+	id = op.Entry.Child
+	return
+}
+
+// Open and read the whole of the named file in the debug directory.
+func (t *DebugFileSystemTest) readFile(name string) (s string, err error) {
+	id, err := t.lookUp(debugDirInodeID, name)
+	if err != nil {
+		return
+	}
+
+	openOp := &fuseops.OpenFileOp{Inode: id, Flags: syscall.O_RDONLY}
+	err = t.fs.OpenFile(t.ctx, openOp)
+	if err != nil {
+		return
+	}
+
+	AssertTrue(openOp.UseDirectIO)
+
+	readOp := &fuseops.ReadFileOp{
+		Inode:  id,
+		Handle: openOp.Handle,
+		Dst:    make([]byte, 1024),
+	}
+
+	err = t.fs.ReadFile(t.ctx, readOp)
+	if err != nil {
+		return
+	}
+
+	s = string(readOp.Dst[:readOp.BytesRead])
+	err = t.fs.ReleaseFileHandle(
+		t.ctx,
+		&fuseops.ReleaseFileHandleOp{Handle: openOp.Handle})
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DebugFileSystemTest) LookUpDirectory() {
+	op := &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   DebugDirName,
+	}
+
+	err := t.fs.LookUpInode(t.ctx, op)
+	AssertEq(nil, err)
+
+	ExpectEq(debugDirInodeID, op.Entry.Child)
+	ExpectEq(0555|os.ModeDir, op.Entry.Attributes.Mode)
+	ExpectEq(123, op.Entry.Attributes.Uid)
+	ExpectEq(456, op.Entry.Attributes.Gid)
+}
+
+func (t *DebugFileSystemTest) LookUpFiles() {
+	id, err := t.lookUp(debugDirInodeID, "count")
+	AssertEq(nil, err)
+	ExpectTrue(isDebugInode(id))
+
+	attrsOp := &fuseops.GetInodeAttributesOp{Inode: id}
+	err = t.fs.GetInodeAttributes(t.ctx, attrsOp)
+	AssertEq(nil, err)
+	ExpectEq(0444, attrsOp.Attributes.Mode)
+
+	_, err = t.lookUp(debugDirInodeID, "burrito")
+	ExpectEq(fuse.ENOENT, err)
+}
+
+func (t *DebugFileSystemTest) OtherNamesPassThrough() {
+	_, err := t.lookUp(fuseops.RootInodeID, "foo")
+	ExpectEq(fuse.ENOSYS, err)
+
+	err = t.fs.GetInodeAttributes(
+		t.ctx,
+		&fuseops.GetInodeAttributesOp{Inode: fuseops.RootInodeID})
+
+	ExpectEq(fuse.ENOSYS, err)
+}
+
+func (t *DebugFileSystemTest) ContentsGeneratedOnOpen() {
+	s, err := t.readFile("count")
+	AssertEq(nil, err)
+	ExpectEq("1\n", s)
+
+	s, err = t.readFile("count")
+	AssertEq(nil, err)
+	ExpectEq("2\n", s)
+}
+
+func (t *DebugFileSystemTest) GenerationFails() {
+	_, err := t.readFile("broken")
+	ExpectNe(nil, err)
+}
+
+func (t *DebugFileSystemTest) ReadsAtOffsets() {
+	id, err := t.lookUp(debugDirInodeID, "count")
+	AssertEq(nil, err)
+
+	openOp := &fuseops.OpenFileOp{Inode: id}
+	AssertEq(nil, t.fs.OpenFile(t.ctx, openOp))
+
+	// Past the end.
+	readOp := &fuseops.ReadFileOp{
+		Handle: openOp.Handle,
+		Offset: 17,
+		Dst:    make([]byte, 1024),
+	}
+
+	AssertEq(nil, t.fs.ReadFile(t.ctx, readOp))
+	ExpectEq(0, readOp.BytesRead)
+
+	// In the middle, seeing the contents from when the file was opened.
+	readOp = &fuseops.ReadFileOp{
+		Handle: openOp.Handle,
+		Offset: 1,
+		Dst:    make([]byte, 1024),
+	}
+
+	AssertEq(nil, t.fs.ReadFile(t.ctx, readOp))
+	ExpectEq("\n", string(readOp.Dst[:readOp.BytesRead]))
+}
+
+func (t *DebugFileSystemTest) ModificationsRefused() {
+	id, err := t.lookUp(debugDirInodeID, "count")
+	AssertEq(nil, err)
+
+	err = t.fs.OpenFile(
+		t.ctx,
+		&fuseops.OpenFileOp{Inode: id, Flags: syscall.O_RDWR})
+
+	ExpectEq(syscall.EACCES, err)
+
+	err = t.fs.Unlink(
+		t.ctx,
+		&fuseops.UnlinkOp{Parent: debugDirInodeID, Name: "count"})
+
+	ExpectEq(syscall.EPERM, err)
+
+	err = t.fs.CreateFile(
+		t.ctx,
+		&fuseops.CreateFileOp{Parent: debugDirInodeID, Name: "foo"})
+
+	ExpectEq(syscall.EPERM, err)
+
+	err = t.fs.RmDir(
+		t.ctx,
+		&fuseops.RmDirOp{Parent: fuseops.RootInodeID, Name: DebugDirName})
+
+	ExpectEq(syscall.EPERM, err)
+
+	err = t.fs.Rename(
+		t.ctx,
+		&fuseops.RenameOp{
+			OldParent: fuseops.RootInodeID,
+			OldName:   "foo",
+			NewParent: debugDirInodeID,
+			NewName:   "bar",
+		})
+
+	ExpectEq(syscall.EPERM, err)
+}
+
+func (t *DebugFileSystemTest) ReadDir() {
+	openOp := &fuseops.OpenDirOp{Inode: debugDirInodeID}
+	AssertEq(nil, t.fs.OpenDir(t.ctx, openOp))
+
+	readOp := &fuseops.ReadDirOp{
+		Inode:  debugDirInodeID,
+		Handle: openOp.Handle,
+		Dst:    make([]byte, 1024),
+	}
+
+	AssertEq(nil, t.fs.ReadDir(t.ctx, readOp))
+
+	var expected []byte
+	for i, name := range []string{"broken", "count"} {
+		id, err := t.lookUp(debugDirInodeID, name)
+		AssertEq(nil, err)
+
+		e := fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  id,
+			Name:   name,
+			Type:   fuseutil.DT_File,
+		}
+
+		buf := make([]byte, 1024)
+		expected = append(expected, buf[:fuseutil.WriteDirent(buf, e)]...)
+	}
+
+	ExpectEq(string(expected), string(readOp.Dst[:readOp.BytesRead]))
+}
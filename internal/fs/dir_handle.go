@@ -27,13 +27,21 @@ import (
 )
 
 // State required for reading from directories.
+//
+// Entries are fetched from the inode a page at a time as the kernel consumes
+// them, rather than all at once, so that memory use stays bounded for huge
+// directories. The cost is that entries are returned in about the order of
+// their object names, not sorted by file name: a file that may conflict with
+// a directory is held back until the directory's object name has been passed,
+// while the entries after it are returned.
 type dirHandle struct {
 	/////////////////////////
 	// Constant data
 	/////////////////////////
 
-	in           inode.DirInode
-	implicitDirs bool
+	in             inode.DirInode
+	implicitDirs   bool
+	conflictSuffix string
 
 	/////////////////////////
 	// Mutable state
@@ -41,29 +49,75 @@ type dirHandle struct {
 
 	Mu syncutil.InvariantMutex
 
-	// All entries in the directory. Populated the first time we need one.
+	// Entries that are ready to return, with offsets assigned, beginning with
+	// the first entry not yet known to have been consumed by the kernel. The
+	// entries before them have offsets up to and including bufferStart.
+	//
+	// INVARIANT: For each i, buffered[i].Offset == bufferStart + i + 1
+	//
+	// GUARDED_BY(Mu)
+	buffered    []fuseutil.Dirent
+	bufferStart fuseops.DirOffset
+
+	// Entries read from the inode that can't be returned yet because a
+	// directory with the same name, whose object name sorts later, may still be
+	// to come. See fixConflictingName.
 	//
-	// INVARIANT: For each i, entries[i+1].Offset == entries[i].Offset + 1
+	// INVARIANT: Sorted by entryKey
 	//
 	// GUARDED_BY(Mu)
-	entries []fuseutil.Dirent
+	pending []fuseutil.Dirent
 
-	// Has entries yet been populated?
+	// The continuation token for the next call to ReadEntries, and whether the
+	// listing is complete.
 	//
-	// INVARIANT: If !entriesValid, then len(entries) == 0
+	// INVARIANT: If done, then tok == ""
 	//
 	// GUARDED_BY(Mu)
-	entriesValid bool
+	tok  string
+	done bool
+
+	// The largest key of an entry read from the inode so far.
+	//
+	// GUARDED_BY(Mu)
+	seen string
+
+	// The state of the listing before each call to ReadEntries, so that a read
+	// from an offset we have already discarded can resume from the page that
+	// contains it rather than from the beginning.
+	//
+	// INVARIANT: Sorted by offset
+	// INVARIANT: For each c, c.offset <= bufferStart + len(buffered)
+	//
+	// GUARDED_BY(Mu)
+	checkpoints []dirCheckpoint
 }
 
-// Create a directory handle that obtains listings from the supplied inode.
+// A point in a listing from which a dirHandle can resume reading.
+type dirCheckpoint struct {
+	// The number of entries released to the buffer before this point, i.e. the
+	// offset of the last of them.
+	offset fuseops.DirOffset
+
+	// The continuation token for the next call to ReadEntries, and the state
+	// that goes along with it.
+	tok     string
+	pending []fuseutil.Dirent
+	seen    string
+}
+
+// Create a directory handle that obtains listings from the supplied inode,
+// appending conflictSuffix to the names of files that conflict with
+// directories.
 func newDirHandle(
 	in inode.DirInode,
-	implicitDirs bool) (dh *dirHandle) {
+	implicitDirs bool,
+	conflictSuffix string) (dh *dirHandle) {
 	// Set up the basic struct.
 	dh = &dirHandle{
-		in:           in,
-		implicitDirs: implicitDirs,
+		in:             in,
+		implicitDirs:   implicitDirs,
+		conflictSuffix: conflictSuffix,
 	}
 
 	// Set up invariant checking.
@@ -76,166 +130,193 @@ func newDirHandle(
 // Helpers
 ////////////////////////////////////////////////////////////////////////
 
-// Dirents, sorted by name.
+// Return the name relative to the directory of the object or prefix that gave
+// rise to the supplied entry, by which GCS orders listings. For example, the
+// file "foo" sorts before "foo-bar", which sorts before the directory "foo".
+func entryKey(e *fuseutil.Dirent) string {
+	if e.Type == fuseutil.DT_Directory {
+		return e.Name + "/"
+	}
+
+	return e.Name
+}
+
+// Dirents, sorted by key.
 type sortedDirents []fuseutil.Dirent
 
 func (p sortedDirents) Len() int           { return len(p) }
-func (p sortedDirents) Less(i, j int) bool { return p[i].Name < p[j].Name }
+func (p sortedDirents) Less(i, j int) bool { return entryKey(&p[i]) < entryKey(&p[j]) }
 func (p sortedDirents) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
 func (dh *dirHandle) checkInvariants() {
-	// INVARIANT: For each i, entries[i+1].Offset == entries[i].Offset + 1
-	for i := 0; i < len(dh.entries)-1; i++ {
-		if !(dh.entries[i+1].Offset == dh.entries[i].Offset+1) {
+	// INVARIANT: For each i, buffered[i].Offset == bufferStart + i + 1
+	for i, e := range dh.buffered {
+		if e.Offset != dh.bufferStart+fuseops.DirOffset(i)+1 {
 			panic(
 				fmt.Sprintf(
-					"Unexpected offset sequence: %v, %v",
-					dh.entries[i].Offset,
-					dh.entries[i+1].Offset))
+					"Unexpected offset %v at index %d after %v",
+					e.Offset,
+					i,
+					dh.bufferStart))
 		}
 	}
 
-	// INVARIANT: If !entriesValid, then len(entries) == 0
-	if !dh.entriesValid && len(dh.entries) != 0 {
-		panic("Unexpected non-empty entries slice")
+	// INVARIANT: Sorted by entryKey
+	if !sort.IsSorted(sortedDirents(dh.pending)) {
+		panic("Unsorted pending entries")
 	}
-}
 
-// Resolve name conflicts between file objects and directory objects (e.g. the
-// objects "foo/bar" and "foo/bar/") by appending U+000A, which is illegal in
-// GCS object names, to conflicting file names.
-//
-// Input must be sorted by name.
-func fixConflictingNames(entries []fuseutil.Dirent) (err error) {
-	// Sanity check.
-	if !sort.IsSorted(sortedDirents(entries)) {
-		err = fmt.Errorf("Expected sorted input")
-		return
+	// INVARIANT: If done, then tok == ""
+	if dh.done && dh.tok != "" {
+		panic(fmt.Sprintf("Unexpected token for finished listing: %q", dh.tok))
 	}
 
-	// Examine each adjacent pair of names.
-	for i, _ := range entries {
-		e := &entries[i]
-
-		// Find the previous entry.
-		if i == 0 {
-			continue
+	// INVARIANT: Sorted by offset
+	// INVARIANT: For each c, c.offset <= bufferStart + len(buffered)
+	end := dh.bufferStart + fuseops.DirOffset(len(dh.buffered))
+	for i, c := range dh.checkpoints {
+		if i > 0 && c.offset < dh.checkpoints[i-1].offset {
+			panic(fmt.Sprintf("Unsorted checkpoints at index %d", i))
 		}
 
-		prev := &entries[i-1]
-
-		// Does the pair have matching names?
-		if e.Name != prev.Name {
-			continue
+		if c.offset > end {
+			panic(fmt.Sprintf("Checkpoint offset %v past end %v", c.offset, end))
 		}
+	}
+}
 
-		// We expect exactly one to be a directory.
-		eIsDir := e.Type == fuseutil.DT_Directory
-		prevIsDir := prev.Type == fuseutil.DT_Directory
-
-		if eIsDir == prevIsDir {
-			err = fmt.Errorf(
-				"Weird dirent type pair for name %q: %v, %v",
-				e.Name,
-				e.Type,
-				prev.Type)
-
+// Resolve a name conflict between a file object and a directory object (e.g.
+// the objects "foo/bar" and "foo/bar/") by appending the conflict suffix,
+// U+000A by default, to the file's name. The file, if any, must be among those
+// pending.
+//
+// LOCKS_REQUIRED(dh.Mu)
+func (dh *dirHandle) fixConflictingName(dirName string) {
+	for i := range dh.pending {
+		e := &dh.pending[i]
+		if e.Name == dirName && e.Type != fuseutil.DT_Directory {
+			e.Name += dh.conflictSuffix
 			return
 		}
+	}
+}
 
-		// Repair whichever is not the directory.
-		if eIsDir {
-			prev.Name += inode.ConflictingFileNameSuffix
-		} else {
-			e.Name += inode.ConflictingFileNameSuffix
-		}
+// Forget all progress, so that the next read starts the listing over.
+//
+// LOCKS_REQUIRED(dh.Mu)
+func (dh *dirHandle) reset() {
+	dh.buffered = nil
+	dh.bufferStart = 0
+	dh.pending = nil
+	dh.tok = ""
+	dh.done = false
+	dh.seen = ""
+	dh.checkpoints = nil
+}
+
+// Return to the latest checkpoint at or before the given offset, so that
+// reading continues from there. If there is none, start over.
+//
+// LOCKS_REQUIRED(dh.Mu)
+func (dh *dirHandle) restore(offset fuseops.DirOffset) {
+	i := sort.Search(len(dh.checkpoints), func(i int) bool {
+		return dh.checkpoints[i].offset > offset
+	}) - 1
+
+	if i < 0 {
+		dh.reset()
+		return
 	}
 
-	return
+	// Checkpoints from here on will be recorded again as we re-read.
+	c := dh.checkpoints[i]
+	dh.checkpoints = dh.checkpoints[:i]
+
+	dh.buffered = nil
+	dh.bufferStart = c.offset
+	dh.pending = c.pending
+	dh.tok = c.tok
+	dh.done = false
+	dh.seen = c.seen
 }
 
-// Read all entries for the directory, fix up conflicting names, and fill in
-// offset fields.
+// Read the next batch of entries from the inode, moving those that are
+// settled to the buffer. Must not be called once the listing is done and
+// nothing is pending.
 //
-// LOCKS_REQUIRED(in)
-func readAllEntries(
-	ctx context.Context,
-	in inode.DirInode) (entries []fuseutil.Dirent, err error) {
-	// Read one batch at a time.
-	var tok string
-	for {
-		// Read a batch.
+// LOCKS_REQUIRED(dh.Mu)
+// LOCKS_EXCLUDED(dh.in)
+func (dh *dirHandle) fetch(ctx context.Context) (err error) {
+	if !dh.done {
 		var batch []fuseutil.Dirent
+		var tok string
+		dh.in.Lock()
+		batch, tok, err = dh.in.ReadEntries(ctx, dh.tok)
+		dh.in.Unlock()
 
-		batch, tok, err = in.ReadEntries(ctx, tok)
 		if err != nil {
 			err = fmt.Errorf("ReadEntries: %v", err)
 			return
 		}
 
-		// Accumulate.
-		entries = append(entries, batch...)
-
-		// Are we done?
-		if tok == "" {
-			break
+		// Remember how to get back here. The pending entries are copied because
+		// we modify them in place below.
+		dh.checkpoints = append(dh.checkpoints, dirCheckpoint{
+			offset:  dh.bufferStart + fuseops.DirOffset(len(dh.buffered)),
+			tok:     dh.tok,
+			pending: append([]fuseutil.Dirent(nil), dh.pending...),
+			seen:    dh.seen,
+		})
+
+		dh.tok = tok
+		dh.done = tok == ""
+
+		// GCS lists a page in order of object names, files and prefixes
+		// separately. Merge them, and resolve conflicts between them.
+		sort.Sort(sortedDirents(batch))
+		for _, e := range batch {
+			if e.Type == fuseutil.DT_Directory {
+				dh.fixConflictingName(e.Name)
+			}
+
+			dh.pending = append(dh.pending, e)
+			if k := entryKey(&e); k > dh.seen {
+				dh.seen = k
+			}
 		}
 	}
 
-	// Ensure that the entries are sorted, for use in fixConflictingNames
-	// below.
-	sort.Sort(sortedDirents(entries))
-
-	// Fix name conflicts.
-	err = fixConflictingNames(entries)
-	if err != nil {
-		err = fmt.Errorf("fixConflictingNames: %v", err)
-		return
-	}
-
-	// Fix up offset fields.
-	for i := 0; i < len(entries); i++ {
-		entries[i].Offset = fuseops.DirOffset(i) + 1
-	}
-
-	// Return a bogus inode ID for each entry, but not the root inode ID.
-	//
-	// NOTE(jacobsa): As far as I can tell this is harmless. Minting and
-	// returning a real inode ID is difficult because fuse does not count
-	// readdir as an operation that increases the inode ID's lookup count and
-	// we therefore don't get a forget for it later, but we would like to not
-	// have to remember every inode ID that we've ever minted for readdir.
-	//
-	// If it turns out this is not harmless, we'll need to switch to something
-	// like inode IDs based on (object name, generation) hashes. But then what
-	// about the birthday problem? And more importantly, what about our
-	// semantic of not minting a new inode ID when the generation changes due
-	// to a local action?
-	for i, _ := range entries {
-		entries[i].Inode = fuseops.RootInodeID + 1
-	}
-
-	return
-}
+	// Release each entry that can no longer be affected by a later directory,
+	// leaving the rest pending. Everything with a key up to dh.seen has been
+	// read.
+	var held []fuseutil.Dirent
+	for _, e := range dh.pending {
+		if !dh.done && e.Type != fuseutil.DT_Directory && e.Name+"/" > dh.seen {
+			held = append(held, e)
+			continue
+		}
 
-// LOCKS_REQUIRED(dh.Mu)
-// LOCKS_EXCLUDED(dh.in)
-func (dh *dirHandle) ensureEntries(ctx context.Context) (err error) {
-	dh.in.Lock()
-	defer dh.in.Unlock()
-
-	// Read entries.
-	var entries []fuseutil.Dirent
-	entries, err = readAllEntries(ctx, dh.in)
-	if err != nil {
-		err = fmt.Errorf("readAllEntries: %v", err)
-		return
+		e.Offset = dh.bufferStart + fuseops.DirOffset(len(dh.buffered)) + 1
+
+		// Return a bogus inode ID for each entry, but not the root inode ID.
+		//
+		// NOTE(jacobsa): As far as I can tell this is harmless. Minting and
+		// returning a real inode ID is difficult because fuse does not count
+		// readdir as an operation that increases the inode ID's lookup count and
+		// we therefore don't get a forget for it later, but we would like to not
+		// have to remember every inode ID that we've ever minted for readdir.
+		//
+		// If it turns out this is not harmless, we'll need to switch to something
+		// like inode IDs based on (object name, generation) hashes. But then what
+		// about the birthday problem? And more importantly, what about our
+		// semantic of not minting a new inode ID when the generation changes due
+		// to a local action?
+		e.Inode = fuseops.RootInodeID + 1
+
+		dh.buffered = append(dh.buffered, e)
 	}
 
-	// Update state.
-	dh.entries = entries
-	dh.entriesValid = true
-
+	dh.pending = held
 	return
 }
 
@@ -247,39 +328,58 @@ func (dh *dirHandle) ensureEntries(ctx context.Context) (err error) {
 //
 // Special case: we assume that a zero offset indicates that rewinddir has been
 // called (since fuse gives us no way to intercept and know for sure), and
-// start the listing process over again.
+// start the listing process over again. An offset before the entries we have
+// buffered (as from seekdir, or a listing restarted by the kernel) is instead
+// found again by resuming from the continuation token for the page that
+// contained it.
 //
 // LOCKS_REQUIRED(dh.Mu)
 // LOCKS_EXCLUDED(du.in)
 func (dh *dirHandle) ReadDir(
 	ctx context.Context,
 	op *fuseops.ReadDirOp) (err error) {
-	// If the request is for offset zero, we assume that either this is the first
-	// call or rewinddir has been called. Reset state.
-	if op.Offset == 0 {
-		dh.entries = nil
-		dh.entriesValid = false
+	switch {
+	case op.Offset == 0:
+		dh.reset()
+
+	case op.Offset < dh.bufferStart:
+		dh.restore(op.Offset)
 	}
 
-	// Do we need to read entries from GCS?
-	if !dh.entriesValid {
-		err = dh.ensureEntries(ctx)
+	for {
+		// The kernel has consumed everything up to the requested offset, so we
+		// needn't keep it any longer.
+		if consumed := int(op.Offset - dh.bufferStart); consumed > 0 {
+			if consumed > len(dh.buffered) {
+				consumed = len(dh.buffered)
+			}
+
+			dh.buffered = dh.buffered[consumed:]
+			dh.bufferStart += fuseops.DirOffset(consumed)
+		}
+
+		// Stop once we have something to return, or there is nothing more.
+		if len(dh.buffered) > 0 || (dh.done && len(dh.pending) == 0) {
+			break
+		}
+
+		err = dh.fetch(ctx)
 		if err != nil {
 			return
 		}
 	}
 
-	// Is the offset past the end of what we have buffered? If so, this must be
-	// an invalid seekdir according to posix.
-	index := int(op.Offset)
-	if index > len(dh.entries) {
+	// Is the offset past the end of the directory? If so, this must be an
+	// invalid seekdir according to posix.
+	if op.Offset > dh.bufferStart {
 		err = fuse.EINVAL
 		return
 	}
 
-	// We copy out entries until we run out of entries or space.
-	for i := index; i < len(dh.entries); i++ {
-		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], dh.entries[i])
+	// We copy out entries until we run out of entries or space. We hold on to
+	// them until the next call tells us how many the kernel consumed.
+	for _, e := range dh.buffered {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], e)
 		if n == 0 {
 			break
 		}
@@ -0,0 +1,374 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"testing"
+	"unsafe"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestDirHandle(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A directory inode that returns canned pages of entries, each page's files
+// before its directories as with a real listing.
+type pagedDirInode struct {
+	inode.DirInode
+	pages [][]fuseutil.Dirent
+
+	// The number of calls to ReadEntries.
+	reads int
+}
+
+func (d *pagedDirInode) Lock()   {}
+func (d *pagedDirInode) Unlock() {}
+
+func (d *pagedDirInode) ReadEntries(
+	ctx context.Context,
+	tok string) (entries []fuseutil.Dirent, newTok string, err error) {
+	d.reads++
+
+	var i int
+	if tok != "" {
+		fmt.Sscanf(tok, "%d", &i)
+	}
+
+	entries = append(entries, d.pages[i]...)
+	if i+1 < len(d.pages) {
+		newTok = fmt.Sprintf("%d", i+1)
+	}
+
+	return
+}
+
+func file(name string) fuseutil.Dirent {
+	return fuseutil.Dirent{Name: name, Type: fuseutil.DT_File}
+}
+
+func dir(name string) fuseutil.Dirent {
+	return fuseutil.Dirent{Name: name, Type: fuseutil.DT_Directory}
+}
+
+type DirHandleTest struct {
+	ctx context.Context
+	in  pagedDirInode
+	dh  *dirHandle
+}
+
+func init() { RegisterTestSuite(&DirHandleTest{}) }
+
+func (t *DirHandleTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.dh = newDirHandle(&t.in, false, inode.ConflictingFileNameSuffix)
+	t.dh.Mu.Lock()
+}
+
+func (t *DirHandleTest) TearDown() {
+	t.dh.Mu.Unlock()
+}
+
+// Read from the given offset into a buffer of the given size, returning the
+// names and offsets of the entries that fit.
+func (t *DirHandleTest) readDir(
+	offset fuseops.DirOffset,
+	size int) (names []string, offsets []fuseops.DirOffset, err error) {
+	op := &fuseops.ReadDirOp{
+		Offset: offset,
+		Dst:    make([]byte, size),
+	}
+
+	err = t.dh.ReadDir(t.ctx, op)
+	if err != nil {
+		return
+	}
+
+	// Parse fuse_dirent structs, which are in the machine's byte order.
+	buf := op.Dst[:op.BytesRead]
+	for len(buf) > 0 {
+		off := *(*uint64)(unsafe.Pointer(&buf[8]))
+		namelen := int(*(*uint32)(unsafe.Pointer(&buf[16])))
+		names = append(names, string(buf[24:24+namelen]))
+		offsets = append(offsets, fuseops.DirOffset(off))
+
+		n := 24 + namelen
+		if n%8 != 0 {
+			n += 8 - n%8
+		}
+
+		buf = buf[n:]
+	}
+
+	return
+}
+
+// Read the whole directory with the given buffer size, the way the kernel
+// does.
+func (t *DirHandleTest) readAll(size int) (names []string, err error) {
+	var offset fuseops.DirOffset
+	for {
+		var tmp []string
+		var offsets []fuseops.DirOffset
+		tmp, offsets, err = t.readDir(offset, size)
+		if err != nil || len(tmp) == 0 {
+			return
+		}
+
+		names = append(names, tmp...)
+		offset = offsets[len(offsets)-1]
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DirHandleTest) EmptyDirectory() {
+	t.in.pages = [][]fuseutil.Dirent{{}}
+
+	names, err := t.readAll(4096)
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre())
+}
+
+func (t *DirHandleTest) MultiplePages() {
+	t.in.pages = [][]fuseutil.Dirent{
+		{file("a"), file("b"), dir("c")},
+		{file("d")},
+		{dir("e"), dir("f")},
+	}
+
+	names, err := t.readAll(4096)
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("a", "b", "c", "d", "e", "f"))
+}
+
+func (t *DirHandleTest) PagesFetchedLazily() {
+	t.in.pages = [][]fuseutil.Dirent{
+		{file("a"), dir("b")},
+		{file("c"), file("d")},
+	}
+
+	// The first read needs only the first page.
+	names, offsets, err := t.readDir(0, 4096)
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("a", "b"))
+	ExpectThat(offsets, ElementsAre(1, 2))
+	ExpectEq(1, t.in.reads)
+
+	// Once the kernel moves on, the entries it has consumed are dropped.
+	names, offsets, err = t.readDir(2, 4096)
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("c", "d"))
+	ExpectThat(offsets, ElementsAre(3, 4))
+	ExpectEq(2, t.in.reads)
+	ExpectEq(2, t.dh.bufferStart)
+}
+
+func (t *DirHandleTest) SmallBuffer() {
+	t.in.pages = [][]fuseutil.Dirent{
+		{file("a"), file("b"), file("c")},
+		{file("d"), file("e")},
+	}
+
+	// Room for one entry at a time.
+	names, err := t.readAll(32)
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("a", "b", "c", "d", "e"))
+}
+
+func (t *DirHandleTest) RereadFromEarlierOffset() {
+	t.in.pages = [][]fuseutil.Dirent{
+		{file("a"), dir("b")},
+		{file("c"), file("d")},
+	}
+
+	_, _, err := t.readDir(0, 4096)
+	AssertEq(nil, err)
+	_, _, err = t.readDir(2, 4096)
+	AssertEq(nil, err)
+
+	// Going back before what's buffered starts over.
+	names, offsets, err := t.readDir(1, 4096)
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("b"))
+	ExpectThat(offsets, ElementsAre(2))
+}
+
+func (t *DirHandleTest) SeekResumesFromContainingPage() {
+	t.in.pages = [][]fuseutil.Dirent{
+		{dir("a"), dir("b")},
+		{dir("c"), dir("d")},
+		{dir("e"), dir("f")},
+	}
+
+	names, err := t.readAll(4096)
+	AssertEq(nil, err)
+	AssertThat(names, ElementsAre("a", "b", "c", "d", "e", "f"))
+	AssertEq(3, t.in.reads)
+
+	// Entries in the first page have changed since, but that shouldn't affect
+	// where the offset for "c" leads.
+	t.in.pages[0] = []fuseutil.Dirent{dir("0"), dir("a"), dir("b")}
+	t.in.reads = 0
+
+	names, offsets, err := t.readDir(3, 4096)
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("d"))
+	ExpectThat(offsets, ElementsAre(4))
+
+	// Only the page containing the offset was listed again.
+	ExpectEq(1, t.in.reads)
+}
+
+func (t *DirHandleTest) SeekWithPendingEntries() {
+	t.in.pages = [][]fuseutil.Dirent{
+		{file("a"), file("b")},
+		{file("b-c")},
+		{dir("b"), file("d")},
+	}
+
+	names, err := t.readAll(4096)
+	AssertEq(nil, err)
+	AssertThat(
+		names,
+		ElementsAre("a", "b"+inode.ConflictingFileNameSuffix, "b-c", "b", "d"))
+
+	// The file "b" was still pending when the last page was fetched, so
+	// resuming there must bring it back along with its conflict.
+	t.in.reads = 0
+
+	names, offsets, err := t.readDir(1, 4096)
+	AssertEq(nil, err)
+	ExpectThat(
+		names,
+		ElementsAre("b"+inode.ConflictingFileNameSuffix, "b-c", "b", "d"))
+	ExpectThat(offsets, ElementsAre(2, 3, 4, 5))
+	ExpectEq(1, t.in.reads)
+}
+
+func (t *DirHandleTest) RewindListsAfresh() {
+	t.in.pages = [][]fuseutil.Dirent{
+		{dir("a")},
+		{dir("b")},
+	}
+
+	names, err := t.readAll(4096)
+	AssertEq(nil, err)
+	AssertThat(names, ElementsAre("a", "b"))
+
+	t.in.pages[0] = []fuseutil.Dirent{dir("0"), dir("a")}
+
+	names, err = t.readAll(4096)
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("0", "a", "b"))
+}
+
+func (t *DirHandleTest) OffsetPastEnd() {
+	t.in.pages = [][]fuseutil.Dirent{{file("a")}}
+
+	_, _, err := t.readDir(0, 4096)
+	AssertEq(nil, err)
+
+	_, _, err = t.readDir(2, 4096)
+	ExpectThat(err, Error(HasSubstr("invalid argument")))
+}
+
+func (t *DirHandleTest) ConflictWithinPage() {
+	t.in.pages = [][]fuseutil.Dirent{
+		{file("foo"), file("foo-bar"), dir("foo")},
+	}
+
+	names, err := t.readAll(4096)
+	AssertEq(nil, err)
+	ExpectThat(
+		names,
+		ElementsAre("foo"+inode.ConflictingFileNameSuffix, "foo-bar", "foo"))
+}
+
+func (t *DirHandleTest) ConflictWithCustomSuffix() {
+	t.dh.Mu.Unlock()
+	t.dh = newDirHandle(&t.in, false, ".file")
+	t.dh.Mu.Lock()
+
+	t.in.pages = [][]fuseutil.Dirent{
+		{file("foo"), file("foo-bar"), dir("foo")},
+	}
+
+	names, err := t.readAll(4096)
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("foo.file", "foo-bar", "foo"))
+}
+
+func (t *DirHandleTest) HeldFileDoesntHoldBackOthers() {
+	t.in.pages = [][]fuseutil.Dirent{
+		{file("a"), file("a-1")},
+		{file("a-2")},
+		{file("a-3")},
+		{dir("b")},
+	}
+
+	// The file "a" must wait for the directory "a" to be ruled out, but the
+	// files after it needn't.
+	names, _, err := t.readDir(0, 4096)
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("a-1"))
+	ExpectEq(2, t.in.reads)
+	ExpectEq(2, len(t.dh.pending))
+
+	names, _, err = t.readDir(1, 4096)
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("a-2"))
+	ExpectEq(2, len(t.dh.pending))
+
+	names, err = t.readAll(4096)
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("a-1", "a-2", "a", "a-3", "b"))
+}
+
+func (t *DirHandleTest) ConflictAcrossPages() {
+	t.in.pages = [][]fuseutil.Dirent{
+		{file("bar"), file("foo")},
+		{file("foo-bar")},
+		{dir("foo"), file("qux")},
+	}
+
+	// The file "foo" can't be returned until we know whether the directory
+	// follows.
+	names, _, err := t.readDir(0, 4096)
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("bar"))
+
+	names, err = t.readAll(4096)
+	AssertEq(nil, err)
+	ExpectThat(
+		names,
+		ElementsAre(
+			"bar",
+			"foo"+inode.ConflictingFileNameSuffix,
+			"foo-bar",
+			"foo",
+			"qux"))
+}
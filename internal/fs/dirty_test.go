@@ -0,0 +1,107 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const dirtyLimit = 10
+
+type DirtyLimitTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&DirtyLimitTest{}) }
+
+func (t *DirtyLimitTest) SetUp(ti *TestInfo) {
+	t.serverCfg.MaxDirtyBytes = dirtyLimit
+
+	// Have each write reach the file system as it's made.
+	t.mountCfg.DisableWritebackCaching = true
+
+	t.fsTest.SetUp(ti)
+}
+
+// Write the supplied contents to the end of the file, failing the test if
+// that takes more than a second.
+func (t *DirtyLimitTest) write(f *os.File, s string) {
+	c := make(chan error, 1)
+	go func() {
+		_, err := f.Write([]byte(s))
+		c <- err
+	}()
+
+	select {
+	case err := <-c:
+		AssertEq(nil, err)
+
+	case <-time.After(time.Second):
+		AddFailure("Write to %s blocked", path.Base(f.Name()))
+		AbortTest()
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DirtyLimitTest) InterleavedWritesToTwoFiles() {
+	var err error
+
+	t.f1, err = os.Create(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	t.f2, err = os.Create(path.Join(t.Dir, "bar"))
+	AssertEq(nil, err)
+
+	// Alternate between the files until both are well over the limit. Each
+	// write to bar while foo has been dirty longer must write foo back first.
+	for i := 0; i < 3; i++ {
+		t.write(t.f1, "taco")
+		t.write(t.f2, "burrito")
+	}
+
+	// Some of foo has made it to GCS without the file being closed.
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectNe("", string(contents))
+
+	// Closing both writes them out in full.
+	err = t.f1.Close()
+	t.f1 = nil
+	AssertEq(nil, err)
+
+	err = t.f2.Close()
+	t.f2 = nil
+	AssertEq(nil, err)
+
+	contents, err = gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("tacotacotaco", string(contents))
+
+	contents, err = gcsutil.ReadObject(t.ctx, t.bucket, "bar")
+	AssertEq(nil, err)
+	ExpectEq("burritoburritoburrito", string(contents))
+}
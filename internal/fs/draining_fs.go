@@ -0,0 +1,133 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"golang.org/x/net/context"
+)
+
+// Wrap the supplied file system so that the ops that would modify it fail
+// with EROFS once the admin has begun draining it. Other ops, including those
+// that write out files already modified, pass through.
+func newDrainingFileSystem(
+	wrapped fuseutil.FileSystem,
+	admin *Admin) fuseutil.FileSystem {
+	return &drainingFileSystem{
+		FileSystem: wrapped,
+		admin:      admin,
+	}
+}
+
+type drainingFileSystem struct {
+	fuseutil.FileSystem
+	admin *Admin
+}
+
+// Call f unless the file system is being drained.
+func (fs *drainingFileSystem) modify(f func() error) (err error) {
+	if !fs.admin.startModification() {
+		err = syscall.EROFS
+		return
+	}
+
+	defer fs.admin.finishModification()
+
+	err = f()
+	return
+}
+
+func (fs *drainingFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return fs.modify(func() error {
+		return fs.FileSystem.SetInodeAttributes(ctx, op)
+	})
+}
+
+func (fs *drainingFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	return fs.modify(func() error { return fs.FileSystem.MkDir(ctx, op) })
+}
+
+func (fs *drainingFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	return fs.modify(func() error { return fs.FileSystem.MkNode(ctx, op) })
+}
+
+func (fs *drainingFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	return fs.modify(func() error { return fs.FileSystem.CreateFile(ctx, op) })
+}
+
+func (fs *drainingFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	return fs.modify(func() error { return fs.FileSystem.CreateSymlink(ctx, op) })
+}
+
+func (fs *drainingFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	return fs.modify(func() error { return fs.FileSystem.CreateLink(ctx, op) })
+}
+
+func (fs *drainingFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return fs.modify(func() error { return fs.FileSystem.Rename(ctx, op) })
+}
+
+func (fs *drainingFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return fs.modify(func() error { return fs.FileSystem.RmDir(ctx, op) })
+}
+
+func (fs *drainingFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return fs.modify(func() error { return fs.FileSystem.Unlink(ctx, op) })
+}
+
+func (fs *drainingFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return fs.modify(func() error { return fs.FileSystem.WriteFile(ctx, op) })
+}
+
+func (fs *drainingFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	return fs.modify(func() error { return fs.FileSystem.CopyFileRange(ctx, op) })
+}
+
+func (fs *drainingFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	return fs.modify(func() error { return fs.FileSystem.RemoveXattr(ctx, op) })
+}
+
+func (fs *drainingFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	return fs.modify(func() error { return fs.FileSystem.SetXattr(ctx, op) })
+}
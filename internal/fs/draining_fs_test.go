@@ -0,0 +1,128 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestDrainingFileSystem(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A file system whose writes wait until release is closed.
+type blockingFileSystem struct {
+	fuseutil.NotImplementedFileSystem
+	started chan struct{}
+	release chan struct{}
+}
+
+func (fs *blockingFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) (err error) {
+	close(fs.started)
+	<-fs.release
+	return
+}
+
+type DrainingFileSystemTest struct {
+	ctx     context.Context
+	admin   *Admin
+	wrapped blockingFileSystem
+	fs      fuseutil.FileSystem
+}
+
+var _ SetUpInterface = &DrainingFileSystemTest{}
+
+func init() { RegisterTestSuite(&DrainingFileSystemTest{}) }
+
+func (t *DrainingFileSystemTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.admin = NewAdmin()
+	t.wrapped.started = make(chan struct{})
+	t.wrapped.release = make(chan struct{})
+	t.fs = newDrainingFileSystem(&t.wrapped, t.admin)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DrainingFileSystemTest) PassesThroughUntilDrained() {
+	err := t.fs.MkDir(t.ctx, &fuseops.MkDirOp{})
+	ExpectEq(fuse.ENOSYS, err)
+}
+
+func (t *DrainingFileSystemTest) RefusesModificationsOnceDrained() {
+	err := t.admin.Drain(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectEq(syscall.EROFS, t.fs.MkDir(t.ctx, &fuseops.MkDirOp{}))
+	ExpectEq(syscall.EROFS, t.fs.Unlink(t.ctx, &fuseops.UnlinkOp{}))
+	ExpectEq(syscall.EROFS, t.fs.WriteFile(t.ctx, &fuseops.WriteFileOp{}))
+
+	// Reading and writing out files still works.
+	ExpectEq(fuse.ENOSYS, t.fs.ReadFile(t.ctx, &fuseops.ReadFileOp{}))
+	ExpectEq(fuse.ENOSYS, t.fs.SyncFile(t.ctx, &fuseops.SyncFileOp{}))
+}
+
+func (t *DrainingFileSystemTest) WaitsForModificationsInProgress() {
+	go t.fs.WriteFile(t.ctx, &fuseops.WriteFileOp{})
+	<-t.wrapped.started
+
+	// Draining doesn't finish while the write is in progress.
+	ctx, cancel := context.WithTimeout(t.ctx, 10*time.Millisecond)
+	defer cancel()
+
+	err := t.admin.Drain(ctx)
+	ExpectTrue(err == context.DeadlineExceeded, "err: %v", err)
+
+	// It does afterward.
+	close(t.wrapped.release)
+	err = t.admin.Drain(t.ctx)
+	ExpectEq(nil, err)
+}
+
+func (t *DrainingFileSystemTest) AcceptsModificationsOnceResumed() {
+	err := t.admin.Drain(t.ctx)
+	AssertEq(nil, err)
+
+	t.admin.Resume()
+	ExpectEq(fuse.ENOSYS, t.fs.MkDir(t.ctx, &fuseops.MkDirOp{}))
+}
+
+func (t *DrainingFileSystemTest) StaysDrainedUntilEachDrainResumed() {
+	err := t.admin.Drain(t.ctx)
+	AssertEq(nil, err)
+
+	err = t.admin.Drain(t.ctx)
+	AssertEq(nil, err)
+
+	t.admin.Resume()
+	ExpectEq(syscall.EROFS, t.fs.MkDir(t.ctx, &fuseops.MkDirOp{}))
+
+	t.admin.Resume()
+	ExpectEq(fuse.ENOSYS, t.fs.MkDir(t.ctx, &fuseops.MkDirOp{}))
+}
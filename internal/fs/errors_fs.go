@@ -0,0 +1,403 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"log"
+	"runtime/debug"
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/syncutil"
+	"golang.org/x/net/context"
+)
+
+// Wrap the supplied file system to decide which errors the kernel sees, which
+// must be errnos to mean anything more specific than EIO:
+//
+//  *  An op that fails because of an error from GCS, wrapped in explanatory
+//     text along the way, fails with the errno that gcsx.Errno gives for it,
+//     if any. The bucket must be wrapped with gcsx.NewErrnoBucket for this.
+//
+//  *  An op that panics, e.g. because it found an inode ID it doesn't know,
+//     fails with EIO rather than taking the whole mount down with it. The
+//     panic is logged along with its stack.
+//
+// Recovering from panics is a last resort: the file system may be left
+// inconsistent, and a panic that leaves a lock held will wedge the ops that
+// need it. But other files usually remain usable, and dirty ones can still be
+// written out.
+//
+// When invariant checking is enabled, panics are not recovered from: a
+// syncutil.InvariantMutex whose check fails panics with the lock still held,
+// and the point of checking is to stop at the first violation anyway.
+func newErrorsFileSystem(
+	wrapped fuseutil.FileSystem) fuseutil.FileSystem {
+	return &errorsFileSystem{
+		FileSystem: wrapped,
+	}
+}
+
+type errorsFileSystem struct {
+	fuseutil.FileSystem
+}
+
+// Deferred by each op, with the recorder carried by the context it passed on.
+func (fs *errorsFileSystem) finish(
+	name string,
+	rec *gcsx.ErrorRecorder,
+	err *error) {
+	// If the op is panicking, log the panic and make the op fail with EIO
+	// instead.
+	if !syncutil.InvariantCheckingEnabled() {
+		if r := recover(); r != nil {
+			log.Printf(
+				"%s panicked, returning EIO: %v\n%s", name, r, debug.Stack())
+			*err = syscall.EIO
+			return
+		}
+	}
+
+	// Leave alone errors that are already errnos.
+	if *err == nil {
+		return
+	}
+
+	if _, ok := (*err).(syscall.Errno); ok {
+		return
+	}
+
+	// Otherwise, find the errno for the GCS error that caused it, if any. The
+	// errno alone loses the explanation, so log that here.
+	errno, ok := rec.Errno(*err)
+	if !ok {
+		return
+	}
+
+	log.Printf("%s failed with %v: %v", name, errno, *err)
+	*err = errno
+}
+
+func (fs *errorsFileSystem) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("StatFS", rec, &err)
+
+	err = fs.FileSystem.StatFS(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("LookUpInode", rec, &err)
+
+	err = fs.FileSystem.LookUpInode(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("GetInodeAttributes", rec, &err)
+
+	err = fs.FileSystem.GetInodeAttributes(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("SetInodeAttributes", rec, &err)
+
+	err = fs.FileSystem.SetInodeAttributes(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("ForgetInode", rec, &err)
+
+	err = fs.FileSystem.ForgetInode(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("MkDir", rec, &err)
+
+	err = fs.FileSystem.MkDir(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("MkNode", rec, &err)
+
+	err = fs.FileSystem.MkNode(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("CreateFile", rec, &err)
+
+	err = fs.FileSystem.CreateFile(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("CreateSymlink", rec, &err)
+
+	err = fs.FileSystem.CreateSymlink(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("CreateLink", rec, &err)
+
+	err = fs.FileSystem.CreateLink(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("Rename", rec, &err)
+
+	err = fs.FileSystem.Rename(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("RmDir", rec, &err)
+
+	err = fs.FileSystem.RmDir(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("Unlink", rec, &err)
+
+	err = fs.FileSystem.Unlink(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("OpenDir", rec, &err)
+
+	err = fs.FileSystem.OpenDir(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("ReadDir", rec, &err)
+
+	err = fs.FileSystem.ReadDir(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("ReleaseDirHandle", rec, &err)
+
+	err = fs.FileSystem.ReleaseDirHandle(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("OpenFile", rec, &err)
+
+	err = fs.FileSystem.OpenFile(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("ReadFile", rec, &err)
+
+	err = fs.FileSystem.ReadFile(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("WriteFile", rec, &err)
+
+	err = fs.FileSystem.WriteFile(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("SyncFile", rec, &err)
+
+	err = fs.FileSystem.SyncFile(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("FlushFile", rec, &err)
+
+	err = fs.FileSystem.FlushFile(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("ReleaseFileHandle", rec, &err)
+
+	err = fs.FileSystem.ReleaseFileHandle(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("CopyFileRange", rec, &err)
+
+	err = fs.FileSystem.CopyFileRange(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) SeekFile(
+	ctx context.Context,
+	op *fuseops.SeekFileOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("SeekFile", rec, &err)
+
+	err = fs.FileSystem.SeekFile(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) GetFileLock(
+	ctx context.Context,
+	op *fuseops.GetFileLockOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("GetFileLock", rec, &err)
+
+	err = fs.FileSystem.GetFileLock(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) SetFileLock(
+	ctx context.Context,
+	op *fuseops.SetFileLockOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("SetFileLock", rec, &err)
+
+	err = fs.FileSystem.SetFileLock(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("ReadSymlink", rec, &err)
+
+	err = fs.FileSystem.ReadSymlink(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("RemoveXattr", rec, &err)
+
+	err = fs.FileSystem.RemoveXattr(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("GetXattr", rec, &err)
+
+	err = fs.FileSystem.GetXattr(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("ListXattr", rec, &err)
+
+	err = fs.FileSystem.ListXattr(ctx, op)
+	return
+}
+
+func (fs *errorsFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) (err error) {
+	ctx, rec := gcsx.WithErrorRecorder(ctx)
+	defer fs.finish("SetXattr", rec, &err)
+
+	err = fs.FileSystem.SetXattr(ctx, op)
+	return
+}
@@ -0,0 +1,112 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestErrorsFileSystem(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A file system that panics when looking up inodes, and that stats the
+// object named by the op's name when making a directory, failing with the
+// resulting error in explanatory text.
+type brokenFileSystem struct {
+	fuseutil.NotImplementedFileSystem
+	bucket gcs.Bucket
+}
+
+func (fs *brokenFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	panic("taco")
+}
+
+func (fs *brokenFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) (err error) {
+	_, err = fs.bucket.StatObject(ctx, &gcs.StatObjectRequest{Name: op.Name})
+	if err != nil {
+		err = fmt.Errorf("StatObject: %v", err)
+		return
+	}
+
+	err = errors.New("Something else went wrong")
+	return
+}
+
+type ErrorsFileSystemTest struct {
+	ctx     context.Context
+	wrapped brokenFileSystem
+	fs      fuseutil.FileSystem
+}
+
+var _ SetUpInterface = &ErrorsFileSystemTest{}
+
+func init() { RegisterTestSuite(&ErrorsFileSystemTest{}) }
+
+func (t *ErrorsFileSystemTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+
+	bucket := gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+	_, err := gcsutil.CreateObject(t.ctx, bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	t.wrapped.bucket = gcsx.NewErrnoBucket(bucket)
+	t.fs = newErrorsFileSystem(&t.wrapped)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ErrorsFileSystemTest) PanicBecomesEIO() {
+	err := t.fs.LookUpInode(t.ctx, &fuseops.LookUpInodeOp{})
+	ExpectEq(syscall.EIO, err)
+}
+
+func (t *ErrorsFileSystemTest) GCSErrorBecomesErrno() {
+	err := t.fs.MkDir(t.ctx, &fuseops.MkDirOp{Name: "bar"})
+	ExpectEq(syscall.ENOENT, err)
+}
+
+func (t *ErrorsFileSystemTest) OtherErrorsUnchanged() {
+	err := t.fs.MkDir(t.ctx, &fuseops.MkDirOp{Name: "foo"})
+	ExpectThat(err, Error(HasSubstr("Something else")))
+}
+
+func (t *ErrorsFileSystemTest) OtherOpsPassThrough() {
+	err := t.fs.GetInodeAttributes(t.ctx, &fuseops.GetInodeAttributesOp{})
+	ExpectEq(fuse.ENOSYS, err)
+}
@@ -0,0 +1,232 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"log"
+	"sync"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"golang.org/x/net/context"
+)
+
+// A flusher writes out dirty files to GCS with a fixed number of workers, so
+// that no more than that many uploads are in progress at once. Files that
+// somebody is waiting on because of fsync(2) or close(2) are taken ahead of
+// those being written back in the background.
+//
+// Safe for concurrent access.
+type flusher struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	// Write out the supplied inode, whose lock is held.
+	sync func(context.Context, inode.Inode) error
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	// Cancelled when the flusher is stopped.
+	ctx    context.Context
+	cancel func()
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// Signalled when a request is queued or the flusher is stopped.
+	ready *sync.Cond
+
+	// Requests that no worker has yet taken, at most one per inode. A request
+	// covers whatever is dirty when a worker takes it, so later callers join an
+	// existing one rather than queueing another.
+	//
+	// INVARIANT: queued contains exactly the requests in urgent and background,
+	// keyed by inode
+	// INVARIANT: For each r in urgent, r.urgent
+	// INVARIANT: For each r in background, !r.urgent
+	//
+	// GUARDED_BY(mu)
+	urgent     []*flushRequest
+	background []*flushRequest
+	queued     map[inode.Inode]*flushRequest
+
+	// GUARDED_BY(mu)
+	stopped bool
+}
+
+type flushRequest struct {
+	in     inode.Inode
+	urgent bool
+
+	// Closed once the inode has been written out, after which err is set.
+	done chan struct{}
+	err  error
+}
+
+// Create a flusher with the given number of workers, which must be positive.
+func newFlusher(
+	workers int,
+	syncInode func(context.Context, inode.Inode) error) (fl *flusher) {
+	fl = &flusher{
+		sync:   syncInode,
+		queued: make(map[inode.Inode]*flushRequest),
+	}
+
+	fl.ctx, fl.cancel = context.WithCancel(context.Background())
+	fl.ready = sync.NewCond(&fl.mu)
+
+	for i := 0; i < workers; i++ {
+		go fl.work()
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Public interface
+////////////////////////////////////////////////////////////////////////
+
+// Flush writes out the supplied inode ahead of any background writeback,
+// waiting until it has been or the context is cancelled.
+//
+// LOCKS_EXCLUDED(in)
+func (fl *flusher) Flush(ctx context.Context, in inode.Inode) (err error) {
+	fl.mu.Lock()
+	r := fl.enqueue(in, true)
+	fl.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+
+	case <-r.done:
+		err = r.err
+	}
+
+	return
+}
+
+// WriteBack arranges for the supplied inode to be written out once no more
+// urgent requests are waiting, without waiting for it. Failures are logged.
+func (fl *flusher) WriteBack(in inode.Inode) {
+	fl.mu.Lock()
+	fl.enqueue(in, false)
+	fl.mu.Unlock()
+}
+
+// Stop the workers, cancelling any uploads in progress. Requests still queued
+// are abandoned.
+func (fl *flusher) Stop() {
+	fl.cancel()
+
+	fl.mu.Lock()
+	fl.stopped = true
+	fl.ready.Broadcast()
+	fl.mu.Unlock()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Queue a request for the given inode, or join the one already queued,
+// promoting it if the caller is in a hurry.
+//
+// LOCKS_REQUIRED(fl.mu)
+func (fl *flusher) enqueue(in inode.Inode, urgent bool) (r *flushRequest) {
+	r, ok := fl.queued[in]
+	if ok {
+		if urgent && !r.urgent {
+			for i, b := range fl.background {
+				if b == r {
+					fl.background = append(fl.background[:i], fl.background[i+1:]...)
+					break
+				}
+			}
+
+			r.urgent = true
+			fl.urgent = append(fl.urgent, r)
+		}
+
+		return
+	}
+
+	r = &flushRequest{
+		in:     in,
+		urgent: urgent,
+		done:   make(chan struct{}),
+	}
+
+	if urgent {
+		fl.urgent = append(fl.urgent, r)
+	} else {
+		fl.background = append(fl.background, r)
+	}
+
+	fl.queued[in] = r
+	fl.ready.Signal()
+
+	return
+}
+
+// Wait for the next request to handle, returning nil once stopped.
+func (fl *flusher) next() (r *flushRequest) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	for !fl.stopped && len(fl.urgent)+len(fl.background) == 0 {
+		fl.ready.Wait()
+	}
+
+	switch {
+	case fl.stopped:
+		return
+
+	case len(fl.urgent) > 0:
+		r = fl.urgent[0]
+		fl.urgent = fl.urgent[1:]
+
+	default:
+		r = fl.background[0]
+		fl.background = fl.background[1:]
+	}
+
+	delete(fl.queued, r.in)
+	return
+}
+
+func (fl *flusher) work() {
+	for {
+		r := fl.next()
+		if r == nil {
+			return
+		}
+
+		r.in.Lock()
+		r.err = fl.sync(fl.ctx, r.in)
+		r.in.Unlock()
+
+		if r.err != nil && !r.urgent {
+			log.Printf("Writing back %q: %v", r.in.Name(), r.err)
+		}
+
+		close(r.done)
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestFlusher(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type namedInode struct {
+	inode.Inode
+	name string
+}
+
+func (in *namedInode) Lock()        {}
+func (in *namedInode) Unlock()      {}
+func (in *namedInode) Name() string { return in.name }
+
+type FlusherTest struct {
+	ctx context.Context
+	fl  *flusher
+
+	// Closed to let the sync of "blocker" finish.
+	unblock chan struct{}
+
+	// Receives the name of each inode as its sync starts.
+	started chan string
+
+	mu sync.Mutex
+
+	// The names of the inodes synced, in order.
+	//
+	// GUARDED_BY(mu)
+	synced []string
+}
+
+var _ SetUpInterface = &FlusherTest{}
+var _ TearDownInterface = &FlusherTest{}
+
+func init() { RegisterTestSuite(&FlusherTest{}) }
+
+func (t *FlusherTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.unblock = make(chan struct{})
+	t.started = make(chan string, 10)
+
+	// A single worker, so that the order in which requests are handled is
+	// predictable.
+	t.fl = newFlusher(1, t.sync)
+}
+
+func (t *FlusherTest) TearDown() {
+	t.fl.Stop()
+}
+
+func (t *FlusherTest) sync(ctx context.Context, in inode.Inode) (err error) {
+	t.started <- in.Name()
+	if in.Name() == "blocker" {
+		<-t.unblock
+	}
+
+	if in.Name() == "broken" {
+		err = errors.New("taco")
+	}
+
+	t.mu.Lock()
+	t.synced = append(t.synced, in.Name())
+	t.mu.Unlock()
+
+	return
+}
+
+// Occupy the worker until t.unblock is closed.
+func (t *FlusherTest) block() {
+	t.fl.WriteBack(&namedInode{name: "blocker"})
+	<-t.started
+}
+
+// Flush the supplied inode in the background, returning a channel that
+// receives the result.
+func (t *FlusherTest) flush(in inode.Inode) (c chan error) {
+	c = make(chan error, 1)
+	go func() {
+		c <- t.fl.Flush(t.ctx, in)
+	}()
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FlusherTest) Flush() {
+	err := t.fl.Flush(t.ctx, &namedInode{name: "foo"})
+	AssertEq(nil, err)
+	ExpectThat(t.synced, ElementsAre("foo"))
+}
+
+func (t *FlusherTest) FlushError() {
+	err := t.fl.Flush(t.ctx, &namedInode{name: "broken"})
+	ExpectThat(err, Error(HasSubstr("taco")))
+}
+
+func (t *FlusherTest) UrgentAheadOfBackground() {
+	t.block()
+
+	t.fl.WriteBack(&namedInode{name: "background"})
+	c := t.flush(&namedInode{name: "urgent"})
+
+	// Wait for the flush to be queued.
+	for {
+		t.fl.mu.Lock()
+		n := len(t.fl.urgent)
+		t.fl.mu.Unlock()
+
+		if n > 0 {
+			break
+		}
+	}
+
+	close(t.unblock)
+	AssertEq(nil, <-c)
+
+	ExpectEq("urgent", <-t.started)
+	ExpectEq("background", <-t.started)
+}
+
+func (t *FlusherTest) JoinsQueuedRequest() {
+	t.block()
+
+	in := &namedInode{name: "foo"}
+	t.fl.WriteBack(in)
+	t.fl.WriteBack(in)
+	c := t.flush(in)
+
+	// Wait for the flush to promote the queued request.
+	for {
+		t.fl.mu.Lock()
+		n := len(t.fl.urgent)
+		t.fl.mu.Unlock()
+
+		if n > 0 {
+			break
+		}
+	}
+
+	close(t.unblock)
+	AssertEq(nil, <-c)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ExpectThat(t.synced, ElementsAre("blocker", "foo"))
+}
+
+func (t *FlusherTest) Cancelled() {
+	t.block()
+	defer close(t.unblock)
+
+	ctx, cancel := context.WithCancel(t.ctx)
+	cancel()
+
+	err := t.fl.Flush(ctx, &namedInode{name: "foo"})
+	ExpectEq(context.Canceled, err)
+}
@@ -15,17 +15,33 @@
 package fs
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
+	"github.com/googlecloudplatform/gcsfuse/internal/audit"
 	"github.com/googlecloudplatform/gcsfuse/internal/fs/handle"
 	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
 	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/monitor"
+	"github.com/googlecloudplatform/gcsfuse/internal/profile"
+	"github.com/googlecloudplatform/gcsfuse/internal/pubsub"
+	"github.com/googlecloudplatform/gcsfuse/internal/tracing"
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
@@ -47,6 +63,37 @@ type ServerConfig struct {
 	// use the system default.
 	TempDir string
 
+	// If positive, the most bytes that local copies of files may take up in
+	// TempDir. Regardless, they aren't allowed to fill its file system; see
+	// gcsx.TempSpace. Writes that would break either rule fail with ENOSPC.
+	MaxTempBytes int64
+
+	// Local copies of files no larger than this many bytes are kept in memory
+	// rather than in TempDir, until they grow larger.
+	MemoryStagingBytes int64
+
+	// If positive, writes are held back while files that have been written to
+	// but not yet synced hold more than this many bytes in total. See
+	// inode.DirtyTracker.
+	MaxDirtyBytes int64
+
+	// If positive, files are written out to GCS by this many background
+	// workers, those being fsync'd or closed ahead of those written back to get
+	// under MaxDirtyBytes. Otherwise each is written out by the op that asks for
+	// it, and a write held back by MaxDirtyBytes first writes back the file
+	// that has been dirty longest itself.
+	UploadWorkers int
+
+	// If non-nil, file handles read object contents through this cache, which
+	// is shared by all of them.
+	ContentCache *gcsx.BlockCache
+
+	// The largest read the kernel sends, as set by the mount's max_read. If
+	// positive, readers keep up to this many bytes that they skip over in a
+	// response from GCS, for the reads that were overtaken. Otherwise they
+	// discard them.
+	MaxReadSize int
+
 	// By default, if a bucket contains the object "foo/bar" but no object named
 	// "foo/", it's as if the directory doesn't exist. This allows us to have
 	// non-flaky name resolution code.
@@ -59,6 +106,23 @@ type ServerConfig struct {
 	// See docs/semantics.md for more info.
 	ImplicitDirectories bool
 
+	// The suffix appended to the name of a file or symlink that has the same
+	// name as a directory, so that both can be shown. If empty,
+	// inode.ConflictingFileNameSuffix is used. Any other suffix may also occur
+	// at the end of object names, in which case the name is ambiguous. See
+	// docs/semantics.md.
+	ConflictSuffix string
+
+	// The Unicode normalization applied to the names of listed and created
+	// files and directories. Looked-up names may stand for objects whose names
+	// are in another form. See docs/semantics.md.
+	NameNormalization inode.Normalization
+
+	// Report a directory's link count as two plus its number of child
+	// directories, listing it to find out, rather than the conventional one
+	// meaning "unknown".
+	CountSubdirs bool
+
 	// How long to allow the kernel to cache inode attributes.
 	//
 	// Any given object generation in GCS is immutable, and a new generation
@@ -71,6 +135,21 @@ type ServerConfig struct {
 	// whether you care about that field being up to date.
 	InodeAttributeCacheTTL time.Duration
 
+	// If set, InodeAttributeCacheTTL is kept when switching profiles.
+	FixedInodeAttributeCacheTTL bool
+
+	// How long to allow the kernel to cache the mapping from a name in a
+	// directory to the inode we looked up for it. While it does, the kernel
+	// won't notice the name being deleted or replaced by another machine, so
+	// this defaults to zero.
+	EntryCacheTTL time.Duration
+
+	// How long to allow the kernel to cache the entries it reads from a
+	// directory, rather than sending ReadDir each time the directory is read.
+	// The kernel forgets them sooner when a child is created or deleted through
+	// the mount, or when we notice a change to one. Zero means no caching.
+	KernelListCacheTTL time.Duration
+
 	// If non-zero, each directory will maintain a cache from child name to
 	// information about whether that name exists as a file and/or directory.
 	// This may speed up calls to look up and stat inodes, especially when
@@ -79,6 +158,12 @@ type ServerConfig struct {
 	// before the expiration, we may fail to find it.
 	DirTypeCacheTTL time.Duration
 
+	// If non-zero and the type cache is enabled, a burst of this many lookups
+	// within one directory that the type cache can't answer causes the
+	// directory to be listed, filling the cache for the lookups of its other
+	// children. See inode.NewDirInode.
+	LookupBurst int
+
 	// The UID and GID that owns all inodes in the file system.
 	Uid uint32
 	Gid uint32
@@ -88,6 +173,12 @@ type ServerConfig struct {
 	FilePerms os.FileMode
 	DirPerms  os.FileMode
 
+	// If set, record the results of chmod(2) and chown(2) on files and explicit
+	// directories in their backing objects' custom metadata, and let recorded
+	// values override Uid, Gid, FilePerms, and DirPerms. See
+	// inode.ModeMetadataKey.
+	PersistPermissions bool
+
 	// Files backed by on object of length at least AppendThreshold that have
 	// only been appended to (i.e. none of the object's contents have been
 	// dirtied) will be written out by "appending" to the object in GCS with this
@@ -106,10 +197,214 @@ type ServerConfig struct {
 	// periodically garbage collected.
 	AppendThreshold int64
 	TmpObjectPrefix string
+
+	// If at least two, files of at least ParallelThreshold bytes that are
+	// written out in full are uploaded in this many parts concurrently, as
+	// temporary objects named with TmpObjectPrefix, which are then composed
+	// into the new object. Must be no more than
+	// gcs.MaxSourcesPerComposeRequest.
+	ParallelUploads   int
+	ParallelThreshold int64
+
+	// If set, record runs of zeros in files written in full, so that they can be
+	// skipped when the contents are fetched again. See
+	// gcsx.SparseExtentsMetadataKey.
+	SparseFiles bool
+
+	// If set, writes that begin at the end of an existing object are held
+	// locally on their own and composed onto it when the file is synced,
+	// regardless of AppendThreshold, rather than first fetching the object's
+	// contents. Ignored if EncryptionKey is set.
+	AppendWrites bool
+
+	// If set, guess the content types of new objects whose names don't have a
+	// known extension from their first few bytes.
+	SniffContentTypes bool
+
+	// The storage class for new objects, or empty for the bucket's default,
+	// overridden for objects whose names start with a key of StorageClasses.
+	// See gcsx.NewStorageClassBucket.
+	StorageClass   string
+	StorageClasses map[string]string
+
+	// If non-empty, the name of the Cloud KMS key with which to encrypt new
+	// objects, including copies made when renaming files.
+	KMSKey string
+
+	// If non-nil, a customer-supplied AES-256 key with which to encrypt new
+	// objects and read objects encrypted with it. Files are then always written
+	// out in full, rather than by composing appended contents onto objects that
+	// might be encrypted otherwise.
+	EncryptionKey []byte
+
+	// If set, present files whose objects are stored with gzip content encoding
+	// by their decompressed contents and size. Otherwise they appear exactly as
+	// stored. Either way, the bucket must not let GCS decompress objects
+	// itself; see gcsx.NewRawEncodingTransport.
+	DecompressGzip bool
+
+	// By default the kernel keeps a file's pages in its page cache from one
+	// open to the next, which is safe because a new object generation gets a
+	// new inode. If DropPageCache is set, it discards them on each open instead.
+	// If DirectIO is set, it doesn't cache file contents at all, sending every
+	// read and write to us.
+	DropPageCache bool
+	DirectIO      bool
+
+	// If non-zero, statfs(2) reports the total size of the objects in the
+	// bucket as used space, measured by listing the whole bucket at most once
+	// per this interval. Otherwise it reports no space used.
+	BucketSizeTTL time.Duration
+
+	// If set, opening a file checks that its inode still holds the latest
+	// generation of its object, failing with ESTALE if not so that the kernel
+	// looks the name up again. Lookups must then not be served from a stat
+	// cache, or they would keep finding the old generation.
+	RevalidateOnOpen bool
+
+	// If set, reading or syncing a file whose object turns out to have been
+	// replaced or deleted in GCS fails with ESTALE, as do later reads, writes,
+	// and syncs through the same inode. Otherwise reads fail with EIO and
+	// syncs succeed without writing anything, as if the file had been
+	// unlinked.
+	StaleErrors bool
+
+	// What syncing a file does when its object turns out to have been replaced
+	// in GCS since the file's contents were derived from it.
+	WriteConflictPolicy inode.WriteConflictPolicy
+
+	// If set, CreateLink copies the target file's object to the new name,
+	// giving an independent file, rather than failing as GCS can't give one
+	// object two names.
+	LinkCopies bool
+
+	// The file system serves advisory locks taken with fcntl(2) and flock(2),
+	// and so must be mounted with fuse.MountConfig.EnableFileLocks. It keeps
+	// them in a table, so that they hold within this mount only, or if
+	// RejectFileLocks is set refuses them with ENOLCK.
+	RejectFileLocks bool
+
+	// If positive, a file on which write locks of either kind are held also
+	// has a lease taken on it in GCS, so that write locks exclude those taken
+	// through other mounts doing the same (see gcsx.Leaser). Each lease is an
+	// object named with LeaseObjectPrefix followed by the file's name, renewed
+	// every third of LockLeaseTTL and taken over by others once that long has
+	// passed without renewal.
+	LockLeaseTTL      time.Duration
+	LeaseObjectPrefix string
+
+	// If non-nil, the bucket has a hierarchical namespace, and Bucket presents
+	// its folders as directory placeholder objects (see gcsx.NewFolderBucket).
+	// Directories can then be renamed, atomically, with this.
+	Folders gcsx.Folders
+
+	// If non-nil, InodeAttributeCacheTTL (unless FixedInodeAttributeCacheTTL is
+	// set) and DirTypeCacheTTL are replaced by the stat and type cache TTLs of
+	// each profile switched to.
+	Profiles *profile.Manager
+
+	// If non-nil, directories forget what they have cached about the type of
+	// each object this subscriber reports as changed. The subscriber must not
+	// yet have been started.
+	Changes *pubsub.Subscriber
+
+	// If non-nil, every op is reported to this tracker.
+	Activity *ActivityTracker
+
+	// If non-nil, each attempt to create, write, delete, or rename an object
+	// is recorded here along with the process that asked for it.
+	AuditLog audit.Log
+
+	// If non-nil, this admin is attached to the file system, and may drain it.
+	Admin *Admin
+
+	// If positive, ops that take longer than this are logged to SlowOpLogger,
+	// with the names of the inodes they concern and their offsets and sizes.
+	SlowOpThreshold time.Duration
+	SlowOpLogger    *log.Logger
+
+	// If non-empty, the root directory contains a directory named DebugDirName,
+	// not listed, holding a read-only file for each key, whose contents are
+	// generated by the function each time the file is opened.
+	DebugFiles map[string]func() ([]byte, error)
+
+	// If set, the root directory contains a directory named VersionsDirName,
+	// not listed, through which every generation of each object in a versioned
+	// bucket can be read.
+	VersionsDir bool
+
+	// If non-nil, the root directory contains a directory named TrashDirName,
+	// not listed, through which the soft-deleted objects of the bucket can be
+	// seen and restored.
+	SoftDeletedObjects gcsx.SoftDeletedObjects
 }
 
 // Create a fuse file system server according to the supplied configuration.
 func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
+	fs, err := newFileSystem(cfg)
+	if err != nil {
+		return
+	}
+
+	// Serve the trash, versions and debug directories, if requested.
+	var wrapped fuseutil.FileSystem = fs
+	if cfg.SoftDeletedObjects != nil {
+		wrapped = newTrashFileSystem(
+			wrapped,
+			cfg.SoftDeletedObjects,
+			cfg.Uid,
+			cfg.Gid)
+	}
+
+	if cfg.VersionsDir {
+		wrapped = newVersionsFileSystem(
+			wrapped,
+			fs.bucket,
+			fs.skippedBuffers,
+			cfg.Uid,
+			cfg.Gid)
+	}
+
+	if len(cfg.DebugFiles) > 0 {
+		wrapped = newDebugFileSystem(wrapped, cfg.DebugFiles, cfg.Uid, cfg.Gid)
+	}
+
+	// Return errnos that say what went wrong, and fail ops that panic rather
+	// than crashing.
+	wrapped = newErrorsFileSystem(wrapped)
+
+	// Let the admin stop modifications, when shutting down.
+	if cfg.Admin != nil {
+		wrapped = newDrainingFileSystem(wrapped, cfg.Admin)
+	}
+
+	// Record a trace and metrics for each op, track activity, and log slow ops,
+	// if requested.
+	var slow *slowOpLogger
+	if cfg.SlowOpThreshold > 0 {
+		slow = &slowOpLogger{
+			threshold: cfg.SlowOpThreshold,
+			logger:    cfg.SlowOpLogger,
+			inodes:    fs.inodes,
+		}
+	}
+
+	if tracing.Enabled() || monitor.Enabled() || cfg.Activity != nil ||
+		slow != nil {
+		wrapped = newInstrumentedFileSystem(wrapped, cfg.Activity, slow)
+	}
+
+	server = &invalidatingServer{
+		Server: fuseutil.NewFileSystemServer(wrapped),
+		inv:    fs.invalidator,
+	}
+
+	return
+}
+
+// Create the file system that serves ops for NewServer, without the wrappers
+// that it adds.
+func newFileSystem(cfg *ServerConfig) (fs *fileSystem, err error) {
 	// Check permissions bits.
 	if cfg.FilePerms&^os.ModePerm != 0 {
 		err = fmt.Errorf("Illegal file perms: %v", cfg.FilePerms)
@@ -121,8 +416,24 @@ func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
 		return
 	}
 
-	// Set up a bucket that infers content types when creating files.
-	bucket := gcsx.NewContentTypeBucket(cfg.Bucket)
+	// Set up a bucket that chooses storage classes and encryption keys and
+	// infers content types when creating files, and that records errors for
+	// newErrorsFileSystem to translate.
+	bucket := gcsx.NewStorageClassBucket(
+		cfg.Bucket,
+		cfg.StorageClass,
+		cfg.StorageClasses)
+
+	if cfg.KMSKey != "" {
+		bucket = gcsx.NewKMSKeyBucket(bucket, cfg.KMSKey)
+	}
+
+	if cfg.EncryptionKey != nil {
+		bucket = gcsx.NewEncryptionKeyBucket(bucket, cfg.EncryptionKey)
+	}
+
+	bucket = gcsx.NewErrnoBucket(
+		gcsx.NewContentTypeBucket(bucket, cfg.SniffContentTypes))
 
 	// Create the object syncer.
 	if cfg.TmpObjectPrefix == "" {
@@ -130,30 +441,91 @@ func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
 		return
 	}
 
+	// GCS composes only objects encrypted with the key supplied, which an
+	// existing object may not be.
+	appendThreshold := cfg.AppendThreshold
+	if cfg.EncryptionKey != nil {
+		appendThreshold = math.MaxInt64
+	}
+
 	syncer := gcsx.NewSyncer(
-		cfg.AppendThreshold,
+		appendThreshold,
 		cfg.TmpObjectPrefix,
+		cfg.SparseFiles,
+		cfg.ParallelUploads,
+		cfg.ParallelThreshold,
 		bucket)
 
+	// Decide where to keep local copies of files.
+	maxTempBytes := cfg.MaxTempBytes
+	if maxTempBytes <= 0 {
+		maxTempBytes = -1
+	}
+
+	tempSpace := gcsx.NewTempSpace(
+		cfg.TempDir,
+		maxTempBytes,
+		cfg.MemoryStagingBytes)
+
+	var dirty *inode.DirtyTracker
+	if cfg.MaxDirtyBytes > 0 {
+		dirty = inode.NewDirtyTracker(cfg.MaxDirtyBytes)
+	}
+
+	var skippedBuffers *gcsx.BufferPool
+	if cfg.MaxReadSize > 0 {
+		skippedBuffers = gcsx.NewBufferPool(cfg.MaxReadSize)
+	}
+
 	// Set up the basic struct.
-	fs := &fileSystem{
+	fs = &fileSystem{
 		mtimeClock:             timeutil.RealClock(),
 		cacheClock:             cfg.CacheClock,
 		bucket:                 bucket,
 		syncer:                 syncer,
-		tempDir:                cfg.TempDir,
+		tempSpace:              tempSpace,
+		dirty:                  dirty,
+		contentCache:           cfg.ContentCache,
+		skippedBuffers:         skippedBuffers,
 		implicitDirs:           cfg.ImplicitDirectories,
+		conflictSuffix:         cfg.ConflictSuffix,
+		normalization:          cfg.NameNormalization,
+		countSubdirs:           cfg.CountSubdirs,
+		lookupBurst:            cfg.LookupBurst,
 		inodeAttributeCacheTTL: cfg.InodeAttributeCacheTTL,
 		dirTypeCacheTTL:        cfg.DirTypeCacheTTL,
 		uid:                    cfg.Uid,
 		gid:                    cfg.Gid,
 		fileMode:               cfg.FilePerms,
 		dirMode:                cfg.DirPerms | os.ModeDir,
-		inodes:                 make(map[fuseops.InodeID]inode.Inode),
+		persistPermissions:     cfg.PersistPermissions,
+		decompressGzip:         cfg.DecompressGzip,
+		appendWrites:           cfg.AppendWrites && cfg.EncryptionKey == nil,
+		dropPageCache:          cfg.DropPageCache,
+		directIO:               cfg.DirectIO,
+		revalidateOnOpen:       cfg.RevalidateOnOpen,
+		staleErrors:            cfg.StaleErrors,
+		writeConflictPolicy:    cfg.WriteConflictPolicy,
+		auditLog:               cfg.AuditLog,
+		linkCopies:             cfg.LinkCopies,
+		rejectFileLocks:        cfg.RejectFileLocks,
+		folders:                cfg.Folders,
+		fixedAttributeCacheTTL: cfg.FixedInodeAttributeCacheTTL,
+		entryCacheTTL:          cfg.EntryCacheTTL,
+		kernelListCacheTTL:     cfg.KernelListCacheTTL,
+		inodes:                 newInodeTable(),
 		nextInodeID:            fuseops.RootInodeID + 1,
 		generationBackedInodes: make(map[string]inode.GenerationBackedInode),
 		implicitDirInodes:      make(map[string]inode.DirInode),
-		handles:                make(map[fuseops.HandleID]interface{}),
+		handles:                newHandleTable(),
+	}
+
+	if fs.conflictSuffix == "" {
+		fs.conflictSuffix = inode.ConflictingFileNameSuffix
+	}
+
+	if cfg.BucketSizeTTL != 0 {
+		fs.sizeProbe = gcsx.NewSizeProbe(bucket, cfg.BucketSizeTTL, cfg.CacheClock)
 	}
 
 	// Set up the root inode.
@@ -171,26 +543,68 @@ func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
 			Mtime: fs.mtimeClock.Now(),
 		},
 		fs.implicitDirs,
-		fs.dirTypeCacheTTL,
+		fs.conflictSuffix,
+		fs.normalization,
+		fs.countSubdirs,
+		fs.typeCacheTTL(),
+		fs.lookupBurst,
 		fs.bucket,
 		fs.mtimeClock,
 		fs.cacheClock)
 
 	root.Lock()
 	root.IncrementLookupCount()
-	fs.inodes[fuseops.RootInodeID] = root
+	fs.inodes.Insert(root)
 	fs.implicitDirInodes[root.Name()] = root
 	root.Unlock()
 
 	// Set up invariant checking.
 	fs.mu = syncutil.NewInvariantMutex(fs.checkInvariants)
 
+	fs.invalidator = newInvalidator()
+
+	// Take leases for write locks if asked.
+	if cfg.LockLeaseTTL > 0 {
+		fs.leaser, err = gcsx.NewLeaser(
+			bucket,
+			cfg.LeaseObjectPrefix,
+			cfg.LockLeaseTTL,
+			cfg.CacheClock)
+
+		if err != nil {
+			err = fmt.Errorf("NewLeaser: %v", err)
+			return
+		}
+
+		fs.locks = newLockTable(fs.leaseWriteLocked)
+	} else {
+		fs.locks = newLockTable(nil)
+	}
+
+	// Start the upload workers, if any.
+	if cfg.UploadWorkers > 0 {
+		fs.flusher = newFlusher(cfg.UploadWorkers, fs.syncInode)
+	}
+
 	// Periodically garbage collect temporary objects.
 	var gcCtx context.Context
 	gcCtx, fs.stopGarbageCollecting = context.WithCancel(context.Background())
 	go garbageCollect(gcCtx, cfg.TmpObjectPrefix, fs.bucket)
 
-	server = fuseutil.NewFileSystemServer(fs)
+	// Follow changes to cache settings.
+	if cfg.Profiles != nil {
+		cfg.Profiles.Subscribe(fs.applyProfile)
+	}
+
+	// Follow changes to objects made elsewhere, if requested.
+	if cfg.Changes != nil {
+		cfg.Changes.Subscribe(fs.applyChange)
+	}
+
+	if cfg.Admin != nil {
+		cfg.Admin.attach(fs)
+	}
+
 	return
 }
 
@@ -204,6 +618,8 @@ func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
 //
 //  1. For any inode lock I, I < FS.
 //  2. For any handle lock H and inode lock I, H < I.
+//  3. For any inodeTable or handleTable shard lock T and any other lock L,
+//     L < T.
 //
 // We follow the rule "acquire A then B only if A < B".
 //
@@ -213,9 +629,13 @@ func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
 //  *  Don't hold multiple inode locks at the same time.
 //  *  Don't acquire inode locks before handle locks.
 //  *  Don't acquire file system locks before either.
+//  *  Don't acquire anything while holding a table shard lock.
 //
 // The intuition is that we hold inode and handle locks for long-running
 // operations, and we don't want to block the entire file system on those.
+// Likewise the file system lock is needed only to look up and change the name
+// indexes; the tables of inodes and handles by ID are sharded so that the
+// many ops that start by looking up one don't contend with each other.
 //
 // See http://goo.gl/rDxxlG for more discussion, including an informal proof
 // that a strict partial order is sufficient.
@@ -227,19 +647,27 @@ type fileSystem struct {
 	// Dependencies
 	/////////////////////////
 
-	mtimeClock timeutil.Clock
-	cacheClock timeutil.Clock
-	bucket     gcs.Bucket
-	syncer     gcsx.Syncer
+	mtimeClock   timeutil.Clock
+	cacheClock   timeutil.Clock
+	bucket       gcs.Bucket
+	syncer       gcsx.Syncer
+	tempSpace    *gcsx.TempSpace
+	dirty        *inode.DirtyTracker
+	contentCache *gcsx.BlockCache
+
+	// Buffers for the bytes that readers skip over, or nil if they shouldn't
+	// keep them.
+	skippedBuffers *gcsx.BufferPool
 
 	/////////////////////////
 	// Constant data
 	/////////////////////////
 
-	tempDir                string
-	implicitDirs           bool
-	inodeAttributeCacheTTL time.Duration
-	dirTypeCacheTTL        time.Duration
+	implicitDirs   bool
+	conflictSuffix string
+	normalization  inode.Normalization
+	countSubdirs   bool
+	lookupBurst    int
 
 	// The user and group owning everything in the file system.
 	uid uint32
@@ -249,6 +677,62 @@ type fileSystem struct {
 	fileMode os.FileMode
 	dirMode  os.FileMode
 
+	// See ServerConfig.PersistPermissions.
+	persistPermissions bool
+
+	// See ServerConfig.DecompressGzip.
+	decompressGzip bool
+
+	// See ServerConfig.AppendWrites.
+	appendWrites bool
+
+	// See ServerConfig.DropPageCache and DirectIO.
+	dropPageCache bool
+	directIO      bool
+
+	// See ServerConfig.RevalidateOnOpen and StaleErrors.
+	revalidateOnOpen bool
+	staleErrors      bool
+
+	// See ServerConfig.WriteConflictPolicy.
+	writeConflictPolicy inode.WriteConflictPolicy
+
+	// See ServerConfig.AuditLog.
+	auditLog audit.Log
+
+	// See ServerConfig.LinkCopies.
+	linkCopies bool
+
+	// See ServerConfig.RejectFileLocks.
+	rejectFileLocks bool
+
+	// See ServerConfig.FixedInodeAttributeCacheTTL, EntryCacheTTL, and
+	// KernelListCacheTTL.
+	fixedAttributeCacheTTL bool
+	entryCacheTTL          time.Duration
+	kernelListCacheTTL     time.Duration
+
+	// Measures the space used in the bucket, or nil if we don't. See
+	// ServerConfig.BucketSizeTTL.
+	sizeProbe gcsx.SizeProbe
+
+	// Writes out files in the background, or nil if ops do so themselves. See
+	// ServerConfig.UploadWorkers.
+	flusher *flusher
+
+	// Tells the kernel about entries and inodes found to be out of date.
+	invalidator *invalidator
+
+	// The advisory locks held on files, unless rejectFileLocks is set.
+	locks *lockTable
+
+	// Takes leases on files with write locks held on them, or nil if we don't.
+	// See ServerConfig.LockLeaseTTL.
+	leaser gcsx.Leaser
+
+	// See ServerConfig.Folders.
+	folders gcsx.Folders
+
 	// A function that shuts down the garbage collector.
 	stopGarbageCollecting func()
 
@@ -256,6 +740,17 @@ type fileSystem struct {
 	// Mutable state
 	/////////////////////////
 
+	// A lock protecting settings that may be changed by switching profiles. It
+	// may be acquired while holding any other lock, and no other lock may be
+	// acquired while holding it.
+	settingsMu sync.Mutex
+
+	// GUARDED_BY(settingsMu)
+	inodeAttributeCacheTTL time.Duration
+
+	// GUARDED_BY(settingsMu)
+	dirTypeCacheTTL time.Duration
+
 	// A lock protecting the state of the file system struct itself (distinct
 	// from per-inode locks). Make sure to see the notes on lock ordering above.
 	mu syncutil.InvariantMutex
@@ -268,15 +763,13 @@ type fileSystem struct {
 	nextInodeID fuseops.InodeID
 
 	// The collection of live inodes, keyed by inode ID. No ID less than
-	// fuseops.RootInodeID is ever used.
+	// fuseops.RootInodeID is ever used. May be read without holding mu, but is
+	// changed only while holding it.
 	//
 	// INVARIANT: For all keys k, fuseops.RootInodeID <= k < nextInodeID
-	// INVARIANT: For all keys k, inodes[k].ID() == k
 	// INVARIANT: inodes[fuseops.RootInodeID] is missing or of type inode.DirInode
 	// INVARIANT: For all v, if IsDirName(v.Name()) then v is inode.DirInode
-	//
-	// GUARDED_BY(mu)
-	inodes map[fuseops.InodeID]inode.Inode
+	inodes *inodeTable
 
 	// A map from object name to an inode for that name backed by a GCS object.
 	// Populated during the name -> inode lookup process, cleared during the
@@ -324,19 +817,9 @@ type fileSystem struct {
 	// GUARDED_BY(mu)
 	implicitDirInodes map[string]inode.DirInode
 
-	// The collection of live handles, keyed by handle ID.
-	//
-	// INVARIANT: All values are of type *dirHandle or *handle.FileHandle
-	//
-	// GUARDED_BY(mu)
-	handles map[fuseops.HandleID]interface{}
-
-	// The next handle ID to hand out. We assume that this will never overflow.
-	//
-	// INVARIANT: For all keys k in handles, k < nextHandleID
-	//
-	// GUARDED_BY(mu)
-	nextHandleID fuseops.HandleID
+	// The collection of live handles, keyed by handle ID. Synchronized
+	// internally; unrelated to mu.
+	handles *handleTable
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -348,25 +831,21 @@ func (fs *fileSystem) checkInvariants() {
 	// inodes
 	//////////////////////////////////
 
+	// Changes to the table are made while holding mu, so this is consistent.
+	inodes := fs.inodes.All()
+
 	// INVARIANT: For all keys k, fuseops.RootInodeID <= k < nextInodeID
-	for id, _ := range fs.inodes {
-		if id < fuseops.RootInodeID || id >= fs.nextInodeID {
+	for _, in := range inodes {
+		if id := in.ID(); id < fuseops.RootInodeID || id >= fs.nextInodeID {
 			panic(fmt.Sprintf("Illegal inode ID: %v", id))
 		}
 	}
 
-	// INVARIANT: For all keys k, inodes[k].ID() == k
-	for id, in := range fs.inodes {
-		if in.ID() != id {
-			panic(fmt.Sprintf("ID mismatch: %v vs. %v", in.ID(), id))
-		}
-	}
-
 	// INVARIANT: inodes[fuseops.RootInodeID] is missing or of type inode.DirInode
 	//
 	// The missing case is when we've received a forget request for the root
 	// inode, while unmounting.
-	switch in := fs.inodes[fuseops.RootInodeID].(type) {
+	switch in := fs.inodes.Get(fuseops.RootInodeID).(type) {
 	case nil:
 	case inode.DirInode:
 	default:
@@ -374,7 +853,7 @@ func (fs *fileSystem) checkInvariants() {
 	}
 
 	// INVARIANT: For all v, if IsDirName(v.Name()) then v is inode.DirInode
-	for _, in := range fs.inodes {
+	for _, in := range inodes {
 		if inode.IsDirName(in.Name()) {
 			_, ok := in.(inode.DirInode)
 			if !ok {
@@ -402,11 +881,11 @@ func (fs *fileSystem) checkInvariants() {
 
 	// INVARIANT: For each value v, inodes[v.ID()] == v
 	for _, v := range fs.generationBackedInodes {
-		if fs.inodes[v.ID()] != v {
+		if fs.inodes.Get(v.ID()) != v {
 			panic(fmt.Sprintf(
 				"Mismatch for ID %v: %v %v",
 				v.ID(),
-				fs.inodes[v.ID()],
+				fs.inodes.Get(v.ID()),
 				v))
 		}
 	}
@@ -427,11 +906,11 @@ func (fs *fileSystem) checkInvariants() {
 
 	// INVARIANT: For each value v, inodes[v.ID()] == v
 	for _, v := range fs.implicitDirInodes {
-		if fs.inodes[v.ID()] != v {
+		if fs.inodes.Get(v.ID()) != v {
 			panic(fmt.Sprintf(
 				"Mismatch for ID %v: %v %v",
 				v.ID(),
-				fs.inodes[v.ID()],
+				fs.inodes.Get(v.ID()),
 				v))
 		}
 	}
@@ -448,7 +927,7 @@ func (fs *fileSystem) checkInvariants() {
 
 	// INVARIANT: For each in in inodes such that in is DirInode but not
 	//            ExplicitDirInode, implicitDirInodes[d.Name()] == d
-	for _, in := range fs.inodes {
+	for _, in := range inodes {
 		_, dir := in.(inode.DirInode)
 		_, edir := in.(inode.ExplicitDirInode)
 
@@ -462,31 +941,6 @@ func (fs *fileSystem) checkInvariants() {
 			}
 		}
 	}
-
-	//////////////////////////////////
-	// handles
-	//////////////////////////////////
-
-	// INVARIANT: All values are of type *dirHandle or *handle.FileHandle
-	for _, h := range fs.handles {
-		switch h.(type) {
-		case *dirHandle:
-		case *handle.FileHandle:
-		default:
-			panic(fmt.Sprintf("Unexpected handle type: %T", h))
-		}
-	}
-
-	//////////////////////////////////
-	// nextHandleID
-	//////////////////////////////////
-
-	// INVARIANT: For all keys k in handles, k < nextHandleID
-	for k, _ := range fs.handles {
-		if k >= fs.nextHandleID {
-			panic(fmt.Sprintf("Illegal handle ID: %v", k))
-		}
-	}
 }
 
 // Implementation detail of lookUpOrCreateInodeIfNotStale; do not use outside
@@ -516,7 +970,11 @@ func (fs *fileSystem) mintInode(name string, o *gcs.Object) (in inode.Inode) {
 				Mtime: fs.mtimeClock.Now(),
 			},
 			fs.implicitDirs,
-			fs.dirTypeCacheTTL,
+			fs.conflictSuffix,
+			fs.normalization,
+			fs.countSubdirs,
+			fs.typeCacheTTL(),
+			fs.lookupBurst,
 			fs.bucket,
 			fs.mtimeClock,
 			fs.cacheClock)
@@ -537,7 +995,11 @@ func (fs *fileSystem) mintInode(name string, o *gcs.Object) (in inode.Inode) {
 				Mtime: fs.mtimeClock.Now(),
 			},
 			fs.implicitDirs,
-			fs.dirTypeCacheTTL,
+			fs.conflictSuffix,
+			fs.normalization,
+			fs.countSubdirs,
+			fs.typeCacheTTL(),
+			fs.lookupBurst,
 			fs.bucket,
 			fs.mtimeClock,
 			fs.cacheClock)
@@ -563,12 +1025,18 @@ func (fs *fileSystem) mintInode(name string, o *gcs.Object) (in inode.Inode) {
 			},
 			fs.bucket,
 			fs.syncer,
-			fs.tempDir,
+			fs.tempSpace,
+			fs.dirty,
+			fs.decompressGzip,
+			fs.staleErrors,
+			fs.appendWrites,
+			fs.writeConflictPolicy,
+			fs.noteClobbered,
 			fs.mtimeClock)
 	}
 
 	// Place it in our map of IDs to inodes.
-	fs.inodes[in.ID()] = in
+	fs.inodes.Insert(in)
 
 	return
 }
@@ -752,10 +1220,24 @@ func (fs *fileSystem) lookUpOrCreateChildInode(
 func (fs *fileSystem) syncFile(
 	ctx context.Context,
 	f *inode.FileInode) (err error) {
-	// Sync the inode.
+	// Sync the inode, recording any new generation or failure.
+	before := f.SourceGeneration().Object
 	err = f.Sync(ctx)
+
+	if after := f.SourceGeneration().Object; after != before || err != nil {
+		fs.recordChange(ctx, &audit.Record{
+			Op:               audit.OpWrite,
+			Name:             f.Name(),
+			GenerationBefore: before,
+			GenerationAfter:  after,
+		}, err)
+	}
+
 	if err != nil {
-		err = fmt.Errorf("FileInode.Sync: %v", err)
+		if err != syscall.ESTALE {
+			err = fmt.Errorf("FileInode.Sync: %v", err)
+		}
+
 		return
 	}
 
@@ -772,6 +1254,66 @@ func (fs *fileSystem) syncFile(
 	return
 }
 
+// Synchronize the supplied file inode to GCS, by way of the flusher if there
+// is one.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_EXCLUDED(f)
+func (fs *fileSystem) flushFile(
+	ctx context.Context,
+	f *inode.FileInode) (err error) {
+	if fs.flusher == nil {
+		f.Lock()
+		defer f.Unlock()
+
+		err = fs.syncFile(ctx, f)
+		return
+	}
+
+	err = fs.flusher.Flush(ctx, f)
+	if err != nil && err == ctx.Err() {
+		err = syscall.EINTR
+	}
+
+	return
+}
+
+// Sync a file inode on behalf of the flusher.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_REQUIRED(in)
+func (fs *fileSystem) syncInode(
+	ctx context.Context,
+	in inode.Inode) (err error) {
+	err = fs.syncFile(ctx, in.(*inode.FileInode))
+	return
+}
+
+// Write back the file inode with the given ID, if it still exists, so that
+// writes held back by fs.dirty may proceed. With a flusher this only starts
+// the write-back; otherwise it is done before returning.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) writeBack(
+	ctx context.Context,
+	id fuseops.InodeID) (err error) {
+	f, ok := fs.inodes.Get(id).(*inode.FileInode)
+	if !ok {
+		return
+	}
+
+	if fs.flusher != nil {
+		fs.flusher.WriteBack(f)
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	err = fs.syncFile(ctx, f)
+	return
+}
+
 // Decrement the supplied inode's lookup count, destroying it if the inode says
 // that it has hit zero.
 //
@@ -791,7 +1333,7 @@ func (fs *fileSystem) unlockAndDecrementLookupCount(
 	// Update file system state, orphaning the inode if we're going to destroy it
 	// below.
 	if shouldDestroy {
-		delete(fs.inodes, in.ID())
+		fs.inodes.Delete(in.ID())
 
 		// Update indexes if necessary.
 		if fs.generationBackedInodes[name] == in {
@@ -869,20 +1411,217 @@ func (fs *fileSystem) getAttributes(
 		return
 	}
 
+	// Honor the permissions recorded by chmod and chown, if enabled.
+	if m, ok := in.(metadataInode); ok && fs.persistPermissions {
+		inode.ApplyPermissions(&attr, m.Source().Metadata)
+	}
+
 	// Set up the expiration time.
-	if fs.inodeAttributeCacheTTL > 0 {
-		expiration = time.Now().Add(fs.inodeAttributeCacheTTL)
+	if ttl := fs.attributeCacheTTL(); ttl > 0 {
+		expiration = time.Now().Add(ttl)
+	}
+
+	return
+}
+
+// Return the time until which the kernel may cache a lookup result.
+func (fs *fileSystem) entryExpiration() (expiration time.Time) {
+	if fs.entryCacheTTL > 0 {
+		expiration = time.Now().Add(fs.entryCacheTTL)
 	}
 
 	return
 }
 
+// An inode backed by an object whose custom metadata can be changed. See
+// inode.FileInode and inode.ExplicitDirInode.
+type metadataInode interface {
+	inode.Inode
+	Source() *gcs.Object
+	UpdateMetadata(ctx context.Context, updates map[string]*string) error
+}
+
+// LOCKS_EXCLUDED(fs.settingsMu)
+func (fs *fileSystem) attributeCacheTTL() time.Duration {
+	fs.settingsMu.Lock()
+	defer fs.settingsMu.Unlock()
+
+	return fs.inodeAttributeCacheTTL
+}
+
+// LOCKS_EXCLUDED(fs.settingsMu)
+func (fs *fileSystem) typeCacheTTL() time.Duration {
+	fs.settingsMu.Lock()
+	defer fs.settingsMu.Unlock()
+
+	return fs.dirTypeCacheTTL
+}
+
+// Adopt the cache TTLs of a newly active profile, for new inodes and for the
+// directory inodes that already exist.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) applyProfile(s profile.Settings) {
+	fs.settingsMu.Lock()
+	if !fs.fixedAttributeCacheTTL {
+		fs.inodeAttributeCacheTTL = s.StatCacheTTL
+	}
+
+	fs.dirTypeCacheTTL = s.TypeCacheTTL
+	fs.settingsMu.Unlock()
+
+	// Find the existing directories. Anything minted after this point sees the
+	// new TTL.
+	var dirs []inode.DirInode
+	fs.mu.Lock()
+	for _, in := range fs.inodes.All() {
+		if d, ok := in.(inode.DirInode); ok {
+			dirs = append(dirs, d)
+		}
+	}
+	fs.mu.Unlock()
+
+	// We can't acquire inode locks while holding the file system lock, so do
+	// this afterward. It doesn't matter if a directory is destroyed meanwhile.
+	for _, d := range dirs {
+		d.Lock()
+		d.SetTypeCacheTTL(s.TypeCacheTTL)
+		d.Unlock()
+	}
+}
+
+// Make the directories that may have cached the type of the changed object,
+// or of one of the implicit directories containing it, forget it, and tell
+// the kernel to do likewise.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) applyChange(c pubsub.Change) {
+	type forget struct {
+		d     inode.DirInode
+		child string
+	}
+
+	// Find each directory along the way that we have an inode for.
+	var forgets []forget
+	parts := strings.Split(strings.TrimSuffix(c.Name, "/"), "/")
+
+	fs.mu.Lock()
+	for i, part := range parts {
+		var dirName string
+		if i > 0 {
+			dirName = strings.Join(parts[:i], "/") + "/"
+		}
+
+		child := inode.EscapeName(fs.normalization.Apply(part))
+
+		if d, ok := fs.implicitDirInodes[dirName]; ok {
+			forgets = append(forgets, forget{d, child})
+		}
+
+		if d, ok := fs.generationBackedInodes[dirName].(inode.DirInode); ok {
+			forgets = append(forgets, forget{d, child})
+		}
+	}
+
+	if in, ok := fs.generationBackedInodes[c.Name]; ok {
+		fs.invalidator.Inode(in.ID())
+	}
+	fs.mu.Unlock()
+
+	for _, f := range forgets {
+		fs.invalidator.Entry(f.d.ID(), f.child)
+	}
+
+	// As in applyProfile, lock the directories only afterward.
+	for _, f := range forgets {
+		f.d.Lock()
+		f.d.ForgetChild(f.child)
+		f.d.Unlock()
+	}
+}
+
+// Tell the kernel to forget the clobbered file inode's cached contents and
+// attributes, and the entry by which it was found, so that the name is looked
+// up again.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) noteClobbered(f *inode.FileInode) {
+	fs.invalidator.Inode(f.ID())
+
+	// Find the parent directory, if we still have an inode for it.
+	dirName, child := "", f.Name()
+	if i := strings.LastIndex(child, "/"); i >= 0 {
+		dirName, child = child[:i+1], child[i+1:]
+	}
+
+	child = inode.EscapeName(fs.normalization.Apply(child))
+
+	fs.mu.Lock()
+	var d inode.Inode
+	if in, ok := fs.implicitDirInodes[dirName]; ok {
+		d = in
+	} else if in, ok := fs.generationBackedInodes[dirName]; ok {
+		d = in
+	}
+	fs.mu.Unlock()
+
+	if d != nil {
+		fs.invalidator.Entry(d.ID(), child)
+	}
+}
+
+// Record in the audit log, if there is one, the change described by r, made
+// on behalf of the process that sent the op with the supplied context and
+// failing with err if non-nil.
+func (fs *fileSystem) recordChange(
+	ctx context.Context,
+	r *audit.Record,
+	err error) {
+	if fs.auditLog == nil {
+		return
+	}
+
+	r.Time = fs.mtimeClock.Now()
+	if c, ok := fuse.OpContextFromContext(ctx); ok {
+		r.Uid, r.Gid, r.Pid = c.Uid, c.Gid, c.Pid
+	}
+
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	fs.auditLog.Write(r)
+}
+
+// Return the name of the object that the child of the supplied directory with
+// the given name would have, for recording changes that may not have made it.
+func (fs *fileSystem) childObjectName(
+	parent inode.DirInode,
+	name string) string {
+	return parent.Name() + fs.normalization.Apply(inode.UnescapeName(name))
+}
+
+// Record an attempt to create the named object, which resulted in o if err is
+// nil.
+func (fs *fileSystem) recordCreate(
+	ctx context.Context,
+	name string,
+	o *gcs.Object,
+	err error) {
+	r := &audit.Record{Op: audit.OpCreate, Name: name}
+	if err == nil {
+		r.Name = o.Name
+		r.GenerationAfter = o.Generation
+	}
+
+	fs.recordChange(ctx, r, err)
+}
+
 // inodeOrDie returns the inode with the given ID, panicking with a helpful
 // error message if it doesn't exist.
 //
-// LOCKS_REQUIRED(fs.mu)
 func (fs *fileSystem) inodeOrDie(id fuseops.InodeID) (in inode.Inode) {
-	in = fs.inodes[id]
+	in = fs.inodes.Get(id)
 	if in == nil {
 		panic(fmt.Sprintf("inode %d doesn't exist", id))
 	}
@@ -893,9 +1632,8 @@ func (fs *fileSystem) inodeOrDie(id fuseops.InodeID) (in inode.Inode) {
 // dirInodeOrDie returns the directory inode with the given ID, panicking with
 // a helpful error message if it doesn't exist or is the wrong type.
 //
-// LOCKS_REQUIRED(fs.mu)
 func (fs *fileSystem) dirInodeOrDie(id fuseops.InodeID) (in inode.DirInode) {
-	tmp := fs.inodes[id]
+	tmp := fs.inodes.Get(id)
 	in, ok := tmp.(inode.DirInode)
 	if !ok {
 		panic(fmt.Sprintf("inode %d is %T, wanted inode.DirInode", id, tmp))
@@ -907,9 +1645,8 @@ func (fs *fileSystem) dirInodeOrDie(id fuseops.InodeID) (in inode.DirInode) {
 // fileInodeOrDie returns the file inode with the given ID, panicking with a
 // helpful error message if it doesn't exist or is the wrong type.
 //
-// LOCKS_REQUIRED(fs.mu)
 func (fs *fileSystem) fileInodeOrDie(id fuseops.InodeID) (in *inode.FileInode) {
-	tmp := fs.inodes[id]
+	tmp := fs.inodes.Get(id)
 	in, ok := tmp.(*inode.FileInode)
 	if !ok {
 		panic(fmt.Sprintf("inode %d is %T, wanted *inode.FileInode", id, tmp))
@@ -921,10 +1658,9 @@ func (fs *fileSystem) fileInodeOrDie(id fuseops.InodeID) (in *inode.FileInode) {
 // symlinkInodeOrDie returns the symlink inode with the given ID, panicking
 // with a helpful error message if it doesn't exist or is the wrong type.
 //
-// LOCKS_REQUIRED(fs.mu)
 func (fs *fileSystem) symlinkInodeOrDie(
 	id fuseops.InodeID) (in *inode.SymlinkInode) {
-	tmp := fs.inodes[id]
+	tmp := fs.inodes.Get(id)
 	in, ok := tmp.(*inode.SymlinkInode)
 	if !ok {
 		panic(fmt.Sprintf("inode %d is %T, wanted *inode.SymlinkInode", id, tmp))
@@ -939,18 +1675,42 @@ func (fs *fileSystem) symlinkInodeOrDie(
 
 func (fs *fileSystem) Destroy() {
 	fs.stopGarbageCollecting()
+	fs.invalidator.Stop()
+
+	if fs.flusher != nil {
+		fs.flusher.Stop()
+	}
+
+	if fs.leaser != nil {
+		fs.leaser.Stop()
+	}
 }
 
+// The block size and amount of free space reported by statfs(2).
+const (
+	statFSBlockSize = gcsx.MB
+	statFSFreeBytes = 1 << 50
+)
+
 func (fs *fileSystem) StatFS(
 	ctx context.Context,
 	op *fuseops.StatFSOp) (err error) {
-	// Simulate a large amount of free space so that the Finder doesn't refuse to
-	// copy in files. (See issue #125.) Use 2^17 as the block size because that
-	// is the largest that OS X will pass on.
-	op.BlockSize = 1 << 17
-	op.Blocks = 1 << 33
-	op.BlocksFree = op.Blocks
-	op.BlocksAvailable = op.Blocks
+	// Simulate a large amount of free space so that the Finder and others don't
+	// refuse to copy in files. (See issue #125.) Use blocks the size of the
+	// smallest read we make from GCS, which is also the largest block size that
+	// OS X will pass on.
+	op.BlockSize = statFSBlockSize
+	op.BlocksFree = statFSFreeBytes / statFSBlockSize
+	op.BlocksAvailable = op.BlocksFree
+
+	// Report the bucket's contents as used space on top of that, if we know
+	// them.
+	op.Blocks = op.BlocksFree
+	if fs.sizeProbe != nil {
+		if used, ok := fs.sizeProbe.Size(); ok {
+			op.Blocks += (used + statFSBlockSize - 1) / statFSBlockSize
+		}
+	}
 
 	// Similarly with inodes.
 	op.Inodes = 1 << 50
@@ -968,9 +1728,7 @@ func (fs *fileSystem) LookUpInode(
 	ctx context.Context,
 	op *fuseops.LookUpInodeOp) (err error) {
 	// Find the parent directory in question.
-	fs.mu.Lock()
 	parent := fs.dirInodeOrDie(op.Parent)
-	fs.mu.Unlock()
 
 	// Find or create the child inode.
 	child, err := fs.lookUpOrCreateChildInode(ctx, parent, op.Name)
@@ -983,6 +1741,7 @@ func (fs *fileSystem) LookUpInode(
 	// Fill out the response.
 	e := &op.Entry
 	e.Child = child.ID()
+	e.EntryExpiration = fs.entryExpiration()
 	e.Attributes, e.AttributesExpiration, err = fs.getAttributes(ctx, child)
 
 	if err != nil {
@@ -997,9 +1756,7 @@ func (fs *fileSystem) GetInodeAttributes(
 	ctx context.Context,
 	op *fuseops.GetInodeAttributesOp) (err error) {
 	// Find the inode.
-	fs.mu.Lock()
 	in := fs.inodeOrDie(op.Inode)
-	fs.mu.Unlock()
 
 	in.Lock()
 	defer in.Unlock()
@@ -1018,9 +1775,7 @@ func (fs *fileSystem) SetInodeAttributes(
 	ctx context.Context,
 	op *fuseops.SetInodeAttributesOp) (err error) {
 	// Find the inode.
-	fs.mu.Lock()
 	in := fs.inodeOrDie(op.Inode)
-	fs.mu.Unlock()
 
 	in.Lock()
 	defer in.Unlock()
@@ -1039,12 +1794,28 @@ func (fs *fileSystem) SetInodeAttributes(
 	if isFile && op.Size != nil {
 		err = file.Truncate(ctx, int64(*op.Size))
 		if err != nil {
-			err = fmt.Errorf("Truncate: %v", err)
+			if err != syscall.ENOSPC && err != syscall.ESTALE {
+				err = fmt.Errorf("Truncate: %v", err)
+			}
+
 			return
 		}
 	}
 
-	// We silently ignore updates to mode and atime.
+	// Record changes to permissions, if enabled and possible. Otherwise we
+	// silently ignore them, as we do updates to atime.
+	m, isMetadataInode := in.(metadataInode)
+	permsChanged := op.Mode != nil || op.Uid != nil || op.Gid != nil
+	if isMetadataInode && fs.persistPermissions && permsChanged {
+		err = m.UpdateMetadata(
+			ctx,
+			inode.PermissionsMetadata(op.Mode, op.Uid, op.Gid))
+
+		if err != nil {
+			err = fmt.Errorf("UpdateMetadata: %v", err)
+			return
+		}
+	}
 
 	// Fill in the response.
 	op.Attributes, op.AttributesExpiration, err = fs.getAttributes(ctx, in)
@@ -1061,9 +1832,7 @@ func (fs *fileSystem) ForgetInode(
 	ctx context.Context,
 	op *fuseops.ForgetInodeOp) (err error) {
 	// Find the inode.
-	fs.mu.Lock()
 	in := fs.inodeOrDie(op.Inode)
-	fs.mu.Unlock()
 
 	// Acquire both locks in the correct order.
 	in.Lock()
@@ -1080,9 +1849,7 @@ func (fs *fileSystem) MkDir(
 	ctx context.Context,
 	op *fuseops.MkDirOp) (err error) {
 	// Find the parent.
-	fs.mu.Lock()
 	parent := fs.dirInodeOrDie(op.Parent)
-	fs.mu.Unlock()
 
 	// Create an empty backing object for the child, failing if it already
 	// exists.
@@ -1090,6 +1857,8 @@ func (fs *fileSystem) MkDir(
 	o, err := parent.CreateChildDir(ctx, op.Name)
 	parent.Unlock()
 
+	fs.recordCreate(ctx, fs.childObjectName(parent, op.Name)+"/", o, err)
+
 	// Special case: *gcs.PreconditionError means the name already exists.
 	if _, ok := err.(*gcs.PreconditionError); ok {
 		err = fuse.EEXIST
@@ -1117,6 +1886,7 @@ func (fs *fileSystem) MkDir(
 	// Fill out the response.
 	e := &op.Entry
 	e.Child = child.ID()
+	e.EntryExpiration = fs.entryExpiration()
 	e.Attributes, e.AttributesExpiration, err = fs.getAttributes(ctx, child)
 
 	if err != nil {
@@ -1142,6 +1912,7 @@ func (fs *fileSystem) MkNode(
 	// Fill out the response.
 	e := &op.Entry
 	e.Child = child.ID()
+	e.EntryExpiration = fs.entryExpiration()
 	e.Attributes, e.AttributesExpiration, err = fs.getAttributes(ctx, child)
 
 	if err != nil {
@@ -1163,9 +1934,7 @@ func (fs *fileSystem) createFile(
 	name string,
 	mode os.FileMode) (child inode.Inode, err error) {
 	// Find the parent.
-	fs.mu.Lock()
 	parent := fs.dirInodeOrDie(parentID)
-	fs.mu.Unlock()
 
 	// Create an empty backing object for the child, failing if it already
 	// exists.
@@ -1173,6 +1942,8 @@ func (fs *fileSystem) createFile(
 	o, err := parent.CreateChildFile(ctx, name)
 	parent.Unlock()
 
+	fs.recordCreate(ctx, fs.childObjectName(parent, name), o, err)
+
 	// Special case: *gcs.PreconditionError means the name already exists.
 	if _, ok := err.(*gcs.PreconditionError); ok {
 		err = fuse.EEXIST
@@ -1210,22 +1981,28 @@ func (fs *fileSystem) CreateFile(
 
 	defer fs.unlockAndMaybeDisposeOfInode(child, &err)
 
-	// Allocate a handle.
-	fs.mu.Lock()
-
-	handleID := fs.nextHandleID
-	fs.nextHandleID++
-
-	fs.handles[handleID] = handle.NewFileHandle(
+	// Allocate a handle. The file is new, so it must have been opened for
+	// writing.
+	appending := op.Flags&syscall.O_APPEND != 0
+	op.Handle = fs.handles.InsertFile(handle.NewFileHandle(
 		child.(*inode.FileInode),
-		fs.bucket)
-	op.Handle = handleID
+		fs.bucket,
+		fs.contentCache,
+		fs.skippedBuffers,
+		true,
+		appending))
 
-	fs.mu.Unlock()
+	child.(*inode.FileInode).AddWriter(appending)
+
+	// Cache as for OpenFile.
+	op.KeepPageCache = !fs.dropPageCache &&
+		child.(*inode.FileInode).ReadHint() != gcsx.ReadHintDontNeed
+	op.UseDirectIO = fs.directIO
 
 	// Fill out the response.
 	e := &op.Entry
 	e.Child = child.ID()
+	e.EntryExpiration = fs.entryExpiration()
 	e.Attributes, e.AttributesExpiration, err = fs.getAttributes(ctx, child)
 
 	if err != nil {
@@ -1241,15 +2018,15 @@ func (fs *fileSystem) CreateSymlink(
 	ctx context.Context,
 	op *fuseops.CreateSymlinkOp) (err error) {
 	// Find the parent.
-	fs.mu.Lock()
 	parent := fs.dirInodeOrDie(op.Parent)
-	fs.mu.Unlock()
 
 	// Create the object in GCS, failing if it already exists.
 	parent.Lock()
 	o, err := parent.CreateChildSymlink(ctx, op.Name, op.Target)
 	parent.Unlock()
 
+	fs.recordCreate(ctx, fs.childObjectName(parent, op.Name), o, err)
+
 	// Special case: *gcs.PreconditionError means the name already exists.
 	if _, ok := err.(*gcs.PreconditionError); ok {
 		err = fuse.EEXIST
@@ -1277,6 +2054,102 @@ func (fs *fileSystem) CreateSymlink(
 	// Fill out the response.
 	e := &op.Entry
 	e.Child = child.ID()
+	e.EntryExpiration = fs.entryExpiration()
+	e.Attributes, e.AttributesExpiration, err = fs.getAttributes(ctx, child)
+
+	if err != nil {
+		err = fmt.Errorf("getAttributes: %v", err)
+		return
+	}
+
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) (err error) {
+	// GCS can't give one object two names, but if allowed we can give the new
+	// name a copy.
+	if !fs.linkCopies {
+		err = fuse.ENOSYS
+		return
+	}
+
+	parent := fs.dirInodeOrDie(op.Parent)
+
+	// Create the object in GCS, failing if it already exists. A file's local
+	// modifications must be written out first to be copied.
+	var o *gcs.Object
+	var method string
+	switch target := fs.inodes.Get(op.Target).(type) {
+	case *inode.FileInode:
+		err = fs.flushFile(ctx, target)
+		if err != nil {
+			return
+		}
+
+		target.Lock()
+		src := target.Source()
+		target.Unlock()
+
+		method = "CloneToNewChildFile"
+		parent.Lock()
+		o, err = parent.CloneToNewChildFile(ctx, op.Name, src)
+		parent.Unlock()
+
+	case *inode.SymlinkInode:
+		target.Lock()
+		t := target.Target()
+		target.Unlock()
+
+		method = "CreateChildSymlink"
+		parent.Lock()
+		o, err = parent.CreateChildSymlink(ctx, op.Name, t)
+		parent.Unlock()
+
+	default:
+		err = syscall.EPERM
+		return
+	}
+
+	fs.recordCreate(ctx, fs.childObjectName(parent, op.Name), o, err)
+
+	switch err.(type) {
+	case nil:
+
+	// Special case: *gcs.PreconditionError means the name already exists.
+	case *gcs.PreconditionError:
+		err = fuse.EEXIST
+		return
+
+	// Special case: *gcs.NotFoundError means the file has since been replaced
+	// or deleted.
+	case *gcs.NotFoundError:
+		err = fuse.ENOENT
+		return
+
+	default:
+		err = fmt.Errorf("%s: %v", method, err)
+		return
+	}
+
+	// Attempt to create a child inode using the object we created. If we fail to
+	// do so, it means someone beat us to the punch with a newer generation
+	// (unlikely, so we're probably okay with failing here).
+	fs.mu.Lock()
+	child := fs.lookUpOrCreateInodeIfNotStale(o.Name, o)
+	if child == nil {
+		err = fmt.Errorf("Newly-created record is already stale")
+		return
+	}
+
+	defer fs.unlockAndMaybeDisposeOfInode(child, &err)
+
+	// Fill out the response.
+	e := &op.Entry
+	e.Child = child.ID()
+	e.EntryExpiration = fs.entryExpiration()
 	e.Attributes, e.AttributesExpiration, err = fs.getAttributes(ctx, child)
 
 	if err != nil {
@@ -1292,9 +2165,7 @@ func (fs *fileSystem) RmDir(
 	ctx context.Context,
 	op *fuseops.RmDirOp) (err error) {
 	// Find the parent.
-	fs.mu.Lock()
 	parent := fs.dirInodeOrDie(op.Parent)
-	fs.mu.Unlock()
 
 	// Find or create the child inode.
 	child, err := fs.lookUpOrCreateChildInode(ctx, parent, op.Name)
@@ -1360,6 +2231,11 @@ func (fs *fileSystem) RmDir(
 	err = parent.DeleteChildDir(ctx, op.Name)
 	parent.Unlock()
 
+	fs.recordChange(ctx, &audit.Record{
+		Op:   audit.OpDelete,
+		Name: fs.childObjectName(parent, op.Name) + "/",
+	}, err)
+
 	if err != nil {
 		err = fmt.Errorf("DeleteChildDir: %v", err)
 		return
@@ -1373,10 +2249,8 @@ func (fs *fileSystem) Rename(
 	ctx context.Context,
 	op *fuseops.RenameOp) (err error) {
 	// Find the old and new parents.
-	fs.mu.Lock()
 	oldParent := fs.dirInodeOrDie(op.OldParent)
 	newParent := fs.dirInodeOrDie(op.NewParent)
-	fs.mu.Unlock()
 
 	// Find the object in the old location.
 	oldParent.Lock()
@@ -1393,15 +2267,36 @@ func (fs *fileSystem) Rename(
 		return
 	}
 
-	// We don't support renaming directories.
+	// We can rename directories only if GCS can do it for us.
 	if inode.IsDirName(lr.FullName) {
-		err = fuse.ENOSYS
+		if fs.folders == nil {
+			err = fuse.ENOSYS
+			return
+		}
+
+		err = fs.renameDir(
+			ctx,
+			oldParent,
+			op.OldName,
+			lr.FullName,
+			newParent,
+			op.NewName)
 		return
 	}
 
+	// Record the outcome, whichever step fails.
+	r := &audit.Record{
+		Op:               audit.OpRename,
+		Name:             lr.Object.Name,
+		NewName:          fs.childObjectName(newParent, op.NewName),
+		GenerationBefore: lr.Object.Generation,
+	}
+
+	defer func() { fs.recordChange(ctx, r, err) }()
+
 	// Clone into the new location.
 	newParent.Lock()
-	_, err = newParent.CloneToChildFile(
+	clone, err := newParent.CloneToChildFile(
 		ctx,
 		op.NewName,
 		lr.Object)
@@ -1412,6 +2307,9 @@ func (fs *fileSystem) Rename(
 		return
 	}
 
+	r.NewName = clone.Name
+	r.GenerationAfter = clone.Generation
+
 	// Delete behind. Make sure to delete exactly the generation we cloned, in
 	// case the referent of the name has changed in the meantime.
 	oldParent.Lock()
@@ -1430,14 +2328,74 @@ func (fs *fileSystem) Rename(
 	return
 }
 
+// Rename a directory by renaming its folder, which moves everything in it at
+// once. Unlike renaming a file, this doesn't replace an existing directory.
+// oldFolder is the name of the folder found for oldName.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_EXCLUDED(oldParent)
+// LOCKS_EXCLUDED(newParent)
+func (fs *fileSystem) renameDir(
+	ctx context.Context,
+	oldParent inode.DirInode,
+	oldName string,
+	oldFolder string,
+	newParent inode.DirInode,
+	newName string) (err error) {
+	// Refuse to clobber whatever is at the destination.
+	newParent.Lock()
+	lr, err := newParent.LookUpChild(ctx, newName)
+	newParent.Unlock()
+
+	if err != nil {
+		err = fmt.Errorf("LookUpChild: %v", err)
+		return
+	}
+
+	switch {
+	case !lr.Exists():
+
+	case inode.IsDirName(lr.FullName):
+		err = fuse.ENOTEMPTY
+		return
+
+	default:
+		err = fuse.ENOTDIR
+		return
+	}
+
+	newFolder := fs.childObjectName(newParent, newName) + "/"
+	err = fs.folders.RenameFolder(ctx, oldFolder, newFolder)
+
+	fs.recordChange(ctx, &audit.Record{
+		Op:      audit.OpRename,
+		Name:    oldFolder,
+		NewName: newFolder,
+	}, err)
+
+	if err != nil {
+		err = fmt.Errorf("RenameFolder: %v", err)
+		return
+	}
+
+	// Neither parent should trust what it has cached about the names.
+	oldParent.Lock()
+	oldParent.ForgetChild(oldName)
+	oldParent.Unlock()
+
+	newParent.Lock()
+	newParent.ForgetChild(newName)
+	newParent.Unlock()
+
+	return
+}
+
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *fileSystem) Unlink(
 	ctx context.Context,
 	op *fuseops.UnlinkOp) (err error) {
 	// Find the parent.
-	fs.mu.Lock()
 	parent := fs.dirInodeOrDie(op.Parent)
-	fs.mu.Unlock()
 
 	parent.Lock()
 	defer parent.Unlock()
@@ -1449,6 +2407,11 @@ func (fs *fileSystem) Unlink(
 		0,   // Latest generation
 		nil) // No meta-generation precondition
 
+	fs.recordChange(ctx, &audit.Record{
+		Op:   audit.OpDelete,
+		Name: fs.childObjectName(parent, op.Name),
+	}, err)
+
 	if err != nil {
 		err = fmt.Errorf("DeleteChildFile: %v", err)
 		return
@@ -1461,20 +2424,23 @@ func (fs *fileSystem) Unlink(
 func (fs *fileSystem) OpenDir(
 	ctx context.Context,
 	op *fuseops.OpenDirOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
 	// Make sure the inode still exists and is a directory. If not, something has
 	// screwed up because the VFS layer shouldn't have let us forget the inode
 	// before opening it.
 	in := fs.dirInodeOrDie(op.Inode)
 
 	// Allocate a handle.
-	handleID := fs.nextHandleID
-	fs.nextHandleID++
+	op.Handle = fs.handles.InsertDir(newDirHandle(in, fs.implicitDirs, fs.conflictSuffix))
 
-	fs.handles[handleID] = newDirHandle(in, fs.implicitDirs)
-	op.Handle = handleID
+	// Let the kernel cache the entries if configured to, keeping what it
+	// already has if that's recent enough.
+	if fs.kernelListCacheTTL > 0 {
+		op.CacheDir = true
+
+		in.Lock()
+		op.KeepCache = in.KeepKernelListCache(fs.kernelListCacheTTL)
+		in.Unlock()
+	}
 
 	return
 }
@@ -1484,9 +2450,10 @@ func (fs *fileSystem) ReadDir(
 	ctx context.Context,
 	op *fuseops.ReadDirOp) (err error) {
 	// Find the handle.
-	fs.mu.Lock()
-	dh := fs.handles[op.Handle].(*dirHandle)
-	fs.mu.Unlock()
+	dh, err := fs.handles.Dir(op.Handle)
+	if err != nil {
+		return
+	}
 
 	dh.Mu.Lock()
 	defer dh.Mu.Unlock()
@@ -1501,14 +2468,8 @@ func (fs *fileSystem) ReadDir(
 func (fs *fileSystem) ReleaseDirHandle(
 	ctx context.Context,
 	op *fuseops.ReleaseDirHandleOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
-	// Sanity check that this handle exists and is of the correct type.
-	_ = fs.handles[op.Handle].(*dirHandle)
-
-	// Clear the entry from the map.
-	delete(fs.handles, op.Handle)
+	// Clear the entry from the table.
+	_, err = fs.handles.RemoveDir(op.Handle)
 
 	return
 }
@@ -1517,24 +2478,59 @@ func (fs *fileSystem) ReleaseDirHandle(
 func (fs *fileSystem) OpenFile(
 	ctx context.Context,
 	op *fuseops.OpenFileOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
 	// Find the inode.
 	in := fs.fileInodeOrDie(op.Inode)
 
-	// Allocate a handle.
-	handleID := fs.nextHandleID
-	fs.nextHandleID++
+	// If asked to, make sure that the inode still holds the latest generation
+	// of its object. If not, ESTALE makes the kernel look up the name again
+	// and retry the open on the inode it finds.
+	if fs.revalidateOnOpen {
+		var clobbered bool
+
+		in.Lock()
+		clobbered, err = in.Clobbered(ctx)
+		in.Unlock()
+
+		if err != nil {
+			err = fmt.Errorf("Clobbered: %v", err)
+			return
+		}
+
+		if clobbered {
+			fs.noteClobbered(in)
+			err = syscall.ESTALE
+			return
+		}
+	}
 
-	fs.handles[handleID] = handle.NewFileHandle(in, fs.bucket)
-	op.Handle = handleID
+	// Allocate a handle.
+	writable := op.Flags&syscall.O_ACCMODE != syscall.O_RDONLY
+	appending := writable && op.Flags&syscall.O_APPEND != 0
+	op.Handle = fs.handles.InsertFile(handle.NewFileHandle(
+		in,
+		fs.bucket,
+		fs.contentCache,
+		fs.skippedBuffers,
+		writable,
+		appending))
 
 	// When we observe object generations that we didn't create, we assign them
 	// new inode IDs. So for a given inode, all modifications go through the
 	// kernel. Therefore it's safe to tell the kernel to keep the page cache from
 	// open to open for a given inode.
-	op.KeepPageCache = true
+	//
+	// The exceptions are when the user has told us that the data won't be
+	// needed again, in which case we let the kernel drop it, and when the mount
+	// has been configured not to cache.
+	in.Lock()
+	op.KeepPageCache = !fs.dropPageCache && in.ReadHint() != gcsx.ReadHintDontNeed
+	if writable {
+		in.AddWriter(appending)
+	}
+
+	in.Unlock()
+
+	op.UseDirectIO = fs.directIO
 
 	return
 }
@@ -1544,9 +2540,10 @@ func (fs *fileSystem) ReadFile(
 	ctx context.Context,
 	op *fuseops.ReadFileOp) (err error) {
 	// Find the handle and lock it.
-	fs.mu.Lock()
-	fh := fs.handles[op.Handle].(*handle.FileHandle)
-	fs.mu.Unlock()
+	fh, err := fs.handles.File(op.Handle)
+	if err != nil {
+		return
+	}
 
 	fh.Lock()
 	defer fh.Unlock()
@@ -1559,93 +2556,727 @@ func (fs *fileSystem) ReadFile(
 		err = nil
 	}
 
+	// If the kernel interrupted the read, for example because the reading
+	// process was killed, our GCS request has been cancelled; say so.
+	if err != nil && ctx.Err() != nil {
+		err = syscall.EINTR
+	}
+
 	return
 }
 
 // LOCKS_EXCLUDED(fs.mu)
-func (fs *fileSystem) ReadSymlink(
+func (fs *fileSystem) SeekFile(
 	ctx context.Context,
-	op *fuseops.ReadSymlinkOp) (err error) {
+	op *fuseops.SeekFileOp) (err error) {
+	if op.Whence != fuseops.SeekData && op.Whence != fuseops.SeekHole {
+		err = fuse.EINVAL
+		return
+	}
+
 	// Find the inode.
-	fs.mu.Lock()
-	in := fs.symlinkInodeOrDie(op.Inode)
-	fs.mu.Unlock()
+	in := fs.fileInodeOrDie(op.Inode)
 
 	in.Lock()
 	defer in.Unlock()
 
 	// Serve the request.
-	op.Target = in.Target()
+	op.NewOffset, err = in.SeekData(ctx, op.Offset, op.Whence == fuseops.SeekHole)
 
 	return
 }
 
 // LOCKS_EXCLUDED(fs.mu)
-func (fs *fileSystem) WriteFile(
+func (fs *fileSystem) GetFileLock(
 	ctx context.Context,
-	op *fuseops.WriteFileOp) (err error) {
-	// Find the inode.
-	fs.mu.Lock()
-	in := fs.fileInodeOrDie(op.Inode)
-	fs.mu.Unlock()
+	op *fuseops.GetFileLockOp) (err error) {
+	if fs.rejectFileLocks {
+		err = syscall.ENOLCK
+		return
+	}
 
-	in.Lock()
-	defer in.Unlock()
+	fs.locks.Test(op)
+	return
+}
 
-	// Serve the request.
-	err = in.Write(ctx, op.Data, op.Offset)
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) SetFileLock(
+	ctx context.Context,
+	op *fuseops.SetFileLockOp) (err error) {
+	if fs.rejectFileLocks {
+		err = syscall.ENOLCK
+		return
+	}
+
+	// Take the lease on the file before granting a write lock, so that the
+	// lock table can take another reference to it without blocking. See
+	// leaseWriteLocked.
+	if fs.leaser != nil && op.Lock.Type == syscall.F_WRLCK {
+		name := fs.inodes.Get(op.Inode).Name()
+		err = fs.leaser.Acquire(ctx, name, op.Wait)
+		switch {
+		case err == gcsx.ErrLeaseHeld:
+			err = syscall.EAGAIN
+			return
+
+		case err == ctx.Err() && err != nil:
+			err = syscall.EINTR
+			return
+
+		case err != nil:
+			err = fmt.Errorf("Acquire: %v", err)
+			return
+		}
 
+		defer fs.leaser.Release(name)
+	}
+
+	err = fs.locks.Set(ctx, op)
 	return
 }
 
+// Hold the lease on a file for as long as write locks are held on it. When the
+// first is granted, the SetFileLock granting it has already taken the lease.
+//
+// LOCKS_REQUIRED(fs.locks.mu)
+func (fs *fileSystem) leaseWriteLocked(id fuseops.InodeID, locked bool) {
+	name := fs.inodes.Get(id).Name()
+	if !locked {
+		fs.leaser.Release(name)
+		return
+	}
+
+	err := fs.leaser.Acquire(context.Background(), name, false)
+	if err != nil {
+		panic(fmt.Sprintf("Acquire(%q) with the lease held: %v", name, err))
+	}
+}
+
 // LOCKS_EXCLUDED(fs.mu)
-func (fs *fileSystem) SyncFile(
+func (fs *fileSystem) ReadSymlink(
 	ctx context.Context,
-	op *fuseops.SyncFileOp) (err error) {
+	op *fuseops.ReadSymlinkOp) (err error) {
 	// Find the inode.
-	fs.mu.Lock()
-	in := fs.fileInodeOrDie(op.Inode)
-	fs.mu.Unlock()
+	in := fs.symlinkInodeOrDie(op.Inode)
 
 	in.Lock()
 	defer in.Unlock()
 
-	// Sync it.
-	err = fs.syncFile(ctx, in)
+	// Serve the request.
+	op.Target = in.Target()
 
 	return
 }
 
 // LOCKS_EXCLUDED(fs.mu)
-func (fs *fileSystem) FlushFile(
+func (fs *fileSystem) WriteFile(
 	ctx context.Context,
-	op *fuseops.FlushFileOp) (err error) {
+	op *fuseops.WriteFileOp) (err error) {
 	// Find the inode.
-	fs.mu.Lock()
 	in := fs.fileInodeOrDie(op.Inode)
-	fs.mu.Unlock()
+
+	// Hold back the write while there is too much dirty data, without holding
+	// the inode's lock so that it can be synced meanwhile. Write back the file
+	// that has been dirty longest to make room.
+	err = fs.dirty.Wait(ctx, op.Inode, fs.writeBack)
+	if err != nil {
+		if err == ctx.Err() {
+			err = syscall.EINTR
+		} else {
+			err = fmt.Errorf("writeBack: %v", err)
+		}
+
+		return
+	}
 
 	in.Lock()
 	defer in.Unlock()
 
-	// Sync it.
-	err = fs.syncFile(ctx, in)
+	// Serve the request.
+	err = in.Write(ctx, op.Data, op.Offset)
 
 	return
 }
 
-// LOCKS_EXCLUDED(fs.mu)
-func (fs *fileSystem) ReleaseFileHandle(
-	ctx context.Context,
-	op *fuseops.ReleaseFileHandleOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+// Return the number of bytes to report copied for the supplied op, given that
+// the whole of an object of the supplied size has been copied.
+func copiedLength(op *fuseops.CopyFileRangeOp, size uint64) (n uint64) {
+	if uint64(op.SrcOffset) >= size {
+		return
+	}
+
+	n = size - uint64(op.SrcOffset)
+	if n > op.Length {
+		n = op.Length
+	}
+
+	if n > math.MaxUint32 {
+		n = math.MaxUint32
+	}
+
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) (err error) {
+	// We can copy only by having GCS rewrite the whole of one object over
+	// another. For anything else, let the kernel fall back to reading and
+	// writing.
+	err = syscall.EOPNOTSUPP
+	if op.SrcInode == op.DstInode || op.SrcOffset != op.DstOffset {
+		return
+	}
+
+	// Find the source object, which must hold exactly what the file does.
+	src := fs.fileInodeOrDie(op.SrcInode)
+	src.Lock()
+	o := src.Source()
+	authoritative := src.SourceGenerationIsAuthoritative()
+	src.Unlock()
+
+	if !authoritative {
+		return
+	}
+
+	dst := fs.fileInodeOrDie(op.DstInode)
+	dst.Lock()
+	defer dst.Unlock()
+
+	// The kernel can be told of less than 4 GiB copied at a time, so it asks
+	// for the rest of a larger copy piece by piece. Those pieces are already
+	// done.
+	if op.SrcOffset > 0 {
+		if dst.CopiedFrom(o) {
+			err = nil
+			op.BytesCopied = copiedLength(op, o.Size)
+		}
+
+		return
+	}
+
+	// The copy must replace every byte of the destination. Newer kernels ask
+	// for no more than a page short of 4 GiB at a time, so a request for that
+	// much is taken to be for the whole of the file.
+	maxLength := uint64(math.MaxUint32) &^ uint64(os.Getpagesize()-1)
+	if op.Length < o.Size && op.Length < maxLength {
+		return
+	}
+
+	attrs, err := dst.Attributes(ctx)
+	if err != nil {
+		err = fmt.Errorf("Attributes: %v", err)
+		return
+	}
+
+	if attrs.Size > o.Size {
+		err = syscall.EOPNOTSUPP
+		return
+	}
+
+	before := dst.SourceGeneration().Object
+	err = dst.CopyFrom(ctx, o)
+
+	fs.recordChange(ctx, &audit.Record{
+		Op:               audit.OpWrite,
+		Name:             dst.Name(),
+		GenerationBefore: before,
+		GenerationAfter:  dst.SourceGeneration().Object,
+	}, err)
+
+	switch err.(type) {
+	case nil:
+
+	case *gcs.NotFoundError, *gcs.PreconditionError:
+		// One of the files has changed in GCS. Copying the usual way will find
+		// out how.
+		err = syscall.EOPNOTSUPP
+		return
+
+	default:
+		if err != syscall.ESTALE {
+			err = fmt.Errorf("CopyFrom: %v", err)
+		}
+
+		return
+	}
+
+	op.BytesCopied = copiedLength(op, o.Size)
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) (err error) {
+	// Find the inode.
+	in := fs.fileInodeOrDie(op.Inode)
+
+	// Sync it.
+	err = fs.flushFile(ctx, in)
+
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) (err error) {
+	// Closing any descriptor for a file releases its owner's POSIX locks.
+	fs.locks.ReleasePOSIX(op.Inode, op.LockOwner)
+
+	// Closing a file that was opened only for reading doesn't make anyone
+	// else's writes durable; they will be flushed when their own handles are.
+	fh, err := fs.handles.File(op.Handle)
+	if err != nil || !fh.Writable() {
+		return
+	}
+
+	// Find the inode.
+	in := fs.fileInodeOrDie(op.Inode)
+
+	// Sync it.
+	err = fs.flushFile(ctx, in)
+
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) (err error) {
+	// Remove the handle from the table and destroy it.
+	fh, err := fs.handles.RemoveFile(op.Handle)
+	if err != nil {
+		return
+	}
+
+	fh.Destroy()
 
-	// Destroy the handle.
-	fs.handles[op.Handle].(*handle.FileHandle).Destroy()
+	if op.FlockUnlock {
+		fs.locks.ReleaseFlock(fh.Inode().ID(), op.LockOwner)
+	}
+
+	if fh.Writable() {
+		in := fh.Inode()
+		in.Lock()
+		in.RemoveWriter(fh.Appending())
+		in.Unlock()
+	}
 
-	// Update the map.
-	delete(fs.handles, op.Handle)
+	return
+}
+
+// The extended attribute through which users may give a posix_fadvise-style
+// hint about how a file will be read, e.g.
+//
+//     setfattr -n user.gcsfuse.fadvise -v sequential some/file
+//
+// Fuse doesn't pass posix_fadvise(2) calls through to the file system, so this
+// is the only way for us to learn of them.
+const fadviseXattrName = "user.gcsfuse.fadvise"
+
+var fadviseHints = map[string]gcsx.ReadHint{
+	"normal":     gcsx.ReadHintNormal,
+	"sequential": gcsx.ReadHintSequential,
+	"random":     gcsx.ReadHintRandom,
+	"willneed":   gcsx.ReadHintWillNeed,
+	"dontneed":   gcsx.ReadHintDontNeed,
+}
+
+// Return the file inode with the given ID, or nil if it is some other kind of
+// inode.
+func (fs *fileSystem) fileInodeOrNil(id fuseops.InodeID) (f *inode.FileInode) {
+	f, _ = fs.inodeOrDie(id).(*inode.FileInode)
+	return
+}
+
+// The read-only extended attribute through which users may see a file inode's
+// counters, as JSON, e.g.
+//
+//     getfattr --only-values -n user.gcsfuse.stats some/file
+//
+// See inode.FileStats.
+const statsXattrName = "user.gcsfuse.stats"
+
+// The prefix of the read-only extended attributes that expose properties of a
+// file's backing object, e.g.
+//
+//     getfattr -d -m '^user\.gcs\.' some/file
+//
+// See objectXattrs.
+const objectXattrPrefix = "user.gcs."
+
+// Return the extended attributes describing the given object, by name,
+// omitting properties that aren't set. Hashes are base64-encoded big-endian
+// bytes, as in the GCS JSON API.
+func objectXattrs(o *gcs.Object) (m map[string]string) {
+	var crc32c [4]byte
+	binary.BigEndian.PutUint32(crc32c[:], o.CRC32C)
+
+	props := map[string]string{
+		"generation":          strconv.FormatInt(o.Generation, 10),
+		"metageneration":      strconv.FormatInt(o.MetaGeneration, 10),
+		"crc32c":              base64.StdEncoding.EncodeToString(crc32c[:]),
+		"storage_class":       o.StorageClass,
+		"kms_key_name":        o.KmsKeyName,
+		"customer_key_sha256": o.CustomerKeySHA256,
+		"content_type":        o.ContentType,
+		"content_encoding":    o.ContentEncoding,
+		"content_language":    o.ContentLanguage,
+		"cache_control":       o.CacheControl,
+	}
+
+	// GCS leaves out the checksum of an object encrypted with a
+	// customer-supplied key unless the key was supplied.
+	if o.CustomerKeySHA256 != "" && o.CRC32C == 0 && o.MD5 == nil {
+		delete(props, "crc32c")
+	}
+
+	// Composite objects have no MD5.
+	if o.MD5 != nil {
+		props["md5"] = base64.StdEncoding.EncodeToString(o.MD5[:])
+	}
+
+	if o.ComponentCount > 0 {
+		props["component_count"] = strconv.FormatInt(o.ComponentCount, 10)
+	}
+
+	if !o.Updated.IsZero() {
+		props["updated"] = o.Updated.UTC().Format(time.RFC3339Nano)
+	}
+
+	m = make(map[string]string)
+	for k, v := range props {
+		if v != "" {
+			m[objectXattrPrefix+k] = v
+		}
+	}
+
+	return
+}
+
+// The prefix of the extended attributes that map to the custom metadata of a
+// file's backing object, e.g. user.pipeline_status for the key
+// pipeline_status. Names under the prefixes above are excluded, as are keys
+// that gcsfuse maintains itself. See metadataKeyForXattr.
+const metadataXattrPrefix = "user."
+
+// The limit that GCS imposes on the total size of an object's custom metadata.
+const maxMetadataBytes = 8 << 10
+
+// Flags for setxattr(2).
+const (
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+)
+
+// Return the custom metadata key to which the named extended attribute maps,
+// or an error to return to the kernel if it doesn't map to one.
+func metadataKeyForXattr(name string) (key string, err error) {
+	switch {
+	case !strings.HasPrefix(name, metadataXattrPrefix):
+		err = syscall.ENOTSUP
+
+	case strings.HasPrefix(name, objectXattrPrefix),
+		strings.HasPrefix(name, "user.gcsfuse."):
+		err = syscall.EPERM
+
+	default:
+		key = strings.TrimPrefix(name, metadataXattrPrefix)
+		switch {
+		case key == "":
+			err = fuse.EINVAL
+
+		case strings.HasPrefix(key, "gcsfuse_"), gcsx.IsContentMetadataKey(key):
+			err = syscall.EPERM
+		}
+	}
+
+	return
+}
+
+// Return the extended attributes that map to the given object's custom
+// metadata, by name.
+func metadataXattrs(o *gcs.Object) (m map[string]string) {
+	m = make(map[string]string)
+	for k, v := range o.Metadata {
+		name := metadataXattrPrefix + k
+		if _, err := metadataKeyForXattr(name); err == nil {
+			m[name] = v
+		}
+	}
+
+	return
+}
+
+// Return the value of the fadvise extended attribute for the inode, or
+// ENOATTR if no hint is set.
+//
+// LOCKS_EXCLUDED(in)
+func fadviseXattrValue(in *inode.FileInode) (value []byte, err error) {
+	in.Lock()
+	h := in.ReadHint()
+	in.Unlock()
+
+	if h == gcsx.ReadHintNormal {
+		err = fuse.ENOATTR
+		return
+	}
+
+	for k, v := range fadviseHints {
+		if v == h {
+			value = []byte(k)
+		}
+	}
+
+	return
+}
+
+// Return the value of the stats extended attribute for the inode.
+func statsXattrValue(in *inode.FileInode) (value []byte, err error) {
+	value, err = json.Marshal(in.Stats())
+	if err != nil {
+		err = fmt.Errorf("Marshal: %v", err)
+		return
+	}
+
+	return
+}
+
+// Copy an extended attribute's value into the op's buffer, or just report its
+// size if the buffer is empty, as getxattr(2) does.
+func copyXattrValue(op *fuseops.GetXattrOp, value []byte) (err error) {
+	op.BytesRead = len(value)
+	if len(op.Dst) == 0 {
+		return
+	}
+
+	if len(op.Dst) < len(value) {
+		err = syscall.ERANGE
+		return
+	}
+
+	copy(op.Dst, value)
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) (err error) {
+	in := fs.fileInodeOrNil(op.Inode)
+
+	if in == nil {
+		err = fuse.ENOATTR
+		return
+	}
+
+	var value []byte
+	switch op.Name {
+	case fadviseXattrName:
+		value, err = fadviseXattrValue(in)
+
+	case statsXattrName:
+		value, err = statsXattrValue(in)
+
+	default:
+		in.Lock()
+		o := in.Source()
+		in.Unlock()
+
+		v, ok := objectXattrs(o)[op.Name]
+		if !ok {
+			v, ok = metadataXattrs(o)[op.Name]
+		}
+
+		if !ok {
+			err = fuse.ENOATTR
+			break
+		}
+
+		value = []byte(v)
+	}
+
+	if err != nil {
+		return
+	}
+
+	err = copyXattrValue(op, value)
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) (err error) {
+	in := fs.fileInodeOrNil(op.Inode)
+
+	// Only files have extended attributes.
+	if in == nil {
+		return
+	}
+
+	in.Lock()
+	o := in.Source()
+	hint := in.ReadHint()
+	in.Unlock()
+
+	names := []string{statsXattrName}
+	if hint != gcsx.ReadHintNormal {
+		names = append(names, fadviseXattrName)
+	}
+
+	for k := range objectXattrs(o) {
+		names = append(names, k)
+	}
+
+	for k := range metadataXattrs(o) {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	// Write out NUL-terminated names, or just report the size if the buffer is
+	// empty.
+	var buf bytes.Buffer
+	for _, n := range names {
+		buf.WriteString(n)
+		buf.WriteByte(0)
+	}
+
+	op.BytesRead = buf.Len()
+	if len(op.Dst) == 0 {
+		return
+	}
+
+	if len(op.Dst) < buf.Len() {
+		err = syscall.ERANGE
+		return
+	}
+
+	copy(op.Dst, buf.Bytes())
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) (err error) {
+	in := fs.fileInodeOrNil(op.Inode)
+
+	if in == nil {
+		err = syscall.ENOTSUP
+		return
+	}
+
+	// Hints live only in memory.
+	if op.Name == fadviseXattrName {
+		h, ok := fadviseHints[string(op.Value)]
+		if !ok {
+			err = fuse.EINVAL
+			return
+		}
+
+		in.Lock()
+		in.SetReadHint(h)
+		in.Unlock()
+
+		return
+	}
+
+	// Anything else must map to custom metadata, whose values are strings.
+	key, err := metadataKeyForXattr(op.Name)
+	if err != nil {
+		return
+	}
+
+	if !utf8.Valid(op.Value) {
+		err = fuse.EINVAL
+		return
+	}
+
+	value := string(op.Value)
+
+	in.Lock()
+	defer in.Unlock()
+
+	metadata := in.Source().Metadata
+	old, exists := metadata[key]
+
+	switch {
+	case op.Flags&xattrCreate != 0 && exists:
+		err = syscall.EEXIST
+		return
+
+	case op.Flags&xattrReplace != 0 && !exists:
+		err = fuse.ENOATTR
+		return
+	}
+
+	// Check the size limit ourselves, so that we can return the appropriate
+	// error.
+	size := len(value) - len(old)
+	if !exists {
+		size += len(key)
+	}
+
+	for k, v := range metadata {
+		size += len(k) + len(v)
+	}
+
+	if size > maxMetadataBytes {
+		err = syscall.ENOSPC
+		return
+	}
+
+	err = in.UpdateMetadata(ctx, map[string]*string{key: &value})
+	if err != nil {
+		err = fmt.Errorf("UpdateMetadata: %v", err)
+		return
+	}
+
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) (err error) {
+	in := fs.fileInodeOrNil(op.Inode)
+
+	if in == nil {
+		err = fuse.ENOATTR
+		return
+	}
+
+	if op.Name == fadviseXattrName {
+		in.Lock()
+		in.SetReadHint(gcsx.ReadHintNormal)
+		in.Unlock()
+
+		return
+	}
+
+	key, err := metadataKeyForXattr(op.Name)
+	if err != nil {
+		return
+	}
+
+	in.Lock()
+	defer in.Unlock()
+
+	if _, ok := in.Source().Metadata[key]; !ok {
+		err = fuse.ENOATTR
+		return
+	}
+
+	err = in.UpdateMetadata(ctx, map[string]*string{key: nil})
+	if err != nil {
+		err = fmt.Errorf("UpdateMetadata: %v", err)
+		return
+	}
 
 	return
 }
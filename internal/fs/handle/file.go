@@ -17,6 +17,7 @@ package handle
 import (
 	"fmt"
 	"io"
+	"syscall"
 
 	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
 	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
@@ -25,12 +26,34 @@ import (
 	"golang.org/x/net/context"
 )
 
+// ReadState describes the reads made through a file handle so far.
+type ReadState struct {
+	// The offset just past the end of the latest read, where the next read
+	// starts if it carries on sequentially. Zero before the first read.
+	NextOffset int64
+
+	// The number of reads that started at NextOffset, and the number that
+	// started elsewhere.
+	SequentialReads uint64
+	Seeks           uint64
+}
+
+// A FileHandle is an open file, either for reading only or for writing too.
 type FileHandle struct {
-	inode  *inode.FileInode
-	bucket gcs.Bucket
+	inode          *inode.FileInode
+	bucket         gcs.Bucket
+	cache          *gcsx.BlockCache
+	skippedBuffers *gcsx.BufferPool
+	writable       bool
+	appending      bool
 
 	mu syncutil.InvariantMutex
 
+	// INVARIANT: readState.NextOffset >= 0
+	//
+	// GUARDED_BY(mu)
+	readState ReadState
+
 	// A random reader configured to some (potentially previous) generation of
 	// the object backing the inode, or nil.
 	//
@@ -40,12 +63,25 @@ type FileHandle struct {
 	reader gcsx.RandomReader
 }
 
+// NewFileHandle creates a handle for the supplied inode, reading through the
+// given bucket and, if it is non-nil, the given cache. Its readers keep the
+// bytes they skip over in buffers from skippedBuffers, if non-nil. writable
+// says whether the file was opened for writing, and appending whether it was
+// opened with O_APPEND.
 func NewFileHandle(
 	inode *inode.FileInode,
-	bucket gcs.Bucket) (fh *FileHandle) {
+	bucket gcs.Bucket,
+	cache *gcsx.BlockCache,
+	skippedBuffers *gcsx.BufferPool,
+	writable bool,
+	appending bool) (fh *FileHandle) {
 	fh = &FileHandle{
-		inode:  inode,
-		bucket: bucket,
+		inode:          inode,
+		bucket:         bucket,
+		cache:          cache,
+		skippedBuffers: skippedBuffers,
+		writable:       writable,
+		appending:      appending,
 	}
 
 	fh.mu = syncutil.NewInvariantMutex(fh.checkInvariants)
@@ -66,6 +102,23 @@ func (fh *FileHandle) Inode() *inode.FileInode {
 	return fh.inode
 }
 
+// Writable reports whether the file was opened for writing.
+func (fh *FileHandle) Writable() bool {
+	return fh.writable
+}
+
+// Appending reports whether the file was opened with O_APPEND.
+func (fh *FileHandle) Appending() bool {
+	return fh.appending
+}
+
+// ReadState returns a description of the reads made through the handle.
+//
+// LOCKS_REQUIRED(fh)
+func (fh *FileHandle) ReadState() ReadState {
+	return fh.readState
+}
+
 func (fh *FileHandle) Lock() {
 	fh.mu.Lock()
 }
@@ -83,6 +136,8 @@ func (fh *FileHandle) Read(
 	ctx context.Context,
 	dst []byte,
 	offset int64) (n int, err error) {
+	defer fh.noteRead(offset, &n)
+
 	// Lock the inode and attempt to ensure that we have a reader for its current
 	// state, or clear fh.reader if it's not possible to create one (probably
 	// because the inode is dirty).
@@ -99,9 +154,23 @@ func (fh *FileHandle) Read(
 	// multiple reads can run concurrently. It's safe because the user can't tell
 	// if a concurrent write started during or after a read.
 	if fh.reader != nil {
+		fh.reader.SetHint(fh.inode.ReadHint())
 		fh.inode.Unlock()
 
 		n, err = fh.reader.ReadAt(ctx, dst, offset)
+		fh.inode.RecordDirectRead(n, err)
+
+		// If the generation has gone away, let the inode decide what to report.
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			fh.inode.Lock()
+			err = fh.inode.NoteClobbered(err)
+			fh.inode.Unlock()
+
+			if err == syscall.ESTALE {
+				return
+			}
+		}
+
 		switch {
 		case err == io.EOF:
 			return
@@ -127,12 +196,30 @@ func (fh *FileHandle) Read(
 
 // LOCKS_REQUIRED(fh.mu)
 func (fh *FileHandle) checkInvariants() {
+	// INVARIANT: readState.NextOffset >= 0
+	if fh.readState.NextOffset < 0 {
+		panic(fmt.Sprintf("Negative next offset: %d", fh.readState.NextOffset))
+	}
+
 	// INVARIANT: If reader != nil, reader.CheckInvariants() doesn't panic.
 	if fh.reader != nil {
 		fh.reader.CheckInvariants()
 	}
 }
 
+// Update the read state for a read of *n bytes at the given offset.
+//
+// LOCKS_REQUIRED(fh)
+func (fh *FileHandle) noteRead(offset int64, n *int) {
+	if offset == fh.readState.NextOffset {
+		fh.readState.SequentialReads++
+	} else {
+		fh.readState.Seeks++
+	}
+
+	fh.readState.NextOffset = offset + int64(*n)
+}
+
 // If possible, ensure that fh.reader is set to an appropriate random reader
 // for the current state of the inode. Otherwise set it to nil.
 //
@@ -162,12 +249,24 @@ func (fh *FileHandle) tryEnsureReader() (err error) {
 	}
 
 	// Attempt to create an appropriate reader.
-	rr, err := gcsx.NewRandomReader(fh.inode.Source(), fh.bucket)
+	rr, err := gcsx.NewRandomReader(
+		fh.inode.Source(),
+		fh.bucket,
+		fh.skippedBuffers)
 	if err != nil {
 		err = fmt.Errorf("NewRandomReader: %v", err)
 		return
 	}
 
+	if fh.cache != nil {
+		rr = gcsx.NewCachingReader(rr, fh.cache)
+	}
+
+	// Serve the object's recorded runs of zeros without fetching them.
+	if holes := fh.inode.SourceHoles(); len(holes) > 0 {
+		rr = gcsx.NewSparseReader(rr, holes)
+	}
+
 	fh.reader = rr
 	return
 }
@@ -16,7 +16,6 @@ package inode
 
 import (
 	"fmt"
-	"path"
 	"strings"
 	"sync"
 	"time"
@@ -64,6 +63,9 @@ func (lr *LookUpResult) Exists() bool {
 // An inode representing a directory, with facilities for listing entries,
 // looking up children, and creating and deleting children. Must be locked for
 // any method additional to the Inode interface.
+//
+// The names of children taken and returned by the methods are file system
+// names, which stand for object name components as described for EscapeName.
 type DirInode interface {
 	Inode
 
@@ -73,9 +75,11 @@ type DirInode interface {
 	// both exist, the directory is preferred. Return a result with
 	// !result.Exists() and a nil error if neither is found.
 	//
-	// Special case: if the name ends in ConflictingFileNameSuffix, we strip the
-	// suffix, confirm that a conflicting directory exists, then return a result
-	// for the file/symlink.
+	// Special case: if the name ends in the inode's conflict suffix (see
+	// NewDirInode), we strip the suffix, confirm that a conflicting directory
+	// exists, then return a result for the file/symlink. If it doesn't, a name
+	// ending in a suffix other than ConflictingFileNameSuffix is looked up as
+	// usual, since an object may have that name.
 	//
 	// If this inode was created with implicitDirs is set, this method will use
 	// ListObjects to find child directories that are "implicitly" defined by the
@@ -115,6 +119,14 @@ type DirInode interface {
 		name string,
 		src *gcs.Object) (o *gcs.Object, err error)
 
+	// Like CloneToChildFile, except fail with *gcs.PreconditionError if a
+	// backing object already exists in GCS. Only the source object's generation
+	// is checked, not its meta-generation.
+	CloneToNewChildFile(
+		ctx context.Context,
+		name string,
+		src *gcs.Object) (o *gcs.Object, err error)
+
 	// Create a symlink object with the supplied (relative) name and the supplied
 	// target, failing with *gcs.PreconditionError if a backing object already
 	// exists in GCS.
@@ -147,6 +159,20 @@ type DirInode interface {
 	DeleteChildDir(
 		ctx context.Context,
 		name string) (err error)
+
+	// Change the TTL of the cache from child name to type, as described for
+	// NewDirInode. Anything already cached is forgotten.
+	SetTypeCacheTTL(ttl time.Duration)
+
+	// Forget anything cached about the type of the child with the given name,
+	// e.g. because it is known to have changed.
+	ForgetChild(name string)
+
+	// Report whether the kernel may keep the entries it has cached from earlier
+	// reads of the directory when a new handle is opened. If not, the kernel is
+	// expected to start caching afresh, and may then keep what it caches for
+	// the supplied TTL, unless a child is created, deleted, or forgotten.
+	KeepKernelListCache(ttl time.Duration) bool
 }
 
 type dirInode struct {
@@ -162,14 +188,16 @@ type dirInode struct {
 	// Constant data
 	/////////////////////////
 
-	id           fuseops.InodeID
-	implicitDirs bool
+	id             fuseops.InodeID
+	implicitDirs   bool
+	conflictSuffix string
+	normalization  Normalization
+	countSubdirs   bool
+	lookupBurst    int
 
 	// INVARIANT: name == "" || name[len(name)-1] == '/'
 	name string
 
-	attrs fuseops.InodeAttributes
-
 	/////////////////////////
 	// Mutable state
 	/////////////////////////
@@ -178,6 +206,14 @@ type dirInode struct {
 	// for each method.
 	mu syncutil.InvariantMutex
 
+	// Held in memory, so that stat needs no request. The mtime and ctime move
+	// forward when children are created or deleted through this inode, but
+	// not for changes made elsewhere, which we'd have to list the directory
+	// to notice.
+	//
+	// GUARDED_BY(mu)
+	attrs fuseops.InodeAttributes
+
 	// GUARDED_BY(mu)
 	lc lookupCount
 
@@ -185,6 +221,19 @@ type dirInode struct {
 	//
 	// GUARDED_BY(mu)
 	cache typeCache
+
+	// Until when the kernel may keep the entries it has cached for the
+	// directory. See KeepKernelListCache.
+	//
+	// GUARDED_BY(mu)
+	kernelListCacheExpiration time.Time
+
+	// The number of lookups since burstStart that the type cache couldn't
+	// answer. See lookUpBurst.
+	//
+	// GUARDED_BY(mu)
+	burstStart  time.Time
+	burstMisses int
 }
 
 var _ DirInode = &dirInode{}
@@ -198,6 +247,19 @@ var _ DirInode = &dirInode{}
 // descendents. For example, if there is an object named "foo/bar/baz" and this
 // is the directory "foo", a child directory named "bar" will be implied.
 //
+// conflictSuffix is appended to the name of a file/symlink that has the same
+// name as a directory, so that both can be shown. It is normally
+// ConflictingFileNameSuffix.
+//
+// normalization is applied to the names of children when listing and
+// creating them. Names looked up or deleted may stand for objects whose names
+// are in any form.
+//
+// If countSubdirs is set, the inode's link count is two plus the number of
+// child directories, as on a local file system, at the cost of listing the
+// directory when attributes are requested. Otherwise it is one, which tools
+// like find take to mean that the count is unknown.
+//
 // If typeCacheTTL is non-zero, a cache from child name to information about
 // whether that name exists as a file/symlink and/or directory will be
 // maintained. This may speed up calls to LookUpChild, especially when combined
@@ -205,6 +267,12 @@ var _ DirInode = &dirInode{}
 // child is removed and recreated with a different type before the expiration,
 // we may fail to find it.
 //
+// If lookupBurst is non-zero and the type cache is enabled, a burst of that
+// many lookups within lookupBurstWindow that the cache can't answer, as from
+// shell globbing or find, causes the directory to be listed, so that the
+// lookups of the remaining children are answered from the listing rather than
+// by statting each of them.
+//
 // The initial lookup count is zero.
 //
 // REQUIRES: IsDirName(name)
@@ -213,7 +281,11 @@ func NewDirInode(
 	name string,
 	attrs fuseops.InodeAttributes,
 	implicitDirs bool,
+	conflictSuffix string,
+	normalization Normalization,
+	countSubdirs bool,
 	typeCacheTTL time.Duration,
+	lookupBurst int,
 	bucket gcs.Bucket,
 	mtimeClock timeutil.Clock,
 	cacheClock timeutil.Clock) (d DirInode) {
@@ -224,14 +296,18 @@ func NewDirInode(
 	// Set up the struct.
 	const typeCacheCapacity = 1 << 16
 	typed := &dirInode{
-		bucket:       bucket,
-		mtimeClock:   mtimeClock,
-		cacheClock:   cacheClock,
-		id:           id,
-		implicitDirs: implicitDirs,
-		name:         name,
-		attrs:        attrs,
-		cache:        newTypeCache(typeCacheCapacity/2, typeCacheTTL),
+		bucket:         bucket,
+		mtimeClock:     mtimeClock,
+		cacheClock:     cacheClock,
+		id:             id,
+		implicitDirs:   implicitDirs,
+		conflictSuffix: conflictSuffix,
+		normalization:  normalization,
+		countSubdirs:   countSubdirs,
+		lookupBurst:    lookupBurst,
+		name:           name,
+		attrs:          attrs,
+		cache:          newTypeCache(typeCacheCapacity/2, typeCacheTTL),
 	}
 
 	typed.lc.Init(id)
@@ -257,6 +333,19 @@ func (d *dirInode) checkInvariants() {
 	d.cache.CheckInvariants()
 }
 
+// Record that the directory's entries have changed.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) touch() {
+	now := d.mtimeClock.Now()
+	d.attrs.Mtime = now
+	d.attrs.Ctime = now
+
+	// Any cached listing no longer reflects the entries.
+	d.cache.EraseListings()
+	d.kernelListCacheExpiration = time.Time{}
+}
+
 func (d *dirInode) lookUpChildFile(
 	ctx context.Context,
 	name string) (result LookUpResult, err error) {
@@ -270,9 +359,12 @@ func (d *dirInode) lookUpChildFile(
 	return
 }
 
+// If knownImplicit is set, the caller knows that the directory is implicitly
+// defined and it is not checked again.
 func (d *dirInode) lookUpChildDir(
 	ctx context.Context,
-	name string) (result LookUpResult, err error) {
+	name string,
+	knownImplicit bool) (result LookUpResult, err error) {
 	b := syncutil.NewBundle(ctx)
 
 	// Stat the placeholder object.
@@ -289,7 +381,8 @@ func (d *dirInode) lookUpChildDir(
 
 	// If implicit directories are enabled, find out whether the child name is
 	// implicitly defined.
-	if d.implicitDirs {
+	result.ImplicitDir = d.implicitDirs && knownImplicit
+	if d.implicitDirs && !knownImplicit {
 		b.Add(func(ctx context.Context) (err error) {
 			result.ImplicitDir, err = objectNamePrefixNonEmpty(
 				ctx,
@@ -318,30 +411,67 @@ func (d *dirInode) lookUpChildDir(
 // the default behavior. If the file doesn't exist, return a nil record with a
 // nil error. If the directory doesn't exist, pretend the file doesn't exist.
 //
-// REQUIRES: strings.HasSuffix(name, ConflictingFileNameSuffix)
+// REQUIRES: strings.HasSuffix(name, d.conflictSuffix)
 func (d *dirInode) lookUpConflicting(
 	ctx context.Context,
 	name string) (result LookUpResult, err error) {
-	strippedName := strings.TrimSuffix(name, ConflictingFileNameSuffix)
+	stripped := UnescapeName(strings.TrimSuffix(name, d.conflictSuffix))
+	for _, strippedName := range d.normalization.candidates(stripped) {
+		// In order to a marked name to be accepted, we require the conflicting
+		// directory to exist.
+		var dirResult LookUpResult
+		dirResult, err = d.lookUpChildDir(ctx, strippedName, false)
+		if err != nil {
+			err = fmt.Errorf("lookUpChildDir for stripped name: %v", err)
+			return
+		}
 
-	// In order to a marked name to be accepted, we require the conflicting
-	// directory to exist.
-	var dirResult LookUpResult
-	dirResult, err = d.lookUpChildDir(ctx, strippedName)
-	if err != nil {
-		err = fmt.Errorf("lookUpChildDir for stripped name: %v", err)
-		return
+		if !dirResult.Exists() {
+			continue
+		}
+
+		// The directory name exists. Find the conflicting file.
+		result, err = d.lookUpChildFile(ctx, strippedName)
+		if err != nil {
+			err = fmt.Errorf("lookUpChildFile for stripped name: %v", err)
+			return
+		}
+
+		if result.Exists() {
+			return
+		}
 	}
 
-	if !dirResult.Exists() {
+	return
+}
+
+// Return the object name component of the child with the supplied file system
+// name, whose backing object's name ends with the given suffix ("/" for a
+// directory). When normalizing, this is the first of the name's forms for
+// which an object exists, or the name itself if there is none.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) resolveChild(
+	ctx context.Context,
+	name string,
+	suffix string) (component string, err error) {
+	cs := d.normalization.candidates(UnescapeName(name))
+	component = cs[0]
+	if len(cs) == 1 {
 		return
 	}
 
-	// The directory name exists. Find the conflicting file.
-	result, err = d.lookUpChildFile(ctx, strippedName)
-	if err != nil {
-		err = fmt.Errorf("lookUpChildFile for stripped name: %v", err)
-		return
+	for _, c := range cs {
+		var o *gcs.Object
+		o, err = statObjectMayNotExist(ctx, d.bucket, d.Name()+c+suffix)
+		if err != nil {
+			return
+		}
+
+		if o != nil {
+			component = c
+			return
+		}
 	}
 
 	return
@@ -423,7 +553,7 @@ func filterMissingChildDirNames(
 	bucket gcs.Bucket,
 	dirName string,
 	unfiltered <-chan string,
-	filtered chan<- string) (err error) {
+	filtered chan<- *gcs.Object) (err error) {
 	for name := range unfiltered {
 		var o *gcs.Object
 
@@ -444,7 +574,7 @@ func filterMissingChildDirNames(
 			err = ctx.Err()
 			return
 
-		case filtered <- name:
+		case filtered <- o:
 		}
 	}
 
@@ -503,7 +633,7 @@ func (d *dirInode) filterMissingChildDirs(
 	// Stat the placeholder object for each, filtering out placeholders that are
 	// not found. Use some parallelism.
 	const statWorkers = 32
-	filtered := make(chan string, 100)
+	filtered := make(chan *gcs.Object, 100)
 	var wg sync.WaitGroup
 	for i := 0; i < statWorkers; i++ {
 		wg.Add(1)
@@ -526,10 +656,10 @@ func (d *dirInode) filterMissingChildDirs(
 	}()
 
 	// Accumulate into a slice.
-	var filteredSlice []string
+	var filteredSlice []*gcs.Object
 	b.Add(func(ctx context.Context) (err error) {
-		for name := range filtered {
-			filteredSlice = append(filteredSlice, name)
+		for o := range filtered {
+			filteredSlice = append(filteredSlice, o)
 		}
 
 		return
@@ -538,15 +668,15 @@ func (d *dirInode) filterMissingChildDirs(
 	// Wait for everything to complete.
 	err = b.Join()
 
-	// Update the cache with everything we learned.
+	// Update the cache with everything we learned, keeping the placeholder
+	// records for the lookups likely to follow.
 	now = d.cacheClock.Now()
-	for _, name := range filteredSlice {
-		d.cache.NoteDir(now, name)
+	for _, o := range filteredSlice {
+		name := strings.TrimSuffix(strings.TrimPrefix(o.Name, d.Name()), "/")
+		d.cache.NoteListedDir(now, name, o)
+		out = append(out, name)
 	}
 
-	// Return everything we learned.
-	out = append(out, filteredSlice...)
-
 	return
 }
 
@@ -594,19 +724,60 @@ func (d *dirInode) Attributes(
 	attrs = d.attrs
 	attrs.Nlink = 1
 
+	// Count the links from child directories' ".." entries, if asked to.
+	if d.countSubdirs {
+		var n uint32
+		n, err = d.countChildDirs(ctx)
+		if err != nil {
+			err = fmt.Errorf("countChildDirs: %v", err)
+			return
+		}
+
+		attrs.Nlink = 2 + n
+	}
+
 	return
 }
 
 // A suffix that can be used to unambiguously tag a file system name.
 // (Unambiguous because U+000A is not allowed in GCS object names.) This is
-// used to refer to the file/symlink in a (file/symlink, directory) pair with
-// conflicting object names.
+// used by default to refer to the file/symlink in a (file/symlink, directory)
+// pair with conflicting object names.
 //
 // See also the notes on DirInode.LookUpChild.
 const ConflictingFileNameSuffix = "\n"
 
 // LOCKS_REQUIRED(d)
 func (d *dirInode) LookUpChild(
+	ctx context.Context,
+	name string) (result LookUpResult, err error) {
+	// Is this a conflict marker name? Unless the suffix is unambiguous, it may
+	// instead be the name of an object in its own right.
+	if strings.HasSuffix(name, d.conflictSuffix) {
+		result, err = d.lookUpConflicting(ctx, name)
+		if err != nil ||
+			result.Exists() ||
+			d.conflictSuffix == ConflictingFileNameSuffix {
+			return
+		}
+	}
+
+	// Try each object name the child may have, if names are normalized.
+	for _, c := range d.normalization.candidates(UnescapeName(name)) {
+		result, err = d.lookUpComponent(ctx, c)
+		if err != nil || result.Exists() {
+			return
+		}
+	}
+
+	return
+}
+
+// Look up the child whose object name component is the supplied one, as
+// described for LookUpChild.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) lookUpComponent(
 	ctx context.Context,
 	name string) (result LookUpResult, err error) {
 	// Consult the cache about the type of the child. This may save us work
@@ -615,12 +786,30 @@ func (d *dirInode) LookUpChild(
 	cacheSaysFile := d.cache.IsFile(now, name)
 	cacheSaysDir := d.cache.IsDir(now, name)
 
-	// Is this a conflict marker name?
-	if strings.HasSuffix(name, ConflictingFileNameSuffix) {
-		result, err = d.lookUpConflicting(ctx, name)
+	result, knownImplicit, ok := d.lookUpListed(now, name, cacheSaysFile, cacheSaysDir)
+	if ok {
 		return
 	}
 
+	// If this is one of a burst of such lookups, list the directory in the hope
+	// of answering the rest of them, and this one, from the listing.
+	if d.lookUpBurst(now) {
+		err = d.prefetchChildren(ctx)
+		if err != nil {
+			err = fmt.Errorf("prefetchChildren: %v", err)
+			return
+		}
+
+		now = d.cacheClock.Now()
+		cacheSaysFile = d.cache.IsFile(now, name)
+		cacheSaysDir = d.cache.IsDir(now, name)
+
+		result, knownImplicit, ok = d.lookUpListed(now, name, cacheSaysFile, cacheSaysDir)
+		if ok {
+			return
+		}
+	}
+
 	// Stat the child as a file, unless the cache has told us it's a directory
 	// but not a file.
 	b := syncutil.NewBundle(ctx)
@@ -638,7 +827,7 @@ func (d *dirInode) LookUpChild(
 	var dirResult LookUpResult
 	if !(cacheSaysFile && !cacheSaysDir) {
 		b.Add(func(ctx context.Context) (err error) {
-			dirResult, err = d.lookUpChildDir(ctx, name)
+			dirResult, err = d.lookUpChildDir(ctx, name, knownImplicit)
 			return
 		})
 	}
@@ -670,33 +859,148 @@ func (d *dirInode) LookUpChild(
 	return
 }
 
+// If we listed this directory recently and the cache says what type the child
+// is, return the child's record from the listing. ok is false if the child
+// must be statted, in which case knownImplicit is set if the listing showed
+// that it is an implicitly defined directory.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) lookUpListed(
+	now time.Time,
+	name string,
+	cacheSaysFile bool,
+	cacheSaysDir bool) (result LookUpResult, knownImplicit bool, ok bool) {
+	// If we saw only a file, use the object record from the listing rather than
+	// statting it again. This saves a round trip per file for the lookups that
+	// follow a listing, as in `ls -l`, even if the stat cache is too small to
+	// hold the whole directory. Each record is used only once, so that a stale
+	// one causes no more than a retry.
+	if cacheSaysFile && !cacheSaysDir {
+		if o := d.cache.TakeListedObject(now, name); o != nil {
+			result = LookUpResult{
+				FullName: o.Name,
+				Object:   o,
+			}
+
+			ok = true
+			return
+		}
+	}
+
+	// Similarly for a directory. If implicit directories are enabled, the
+	// listing tells us only that the directory is implicitly defined, so we must
+	// still stat its placeholder object.
+	if cacheSaysDir && !cacheSaysFile {
+		if o, listed := d.cache.TakeListedDir(now, name); listed {
+			if o != nil {
+				result = LookUpResult{
+					FullName: o.Name,
+					Object:   o,
+				}
+
+				ok = true
+				return
+			}
+
+			knownImplicit = true
+		}
+	}
+
+	return
+}
+
+// The period within which lookups that the type cache can't answer make up a
+// burst. See NewDirInode.
+const lookupBurstWindow = time.Second
+
+// The most pages of the directory's listing that a burst of lookups reads.
+const maxPrefetchPages = 10
+
+// Record a lookup that the type cache couldn't answer, returning true if it
+// completes a burst of them.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) lookUpBurst(now time.Time) bool {
+	// Is prefetching disabled, or would the listing be forgotten straight away?
+	if d.lookupBurst <= 0 || d.cache.ttl == 0 {
+		return false
+	}
+
+	if now.Sub(d.burstStart) > lookupBurstWindow {
+		d.burstStart = now
+		d.burstMisses = 0
+	}
+
+	d.burstMisses++
+	if d.burstMisses < d.lookupBurst {
+		return false
+	}
+
+	// Start counting afresh, so that the lookups the listing can't answer
+	// don't list the directory again straight away.
+	d.burstStart = time.Time{}
+	d.burstMisses = 0
+
+	return true
+}
+
+// Read the first pages of the directory's listing, noting the children in the
+// type cache for the lookups likely to follow.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) prefetchChildren(ctx context.Context) (err error) {
+	var tok string
+	for i := 0; i < maxPrefetchPages; i++ {
+		var page listingPage
+		page, err = d.readPage(ctx, tok)
+		if err != nil {
+			return
+		}
+
+		d.noteListedPage(page)
+
+		tok = page.newTok
+		if tok == "" {
+			return
+		}
+	}
+
+	return
+}
+
+// Note the children in a page of the directory's listing in the type cache,
+// remembering the objects for the lookups likely to follow. A cached page is
+// only as fresh as the listing it came from.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) noteListedPage(page listingPage) {
+	for _, o := range page.objects {
+		d.cache.NoteListedFile(page.time, strings.TrimPrefix(o.Name, d.Name()), o)
+	}
+
+	// Note the directories we learned of, if filterMissingChildDirs didn't
+	// already.
+	if d.implicitDirs {
+		for _, name := range page.dirNames {
+			d.cache.NoteListedDir(page.time, name, nil)
+		}
+	}
+}
+
 // LOCKS_REQUIRED(d)
 func (d *dirInode) ReadEntries(
 	ctx context.Context,
 	tok string) (entries []fuseutil.Dirent, newTok string, err error) {
-	// Ask the bucket to list some objects.
-	req := &gcs.ListObjectsRequest{
-		Delimiter:         "/",
-		Prefix:            d.Name(),
-		ContinuationToken: tok,
-	}
-
-	listing, err := d.bucket.ListObjects(ctx, req)
+	page, err := d.readPage(ctx, tok)
 	if err != nil {
-		err = fmt.Errorf("ListObjects: %v", err)
 		return
 	}
 
 	// Convert objects to entries for files or symlinks.
-	for _, o := range listing.Objects {
-		// Skip the entry for the backing object itself, which of course has its
-		// own name as a prefix but which we don't wan to appear to contain itself.
-		if o.Name == d.Name() {
-			continue
-		}
-
+	for _, o := range page.objects {
+		name := strings.TrimPrefix(o.Name, d.Name())
 		e := fuseutil.Dirent{
-			Name: path.Base(o.Name),
+			Name: EscapeName(d.normalization.Apply(name)),
 			Type: fuseutil.DT_File,
 		}
 
@@ -707,44 +1011,112 @@ func (d *dirInode) ReadEntries(
 		entries = append(entries, e)
 	}
 
-	// Extract directory names from the collapsed runs.
-	var dirNames []string
-	for _, p := range listing.CollapsedRuns {
-		dirNames = append(dirNames, path.Base(p))
+	// Return entries for directories.
+	for _, name := range page.dirNames {
+		e := fuseutil.Dirent{
+			Name: EscapeName(d.normalization.Apply(name)),
+			Type: fuseutil.DT_Directory,
+		}
+
+		entries = append(entries, e)
 	}
 
-	// Filter the directory names according to our implicit directory settings.
-	dirNames, err = d.filterMissingChildDirs(ctx, dirNames)
+	// Return an appropriate continuation token, if any.
+	newTok = page.newTok
+
+	// Update the type cache with what we learned.
+	d.noteListedPage(page)
+
+	return
+}
+
+// Return the page of the directory's listing starting at the supplied
+// continuation token, from a recent listing if we have one, saving a request.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) readPage(
+	ctx context.Context,
+	tok string) (page listingPage, err error) {
+	page, ok := d.cache.LookUpListing(d.cacheClock.Now(), tok)
+	if ok {
+		return
+	}
+
+	page, err = d.listPage(ctx, tok)
 	if err != nil {
-		err = fmt.Errorf("filterMissingChildDirs: %v", err)
 		return
 	}
 
-	// Return entries for directories.
-	for _, name := range dirNames {
-		e := fuseutil.Dirent{
-			Name: name,
-			Type: fuseutil.DT_Directory,
+	d.cache.NoteListing(page.time, tok, page)
+	return
+}
+
+// Count the directories that ReadEntries would return.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) countChildDirs(ctx context.Context) (n uint32, err error) {
+	var tok string
+	for {
+		var page listingPage
+		page, err = d.readPage(ctx, tok)
+		if err != nil {
+			return
 		}
 
-		entries = append(entries, e)
+		n += uint32(len(page.dirNames))
+
+		tok = page.newTok
+		if tok == "" {
+			return
+		}
 	}
+}
 
-	// Return an appropriate continuation token, if any.
-	newTok = listing.ContinuationToken
+// Ask the bucket for the page of the directory's listing starting at the
+// supplied continuation token.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) listPage(
+	ctx context.Context,
+	tok string) (page listingPage, err error) {
+	req := &gcs.ListObjectsRequest{
+		Delimiter:         "/",
+		Prefix:            d.Name(),
+		ContinuationToken: tok,
+	}
 
-	// Update the type cache with everything we learned.
-	now := d.cacheClock.Now()
-	for _, e := range entries {
-		switch e.Type {
-		case fuseutil.DT_File:
-			d.cache.NoteFile(now, e.Name)
+	page.time = d.cacheClock.Now()
+	listing, err := d.bucket.ListObjects(ctx, req)
+	if err != nil {
+		err = fmt.Errorf("ListObjects: %v", err)
+		return
+	}
 
-		case fuseutil.DT_Directory:
-			d.cache.NoteDir(now, e.Name)
+	for _, o := range listing.Objects {
+		// Skip the entry for the backing object itself, which of course has its
+		// own name as a prefix but which we don't wan to appear to contain itself.
+		if o.Name == d.Name() {
+			continue
 		}
+
+		page.objects = append(page.objects, o)
 	}
 
+	// Extract directory names from the collapsed runs. Unlike path.Base, this
+	// keeps the empty name of a run like "foo//".
+	var dirNames []string
+	for _, p := range listing.CollapsedRuns {
+		dirNames = append(dirNames, strings.TrimSuffix(p[len(d.Name()):], "/"))
+	}
+
+	// Filter the directory names according to our implicit directory settings.
+	page.dirNames, err = d.filterMissingChildDirs(ctx, dirNames)
+	if err != nil {
+		err = fmt.Errorf("filterMissingChildDirs: %v", err)
+		return
+	}
+
+	page.newTok = listing.ContinuationToken
 	return
 }
 
@@ -752,17 +1124,20 @@ func (d *dirInode) ReadEntries(
 func (d *dirInode) CreateChildFile(
 	ctx context.Context,
 	name string) (o *gcs.Object, err error) {
+	name = d.normalization.Apply(UnescapeName(name))
+
 	metadata := map[string]string{
 		FileMtimeMetadataKey: d.mtimeClock.Now().UTC().Format(time.RFC3339Nano),
 	}
 
-	o, err = d.createNewObject(ctx, path.Join(d.Name(), name), metadata)
+	o, err = d.createNewObject(ctx, d.Name()+name, metadata)
 	if err != nil {
 		return
 	}
 
 	d.cache.NoteFile(d.cacheClock.Now(), name)
 
+	d.touch()
 	return
 }
 
@@ -771,6 +1146,8 @@ func (d *dirInode) CloneToChildFile(
 	ctx context.Context,
 	name string,
 	src *gcs.Object) (o *gcs.Object, err error) {
+	name = d.normalization.Apply(UnescapeName(name))
+
 	// Erase any existing type information for this name.
 	d.cache.Erase(name)
 
@@ -781,7 +1158,7 @@ func (d *dirInode) CloneToChildFile(
 			SrcName:                       src.Name,
 			SrcGeneration:                 src.Generation,
 			SrcMetaGenerationPrecondition: &src.MetaGeneration,
-			DstName: path.Join(d.Name(), name),
+			DstName:                       d.Name() + name,
 		})
 
 	if err != nil {
@@ -791,6 +1168,35 @@ func (d *dirInode) CloneToChildFile(
 	// Update the type cache.
 	d.cache.NoteFile(d.cacheClock.Now(), name)
 
+	d.touch()
+	return
+}
+
+// LOCKS_REQUIRED(d)
+func (d *dirInode) CloneToNewChildFile(
+	ctx context.Context,
+	name string,
+	src *gcs.Object) (o *gcs.Object, err error) {
+	name = d.normalization.Apply(UnescapeName(name))
+
+	// Clone, failing if the name already exists.
+	var precond int64
+	o, err = d.bucket.CopyObject(
+		ctx,
+		&gcs.CopyObjectRequest{
+			SrcName:                   src.Name,
+			SrcGeneration:             src.Generation,
+			DstName:                   d.Name() + name,
+			DstGenerationPrecondition: &precond,
+		})
+
+	if err != nil {
+		return
+	}
+
+	d.cache.NoteFile(d.cacheClock.Now(), name)
+
+	d.touch()
 	return
 }
 
@@ -799,17 +1205,20 @@ func (d *dirInode) CreateChildSymlink(
 	ctx context.Context,
 	name string,
 	target string) (o *gcs.Object, err error) {
+	name = d.normalization.Apply(UnescapeName(name))
+
 	metadata := map[string]string{
 		SymlinkMetadataKey: target,
 	}
 
-	o, err = d.createNewObject(ctx, path.Join(d.Name(), name), metadata)
+	o, err = d.createNewObject(ctx, d.Name()+name, metadata)
 	if err != nil {
 		return
 	}
 
 	d.cache.NoteFile(d.cacheClock.Now(), name)
 
+	d.touch()
 	return
 }
 
@@ -817,13 +1226,16 @@ func (d *dirInode) CreateChildSymlink(
 func (d *dirInode) CreateChildDir(
 	ctx context.Context,
 	name string) (o *gcs.Object, err error) {
-	o, err = d.createNewObject(ctx, path.Join(d.Name(), name)+"/", nil)
+	name = d.normalization.Apply(UnescapeName(name))
+
+	o, err = d.createNewObject(ctx, d.Name()+name+"/", nil)
 	if err != nil {
 		return
 	}
 
 	d.cache.NoteDir(d.cacheClock.Now(), name)
 
+	d.touch()
 	return
 }
 
@@ -833,12 +1245,18 @@ func (d *dirInode) DeleteChildFile(
 	name string,
 	generation int64,
 	metaGeneration *int64) (err error) {
+	name, err = d.resolveChild(ctx, name, "")
+	if err != nil {
+		err = fmt.Errorf("resolveChild: %v", err)
+		return
+	}
+
 	d.cache.Erase(name)
 
 	err = d.bucket.DeleteObject(
 		ctx,
 		&gcs.DeleteObjectRequest{
-			Name:                       path.Join(d.Name(), name),
+			Name:                       d.Name() + name,
 			Generation:                 generation,
 			MetaGenerationPrecondition: metaGeneration,
 		})
@@ -848,6 +1266,7 @@ func (d *dirInode) DeleteChildFile(
 		return
 	}
 
+	d.touch()
 	return
 }
 
@@ -855,6 +1274,12 @@ func (d *dirInode) DeleteChildFile(
 func (d *dirInode) DeleteChildDir(
 	ctx context.Context,
 	name string) (err error) {
+	name, err = d.resolveChild(ctx, name, "/")
+	if err != nil {
+		err = fmt.Errorf("resolveChild: %v", err)
+		return
+	}
+
 	d.cache.Erase(name)
 
 	// Delete the backing object. Unfortunately we have no way to precondition
@@ -862,7 +1287,7 @@ func (d *dirInode) DeleteChildDir(
 	err = d.bucket.DeleteObject(
 		ctx,
 		&gcs.DeleteObjectRequest{
-			Name: path.Join(d.Name(), name) + "/",
+			Name: d.Name() + name + "/",
 		})
 
 	if err != nil {
@@ -870,5 +1295,32 @@ func (d *dirInode) DeleteChildDir(
 		return
 	}
 
+	d.touch()
+	return
+}
+
+// LOCKS_REQUIRED(d)
+func (d *dirInode) SetTypeCacheTTL(ttl time.Duration) {
+	d.cache.SetTTL(ttl)
+}
+
+// LOCKS_REQUIRED(d)
+func (d *dirInode) ForgetChild(name string) {
+	for _, c := range d.normalization.candidates(UnescapeName(name)) {
+		d.cache.Erase(c)
+	}
+
+	d.kernelListCacheExpiration = time.Time{}
+}
+
+// LOCKS_REQUIRED(d)
+func (d *dirInode) KeepKernelListCache(ttl time.Duration) (keep bool) {
+	now := d.cacheClock.Now()
+	if now.Before(d.kernelListCacheExpiration) {
+		keep = true
+		return
+	}
+
+	d.kernelListCacheExpiration = now.Add(ttl)
 	return
 }
@@ -50,6 +50,13 @@ type DirTest struct {
 	bucket gcs.Bucket
 	clock  timeutil.SimulatedClock
 
+	// The suffix, normalization, nlink, and lookup burst settings with which to
+	// create the inode.
+	conflictSuffix string
+	normalization  inode.Normalization
+	countSubdirs   bool
+	lookupBurst    int
+
 	in inode.DirInode
 }
 
@@ -62,6 +69,7 @@ func (t *DirTest) SetUp(ti *TestInfo) {
 	t.ctx = ti.Ctx
 	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
 	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.conflictSuffix = inode.ConflictingFileNameSuffix
 
 	// Create the inode. No implicit dirs by default.
 	t.resetInode(false)
@@ -95,7 +103,11 @@ func (t *DirTest) resetInode(implicitDirs bool) {
 			Mode: dirMode,
 		},
 		implicitDirs,
+		t.conflictSuffix,
+		t.normalization,
+		t.countSubdirs,
 		typeCacheTTL,
+		t.lookupBurst,
 		t.bucket,
 		&t.clock,
 		&t.clock)
@@ -167,6 +179,80 @@ func (t *DirTest) Attributes() {
 	ExpectEq(uid, attrs.Uid)
 	ExpectEq(gid, attrs.Gid)
 	ExpectEq(dirMode|os.ModeDir, attrs.Mode)
+	ExpectEq(1, attrs.Nlink)
+}
+
+func (t *DirTest) Attributes_CountSubdirs() {
+	t.countSubdirs = true
+	t.resetInode(false)
+
+	// Create a file and two directories, one of them holding another.
+	objs := []string{
+		dirInodeName + "foo",
+		dirInodeName + "bar/",
+		dirInodeName + "baz/",
+		dirInodeName + "baz/qux/",
+	}
+
+	for _, name := range objs {
+		_, err := gcsutil.CreateObject(t.ctx, t.bucket, name, []byte(""))
+		AssertEq(nil, err)
+	}
+
+	// Only the direct child directories should be counted.
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(4, attrs.Nlink)
+
+	// A new directory should be counted too.
+	_, err = t.in.CreateChildDir(t.ctx, "taco")
+	AssertEq(nil, err)
+
+	attrs, err = t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(5, attrs.Nlink)
+}
+
+func (t *DirTest) Attributes_ChildrenChanged() {
+	var attrs fuseops.InodeAttributes
+	var err error
+
+	// Creating a child moves the times forward.
+	t.clock.AdvanceTime(time.Second)
+	_, err = t.in.CreateChildFile(t.ctx, "qux")
+	AssertEq(nil, err)
+
+	attrs, err = t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectThat(attrs.Mtime, timeutil.TimeEq(t.clock.Now()))
+	ExpectThat(attrs.Ctime, timeutil.TimeEq(t.clock.Now()))
+
+	// So does deleting it.
+	t.clock.AdvanceTime(time.Second)
+	err = t.in.DeleteChildFile(t.ctx, "qux", 0, nil)
+	AssertEq(nil, err)
+
+	attrs, err = t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectThat(attrs.Mtime, timeutil.TimeEq(t.clock.Now()))
+	ExpectThat(attrs.Ctime, timeutil.TimeEq(t.clock.Now()))
+}
+
+func (t *DirTest) Attributes_FailedCreate() {
+	_, err := t.in.CreateChildDir(t.ctx, "qux")
+	AssertEq(nil, err)
+
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+
+	// Creating it again fails, leaving the times alone.
+	t.clock.AdvanceTime(time.Second)
+	_, err = t.in.CreateChildDir(t.ctx, "qux")
+	AssertNe(nil, err)
+
+	newAttrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectThat(newAttrs.Mtime, timeutil.TimeEq(attrs.Mtime))
 }
 
 func (t *DirTest) LookUpChild_NonExistent() {
@@ -323,6 +409,120 @@ func (t *DirTest) LookUpChild_FileAndDir() {
 	ExpectEq(fileObj.Size, o.Size)
 }
 
+func (t *DirTest) LookUpChild_FileAndDir_CustomSuffix() {
+	const name = "qux"
+	fileObjName := path.Join(dirInodeName, name)
+	dirObjName := path.Join(dirInodeName, name) + "/"
+
+	t.conflictSuffix = ".file"
+	t.resetInode(false)
+
+	// Create backing objects.
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, fileObjName, []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirObjName, []byte(""))
+	AssertEq(nil, err)
+
+	// Look up with the custom suffix.
+	result, err := t.in.LookUpChild(t.ctx, name+".file")
+
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+	ExpectEq(fileObjName, result.FullName)
+
+	// The default suffix is just part of a name that doesn't exist.
+	result, err = t.in.LookUpChild(t.ctx, name+inode.ConflictingFileNameSuffix)
+
+	AssertEq(nil, err)
+	ExpectFalse(result.Exists())
+}
+
+func (t *DirTest) LookUpChild_CustomSuffixWithoutConflict() {
+	const name = "qux.file"
+	objName := path.Join(dirInodeName, name)
+
+	t.conflictSuffix = ".file"
+	t.resetInode(false)
+
+	// Create an object whose name happens to end in the suffix, with no
+	// directory to conflict with.
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, objName, []byte("taco"))
+	AssertEq(nil, err)
+
+	// It should be found under its own name.
+	result, err := t.in.LookUpChild(t.ctx, name)
+
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+	ExpectEq(objName, result.FullName)
+}
+
+func (t *DirTest) LookUpChild_UnrepresentableNames() {
+	// Create objects whose names can't be used as they are.
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, dirInodeName+"/", []byte(""))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirInodeName+"..", []byte(""))
+	AssertEq(nil, err)
+
+	// They should be found by their escaped names.
+	result, err := t.in.LookUpChild(t.ctx, "\r")
+
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+	ExpectEq(dirInodeName+"/", result.FullName)
+
+	result, err = t.in.LookUpChild(t.ctx, "..\r")
+
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+	ExpectEq(dirInodeName+"..", result.FullName)
+
+	// A name that isn't an escape stands for nothing.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirInodeName+"qux", []byte(""))
+	AssertEq(nil, err)
+
+	result, err = t.in.LookUpChild(t.ctx, "qux\r")
+
+	AssertEq(nil, err)
+	ExpectFalse(result.Exists())
+}
+
+func (t *DirTest) LookUpChild_Normalization() {
+	const nfc = "caf\u00e9"
+	const nfd = "cafe\u0301"
+
+	t.normalization = inode.NormalizeNFC
+	t.resetInode(false)
+
+	// Create an object whose name is in the other form.
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, dirInodeName+nfd, []byte(""))
+	AssertEq(nil, err)
+
+	// It should be found by either name.
+	for _, name := range []string{nfc, nfd} {
+		result, err := t.in.LookUpChild(t.ctx, name)
+
+		AssertEq(nil, err)
+		AssertNe(nil, result.Object)
+		ExpectEq(dirInodeName+nfd, result.FullName)
+	}
+}
+
+func (t *DirTest) LookUpChild_NormalizationOff() {
+	const nfc = "caf\u00e9"
+	const nfd = "cafe\u0301"
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, dirInodeName+nfd, []byte(""))
+	AssertEq(nil, err)
+
+	result, err := t.in.LookUpChild(t.ctx, nfc)
+
+	AssertEq(nil, err)
+	ExpectFalse(result.Exists())
+}
+
 func (t *DirTest) LookUpChild_SymlinkAndDir() {
 	const name = "qux"
 	linkObjName := path.Join(dirInodeName, name)
@@ -506,6 +706,159 @@ func (t *DirTest) LookUpChild_TypeCaching() {
 	ExpectEq(dirObjName, o.Name)
 }
 
+func (t *DirTest) LookUpChild_TypeCacheTTLChanged() {
+	const name = "qux"
+	fileObjName := path.Join(dirInodeName, name)
+	dirObjName := path.Join(dirInodeName, name) + "/"
+
+	var o *gcs.Object
+	var err error
+
+	// Create a backing object for a file, and look it up so that it's cached.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, fileObjName, []byte("taco"))
+	AssertEq(nil, err)
+
+	result, err := t.in.LookUpChild(t.ctx, name)
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+
+	// Create a backing object for a directory, then disable the cache. The
+	// directory should be seen immediately.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirObjName, []byte("taco"))
+	AssertEq(nil, err)
+
+	t.in.SetTypeCacheTTL(0)
+
+	result, err = t.in.LookUpChild(t.ctx, name)
+	o = result.Object
+
+	AssertEq(nil, err)
+	AssertNe(nil, o)
+
+	ExpectEq(dirObjName, o.Name)
+}
+
+func (t *DirTest) LookUpChild_ForgottenChild() {
+	const name = "qux"
+	fileObjName := path.Join(dirInodeName, name)
+	dirObjName := path.Join(dirInodeName, name) + "/"
+
+	var err error
+
+	// Create a backing object for a file, and look it up so that it's cached.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, fileObjName, []byte("taco"))
+	AssertEq(nil, err)
+
+	result, err := t.in.LookUpChild(t.ctx, name)
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+
+	// Create a backing object for a directory, then forget the child. The
+	// directory should be seen immediately.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirObjName, []byte("taco"))
+	AssertEq(nil, err)
+
+	t.in.ForgetChild(name)
+
+	result, err = t.in.LookUpChild(t.ctx, name)
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+
+	ExpectEq(dirObjName, result.Object.Name)
+}
+
+func (t *DirTest) LookUpChild_BurstPrefetchesListing() {
+	t.lookupBurst = 3
+	t.resetInode(false)
+
+	// Create backing objects for some files and a directory.
+	objs := make(map[string]*gcs.Object)
+	for _, name := range []string{"a", "b", "c", "d", "e/"} {
+		o, err := gcsutil.CreateObject(
+			t.ctx,
+			t.bucket,
+			dirInodeName+name,
+			[]byte("taco"))
+
+		AssertEq(nil, err)
+		objs[name] = o
+	}
+
+	// Look up enough names to make a burst, causing the directory to be listed.
+	for _, name := range []string{"a", "b", "c"} {
+		result, err := t.in.LookUpChild(t.ctx, name)
+		AssertEq(nil, err)
+		AssertNe(nil, result.Object)
+	}
+
+	// Change the other children behind our back.
+	_, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		dirInodeName+"d",
+		[]byte("burrito"))
+
+	AssertEq(nil, err)
+
+	err = t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: dirInodeName + "e/"})
+
+	AssertEq(nil, err)
+
+	// Their look ups should be served from the listing, without going to the
+	// bucket.
+	result, err := t.in.LookUpChild(t.ctx, "d")
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+	ExpectEq(objs["d"].Generation, result.Object.Generation)
+
+	result, err = t.in.LookUpChild(t.ctx, "e")
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+	ExpectEq(objs["e/"].Generation, result.Object.Generation)
+}
+
+func (t *DirTest) LookUpChild_SlowLookUpsDontPrefetch() {
+	t.lookupBurst = 3
+	t.resetInode(false)
+
+	// Create backing objects for some files.
+	for _, name := range []string{"a", "b", "c", "d"} {
+		_, err := gcsutil.CreateObject(
+			t.ctx,
+			t.bucket,
+			dirInodeName+name,
+			[]byte("taco"))
+
+		AssertEq(nil, err)
+	}
+
+	// Look up as many names as make a burst, but slowly.
+	for _, name := range []string{"a", "b", "c"} {
+		t.clock.AdvanceTime(2 * time.Second)
+
+		result, err := t.in.LookUpChild(t.ctx, name)
+		AssertEq(nil, err)
+		AssertNe(nil, result.Object)
+	}
+
+	// Change another child behind our back. Its look up should go to the
+	// bucket.
+	_, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		dirInodeName+"d",
+		[]byte("burrito"))
+
+	AssertEq(nil, err)
+
+	result, err := t.in.LookUpChild(t.ctx, "d")
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+	ExpectEq(len("burrito"), result.Object.Size)
+}
+
 func (t *DirTest) ReadEntries_Empty() {
 	entries, err := t.readAllEntries()
 
@@ -650,6 +1003,267 @@ func (t *DirTest) ReadEntries_TypeCaching() {
 	ExpectEq(dirObjName, o.Name)
 }
 
+func (t *DirTest) ReadEntries_PrefillsLookUps() {
+	const name = "qux"
+	objName := path.Join(dirInodeName, name)
+
+	// Create a backing object for a file.
+	listed, err := gcsutil.CreateObject(t.ctx, t.bucket, objName, []byte("taco"))
+	AssertEq(nil, err)
+
+	// Read the directory.
+	_, err = t.readAllEntries()
+	AssertEq(nil, err)
+
+	// Overwrite the object behind our back.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, objName, []byte("burrito"))
+	AssertEq(nil, err)
+
+	// The first look up should be served from the listing, without going to the
+	// bucket.
+	result, err := t.in.LookUpChild(t.ctx, name)
+
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+	ExpectEq(objName, result.FullName)
+	ExpectEq(listed.Generation, result.Object.Generation)
+
+	// But the listing is used only once.
+	result, err = t.in.LookUpChild(t.ctx, name)
+
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+	ExpectEq(len("burrito"), result.Object.Size)
+}
+
+func (t *DirTest) ReadEntries_PrefillsDirLookUps() {
+	const name = "qux"
+	objName := path.Join(dirInodeName, name) + "/"
+
+	// Create a backing object for a directory.
+	listed, err := gcsutil.CreateObject(t.ctx, t.bucket, objName, []byte(""))
+	AssertEq(nil, err)
+
+	// Read the directory.
+	_, err = t.readAllEntries()
+	AssertEq(nil, err)
+
+	// Delete the placeholder behind our back.
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: objName})
+	AssertEq(nil, err)
+
+	// The first look up should be served from the listing, without going to the
+	// bucket.
+	result, err := t.in.LookUpChild(t.ctx, name)
+
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+	ExpectEq(objName, result.FullName)
+	ExpectEq(listed.Generation, result.Object.Generation)
+
+	// But the listing is used only once.
+	result, err = t.in.LookUpChild(t.ctx, name)
+
+	AssertEq(nil, err)
+	ExpectFalse(result.Exists())
+}
+
+func (t *DirTest) ReadEntries_PrefillsImplicitDirLookUps() {
+	const name = "qux"
+	objName := path.Join(dirInodeName, name) + "/"
+
+	// Enable implicit dirs.
+	t.resetInode(true)
+
+	// Create an object that implicitly defines a directory.
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, objName+"asdf", []byte(""))
+	AssertEq(nil, err)
+
+	// Read the directory.
+	_, err = t.readAllEntries()
+	AssertEq(nil, err)
+
+	// Delete the object behind our back.
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: objName + "asdf"})
+	AssertEq(nil, err)
+
+	// The listing should stand in for checking whether the directory is
+	// implicitly defined.
+	result, err := t.in.LookUpChild(t.ctx, name)
+
+	AssertEq(nil, err)
+	ExpectTrue(result.ImplicitDir)
+	ExpectEq(nil, result.Object)
+
+	// But the listing is used only once.
+	result, err = t.in.LookUpChild(t.ctx, name)
+
+	AssertEq(nil, err)
+	ExpectFalse(result.Exists())
+}
+
+func (t *DirTest) ReadEntries_ListingCaching() {
+	// Create a backing object for a file.
+	_, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		path.Join(dirInodeName, "foo"),
+		[]byte("taco"))
+
+	AssertEq(nil, err)
+
+	// Read the directory, caching the listing.
+	entries, err := t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+
+	// Create another behind our back. Reading again should give the cached
+	// listing.
+	_, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		path.Join(dirInodeName, "bar"),
+		[]byte("burrito"))
+
+	AssertEq(nil, err)
+
+	entries, err = t.readAllEntries()
+	AssertEq(nil, err)
+	ExpectEq(1, len(entries))
+
+	// But after the TTL expires, the new object should show up.
+	t.clock.AdvanceTime(typeCacheTTL + time.Millisecond)
+
+	entries, err = t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(2, len(entries))
+	ExpectEq("bar", entries[0].Name)
+	ExpectEq("foo", entries[1].Name)
+}
+
+func (t *DirTest) ReadEntries_ListingCacheInvalidatedByCreate() {
+	// Read the empty directory, caching the listing.
+	entries, err := t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(0, len(entries))
+
+	// Create a child via the inode. It should show up straight away.
+	_, err = t.in.CreateChildFile(t.ctx, "foo")
+	AssertEq(nil, err)
+
+	entries, err = t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+	ExpectEq("foo", entries[0].Name)
+
+	_, err = t.in.CreateChildDir(t.ctx, "bar")
+	AssertEq(nil, err)
+
+	entries, err = t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(2, len(entries))
+	ExpectEq("bar", entries[0].Name)
+	ExpectEq(fuseutil.DT_Directory, entries[0].Type)
+}
+
+func (t *DirTest) ReadEntries_ListingCacheInvalidatedByDelete() {
+	// Create a child via the inode and read the directory, caching the listing.
+	_, err := t.in.CreateChildFile(t.ctx, "foo")
+	AssertEq(nil, err)
+
+	entries, err := t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+
+	// Deleting the child via the inode should make it disappear straight away.
+	err = t.in.DeleteChildFile(t.ctx, "foo", 0, nil)
+	AssertEq(nil, err)
+
+	entries, err = t.readAllEntries()
+	AssertEq(nil, err)
+	ExpectEq(0, len(entries))
+}
+
+func (t *DirTest) ReadEntries_ListingCacheForgottenChild() {
+	// Read the empty directory, caching the listing.
+	entries, err := t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(0, len(entries))
+
+	// Create a child behind our back, then say it has changed.
+	_, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		path.Join(dirInodeName, "foo"),
+		[]byte("taco"))
+
+	AssertEq(nil, err)
+	t.in.ForgetChild("foo")
+
+	entries, err = t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+	ExpectEq("foo", entries[0].Name)
+}
+
+func (t *DirTest) ReadEntries_UnrepresentableNames() {
+	// Create objects whose names can't be used as they are.
+	objs := []string{
+		dirInodeName + "/",
+		dirInodeName + ".",
+		dirInodeName + "..",
+		dirInodeName + "a\x00b",
+	}
+
+	for _, name := range objs {
+		_, err := gcsutil.CreateObject(t.ctx, t.bucket, name, []byte(""))
+		AssertEq(nil, err)
+	}
+
+	// Read the directory.
+	entries, err := t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(4, len(entries))
+
+	ExpectEq("\r", entries[0].Name)
+	ExpectEq(fuseutil.DT_Directory, entries[0].Type)
+	ExpectEq(".\r", entries[1].Name)
+	ExpectEq(fuseutil.DT_File, entries[1].Type)
+	ExpectEq("..\r", entries[2].Name)
+	ExpectEq(fuseutil.DT_File, entries[2].Type)
+	ExpectEq("a\r0b\r", entries[3].Name)
+	ExpectEq(fuseutil.DT_File, entries[3].Type)
+}
+
+func (t *DirTest) ReadEntries_Normalization() {
+	const nfc = "caf\u00e9"
+	const nfd = "cafe\u0301"
+
+	t.normalization = inode.NormalizeNFD
+	t.resetInode(false)
+
+	// Create a file and a directory with names in the other form.
+	objs := []string{
+		dirInodeName + nfc,
+		dirInodeName + "x" + nfc + "/",
+	}
+
+	for _, name := range objs {
+		_, err := gcsutil.CreateObject(t.ctx, t.bucket, name, []byte(""))
+		AssertEq(nil, err)
+	}
+
+	// Both should be listed in the normalization form.
+	entries, err := t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(2, len(entries))
+
+	ExpectEq(nfd, entries[0].Name)
+	ExpectEq(fuseutil.DT_File, entries[0].Type)
+	ExpectEq("x"+nfd, entries[1].Name)
+	ExpectEq(fuseutil.DT_Directory, entries[1].Type)
+}
+
 func (t *DirTest) CreateChildFile_DoesntExist() {
 	const name = "qux"
 	objName := path.Join(dirInodeName, name)
@@ -801,6 +1415,49 @@ func (t *DirTest) CloneToChildFile_DestinationExists() {
 	ExpectEq("taco", string(contents))
 }
 
+func (t *DirTest) CloneToNewChildFile_DestinationDoesntExist() {
+	const srcName = "blah/baz"
+	dstName := path.Join(dirInodeName, "qux")
+
+	// Create the source.
+	src, err := gcsutil.CreateObject(t.ctx, t.bucket, srcName, []byte("taco"))
+	AssertEq(nil, err)
+
+	// Call the inode.
+	o, err := t.in.CloneToNewChildFile(t.ctx, path.Base(dstName), src)
+	AssertEq(nil, err)
+	AssertNe(nil, o)
+
+	ExpectEq(dstName, o.Name)
+	ExpectEq(len("taco"), o.Size)
+
+	// Check resulting contents.
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, dstName)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *DirTest) CloneToNewChildFile_DestinationExists() {
+	const srcName = "blah/baz"
+	dstName := path.Join(dirInodeName, "qux")
+
+	// Create the source, and a destination object that must not be overwritten.
+	src, err := gcsutil.CreateObject(t.ctx, t.bucket, srcName, []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dstName, []byte(""))
+	AssertEq(nil, err)
+
+	// Call the inode.
+	_, err = t.in.CloneToNewChildFile(t.ctx, path.Base(dstName), src)
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+
+	// The destination should be unchanged.
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, dstName)
+	AssertEq(nil, err)
+	ExpectEq("", string(contents))
+}
+
 func (t *DirTest) CloneToChildFile_TypeCaching() {
 	const srcName = "blah/baz"
 	dstName := path.Join(dirInodeName, "qux")
@@ -948,6 +1605,45 @@ func (t *DirTest) CreateChildDir_Exists() {
 	ExpectThat(err, Error(HasSubstr("exists")))
 }
 
+func (t *DirTest) CreateChildDir_EscapedName() {
+	o, err := t.in.CreateChildDir(t.ctx, "\r")
+	AssertEq(nil, err)
+	AssertNe(nil, o)
+	ExpectEq(dirInodeName+"/", o.Name)
+
+	// Deleting it should remove the same object.
+	err = t.in.DeleteChildDir(t.ctx, "\r")
+	AssertEq(nil, err)
+
+	_, err = gcsutil.ReadObject(t.ctx, t.bucket, dirInodeName+"/")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *DirTest) CreateAndDeleteChild_Normalization() {
+	const nfc = "caf\u00e9"
+	const nfd = "cafe\u0301"
+
+	t.normalization = inode.NormalizeNFC
+	t.resetInode(false)
+
+	// A created file should be named in the normalization form.
+	o, err := t.in.CreateChildFile(t.ctx, nfd)
+	AssertEq(nil, err)
+	AssertNe(nil, o)
+	ExpectEq(dirInodeName+nfc, o.Name)
+
+	// Deleting an object named in the other form by either name should remove
+	// it.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirInodeName+"x"+nfd, []byte(""))
+	AssertEq(nil, err)
+
+	err = t.in.DeleteChildFile(t.ctx, "x"+nfc, 0, nil)
+	AssertEq(nil, err)
+
+	_, err = gcsutil.ReadObject(t.ctx, t.bucket, dirInodeName+"x"+nfd)
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
 func (t *DirTest) DeleteChildFile_DoesntExist() {
 	const name = "qux"
 
@@ -1100,3 +1796,39 @@ func (t *DirTest) DeleteChildDir_Exists() {
 	_, err = gcsutil.ReadObject(t.ctx, t.bucket, objName)
 	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
 }
+
+func (t *DirTest) KeepKernelListCache() {
+	const ttl = time.Minute
+
+	// The first handle starts the kernel caching afresh, and later ones keep
+	// what it has.
+	ExpectFalse(t.in.KeepKernelListCache(ttl))
+	ExpectTrue(t.in.KeepKernelListCache(ttl))
+
+	t.clock.AdvanceTime(ttl - time.Millisecond)
+	ExpectTrue(t.in.KeepKernelListCache(ttl))
+
+	// Until the TTL expires.
+	t.clock.AdvanceTime(2 * time.Millisecond)
+	ExpectFalse(t.in.KeepKernelListCache(ttl))
+	ExpectTrue(t.in.KeepKernelListCache(ttl))
+}
+
+func (t *DirTest) KeepKernelListCache_ChildrenChanged() {
+	const ttl = time.Minute
+
+	ExpectFalse(t.in.KeepKernelListCache(ttl))
+
+	// Creating a child through the inode should make the kernel start afresh.
+	_, err := t.in.CreateChildFile(t.ctx, "foo")
+	AssertEq(nil, err)
+
+	ExpectFalse(t.in.KeepKernelListCache(ttl))
+	ExpectTrue(t.in.KeepKernelListCache(ttl))
+
+	// So should forgetting a child.
+	t.in.ForgetChild("bar")
+
+	ExpectFalse(t.in.KeepKernelListCache(ttl))
+	ExpectTrue(t.in.KeepKernelListCache(ttl))
+}
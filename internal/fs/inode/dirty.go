@@ -0,0 +1,175 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inode
+
+import (
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/net/context"
+)
+
+// DirtyTracker keeps count of the local contents of file inodes that have
+// been modified but not yet written out to GCS, and holds back writers while
+// there is more than a limit of them.
+//
+// To make sure that some writer can always make progress, the file that has
+// been dirty longest is never held back; its data is drained when it is
+// synced. Others wait until enough dirty data has been synced or thrown away,
+// asking for that file to be written back meanwhile.
+//
+// A nil *DirtyTracker is valid, and tracks nothing.
+//
+// Safe for concurrent access.
+type DirtyTracker struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	limit int64
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The number of dirty bytes for each inode that has any, and the order in
+	// which they became dirty.
+	//
+	// INVARIANT: For each k, v in sizes, v > 0
+	// INVARIANT: total is the sum of the values in sizes
+	// INVARIANT: order contains exactly the keys of sizes
+	//
+	// GUARDED_BY(mu)
+	sizes map[fuseops.InodeID]int64
+	total int64
+	order []fuseops.InodeID
+
+	// Closed and replaced whenever the amount of dirty data shrinks.
+	//
+	// GUARDED_BY(mu)
+	shrunk chan struct{}
+}
+
+// NewDirtyTracker creates a tracker that holds back writers while there are
+// more than limit dirty bytes.
+func NewDirtyTracker(limit int64) (t *DirtyTracker) {
+	t = &DirtyTracker{
+		limit:  limit,
+		sizes:  make(map[fuseops.InodeID]int64),
+		shrunk: make(chan struct{}),
+	}
+
+	return
+}
+
+// Total returns the number of dirty bytes across all inodes.
+func (t *DirtyTracker) Total() (n int64) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	n = t.total
+	t.mu.Unlock()
+
+	return
+}
+
+// Set records that the given inode now has n dirty bytes.
+func (t *DirtyTracker) Set(id fuseops.InodeID, n int64) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	old, ok := t.sizes[id]
+	switch {
+	case n > 0 && !ok:
+		t.order = append(t.order, id)
+
+	case n <= 0 && ok:
+		for i, o := range t.order {
+			if o == id {
+				t.order = append(t.order[:i], t.order[i+1:]...)
+				break
+			}
+		}
+	}
+
+	if n > 0 {
+		t.sizes[id] = n
+	} else {
+		delete(t.sizes, id)
+		n = 0
+	}
+
+	t.total += n - old
+
+	// Wake up anybody who might now be able to write.
+	if n < old {
+		close(t.shrunk)
+		t.shrunk = make(chan struct{})
+	}
+}
+
+// Wait until the given inode may be written to, or the context is cancelled.
+//
+// If writeBack is non-nil, it is called with the inode that has been dirty
+// longest each time the caller is held back, so that it may be synced to let
+// the caller proceed. If it returns an error, Wait returns that error.
+func (t *DirtyTracker) Wait(
+	ctx context.Context,
+	id fuseops.InodeID,
+	writeBack func(context.Context, fuseops.InodeID) error) (err error) {
+	if t == nil {
+		return
+	}
+
+	for {
+		t.mu.Lock()
+		ok := t.total < t.limit || len(t.order) == 0 || t.order[0] == id
+		shrunk := t.shrunk
+
+		var oldest fuseops.InodeID
+		if !ok {
+			oldest = t.order[0]
+		}
+
+		t.mu.Unlock()
+
+		if ok {
+			return
+		}
+
+		if writeBack != nil {
+			err = writeBack(ctx, oldest)
+			if err != nil {
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+
+		case <-shrunk:
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inode_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestDirtyTracker(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const dirtyLimit = 100
+
+type DirtyTrackerTest struct {
+	ctx     context.Context
+	tracker *inode.DirtyTracker
+}
+
+var _ SetUpInterface = &DirtyTrackerTest{}
+
+func init() { RegisterTestSuite(&DirtyTrackerTest{}) }
+
+func (t *DirtyTrackerTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.tracker = inode.NewDirtyTracker(dirtyLimit)
+}
+
+// Start waiting for the given inode in the background, returning a channel
+// that receives the result.
+func (t *DirtyTrackerTest) wait(
+	ctx context.Context,
+	id int) (c chan error) {
+	c = make(chan error, 1)
+	go func() {
+		c <- t.tracker.Wait(ctx, fuseops.InodeID(id), nil)
+	}()
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DirtyTrackerTest) Total() {
+	t.tracker.Set(1, 10)
+	t.tracker.Set(2, 20)
+	ExpectEq(30, t.tracker.Total())
+
+	t.tracker.Set(1, 15)
+	ExpectEq(35, t.tracker.Total())
+
+	t.tracker.Set(2, 0)
+	ExpectEq(15, t.tracker.Total())
+}
+
+func (t *DirtyTrackerTest) UnderLimit() {
+	t.tracker.Set(1, dirtyLimit-1)
+
+	err := t.tracker.Wait(t.ctx, 2, nil)
+	ExpectEq(nil, err)
+}
+
+func (t *DirtyTrackerTest) OldestNotHeldBack() {
+	t.tracker.Set(1, dirtyLimit/2)
+	t.tracker.Set(2, dirtyLimit)
+
+	err := t.tracker.Wait(t.ctx, 1, nil)
+	ExpectEq(nil, err)
+}
+
+func (t *DirtyTrackerTest) OthersHeldBackUntilSynced() {
+	t.tracker.Set(1, dirtyLimit/2)
+	t.tracker.Set(2, dirtyLimit/2)
+
+	c := t.wait(t.ctx, 2)
+	select {
+	case err := <-c:
+		AddFailure("Returned early: %v", err)
+		return
+
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Once the oldest file is synced, the other may proceed.
+	t.tracker.Set(1, 0)
+	ExpectEq(nil, <-c)
+}
+
+func (t *DirtyTrackerTest) WritesBackOldest() {
+	t.tracker.Set(1, dirtyLimit/2)
+	t.tracker.Set(2, dirtyLimit/2)
+
+	// Sync the oldest file when asked to, letting the other proceed.
+	var writtenBack []fuseops.InodeID
+	writeBack := func(ctx context.Context, id fuseops.InodeID) (err error) {
+		writtenBack = append(writtenBack, id)
+		t.tracker.Set(id, 0)
+		return
+	}
+
+	err := t.tracker.Wait(t.ctx, 2, writeBack)
+	AssertEq(nil, err)
+	ExpectThat(writtenBack, ElementsAre(1))
+}
+
+func (t *DirtyTrackerTest) WriteBackFails() {
+	t.tracker.Set(1, dirtyLimit/2)
+	t.tracker.Set(2, dirtyLimit/2)
+
+	expected := errors.New("taco")
+	writeBack := func(ctx context.Context, id fuseops.InodeID) error {
+		return expected
+	}
+
+	err := t.tracker.Wait(t.ctx, 2, writeBack)
+	ExpectEq(expected, err)
+}
+
+func (t *DirtyTrackerTest) Cancelled() {
+	t.tracker.Set(1, dirtyLimit)
+
+	ctx, cancel := context.WithCancel(t.ctx)
+	c := t.wait(ctx, 2)
+	cancel()
+
+	ExpectEq(context.Canceled, <-c)
+}
+
+func (t *DirtyTrackerTest) NilTracker() {
+	var tracker *inode.DirtyTracker
+	tracker.Set(1, dirtyLimit)
+
+	ExpectEq(0, tracker.Total())
+	ExpectEq(nil, tracker.Wait(t.ctx, 2, nil))
+}
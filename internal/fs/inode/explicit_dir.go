@@ -15,11 +15,13 @@
 package inode
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
 )
 
 // An inode representing a directory backed by an object in GCS with a specific
@@ -27,6 +29,16 @@ import (
 type ExplicitDirInode interface {
 	DirInode
 	SourceGeneration() Generation
+
+	// Return a record for the backing object, which must not be modified.
+	Source() *gcs.Object
+
+	// Apply the supplied updates to the backing object's custom metadata, as
+	// with FileInode.UpdateMetadata. The updates are silently dropped if the
+	// object has been replaced or deleted.
+	UpdateMetadata(
+		ctx context.Context,
+		updates map[string]*string) (err error)
 }
 
 // Create an explicit dir inode backed by the supplied object. See notes on
@@ -36,7 +48,11 @@ func NewExplicitDirInode(
 	o *gcs.Object,
 	attrs fuseops.InodeAttributes,
 	implicitDirs bool,
+	conflictSuffix string,
+	normalization Normalization,
+	countSubdirs bool,
 	typeCacheTTL time.Duration,
+	lookupBurst int,
 	bucket gcs.Bucket,
 	mtimeClock timeutil.Clock,
 	cacheClock timeutil.Clock) (d ExplicitDirInode) {
@@ -45,17 +61,18 @@ func NewExplicitDirInode(
 		o.Name,
 		attrs,
 		implicitDirs,
+		conflictSuffix,
+		normalization,
+		countSubdirs,
 		typeCacheTTL,
+		lookupBurst,
 		bucket,
 		mtimeClock,
 		cacheClock)
 
 	d = &explicitDirInode{
 		dirInode: wrapped.(*dirInode),
-		generation: Generation{
-			Object:   o.Generation,
-			Metadata: o.MetaGeneration,
-		},
+		src:      *o,
 	}
 
 	return
@@ -63,10 +80,54 @@ func NewExplicitDirInode(
 
 type explicitDirInode struct {
 	*dirInode
-	generation Generation
+
+	// The backing object. Only its metadata ever changes.
+	//
+	// GUARDED_BY(mu)
+	src gcs.Object
 }
 
+// LOCKS_REQUIRED(d)
 func (d *explicitDirInode) SourceGeneration() (gen Generation) {
-	gen = d.generation
+	gen = Generation{
+		Object:   d.src.Generation,
+		Metadata: d.src.MetaGeneration,
+	}
+
 	return
 }
+
+// LOCKS_REQUIRED(d)
+func (d *explicitDirInode) Source() *gcs.Object {
+	// Make a copy, since we modify d.src.
+	o := d.src
+	return &o
+}
+
+// LOCKS_REQUIRED(d)
+func (d *explicitDirInode) UpdateMetadata(
+	ctx context.Context,
+	updates map[string]*string) (err error) {
+	req := &gcs.UpdateObjectRequest{
+		Name:                       d.src.Name,
+		Generation:                 d.src.Generation,
+		MetaGenerationPrecondition: &d.src.MetaGeneration,
+		Metadata:                   updates,
+	}
+
+	o, err := d.bucket.UpdateObject(ctx, req)
+	switch err.(type) {
+	case nil:
+		d.src = *o
+		return
+
+	case *gcs.NotFoundError, *gcs.PreconditionError:
+		// Special case: the directory has been removed or replaced.
+		err = nil
+		return
+
+	default:
+		err = fmt.Errorf("UpdateObject: %v", err)
+		return
+	}
+}
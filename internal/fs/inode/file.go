@@ -15,9 +15,15 @@
 package inode
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"log"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
@@ -32,6 +38,50 @@ import (
 // the format defined by time.RFC3339Nano.
 const FileMtimeMetadataKey = gcsx.MtimeMetadataKey
 
+// FileStats contains counters describing the recent history of a file inode,
+// for diagnosing problems with a particular file. They live only as long as
+// the inode. Field names are part of the format of the user.gcsfuse.stats
+// extended attribute, so should not be changed once released.
+type FileStats struct {
+	// The number of reads served, and how many of them were served from a local
+	// copy of the contents without contacting GCS.
+	Reads     int64 `json:"reads"`
+	CacheHits int64 `json:"cache_hits"`
+
+	// The number of bytes of contents fetched from GCS, whether to serve reads
+	// directly or to make a local copy.
+	BytesFetched int64 `json:"bytes_fetched"`
+
+	// The generation of the backing object most recently confirmed to be
+	// current by a request to GCS, or zero if none has been.
+	LastGenerationValidated int64 `json:"last_generation_validated"`
+
+	// The most recent error from a GCS request made on behalf of the inode, and
+	// when it happened, or zero values if there has been none.
+	LastError     string    `json:"last_error"`
+	LastErrorTime time.Time `json:"last_error_time"`
+}
+
+// A WriteConflictPolicy says what a sync does when it finds that the source
+// object has been replaced in GCS since the inode's contents were derived
+// from it.
+type WriteConflictPolicy int
+
+const (
+	// Write nothing, treating the inode as unlinked or, if configured to,
+	// failing with ESTALE.
+	WriteConflictFail WriteConflictPolicy = iota
+
+	// Write the contents over whatever generation has replaced the source
+	// object.
+	WriteConflictOverwrite
+
+	// As for WriteConflictOverwrite if the contents were modified after the
+	// generation that replaced the source object, and as for WriteConflictFail
+	// otherwise.
+	WriteConflictNewestWins
+)
+
 type FileInode struct {
 	/////////////////////////
 	// Dependencies
@@ -39,16 +89,38 @@ type FileInode struct {
 
 	bucket     gcs.Bucket
 	syncer     gcsx.Syncer
+	tempSpace  *gcsx.TempSpace
+	dirty      *DirtyTracker
 	mtimeClock timeutil.Clock
 
+	// If non-nil, called with the inode's lock held each time an op finds the
+	// source object clobbered.
+	onClobbered func(f *FileInode)
+
 	/////////////////////////
 	// Constant data
 	/////////////////////////
 
-	id      fuseops.InodeID
-	name    string
-	attrs   fuseops.InodeAttributes
-	tempDir string
+	id    fuseops.InodeID
+	name  string
+	attrs fuseops.InodeAttributes
+
+	// Whether to present objects stored with gzip content encoding by their
+	// decompressed contents, rather than by the bytes stored.
+	decompressGzip bool
+
+	// Whether to fail ops that find the source object clobbered with ESTALE,
+	// rather than failing reads with the error from GCS and treating the
+	// inode as unlinked when syncing.
+	staleErrors bool
+
+	// Whether writes that begin at the end of the source object may be held
+	// locally on their own and composed onto it when syncing, rather than
+	// first fetching its contents.
+	appendWrites bool
+
+	// What to do when syncing finds the source object replaced.
+	conflictPolicy WriteConflictPolicy
 
 	/////////////////////////
 	// Mutable state
@@ -69,19 +141,85 @@ type FileInode struct {
 	src gcs.Object
 
 	// The current content of this inode, or nil if the source object is still
-	// authoritative.
+	// authoritative. This may hold only what has been appended to the source
+	// object, in which case gcsx.AppendBase(content) == src.Size and the rest
+	// is read from GCS.
 	content gcsx.TempFile
 
+	// When f.decompressed(), the size of the decompressed contents of the
+	// source object as recorded in its gzip trailer, and the generation to
+	// which that applies. Used to report the size without downloading the
+	// contents.
+	//
+	// GUARDED_BY(mu)
+	gzipSize           uint64
+	gzipSizeGeneration int64
+
+	// When f.decompressed() and content != nil, the size of the decompressed
+	// contents with which content was initialized.
+	//
+	// GUARDED_BY(mu)
+	decompressedSize int64
+
 	// Has Destroy been called?
 	//
 	// GUARDED_BY(mu)
 	destroyed bool
+
+	// Set once an op has found the source object clobbered, if staleErrors is
+	// set. From then on the source object is never read again, and ops that
+	// would need it or would write it out fail with ESTALE.
+	//
+	// INVARIANT: stale => staleErrors
+	//
+	// GUARDED_BY(mu)
+	stale bool
+
+	// The access pattern hint set by the user for this inode, if any.
+	//
+	// GUARDED_BY(mu)
+	readHint gcsx.ReadHint
+
+	// The name and generation of the source object of the most recent
+	// successful call to CopyFrom, and the generation of the object that it
+	// produced.
+	//
+	// GUARDED_BY(mu)
+	copiedFromName       string
+	copiedFromGeneration int64
+	copiedToGeneration   int64
+
+	// The number of open handles through which the file may be written, and how
+	// many of them were opened with O_APPEND.
+	//
+	// INVARIANT: 0 <= appendWriters <= writers
+	//
+	// GUARDED_BY(mu)
+	writers       int
+	appendWriters int
+
+	// Set when the contents are modified other than by a write while only
+	// O_APPEND handles are open, and cleared when they are synced. While it is
+	// clear, whatever has been written after the end of the source object may
+	// instead be appended to whatever generation has since replaced it.
+	//
+	// GUARDED_BY(mu)
+	positionedWrites bool
+
+	// Counters for Stats, guarded by their own lock so that they can be
+	// updated by reads that don't hold mu.
+	//
+	// LOCK ORDERING: mu < statsMu
+	statsMu sync.Mutex
+
+	// GUARDED_BY(statsMu)
+	stats FileStats
 }
 
 var _ Inode = &FileInode{}
 
 // Create a file inode for the given object in GCS. The initial lookup count is
-// zero.
+// zero. If onClobbered is non-nil, it is called as described for NoteClobbered.
 //
 // REQUIRES: o != nil
 // REQUIRES: o.Generation > 0
@@ -94,18 +232,30 @@ func NewFileInode(
 	attrs fuseops.InodeAttributes,
 	bucket gcs.Bucket,
 	syncer gcsx.Syncer,
-	tempDir string,
+	tempSpace *gcsx.TempSpace,
+	dirty *DirtyTracker,
+	decompressGzip bool,
+	staleErrors bool,
+	appendWrites bool,
+	conflictPolicy WriteConflictPolicy,
+	onClobbered func(f *FileInode),
 	mtimeClock timeutil.Clock) (f *FileInode) {
 	// Set up the basic struct.
 	f = &FileInode{
-		bucket:     bucket,
-		syncer:     syncer,
-		mtimeClock: mtimeClock,
-		id:         id,
-		name:       o.Name,
-		attrs:      attrs,
-		tempDir:    tempDir,
-		src:        *o,
+		bucket:         bucket,
+		syncer:         syncer,
+		mtimeClock:     mtimeClock,
+		onClobbered:    onClobbered,
+		id:             id,
+		name:           o.Name,
+		attrs:          attrs,
+		tempSpace:      tempSpace,
+		dirty:          dirty,
+		decompressGzip: decompressGzip,
+		staleErrors:    staleErrors,
+		appendWrites:   appendWrites,
+		conflictPolicy: conflictPolicy,
+		src:            *o,
 	}
 
 	f.lc.Init(id)
@@ -141,10 +291,29 @@ func (f *FileInode) checkInvariants() {
 	if f.content != nil {
 		f.content.CheckInvariants()
 	}
+
+	// INVARIANT: stale => staleErrors
+	if f.stale && !f.staleErrors {
+		panic("Stale inode without staleErrors")
+	}
+
+	// INVARIANT: 0 <= appendWriters <= writers
+	if f.appendWriters < 0 || f.appendWriters > f.writers {
+		panic(fmt.Sprintf("Writer counts: %d, %d", f.appendWriters, f.writers))
+	}
+
+	// INVARIANT: If content holds only appended contents, they were appended to
+	// src.
+	if base := gcsx.AppendBase(f.content); base != 0 && base != int64(f.src.Size) {
+		panic(fmt.Sprintf("Append base %d for size %d", base, f.src.Size))
+	}
 }
 
+// Clobbered reports whether the object from which this inode is branched has
+// since been deleted or replaced by another generation in GCS.
+//
 // LOCKS_REQUIRED(f.mu)
-func (f *FileInode) clobbered(ctx context.Context) (b bool, err error) {
+func (f *FileInode) Clobbered(ctx context.Context) (b bool, err error) {
 	// Stat the object in GCS.
 	req := &gcs.StatObjectRequest{Name: f.name}
 	o, err := f.bucket.StatObject(ctx, req)
@@ -159,6 +328,7 @@ func (f *FileInode) clobbered(ctx context.Context) (b bool, err error) {
 	// Propagate other errors.
 	if err != nil {
 		err = fmt.Errorf("StatObject: %v", err)
+		f.recordError(err)
 		return
 	}
 
@@ -166,9 +336,59 @@ func (f *FileInode) clobbered(ctx context.Context) (b bool, err error) {
 	oGen := Generation{o.Generation, o.MetaGeneration}
 	b = f.SourceGeneration().Compare(oGen) != 0
 
+	if !b {
+		f.recordValidated(o.Generation)
+	}
+
 	return
 }
 
+// LOCKS_EXCLUDED(f.statsMu)
+func (f *FileInode) recordRead(cacheHit bool, bytesFetched int64, err error) {
+	f.statsMu.Lock()
+	defer f.statsMu.Unlock()
+
+	f.stats.Reads++
+	if cacheHit {
+		f.stats.CacheHits++
+	}
+
+	f.stats.BytesFetched += bytesFetched
+	if err != nil && err != io.EOF {
+		f.recordErrorLocked(err)
+	}
+}
+
+// LOCKS_EXCLUDED(f.statsMu)
+func (f *FileInode) recordFetched(bytesFetched int64) {
+	f.statsMu.Lock()
+	defer f.statsMu.Unlock()
+
+	f.stats.BytesFetched += bytesFetched
+}
+
+// LOCKS_EXCLUDED(f.statsMu)
+func (f *FileInode) recordValidated(generation int64) {
+	f.statsMu.Lock()
+	defer f.statsMu.Unlock()
+
+	f.stats.LastGenerationValidated = generation
+}
+
+// LOCKS_EXCLUDED(f.statsMu)
+func (f *FileInode) recordError(err error) {
+	f.statsMu.Lock()
+	defer f.statsMu.Unlock()
+
+	f.recordErrorLocked(err)
+}
+
+// LOCKS_REQUIRED(f.statsMu)
+func (f *FileInode) recordErrorLocked(err error) {
+	f.stats.LastError = err.Error()
+	f.stats.LastErrorTime = f.mtimeClock.Now()
+}
+
 // Ensure that f.content != nil
 //
 // LOCKS_REQUIRED(f.mu)
@@ -178,30 +398,478 @@ func (f *FileInode) ensureContent(ctx context.Context) (err error) {
 		return
 	}
 
-	// Open a reader for the generation we care about.
+	// Don't mix in the contents of some other generation.
+	if f.stale {
+		err = syscall.ESTALE
+		return
+	}
+
+	if f.decompressed() {
+		err = f.ensureDecompressedContent(ctx)
+		return
+	}
+
+	// If the object records runs of zeros, fetch only the rest.
+	if holes := f.SourceHoles(); len(holes) > 0 {
+		var tf gcsx.TempFile
+		tf, err = gcsx.NewSparseTempFile(
+			ctx,
+			f.bucket,
+			&f.src,
+			holes,
+			f.tempSpace,
+			f.mtimeClock)
+
+		if err != nil {
+			if err != syscall.ENOSPC {
+				err = fmt.Errorf("NewSparseTempFile: %v", err)
+			}
+
+			f.recordError(err)
+			return
+		}
+
+		fetched := int64(f.src.Size)
+		for _, h := range holes {
+			fetched -= h.Length
+		}
+
+		f.recordFetched(fetched)
+		f.content = tf
+		return
+	}
+
+	// Open a reader for the generation we care about.
+	rc, err := f.bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:       f.src.Name,
+			Generation: f.src.Generation,
+		})
+
+	if err != nil {
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			err = f.NoteClobbered(err)
+			if err == syscall.ESTALE {
+				return
+			}
+		}
+
+		err = fmt.Errorf("NewReader: %v", err)
+		f.recordError(err)
+		return
+	}
+
+	defer rc.Close()
+
+	// Create a temporary file with its contents, refusing to use them if they
+	// don't match the checksum GCS has for the object.
+	tf, err := gcsx.NewTempFile(
+		gcsx.NewVerifyingReader(rc, &f.src),
+		f.tempSpace,
+		f.mtimeClock)
+
+	if err != nil {
+		if err != syscall.ENOSPC {
+			err = fmt.Errorf("NewTempFile: %v", err)
+		}
+
+		f.recordError(err)
+		return
+	}
+
+	// Update state.
+	f.recordFetched(int64(f.src.Size))
+	f.content = tf
+
+	return
+}
+
+// Tell the dirty tracker how large our contents are, if they are dirty.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) noteDirty() {
+	sr, err := f.content.Stat()
+	if err != nil || sr.Mtime == nil {
+		return
+	}
+
+	// Count only what is held locally.
+	f.dirty.Set(f.id, sr.Size-gcsx.AppendBase(f.content))
+}
+
+// The most that a write beginning before the appended contents may overlap
+// the source object by and still be appended. The kernel's writeback cache
+// writes out whole pages, so rewrites at most the last page unchanged.
+const maxAppendOverlap = 1 << 16
+
+// Return the offset beyond which writes to the file may be held locally on
+// their own, without fetching the contents of the source object, or zero if
+// there is none.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) appendBase() int64 {
+	if f.content != nil {
+		return gcsx.AppendBase(f.content)
+	}
+
+	if f.appendable() {
+		return int64(f.src.Size)
+	}
+
+	return 0
+}
+
+// Can what is written after the end of the source object be held locally on
+// its own, and composed onto it when syncing?
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) appendable() bool {
+	return f.appendWrites &&
+		!f.stale &&
+		!f.decompressed() &&
+		f.src.Size > 0 &&
+		f.src.ComponentCount < gcs.MaxComponentCount &&
+		f.src.ContentEncoding == ""
+}
+
+// The number of times Sync tries again to append to the object when another
+// generation keeps replacing the one it appended to.
+const maxAppendConflictRetries = 5
+
+// Have the contents been modified only by appending through O_APPEND handles?
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) onlyAppended() bool {
+	if f.positionedWrites || f.decompressed() {
+		return false
+	}
+
+	sr, err := f.content.Stat()
+	return err == nil && sr.DirtyThreshold >= int64(f.src.Size)
+}
+
+// Make what has been appended to the source object instead be appended to the
+// supplied generation of the object, which becomes the source object.
+//
+// REQUIRES: f.onlyAppended()
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) rebaseAppended(
+	ctx context.Context,
+	o *gcs.Object) (err error) {
+	old := f.content
+	sr, err := old.Stat()
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	tf, err := gcsx.NewAppendTempFile(int64(o.Size), f.tempSpace, f.mtimeClock)
+	if err != nil {
+		if err != syscall.ENOSPC {
+			err = fmt.Errorf("NewAppendTempFile: %v", err)
+		}
+
+		return
+	}
+
+	// Copy over the appended contents.
+	err = copyContents(
+		tf,
+		int64(o.Size),
+		old,
+		int64(f.src.Size),
+		sr.Size-int64(f.src.Size))
+
+	if err != nil {
+		tf.Destroy()
+		return
+	}
+
+	if sr.Mtime != nil {
+		tf.SetMtime(*sr.Mtime)
+	}
+
+	old.Destroy()
+	f.content = tf
+	f.src = *o
+
+	// Fetch the new generation's contents if it can't be composed onto.
+	if !f.appendable() {
+		err = f.materialize(ctx)
+		if err != nil {
+			return
+		}
+	}
+
+	f.noteDirty()
+	return
+}
+
+// Does the source object hold the supplied data at the given offset?
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) sourceMatches(
+	ctx context.Context,
+	data []byte,
+	offset int64) (b bool, err error) {
+	buf := make([]byte, len(data))
+	n, err := f.readSource(ctx, buf, offset)
+	if err != nil {
+		return
+	}
+
+	b = n == len(data) && bytes.Equal(buf, data)
+	return
+}
+
+// If f.content holds only appended contents, replace it with a full copy of
+// the contents, fetching those of the source object.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) materialize(ctx context.Context) (err error) {
+	base := gcsx.AppendBase(f.content)
+	if base == 0 {
+		return
+	}
+
+	appended := f.content
+	sr, err := appended.Stat()
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	f.content = nil
+	err = f.ensureContent(ctx)
+	if err != nil {
+		f.content = appended
+		return
+	}
+
+	// Copy over the appended contents.
+	err = copyContents(f.content, base, appended, base, sr.Size-base)
+	if err != nil {
+		f.content.Destroy()
+		f.content = appended
+		return
+	}
+
+	if sr.Mtime != nil {
+		f.content.SetMtime(*sr.Mtime)
+	}
+
+	appended.Destroy()
+	return
+}
+
+// Copy n bytes from src at srcOffset to dst at dstOffset. The temp file's
+// ENOSPC is returned unwrapped.
+func copyContents(
+	dst gcsx.TempFile,
+	dstOffset int64,
+	src gcsx.TempFile,
+	srcOffset int64,
+	n int64) (err error) {
+	buf := make([]byte, 1<<20)
+	for n > 0 {
+		p := buf
+		if int64(len(p)) > n {
+			p = p[:n]
+		}
+
+		var nr int
+		nr, err = src.ReadAt(p, srcOffset)
+		if err == io.EOF && nr == len(p) {
+			err = nil
+		}
+
+		if err != nil {
+			err = fmt.Errorf("ReadAt: %v", err)
+			return
+		}
+
+		_, err = dst.WriteAt(p, dstOffset)
+		if err != nil {
+			return
+		}
+
+		srcOffset += int64(nr)
+		dstOffset += int64(nr)
+		n -= int64(nr)
+	}
+
+	return
+}
+
+// Read from the source object into dst at the given offset, which must be
+// within it, stopping at its end.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) readSource(
+	ctx context.Context,
+	dst []byte,
+	offset int64) (n int, err error) {
+	limit := offset + int64(len(dst))
+	if limit > int64(f.src.Size) {
+		limit = int64(f.src.Size)
+	}
+
+	rc, err := f.bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:       f.src.Name,
+			Generation: f.src.Generation,
+			Range: &gcs.ByteRange{
+				Start: uint64(offset),
+				Limit: uint64(limit),
+			},
+		})
+
+	if err != nil {
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			err = f.NoteClobbered(err)
+			if err == syscall.ESTALE {
+				return
+			}
+		}
+
+		err = fmt.Errorf("NewReader: %v", err)
+		f.recordError(err)
+		return
+	}
+
+	defer rc.Close()
+
+	n, err = io.ReadFull(rc, dst[:limit-offset])
+	f.recordFetched(int64(n))
+	if err != nil {
+		err = fmt.Errorf("ReadFull: %v", err)
+		f.recordError(err)
+		return
+	}
+
+	return
+}
+
+// Is the source object one whose contents we present decompressed?
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) decompressed() bool {
+	return f.decompressGzip && f.src.ContentEncoding == "gzip"
+}
+
+// Like ensureContent, for f.decompressed().
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) ensureDecompressedContent(
+	ctx context.Context) (err error) {
+	rc, err := f.bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:       f.src.Name,
+			Generation: f.src.Generation,
+		})
+
+	if err != nil {
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			err = f.NoteClobbered(err)
+			if err == syscall.ESTALE {
+				return
+			}
+		}
+
+		err = fmt.Errorf("NewReader: %v", err)
+		f.recordError(err)
+		return
+	}
+
+	defer rc.Close()
+
+	// The checksum covers the compressed bytes, so verify those.
+	zr, err := gzip.NewReader(gcsx.NewVerifyingReader(rc, &f.src))
+	if err != nil {
+		err = fmt.Errorf("gzip.NewReader: %v", err)
+		f.recordError(err)
+		return
+	}
+
+	tf, err := gcsx.NewTempFile(zr, f.tempSpace, f.mtimeClock)
+	if err != nil {
+		if err != syscall.ENOSPC {
+			err = fmt.Errorf("NewTempFile: %v", err)
+		}
+
+		f.recordError(err)
+		return
+	}
+
+	sr, err := tf.Stat()
+	if err != nil {
+		tf.Destroy()
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	f.recordFetched(int64(f.src.Size))
+	f.content = tf
+	f.decompressedSize = sr.Size
+
+	return
+}
+
+// Return the decompressed size of the source object, which must be
+// f.decompressed(), reading it from the gzip trailer if we haven't already.
+// This is the size modulo 2^32, and of only the last member of a multi-member
+// stream, so may be wrong for unusual objects.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) decompressedSourceSize(
+	ctx context.Context) (size uint64, err error) {
+	if f.gzipSizeGeneration == f.src.Generation {
+		size = f.gzipSize
+		return
+	}
+
+	// A gzip stream is at least a 10-byte header and an 8-byte trailer.
+	const trailerSize = 8
+	if f.src.Size < 10+trailerSize {
+		err = fmt.Errorf("%d bytes is too short for a gzip stream", f.src.Size)
+		return
+	}
+
+	// The last four bytes hold the size, little-endian.
 	rc, err := f.bucket.NewReader(
 		ctx,
 		&gcs.ReadObjectRequest{
 			Name:       f.src.Name,
 			Generation: f.src.Generation,
+			Range: &gcs.ByteRange{
+				Start: f.src.Size - 4,
+				Limit: f.src.Size,
+			},
 		})
 
 	if err != nil {
 		err = fmt.Errorf("NewReader: %v", err)
+		f.recordError(err)
 		return
 	}
 
 	defer rc.Close()
 
-	// Create a temporary file with its contents.
-	tf, err := gcsx.NewTempFile(rc, f.tempDir, f.mtimeClock)
+	var buf [4]byte
+	_, err = io.ReadFull(rc, buf[:])
 	if err != nil {
-		err = fmt.Errorf("NewTempFile: %v", err)
+		err = fmt.Errorf("ReadFull: %v", err)
+		f.recordError(err)
 		return
 	}
 
-	// Update state.
-	f.content = tf
+	size = uint64(binary.LittleEndian.Uint32(buf[:]))
+	f.gzipSize = size
+	f.gzipSizeGeneration = f.src.Generation
 
 	return
 }
@@ -226,6 +894,25 @@ func (f *FileInode) Name() string {
 	return f.name
 }
 
+// SourceHoles returns the runs of zeros recorded for the source object under
+// gcsx.SparseExtentsMetadataKey, ignoring a malformed record since the
+// object's contents are authoritative. Decompressed objects have none.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) SourceHoles() (holes []gcsx.Extent) {
+	v, ok := f.src.Metadata[gcsx.SparseExtentsMetadataKey]
+	if !ok || f.decompressed() {
+		return
+	}
+
+	holes, err := gcsx.ParseExtents(v, int64(f.src.Size))
+	if err != nil {
+		holes = nil
+	}
+
+	return
+}
+
 // Source returns a record for the GCS object from which this inode is branched. The
 // record is guaranteed not to be modified, and users must not modify it.
 //
@@ -243,7 +930,102 @@ func (f *FileInode) Source() *gcs.Object {
 //
 // LOCKS_REQUIRED(f.mu)
 func (f *FileInode) SourceGenerationIsAuthoritative() bool {
-	return f.content == nil
+	return f.content == nil && !f.decompressed() && !f.stale
+}
+
+// Dirty reports whether the file has local modifications that have not yet
+// been written to GCS. A destroyed inode is never dirty.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) Dirty() bool {
+	if f.destroyed || f.content == nil {
+		return false
+	}
+
+	sr, err := f.content.Stat()
+	return err == nil && sr.Mtime != nil
+}
+
+// NoteClobbered records that err, returned while reading the source object,
+// shows it to have been clobbered, and tells the onClobbered callback. It
+// returns the error with which to fail the op that found out: ESTALE if the
+// inode was configured to report that, or err otherwise.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) NoteClobbered(err error) error {
+	if f.onClobbered != nil {
+		f.onClobbered(f)
+	}
+
+	if !f.staleErrors {
+		return err
+	}
+
+	if !f.stale {
+		log.Printf("%q was replaced or deleted in GCS; failing with ESTALE.", f.name)
+		f.stale = true
+	}
+
+	return syscall.ESTALE
+}
+
+// ReadHint returns the access pattern hint most recently set with
+// SetReadHint, or gcsx.ReadHintNormal if none.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) ReadHint() gcsx.ReadHint {
+	return f.readHint
+}
+
+// SetReadHint records a hint about how the file will be read, used when
+// reading from GCS through any handle for the inode. The hint lives only as
+// long as the inode.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) SetReadHint(h gcsx.ReadHint) {
+	f.readHint = h
+}
+
+// AddWriter records that a handle through which the file may be written has
+// been opened, with O_APPEND if appending is set.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) AddWriter(appending bool) {
+	f.writers++
+	if appending {
+		f.appendWriters++
+	}
+}
+
+// RemoveWriter records that a handle previously passed to AddWriter has been
+// released.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) RemoveWriter(appending bool) {
+	f.writers--
+	if appending {
+		f.appendWriters--
+	}
+}
+
+// Stats returns a snapshot of the inode's counters.
+//
+// LOCKS_EXCLUDED(f.statsMu)
+func (f *FileInode) Stats() (s FileStats) {
+	f.statsMu.Lock()
+	defer f.statsMu.Unlock()
+
+	s = f.stats
+	return
+}
+
+// RecordDirectRead updates the counters returned by Stats for a read of n bytes
+// that a handle served directly from GCS, as suggested by
+// SourceGenerationIsAuthoritative, rather than calling f.Read.
+//
+// LOCKS_EXCLUDED(f.statsMu)
+func (f *FileInode) RecordDirectRead(n int, err error) {
+	f.recordRead(false, int64(n), err)
 }
 
 // Equivalent to the generation returned by f.Source().
@@ -272,6 +1054,7 @@ func (f *FileInode) Destroy() (err error) {
 
 	if f.content != nil {
 		f.content.Destroy()
+		f.dirty.Set(f.id, 0)
 	}
 
 	return
@@ -283,28 +1066,20 @@ func (f *FileInode) Attributes(
 	attrs = f.attrs
 
 	// Obtain default information from the source object.
-	attrs.Mtime = f.src.Updated
+	attrs.Mtime = objectMtime(&f.src)
 	attrs.Size = uint64(f.src.Size)
 
 	// We require only that atime and ctime be "reasonable".
-	attrs.Atime = attrs.Mtime
-	attrs.Ctime = attrs.Mtime
-
-	// If the source object has an mtime metadata key, use that instead of its
-	// update time.
-	// If the file was copied via gsutil, we'll have goog-reserved-file-mtime
-	if strTimestamp, ok := f.src.Metadata["goog-reserved-file-mtime"]; ok {
-		if timestamp, err := strconv.ParseInt(strTimestamp, 0, 64); err == nil {
-			attrs.Mtime = time.Unix(timestamp, 0)
-		}
-	}
-
-	// Otherwise, if its been synced with gcsfuse before, we'll have gcsfuse_mtime
-	if formatted, ok := f.src.Metadata["gcsfuse_mtime"]; ok {
-		attrs.Mtime, err = time.Parse(time.RFC3339Nano, formatted)
-		if err != nil {
-			err = fmt.Errorf("time.Parse(%q): %v", formatted, err)
-			return
+	attrs.Atime = f.src.Updated
+	attrs.Ctime = f.src.Updated
+
+	// If we present the object decompressed, report the size of that. Don't
+	// fail the stat if the object turns out not to be gzip after all; reads will
+	// fail instead.
+	if f.decompressed() && f.content == nil {
+		size, sizeErr := f.decompressedSourceSize(ctx)
+		if sizeErr == nil {
+			attrs.Size = size
 		}
 	}
 
@@ -325,9 +1100,9 @@ func (f *FileInode) Attributes(
 
 	// If the object has been clobbered, we reflect that as the inode being
 	// unlinked.
-	clobbered, err := f.clobbered(ctx)
+	clobbered, err := f.Clobbered(ctx)
 	if err != nil {
-		err = fmt.Errorf("clobbered: %v", err)
+		err = fmt.Errorf("Clobbered: %v", err)
 		return
 	}
 
@@ -348,10 +1123,36 @@ func (f *FileInode) Read(
 	ctx context.Context,
 	dst []byte,
 	offset int64) (n int, err error) {
+	// Note whether the read can be served without contacting GCS.
+	cacheHit := f.content != nil
+	defer func() { f.recordRead(cacheHit, 0, err) }()
+
 	// Make sure f.content != nil.
 	err = f.ensureContent(ctx)
 	if err != nil {
-		err = fmt.Errorf("ensureContent: %v", err)
+		if err != syscall.ESTALE {
+			err = fmt.Errorf("ensureContent: %v", err)
+		}
+
+		return
+	}
+
+	// If we hold only appended contents, read what comes before them from the
+	// source object.
+	if offset < gcsx.AppendBase(f.content) {
+		cacheHit = false
+		n, err = f.readSource(ctx, dst, offset)
+		if err != nil || n == len(dst) {
+			return
+		}
+
+		var tailN int
+		tailN, err = f.content.ReadAt(dst[n:], offset+int64(n))
+		n += tailN
+		if err != nil && err != io.EOF {
+			err = fmt.Errorf("content.ReadAt: %v", err)
+		}
+
 		return
 	}
 
@@ -369,6 +1170,47 @@ func (f *FileInode) Read(
 	return
 }
 
+// Find the next data or hole at or after the given offset, with the semantics
+// of TempFile.SeekData. Where the contents are not held locally, the holes are
+// those recorded for the source object, if any.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) SeekData(
+	ctx context.Context,
+	offset int64,
+	hole bool) (off int64, err error) {
+	base := gcsx.AppendBase(f.content)
+	if f.content != nil && offset >= base {
+		off, err = f.content.SeekData(offset, hole)
+		return
+	}
+
+	// Otherwise the offset lies within the source object.
+	size := int64(f.src.Size)
+	if f.decompressed() {
+		var usize uint64
+		usize, err = f.decompressedSourceSize(ctx)
+		if err != nil {
+			err = fmt.Errorf("decompressedSourceSize: %v", err)
+			return
+		}
+
+		size = int64(usize)
+	}
+
+	data := gcsx.DataExtents(f.SourceHoles(), size)
+	off, err = gcsx.SeekExtents(data, size, offset, hole)
+
+	// If we hold appended contents, carry on into them from the end of the
+	// source object, which isn't a hole after all.
+	if f.content != nil &&
+		((!hole && err == syscall.ENXIO) || (hole && err == nil && off == base)) {
+		off, err = f.content.SeekData(base, hole)
+	}
+
+	return
+}
+
 // Serve a write for this file with semantics matching fuseops.WriteFileOp.
 //
 // LOCKS_REQUIRED(f.mu)
@@ -376,16 +1218,78 @@ func (f *FileInode) Write(
 	ctx context.Context,
 	data []byte,
 	offset int64) (err error) {
-	// Make sure f.content != nil.
+	// Drop any part of a write beginning before the appended contents that
+	// rewrites the source object unchanged.
+	base := f.appendBase()
+	overlap := base - offset
+	if overlap > 0 && overlap <= maxAppendOverlap && overlap < int64(len(data)) {
+		var same bool
+		same, err = f.sourceMatches(ctx, data[:overlap], offset)
+		if err != nil {
+			if err != syscall.ESTALE {
+				err = fmt.Errorf("sourceMatches: %v", err)
+			}
+
+			return
+		}
+
+		if same {
+			data = data[overlap:]
+			offset = base
+		}
+	}
+
+	// If this appends to the source object, hold only what is appended.
+	if f.content == nil && base > 0 && offset == base {
+		f.content, err = gcsx.NewAppendTempFile(
+			int64(f.src.Size),
+			f.tempSpace,
+			f.mtimeClock)
+
+		if err != nil {
+			if err != syscall.ENOSPC {
+				err = fmt.Errorf("NewAppendTempFile: %v", err)
+			}
+
+			return
+		}
+	}
+
+	// Otherwise the contents of the source object are needed, unless the write
+	// is beyond them.
+	if offset < gcsx.AppendBase(f.content) {
+		err = f.materialize(ctx)
+		if err != nil {
+			if err != syscall.ENOSPC && err != syscall.ESTALE {
+				err = fmt.Errorf("materialize: %v", err)
+			}
+
+			return
+		}
+	}
+
+	// Make sure f.content != nil. Running out of space for it, or finding the
+	// object clobbered, is reported to the writer as such.
 	err = f.ensureContent(ctx)
 	if err != nil {
-		err = fmt.Errorf("ensureContent: %v", err)
+		if err != syscall.ENOSPC && err != syscall.ESTALE {
+			err = fmt.Errorf("ensureContent: %v", err)
+		}
+
 		return
 	}
 
+	// The kernel sends writes through O_APPEND handles at the end of the file,
+	// but they can't be told apart from others.
+	if f.appendWriters == 0 || f.appendWriters < f.writers {
+		f.positionedWrites = true
+	}
+
 	// Write to the mutable content. Note that io.WriterAt guarantees it returns
-	// an error for short writes.
+	// an error for short writes, and that the temp file returns ENOSPC
+	// unwrapped.
 	_, err = f.content.WriteAt(data, offset)
+	f.noteDirty()
 
 	return
 }
@@ -450,6 +1354,44 @@ func (f *FileInode) SetMtime(
 
 	default:
 		err = fmt.Errorf("UpdateObject: %v", err)
+		f.recordError(err)
+		return
+	}
+}
+
+// UpdateMetadata applies the supplied updates to the backing object's custom
+// metadata, with the semantics of gcs.UpdateObjectRequest.Metadata. This
+// involves a round trip to GCS, even if the content is dirty; the keys are
+// carried over when the content is synced. As with SetMtime, the updates are
+// silently dropped if the file has been clobbered.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) UpdateMetadata(
+	ctx context.Context,
+	updates map[string]*string) (err error) {
+	srcGen := f.SourceGeneration()
+
+	req := &gcs.UpdateObjectRequest{
+		Name:                       f.src.Name,
+		Generation:                 srcGen.Object,
+		MetaGenerationPrecondition: &srcGen.Metadata,
+		Metadata:                   updates,
+	}
+
+	o, err := f.bucket.UpdateObject(ctx, req)
+	switch err.(type) {
+	case nil:
+		f.src = *o
+		return
+
+	case *gcs.NotFoundError, *gcs.PreconditionError:
+		// Special case: the file has been unlinked or clobbered.
+		err = nil
+		return
+
+	default:
+		err = fmt.Errorf("UpdateObject: %v", err)
+		f.recordError(err)
 		return
 	}
 }
@@ -469,18 +1411,114 @@ func (f *FileInode) Sync(ctx context.Context) (err error) {
 		return
 	}
 
+	// If we already know the object to have been clobbered, don't bother.
+	if f.stale {
+		err = syscall.ESTALE
+		return
+	}
+
+	// Decompressed contents have nothing in common with the object's bytes, so
+	// describe to the syncer an object that they could have been read from
+	// verbatim, and have it rewrite the object rather than append to the
+	// compressed bytes. The new object holds the contents uncompressed, with no
+	// content encoding.
+	src := &f.src
+	sync := f.syncer.SyncObject
+	if f.decompressed() {
+		o := f.src
+		o.Size = uint64(f.decompressedSize)
+		o.ContentEncoding = ""
+		src = &o
+		sync = f.syncer.RewriteObject
+	}
+
 	// Write out the contents if they are dirty.
-	newObj, err := f.syncer.SyncObject(ctx, &f.src, f.content)
+	newObj, err := sync(ctx, src, f.content)
+
+	// If the file has only been appended to through O_APPEND handles, and
+	// another generation has replaced the source object meanwhile, append to
+	// that instead.
+	for i := 0; i < maxAppendConflictRetries; i++ {
+		if _, ok := err.(*gcs.PreconditionError); !ok || !f.onlyAppended() {
+			break
+		}
+
+		var o *gcs.Object
+		o, err = f.bucket.StatObject(
+			ctx,
+			&gcs.StatObjectRequest{Name: f.name})
+
+		// The object having been deleted is as for any other clobbering.
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			err = &gcs.PreconditionError{Err: err}
+			break
+		}
+
+		if err != nil {
+			err = fmt.Errorf("StatObject: %v", err)
+			f.recordError(err)
+			return
+		}
+
+		err = f.rebaseAppended(ctx, o)
+		if err != nil {
+			if err != syscall.ENOSPC && err != syscall.ESTALE {
+				err = fmt.Errorf("rebaseAppended: %v", err)
+			}
+
+			return
+		}
+
+		src = &f.src
+		newObj, err = f.syncer.SyncObject(ctx, src, f.content)
+	}
+
+	// Under a policy of writing over whatever has replaced the source object,
+	// do so if we hold the full contents.
+	for i := 0; i < maxAppendConflictRetries; i++ {
+		if _, ok := err.(*gcs.PreconditionError); !ok ||
+			f.conflictPolicy == WriteConflictFail ||
+			gcsx.AppendBase(f.content) != 0 {
+			break
+		}
+
+		o, statErr := f.conflictingObject(ctx)
+		if statErr != nil {
+			err = fmt.Errorf("conflictingObject: %v", statErr)
+			f.recordError(err)
+			return
+		}
+
+		if o == nil {
+			break
+		}
+
+		if i == 0 {
+			log.Printf("%q was replaced in GCS; overwriting it.", f.name)
+		}
+
+		// Have the syncer write out the full contents with preconditions on the
+		// new generation, whose bytes they needn't share.
+		dst := *src
+		dst.Generation = o.Generation
+		dst.MetaGeneration = o.MetaGeneration
+		newObj, err = f.syncer.RewriteObject(ctx, &dst, f.content)
+	}
 
 	// Special case: a precondition error means we were clobbered, which we treat
-	// as being unlinked. There's no reason to return an error in that case.
+	// as being unlinked. There's no reason to return an error in that case,
+	// unless we've been asked to report it.
 	if _, ok := err.(*gcs.PreconditionError); ok {
-		err = nil
+		err = f.NoteClobbered(nil)
+		if err != nil {
+			return
+		}
 	}
 
 	// Propagate other errors.
 	if err != nil {
 		err = fmt.Errorf("SyncObject: %v", err)
+		f.recordError(err)
 		return
 	}
 
@@ -488,26 +1526,173 @@ func (f *FileInode) Sync(ctx context.Context) (err error) {
 	if newObj != nil {
 		f.src = *newObj
 		f.content = nil
+		f.positionedWrites = false
+		f.dirty.Set(f.id, 0)
+		f.recordValidated(newObj.Generation)
+	}
+
+	return
+}
+
+// Return the generation of the object that has replaced the source object, if
+// the conflict policy says to write over it: any generation for
+// WriteConflictOverwrite, or one last modified before the contents for
+// WriteConflictNewestWins. A deleted object is never written over, as the
+// file has been unlinked.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) conflictingObject(
+	ctx context.Context) (o *gcs.Object, err error) {
+	o, err = f.bucket.StatObject(ctx, &gcs.StatObjectRequest{Name: f.name})
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		o, err = nil, nil
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("StatObject: %v", err)
+		return
+	}
+
+	if f.conflictPolicy != WriteConflictNewestWins {
+		return
+	}
+
+	sr, err := f.content.Stat()
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	if sr.Mtime == nil || !sr.Mtime.After(objectMtime(o)) {
+		o = nil
+	}
+
+	return
+}
+
+// Return the mtime recorded for the supplied object, as reported by
+// Attributes, or its update time if none can be parsed.
+func objectMtime(o *gcs.Object) (mtime time.Time) {
+	mtime = o.Updated
+
+	// If the file was copied via gsutil, we'll have goog-reserved-file-mtime.
+	if strTimestamp, ok := o.Metadata["goog-reserved-file-mtime"]; ok {
+		if timestamp, err := strconv.ParseInt(strTimestamp, 0, 64); err == nil {
+			mtime = time.Unix(timestamp, 0)
+		}
+	}
+
+	// If it's been synced with gcsfuse since, we'll have gcsfuse_mtime.
+	if formatted, ok := o.Metadata[FileMtimeMetadataKey]; ok {
+		if t, err := time.Parse(time.RFC3339Nano, formatted); err == nil {
+			mtime = t
+		}
+	}
+
+	return
+}
+
+// CopyFrom replaces the contents of the file with those of the supplied
+// object, which GCS copies without the data passing through us. The object
+// that results has the supplied object's metadata. Any local contents are
+// discarded.
+//
+// NotFoundError and PreconditionError are returned as is, and mean that
+// either object has changed since it was last seen.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) CopyFrom(
+	ctx context.Context,
+	src *gcs.Object) (err error) {
+	// If we already know the object to have been clobbered, don't bother.
+	if f.stale {
+		err = syscall.ESTALE
+		return
+	}
+
+	dstGeneration := f.src.Generation
+	req := &gcs.CopyObjectRequest{
+		SrcName:                       src.Name,
+		DstName:                       f.src.Name,
+		SrcGeneration:                 src.Generation,
+		SrcMetaGenerationPrecondition: &src.MetaGeneration,
+		DstGenerationPrecondition:     &dstGeneration,
+	}
+
+	o, err := f.bucket.CopyObject(ctx, req)
+	switch err.(type) {
+	case nil:
+
+	case *gcs.NotFoundError, *gcs.PreconditionError:
+		return
+
+	default:
+		err = fmt.Errorf("CopyObject: %v", err)
+		f.recordError(err)
+		return
+	}
+
+	if f.content != nil {
+		f.content.Destroy()
+		f.content = nil
+		f.positionedWrites = false
+		f.dirty.Set(f.id, 0)
 	}
 
+	f.src = *o
+	f.copiedFromName = src.Name
+	f.copiedFromGeneration = src.Generation
+	f.copiedToGeneration = o.Generation
+	f.recordValidated(o.Generation)
+
 	return
 }
 
+// CopiedFrom reports whether the contents of the file are still those that
+// the most recent call to CopyFrom copied from the supplied object.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) CopiedFrom(src *gcs.Object) bool {
+	return f.content == nil &&
+		!f.stale &&
+		f.src.Generation == f.copiedToGeneration &&
+		f.copiedFromName == src.Name &&
+		f.copiedFromGeneration == src.Generation
+}
+
 // Truncate the file to the specified size.
 //
 // LOCKS_REQUIRED(f.mu)
 func (f *FileInode) Truncate(
 	ctx context.Context,
 	size int64) (err error) {
+	// Cutting into the source object needs its contents.
+	if size < gcsx.AppendBase(f.content) {
+		err = f.materialize(ctx)
+		if err != nil {
+			if err != syscall.ENOSPC && err != syscall.ESTALE {
+				err = fmt.Errorf("materialize: %v", err)
+			}
+
+			return
+		}
+	}
+
 	// Make sure f.content != nil.
 	err = f.ensureContent(ctx)
 	if err != nil {
-		err = fmt.Errorf("ensureContent: %v", err)
+		if err != syscall.ENOSPC && err != syscall.ESTALE {
+			err = fmt.Errorf("ensureContent: %v", err)
+		}
+
 		return
 	}
 
 	// Call through.
+	f.positionedWrites = true
 	err = f.content.Truncate(size)
+	f.noteDirty()
 
 	return
 }
@@ -15,10 +15,15 @@
 package inode_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -30,6 +35,7 @@ import (
 	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/gcloud/gcs/gcsfake"
 	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
 	. "github.com/jacobsa/ogletest"
 	"github.com/jacobsa/timeutil"
 )
@@ -54,6 +60,10 @@ type FileTest struct {
 
 	initialContents string
 	backingObj      *gcs.Object
+	decompressGzip  bool
+	staleErrors     bool
+	appendWrites    bool
+	conflictPolicy  inode.WriteConflictPolicy
 
 	in *inode.FileInode
 }
@@ -105,8 +115,17 @@ func (t *FileTest) createInode() {
 		gcsx.NewSyncer(
 			1, // Append threshold
 			".gcsfuse_tmp/",
+			false, // Record holes
+			0,     // Parallel uploads
+			0,     // Parallel upload threshold
 			t.bucket),
-		"",
+		nil, // Temp space
+		nil, // Dirty tracker
+		t.decompressGzip,
+		t.staleErrors,
+		t.appendWrites,
+		t.conflictPolicy,
+		nil, // Clobbered callback
 		&t.clock)
 
 	t.in.Lock()
@@ -201,6 +220,25 @@ func (t *FileTest) InitialAttributes_MtimeFromObjectMetadata_GcsfuseOutranksGsut
 	ExpectThat(attrs.Mtime, timeutil.TimeEq(canonicalMtime))
 }
 
+func (t *FileTest) InitialAttributes_MtimeFromObjectMetadata_Unparseable() {
+	// Set up an mtime that can't be parsed, alongside one that can.
+	if t.backingObj.Metadata == nil {
+		t.backingObj.Metadata = make(map[string]string)
+	}
+
+	gsutilMtime := time.Now().Add(123*time.Second).UTC().AddDate(0, 0, 0).Round(time.Second)
+	t.backingObj.Metadata["goog-reserved-file-mtime"] = strconv.FormatInt(gsutilMtime.Unix(), 10)
+	t.backingObj.Metadata["gcsfuse_mtime"] = "taco"
+
+	t.createInode()
+
+	// The one that can be parsed should be used.
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectThat(attrs.Mtime.UTC(), timeutil.TimeEq(gsutilMtime))
+}
+
 func (t *FileTest) Read() {
 	AssertEq("taco", t.initialContents)
 
@@ -251,6 +289,109 @@ func (t *FileTest) Read() {
 	}
 }
 
+func (t *FileTest) Read_SparseExtents() {
+	// Record a hole in the backing object that doesn't actually contain zeros,
+	// so that we can tell that it wasn't fetched.
+	if t.backingObj.Metadata == nil {
+		t.backingObj.Metadata = make(map[string]string)
+	}
+
+	t.backingObj.Metadata[gcsx.SparseExtentsMetadataKey] = "1+2"
+	t.createInode()
+
+	data := make([]byte, 4)
+	n, err := t.in.Read(t.ctx, data, 0)
+	AssertEq(nil, err)
+	ExpectEq("t\x00\x00o", string(data[:n]))
+}
+
+func (t *FileTest) Read_MalformedSparseExtents() {
+	// A record that doesn't fit the object should be ignored.
+	if t.backingObj.Metadata == nil {
+		t.backingObj.Metadata = make(map[string]string)
+	}
+
+	t.backingObj.Metadata[gcsx.SparseExtentsMetadataKey] = "1+17"
+	t.createInode()
+
+	data := make([]byte, 4)
+	n, err := t.in.Read(t.ctx, data, 0)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(data[:n]))
+}
+
+func (t *FileTest) SeekData_SparseExtents() {
+	if t.backingObj.Metadata == nil {
+		t.backingObj.Metadata = make(map[string]string)
+	}
+
+	t.backingObj.Metadata[gcsx.SparseExtentsMetadataKey] = "1+2"
+	t.createInode()
+
+	testCases := []struct {
+		offset int64
+		hole   bool
+		off    int64
+	}{
+		{0, false, 0},
+		{0, true, 1},
+		{1, false, 3},
+		{3, true, 4},
+	}
+
+	for _, tc := range testCases {
+		off, err := t.in.SeekData(t.ctx, tc.offset, tc.hole)
+		AssertEq(nil, err, "%d %v", tc.offset, tc.hole)
+		ExpectEq(tc.off, off, "%d %v", tc.offset, tc.hole)
+	}
+
+	_, err := t.in.SeekData(t.ctx, 4, true)
+	ExpectEq(syscall.ENXIO, err)
+
+	// Nothing should have been fetched to answer.
+	ExpectEq(0, t.in.Stats().BytesFetched)
+}
+
+func (t *FileTest) SeekData_WriteBeyondEnd() {
+	err := t.in.Write(t.ctx, []byte("burrito"), 10)
+	AssertEq(nil, err)
+
+	off, err := t.in.SeekData(t.ctx, 0, true)
+	AssertEq(nil, err)
+	ExpectEq(len("taco"), off)
+
+	off, err = t.in.SeekData(t.ctx, 4, false)
+	AssertEq(nil, err)
+	ExpectEq(10, off)
+}
+
+func (t *FileTest) SeekData_AppendWrites() {
+	if t.backingObj.Metadata == nil {
+		t.backingObj.Metadata = make(map[string]string)
+	}
+
+	t.backingObj.Metadata[gcsx.SparseExtentsMetadataKey] = "1+2"
+	t.appendWrites = true
+	t.createInode()
+
+	err := t.in.Write(t.ctx, []byte("burrito"), int64(len("taco")))
+	AssertEq(nil, err)
+
+	// The end of the source object is no hole, since the appended contents
+	// follow it.
+	off, err := t.in.SeekData(t.ctx, 3, true)
+	AssertEq(nil, err)
+	ExpectEq(len("tacoburrito"), off)
+
+	off, err = t.in.SeekData(t.ctx, 1, false)
+	AssertEq(nil, err)
+	ExpectEq(3, off)
+
+	off, err = t.in.SeekData(t.ctx, 5, false)
+	AssertEq(nil, err)
+	ExpectEq(5, off)
+}
+
 func (t *FileTest) Write() {
 	var err error
 
@@ -288,6 +429,33 @@ func (t *FileTest) Write() {
 	ExpectThat(attrs.Mtime, timeutil.TimeEq(writeTime))
 }
 
+func (t *FileTest) Write_OutOfOrder() {
+	var err error
+
+	AssertEq("taco", t.initialContents)
+
+	// With writeback caching, the kernel may send pages in any order, including
+	// ones beyond the current end of the file before those that precede them.
+	err = t.in.Write(t.ctx, []byte("ito"), 8)
+	AssertEq(nil, err)
+
+	err = t.in.Write(t.ctx, []byte("burr"), 4)
+	AssertEq(nil, err)
+
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	// Sync.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	// The object should contain everything in the right place.
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+
+	AssertEq(nil, err)
+	ExpectEq("pacoburrito", string(contents))
+}
+
 func (t *FileTest) Truncate() {
 	var attrs fuseops.InodeAttributes
 	var err error
@@ -532,6 +700,263 @@ func (t *FileTest) Sync_Clobbered() {
 	ExpectEq(newObj.Size, o.Size)
 }
 
+func (t *FileTest) Clobbered() {
+	// Initially the inode holds the latest generation.
+	clobbered, err := t.in.Clobbered(t.ctx)
+	AssertEq(nil, err)
+	ExpectFalse(clobbered)
+
+	// Replace the backing object.
+	_, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		t.in.Name(),
+		[]byte("burrito"))
+
+	AssertEq(nil, err)
+
+	clobbered, err = t.in.Clobbered(t.ctx)
+	AssertEq(nil, err)
+	ExpectTrue(clobbered)
+
+	// Deleting it counts too.
+	err = t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: t.in.Name()})
+
+	AssertEq(nil, err)
+
+	clobbered, err = t.in.Clobbered(t.ctx)
+	AssertEq(nil, err)
+	ExpectTrue(clobbered)
+}
+
+func (t *FileTest) Read_ClobberedWithStaleErrors() {
+	t.staleErrors = true
+	t.createInode()
+
+	// Clobber the backing object.
+	_, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		t.in.Name(),
+		[]byte("burrito"))
+
+	AssertEq(nil, err)
+
+	// Reading fails with ESTALE, rather than returning the new contents, and
+	// the inode no longer claims the source object to be authoritative.
+	buf := make([]byte, 4)
+	_, err = t.in.Read(t.ctx, buf, 0)
+	ExpectEq(syscall.ESTALE, err)
+	ExpectFalse(t.in.SourceGenerationIsAuthoritative())
+
+	// So does writing.
+	err = t.in.Write(t.ctx, []byte("queso"), 0)
+	ExpectEq(syscall.ESTALE, err)
+}
+
+func (t *FileTest) Sync_ClobberedWithStaleErrors() {
+	var err error
+
+	t.staleErrors = true
+	t.createInode()
+
+	// Dirty the inode.
+	err = t.in.Truncate(t.ctx, 2)
+	AssertEq(nil, err)
+
+	// Clobber the backing object.
+	newObj, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		t.in.Name(),
+		[]byte("burrito"))
+
+	AssertEq(nil, err)
+
+	// Syncing fails with ESTALE, both now and later.
+	err = t.in.Sync(t.ctx)
+	ExpectEq(syscall.ESTALE, err)
+
+	err = t.in.Sync(t.ctx)
+	ExpectEq(syscall.ESTALE, err)
+
+	// The object in the bucket should not have been changed.
+	statReq := &gcs.StatObjectRequest{Name: t.in.Name()}
+	o, err := t.bucket.StatObject(t.ctx, statReq)
+
+	AssertEq(nil, err)
+	ExpectEq(newObj.Generation, o.Generation)
+}
+
+func (t *FileTest) Stats_Initial() {
+	s := t.in.Stats()
+	ExpectEq(0, s.Reads)
+	ExpectEq(0, s.CacheHits)
+	ExpectEq(0, s.BytesFetched)
+	ExpectEq(0, s.LastGenerationValidated)
+	ExpectEq("", s.LastError)
+	ExpectTrue(s.LastErrorTime.IsZero())
+}
+
+func (t *FileTest) Stats_Reads() {
+	// Read several times. Only the first should need to fetch the contents.
+	data := make([]byte, 4)
+	for i := 0; i < 3; i++ {
+		_, err := t.in.Read(t.ctx, data, 0)
+		AssertEq(nil, err)
+	}
+
+	s := t.in.Stats()
+	ExpectEq(3, s.Reads)
+	ExpectEq(2, s.CacheHits)
+	ExpectEq(len(t.initialContents), s.BytesFetched)
+}
+
+func (t *FileTest) Stats_SparseExtents() {
+	if t.backingObj.Metadata == nil {
+		t.backingObj.Metadata = make(map[string]string)
+	}
+
+	t.backingObj.Metadata[gcsx.SparseExtentsMetadataKey] = "1+2"
+	t.createInode()
+
+	data := make([]byte, 4)
+	_, err := t.in.Read(t.ctx, data, 0)
+	AssertEq(nil, err)
+
+	// The hole wasn't fetched.
+	ExpectEq(2, t.in.Stats().BytesFetched)
+}
+
+func (t *FileTest) Stats_DirectReads() {
+	t.in.RecordDirectRead(3, nil)
+	t.in.RecordDirectRead(1, io.EOF)
+
+	s := t.in.Stats()
+	ExpectEq(2, s.Reads)
+	ExpectEq(0, s.CacheHits)
+	ExpectEq(4, s.BytesFetched)
+	ExpectEq("", s.LastError)
+
+	// A failed read records its error.
+	t.in.RecordDirectRead(0, errors.New("taco"))
+
+	s = t.in.Stats()
+	ExpectEq(3, s.Reads)
+	ExpectEq("taco", s.LastError)
+	ExpectTrue(s.LastErrorTime.Equal(t.clock.Now()), "%v", s.LastErrorTime)
+}
+
+func (t *FileTest) Stats_GenerationValidated() {
+	var err error
+
+	// Fetching attributes confirms the source generation with GCS.
+	_, err = t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(t.backingObj.Generation, t.in.Stats().LastGenerationValidated)
+
+	// So does syncing a new generation.
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	gen := t.in.SourceGeneration().Object
+	ExpectNe(t.backingObj.Generation, gen)
+	ExpectEq(gen, t.in.Stats().LastGenerationValidated)
+}
+
+func (t *FileTest) Stats_LastError() {
+	// Delete the backing object, so that fetching its contents fails.
+	err := t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: t.in.Name()})
+
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(time.Second)
+
+	data := make([]byte, 4)
+	_, err = t.in.Read(t.ctx, data, 0)
+	AssertNe(nil, err)
+
+	s := t.in.Stats()
+	ExpectEq(1, s.Reads)
+	ExpectEq(0, s.CacheHits)
+	ExpectEq(0, s.BytesFetched)
+	ExpectNe("", s.LastError)
+	ExpectTrue(s.LastErrorTime.Equal(t.clock.Now()), "%v", s.LastErrorTime)
+}
+
+func (t *FileTest) UpdateMetadata() {
+	var err error
+
+	// Set a key.
+	v := "burrito"
+	err = t.in.UpdateMetadata(t.ctx, map[string]*string{"taco": &v})
+	AssertEq(nil, err)
+	ExpectEq("burrito", t.in.Source().Metadata["taco"])
+
+	statReq := &gcs.StatObjectRequest{Name: t.in.Name()}
+	o, err := t.bucket.StatObject(t.ctx, statReq)
+	AssertEq(nil, err)
+	ExpectEq("burrito", o.Metadata["taco"])
+	ExpectEq(o.MetaGeneration, t.in.SourceGeneration().Metadata)
+
+	// Delete it.
+	err = t.in.UpdateMetadata(t.ctx, map[string]*string{"taco": nil})
+	AssertEq(nil, err)
+
+	o, err = t.bucket.StatObject(t.ctx, statReq)
+	AssertEq(nil, err)
+	_, ok := o.Metadata["taco"]
+	ExpectFalse(ok)
+}
+
+func (t *FileTest) UpdateMetadata_Clobbered() {
+	var err error
+
+	// Clobber the backing object.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, t.in.Name(), []byte("burrito"))
+	AssertEq(nil, err)
+
+	// The update should be silently dropped.
+	v := "burrito"
+	err = t.in.UpdateMetadata(t.ctx, map[string]*string{"taco": &v})
+	AssertEq(nil, err)
+
+	statReq := &gcs.StatObjectRequest{Name: t.in.Name()}
+	o, err := t.bucket.StatObject(t.ctx, statReq)
+	AssertEq(nil, err)
+	_, ok := o.Metadata["taco"]
+	ExpectFalse(ok)
+}
+
+func (t *FileTest) UpdateMetadataThenWriteAndSync() {
+	var err error
+
+	// Set a key, then dirty the contents and sync them.
+	v := "burrito"
+	err = t.in.UpdateMetadata(t.ctx, map[string]*string{"taco": &v})
+	AssertEq(nil, err)
+
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	// The key should have been carried over to the new generation.
+	statReq := &gcs.StatObjectRequest{Name: t.in.Name()}
+	o, err := t.bucket.StatObject(t.ctx, statReq)
+	AssertEq(nil, err)
+	ExpectNe(t.backingObj.Generation, o.Generation)
+	ExpectEq("burrito", o.Metadata["taco"])
+}
+
 func (t *FileTest) SetMtime_ContentNotFaultedIn() {
 	var err error
 	var attrs fuseops.InodeAttributes
@@ -675,3 +1100,570 @@ func (t *FileTest) SetMtime_SourceObjectMetaGenerationChanged() {
 	ExpectEq(newObj.Generation, o.Generation)
 	ExpectEq(newObj.MetaGeneration, o.MetaGeneration)
 }
+
+func (t *FileTest) CopyFrom() {
+	var err error
+
+	src, err := gcsutil.CreateObject(t.ctx, t.bucket, "src", []byte("burrito"))
+	AssertEq(nil, err)
+
+	// Dirty the content, which the copy should replace.
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	err = t.in.CopyFrom(t.ctx, src)
+	AssertEq(nil, err)
+
+	ExpectTrue(t.in.SourceGenerationIsAuthoritative())
+	ExpectTrue(t.in.CopiedFrom(src))
+	ExpectEq(len("burrito"), t.in.Source().Size)
+
+	// Check the bucket.
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+
+	// Writing to the file makes it no longer a copy.
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+	ExpectFalse(t.in.CopiedFrom(src))
+}
+
+func (t *FileTest) CopyFrom_Clobbered() {
+	var err error
+
+	src, err := gcsutil.CreateObject(t.ctx, t.bucket, "src", []byte("burrito"))
+	AssertEq(nil, err)
+
+	// Clobber the backing object.
+	newObj, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		t.in.Name(),
+		[]byte("enchilada"))
+
+	AssertEq(nil, err)
+
+	// The copy should fail, leaving the bucket alone.
+	err = t.in.CopyFrom(t.ctx, src)
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+	ExpectFalse(t.in.CopiedFrom(src))
+
+	statReq := &gcs.StatObjectRequest{Name: t.in.Name()}
+	o, err := t.bucket.StatObject(t.ctx, statReq)
+
+	AssertEq(nil, err)
+	ExpectEq(newObj.Generation, o.Generation)
+}
+
+func (t *FileTest) CopyFrom_SourceChanged() {
+	var err error
+
+	src, err := gcsutil.CreateObject(t.ctx, t.bucket, "src", []byte("burrito"))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "src", []byte("enchilada"))
+	AssertEq(nil, err)
+
+	err = t.in.CopyFrom(t.ctx, src)
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration().Object)
+}
+
+func (t *FileTest) createGzipObject(contents string) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write([]byte(contents))
+	AssertEq(nil, err)
+	AssertEq(nil, w.Close())
+
+	t.backingObj, err = t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:            fileInodeName,
+			ContentEncoding: "gzip",
+			Contents:        &buf,
+		})
+
+	AssertEq(nil, err)
+	t.createInode()
+}
+
+func (t *FileTest) Gzip_Raw() {
+	t.createGzipObject("taco burrito")
+
+	// Attributes
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(t.backingObj.Size, attrs.Size)
+
+	// Reads can go straight to GCS.
+	ExpectTrue(t.in.SourceGenerationIsAuthoritative())
+
+	// Local contents hold the stored bytes.
+	buf := make([]byte, 1024)
+	n, err := t.in.Read(t.ctx, buf, 0)
+	AssertEq(io.EOF, err)
+	ExpectEq(t.backingObj.Size, n)
+	ExpectEq(0x1f, buf[0])
+	ExpectEq(0x8b, buf[1])
+}
+
+func (t *FileTest) Gzip_Raw_SyncPreservesEncoding() {
+	t.createGzipObject("taco burrito")
+
+	err := t.in.Truncate(t.ctx, 2)
+	AssertEq(nil, err)
+
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: t.in.Name()})
+
+	AssertEq(nil, err)
+	ExpectEq("gzip", o.ContentEncoding)
+	ExpectEq(2, o.Size)
+}
+
+func (t *FileTest) Gzip_Decompress_Attributes() {
+	t.decompressGzip = true
+	t.createGzipObject("taco burrito")
+
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(len("taco burrito"), attrs.Size)
+
+	// The size shouldn't change once the contents are local.
+	buf := make([]byte, 4)
+	_, err = t.in.Read(t.ctx, buf, 0)
+	AssertEq(nil, err)
+
+	attrs, err = t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(len("taco burrito"), attrs.Size)
+}
+
+func (t *FileTest) Gzip_Decompress_Read() {
+	t.decompressGzip = true
+	t.createGzipObject("taco burrito")
+
+	// Reads can't be served from the compressed bytes in GCS.
+	ExpectFalse(t.in.SourceGenerationIsAuthoritative())
+
+	buf := make([]byte, 1024)
+	n, err := t.in.Read(t.ctx, buf, 5)
+	AssertEq(io.EOF, err)
+	ExpectEq("burrito", string(buf[:n]))
+
+	// The download should be counted by its compressed size.
+	ExpectEq(t.backingObj.Size, t.in.Stats().BytesFetched)
+}
+
+func (t *FileTest) Gzip_Decompress_NotReallyGzip() {
+	t.decompressGzip = true
+
+	var err error
+	t.backingObj, err = t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:            fileInodeName,
+			ContentEncoding: "gzip",
+			Contents:        bytes.NewReader([]byte("taco")),
+		})
+
+	AssertEq(nil, err)
+	t.createInode()
+
+	// Stat succeeds, reporting the stored size.
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(4, attrs.Size)
+
+	// But reads fail.
+	buf := make([]byte, 1024)
+	_, err = t.in.Read(t.ctx, buf, 0)
+	ExpectNe(nil, err)
+}
+
+func (t *FileTest) Gzip_Decompress_WriteAndSync() {
+	t.decompressGzip = true
+	t.createGzipObject("taco burrito")
+
+	err := t.in.Write(t.ctx, []byte("enchilada"), 5)
+	AssertEq(nil, err)
+
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	// The new object holds the contents uncompressed.
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: t.in.Name()})
+
+	AssertEq(nil, err)
+	ExpectEq("", o.ContentEncoding)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("taco enchilada", string(contents))
+
+	// And the inode is no longer treated as compressed.
+	ExpectTrue(t.in.SourceGenerationIsAuthoritative())
+
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(len("taco enchilada"), attrs.Size)
+}
+
+func (t *FileTest) AppendWrites_DoesntFetchContents() {
+	t.appendWrites = true
+	t.createInode()
+
+	// Append some data.
+	err := t.in.Write(t.ctx, []byte("burrito"), int64(len("taco")))
+	AssertEq(nil, err)
+
+	ExpectEq(0, t.in.Stats().BytesFetched)
+
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(len("tacoburrito"), attrs.Size)
+
+	// Reading the lot fetches only the source object's contents.
+	buf := make([]byte, 1024)
+	n, err := t.in.Read(t.ctx, buf, 2)
+
+	ExpectThat(err, AnyOf(nil, io.EOF))
+	ExpectEq("coburrito", string(buf[:n]))
+	ExpectEq(len("co"), t.in.Stats().BytesFetched)
+
+	// Sync.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", string(contents))
+	ExpectEq(len("co"), t.in.Stats().BytesFetched)
+}
+
+func (t *FileTest) AppendWrites_RewritesEndOfSource() {
+	t.appendWrites = true
+	t.createInode()
+
+	// Rewrite the end of the object unchanged, as the kernel's writeback cache
+	// does with a page.
+	err := t.in.Write(t.ctx, []byte("coburrito"), int64(len("ta")))
+	AssertEq(nil, err)
+
+	// Only the overlap should have been fetched, to compare.
+	ExpectEq(len("co"), t.in.Stats().BytesFetched)
+
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", string(contents))
+}
+
+func (t *FileTest) AppendWrites_OverwritesSource() {
+	t.appendWrites = true
+	t.createInode()
+
+	err := t.in.Write(t.ctx, []byte("burrito"), int64(len("taco")))
+	AssertEq(nil, err)
+
+	// Overwriting the source object's contents needs all of them.
+	err = t.in.Write(t.ctx, []byte("X"), 1)
+	AssertEq(nil, err)
+
+	ExpectEq(len("taco"), t.in.Stats().BytesFetched)
+
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("tXcoburrito", string(contents))
+}
+
+func (t *FileTest) AppendWrites_TruncateIntoSource() {
+	t.appendWrites = true
+	t.createInode()
+
+	err := t.in.Write(t.ctx, []byte("burrito"), int64(len("taco")))
+	AssertEq(nil, err)
+
+	// Truncating within what was appended doesn't need the source object.
+	err = t.in.Truncate(t.ctx, int64(len("tacobu")))
+	AssertEq(nil, err)
+	ExpectEq(0, t.in.Stats().BytesFetched)
+
+	// Truncating into it does.
+	err = t.in.Truncate(t.ctx, int64(len("ta")))
+	AssertEq(nil, err)
+
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("ta", string(contents))
+}
+
+func (t *FileTest) Sync_ClobberedWithOverwrite() {
+	var err error
+
+	t.conflictPolicy = inode.WriteConflictOverwrite
+	t.createInode()
+
+	err = t.in.Truncate(t.ctx, 2)
+	AssertEq(nil, err)
+
+	newObj, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		t.in.Name(),
+		[]byte("burrito"))
+
+	AssertEq(nil, err)
+
+	// Sync. Our contents should replace the new generation.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: t.in.Name()})
+
+	AssertEq(nil, err)
+	ExpectGt(o.Generation, newObj.Generation)
+	ExpectEq(o.Generation, t.in.SourceGeneration().Object)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("ta", string(contents))
+}
+
+func (t *FileTest) Sync_DeletedWithOverwrite() {
+	var err error
+
+	t.conflictPolicy = inode.WriteConflictOverwrite
+	t.createInode()
+
+	err = t.in.Truncate(t.ctx, 2)
+	AssertEq(nil, err)
+
+	err = t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: t.in.Name()})
+
+	AssertEq(nil, err)
+
+	// The file has been unlinked, so nothing should be written.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration().Object)
+
+	_, err = t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: t.in.Name()})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *FileTest) Sync_ClobberedByNewerWithNewestWins() {
+	var err error
+
+	t.conflictPolicy = inode.WriteConflictNewestWins
+	t.createInode()
+
+	err = t.in.Truncate(t.ctx, 2)
+	AssertEq(nil, err)
+
+	// Someone else writes later than we did.
+	t.clock.AdvanceTime(time.Second)
+	newObj, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		t.in.Name(),
+		[]byte("burrito"))
+
+	AssertEq(nil, err)
+
+	// Their generation should be left alone.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration().Object)
+
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: t.in.Name()})
+
+	AssertEq(nil, err)
+	ExpectEq(newObj.Generation, o.Generation)
+}
+
+func (t *FileTest) Sync_ClobberedByOlderWithNewestWins() {
+	var err error
+
+	t.conflictPolicy = inode.WriteConflictNewestWins
+	t.createInode()
+
+	err = t.in.Truncate(t.ctx, 2)
+	AssertEq(nil, err)
+
+	// Someone else writes a file modified before we modified ours.
+	mtime := t.clock.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)
+	newObj, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     t.in.Name(),
+			Contents: strings.NewReader("burrito"),
+			Metadata: map[string]string{
+				inode.FileMtimeMetadataKey: mtime,
+			},
+		})
+
+	AssertEq(nil, err)
+
+	// Our contents should replace theirs.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: t.in.Name()})
+
+	AssertEq(nil, err)
+	ExpectGt(o.Generation, newObj.Generation)
+	ExpectEq(o.Generation, t.in.SourceGeneration().Object)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("ta", string(contents))
+}
+
+func (t *FileTest) Sync_AppendingAfterClobbered() {
+	var err error
+	t.in.AddWriter(true)
+
+	// Append some data.
+	err = t.in.Write(t.ctx, []byte("burrito"), int64(len("taco")))
+	AssertEq(nil, err)
+
+	// Meanwhile, someone else appends too.
+	_, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		t.in.Name(),
+		[]byte("taco enchilada"))
+
+	AssertEq(nil, err)
+
+	// Sync. Our data should be appended to theirs.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("taco enchiladaburrito", string(contents))
+
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: t.in.Name()})
+
+	AssertEq(nil, err)
+	ExpectEq(o.Generation, t.in.SourceGeneration().Object)
+
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(len("taco enchiladaburrito"), attrs.Size)
+	ExpectEq(1, attrs.Nlink)
+}
+
+func (t *FileTest) Sync_AppendingAfterClobbered_AppendWrites() {
+	var err error
+	t.appendWrites = true
+	t.createInode()
+	t.in.AddWriter(true)
+
+	err = t.in.Write(t.ctx, []byte("burrito"), int64(len("taco")))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		t.in.Name(),
+		[]byte("taco enchilada"))
+
+	AssertEq(nil, err)
+
+	// Neither generation's contents should need to be fetched.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(0, t.in.Stats().BytesFetched)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("taco enchiladaburrito", string(contents))
+}
+
+func (t *FileTest) Sync_AppendingAfterDeleted() {
+	var err error
+	t.in.AddWriter(true)
+
+	err = t.in.Write(t.ctx, []byte("burrito"), int64(len("taco")))
+	AssertEq(nil, err)
+
+	err = t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: t.in.Name()})
+
+	AssertEq(nil, err)
+
+	// As for any other clobbering, the call succeeds without writing anything.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration().Object)
+
+	_, err = t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: t.in.Name()})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *FileTest) Sync_PositionedWriteAfterClobbered() {
+	var err error
+
+	// Another writer without O_APPEND is open.
+	t.in.AddWriter(true)
+	t.in.AddWriter(false)
+
+	err = t.in.Write(t.ctx, []byte("burrito"), int64(len("taco")))
+	AssertEq(nil, err)
+
+	newObj, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		t.in.Name(),
+		[]byte("taco enchilada"))
+
+	AssertEq(nil, err)
+
+	// The write can't be moved, so nothing should change.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration().Object)
+
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: t.in.Name()})
+
+	AssertEq(nil, err)
+	ExpectEq(newObj.Generation, o.Generation)
+}
@@ -0,0 +1,109 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inode
+
+import (
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// A suffix that marks a file system name as standing for an object name
+// component that can't be used as a name as it is. (Unambiguous because U+000D
+// is not allowed in GCS object names.)
+const EscapedNameSuffix = "\r"
+
+// What a NUL byte in an object name component becomes in an escaped name.
+const escapedNUL = "\r0"
+
+// EscapeName returns the file system name for the supplied component of an
+// object name, i.e. a part between slashes. Most components are used as they
+// are, but some can't be: the empty component (as in "foo//bar" or "/foo"),
+// "." and "..", which have their own meanings in paths, and components
+// containing NUL bytes. Those are suffixed with EscapedNameSuffix, with each
+// NUL replaced.
+func EscapeName(component string) string {
+	switch {
+	case component == "" || component == "." || component == "..":
+	case strings.Contains(component, "\x00"):
+	default:
+		return component
+	}
+
+	return strings.Replace(component, "\x00", escapedNUL, -1) + EscapedNameSuffix
+}
+
+// UnescapeName returns the object name component for the supplied file system
+// name, reversing EscapeName. A name that EscapeName never returns, such as
+// "foo\r", is returned as it is, so that it matches no object.
+func UnescapeName(name string) string {
+	if !strings.HasSuffix(name, EscapedNameSuffix) {
+		return name
+	}
+
+	component := strings.Replace(
+		strings.TrimSuffix(name, EscapedNameSuffix),
+		escapedNUL,
+		"\x00",
+		-1)
+
+	if EscapeName(component) != name {
+		return name
+	}
+
+	return component
+}
+
+// A Unicode normalization applied to file system names, for clients that
+// expect names in a particular form. Object names may be in any form, so a
+// name may stand for an object whose name is in another.
+type Normalization int
+
+const (
+	NormalizeOff Normalization = iota
+	NormalizeNFC
+	NormalizeNFD
+)
+
+// Apply returns the supplied name in the normalization form.
+func (n Normalization) Apply(name string) string {
+	switch n {
+	case NormalizeNFC:
+		return norm.NFC.String(name)
+
+	case NormalizeNFD:
+		return norm.NFD.String(name)
+	}
+
+	return name
+}
+
+// Return the object name components that the supplied one may stand for,
+// most likely first: itself, then its other forms if normalizing.
+func (n Normalization) candidates(component string) (cs []string) {
+	cs = append(cs, component)
+	if n == NormalizeOff {
+		return
+	}
+
+	for _, f := range []norm.Form{norm.NFC, norm.NFD} {
+		c := f.String(component)
+		if c != cs[0] && (len(cs) == 1 || c != cs[1]) {
+			cs = append(cs, c)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inode_test
+
+import (
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestNames(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type NamesTest struct {
+}
+
+func init() { RegisterTestSuite(&NamesTest{}) }
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *NamesTest) OrdinaryNames() {
+	for _, c := range []string{"foo", ".foo", "...", "foo.", "taco\tburrito"} {
+		ExpectEq(c, inode.EscapeName(c))
+		ExpectEq(c, inode.UnescapeName(c))
+	}
+}
+
+func (t *NamesTest) UnrepresentableNames() {
+	testCases := []struct {
+		component string
+		escaped   string
+	}{
+		{"", "\r"},
+		{".", ".\r"},
+		{"..", "..\r"},
+		{"foo\x00bar", "foo\r0bar\r"},
+		{"\x00", "\r0\r"},
+	}
+
+	for _, tc := range testCases {
+		ExpectEq(tc.escaped, inode.EscapeName(tc.component), "%q", tc.component)
+		ExpectEq(tc.component, inode.UnescapeName(tc.escaped), "%q", tc.escaped)
+	}
+}
+
+func (t *NamesTest) NamesNeverEscaped() {
+	// These aren't what EscapeName returns for any component, so they stand for
+	// no object.
+	for _, name := range []string{"foo\r", "\r0", "foo\r1\r", "a\rb"} {
+		ExpectEq(name, inode.UnescapeName(name), "%q", name)
+	}
+}
+
+func (t *NamesTest) Normalization() {
+	const nfc = "caf\u00e9"
+	const nfd = "cafe\u0301"
+
+	ExpectEq(nfc, inode.NormalizeOff.Apply(nfc))
+	ExpectEq(nfd, inode.NormalizeOff.Apply(nfd))
+
+	ExpectEq(nfc, inode.NormalizeNFC.Apply(nfc))
+	ExpectEq(nfc, inode.NormalizeNFC.Apply(nfd))
+
+	ExpectEq(nfd, inode.NormalizeNFD.Apply(nfc))
+	ExpectEq(nfd, inode.NormalizeNFD.Apply(nfd))
+
+	ExpectEq("foo", inode.NormalizeNFD.Apply("foo"))
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inode
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Custom metadata keys in which the permission bits (in octal) and owner set
+// with chmod(2) and chown(2) may be recorded, so that they survive remounting
+// and are shared between mounts of the same bucket.
+const (
+	ModeMetadataKey = "gcsfuse_mode"
+	UidMetadataKey  = "gcsfuse_uid"
+	GidMetadataKey  = "gcsfuse_gid"
+)
+
+// ApplyPermissions overrides the permission bits and owner in attrs with those
+// recorded in the supplied custom metadata, if any. Malformed values are
+// ignored.
+func ApplyPermissions(
+	attrs *fuseops.InodeAttributes,
+	metadata map[string]string) {
+	if v, ok := metadata[ModeMetadataKey]; ok {
+		perm, err := strconv.ParseUint(v, 8, 32)
+		if err == nil && os.FileMode(perm)&^os.ModePerm == 0 {
+			attrs.Mode = attrs.Mode&^os.ModePerm | os.FileMode(perm)
+		}
+	}
+
+	if v, ok := metadata[UidMetadataKey]; ok {
+		uid, err := strconv.ParseUint(v, 10, 32)
+		if err == nil {
+			attrs.Uid = uint32(uid)
+		}
+	}
+
+	if v, ok := metadata[GidMetadataKey]; ok {
+		gid, err := strconv.ParseUint(v, 10, 32)
+		if err == nil {
+			attrs.Gid = uint32(gid)
+		}
+	}
+}
+
+// PermissionsMetadata returns custom metadata updates recording the supplied
+// permission bits and owner, suitable for gcs.UpdateObjectRequest. Nil
+// arguments are left out.
+func PermissionsMetadata(
+	mode *os.FileMode,
+	uid *uint32,
+	gid *uint32) (m map[string]*string) {
+	m = make(map[string]*string)
+
+	if mode != nil {
+		v := strconv.FormatUint(uint64(mode.Perm()), 8)
+		m[ModeMetadataKey] = &v
+	}
+
+	if uid != nil {
+		v := strconv.FormatUint(uint64(*uid), 10)
+		m[UidMetadataKey] = &v
+	}
+
+	if gid != nil {
+		v := strconv.FormatUint(uint64(*gid), 10)
+		m[GidMetadataKey] = &v
+	}
+
+	return
+}
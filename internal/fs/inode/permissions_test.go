@@ -0,0 +1,192 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inode_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestPermissions(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type PermissionsTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	attrs  fuseops.InodeAttributes
+}
+
+var _ SetUpInterface = &PermissionsTest{}
+
+func init() { RegisterTestSuite(&PermissionsTest{}) }
+
+func (t *PermissionsTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	t.attrs = fuseops.InodeAttributes{
+		Uid:  uid,
+		Gid:  gid,
+		Mode: 0755 | os.ModeDir,
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *PermissionsTest) ApplyPermissions_NoMetadata() {
+	attrs := t.attrs
+	inode.ApplyPermissions(&attrs, nil)
+	ExpectTrue(attrs == t.attrs, "%v", attrs)
+}
+
+func (t *PermissionsTest) ApplyPermissions_AllRecorded() {
+	attrs := t.attrs
+	inode.ApplyPermissions(
+		&attrs,
+		map[string]string{
+			inode.ModeMetadataKey: "700",
+			inode.UidMetadataKey:  "1001",
+			inode.GidMetadataKey:  "1002",
+		})
+
+	// The type bits are preserved.
+	ExpectEq(0700|os.ModeDir, attrs.Mode)
+	ExpectEq(1001, attrs.Uid)
+	ExpectEq(1002, attrs.Gid)
+}
+
+func (t *PermissionsTest) ApplyPermissions_MalformedMode() {
+	values := []string{
+		"",
+		"taco",
+		"999",
+		"17777",
+		"-1",
+	}
+
+	for _, v := range values {
+		attrs := t.attrs
+		inode.ApplyPermissions(&attrs, map[string]string{inode.ModeMetadataKey: v})
+		ExpectTrue(attrs == t.attrs, "%q: %v", v, attrs)
+	}
+}
+
+func (t *PermissionsTest) ApplyPermissions_MalformedOwner() {
+	values := []string{
+		"",
+		"taco",
+		"-1",
+		"4294967296",
+	}
+
+	for _, v := range values {
+		attrs := t.attrs
+		inode.ApplyPermissions(
+			&attrs,
+			map[string]string{
+				inode.UidMetadataKey: v,
+				inode.GidMetadataKey: v,
+			})
+
+		ExpectTrue(attrs == t.attrs, "%q: %v", v, attrs)
+	}
+}
+
+func (t *PermissionsTest) PermissionsMetadata() {
+	mode := os.FileMode(0640)
+	uid := uint32(1001)
+	gid := uint32(0)
+
+	m := inode.PermissionsMetadata(&mode, &uid, &gid)
+	AssertEq(3, len(m))
+	ExpectThat(m[inode.ModeMetadataKey], Pointee(Equals("640")))
+	ExpectThat(m[inode.UidMetadataKey], Pointee(Equals("1001")))
+	ExpectThat(m[inode.GidMetadataKey], Pointee(Equals("0")))
+
+	// Only what's supplied is included.
+	m = inode.PermissionsMetadata(&mode, nil, nil)
+	AssertEq(1, len(m))
+	ExpectThat(m[inode.ModeMetadataKey], Pointee(Equals("640")))
+}
+
+func (t *PermissionsTest) RoundTrip() {
+	mode := os.ModeSetuid | 0751
+
+	m := inode.PermissionsMetadata(&mode, nil, nil)
+	metadata := map[string]string{
+		inode.ModeMetadataKey: *m[inode.ModeMetadataKey],
+	}
+
+	attrs := t.attrs
+	inode.ApplyPermissions(&attrs, metadata)
+	ExpectEq(0751|os.ModeDir, attrs.Mode)
+}
+
+func (t *PermissionsTest) ExplicitDirUpdateMetadata() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "dir/", []byte{})
+	AssertEq(nil, err)
+
+	d := inode.NewExplicitDirInode(
+		dirInodeID,
+		o,
+		t.attrs,
+		false, // implicitDirs
+		inode.ConflictingFileNameSuffix,
+		inode.NormalizeOff,
+		false, // countSubdirs
+		0,     // typeCacheTTL
+		0,     // lookupBurst
+		t.bucket,
+		&t.clock,
+		&t.clock)
+
+	d.Lock()
+	defer d.Unlock()
+
+	mode := os.FileMode(0700)
+	err = d.UpdateMetadata(t.ctx, inode.PermissionsMetadata(&mode, nil, nil))
+	AssertEq(nil, err)
+
+	// The inode's record, and its generation, should reflect the update.
+	ExpectEq("700", d.Source().Metadata[inode.ModeMetadataKey])
+	ExpectEq(o.Generation, d.SourceGeneration().Object)
+	ExpectLt(o.MetaGeneration, d.SourceGeneration().Metadata)
+
+	// As should the object.
+	statReq := &gcs.StatObjectRequest{Name: "dir/"}
+	newObj, err := t.bucket.StatObject(t.ctx, statReq)
+	AssertEq(nil, err)
+	ExpectEq("700", newObj.Metadata[inode.ModeMetadataKey])
+	ExpectEq(newObj.MetaGeneration, d.SourceGeneration().Metadata)
+}
@@ -17,6 +17,7 @@ package inode
 import (
 	"time"
 
+	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/util/lrucache"
 )
 
@@ -35,12 +36,14 @@ type typeCache struct {
 	// Constant data
 	/////////////////////////
 
-	ttl time.Duration
+	perTypeCapacity int
 
 	/////////////////////////
 	// Mutable state
 	/////////////////////////
 
+	ttl time.Duration
+
 	// A cache mapping file names to the time at which the entry should expire.
 	//
 	// INVARIANT: files.CheckInvariants() does not panic
@@ -53,6 +56,51 @@ type typeCache struct {
 	// INVARIANT: dirs.CheckInvariants() does not panic
 	// INVARIANT: Each value is of type time.Time
 	dirs lrucache.Cache
+
+	// A cache mapping file names to the object record seen for them in the
+	// latest listing, which is valid for as long as the name's entry in files.
+	//
+	// INVARIANT: listed.CheckInvariants() does not panic
+	// INVARIANT: Each value is of type *gcs.Object
+	listed lrucache.Cache
+
+	// The same for directory names, valid for as long as the name's entry in
+	// dirs.
+	//
+	// INVARIANT: listedDirs.CheckInvariants() does not panic
+	// INVARIANT: Each value is of type listedDir
+	listedDirs lrucache.Cache
+
+	// Pages of the latest listing of the directory, by the continuation token at
+	// which each starts. All are forgotten whenever any name is erased, since
+	// any page may mention it.
+	listings map[string]cachedListingPage
+}
+
+// A page of a directory's listing, as ReadEntries found it.
+type listingPage struct {
+	// The objects for files and symlinks, and the names of child directories
+	// that exist according to the implicit directory settings.
+	objects  []*gcs.Object
+	dirNames []string
+
+	// The continuation token for the next page, or empty at the end.
+	newTok string
+
+	// The time just before the bucket was listed.
+	time time.Time
+}
+
+type cachedListingPage struct {
+	page       listingPage
+	expiration time.Time
+}
+
+// What a listing told us about a child directory.
+type listedDir struct {
+	// The directory's placeholder object, or nil if the listing showed only
+	// that the directory is implicitly defined by objects within it.
+	placeholder *gcs.Object
 }
 
 // Create a cache whose information expires with the supplied TTL. If the TTL
@@ -61,9 +109,13 @@ func newTypeCache(
 	perTypeCapacity int,
 	ttl time.Duration) (tc typeCache) {
 	tc = typeCache{
-		ttl:   ttl,
-		files: lrucache.New(perTypeCapacity),
-		dirs:  lrucache.New(perTypeCapacity),
+		perTypeCapacity: perTypeCapacity,
+		ttl:             ttl,
+		files:           lrucache.New(perTypeCapacity),
+		dirs:            lrucache.New(perTypeCapacity),
+		listed:          lrucache.New(perTypeCapacity),
+		listedDirs:      lrucache.New(perTypeCapacity),
+		listings:        make(map[string]cachedListingPage),
 	}
 
 	return
@@ -81,6 +133,24 @@ func (tc *typeCache) CheckInvariants() {
 
 	// INVARIANT: dirs.CheckInvariants() does not panic
 	tc.dirs.CheckInvariants()
+
+	// INVARIANT: listed.CheckInvariants() does not panic
+	tc.listed.CheckInvariants()
+
+	// INVARIANT: listedDirs.CheckInvariants() does not panic
+	tc.listedDirs.CheckInvariants()
+}
+
+// Change the TTL for information recorded from now on. Information recorded
+// under the old TTL is forgotten, so that shortening the TTL takes effect
+// immediately.
+func (tc *typeCache) SetTTL(ttl time.Duration) {
+	tc.ttl = ttl
+	tc.files = lrucache.New(tc.perTypeCapacity)
+	tc.dirs = lrucache.New(tc.perTypeCapacity)
+	tc.listed = lrucache.New(tc.perTypeCapacity)
+	tc.listedDirs = lrucache.New(tc.perTypeCapacity)
+	tc.EraseListings()
 }
 
 // Record that the supplied name is a file. It may still also be a directory.
@@ -91,6 +161,36 @@ func (tc *typeCache) NoteFile(now time.Time, name string) {
 	}
 
 	tc.files.Insert(name, now.Add(tc.ttl))
+	tc.listed.Erase(name)
+}
+
+// Record that the supplied name is a file backed by the given object, as seen
+// in a listing. The record may be returned once by TakeListedObject.
+func (tc *typeCache) NoteListedFile(now time.Time, name string, o *gcs.Object) {
+	// Are we disabled?
+	if tc.ttl == 0 {
+		return
+	}
+
+	tc.files.Insert(name, now.Add(tc.ttl))
+	tc.listed.Insert(name, o)
+}
+
+// Return and forget the object record supplied to NoteListedFile for the given
+// name, if we still think the name is a file. Otherwise return nil.
+func (tc *typeCache) TakeListedObject(now time.Time, name string) (o *gcs.Object) {
+	val := tc.listed.LookUp(name)
+	if val == nil {
+		return
+	}
+
+	tc.listed.Erase(name)
+	if !tc.IsFile(now, name) {
+		return
+	}
+
+	o = val.(*gcs.Object)
+	return
 }
 
 // Record that the supplied name is a directory. It may still also be a file.
@@ -101,12 +201,99 @@ func (tc *typeCache) NoteDir(now time.Time, name string) {
 	}
 
 	tc.dirs.Insert(name, now.Add(tc.ttl))
+	tc.listedDirs.Erase(name)
+}
+
+// Record that the supplied name is a directory, as seen in a listing. If the
+// placeholder object is nil, the directory is known only to be implicitly
+// defined. The information may be returned once by TakeListedDir.
+func (tc *typeCache) NoteListedDir(
+	now time.Time,
+	name string,
+	placeholder *gcs.Object) {
+	// Are we disabled?
+	if tc.ttl == 0 {
+		return
+	}
+
+	tc.dirs.Insert(name, now.Add(tc.ttl))
+	tc.listedDirs.Insert(name, listedDir{placeholder})
+}
+
+// Return and forget the information supplied to NoteListedDir for the given
+// name, if we still think the name is a directory. ok is false if there is
+// none.
+func (tc *typeCache) TakeListedDir(
+	now time.Time,
+	name string) (placeholder *gcs.Object, ok bool) {
+	val := tc.listedDirs.LookUp(name)
+	if val == nil {
+		return
+	}
+
+	tc.listedDirs.Erase(name)
+	if !tc.IsDir(now, name) {
+		return
+	}
+
+	placeholder = val.(listedDir).placeholder
+	ok = true
+	return
 }
 
 // Erase all information about the supplied name.
 func (tc *typeCache) Erase(name string) {
 	tc.files.Erase(name)
 	tc.dirs.Erase(name)
+	tc.listed.Erase(name)
+	tc.listedDirs.Erase(name)
+	tc.EraseListings()
+}
+
+// Record the page of the directory's listing starting at the supplied
+// continuation token, forgetting any pages that have expired.
+func (tc *typeCache) NoteListing(now time.Time, tok string, page listingPage) {
+	// Are we disabled?
+	if tc.ttl == 0 {
+		return
+	}
+
+	for t, c := range tc.listings {
+		if now.After(c.expiration) {
+			delete(tc.listings, t)
+		}
+	}
+
+	tc.listings[tok] = cachedListingPage{
+		page:       page,
+		expiration: now.Add(tc.ttl),
+	}
+}
+
+// Return the recorded page of the directory's listing starting at the
+// supplied continuation token, if it hasn't expired.
+func (tc *typeCache) LookUpListing(
+	now time.Time,
+	tok string) (page listingPage, ok bool) {
+	c, ok := tc.listings[tok]
+	if !ok {
+		return
+	}
+
+	if now.After(c.expiration) {
+		delete(tc.listings, tok)
+		ok = false
+		return
+	}
+
+	page = c.page
+	return
+}
+
+// Forget all pages of the directory's listing, e.g. because a child has been
+// created or deleted.
+func (tc *typeCache) EraseListings() {
+	tc.listings = make(map[string]cachedListingPage)
 }
 
 // Do we currently think the given name is a file?
@@ -0,0 +1,573 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/monitor"
+	"github.com/googlecloudplatform/gcsfuse/internal/tracing"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// Wrap the supplied file system so that each op is recorded as the root span
+// of a trace, with GCS requests made while handling the op as its children,
+// and counted in the metrics of package monitor. If activity is non-nil, ops
+// are also reported to it. If slow is non-nil, ops taking longer than its
+// threshold are logged, along with the process that sent them.
+//
+// When monitoring is enabled, ops and the GCS requests made while handling
+// them are also counted by the process that sent them.
+func newInstrumentedFileSystem(
+	wrapped fuseutil.FileSystem,
+	activity *ActivityTracker,
+	slow *slowOpLogger) fuseutil.FileSystem {
+	return &instrumentedFileSystem{
+		wrapped:   wrapped,
+		activity:  activity,
+		slow:      slow,
+		processes: newProcessNamer("/proc"),
+	}
+}
+
+type instrumentedFileSystem struct {
+	wrapped   fuseutil.FileSystem
+	activity  *ActivityTracker
+	slow      *slowOpLogger
+	processes *processNamer
+}
+
+// Logs ops that take longer than a threshold, with the attributes recorded
+// for them, the names of the inodes they concern, and the number of times
+// the GCS requests they made were retried.
+type slowOpLogger struct {
+	threshold time.Duration
+	logger    *log.Logger
+
+	// Used to look up the names of inodes. Needs no lock to be held.
+	inodes *inodeTable
+}
+
+// Attributes whose values are inode IDs, to be logged with inode names.
+var inodeAttributes = map[string]bool{
+	"fuse.inode":      true,
+	"fuse.parent":     true,
+	"fuse.old_parent": true,
+	"fuse.new_parent": true,
+}
+
+type opAttribute struct {
+	key   string
+	value interface{}
+}
+
+// An op in progress. The embedded span is nil if tracing is disabled.
+type opRecord struct {
+	*tracing.Span
+	name     string
+	start    time.Time
+	activity *ActivityTracker
+
+	// The process that sent the op and its command name, set only if the op
+	// came from the kernel and metrics are enabled or slow ops are logged.
+	process     fuseops.OpContext
+	processName string
+
+	// Set only if slow ops are logged.
+	slow    *slowOpLogger
+	attrs   []opAttribute
+	retries *gcs.RetryCounter
+}
+
+func (fs *instrumentedFileSystem) startOp(
+	ctx context.Context,
+	name string) (newCtx context.Context, rec *opRecord) {
+	rec = &opRecord{
+		name:     name,
+		start:    time.Now(),
+		activity: fs.activity,
+		slow:     fs.slow,
+	}
+
+	if rec.activity != nil {
+		rec.activity.startOp()
+	}
+
+	if rec.slow != nil {
+		ctx, rec.retries = gcs.WithRetryCounter(ctx)
+	}
+
+	if monitor.Enabled() || rec.slow != nil {
+		var ok bool
+		if rec.process, ok = fuse.OpContextFromContext(ctx); ok {
+			rec.processName = fs.processes.Name(rec.process.Pid)
+			ctx = monitor.WithProcess(ctx, rec.processName)
+		}
+	}
+
+	newCtx, rec.Span = tracing.StartSpan(
+		ctx,
+		"fuse."+name,
+		tracing.SpanKindServer)
+
+	return
+}
+
+// Set an attribute on the span, and keep it for logging if the op is slow.
+func (rec *opRecord) SetAttribute(key string, value interface{}) {
+	rec.Span.SetAttribute(key, value)
+
+	if rec.slow != nil {
+		rec.attrs = append(rec.attrs, opAttribute{key, value})
+	}
+}
+
+// Describe the attributes of the op, naming the inodes that still exist.
+func (rec *opRecord) describeAttributes() string {
+	var parts []string
+	for _, a := range rec.attrs {
+		s := fmt.Sprintf("%s=%v", strings.TrimPrefix(a.key, "fuse."), a.value)
+		if id, ok := a.value.(uint64); ok && inodeAttributes[a.key] {
+			if in := rec.slow.inodes.Get(fuseops.InodeID(id)); in != nil {
+				s += fmt.Sprintf(" %q", "/"+in.Name())
+			}
+		}
+
+		parts = append(parts, s)
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+func (rec *opRecord) finish(err *error) {
+	rec.EndWithError(err)
+
+	if rec.activity != nil {
+		rec.activity.finishOp()
+	}
+
+	d := time.Since(rec.start)
+	if monitor.Enabled() {
+		monitor.FSOps.Add(rec.name, 1)
+		monitor.FSOpLatency.Record(rec.name, d)
+		if *err != nil {
+			monitor.FSOpErrors.Add(rec.name, 1)
+		}
+
+		if rec.processName != "" {
+			monitor.FSOpsByProcess.Add(rec.processName, 1)
+			monitor.FSOpsByUser.Add(strconv.FormatUint(uint64(rec.process.Uid), 10), 1)
+		}
+	}
+
+	if rec.slow != nil && d > rec.slow.threshold {
+		outcome := "OK"
+		if *err != nil {
+			outcome = (*err).Error()
+		}
+
+		var from string
+		if rec.processName != "" {
+			from = fmt.Sprintf(
+				" from pid %d (%s, uid %d)",
+				rec.process.Pid,
+				rec.processName,
+				rec.process.Uid)
+		}
+
+		rec.slow.logger.Printf(
+			"Slow op: %s(%s)%s took %v with %d GCS retries: %s",
+			rec.name,
+			rec.describeAttributes(),
+			from,
+			d,
+			rec.retries.Count(),
+			outcome)
+	}
+}
+
+func (fs *instrumentedFileSystem) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "StatFS")
+	defer rec.finish(&err)
+
+	err = fs.wrapped.StatFS(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "LookUpInode")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.parent", uint64(op.Parent))
+	rec.SetAttribute("fuse.name", op.Name)
+
+	err = fs.wrapped.LookUpInode(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "GetInodeAttributes")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.inode", uint64(op.Inode))
+
+	err = fs.wrapped.GetInodeAttributes(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "SetInodeAttributes")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.inode", uint64(op.Inode))
+
+	err = fs.wrapped.SetInodeAttributes(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "ForgetInode")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.inode", uint64(op.Inode))
+
+	err = fs.wrapped.ForgetInode(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "MkDir")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.parent", uint64(op.Parent))
+	rec.SetAttribute("fuse.name", op.Name)
+
+	err = fs.wrapped.MkDir(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "MkNode")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.parent", uint64(op.Parent))
+	rec.SetAttribute("fuse.name", op.Name)
+
+	err = fs.wrapped.MkNode(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "CreateFile")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.parent", uint64(op.Parent))
+	rec.SetAttribute("fuse.name", op.Name)
+
+	err = fs.wrapped.CreateFile(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "CreateSymlink")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.parent", uint64(op.Parent))
+	rec.SetAttribute("fuse.name", op.Name)
+
+	err = fs.wrapped.CreateSymlink(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "CreateLink")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.parent", uint64(op.Parent))
+	rec.SetAttribute("fuse.name", op.Name)
+	rec.SetAttribute("fuse.inode", uint64(op.Target))
+
+	err = fs.wrapped.CreateLink(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "Rename")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.old_parent", uint64(op.OldParent))
+	rec.SetAttribute("fuse.old_name", op.OldName)
+	rec.SetAttribute("fuse.new_parent", uint64(op.NewParent))
+	rec.SetAttribute("fuse.new_name", op.NewName)
+
+	err = fs.wrapped.Rename(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "RmDir")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.parent", uint64(op.Parent))
+	rec.SetAttribute("fuse.name", op.Name)
+
+	err = fs.wrapped.RmDir(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "Unlink")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.parent", uint64(op.Parent))
+	rec.SetAttribute("fuse.name", op.Name)
+
+	err = fs.wrapped.Unlink(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "OpenDir")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.inode", uint64(op.Inode))
+
+	err = fs.wrapped.OpenDir(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "ReadDir")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.inode", uint64(op.Inode))
+	rec.SetAttribute("fuse.offset", uint64(op.Offset))
+
+	err = fs.wrapped.ReadDir(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "ReleaseDirHandle")
+	defer rec.finish(&err)
+
+	err = fs.wrapped.ReleaseDirHandle(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "OpenFile")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.inode", uint64(op.Inode))
+
+	err = fs.wrapped.OpenFile(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "ReadFile")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.inode", uint64(op.Inode))
+	rec.SetAttribute("fuse.offset", op.Offset)
+	rec.SetAttribute("fuse.size", len(op.Dst))
+
+	err = fs.wrapped.ReadFile(ctx, op)
+	rec.SetAttribute("fuse.bytes_read", op.BytesRead)
+	return
+}
+
+func (fs *instrumentedFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "WriteFile")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.inode", uint64(op.Inode))
+	rec.SetAttribute("fuse.offset", op.Offset)
+	rec.SetAttribute("fuse.size", len(op.Data))
+
+	err = fs.wrapped.WriteFile(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "SyncFile")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.inode", uint64(op.Inode))
+
+	err = fs.wrapped.SyncFile(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "FlushFile")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.inode", uint64(op.Inode))
+
+	err = fs.wrapped.FlushFile(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "ReleaseFileHandle")
+	defer rec.finish(&err)
+
+	err = fs.wrapped.ReleaseFileHandle(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "CopyFileRange")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.inode", uint64(op.DstInode))
+	rec.SetAttribute("fuse.offset", op.DstOffset)
+	rec.SetAttribute("fuse.size", op.Length)
+
+	err = fs.wrapped.CopyFileRange(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) SeekFile(
+	ctx context.Context,
+	op *fuseops.SeekFileOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "SeekFile")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.inode", uint64(op.Inode))
+	rec.SetAttribute("fuse.offset", op.Offset)
+
+	err = fs.wrapped.SeekFile(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) GetFileLock(
+	ctx context.Context,
+	op *fuseops.GetFileLockOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "GetFileLock")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.inode", uint64(op.Inode))
+
+	err = fs.wrapped.GetFileLock(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) SetFileLock(
+	ctx context.Context,
+	op *fuseops.SetFileLockOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "SetFileLock")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.inode", uint64(op.Inode))
+
+	err = fs.wrapped.SetFileLock(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "ReadSymlink")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.inode", uint64(op.Inode))
+
+	err = fs.wrapped.ReadSymlink(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "RemoveXattr")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.inode", uint64(op.Inode))
+	rec.SetAttribute("fuse.name", op.Name)
+
+	err = fs.wrapped.RemoveXattr(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "GetXattr")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.inode", uint64(op.Inode))
+	rec.SetAttribute("fuse.name", op.Name)
+
+	err = fs.wrapped.GetXattr(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "ListXattr")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.inode", uint64(op.Inode))
+
+	err = fs.wrapped.ListXattr(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) (err error) {
+	ctx, rec := fs.startOp(ctx, "SetXattr")
+	defer rec.finish(&err)
+	rec.SetAttribute("fuse.inode", uint64(op.Inode))
+	rec.SetAttribute("fuse.name", op.Name)
+
+	err = fs.wrapped.SetXattr(ctx, op)
+	return
+}
+
+func (fs *instrumentedFileSystem) Destroy() {
+	fs.wrapped.Destroy()
+}
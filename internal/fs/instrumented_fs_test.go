@@ -0,0 +1,109 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"bytes"
+	"log"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestInstrumentedFileSystem(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const slowOpThreshold = 10 * time.Millisecond
+
+// A file system whose reads take longer than slowOpThreshold and fail.
+type slowFileSystem struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *slowFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	time.Sleep(2 * slowOpThreshold)
+	err = syscall.EIO
+	return
+}
+
+type InstrumentedFileSystemTest struct {
+	ctx    context.Context
+	log    bytes.Buffer
+	inodes *inodeTable
+	fs     fuseutil.FileSystem
+}
+
+var _ SetUpInterface = &InstrumentedFileSystemTest{}
+
+func init() { RegisterTestSuite(&InstrumentedFileSystemTest{}) }
+
+func (t *InstrumentedFileSystemTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.inodes = newInodeTable()
+	t.inodes.Insert(&namedInode{Inode: &idInode{id: 17}, name: "dir/foo"})
+
+	t.fs = newInstrumentedFileSystem(
+		&slowFileSystem{},
+		nil,
+		&slowOpLogger{
+			threshold: slowOpThreshold,
+			logger:    log.New(&t.log, "", 0),
+			inodes:    t.inodes,
+		})
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *InstrumentedFileSystemTest) FastOpsNotLogged() {
+	t.fs.LookUpInode(t.ctx, &fuseops.LookUpInodeOp{Parent: 17, Name: "bar"})
+	ExpectEq("", t.log.String())
+}
+
+func (t *InstrumentedFileSystemTest) SlowOpLogged() {
+	op := &fuseops.ReadFileOp{
+		Inode:  17,
+		Offset: 4096,
+		Dst:    make([]byte, 100),
+	}
+
+	err := t.fs.ReadFile(t.ctx, op)
+	AssertEq(syscall.EIO, err)
+
+	ExpectThat(
+		t.log.String(),
+		MatchesRegexp(
+			`^Slow op: ReadFile\(inode=17 "/dir/foo", offset=4096, size=100, bytes_read=0\) `+
+				`took .+ with 0 GCS retries: input/output error\n$`))
+}
+
+func (t *InstrumentedFileSystemTest) UnknownInodeLoggedByID() {
+	err := t.fs.ReadFile(t.ctx, &fuseops.ReadFileOp{Inode: 19})
+	AssertEq(syscall.EIO, err)
+
+	ExpectThat(t.log.String(), HasSubstr("ReadFile(inode=19, offset=0, size=0, bytes_read=0)"))
+}
@@ -0,0 +1,171 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"log"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The most invalidations that may be waiting to be sent. Beyond this they are
+// dropped, leaving the kernel's caches to expire as usual.
+const maxPendingInvalidations = 1024
+
+// The subset of *fuse.Connection used by an invalidator.
+type kernelNotifier interface {
+	InvalidateInode(id fuseops.InodeID, offset int64, length int64) error
+	InvalidateEntry(parent fuseops.InodeID, name string) error
+}
+
+// An invalidator tells the kernel to forget what it has cached about inodes
+// and directory entries found to be out of date, so that it asks us again
+// rather than waiting for its caches to expire.
+//
+// The kernel may need locks held by ops in progress to act on a notification,
+// including the op that found out, so notifications are queued and sent from
+// a goroutine of their own.
+//
+// Safe for concurrent access.
+type invalidator struct {
+	// Invalidations waiting to be sent.
+	pending chan invalidation
+
+	// Closed by Stop.
+	stop chan struct{}
+
+	mu sync.Mutex
+
+	// The connection to notify, or nil if the file system isn't yet being
+	// served or the kernel doesn't support notifications.
+	//
+	// GUARDED_BY(mu)
+	conn kernelNotifier
+}
+
+// If name is empty, an invalidation of the attributes and contents of inode
+// id. Otherwise an invalidation of the entry for name in directory id.
+type invalidation struct {
+	id   fuseops.InodeID
+	name string
+}
+
+func newInvalidator() (inv *invalidator) {
+	inv = &invalidator{
+		pending: make(chan invalidation, maxPendingInvalidations),
+		stop:    make(chan struct{}),
+	}
+
+	go inv.loop()
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Public interface
+////////////////////////////////////////////////////////////////////////
+
+// SetConn starts sending invalidations to the supplied connection. Until then
+// they are discarded.
+func (inv *invalidator) SetConn(conn kernelNotifier) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	inv.conn = conn
+}
+
+// Inode queues an invalidation of the attributes and cached contents of the
+// given inode.
+func (inv *invalidator) Inode(id fuseops.InodeID) {
+	inv.enqueue(invalidation{id: id})
+}
+
+// Entry queues an invalidation of the entry for the given name within the
+// given directory.
+func (inv *invalidator) Entry(parent fuseops.InodeID, name string) {
+	inv.enqueue(invalidation{id: parent, name: name})
+}
+
+// Stop sending invalidations. Those still queued are discarded.
+func (inv *invalidator) Stop() {
+	close(inv.stop)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func (inv *invalidator) enqueue(i invalidation) {
+	select {
+	case inv.pending <- i:
+	default:
+	}
+}
+
+func (inv *invalidator) loop() {
+	for {
+		select {
+		case <-inv.stop:
+			return
+
+		case i := <-inv.pending:
+			inv.send(i)
+		}
+	}
+}
+
+func (inv *invalidator) send(i invalidation) {
+	inv.mu.Lock()
+	conn := inv.conn
+	inv.mu.Unlock()
+
+	if conn == nil {
+		return
+	}
+
+	var err error
+	if i.name == "" {
+		err = conn.InvalidateInode(i.id, 0, 0)
+	} else {
+		err = conn.InvalidateEntry(i.id, i.name)
+	}
+
+	switch err {
+	case nil:
+
+	// The kernel had nothing cached.
+	case syscall.ENOENT:
+
+	case syscall.ENOSYS:
+		log.Println("The kernel doesn't support invalidation; relying on TTLs.")
+		inv.SetConn(nil)
+
+	default:
+		log.Printf("Invalidating %v %q: %v", i.id, i.name, err)
+	}
+}
+
+// A fuse.Server that hands the connection it serves to an invalidator.
+type invalidatingServer struct {
+	fuse.Server
+	inv *invalidator
+}
+
+func (s *invalidatingServer) ServeOps(c *fuse.Connection) {
+	s.inv.SetConn(c)
+	s.Server.ServeOps(c)
+}
@@ -0,0 +1,104 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestInvalidator(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A kernelNotifier that describes each notification on a channel, failing
+// them all with err.
+type fakeNotifier struct {
+	sent chan string
+	err  error
+}
+
+func (n *fakeNotifier) InvalidateInode(
+	id fuseops.InodeID,
+	offset int64,
+	length int64) error {
+	n.sent <- fmt.Sprintf("inode %d", id)
+	return n.err
+}
+
+func (n *fakeNotifier) InvalidateEntry(
+	parent fuseops.InodeID,
+	name string) error {
+	n.sent <- fmt.Sprintf("entry %d %s", parent, name)
+	return n.err
+}
+
+type InvalidatorTest struct {
+	notifier fakeNotifier
+	inv      *invalidator
+}
+
+var _ SetUpInterface = &InvalidatorTest{}
+var _ TearDownInterface = &InvalidatorTest{}
+
+func init() { RegisterTestSuite(&InvalidatorTest{}) }
+
+func (t *InvalidatorTest) SetUp(ti *TestInfo) {
+	t.notifier.sent = make(chan string, 10)
+	t.inv = newInvalidator()
+}
+
+func (t *InvalidatorTest) TearDown() {
+	t.inv.Stop()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *InvalidatorTest) SendsInOrder() {
+	t.inv.SetConn(&t.notifier)
+
+	t.inv.Inode(17)
+	t.inv.Entry(1, "foo")
+
+	ExpectEq("inode 17", <-t.notifier.sent)
+	ExpectEq("entry 1 foo", <-t.notifier.sent)
+}
+
+func (t *InvalidatorTest) StopsWhenUnsupported() {
+	t.notifier.err = syscall.ENOSYS
+	t.inv.SetConn(&t.notifier)
+
+	t.inv.Inode(17)
+	ExpectEq("inode 17", <-t.notifier.sent)
+
+	// Wait for the invalidator to give up on the connection.
+	for {
+		t.inv.mu.Lock()
+		conn := t.inv.conn
+		t.inv.mu.Unlock()
+
+		if conn == nil {
+			break
+		}
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/net/context"
+)
+
+// A lockTable holds the advisory locks taken on files within this mount with
+// fcntl(2) and flock(2), so that they are respected by every process using
+// the mount but not by other mounts of the same bucket.
+//
+// POSIX locks cover byte ranges and belong to a process's file descriptor
+// table, which releases them all on closing any descriptor for the file.
+// flock(2) locks cover whole files and belong to an open file description,
+// which releases them when it is closed for good. As on Linux, the two kinds
+// don't conflict with each other.
+//
+// Safe for concurrent access.
+type lockTable struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	// If non-nil, called whenever a file comes to have a write lock of either
+	// kind held on it, or to have none, with the table's lock held.
+	writeLocked func(id fuseops.InodeID, locked bool)
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The locks held on each file, by kind. Each owner's POSIX locks on a file
+	// don't overlap one another, and each owner holds at most one flock(2) lock
+	// on a file.
+	//
+	// INVARIANT: No slice is empty.
+	//
+	// GUARDED_BY(mu)
+	held map[lockKey][]heldLock
+
+	// Closed and replaced whenever a lock is released or downgraded, waking
+	// those waiting for a conflicting one to go away.
+	//
+	// GUARDED_BY(mu)
+	released chan struct{}
+}
+
+type lockKey struct {
+	inode fuseops.InodeID
+	flock bool
+}
+
+type heldLock struct {
+	owner uint64
+	pid   uint32
+	write bool
+
+	// The range covered, inclusive of end.
+	start uint64
+	end   uint64
+}
+
+func newLockTable(
+	writeLocked func(id fuseops.InodeID, locked bool)) (lt *lockTable) {
+	lt = &lockTable{
+		writeLocked: writeLocked,
+		held:        make(map[lockKey][]heldLock),
+		released:    make(chan struct{}),
+	}
+
+	return
+}
+
+// Test fills in the conflict field of the supplied op with a lock held by
+// another owner that conflicts with the one it describes, or sets its type to
+// F_UNLCK if there is none.
+func (lt *lockTable) Test(op *fuseops.GetFileLockOp) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	op.Conflict = fuseops.FileLock{Type: syscall.F_UNLCK}
+	l := heldLockFor(op.Owner, op.Lock)
+	if c, ok := lt.conflict(lockKey{op.Inode, false}, l); ok {
+		op.Conflict = fuseops.FileLock{
+			Start: c.start,
+			End:   c.end,
+			Type:  lockType(c.write),
+			Pid:   c.pid,
+		}
+	}
+}
+
+// Set takes or releases the lock described by the supplied op. If another
+// owner holds a conflicting lock, it returns EAGAIN or, if the op asks to
+// wait, waits for that lock to be released, returning EINTR if the context
+// is cancelled first.
+func (lt *lockTable) Set(
+	ctx context.Context,
+	op *fuseops.SetFileLockOp) (err error) {
+	key := lockKey{op.Inode, op.Flock}
+	l := heldLockFor(op.Owner, op.Lock)
+
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	if op.Lock.Type == syscall.F_UNLCK {
+		lt.change(op.Inode, func() { lt.remove(key, l.owner, l.start, l.end) })
+		return
+	}
+
+	for {
+		if _, ok := lt.conflict(key, l); !ok {
+			break
+		}
+
+		if !op.Wait {
+			err = syscall.EAGAIN
+			return
+		}
+
+		released := lt.released
+		lt.mu.Unlock()
+
+		select {
+		case <-released:
+			lt.mu.Lock()
+
+		case <-ctx.Done():
+			lt.mu.Lock()
+			err = syscall.EINTR
+			return
+		}
+	}
+
+	// Replace whatever the owner already holds in the range. This may release
+	// a write lock that others are waiting on, in favour of a read lock.
+	lt.change(op.Inode, func() {
+		lt.remove(key, l.owner, l.start, l.end)
+		lt.held[key] = append(lt.held[key], l)
+	})
+
+	return
+}
+
+// ReleasePOSIX releases the POSIX locks held by the given owner on the given
+// file, as when it closes a file descriptor for it.
+func (lt *lockTable) ReleasePOSIX(id fuseops.InodeID, owner uint64) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	lt.change(id, func() { lt.remove(lockKey{id, false}, owner, 0, ^uint64(0)) })
+}
+
+// ReleaseFlock releases the flock(2) lock held by the given owner on the given
+// file, if any, as when the open file description holding it is closed.
+func (lt *lockTable) ReleaseFlock(id fuseops.InodeID, owner uint64) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	lt.change(id, func() { lt.remove(lockKey{id, true}, owner, 0, ^uint64(0)) })
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func heldLockFor(owner uint64, fl fuseops.FileLock) (l heldLock) {
+	l = heldLock{
+		owner: owner,
+		pid:   fl.Pid,
+		write: fl.Type == syscall.F_WRLCK,
+		start: fl.Start,
+		end:   fl.End,
+	}
+
+	return
+}
+
+func lockType(write bool) uint32 {
+	if write {
+		return syscall.F_WRLCK
+	}
+
+	return syscall.F_RDLCK
+}
+
+// Apply the supplied change to the locks held on the given file, calling
+// writeLocked if it changes whether any of them is a write lock.
+//
+// LOCKS_REQUIRED(lt.mu)
+func (lt *lockTable) change(id fuseops.InodeID, f func()) {
+	before := lt.hasWriteLock(id)
+	f()
+
+	after := lt.hasWriteLock(id)
+	if after != before && lt.writeLocked != nil {
+		lt.writeLocked(id, after)
+	}
+}
+
+// LOCKS_REQUIRED(lt.mu)
+func (lt *lockTable) hasWriteLock(id fuseops.InodeID) bool {
+	for _, flock := range []bool{false, true} {
+		for _, h := range lt.held[lockKey{id, flock}] {
+			if h.write {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Return a lock held under the given key by an owner other than l's that
+// overlaps l, where at least one of the two is a write lock.
+//
+// LOCKS_REQUIRED(lt.mu)
+func (lt *lockTable) conflict(
+	key lockKey,
+	l heldLock) (c heldLock, ok bool) {
+	for _, h := range lt.held[key] {
+		if h.owner == l.owner || !(h.write || l.write) {
+			continue
+		}
+
+		if h.start <= l.end && l.start <= h.end {
+			c = h
+			ok = true
+			return
+		}
+	}
+
+	return
+}
+
+// Release the given owner's locks under the given key within [start, end],
+// trimming or splitting those that extend beyond it, and wake any waiters.
+//
+// LOCKS_REQUIRED(lt.mu)
+func (lt *lockTable) remove(
+	key lockKey,
+	owner uint64,
+	start uint64,
+	end uint64) {
+	var kept []heldLock
+	var removed bool
+	for _, h := range lt.held[key] {
+		if h.owner != owner || h.end < start || end < h.start {
+			kept = append(kept, h)
+			continue
+		}
+
+		removed = true
+		if h.start < start {
+			before := h
+			before.end = start - 1
+			kept = append(kept, before)
+		}
+
+		if end < h.end {
+			after := h
+			after.start = end + 1
+			kept = append(kept, after)
+		}
+	}
+
+	if len(kept) == 0 {
+		delete(lt.held, key)
+	} else {
+		lt.held[key] = kept
+	}
+
+	if removed {
+		close(lt.released)
+		lt.released = make(chan struct{})
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"math"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestLockTable(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const lockedInode = 17
+
+type LockTableTest struct {
+	ctx context.Context
+	lt  *lockTable
+
+	// The arguments to each call to writeLocked, in order.
+	writeLocked []bool
+}
+
+var _ SetUpInterface = &LockTableTest{}
+
+func init() { RegisterTestSuite(&LockTableTest{}) }
+
+func (t *LockTableTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.lt = newLockTable(t.noteWriteLocked)
+}
+
+func (t *LockTableTest) noteWriteLocked(id fuseops.InodeID, locked bool) {
+	AssertEq(lockedInode, id)
+	t.writeLocked = append(t.writeLocked, locked)
+}
+
+// Take or release a POSIX lock on [start, end] without waiting.
+func (t *LockTableTest) setPOSIX(
+	owner uint64,
+	typ uint32,
+	start uint64,
+	end uint64) error {
+	return t.lt.Set(t.ctx, &fuseops.SetFileLockOp{
+		Inode: lockedInode,
+		Owner: owner,
+		Lock:  fuseops.FileLock{Start: start, End: end, Type: typ, Pid: uint32(owner)},
+	})
+}
+
+// Take or release a flock(2) lock, waiting if asked.
+func (t *LockTableTest) setFlock(
+	ctx context.Context,
+	owner uint64,
+	typ uint32,
+	wait bool) error {
+	return t.lt.Set(ctx, &fuseops.SetFileLockOp{
+		Inode: lockedInode,
+		Owner: owner,
+		Lock:  fuseops.FileLock{End: math.MaxInt64, Type: typ},
+		Flock: true,
+		Wait:  wait,
+	})
+}
+
+// Return the lock conflicting with a write lock on [start, end] by the given
+// owner.
+func (t *LockTableTest) test(
+	owner uint64,
+	start uint64,
+	end uint64) fuseops.FileLock {
+	op := &fuseops.GetFileLockOp{
+		Inode: lockedInode,
+		Owner: owner,
+		Lock:  fuseops.FileLock{Start: start, End: end, Type: syscall.F_WRLCK},
+	}
+
+	t.lt.Test(op)
+	return op.Conflict
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *LockTableTest) SharedAndExclusive() {
+	AssertEq(nil, t.setPOSIX(1, syscall.F_RDLCK, 0, 99))
+	AssertEq(nil, t.setPOSIX(2, syscall.F_RDLCK, 50, 149))
+
+	// A write lock conflicts with the other owner's read lock, but not with
+	// the owner's own.
+	ExpectEq(syscall.EAGAIN, t.setPOSIX(1, syscall.F_WRLCK, 0, 99))
+	ExpectEq(nil, t.setPOSIX(1, syscall.F_WRLCK, 0, 49))
+
+	// Nor with locks elsewhere in the file.
+	ExpectEq(nil, t.setPOSIX(3, syscall.F_WRLCK, 150, math.MaxInt64))
+	ExpectEq(syscall.EAGAIN, t.setPOSIX(3, syscall.F_RDLCK, 10, 10))
+}
+
+func (t *LockTableTest) Test() {
+	AssertEq(nil, t.setPOSIX(1, syscall.F_RDLCK, 10, 19))
+
+	c := t.test(2, 0, 9)
+	ExpectEq(syscall.F_UNLCK, c.Type)
+
+	c = t.test(2, 15, math.MaxInt64)
+	ExpectEq(syscall.F_RDLCK, c.Type)
+	ExpectEq(10, c.Start)
+	ExpectEq(19, c.End)
+	ExpectEq(1, c.Pid)
+
+	c = t.test(1, 0, math.MaxInt64)
+	ExpectEq(syscall.F_UNLCK, c.Type)
+}
+
+func (t *LockTableTest) UnlockSplitsRange() {
+	AssertEq(nil, t.setPOSIX(1, syscall.F_WRLCK, 0, 99))
+	AssertEq(nil, t.setPOSIX(1, syscall.F_UNLCK, 40, 59))
+
+	ExpectEq(syscall.F_UNLCK, t.test(2, 40, 59).Type)
+
+	c := t.test(2, 0, 40)
+	ExpectEq(0, c.Start)
+	ExpectEq(39, c.End)
+
+	c = t.test(2, 59, 60)
+	ExpectEq(60, c.Start)
+	ExpectEq(99, c.End)
+}
+
+func (t *LockTableTest) ReleasePOSIX() {
+	AssertEq(nil, t.setPOSIX(1, syscall.F_WRLCK, 0, 9))
+	AssertEq(nil, t.setPOSIX(1, syscall.F_WRLCK, 20, 29))
+	AssertEq(nil, t.setFlock(t.ctx, 1, syscall.F_WRLCK, false))
+
+	t.lt.ReleasePOSIX(lockedInode, 1)
+	ExpectEq(syscall.F_UNLCK, t.test(2, 0, math.MaxInt64).Type)
+
+	// The flock(2) lock is unaffected.
+	ExpectEq(syscall.EAGAIN, t.setFlock(t.ctx, 2, syscall.F_RDLCK, false))
+}
+
+func (t *LockTableTest) FlockIndependentOfPOSIX() {
+	AssertEq(nil, t.setFlock(t.ctx, 1, syscall.F_WRLCK, false))
+	ExpectEq(nil, t.setPOSIX(2, syscall.F_WRLCK, 0, math.MaxInt64))
+	ExpectEq(syscall.EAGAIN, t.setFlock(t.ctx, 2, syscall.F_RDLCK, false))
+
+	// Releasing the flock(2) lock lets the other owner take one.
+	t.lt.ReleaseFlock(lockedInode, 1)
+	ExpectEq(nil, t.setFlock(t.ctx, 2, syscall.F_WRLCK, false))
+}
+
+func (t *LockTableTest) WaitForRelease() {
+	AssertEq(nil, t.setFlock(t.ctx, 1, syscall.F_WRLCK, false))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- t.setFlock(t.ctx, 2, syscall.F_WRLCK, true)
+	}()
+
+	// The waiter should be blocked until the lock is downgraded and then
+	// released.
+	select {
+	case err := <-done:
+		AddFailure("Set returned early: %v", err)
+		return
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	AssertEq(nil, t.setFlock(t.ctx, 1, syscall.F_RDLCK, false))
+	select {
+	case err := <-done:
+		AddFailure("Set returned early: %v", err)
+		return
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	AssertEq(nil, t.setFlock(t.ctx, 1, syscall.F_UNLCK, false))
+	ExpectEq(nil, <-done)
+	ExpectEq(syscall.EAGAIN, t.setFlock(t.ctx, 1, syscall.F_RDLCK, false))
+}
+
+func (t *LockTableTest) WaitInterrupted() {
+	AssertEq(nil, t.setFlock(t.ctx, 1, syscall.F_WRLCK, false))
+
+	ctx, cancel := context.WithCancel(t.ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- t.setFlock(ctx, 2, syscall.F_RDLCK, true)
+	}()
+
+	cancel()
+	ExpectEq(syscall.EINTR, <-done)
+
+	// The waiter took nothing.
+	AssertEq(nil, t.setFlock(t.ctx, 1, syscall.F_UNLCK, false))
+	ExpectEq(nil, t.setFlock(t.ctx, 3, syscall.F_WRLCK, false))
+}
+
+func (t *LockTableTest) WriteLockedTransitions() {
+	// Read locks don't count.
+	AssertEq(nil, t.setPOSIX(1, syscall.F_RDLCK, 0, 9))
+	ExpectThat(t.writeLocked, ElementsAre())
+
+	// The first write lock does, of either kind, and releasing the last.
+	AssertEq(nil, t.setPOSIX(1, syscall.F_WRLCK, 0, 9))
+	AssertEq(nil, t.setFlock(t.ctx, 2, syscall.F_WRLCK, false))
+	AssertEq(nil, t.setPOSIX(1, syscall.F_RDLCK, 0, 9))
+	ExpectThat(t.writeLocked, ElementsAre(true))
+
+	t.lt.ReleaseFlock(lockedInode, 2)
+	ExpectThat(t.writeLocked, ElementsAre(true, false))
+}
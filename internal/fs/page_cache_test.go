@@ -0,0 +1,128 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestPageCache(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type PageCacheTest struct {
+	ctx context.Context
+	cfg ServerConfig
+}
+
+var _ SetUpInterface = &PageCacheTest{}
+
+func init() { RegisterTestSuite(&PageCacheTest{}) }
+
+func (t *PageCacheTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.cfg = ServerConfig{
+		CacheClock:      &timeutil.SimulatedClock{},
+		Bucket:          gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket"),
+		FilePerms:       0644,
+		DirPerms:        0755,
+		TmpObjectPrefix: ".gcsfuse_tmp/",
+	}
+}
+
+// Create the file "foo" and open the object "bar" with a file system set up
+// according to t.cfg, returning the ops.
+func (t *PageCacheTest) createAndOpen() (
+	createOp *fuseops.CreateFileOp,
+	openOp *fuseops.OpenFileOp) {
+	_, err := gcsutil.CreateObject(t.ctx, t.cfg.Bucket, "bar", []byte("taco"))
+	AssertEq(nil, err)
+
+	fs, err := newFileSystem(&t.cfg)
+	AssertEq(nil, err)
+	defer fs.Destroy()
+
+	createOp = &fuseops.CreateFileOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+		Mode:   0644,
+		Flags:  syscall.O_RDWR,
+	}
+
+	err = fs.CreateFile(t.ctx, createOp)
+	AssertEq(nil, err)
+
+	lookUpOp := &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "bar",
+	}
+
+	err = fs.LookUpInode(t.ctx, lookUpOp)
+	AssertEq(nil, err)
+
+	openOp = &fuseops.OpenFileOp{
+		Inode: lookUpOp.Entry.Child,
+		Flags: syscall.O_RDONLY,
+	}
+
+	err = fs.OpenFile(t.ctx, openOp)
+	AssertEq(nil, err)
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *PageCacheTest) KeepByDefault() {
+	createOp, openOp := t.createAndOpen()
+
+	ExpectTrue(createOp.KeepPageCache)
+	ExpectFalse(createOp.UseDirectIO)
+
+	ExpectTrue(openOp.KeepPageCache)
+	ExpectFalse(openOp.UseDirectIO)
+}
+
+func (t *PageCacheTest) Drop() {
+	t.cfg.DropPageCache = true
+	createOp, openOp := t.createAndOpen()
+
+	ExpectFalse(createOp.KeepPageCache)
+	ExpectFalse(createOp.UseDirectIO)
+
+	ExpectFalse(openOp.KeepPageCache)
+	ExpectFalse(openOp.UseDirectIO)
+}
+
+func (t *PageCacheTest) Direct() {
+	t.cfg.DropPageCache = true
+	t.cfg.DirectIO = true
+	createOp, openOp := t.createAndOpen()
+
+	ExpectTrue(createOp.UseDirectIO)
+	ExpectTrue(openOp.UseDirectIO)
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/jacobsa/gcloud/gcs"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type PersistPermissionsTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&PersistPermissionsTest{}) }
+
+func (t *PersistPermissionsTest) SetUp(ti *TestInfo) {
+	t.serverCfg.PersistPermissions = true
+	t.fsTest.SetUp(ti)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *PersistPermissionsTest) ChmodFile() {
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+	p := path.Join(t.mfs.Dir(), "foo")
+
+	err := os.Chmod(p, 0600)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(p)
+	AssertEq(nil, err)
+	ExpectEq(os.FileMode(0600), fi.Mode())
+
+	// The mode should be recorded in the object.
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq("600", o.Metadata[inode.ModeMetadataKey])
+}
+
+func (t *PersistPermissionsTest) ChownDirectory() {
+	AssertEq(nil, t.createEmptyObjects([]string{"dir/"}))
+	p := path.Join(t.mfs.Dir(), "dir")
+
+	err := os.Chown(p, 1001, 1002)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(p)
+	AssertEq(nil, err)
+	ExpectEq(1001, fi.Sys().(*syscall.Stat_t).Uid)
+	ExpectEq(1002, fi.Sys().(*syscall.Stat_t).Gid)
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "dir/"})
+	AssertEq(nil, err)
+	ExpectEq("1001", o.Metadata[inode.UidMetadataKey])
+	ExpectEq("1002", o.Metadata[inode.GidMetadataKey])
+}
+
+func (t *PersistPermissionsTest) HonorsRecordedPermissions() {
+	// Create an object with permissions recorded by some other mount.
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "foo",
+			Contents: strings.NewReader(""),
+			Metadata: map[string]string{
+				inode.ModeMetadataKey: "751",
+				inode.UidMetadataKey:  "1001",
+			},
+		})
+
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(path.Join(t.mfs.Dir(), "foo"))
+	AssertEq(nil, err)
+	ExpectEq(os.FileMode(0751), fi.Mode())
+	ExpectEq(1001, fi.Sys().(*syscall.Stat_t).Uid)
+	ExpectEq(currentGid(), fi.Sys().(*syscall.Stat_t).Gid)
+}
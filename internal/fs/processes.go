@@ -0,0 +1,110 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long the name of a process is remembered before it is looked up
+	// again, in case its PID has been reused.
+	processNameTTL = time.Minute
+
+	// The most names remembered at once. Beyond this they are all forgotten.
+	maxProcessNames = 4096
+)
+
+// Names given to processes whose command can't be found.
+const (
+	// For ops the kernel sends on its own behalf, which carry PID zero.
+	kernelProcess = "kernel"
+
+	// For processes that have exited, or live in another PID namespace.
+	unknownProcess = "unknown"
+)
+
+// Names processes by the command they are running, as found in /proc, for
+// labelling metrics and logs. Command names rather than PIDs keep the number
+// of label values small. Safe for concurrent access.
+type processNamer struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	// The proc file system, normally "/proc".
+	procDir string
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	names map[uint32]cachedProcessName
+}
+
+type cachedProcessName struct {
+	name    string
+	expires time.Time
+}
+
+func newProcessNamer(procDir string) *processNamer {
+	return &processNamer{
+		procDir: procDir,
+		names:   make(map[uint32]cachedProcessName),
+	}
+}
+
+// Name returns the command name of the process with the given PID.
+func (pn *processNamer) Name(pid uint32) (name string) {
+	if pid == 0 {
+		name = kernelProcess
+		return
+	}
+
+	now := time.Now()
+
+	pn.mu.Lock()
+	c, ok := pn.names[pid]
+	pn.mu.Unlock()
+
+	if ok && now.Before(c.expires) {
+		name = c.name
+		return
+	}
+
+	name = unknownProcess
+	p := path.Join(pn.procDir, strconv.FormatUint(uint64(pid), 10), "comm")
+	if contents, err := ioutil.ReadFile(p); err == nil {
+		name = strings.TrimSpace(string(contents))
+	}
+
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+
+	if len(pn.names) >= maxProcessNames {
+		pn.names = make(map[uint32]cachedProcessName)
+	}
+
+	pn.names[pid] = cachedProcessName{name: name, expires: now.Add(processNameTTL)}
+	return
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestProcessNamer(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ProcessNamerTest struct {
+	dir   string
+	namer *processNamer
+}
+
+var _ SetUpInterface = &ProcessNamerTest{}
+var _ TearDownInterface = &ProcessNamerTest{}
+
+func init() { RegisterTestSuite(&ProcessNamerTest{}) }
+
+func (t *ProcessNamerTest) SetUp(ti *TestInfo) {
+	var err error
+	t.dir, err = ioutil.TempDir("", "processes_test")
+	AssertEq(nil, err)
+
+	t.namer = newProcessNamer(t.dir)
+}
+
+func (t *ProcessNamerTest) TearDown() {
+	os.RemoveAll(t.dir)
+}
+
+func (t *ProcessNamerTest) setComm(pid string, comm string) {
+	err := os.MkdirAll(path.Join(t.dir, pid), 0700)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.dir, pid, "comm"), []byte(comm), 0600)
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ProcessNamerTest) Kernel() {
+	ExpectEq(kernelProcess, t.namer.Name(0))
+}
+
+func (t *ProcessNamerTest) Unknown() {
+	ExpectEq(unknownProcess, t.namer.Name(17))
+}
+
+func (t *ProcessNamerTest) ReadsComm() {
+	t.setComm("17", "python3\n")
+	ExpectEq("python3", t.namer.Name(17))
+}
+
+func (t *ProcessNamerTest) RemembersNames() {
+	t.setComm("17", "python3\n")
+	AssertEq("python3", t.namer.Name(17))
+
+	t.setComm("17", "bash\n")
+	ExpectEq("python3", t.namer.Name(17))
+}
+
+func (t *ProcessNamerTest) RealProcess() {
+	namer := newProcessNamer("/proc")
+	ExpectEq("fs.test", namer.Name(uint32(os.Getpid())))
+}
@@ -0,0 +1,344 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/handle"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/syncutil"
+)
+
+// The number of independently locked shards in an inodeTable or handleTable.
+// Nearly every op starts by looking up an inode or handle by ID, so this
+// bounds how many can do so without contending.
+const tableShards = 32
+
+////////////////////////////////////////////////////////////////////////
+// inodeTable
+////////////////////////////////////////////////////////////////////////
+
+// A map from inode ID to live inode, sharded by ID. The file system looks up
+// inodes here without its own lock; it holds that lock only while adding or
+// removing them, so that they stay consistent with its name indexes.
+//
+// Shard locks come last in the lock order: they may be acquired while holding
+// any other lock, and no other lock may be acquired while holding one.
+//
+// Must be created with newInodeTable.
+type inodeTable struct {
+	shards [tableShards]inodeShard
+}
+
+type inodeShard struct {
+	mu syncutil.InvariantMutex
+
+	// INVARIANT: For all keys k, inodes[k].ID() == k
+	// INVARIANT: For all keys k, k hashes to this shard
+	//
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]inode.Inode
+}
+
+func newInodeTable() (t *inodeTable) {
+	t = &inodeTable{}
+	for i := range t.shards {
+		s := &t.shards[i]
+		index := i
+		s.inodes = make(map[fuseops.InodeID]inode.Inode)
+		s.mu = syncutil.NewInvariantMutex(func() { s.checkInvariants(index) })
+	}
+
+	return
+}
+
+func (t *inodeTable) shard(id fuseops.InodeID) *inodeShard {
+	return &t.shards[uint64(id)%tableShards]
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *inodeShard) checkInvariants(index int) {
+	for id, in := range s.inodes {
+		// INVARIANT: For all keys k, inodes[k].ID() == k
+		if in.ID() != id {
+			panic(fmt.Sprintf("ID mismatch: %v vs. %v", in.ID(), id))
+		}
+
+		// INVARIANT: For all keys k, k hashes to this shard
+		if int(uint64(id)%tableShards) != index {
+			panic(fmt.Sprintf("Inode %v in shard %d", id, index))
+		}
+	}
+}
+
+// Return the inode with the given ID, or nil if there is none.
+func (t *inodeTable) Get(id fuseops.InodeID) (in inode.Inode) {
+	s := t.shard(id)
+	s.mu.Lock()
+	in = s.inodes[id]
+	s.mu.Unlock()
+
+	return
+}
+
+// Add the supplied inode under its ID.
+func (t *inodeTable) Insert(in inode.Inode) {
+	s := t.shard(in.ID())
+	s.mu.Lock()
+	s.inodes[in.ID()] = in
+	s.mu.Unlock()
+}
+
+// Remove the inode with the given ID, if any.
+func (t *inodeTable) Delete(id fuseops.InodeID) {
+	s := t.shard(id)
+	s.mu.Lock()
+	delete(s.inodes, id)
+	s.mu.Unlock()
+}
+
+// Return all of the inodes in the table, in no particular order. The result
+// is consistent only if the caller excludes concurrent changes.
+func (t *inodeTable) All() (inodes []inode.Inode) {
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mu.Lock()
+		for _, in := range s.inodes {
+			inodes = append(inodes, in)
+		}
+		s.mu.Unlock()
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// handleTable
+////////////////////////////////////////////////////////////////////////
+
+// The kinds of handle kept in a handleTable.
+type handleKind int
+
+const (
+	dirHandleKind handleKind = iota
+
+	// A file opened only for reading.
+	readHandleKind
+
+	// A file opened for writing, and perhaps reading too.
+	writeHandleKind
+)
+
+// An entry in a handleTable.
+//
+// INVARIANT: (dir != nil) == (kind == dirHandleKind)
+// INVARIANT: (file != nil) == (kind != dirHandleKind)
+// INVARIANT: If file != nil, file.Writable() == (kind == writeHandleKind)
+type handleEntry struct {
+	kind handleKind
+	dir  *dirHandle
+	file *handle.FileHandle
+}
+
+func (e *handleEntry) checkInvariants() {
+	// INVARIANT: (dir != nil) == (kind == dirHandleKind)
+	if (e.dir != nil) != (e.kind == dirHandleKind) {
+		panic(fmt.Sprintf("Kind %d with dir handle %v", e.kind, e.dir))
+	}
+
+	// INVARIANT: (file != nil) == (kind != dirHandleKind)
+	if (e.file != nil) != (e.kind != dirHandleKind) {
+		panic(fmt.Sprintf("Kind %d with file handle %v", e.kind, e.file))
+	}
+
+	// INVARIANT: If file != nil, file.Writable() == (kind == writeHandleKind)
+	if e.file != nil && e.file.Writable() != (e.kind == writeHandleKind) {
+		panic(fmt.Sprintf("Kind %d with writable %v", e.kind, e.file.Writable()))
+	}
+}
+
+// A map from handle ID to open handle, sharded by ID. Handles are unrelated to
+// the file system's other state, so the table is used without the file system
+// lock. Shard locks are leaves in the lock order, as for inodeTable.
+//
+// Looking up a handle as the wrong kind, or one that doesn't exist, is an
+// error. The kernel only ever refers to handles we gave it, of the kind it
+// asked for, so the op that does so should fail rather than go on.
+//
+// Must be created with newHandleTable.
+type handleTable struct {
+	// The last handle ID handed out. Accessed atomically. We assume that this
+	// will never overflow.
+	//
+	// INVARIANT: For all keys k in any shard, k <= lastID
+	lastID uint64
+
+	shards [tableShards]handleShard
+}
+
+type handleShard struct {
+	mu syncutil.InvariantMutex
+
+	// INVARIANT: For all values v, v.checkInvariants() doesn't panic
+	// INVARIANT: For all keys k, k hashes to this shard
+	//
+	// GUARDED_BY(mu)
+	handles map[fuseops.HandleID]handleEntry
+}
+
+func newHandleTable() (t *handleTable) {
+	t = &handleTable{}
+	for i := range t.shards {
+		s := &t.shards[i]
+		index := i
+		s.handles = make(map[fuseops.HandleID]handleEntry)
+		s.mu = syncutil.NewInvariantMutex(func() { s.checkInvariants(t, index) })
+	}
+
+	return
+}
+
+func (t *handleTable) shard(id fuseops.HandleID) *handleShard {
+	return &t.shards[uint64(id)%tableShards]
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *handleShard) checkInvariants(t *handleTable, index int) {
+	lastID := fuseops.HandleID(atomic.LoadUint64(&t.lastID))
+	for id, e := range s.handles {
+		// INVARIANT: For all values v, v.checkInvariants() doesn't panic
+		e.checkInvariants()
+
+		// INVARIANT: For all keys k, k hashes to this shard
+		if int(uint64(id)%tableShards) != index {
+			panic(fmt.Sprintf("Handle %v in shard %d", id, index))
+		}
+
+		// INVARIANT: For all keys k in any shard, k <= lastID
+		if id > lastID {
+			panic(fmt.Sprintf("Illegal handle ID: %v", id))
+		}
+	}
+}
+
+func (t *handleTable) insert(e handleEntry) (id fuseops.HandleID) {
+	id = fuseops.HandleID(atomic.AddUint64(&t.lastID, 1))
+
+	s := t.shard(id)
+	s.mu.Lock()
+	s.handles[id] = e
+	s.mu.Unlock()
+
+	return
+}
+
+// Look up the handle with the given ID, removing it if remove is set, and
+// return an error unless it is of one of the given kinds. A handle of the
+// wrong kind is left alone, so that it still works afterward.
+func (t *handleTable) find(
+	id fuseops.HandleID,
+	remove bool,
+	kinds ...handleKind) (e handleEntry, err error) {
+	s := t.shard(id)
+	s.mu.Lock()
+	e, ok := s.handles[id]
+	wanted := false
+	for _, k := range kinds {
+		wanted = wanted || e.kind == k
+	}
+
+	if ok && wanted && remove {
+		delete(s.handles, id)
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		err = fmt.Errorf("handle %d doesn't exist", id)
+		return
+	}
+
+	if !wanted {
+		err = fmt.Errorf("handle %d is of kind %d, wanted %v", id, e.kind, kinds)
+		return
+	}
+
+	return
+}
+
+// Add the supplied directory handle under a new ID, which is returned.
+func (t *handleTable) InsertDir(dh *dirHandle) fuseops.HandleID {
+	return t.insert(handleEntry{kind: dirHandleKind, dir: dh})
+}
+
+// Add the supplied file handle under a new ID, which is returned, as a read
+// or write handle according to whether it is writable.
+func (t *handleTable) InsertFile(fh *handle.FileHandle) fuseops.HandleID {
+	kind := readHandleKind
+	if fh.Writable() {
+		kind = writeHandleKind
+	}
+
+	return t.insert(handleEntry{kind: kind, file: fh})
+}
+
+// Return the directory handle with the given ID.
+func (t *handleTable) Dir(id fuseops.HandleID) (dh *dirHandle, err error) {
+	e, err := t.find(id, false, dirHandleKind)
+	dh = e.dir
+	return
+}
+
+// Return the read or write handle with the given ID.
+func (t *handleTable) File(
+	id fuseops.HandleID) (fh *handle.FileHandle, err error) {
+	e, err := t.find(id, false, readHandleKind, writeHandleKind)
+	fh = e.file
+	return
+}
+
+// Remove and return the directory handle with the given ID.
+func (t *handleTable) RemoveDir(
+	id fuseops.HandleID) (dh *dirHandle, err error) {
+	e, err := t.find(id, true, dirHandleKind)
+	dh = e.dir
+	return
+}
+
+// Remove and return the read or write handle with the given ID.
+func (t *handleTable) RemoveFile(
+	id fuseops.HandleID) (fh *handle.FileHandle, err error) {
+	e, err := t.find(id, true, readHandleKind, writeHandleKind)
+	fh = e.file
+	return
+}
+
+// Return the IDs and entries of all of the handles in the table, in no
+// particular order.
+func (t *handleTable) All() (ids []fuseops.HandleID, entries []handleEntry) {
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mu.Lock()
+		for id, e := range s.handles {
+			ids = append(ids, id)
+			entries = append(entries, e)
+		}
+		s.mu.Unlock()
+	}
+
+	return
+}
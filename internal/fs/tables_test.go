@@ -0,0 +1,190 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/handle"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestTables(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type idInode struct {
+	inode.Inode
+	id fuseops.InodeID
+}
+
+func (in *idInode) ID() fuseops.InodeID { return in.id }
+
+type TablesTest struct {
+	inodes  *inodeTable
+	handles *handleTable
+}
+
+var _ SetUpInterface = &TablesTest{}
+
+func init() { RegisterTestSuite(&TablesTest{}) }
+
+func (t *TablesTest) SetUp(ti *TestInfo) {
+	t.inodes = newInodeTable()
+	t.handles = newHandleTable()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *TablesTest) Inodes() {
+	// Choose IDs that land in the same shard as well as different ones.
+	a := &idInode{id: 1}
+	b := &idInode{id: 2}
+	c := &idInode{id: 1 + tableShards}
+
+	t.inodes.Insert(a)
+	t.inodes.Insert(b)
+	t.inodes.Insert(c)
+
+	ExpectEq(a, t.inodes.Get(1))
+	ExpectEq(c, t.inodes.Get(1+tableShards))
+	ExpectEq(nil, t.inodes.Get(3))
+
+	t.inodes.Delete(1)
+	ExpectEq(nil, t.inodes.Get(1))
+	ExpectEq(c, t.inodes.Get(1+tableShards))
+
+	var ids []int
+	for _, in := range t.inodes.All() {
+		ids = append(ids, int(in.ID()))
+	}
+
+	sort.Ints(ids)
+	ExpectThat(ids, ElementsAre(2, 1+tableShards))
+}
+
+func (t *TablesTest) Handles() {
+	dh := &dirHandle{}
+	rh := handle.NewFileHandle(nil, nil, nil, nil, false, false)
+	wh := handle.NewFileHandle(nil, nil, nil, nil, true, false)
+
+	dirID := t.handles.InsertDir(dh)
+	readID := t.handles.InsertFile(rh)
+	writeID := t.handles.InsertFile(wh)
+
+	ExpectNe(dirID, readID)
+	ExpectNe(readID, writeID)
+
+	gotDir, err := t.handles.Dir(dirID)
+	AssertEq(nil, err)
+	ExpectEq(dh, gotDir)
+
+	gotFile, err := t.handles.File(readID)
+	AssertEq(nil, err)
+	ExpectEq(rh, gotFile)
+
+	gotFile, err = t.handles.File(writeID)
+	AssertEq(nil, err)
+	ExpectEq(wh, gotFile)
+
+	ids, entries := t.handles.All()
+	ExpectEq(3, len(ids))
+	ExpectEq(3, len(entries))
+
+	gotFile, err = t.handles.RemoveFile(readID)
+	AssertEq(nil, err)
+	ExpectEq(rh, gotFile)
+
+	gotDir, err = t.handles.RemoveDir(dirID)
+	AssertEq(nil, err)
+	ExpectEq(dh, gotDir)
+
+	gotFile, err = t.handles.File(writeID)
+	AssertEq(nil, err)
+	ExpectEq(wh, gotFile)
+}
+
+func (t *TablesTest) WrongKindOfHandle() {
+	dirID := t.handles.InsertDir(&dirHandle{})
+	fileID := t.handles.InsertFile(handle.NewFileHandle(nil, nil, nil, nil, false, false))
+
+	_, err := t.handles.File(dirID)
+	ExpectThat(err, Error(HasSubstr("kind")))
+
+	_, err = t.handles.Dir(fileID)
+	ExpectThat(err, Error(HasSubstr("kind")))
+
+	// Removing a handle as the wrong kind leaves it in place.
+	_, err = t.handles.RemoveDir(fileID)
+	ExpectThat(err, Error(HasSubstr("kind")))
+
+	fh, err := t.handles.File(fileID)
+	AssertEq(nil, err)
+	ExpectNe(nil, fh)
+}
+
+func (t *TablesTest) MissingHandle() {
+	id := t.handles.InsertDir(&dirHandle{})
+	_, err := t.handles.RemoveDir(id)
+	AssertEq(nil, err)
+
+	_, err = t.handles.RemoveDir(id)
+	ExpectThat(err, Error(HasSubstr("doesn't exist")))
+
+	_, err = t.handles.File(id)
+	ExpectThat(err, Error(HasSubstr("doesn't exist")))
+}
+
+func (t *TablesTest) ConcurrentHandles() {
+	const perWorker = 100
+	const workers = 8
+
+	var mu sync.Mutex
+	seen := make(map[fuseops.HandleID]bool)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				id := t.handles.InsertDir(&dirHandle{})
+
+				mu.Lock()
+				seen[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// Every handle got a distinct ID.
+	AssertEq(workers*perWorker, len(seen))
+	for id := range seen {
+		dh, err := t.handles.Dir(id)
+		AssertEq(nil, err)
+		ExpectNe(nil, dh)
+	}
+}
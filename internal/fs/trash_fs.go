@@ -0,0 +1,815 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// The name of the directory in the root through which soft-deleted objects
+// can be seen and restored, when ServerConfig.SoftDeletedObjects is set.
+const TrashDirName = ".trash"
+
+// The trash directory and the inodes below it, and the handles opened on
+// them, get IDs from the second quarter of each ID space, below those of the
+// versions directory.
+const (
+	trashDirInodeID    = fuseops.InodeID(1 << 61)
+	firstTrashHandleID = fuseops.HandleID(1 << 61)
+)
+
+// Wrap the supplied file system so that its root directory also contains a
+// directory named TrashDirName, which isn't listed. Below it, the directory
+// at path p holds a file for each object one level below p that has been
+// soft-deleted, standing for its most recently deleted generation, along with
+// a subdirectory for each name further down. A file shadows a subdirectory of
+// the same name. The directories and files belong to the given user and
+// group.
+//
+// Files can't be opened, since soft-deleted objects can't be read. Renaming
+// one out of the trash directory restores its generation to the object's
+// name, and then moves it to the new name if that differs. The directory of
+// the object's name must exist.
+func newTrashFileSystem(
+	wrapped fuseutil.FileSystem,
+	deleted gcsx.SoftDeletedObjects,
+	uid uint32,
+	gid uint32) fuseutil.FileSystem {
+	fs := &trashFileSystem{
+		FileSystem: wrapped,
+		deleted:    deleted,
+		uid:        uid,
+		gid:        gid,
+		created:    time.Now(),
+		inodes:     make(map[fuseops.InodeID]*trashInode),
+		ids:        make(map[trashKey]fuseops.InodeID),
+		nextInode:  trashDirInodeID + 1,
+		dirHandles: make(map[fuseops.HandleID][]fuseutil.Dirent),
+		nextHandle: firstTrashHandleID,
+	}
+
+	// The trash directory itself is never forgotten.
+	fs.inodes[trashDirInodeID] = &trashInode{}
+	fs.ids[trashKey{}] = trashDirInodeID
+
+	return fs
+}
+
+// Identifies an inode below the trash directory: a directory by the name it
+// stands for, and a file by that of its object and its generation.
+type trashKey struct {
+	name       string
+	generation int64
+}
+
+type trashInode struct {
+	// The name of the object that a file stands for, or for a directory the
+	// prefix of the objects below it without the trailing slash. Empty for the
+	// trash directory itself.
+	name string
+
+	// For a file, the soft-deleted generation it stands for. Nil for a
+	// directory.
+	object *gcsx.SoftDeletedObject
+
+	// The number of lookups the kernel has yet to forget.
+	lookupCount uint64
+}
+
+type trashFileSystem struct {
+	fuseutil.FileSystem
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	deleted gcsx.SoftDeletedObjects
+	uid     uint32
+	gid     uint32
+	created time.Time
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The inodes that the kernel knows about, and their IDs.
+	//
+	// INVARIANT: For each k, v in ids: inodes[v] is the inode for k
+	//
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*trashInode
+
+	// GUARDED_BY(mu)
+	ids map[trashKey]fuseops.InodeID
+
+	// GUARDED_BY(mu)
+	nextInode fuseops.InodeID
+
+	// The listing taken when each directory handle was opened.
+	//
+	// GUARDED_BY(mu)
+	dirHandles map[fuseops.HandleID][]fuseutil.Dirent
+
+	// GUARDED_BY(mu)
+	nextHandle fuseops.HandleID
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func isTrashInode(id fuseops.InodeID) bool {
+	return id >= trashDirInodeID && id < versionsDirInodeID
+}
+
+func isTrashHandle(id fuseops.HandleID) bool {
+	return id >= firstTrashHandleID && id < firstVersionsHandleID
+}
+
+// Is the child of the given parent with the given name the trash directory or
+// below it?
+func isTrashChild(parent fuseops.InodeID, name string) bool {
+	return isTrashInode(parent) ||
+		(parent == fuseops.RootInodeID && name == TrashDirName)
+}
+
+// Return the prefix of the names of objects one level below the directory
+// standing for the given name.
+func trashChildPrefix(name string) string {
+	if name == "" {
+		return ""
+	}
+
+	return name + "/"
+}
+
+// Of several soft-deleted generations, return the most recently deleted.
+func newestDeleted(
+	a *gcsx.SoftDeletedObject,
+	b *gcsx.SoftDeletedObject) *gcsx.SoftDeletedObject {
+	switch {
+	case a == nil:
+		return b
+
+	case b.SoftDeleteTime.After(a.SoftDeleteTime):
+		return b
+
+	case b.SoftDeleteTime.Equal(a.SoftDeleteTime) &&
+		b.Generation > a.Generation:
+		return b
+	}
+
+	return a
+}
+
+// Find the child of the given directory with the given name: a file for the
+// newest soft-deleted generation of the object by the child's name, or else a
+// subdirectory if any soft-deleted object lies below it.
+func (fs *trashFileSystem) lookUpChild(
+	ctx context.Context,
+	parent *trashInode,
+	name string) (key trashKey, o *gcsx.SoftDeletedObject, err error) {
+	child := trashChildPrefix(parent.name) + inode.UnescapeName(name)
+	objects, runs, err := fs.deleted.ListSoftDeleted(ctx, child, "/")
+	if err != nil {
+		err = fmt.Errorf("ListSoftDeleted: %v", err)
+		return
+	}
+
+	for _, c := range objects {
+		if c.Name == child {
+			o = newestDeleted(o, c)
+		}
+	}
+
+	if o != nil {
+		key = trashKey{child, o.Generation}
+		return
+	}
+
+	for _, r := range runs {
+		if r == child+"/" {
+			key = trashKey{name: child}
+			return
+		}
+	}
+
+	err = fuse.ENOENT
+	return
+}
+
+// Return the entries of the directory standing for the given name: its
+// files, then its subdirectories.
+func (fs *trashFileSystem) readEntries(
+	ctx context.Context,
+	name string) (entries []fuseutil.Dirent, err error) {
+	prefix := trashChildPrefix(name)
+	objects, runs, err := fs.deleted.ListSoftDeleted(ctx, prefix, "/")
+	if err != nil {
+		err = fmt.Errorf("ListSoftDeleted: %v", err)
+		return
+	}
+
+	var files []string
+	var dirs []string
+	taken := make(map[string]bool)
+	for _, o := range objects {
+		// Skip a placeholder object for the directory itself.
+		n := inode.EscapeName(o.Name[len(prefix):])
+		if o.Name != prefix && !taken[n] {
+			taken[n] = true
+			files = append(files, n)
+		}
+	}
+
+	for _, r := range runs {
+		n := inode.EscapeName(strings.TrimSuffix(r[len(prefix):], "/"))
+		if !taken[n] {
+			taken[n] = true
+			dirs = append(dirs, n)
+		}
+	}
+
+	sort.Strings(files)
+	sort.Strings(dirs)
+
+	for _, n := range files {
+		entries = append(entries, fuseutil.Dirent{
+			Name: n,
+			Type: fuseutil.DT_File,
+		})
+	}
+
+	for _, n := range dirs {
+		entries = append(entries, fuseutil.Dirent{
+			Name: n,
+			Type: fuseutil.DT_Directory,
+		})
+	}
+
+	for i := range entries {
+		entries[i].Offset = fuseops.DirOffset(i + 1)
+	}
+
+	return
+}
+
+func (fs *trashFileSystem) attributes(
+	in *trashInode) (attrs fuseops.InodeAttributes) {
+	attrs = fuseops.InodeAttributes{
+		Nlink:  2,
+		Mode:   0555 | os.ModeDir,
+		Atime:  fs.created,
+		Mtime:  fs.created,
+		Ctime:  fs.created,
+		Crtime: fs.created,
+		Uid:    fs.uid,
+		Gid:    fs.gid,
+	}
+
+	// A file was modified when its generation was written, and changed when
+	// it was deleted.
+	if in.object != nil {
+		attrs.Nlink = 1
+		attrs.Mode = 0444
+		attrs.Size = in.object.Size
+		attrs.Atime = in.object.Updated
+		attrs.Mtime = in.object.Updated
+		attrs.Ctime = in.object.SoftDeleteTime
+		attrs.Crtime = in.object.Updated
+	}
+
+	return
+}
+
+// Look up the inode with the given ID, or fail with ENOENT for one that the
+// kernel has forgotten.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *trashFileSystem) inode(
+	id fuseops.InodeID) (in trashInode, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	p, ok := fs.inodes[id]
+	if !ok {
+		err = fuse.ENOENT
+		return
+	}
+
+	in = *p
+	return
+}
+
+// Look up the directory with the given object name prefix in the wrapped file
+// system, one component at a time, returning the ID of each inode looked up
+// along the way. The caller must forget them.
+func (fs *trashFileSystem) lookUpDir(
+	ctx context.Context,
+	prefix string) (ids []fuseops.InodeID, err error) {
+	var id fuseops.InodeID = fuseops.RootInodeID
+	for _, c := range strings.Split(prefix, "/") {
+		if c == "" {
+			continue
+		}
+
+		op := &fuseops.LookUpInodeOp{
+			Parent: id,
+			Name:   inode.EscapeName(c),
+		}
+
+		err = fs.FileSystem.LookUpInode(ctx, op)
+		if err != nil {
+			return
+		}
+
+		id = op.Entry.Child
+		ids = append(ids, id)
+
+		if !op.Entry.Attributes.Mode.IsDir() {
+			err = syscall.ENOTDIR
+			return
+		}
+	}
+
+	return
+}
+
+// Restore the soft-deleted generation that the child of the trash directory
+// named by op stands for, and move it to op's new name.
+func (fs *trashFileSystem) restore(
+	ctx context.Context,
+	op *fuseops.RenameOp) (err error) {
+	parent, err := fs.inode(op.OldParent)
+	if err != nil {
+		return
+	}
+
+	_, o, err := fs.lookUpChild(ctx, &parent, op.OldName)
+	if err != nil {
+		return
+	}
+
+	// Directories can't be restored wholesale.
+	if o == nil {
+		err = syscall.EPERM
+		return
+	}
+
+	// Find the directory in which the object reappears, telling whether it is
+	// being put back where it was.
+	dir, base := path.Split(o.Name)
+	ids, err := fs.lookUpDir(ctx, dir)
+	defer func() {
+		for _, id := range ids {
+			fs.FileSystem.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: id, N: 1})
+		}
+	}()
+
+	if err != nil {
+		err = fmt.Errorf("Looking up %q: %v", dir, err)
+		return
+	}
+
+	var dirID fuseops.InodeID = fuseops.RootInodeID
+	if len(ids) > 0 {
+		dirID = ids[len(ids)-1]
+	}
+
+	inPlace := op.NewParent == dirID && op.NewName == inode.EscapeName(base)
+
+	// Like any rename, putting it back replaces whatever is there. Otherwise
+	// the object's name must be free for the moment it takes to move it on.
+	err = fs.deleted.RestoreObject(ctx, o.Name, o.Generation, !inPlace)
+	switch err.(type) {
+	case nil:
+	case *gcs.NotFoundError:
+		err = fuse.ENOENT
+		return
+
+	case *gcs.PreconditionError:
+		err = fuse.EEXIST
+		return
+
+	default:
+		err = fmt.Errorf("RestoreObject: %v", err)
+		return
+	}
+
+	if inPlace {
+		return
+	}
+
+	err = fs.FileSystem.Rename(ctx, &fuseops.RenameOp{
+		OldParent: dirID,
+		OldName:   inode.EscapeName(base),
+		NewParent: op.NewParent,
+		NewName:   op.NewName,
+	})
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Names
+////////////////////////////////////////////////////////////////////////
+
+func (fs *trashFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	var key trashKey
+	var o *gcsx.SoftDeletedObject
+	switch {
+	case op.Parent == fuseops.RootInodeID && op.Name == TrashDirName:
+
+	case isTrashInode(op.Parent):
+		var parent trashInode
+		parent, err = fs.inode(op.Parent)
+		if err != nil {
+			return
+		}
+
+		key, o, err = fs.lookUpChild(ctx, &parent, op.Name)
+		if err != nil {
+			return
+		}
+
+	default:
+		err = fs.FileSystem.LookUpInode(ctx, op)
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	id, ok := fs.ids[key]
+	if !ok {
+		id = fs.nextInode
+		fs.nextInode++
+		fs.ids[key] = id
+		fs.inodes[id] = &trashInode{name: key.name, object: o}
+	}
+
+	in := fs.inodes[id]
+	in.lookupCount++
+
+	// Nothing is cached by the kernel, so that deletions show up.
+	op.Entry.Child = id
+	op.Entry.Attributes = fs.attributes(in)
+	return
+}
+
+func (fs *trashFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	if !isTrashInode(op.Inode) {
+		err = fs.FileSystem.GetInodeAttributes(ctx, op)
+		return
+	}
+
+	in, err := fs.inode(op.Inode)
+	if err != nil {
+		return
+	}
+
+	op.Attributes = fs.attributes(&in)
+	return
+}
+
+func (fs *trashFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) (err error) {
+	if !isTrashInode(op.Inode) {
+		err = fs.FileSystem.SetInodeAttributes(ctx, op)
+		return
+	}
+
+	err = syscall.EPERM
+	return
+}
+
+func (fs *trashFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) (err error) {
+	if !isTrashInode(op.Inode) {
+		err = fs.FileSystem.ForgetInode(ctx, op)
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in, ok := fs.inodes[op.Inode]
+	if !ok || op.Inode == trashDirInodeID {
+		return
+	}
+
+	if op.N < in.lookupCount {
+		in.lookupCount -= op.N
+		return
+	}
+
+	var generation int64
+	if in.object != nil {
+		generation = in.object.Generation
+	}
+
+	delete(fs.ids, trashKey{in.name, generation})
+	delete(fs.inodes, op.Inode)
+	return
+}
+
+func (fs *trashFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) (err error) {
+	if isTrashChild(op.Parent, op.Name) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.MkDir(ctx, op)
+	return
+}
+
+func (fs *trashFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) (err error) {
+	if isTrashChild(op.Parent, op.Name) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.MkNode(ctx, op)
+	return
+}
+
+func (fs *trashFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) (err error) {
+	if isTrashChild(op.Parent, op.Name) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.CreateFile(ctx, op)
+	return
+}
+
+func (fs *trashFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) (err error) {
+	if isTrashChild(op.Parent, op.Name) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.CreateSymlink(ctx, op)
+	return
+}
+
+func (fs *trashFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) (err error) {
+	if isTrashChild(op.Parent, op.Name) || isTrashInode(op.Target) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.CreateLink(ctx, op)
+	return
+}
+
+func (fs *trashFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) (err error) {
+	switch {
+	case isTrashChild(op.NewParent, op.NewName):
+		err = syscall.EPERM
+
+	case op.OldParent == fuseops.RootInodeID && op.OldName == TrashDirName:
+		err = syscall.EPERM
+
+	case isTrashInode(op.OldParent):
+		err = fs.restore(ctx, op)
+
+	default:
+		err = fs.FileSystem.Rename(ctx, op)
+	}
+
+	return
+}
+
+func (fs *trashFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) (err error) {
+	if isTrashChild(op.Parent, op.Name) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.RmDir(ctx, op)
+	return
+}
+
+func (fs *trashFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) (err error) {
+	if isTrashChild(op.Parent, op.Name) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.Unlink(ctx, op)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Directories
+////////////////////////////////////////////////////////////////////////
+
+func (fs *trashFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) (err error) {
+	if !isTrashInode(op.Inode) {
+		err = fs.FileSystem.OpenDir(ctx, op)
+		return
+	}
+
+	in, err := fs.inode(op.Inode)
+	if err != nil {
+		return
+	}
+
+	if in.object != nil {
+		err = syscall.ENOTDIR
+		return
+	}
+
+	entries, err := fs.readEntries(ctx, in.name)
+	if err != nil {
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Handle = fs.nextHandle
+	fs.nextHandle++
+	fs.dirHandles[op.Handle] = entries
+
+	return
+}
+
+func (fs *trashFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) (err error) {
+	if !isTrashHandle(op.Handle) {
+		err = fs.FileSystem.ReadDir(ctx, op)
+		return
+	}
+
+	fs.mu.Lock()
+	entries := fs.dirHandles[op.Handle]
+	fs.mu.Unlock()
+
+	if int(op.Offset) > len(entries) {
+		err = fuse.EINVAL
+		return
+	}
+
+	for _, e := range entries[op.Offset:] {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], e)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return
+}
+
+func (fs *trashFileSystem) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) (err error) {
+	if !isTrashHandle(op.Handle) {
+		err = fs.FileSystem.ReleaseDirHandle(ctx, op)
+		return
+	}
+
+	fs.mu.Lock()
+	delete(fs.dirHandles, op.Handle)
+	fs.mu.Unlock()
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Files
+////////////////////////////////////////////////////////////////////////
+
+func (fs *trashFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	if !isTrashInode(op.Inode) {
+		err = fs.FileSystem.OpenFile(ctx, op)
+		return
+	}
+
+	// The contents of soft-deleted objects can't be read.
+	err = syscall.EACCES
+	return
+}
+
+func (fs *trashFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) (err error) {
+	if !isTrashHandle(op.SrcHandle) && !isTrashHandle(op.DstHandle) {
+		err = fs.FileSystem.CopyFileRange(ctx, op)
+		return
+	}
+
+	// Let the kernel fall back to reading and writing.
+	err = syscall.EOPNOTSUPP
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Extended attributes
+////////////////////////////////////////////////////////////////////////
+
+func (fs *trashFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) (err error) {
+	if !isTrashInode(op.Inode) {
+		err = fs.FileSystem.GetXattr(ctx, op)
+		return
+	}
+
+	err = fuse.ENOATTR
+	return
+}
+
+func (fs *trashFileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) (err error) {
+	if !isTrashInode(op.Inode) {
+		err = fs.FileSystem.ListXattr(ctx, op)
+		return
+	}
+
+	return
+}
+
+func (fs *trashFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) (err error) {
+	if !isTrashInode(op.Inode) {
+		err = fs.FileSystem.SetXattr(ctx, op)
+		return
+	}
+
+	err = syscall.EPERM
+	return
+}
+
+func (fs *trashFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) (err error) {
+	if !isTrashInode(op.Inode) {
+		err = fs.FileSystem.RemoveXattr(ctx, op)
+		return
+	}
+
+	err = syscall.EPERM
+	return
+}
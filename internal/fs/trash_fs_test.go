@@ -0,0 +1,366 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/gcloud/gcs"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestTrashFileSystem(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// The ID of the directory "dir" in fakeTrashWrapped.
+const trashTestDirInodeID = fuseops.InodeID(17)
+
+// A file system in which the root holds a directory named "dir", recording
+// renames and the lookups not yet forgotten.
+type fakeTrashWrapped struct {
+	fuseutil.NotImplementedFileSystem
+
+	renames []fuseops.RenameOp
+	lookups int
+}
+
+func (fs *fakeTrashWrapped) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	if op.Parent != fuseops.RootInodeID || op.Name != "dir" {
+		err = fuse.ENOENT
+		return
+	}
+
+	fs.lookups++
+	op.Entry.Child = trashTestDirInodeID
+	op.Entry.Attributes.Mode = 0700 | os.ModeDir
+	return
+}
+
+func (fs *fakeTrashWrapped) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) (err error) {
+	fs.lookups -= int(op.N)
+	return
+}
+
+func (fs *fakeTrashWrapped) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) (err error) {
+	fs.renames = append(fs.renames, *op)
+	return
+}
+
+// A fake of the soft-deleted objects of a bucket, in which the names of live
+// objects are recorded.
+type fakeSoftDeletedObjects struct {
+	objects []*gcsx.SoftDeletedObject
+	live    map[string]bool
+}
+
+func (s *fakeSoftDeletedObjects) ListSoftDeleted(
+	ctx context.Context,
+	prefix string,
+	delimiter string) (objects []*gcsx.SoftDeletedObject, runs []string, err error) {
+	seen := make(map[string]bool)
+	for _, o := range s.objects {
+		if !strings.HasPrefix(o.Name, prefix) {
+			continue
+		}
+
+		rest := o.Name[len(prefix):]
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			run := prefix + rest[:i+1]
+			if !seen[run] {
+				seen[run] = true
+				runs = append(runs, run)
+			}
+
+			continue
+		}
+
+		objects = append(objects, o)
+	}
+
+	return
+}
+
+func (s *fakeSoftDeletedObjects) RestoreObject(
+	ctx context.Context,
+	name string,
+	generation int64,
+	mustNotExist bool) (err error) {
+	for i, o := range s.objects {
+		if o.Name != name || o.Generation != generation {
+			continue
+		}
+
+		if mustNotExist && s.live[name] {
+			err = &gcs.PreconditionError{}
+			return
+		}
+
+		s.objects = append(s.objects[:i], s.objects[i+1:]...)
+		s.live[name] = true
+		return
+	}
+
+	err = &gcs.NotFoundError{}
+	return
+}
+
+type TrashFileSystemTest struct {
+	ctx     context.Context
+	deleted fakeSoftDeletedObjects
+	wrapped fakeTrashWrapped
+	fs      fuseutil.FileSystem
+}
+
+var _ SetUpInterface = &TrashFileSystemTest{}
+
+func init() { RegisterTestSuite(&TrashFileSystemTest{}) }
+
+func (t *TrashFileSystemTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+
+	// "foo" has been deleted twice, and "dir/bar" once.
+	t0 := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	t.deleted.objects = []*gcsx.SoftDeletedObject{
+		{
+			Name:           "foo",
+			Generation:     2,
+			Size:           7,
+			Updated:        t0,
+			SoftDeleteTime: t0.Add(2 * time.Hour),
+		},
+		{
+			Name:           "foo",
+			Generation:     1,
+			Size:           4,
+			Updated:        t0,
+			SoftDeleteTime: t0.Add(time.Hour),
+		},
+		{
+			Name:           "dir/bar",
+			Generation:     3,
+			Updated:        t0,
+			SoftDeleteTime: t0,
+		},
+	}
+
+	t.deleted.live = make(map[string]bool)
+	t.fs = newTrashFileSystem(&t.wrapped, &t.deleted, 123, 456)
+}
+
+// Look up the named child of the given parent, returning its inode ID.
+func (t *TrashFileSystemTest) lookUp(
+	parent fuseops.InodeID,
+	name string) (id fuseops.InodeID, err error) {
+	op := &fuseops.LookUpInodeOp{Parent: parent, Name: name}
+	err = t.fs.LookUpInode(t.ctx, op)
+	id = op.Entry.Child
+	return
+}
+
+// Read the listing of the given directory.
+func (t *TrashFileSystemTest) readDir(
+	id fuseops.InodeID) (s string, err error) {
+	openOp := &fuseops.OpenDirOp{Inode: id}
+	err = t.fs.OpenDir(t.ctx, openOp)
+	if err != nil {
+		return
+	}
+
+	readOp := &fuseops.ReadDirOp{
+		Inode:  id,
+		Handle: openOp.Handle,
+		Dst:    make([]byte, 4096),
+	}
+
+	err = t.fs.ReadDir(t.ctx, readOp)
+	if err != nil {
+		return
+	}
+
+	s = string(readOp.Dst[:readOp.BytesRead])
+	err = t.fs.ReleaseDirHandle(
+		t.ctx,
+		&fuseops.ReleaseDirHandleOp{Handle: openOp.Handle})
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *TrashFileSystemTest) LookUpDirectory() {
+	op := &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   TrashDirName,
+	}
+
+	err := t.fs.LookUpInode(t.ctx, op)
+	AssertEq(nil, err)
+
+	ExpectEq(trashDirInodeID, op.Entry.Child)
+	ExpectEq(0555|os.ModeDir, op.Entry.Attributes.Mode)
+	ExpectEq(123, op.Entry.Attributes.Uid)
+	ExpectEq(456, op.Entry.Attributes.Gid)
+}
+
+func (t *TrashFileSystemTest) ListsDeletedObjects() {
+	s, err := t.readDir(trashDirInodeID)
+
+	AssertEq(nil, err)
+	ExpectEq(versionsListing(file("foo"), dir("dir")), s)
+
+	id, err := t.lookUp(trashDirInodeID, "dir")
+	AssertEq(nil, err)
+
+	s, err = t.readDir(id)
+
+	AssertEq(nil, err)
+	ExpectEq(versionsListing(file("bar")), s)
+}
+
+func (t *TrashFileSystemTest) ShowsNewestDeletion() {
+	op := &fuseops.LookUpInodeOp{Parent: trashDirInodeID, Name: "foo"}
+
+	AssertEq(nil, t.fs.LookUpInode(t.ctx, op))
+	ExpectEq(0444, op.Entry.Attributes.Mode)
+	ExpectEq(7, op.Entry.Attributes.Size)
+	ExpectEq(5, op.Entry.Attributes.Ctime.Hour())
+}
+
+func (t *TrashFileSystemTest) UnknownNames() {
+	_, err := t.lookUp(trashDirInodeID, "bar")
+	ExpectEq(fuse.ENOENT, err)
+
+	_, err = t.lookUp(trashDirInodeID, "di")
+	ExpectEq(fuse.ENOENT, err)
+}
+
+func (t *TrashFileSystemTest) RestoresInPlace() {
+	dir, err := t.lookUp(trashDirInodeID, "dir")
+	AssertEq(nil, err)
+
+	err = t.fs.Rename(
+		t.ctx,
+		&fuseops.RenameOp{
+			OldParent: dir,
+			OldName:   "bar",
+			NewParent: trashTestDirInodeID,
+			NewName:   "bar",
+		})
+
+	AssertEq(nil, err)
+	ExpectTrue(t.deleted.live["dir/bar"])
+	ExpectEq(0, len(t.wrapped.renames))
+	ExpectEq(0, t.wrapped.lookups)
+
+	_, err = t.lookUp(dir, "bar")
+	ExpectEq(fuse.ENOENT, err)
+}
+
+func (t *TrashFileSystemTest) RestoresElsewhere() {
+	err := t.fs.Rename(
+		t.ctx,
+		&fuseops.RenameOp{
+			OldParent: trashDirInodeID,
+			OldName:   "foo",
+			NewParent: trashTestDirInodeID,
+			NewName:   "baz",
+		})
+
+	AssertEq(nil, err)
+	ExpectTrue(t.deleted.live["foo"])
+	AssertEq(2, len(t.deleted.objects))
+	ExpectEq(1, t.deleted.objects[0].Generation)
+
+	AssertEq(1, len(t.wrapped.renames))
+	ExpectEq(fuseops.RootInodeID, t.wrapped.renames[0].OldParent)
+	ExpectEq("foo", t.wrapped.renames[0].OldName)
+	ExpectEq(trashTestDirInodeID, t.wrapped.renames[0].NewParent)
+	ExpectEq("baz", t.wrapped.renames[0].NewName)
+}
+
+func (t *TrashFileSystemTest) WontRestoreElsewhereOverLiveObject() {
+	t.deleted.live["foo"] = true
+
+	err := t.fs.Rename(
+		t.ctx,
+		&fuseops.RenameOp{
+			OldParent: trashDirInodeID,
+			OldName:   "foo",
+			NewParent: trashTestDirInodeID,
+			NewName:   "baz",
+		})
+
+	ExpectEq(fuse.EEXIST, err)
+	ExpectEq(0, len(t.wrapped.renames))
+}
+
+func (t *TrashFileSystemTest) ModificationsRefused() {
+	id, err := t.lookUp(trashDirInodeID, "foo")
+	AssertEq(nil, err)
+
+	err = t.fs.OpenFile(
+		t.ctx,
+		&fuseops.OpenFileOp{Inode: id, Flags: syscall.O_RDONLY})
+
+	ExpectEq(syscall.EACCES, err)
+
+	err = t.fs.Unlink(
+		t.ctx,
+		&fuseops.UnlinkOp{Parent: trashDirInodeID, Name: "foo"})
+
+	ExpectEq(syscall.EPERM, err)
+
+	err = t.fs.Rename(
+		t.ctx,
+		&fuseops.RenameOp{
+			OldParent: fuseops.RootInodeID,
+			OldName:   "qux",
+			NewParent: trashDirInodeID,
+			NewName:   "qux",
+		})
+
+	ExpectEq(syscall.EPERM, err)
+
+	err = t.fs.Rename(
+		t.ctx,
+		&fuseops.RenameOp{
+			OldParent: trashDirInodeID,
+			OldName:   "dir",
+			NewParent: fuseops.RootInodeID,
+			NewName:   "dir",
+		})
+
+	ExpectEq(syscall.EPERM, err)
+}
@@ -0,0 +1,931 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// The name of the directory in the root through which every generation of
+// each object can be read, when ServerConfig.VersionsDir is set.
+const VersionsDirName = ".versions"
+
+// The versions directory and the inodes below it, and the handles opened on
+// them, get IDs from the third quarter of each ID space, below those of the
+// debug directory.
+const (
+	versionsDirInodeID    = fuseops.InodeID(1 << 62)
+	firstVersionsHandleID = fuseops.HandleID(1 << 62)
+)
+
+// Wrap the supplied file system so that its root directory also contains a
+// directory named VersionsDirName, which isn't listed. Below it, the directory
+// at path p stands for the object named p: it holds a read-only file for each
+// of the object's generations in the bucket, live or noncurrent, named by
+// generation number, along with a subdirectory for each name one level
+// further down. The directories and files belong to the given user and group.
+//
+// The directory shadows anything of the same name in the bucket.
+func newVersionsFileSystem(
+	wrapped fuseutil.FileSystem,
+	bucket gcs.Bucket,
+	skippedBuffers *gcsx.BufferPool,
+	uid uint32,
+	gid uint32) fuseutil.FileSystem {
+	fs := &versionsFileSystem{
+		FileSystem:     wrapped,
+		bucket:         bucket,
+		skippedBuffers: skippedBuffers,
+		uid:            uid,
+		gid:            gid,
+		created:        time.Now(),
+		inodes:         make(map[fuseops.InodeID]*versionsInode),
+		ids:            make(map[versionsKey]fuseops.InodeID),
+		nextInode:      versionsDirInodeID + 1,
+		dirHandles:     make(map[fuseops.HandleID][]fuseutil.Dirent),
+		fileHandles:    make(map[fuseops.HandleID]*versionsFileHandle),
+		nextHandle:     firstVersionsHandleID,
+	}
+
+	// The versions directory itself is never forgotten.
+	fs.inodes[versionsDirInodeID] = &versionsInode{}
+	fs.ids[versionsKey{}] = versionsDirInodeID
+
+	return fs
+}
+
+// Identifies an inode below the versions directory: a directory by the name
+// of the object it stands for, and a file by that and its generation.
+type versionsKey struct {
+	name       string
+	generation int64
+}
+
+type versionsInode struct {
+	// The name of the object that a directory stands for, or empty for the
+	// versions directory itself.
+	name string
+
+	// For a file, the generation whose contents it holds. Nil for a directory.
+	object *gcs.Object
+
+	// The number of lookups the kernel has yet to forget.
+	lookupCount uint64
+}
+
+type versionsFileHandle struct {
+	mu sync.Mutex
+	rr gcsx.RandomReader // GUARDED_BY(mu)
+}
+
+type versionsFileSystem struct {
+	fuseutil.FileSystem
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	bucket         gcs.Bucket
+	skippedBuffers *gcsx.BufferPool
+	uid            uint32
+	gid            uint32
+	created        time.Time
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The inodes that the kernel knows about, and their IDs.
+	//
+	// INVARIANT: For each k, v in ids: inodes[v] is the inode for k
+	//
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*versionsInode
+
+	// GUARDED_BY(mu)
+	ids map[versionsKey]fuseops.InodeID
+
+	// GUARDED_BY(mu)
+	nextInode fuseops.InodeID
+
+	// The listing taken when each directory handle was opened, and the reader
+	// for each file handle.
+	//
+	// GUARDED_BY(mu)
+	dirHandles map[fuseops.HandleID][]fuseutil.Dirent
+
+	// GUARDED_BY(mu)
+	fileHandles map[fuseops.HandleID]*versionsFileHandle
+
+	// GUARDED_BY(mu)
+	nextHandle fuseops.HandleID
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func isVersionsInode(id fuseops.InodeID) bool {
+	return id >= versionsDirInodeID && id < debugDirInodeID
+}
+
+func isVersionsHandle(id fuseops.HandleID) bool {
+	return id >= firstVersionsHandleID && id < firstDebugHandleID
+}
+
+// Is the child of the given parent with the given name the versions directory
+// or below it?
+func isVersionsChild(parent fuseops.InodeID, name string) bool {
+	return isVersionsInode(parent) ||
+		(parent == fuseops.RootInodeID && name == VersionsDirName)
+}
+
+// Return the prefix of the names of objects one level below the directory
+// standing for the named object.
+func versionsChildPrefix(name string) string {
+	if name == "" {
+		return ""
+	}
+
+	return name + "/"
+}
+
+// List every generation of every object whose name begins with the given
+// prefix, with names containing a further slash collapsed into runs.
+func (fs *versionsFileSystem) listAll(
+	ctx context.Context,
+	prefix string) (objects []*gcs.Object, runs []string, err error) {
+	req := &gcs.ListObjectsRequest{
+		Prefix:    prefix,
+		Delimiter: "/",
+		Versions:  true,
+	}
+
+	for {
+		var listing *gcs.Listing
+		listing, err = fs.bucket.ListObjects(ctx, req)
+		if err != nil {
+			err = fmt.Errorf("ListObjects: %v", err)
+			return
+		}
+
+		objects = append(objects, listing.Objects...)
+		runs = append(runs, listing.CollapsedRuns...)
+
+		if listing.ContinuationToken == "" {
+			return
+		}
+
+		req.ContinuationToken = listing.ContinuationToken
+	}
+}
+
+// Return the generations of the named object, oldest first.
+func (fs *versionsFileSystem) generations(
+	ctx context.Context,
+	name string) (gens []*gcs.Object, err error) {
+	objects, _, err := fs.listAll(ctx, name)
+	if err != nil {
+		return
+	}
+
+	for _, o := range objects {
+		if o.Name == name {
+			gens = append(gens, o)
+		}
+	}
+
+	return
+}
+
+// Return the sorted names of the subdirectories of the directory standing for
+// the named object, one for each name one level further down.
+func (fs *versionsFileSystem) children(
+	ctx context.Context,
+	name string) (names []string, err error) {
+	prefix := versionsChildPrefix(name)
+	objects, runs, err := fs.listAll(ctx, prefix)
+	if err != nil {
+		return
+	}
+
+	seen := make(map[string]bool)
+	add := func(component string) {
+		n := inode.EscapeName(component)
+		if !seen[n] {
+			seen[n] = true
+			names = append(names, n)
+		}
+	}
+
+	for _, o := range objects {
+		// Skip a placeholder object for the directory itself.
+		if o.Name != prefix {
+			add(o.Name[len(prefix):])
+		}
+	}
+
+	for _, r := range runs {
+		add(strings.TrimSuffix(r[len(prefix):], "/"))
+	}
+
+	sort.Strings(names)
+	return
+}
+
+// Find the child of the given directory with the given name: a file for a
+// generation of the object it stands for, or else a subdirectory if any
+// generation of an object has the child's name or lies below it.
+func (fs *versionsFileSystem) lookUpChild(
+	ctx context.Context,
+	parent *versionsInode,
+	name string) (key versionsKey, o *gcs.Object, err error) {
+	if parent.name != "" {
+		gen, parseErr := strconv.ParseInt(name, 10, 64)
+		if parseErr == nil && strconv.FormatInt(gen, 10) == name {
+			var gens []*gcs.Object
+			gens, err = fs.generations(ctx, parent.name)
+			if err != nil {
+				return
+			}
+
+			for _, g := range gens {
+				if g.Generation == gen {
+					key = versionsKey{parent.name, gen}
+					o = g
+					return
+				}
+			}
+		}
+	}
+
+	child := versionsChildPrefix(parent.name) + inode.UnescapeName(name)
+	gens, err := fs.generations(ctx, child)
+	if err != nil {
+		return
+	}
+
+	if len(gens) == 0 {
+		var listing *gcs.Listing
+		listing, err = fs.bucket.ListObjects(
+			ctx,
+			&gcs.ListObjectsRequest{
+				Prefix:     child + "/",
+				Versions:   true,
+				MaxResults: 1,
+			})
+
+		if err != nil {
+			err = fmt.Errorf("ListObjects: %v", err)
+			return
+		}
+
+		if len(listing.Objects) == 0 {
+			err = fuse.ENOENT
+			return
+		}
+	}
+
+	key = versionsKey{name: child}
+	return
+}
+
+// Return the entries of the directory standing for the named object: its
+// generations, then its subdirectories.
+func (fs *versionsFileSystem) readEntries(
+	ctx context.Context,
+	name string) (entries []fuseutil.Dirent, err error) {
+	var gens []*gcs.Object
+	if name != "" {
+		gens, err = fs.generations(ctx, name)
+		if err != nil {
+			return
+		}
+	}
+
+	children, err := fs.children(ctx, name)
+	if err != nil {
+		return
+	}
+
+	// A generation shadows a subdirectory of the same name.
+	taken := make(map[string]bool)
+	for _, o := range gens {
+		n := strconv.FormatInt(o.Generation, 10)
+		taken[n] = true
+		entries = append(entries, fuseutil.Dirent{
+			Name: n,
+			Type: fuseutil.DT_File,
+		})
+	}
+
+	for _, n := range children {
+		if !taken[n] {
+			entries = append(entries, fuseutil.Dirent{
+				Name: n,
+				Type: fuseutil.DT_Directory,
+			})
+		}
+	}
+
+	for i := range entries {
+		entries[i].Offset = fuseops.DirOffset(i + 1)
+	}
+
+	return
+}
+
+func (fs *versionsFileSystem) attributes(
+	in *versionsInode) (attrs fuseops.InodeAttributes) {
+	attrs = fuseops.InodeAttributes{
+		Nlink:  2,
+		Mode:   0555 | os.ModeDir,
+		Atime:  fs.created,
+		Mtime:  fs.created,
+		Ctime:  fs.created,
+		Crtime: fs.created,
+		Uid:    fs.uid,
+		Gid:    fs.gid,
+	}
+
+	// A file's times are those at which its generation was written.
+	if in.object != nil {
+		attrs.Nlink = 1
+		attrs.Mode = 0444
+		attrs.Size = in.object.Size
+		attrs.Atime = in.object.Updated
+		attrs.Mtime = in.object.Updated
+		attrs.Ctime = in.object.Updated
+		attrs.Crtime = in.object.Updated
+	}
+
+	return
+}
+
+// Look up the inode with the given ID, or fail with ENOENT for one that the
+// kernel has forgotten.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *versionsFileSystem) inode(
+	id fuseops.InodeID) (in versionsInode, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	p, ok := fs.inodes[id]
+	if !ok {
+		err = fuse.ENOENT
+		return
+	}
+
+	in = *p
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Names
+////////////////////////////////////////////////////////////////////////
+
+func (fs *versionsFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	var key versionsKey
+	var o *gcs.Object
+	switch {
+	case op.Parent == fuseops.RootInodeID && op.Name == VersionsDirName:
+
+	case isVersionsInode(op.Parent):
+		var parent versionsInode
+		parent, err = fs.inode(op.Parent)
+		if err != nil {
+			return
+		}
+
+		key, o, err = fs.lookUpChild(ctx, &parent, op.Name)
+		if err != nil {
+			return
+		}
+
+	default:
+		err = fs.FileSystem.LookUpInode(ctx, op)
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	id, ok := fs.ids[key]
+	if !ok {
+		id = fs.nextInode
+		fs.nextInode++
+		fs.ids[key] = id
+		fs.inodes[id] = &versionsInode{name: key.name, object: o}
+	}
+
+	in := fs.inodes[id]
+	in.lookupCount++
+
+	// Nothing is cached by the kernel, so that new generations show up.
+	op.Entry.Child = id
+	op.Entry.Attributes = fs.attributes(in)
+	return
+}
+
+func (fs *versionsFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	if !isVersionsInode(op.Inode) {
+		err = fs.FileSystem.GetInodeAttributes(ctx, op)
+		return
+	}
+
+	in, err := fs.inode(op.Inode)
+	if err != nil {
+		return
+	}
+
+	op.Attributes = fs.attributes(&in)
+	return
+}
+
+func (fs *versionsFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) (err error) {
+	if !isVersionsInode(op.Inode) {
+		err = fs.FileSystem.SetInodeAttributes(ctx, op)
+		return
+	}
+
+	err = syscall.EPERM
+	return
+}
+
+func (fs *versionsFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) (err error) {
+	if !isVersionsInode(op.Inode) {
+		err = fs.FileSystem.ForgetInode(ctx, op)
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in, ok := fs.inodes[op.Inode]
+	if !ok || op.Inode == versionsDirInodeID {
+		return
+	}
+
+	if op.N < in.lookupCount {
+		in.lookupCount -= op.N
+		return
+	}
+
+	var generation int64
+	if in.object != nil {
+		generation = in.object.Generation
+	}
+
+	delete(fs.ids, versionsKey{in.name, generation})
+	delete(fs.inodes, op.Inode)
+	return
+}
+
+func (fs *versionsFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) (err error) {
+	if isVersionsChild(op.Parent, op.Name) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.MkDir(ctx, op)
+	return
+}
+
+func (fs *versionsFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) (err error) {
+	if isVersionsChild(op.Parent, op.Name) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.MkNode(ctx, op)
+	return
+}
+
+func (fs *versionsFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) (err error) {
+	if isVersionsChild(op.Parent, op.Name) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.CreateFile(ctx, op)
+	return
+}
+
+func (fs *versionsFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) (err error) {
+	if isVersionsChild(op.Parent, op.Name) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.CreateSymlink(ctx, op)
+	return
+}
+
+func (fs *versionsFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) (err error) {
+	if isVersionsChild(op.Parent, op.Name) || isVersionsInode(op.Target) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.CreateLink(ctx, op)
+	return
+}
+
+func (fs *versionsFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) (err error) {
+	if isVersionsChild(op.OldParent, op.OldName) ||
+		isVersionsChild(op.NewParent, op.NewName) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.Rename(ctx, op)
+	return
+}
+
+func (fs *versionsFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) (err error) {
+	if isVersionsChild(op.Parent, op.Name) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.RmDir(ctx, op)
+	return
+}
+
+func (fs *versionsFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) (err error) {
+	if isVersionsChild(op.Parent, op.Name) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = fs.FileSystem.Unlink(ctx, op)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Directories
+////////////////////////////////////////////////////////////////////////
+
+func (fs *versionsFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) (err error) {
+	if !isVersionsInode(op.Inode) {
+		err = fs.FileSystem.OpenDir(ctx, op)
+		return
+	}
+
+	in, err := fs.inode(op.Inode)
+	if err != nil {
+		return
+	}
+
+	entries, err := fs.readEntries(ctx, in.name)
+	if err != nil {
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Handle = fs.nextHandle
+	fs.nextHandle++
+	fs.dirHandles[op.Handle] = entries
+
+	return
+}
+
+func (fs *versionsFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) (err error) {
+	if !isVersionsHandle(op.Handle) {
+		err = fs.FileSystem.ReadDir(ctx, op)
+		return
+	}
+
+	fs.mu.Lock()
+	entries := fs.dirHandles[op.Handle]
+	fs.mu.Unlock()
+
+	if int(op.Offset) > len(entries) {
+		err = fuse.EINVAL
+		return
+	}
+
+	for _, e := range entries[op.Offset:] {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], e)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return
+}
+
+func (fs *versionsFileSystem) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) (err error) {
+	if !isVersionsHandle(op.Handle) {
+		err = fs.FileSystem.ReleaseDirHandle(ctx, op)
+		return
+	}
+
+	fs.mu.Lock()
+	delete(fs.dirHandles, op.Handle)
+	fs.mu.Unlock()
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Files
+////////////////////////////////////////////////////////////////////////
+
+func (fs *versionsFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	if !isVersionsInode(op.Inode) {
+		err = fs.FileSystem.OpenFile(ctx, op)
+		return
+	}
+
+	if op.Flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		err = syscall.EACCES
+		return
+	}
+
+	in, err := fs.inode(op.Inode)
+	if err != nil {
+		return
+	}
+
+	if in.object == nil {
+		err = syscall.EISDIR
+		return
+	}
+
+	rr, err := gcsx.NewRandomReader(in.object, fs.bucket, fs.skippedBuffers)
+	if err != nil {
+		err = fmt.Errorf("NewRandomReader: %v", err)
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Handle = fs.nextHandle
+	fs.nextHandle++
+	fs.fileHandles[op.Handle] = &versionsFileHandle{rr: rr}
+
+	// A generation's contents never change.
+	op.KeepPageCache = true
+
+	return
+}
+
+func (fs *versionsFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	if !isVersionsHandle(op.Handle) {
+		err = fs.FileSystem.ReadFile(ctx, op)
+		return
+	}
+
+	fs.mu.Lock()
+	h := fs.fileHandles[op.Handle]
+	fs.mu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	op.BytesRead, err = h.rr.ReadAt(ctx, op.Dst, op.Offset)
+	if err == io.EOF {
+		err = nil
+	}
+
+	return
+}
+
+func (fs *versionsFileSystem) SeekFile(
+	ctx context.Context,
+	op *fuseops.SeekFileOp) (err error) {
+	if !isVersionsHandle(op.Handle) {
+		err = fs.FileSystem.SeekFile(ctx, op)
+		return
+	}
+
+	fs.mu.Lock()
+	h := fs.fileHandles[op.Handle]
+	fs.mu.Unlock()
+
+	h.mu.Lock()
+	size := int64(h.rr.Object().Size)
+	h.mu.Unlock()
+
+	op.NewOffset, err = gcsx.SeekExtents(
+		gcsx.DataExtents(nil, size),
+		size,
+		op.Offset,
+		op.Whence == fuseops.SeekHole)
+
+	return
+}
+
+// Locks on past generations aren't supported.
+func (fs *versionsFileSystem) GetFileLock(
+	ctx context.Context,
+	op *fuseops.GetFileLockOp) (err error) {
+	if !isVersionsHandle(op.Handle) {
+		err = fs.FileSystem.GetFileLock(ctx, op)
+		return
+	}
+
+	err = syscall.ENOLCK
+	return
+}
+
+func (fs *versionsFileSystem) SetFileLock(
+	ctx context.Context,
+	op *fuseops.SetFileLockOp) (err error) {
+	if !isVersionsHandle(op.Handle) {
+		err = fs.FileSystem.SetFileLock(ctx, op)
+		return
+	}
+
+	err = syscall.ENOLCK
+	return
+}
+
+func (fs *versionsFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) (err error) {
+	if !isVersionsHandle(op.Handle) {
+		err = fs.FileSystem.WriteFile(ctx, op)
+		return
+	}
+
+	err = syscall.EBADF
+	return
+}
+
+func (fs *versionsFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) (err error) {
+	if !isVersionsInode(op.Inode) {
+		err = fs.FileSystem.SyncFile(ctx, op)
+		return
+	}
+
+	return
+}
+
+func (fs *versionsFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) (err error) {
+	if !isVersionsHandle(op.Handle) {
+		err = fs.FileSystem.FlushFile(ctx, op)
+		return
+	}
+
+	return
+}
+
+func (fs *versionsFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) (err error) {
+	if !isVersionsHandle(op.Handle) {
+		err = fs.FileSystem.ReleaseFileHandle(ctx, op)
+		return
+	}
+
+	fs.mu.Lock()
+	h := fs.fileHandles[op.Handle]
+	delete(fs.fileHandles, op.Handle)
+	fs.mu.Unlock()
+
+	h.mu.Lock()
+	h.rr.Destroy()
+	h.mu.Unlock()
+
+	return
+}
+
+func (fs *versionsFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) (err error) {
+	if !isVersionsHandle(op.SrcHandle) && !isVersionsHandle(op.DstHandle) {
+		err = fs.FileSystem.CopyFileRange(ctx, op)
+		return
+	}
+
+	// Let the kernel fall back to reading and writing.
+	err = syscall.EOPNOTSUPP
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Extended attributes
+////////////////////////////////////////////////////////////////////////
+
+func (fs *versionsFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) (err error) {
+	if !isVersionsInode(op.Inode) {
+		err = fs.FileSystem.GetXattr(ctx, op)
+		return
+	}
+
+	err = fuse.ENOATTR
+	return
+}
+
+func (fs *versionsFileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) (err error) {
+	if !isVersionsInode(op.Inode) {
+		err = fs.FileSystem.ListXattr(ctx, op)
+		return
+	}
+
+	return
+}
+
+func (fs *versionsFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) (err error) {
+	if !isVersionsInode(op.Inode) {
+		err = fs.FileSystem.SetXattr(ctx, op)
+		return
+	}
+
+	err = syscall.EPERM
+	return
+}
+
+func (fs *versionsFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) (err error) {
+	if !isVersionsInode(op.Inode) {
+		err = fs.FileSystem.RemoveXattr(ctx, op)
+		return
+	}
+
+	err = syscall.EPERM
+	return
+}
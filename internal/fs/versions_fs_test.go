@@ -0,0 +1,303 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestVersionsFileSystem(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type VersionsFileSystemTest struct {
+	ctx    context.Context
+	bucket gcs.Bucket
+
+	// Records for the two generations of "foo".
+	foo1 *gcs.Object
+	foo2 *gcs.Object
+
+	fs fuseutil.FileSystem
+}
+
+var _ SetUpInterface = &VersionsFileSystemTest{}
+
+func init() { RegisterTestSuite(&VersionsFileSystemTest{}) }
+
+func (t *VersionsFileSystemTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+	t.bucket = gcsfake.NewVersionedFakeBucket(timeutil.RealClock(), "")
+
+	// "foo" has been overwritten, "bar" deleted, and "dir/baz" left alone.
+	t.foo1, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	t.foo2, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("burrito"))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "bar", []byte(""))
+	AssertEq(nil, err)
+
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "bar"})
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "dir/baz", []byte(""))
+	AssertEq(nil, err)
+
+	t.fs = newVersionsFileSystem(
+		&fuseutil.NotImplementedFileSystem{},
+		t.bucket,
+		nil,
+		123,
+		456)
+}
+
+// Look up the named child of the given parent, returning its inode ID.
+func (t *VersionsFileSystemTest) lookUp(
+	parent fuseops.InodeID,
+	name string) (id fuseops.InodeID, err error) {
+	op := &fuseops.LookUpInodeOp{Parent: parent, Name: name}
+	err = t.fs.LookUpInode(t.ctx, op)
+	id = op.Entry.Child
+	return
+}
+
+// Return the listing that the supplied entries make, in order.
+func versionsListing(entries ...fuseutil.Dirent) string {
+	var b []byte
+	for i, e := range entries {
+		e.Offset = fuseops.DirOffset(i + 1)
+		buf := make([]byte, 1024)
+		b = append(b, buf[:fuseutil.WriteDirent(buf, e)]...)
+	}
+
+	return string(b)
+}
+
+// Read the listing of the given directory.
+func (t *VersionsFileSystemTest) readDir(
+	id fuseops.InodeID) (s string, err error) {
+	openOp := &fuseops.OpenDirOp{Inode: id}
+	err = t.fs.OpenDir(t.ctx, openOp)
+	if err != nil {
+		return
+	}
+
+	readOp := &fuseops.ReadDirOp{
+		Inode:  id,
+		Handle: openOp.Handle,
+		Dst:    make([]byte, 4096),
+	}
+
+	err = t.fs.ReadDir(t.ctx, readOp)
+	if err != nil {
+		return
+	}
+
+	s = string(readOp.Dst[:readOp.BytesRead])
+	err = t.fs.ReleaseDirHandle(
+		t.ctx,
+		&fuseops.ReleaseDirHandleOp{Handle: openOp.Handle})
+
+	return
+}
+
+// Open and read the whole of the given file.
+func (t *VersionsFileSystemTest) readFile(
+	id fuseops.InodeID) (s string, err error) {
+	openOp := &fuseops.OpenFileOp{Inode: id, Flags: syscall.O_RDONLY}
+	err = t.fs.OpenFile(t.ctx, openOp)
+	if err != nil {
+		return
+	}
+
+	AssertTrue(openOp.KeepPageCache)
+
+	readOp := &fuseops.ReadFileOp{
+		Inode:  id,
+		Handle: openOp.Handle,
+		Dst:    make([]byte, 1024),
+	}
+
+	err = t.fs.ReadFile(t.ctx, readOp)
+	if err != nil {
+		return
+	}
+
+	s = string(readOp.Dst[:readOp.BytesRead])
+	err = t.fs.ReleaseFileHandle(
+		t.ctx,
+		&fuseops.ReleaseFileHandleOp{Handle: openOp.Handle})
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *VersionsFileSystemTest) LookUpDirectory() {
+	op := &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   VersionsDirName,
+	}
+
+	err := t.fs.LookUpInode(t.ctx, op)
+	AssertEq(nil, err)
+
+	ExpectEq(versionsDirInodeID, op.Entry.Child)
+	ExpectEq(0555|os.ModeDir, op.Entry.Attributes.Mode)
+	ExpectEq(123, op.Entry.Attributes.Uid)
+	ExpectEq(456, op.Entry.Attributes.Gid)
+}
+
+func (t *VersionsFileSystemTest) OtherNamesPassThrough() {
+	_, err := t.lookUp(fuseops.RootInodeID, "foo")
+	ExpectEq(fuse.ENOSYS, err)
+}
+
+func (t *VersionsFileSystemTest) ListsNamesIncludingDeleted() {
+	s, err := t.readDir(versionsDirInodeID)
+
+	AssertEq(nil, err)
+	ExpectEq(versionsListing(dir("bar"), dir("dir"), dir("foo")), s)
+}
+
+func (t *VersionsFileSystemTest) ListsGenerations() {
+	id, err := t.lookUp(versionsDirInodeID, "foo")
+	AssertEq(nil, err)
+
+	s, err := t.readDir(id)
+
+	AssertEq(nil, err)
+	ExpectEq(
+		versionsListing(
+			file(strconv.FormatInt(t.foo1.Generation, 10)),
+			file(strconv.FormatInt(t.foo2.Generation, 10))),
+		s)
+}
+
+func (t *VersionsFileSystemTest) ListsSubdirectories() {
+	id, err := t.lookUp(versionsDirInodeID, "dir")
+	AssertEq(nil, err)
+
+	s, err := t.readDir(id)
+
+	AssertEq(nil, err)
+	ExpectEq(versionsListing(dir("baz")), s)
+}
+
+func (t *VersionsFileSystemTest) ReadsOldGeneration() {
+	dir, err := t.lookUp(versionsDirInodeID, "foo")
+	AssertEq(nil, err)
+
+	op := &fuseops.LookUpInodeOp{
+		Parent: dir,
+		Name:   strconv.FormatInt(t.foo1.Generation, 10),
+	}
+
+	AssertEq(nil, t.fs.LookUpInode(t.ctx, op))
+	ExpectEq(0444, op.Entry.Attributes.Mode)
+	ExpectEq(len("taco"), op.Entry.Attributes.Size)
+	ExpectThat(op.Entry.Attributes.Mtime, timeutil.TimeEq(t.foo1.Updated))
+
+	s, err := t.readFile(op.Entry.Child)
+
+	AssertEq(nil, err)
+	ExpectEq("taco", s)
+}
+
+func (t *VersionsFileSystemTest) UnknownNames() {
+	_, err := t.lookUp(versionsDirInodeID, "qux")
+	ExpectEq(fuse.ENOENT, err)
+
+	dir, err := t.lookUp(versionsDirInodeID, "foo")
+	AssertEq(nil, err)
+
+	_, err = t.lookUp(dir, "17")
+	ExpectEq(fuse.ENOENT, err)
+
+	_, err = t.lookUp(dir, "0"+strconv.FormatInt(t.foo1.Generation, 10))
+	ExpectEq(fuse.ENOENT, err)
+}
+
+func (t *VersionsFileSystemTest) SameInodeUntilForgotten() {
+	id1, err := t.lookUp(versionsDirInodeID, "foo")
+	AssertEq(nil, err)
+
+	id2, err := t.lookUp(versionsDirInodeID, "foo")
+	AssertEq(nil, err)
+	ExpectEq(id1, id2)
+
+	err = t.fs.ForgetInode(
+		t.ctx,
+		&fuseops.ForgetInodeOp{Inode: id1, N: 2})
+
+	AssertEq(nil, err)
+
+	err = t.fs.GetInodeAttributes(
+		t.ctx,
+		&fuseops.GetInodeAttributesOp{Inode: id1})
+
+	ExpectEq(fuse.ENOENT, err)
+}
+
+func (t *VersionsFileSystemTest) ModificationsRefused() {
+	dir, err := t.lookUp(versionsDirInodeID, "foo")
+	AssertEq(nil, err)
+
+	id, err := t.lookUp(dir, strconv.FormatInt(t.foo2.Generation, 10))
+	AssertEq(nil, err)
+
+	err = t.fs.OpenFile(
+		t.ctx,
+		&fuseops.OpenFileOp{Inode: id, Flags: syscall.O_RDWR})
+
+	ExpectEq(syscall.EACCES, err)
+
+	err = t.fs.CreateFile(
+		t.ctx,
+		&fuseops.CreateFileOp{Parent: dir, Name: "bar"})
+
+	ExpectEq(syscall.EPERM, err)
+
+	err = t.fs.Rename(
+		t.ctx,
+		&fuseops.RenameOp{
+			OldParent: dir,
+			OldName:   strconv.FormatInt(t.foo2.Generation, 10),
+			NewParent: fuseops.RootInodeID,
+			NewName:   "foo",
+		})
+
+	ExpectEq(syscall.EPERM, err)
+}
@@ -0,0 +1,244 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tests for extended attributes, using the Linux system calls directly.
+
+package fs_test
+
+import (
+	"encoding/json"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/jacobsa/gcloud/gcs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func getXattr(p string, name string) (value string, err error) {
+	n, err := syscall.Getxattr(p, name, nil)
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, n)
+	n, err = syscall.Getxattr(p, name, buf)
+	if err != nil {
+		return
+	}
+
+	value = string(buf[:n])
+	return
+}
+
+func listXattr(p string) (names []string, err error) {
+	n, err := syscall.Listxattr(p, nil)
+	if err != nil || n == 0 {
+		return
+	}
+
+	buf := make([]byte, n)
+	n, err = syscall.Listxattr(p, buf)
+	if err != nil {
+		return
+	}
+
+	names = strings.Split(strings.TrimSuffix(string(buf[:n]), "\x00"), "\x00")
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type XattrTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&XattrTest{}) }
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *XattrTest) ObjectProperties() {
+	o, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:        "foo",
+			ContentType: "text/plain",
+			Contents:    strings.NewReader("taco"),
+		})
+
+	AssertEq(nil, err)
+
+	p := path.Join(t.mfs.Dir(), "foo")
+
+	v, err := getXattr(p, "user.gcs.generation")
+	AssertEq(nil, err)
+	ExpectEq(strconv.FormatInt(o.Generation, 10), v)
+
+	v, err = getXattr(p, "user.gcs.metageneration")
+	AssertEq(nil, err)
+	ExpectEq(strconv.FormatInt(o.MetaGeneration, 10), v)
+
+	v, err = getXattr(p, "user.gcs.content_type")
+	AssertEq(nil, err)
+	ExpectEq("text/plain", v)
+
+	// Unset properties are missing.
+	_, err = getXattr(p, "user.gcs.content_language")
+	ExpectEq(syscall.ENODATA, err)
+
+	_, err = getXattr(p, "user.gcs.taco")
+	ExpectEq(syscall.ENODATA, err)
+}
+
+func (t *XattrTest) ListFileAttributes() {
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+
+	names, err := listXattr(path.Join(t.mfs.Dir(), "foo"))
+	AssertEq(nil, err)
+
+	ExpectThat(names, Contains("user.gcs.generation"))
+	ExpectThat(names, Contains("user.gcs.crc32c"))
+	ExpectThat(names, Contains("user.gcsfuse.stats"))
+	ExpectThat(names, Not(Contains("user.gcs.content_language")))
+	ExpectThat(names, Not(Contains("user.gcsfuse.fadvise")))
+}
+
+func (t *XattrTest) Directories() {
+	AssertEq(nil, t.createEmptyObjects([]string{"dir/"}))
+	p := path.Join(t.mfs.Dir(), "dir")
+
+	names, err := listXattr(p)
+	AssertEq(nil, err)
+	ExpectEq(0, len(names))
+
+	_, err = getXattr(p, "user.gcs.generation")
+	ExpectEq(syscall.ENODATA, err)
+}
+
+func (t *XattrTest) Stats() {
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+
+	v, err := getXattr(path.Join(t.mfs.Dir(), "foo"), "user.gcsfuse.stats")
+	AssertEq(nil, err)
+
+	var s inode.FileStats
+	AssertEq(nil, json.Unmarshal([]byte(v), &s))
+	ExpectEq("", s.LastError)
+}
+
+func (t *XattrTest) SetAndRemoveCustomMetadata() {
+	var err error
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+	p := path.Join(t.mfs.Dir(), "foo")
+
+	// Set an attribute.
+	err = syscall.Setxattr(p, "user.pipeline_status", []byte("done"), 0)
+	AssertEq(nil, err)
+
+	v, err := getXattr(p, "user.pipeline_status")
+	AssertEq(nil, err)
+	ExpectEq("done", v)
+
+	names, err := listXattr(p)
+	AssertEq(nil, err)
+	ExpectThat(names, Contains("user.pipeline_status"))
+
+	// It should be custom metadata on the object.
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq("done", o.Metadata["pipeline_status"])
+
+	// Remove it.
+	err = syscall.Removexattr(p, "user.pipeline_status")
+	AssertEq(nil, err)
+
+	_, err = getXattr(p, "user.pipeline_status")
+	ExpectEq(syscall.ENODATA, err)
+
+	o, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	_, ok := o.Metadata["pipeline_status"]
+	ExpectFalse(ok)
+
+	// Removing it again fails.
+	err = syscall.Removexattr(p, "user.pipeline_status")
+	ExpectEq(syscall.ENODATA, err)
+}
+
+func (t *XattrTest) CreateAndReplaceFlags() {
+	var err error
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+	p := path.Join(t.mfs.Dir(), "foo")
+
+	const xattrCreate = 0x1
+	const xattrReplace = 0x2
+
+	err = syscall.Setxattr(p, "user.label", []byte("a"), xattrReplace)
+	ExpectEq(syscall.ENODATA, err)
+
+	err = syscall.Setxattr(p, "user.label", []byte("a"), xattrCreate)
+	AssertEq(nil, err)
+
+	err = syscall.Setxattr(p, "user.label", []byte("b"), xattrCreate)
+	ExpectEq(syscall.EEXIST, err)
+
+	err = syscall.Setxattr(p, "user.label", []byte("b"), xattrReplace)
+	AssertEq(nil, err)
+
+	v, err := getXattr(p, "user.label")
+	AssertEq(nil, err)
+	ExpectEq("b", v)
+}
+
+func (t *XattrTest) ReservedNames() {
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+	p := path.Join(t.mfs.Dir(), "foo")
+
+	names := []string{
+		"user.gcs.generation",
+		"user.gcsfuse.stats",
+		"user.gcsfuse_mtime",
+		"user.goog-reserved-file-mtime",
+	}
+
+	for _, n := range names {
+		err := syscall.Setxattr(p, n, []byte("taco"), 0)
+		ExpectEq(syscall.EPERM, err, "%s", n)
+	}
+
+	// Metadata that gcsfuse maintains itself isn't listed.
+	listed, err := listXattr(p)
+	AssertEq(nil, err)
+	ExpectThat(listed, Not(Contains("user.gcsfuse_mtime")))
+}
+
+func (t *XattrTest) TooLarge() {
+	AssertEq(nil, t.createWithContents("foo", "taco"))
+	p := path.Join(t.mfs.Dir(), "foo")
+
+	value := []byte(strings.Repeat("x", 8<<10))
+	err := syscall.Setxattr(p, "user.big", value, 0)
+	ExpectEq(syscall.ENOSPC, err)
+}
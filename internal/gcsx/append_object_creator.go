@@ -54,6 +54,13 @@ type appendObjectCreator struct {
 }
 
 func (oc *appendObjectCreator) chooseName() (name string, err error) {
+	name, err = chooseTmpObjectName(oc.prefix)
+	return
+}
+
+// Choose a random name for a temporary object, beginning with the supplied
+// prefix.
+func chooseTmpObjectName(prefix string) (name string, err error) {
 	// Generate a good 64-bit random number.
 	var buf [8]byte
 	_, err = io.ReadFull(rand.Reader, buf[:])
@@ -72,7 +79,7 @@ func (oc *appendObjectCreator) chooseName() (name string, err error) {
 		uint64(buf[7])<<56
 
 	// Turn it into a name.
-	name = fmt.Sprintf("%s%016x", oc.prefix, x)
+	name = fmt.Sprintf("%s%016x", prefix, x)
 
 	return
 }
@@ -127,6 +134,14 @@ func (oc *appendObjectCreator) Create(
 		}
 	}()
 
+	// The holes recorded for the old contents, if any, are still accurate.
+	metadata := preservedMetadata(srcObject)
+	metadata[MtimeMetadataKey] = mtime.Format(time.RFC3339Nano)
+
+	if holes, ok := srcObject.Metadata[SparseExtentsMetadataKey]; ok {
+		metadata[SparseExtentsMetadataKey] = holes
+	}
+
 	// Compose the old contents plus the new over the old.
 	o, err = oc.bucket.ComposeObjects(
 		ctx,
@@ -145,9 +160,7 @@ func (oc *appendObjectCreator) Create(
 					Generation: tmp.Generation,
 				},
 			},
-			Metadata: map[string]string{
-				MtimeMetadataKey: mtime.Format(time.RFC3339Nano),
-			},
+			Metadata: metadata,
 		})
 
 	switch typed := err.(type) {
@@ -200,6 +200,46 @@ func (t *AppendObjectCreatorTest) CallsComposeObjects() {
 	ExpectEq(tmpObject.Generation, src.Generation)
 }
 
+func (t *AppendObjectCreatorTest) ComposeObjectsPreservesCustomMetadata() {
+	t.srcObject.Name = "foo"
+	t.srcObject.Metadata = map[string]string{
+		"taco":                     "burrito",
+		"gcsfuse_mtime":            "some old time",
+		"goog-reserved-file-mtime": "1234",
+	}
+
+	t.mtime = time.Now().Add(123 * time.Second).UTC()
+
+	// CreateObject
+	tmpObject := &gcs.Object{
+		Name:       "bar",
+		Generation: 19,
+	}
+
+	ExpectCall(t.bucket, "CreateObject")(Any(), Any()).
+		WillOnce(Return(tmpObject, nil))
+
+	// ComposeObjects
+	var req *gcs.ComposeObjectsRequest
+	ExpectCall(t.bucket, "ComposeObjects")(Any(), Any()).
+		WillOnce(DoAll(SaveArg(1, &req), Return(nil, errors.New(""))))
+
+	// DeleteObject
+	ExpectCall(t.bucket, "DeleteObject")(Any(), Any()).
+		WillOnce(Return(nil))
+
+	// Call
+	t.call()
+
+	AssertNe(nil, req)
+	ExpectThat(
+		req.Metadata,
+		DeepEquals(map[string]string{
+			"taco":          "burrito",
+			"gcsfuse_mtime": t.mtime.Format(time.RFC3339Nano),
+		}))
+}
+
 func (t *AppendObjectCreatorTest) ComposeObjectsFails() {
 	// CreateObject
 	tmpObject := &gcs.Object{
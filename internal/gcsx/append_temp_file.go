@@ -0,0 +1,162 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jacobsa/timeutil"
+)
+
+// NewAppendTempFile creates a temp file standing for the contents of an object
+// of the given size followed by whatever is written after them, of which only
+// the latter are held locally. The file may be read, written, sought, and
+// truncated only at or beyond base; the object's own contents are for the
+// caller to read from GCS.
+//
+// A Syncer appends the contents written to such a file to the object by
+// composing, whatever the object's size, so the caller must make sure that the
+// object can be composed (see SyncObject).
+func NewAppendTempFile(
+	base int64,
+	space *TempSpace,
+	clock timeutil.Clock) (tf TempFile, err error) {
+	tail, err := NewTempFile(strings.NewReader(""), space, clock)
+	if err != nil {
+		return
+	}
+
+	tf = &appendTempFile{
+		base: base,
+		tail: tail,
+	}
+
+	return
+}
+
+// AppendBase returns the size of the object whose contents the supplied temp
+// file doesn't hold, if it was created by NewAppendTempFile, or zero.
+func AppendBase(tf TempFile) int64 {
+	if a, ok := tf.(*appendTempFile); ok {
+		return a.base
+	}
+
+	return 0
+}
+
+type appendTempFile struct {
+	base int64
+
+	// The contents beyond base, at offsets relative to it.
+	tail TempFile
+}
+
+func (a *appendTempFile) checkOffset(off int64) (err error) {
+	if off < a.base {
+		err = fmt.Errorf(
+			"Offset %d is before the appended contents at %d",
+			off,
+			a.base)
+	}
+
+	return
+}
+
+func (a *appendTempFile) CheckInvariants() {
+	a.tail.CheckInvariants()
+}
+
+func (a *appendTempFile) Read(p []byte) (n int, err error) {
+	n, err = a.tail.Read(p)
+	return
+}
+
+func (a *appendTempFile) Seek(offset int64, whence int) (off int64, err error) {
+	// Offsets relative to the current position or the end are the same for the
+	// tail.
+	if whence == 0 {
+		err = a.checkOffset(offset)
+		if err != nil {
+			return
+		}
+
+		offset -= a.base
+	}
+
+	off, err = a.tail.Seek(offset, whence)
+	off += a.base
+
+	return
+}
+
+func (a *appendTempFile) ReadAt(p []byte, off int64) (n int, err error) {
+	err = a.checkOffset(off)
+	if err != nil {
+		return
+	}
+
+	n, err = a.tail.ReadAt(p, off-a.base)
+	return
+}
+
+func (a *appendTempFile) WriteAt(p []byte, off int64) (n int, err error) {
+	err = a.checkOffset(off)
+	if err != nil {
+		return
+	}
+
+	n, err = a.tail.WriteAt(p, off-a.base)
+	return
+}
+
+func (a *appendTempFile) Truncate(n int64) (err error) {
+	err = a.checkOffset(n)
+	if err != nil {
+		return
+	}
+
+	err = a.tail.Truncate(n - a.base)
+	return
+}
+
+func (a *appendTempFile) Stat() (sr StatResult, err error) {
+	sr, err = a.tail.Stat()
+	sr.Size += a.base
+	sr.DirtyThreshold += a.base
+
+	return
+}
+
+func (a *appendTempFile) SeekData(offset int64, hole bool) (off int64, err error) {
+	err = a.checkOffset(offset)
+	if err != nil {
+		return
+	}
+
+	off, err = a.tail.SeekData(offset-a.base, hole)
+	off += a.base
+
+	return
+}
+
+func (a *appendTempFile) SetMtime(mtime time.Time) {
+	a.tail.SetMtime(mtime)
+}
+
+func (a *appendTempFile) Destroy() {
+	a.tail.Destroy()
+}
@@ -0,0 +1,155 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestAppendTempFile(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// The size of the object whose contents the temp file doesn't hold.
+const appendBase = 11
+
+type AppendTempFileTest struct {
+	clock timeutil.SimulatedClock
+
+	tf checkingTempFile
+}
+
+func init() { RegisterTestSuite(&AppendTempFileTest{}) }
+
+var _ SetUpInterface = &AppendTempFileTest{}
+
+func (t *AppendTempFileTest) SetUp(ti *TestInfo) {
+	var err error
+
+	// Set up the clock.
+	t.clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
+
+	// And the temp file.
+	t.tf.wrapped, err = gcsx.NewAppendTempFile(
+		appendBase,
+		nil, // Temp space
+		&t.clock)
+
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *AppendTempFileTest) Stat_InitialState() {
+	sr, err := t.tf.Stat()
+
+	AssertEq(nil, err)
+	ExpectEq(appendBase, sr.Size)
+	ExpectEq(appendBase, sr.DirtyThreshold)
+	ExpectEq(nil, sr.Mtime)
+
+	ExpectEq(appendBase, gcsx.AppendBase(t.tf.wrapped))
+}
+
+func (t *AppendTempFileTest) WriteAt() {
+	// Call
+	n, err := t.tf.WriteAt([]byte("taco"), appendBase)
+
+	ExpectEq(4, n)
+	ExpectEq(nil, err)
+
+	// Check Stat.
+	sr, err := t.tf.Stat()
+
+	AssertEq(nil, err)
+	ExpectEq(appendBase+4, sr.Size)
+	ExpectEq(appendBase, sr.DirtyThreshold)
+	ExpectThat(sr.Mtime, Pointee(timeutil.TimeEq(t.clock.Now())))
+
+	// Read back from the base, as the syncer does.
+	off, err := t.tf.Seek(appendBase, 0)
+	AssertEq(nil, err)
+	ExpectEq(appendBase, off)
+
+	actual, err := ioutil.ReadAll(&t.tf)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(actual))
+
+	// And at an offset.
+	buf := make([]byte, 2)
+	n, err = t.tf.ReadAt(buf, appendBase+1)
+
+	AssertEq(nil, err)
+	ExpectEq("ac", string(buf[:n]))
+}
+
+func (t *AppendTempFileTest) Truncate() {
+	_, err := t.tf.WriteAt([]byte("taco"), appendBase)
+	AssertEq(nil, err)
+
+	// Call
+	err = t.tf.Truncate(appendBase + 1)
+	AssertEq(nil, err)
+
+	// Check Stat.
+	sr, err := t.tf.Stat()
+
+	AssertEq(nil, err)
+	ExpectEq(appendBase+1, sr.Size)
+}
+
+func (t *AppendTempFileTest) OffsetsBeforeBase() {
+	var err error
+	buf := make([]byte, 2)
+
+	_, err = t.tf.ReadAt(buf, appendBase-1)
+	ExpectThat(err, Error(HasSubstr("before the appended")))
+
+	_, err = t.tf.WriteAt(buf, appendBase-1)
+	ExpectThat(err, Error(HasSubstr("before the appended")))
+
+	_, err = t.tf.Seek(0, 0)
+	ExpectThat(err, Error(HasSubstr("before the appended")))
+
+	err = t.tf.Truncate(appendBase - 1)
+	ExpectThat(err, Error(HasSubstr("before the appended")))
+
+	// Nothing should have changed.
+	sr, err := t.tf.Stat()
+
+	AssertEq(nil, err)
+	ExpectEq(appendBase, sr.Size)
+	ExpectEq(appendBase, sr.DirtyThreshold)
+}
+
+func (t *AppendTempFileTest) OrdinaryTempFile() {
+	tf, err := gcsx.NewTempFile(strings.NewReader(""), nil, &t.clock)
+	AssertEq(nil, err)
+	defer tf.Destroy()
+
+	ExpectEq(0, gcsx.AppendBase(tf))
+}
@@ -0,0 +1,318 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"io"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// A BackgroundDeleteBucket makes deletions of the latest generation of an
+// object, without preconditions, return as soon as one of its workers is free
+// to make them and the object has been found to exist, rather than waiting
+// for GCS to delete it. This lets a series of deletions made one at a time,
+// as by `rm -r`, run concurrently. Deletions with preconditions are made
+// synchronously, since their callers care whether they succeed.
+//
+// Until its deletion is done, an object can't be seen: lookups, reads and
+// updates fail with *gcs.NotFoundError, as do copies and compositions from
+// it, while creating it again waits for the deletion. Listings wait for the
+// deletions beneath their prefix, so that an empty directory is listed as
+// such. Failures are logged, leaving the object in place, where it can be
+// seen again.
+type BackgroundDeleteBucket interface {
+	gcs.Bucket
+
+	// Wait until the deletions running, and any started meanwhile, are done,
+	// or ctx is. Deletions still running when the process exits are lost, so
+	// this must be called before exiting.
+	Wait(ctx context.Context) (err error)
+}
+
+// NewBackgroundDeleteBucket wraps a bucket, making deletions with the given
+// number of workers and logging failures to logger.
+//
+// REQUIRES: workers > 0
+func NewBackgroundDeleteBucket(
+	wrapped gcs.Bucket,
+	workers int,
+	logger *log.Logger) BackgroundDeleteBucket {
+	return &backgroundDeleteBucket{
+		Bucket:  wrapped,
+		logger:  logger,
+		workers: make(chan struct{}, workers),
+		pending: make(map[string]chan struct{}),
+	}
+}
+
+type backgroundDeleteBucket struct {
+	gcs.Bucket
+
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	logger *log.Logger
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	// Holds a value for each deletion running.
+	workers chan struct{}
+
+	mu sync.Mutex
+
+	// A channel for each name being deleted, closed once it is.
+	//
+	// GUARDED_BY(mu)
+	pending map[string]chan struct{}
+}
+
+// Is the object with the given name being deleted?
+func (b *backgroundDeleteBucket) deleting(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.pending[name] != nil
+}
+
+// Wait until there are no deletions running of names for which match returns
+// true.
+func (b *backgroundDeleteBucket) waitFor(
+	ctx context.Context,
+	match func(name string) bool) (err error) {
+	for {
+		var done chan struct{}
+
+		b.mu.Lock()
+		for name, c := range b.pending {
+			if match(name) {
+				done = c
+				break
+			}
+		}
+		b.mu.Unlock()
+
+		if done == nil {
+			return
+		}
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+	}
+}
+
+func (b *backgroundDeleteBucket) Wait(ctx context.Context) (err error) {
+	err = b.waitFor(ctx, func(string) bool { return true })
+	return
+}
+
+// Wait until the object with the given name isn't being deleted.
+func (b *backgroundDeleteBucket) waitForName(
+	ctx context.Context,
+	name string) (err error) {
+	err = b.waitFor(ctx, func(n string) bool { return n == name })
+	return
+}
+
+func (b *backgroundDeleteBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	if b.deleting(req.Name) {
+		err = notFound(req.Name)
+		return
+	}
+
+	rc, err = b.Bucket.NewReader(ctx, req)
+	return
+}
+
+func (b *backgroundDeleteBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	err = b.waitForName(ctx, req.Name)
+	if err != nil {
+		return
+	}
+
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+func (b *backgroundDeleteBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	if b.deleting(req.SrcName) {
+		err = notFound(req.SrcName)
+		return
+	}
+
+	err = b.waitForName(ctx, req.DstName)
+	if err != nil {
+		return
+	}
+
+	o, err = b.Bucket.CopyObject(ctx, req)
+	return
+}
+
+func (b *backgroundDeleteBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	for _, src := range req.Sources {
+		if b.deleting(src.Name) {
+			err = notFound(src.Name)
+			return
+		}
+	}
+
+	err = b.waitForName(ctx, req.DstName)
+	if err != nil {
+		return
+	}
+
+	o, err = b.Bucket.ComposeObjects(ctx, req)
+	return
+}
+
+func (b *backgroundDeleteBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	if b.deleting(req.Name) {
+		err = notFound(req.Name)
+		return
+	}
+
+	o, err = b.Bucket.StatObject(ctx, req)
+	return
+}
+
+func (b *backgroundDeleteBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	err = b.waitFor(ctx, func(name string) bool {
+		return strings.HasPrefix(name, req.Prefix)
+	})
+
+	if err != nil {
+		return
+	}
+
+	listing, err = b.Bucket.ListObjects(ctx, req)
+	return
+}
+
+func (b *backgroundDeleteBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	if b.deleting(req.Name) {
+		err = notFound(req.Name)
+		return
+	}
+
+	o, err = b.Bucket.UpdateObject(ctx, req)
+	return
+}
+
+func (b *backgroundDeleteBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	if req.Generation != 0 || req.MetaGenerationPrecondition != nil {
+		err = b.waitForName(ctx, req.Name)
+		if err != nil {
+			return
+		}
+
+		err = b.Bucket.DeleteObject(ctx, req)
+		return
+	}
+
+	// Wait for a free worker.
+	select {
+	case b.workers <- struct{}{}:
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	}
+
+	// Claim the name, once any earlier deletion of it is done.
+	done := make(chan struct{})
+	for {
+		b.mu.Lock()
+		prev := b.pending[req.Name]
+		if prev == nil {
+			b.pending[req.Name] = done
+		}
+		b.mu.Unlock()
+
+		if prev == nil {
+			break
+		}
+
+		select {
+		case <-prev:
+		case <-ctx.Done():
+			<-b.workers
+			err = ctx.Err()
+			return
+		}
+	}
+
+	// Make sure there is something to delete, so that deleting an object
+	// that doesn't exist fails as it would otherwise.
+	_, err = b.Bucket.StatObject(ctx, &gcs.StatObjectRequest{Name: req.Name})
+	if err != nil {
+		b.finish(req.Name, done)
+		return
+	}
+
+	go b.delete(req.Name, done)
+	return
+}
+
+func (b *backgroundDeleteBucket) delete(name string, done chan struct{}) {
+	err := b.Bucket.DeleteObject(
+		context.Background(),
+		&gcs.DeleteObjectRequest{Name: name})
+
+	if err != nil {
+		b.logger.Printf(
+			"Failed to delete %q in the background; it remains in the bucket: %v",
+			name,
+			err)
+	}
+
+	b.finish(name, done)
+}
+
+// Release the name and worker claimed for a deletion.
+func (b *backgroundDeleteBucket) finish(name string, done chan struct{}) {
+	b.mu.Lock()
+	delete(b.pending, name)
+	b.mu.Unlock()
+
+	close(done)
+	<-b.workers
+}
@@ -0,0 +1,272 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestBackgroundDeleteBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose DeleteObject requests wait for a value on a channel, and
+// then fail if it's non-nil.
+type gatedDeleteBucket struct {
+	gcs.Bucket
+	gate chan error
+}
+
+func (b *gatedDeleteBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = <-b.gate
+	if err != nil {
+		return
+	}
+
+	err = b.Bucket.DeleteObject(ctx, req)
+	return
+}
+
+type BackgroundDeleteBucketTest struct {
+	ctx     context.Context
+	wrapped *gatedDeleteBucket
+	logs    bytes.Buffer
+	bucket  gcsx.BackgroundDeleteBucket
+}
+
+var _ SetUpInterface = &BackgroundDeleteBucketTest{}
+
+func init() { RegisterTestSuite(&BackgroundDeleteBucketTest{}) }
+
+func (t *BackgroundDeleteBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.wrapped = &gatedDeleteBucket{
+		Bucket: gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket"),
+		gate:   make(chan error),
+	}
+
+	// A single worker, so that a second deletion must wait for the first.
+	t.bucket = gcsx.NewBackgroundDeleteBucket(
+		t.wrapped,
+		1,
+		log.New(&t.logs, "", 0))
+
+	for _, name := range []string{"dir/a", "dir/b", "other/c"} {
+		_, err := gcsutil.CreateObject(t.ctx, t.wrapped, name, []byte("taco"))
+		AssertEq(nil, err)
+	}
+}
+
+func (t *BackgroundDeleteBucketTest) delete(name string) {
+	err := t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: name})
+	AssertEq(nil, err)
+}
+
+// List the names of the objects beneath the given prefix.
+func (t *BackgroundDeleteBucketTest) list(prefix string) (names []string) {
+	objects, _, err := gcsutil.ListAll(
+		t.ctx,
+		t.bucket,
+		&gcs.ListObjectsRequest{Prefix: prefix})
+
+	AssertEq(nil, err)
+	for _, o := range objects {
+		names = append(names, o.Name)
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *BackgroundDeleteBucketTest) DeletionReturnsBeforeDone() {
+	t.delete("dir/a")
+
+	// The object is still in the wrapped bucket, but can't be seen.
+	_, err := t.wrapped.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "dir/a"})
+	ExpectEq(nil, err)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "dir/a"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	_, err = t.bucket.NewReader(t.ctx, &gcs.ReadObjectRequest{Name: "dir/a"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	_, err = t.bucket.CopyObject(
+		t.ctx,
+		&gcs.CopyObjectRequest{SrcName: "dir/a", DstName: "foo"})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	// Listings elsewhere needn't wait.
+	ExpectThat(t.list("other/"), ElementsAre("other/c"))
+
+	t.wrapped.gate <- nil
+	ExpectThat(t.list("dir/"), ElementsAre("dir/b"))
+}
+
+func (t *BackgroundDeleteBucketTest) ListingsWaitForDeletions() {
+	t.delete("dir/a")
+
+	listed := make(chan []string)
+	go func() {
+		objects, _, _ := gcsutil.ListAll(
+			t.ctx,
+			t.bucket,
+			&gcs.ListObjectsRequest{Prefix: "dir/"})
+
+		var names []string
+		for _, o := range objects {
+			names = append(names, o.Name)
+		}
+
+		listed <- names
+	}()
+
+	t.wrapped.gate <- nil
+	ExpectThat(<-listed, ElementsAre("dir/b"))
+}
+
+func (t *BackgroundDeleteBucketTest) CreationWaitsForDeletion() {
+	t.delete("dir/a")
+
+	created := make(chan error)
+	go func() {
+		_, err := gcsutil.CreateObject(t.ctx, t.bucket, "dir/a", []byte("burrito"))
+		created <- err
+	}()
+
+	t.wrapped.gate <- nil
+	AssertEq(nil, <-created)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "dir/a")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+}
+
+func (t *BackgroundDeleteBucketTest) DeletingMissingObject() {
+	err := t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	// Nothing is left pending, and the worker is free again.
+	AssertEq(nil, t.bucket.Wait(t.ctx))
+
+	t.delete("dir/a")
+	t.wrapped.gate <- nil
+	ExpectThat(t.list("dir/"), ElementsAre("dir/b"))
+}
+
+func (t *BackgroundDeleteBucketTest) DeletingTwice() {
+	t.delete("dir/a")
+
+	// The second deletion waits for the first, and then finds nothing left.
+	deleted := make(chan error)
+	go func() {
+		deleted <- t.bucket.DeleteObject(
+			t.ctx,
+			&gcs.DeleteObjectRequest{Name: "dir/a"})
+	}()
+
+	t.wrapped.gate <- nil
+	ExpectThat(<-deleted, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *BackgroundDeleteBucketTest) DeletionWaitsForWorker() {
+	t.delete("dir/a")
+
+	// The only worker is busy.
+	ctx, cancel := context.WithCancel(t.ctx)
+	cancel()
+
+	err := t.bucket.DeleteObject(ctx, &gcs.DeleteObjectRequest{Name: "dir/b"})
+	ExpectEq(context.Canceled, err)
+
+	t.wrapped.gate <- nil
+	t.delete("dir/b")
+	t.wrapped.gate <- nil
+
+	ExpectThat(t.list("dir/"), ElementsAre())
+}
+
+func (t *BackgroundDeleteBucketTest) PreconditionedDeletionSynchronous() {
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "dir/a"})
+	AssertEq(nil, err)
+
+	deleted := make(chan error)
+	go func() {
+		deleted <- t.bucket.DeleteObject(
+			t.ctx,
+			&gcs.DeleteObjectRequest{
+				Name:       "dir/a",
+				Generation: o.Generation,
+			})
+	}()
+
+	t.wrapped.gate <- errors.New("taco")
+	ExpectThat(<-deleted, Error(HasSubstr("taco")))
+}
+
+func (t *BackgroundDeleteBucketTest) WaitForDeletions() {
+	// Nothing to wait for.
+	AssertEq(nil, t.bucket.Wait(t.ctx))
+
+	t.delete("dir/a")
+
+	// Give up waiting.
+	ctx, cancel := context.WithCancel(t.ctx)
+	cancel()
+	ExpectEq(context.Canceled, t.bucket.Wait(ctx))
+
+	// Wait for the deletion to be made.
+	waited := make(chan error)
+	go func() {
+		waited <- t.bucket.Wait(t.ctx)
+	}()
+
+	t.wrapped.gate <- nil
+	AssertEq(nil, <-waited)
+
+	_, err := t.wrapped.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "dir/a"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *BackgroundDeleteBucketTest) FailuresLogged() {
+	t.delete("dir/a")
+	t.wrapped.gate <- errors.New("taco")
+
+	// Once the deletion is done, the object can be seen again.
+	ExpectThat(t.list("dir/"), ElementsAre("dir/a", "dir/b"))
+	ExpectThat(t.logs.String(), HasSubstr("Failed to delete \"dir/a\""))
+	ExpectThat(t.logs.String(), HasSubstr("taco"))
+}
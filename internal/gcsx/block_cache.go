@@ -0,0 +1,914 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/syncutil"
+	"golang.org/x/net/context"
+)
+
+// The size of the blocks in which a BlockCache holds object contents. Every
+// block but the last of an object is this long.
+const BlockSize = MB
+
+// The version of the index format written by SaveIndex. Indexes of other
+// versions are ignored.
+const blockCacheIndexVersion = 1
+
+const (
+	blockCacheIndexName = "index.json"
+	blockFileSuffix     = ".block"
+)
+
+// A BlockCache holds the contents of object generations in fixed-size blocks,
+// shared by every reader that uses it, evicting the least recently used block
+// when full. A generation's contents never change, so blocks never need to be
+// invalidated.
+//
+// The blocks are kept either in memory, or in files in a directory along with
+// an index that lets a later process reuse them. Blocks read from disk are
+// checked against the checksums in the index, so a block damaged by a crash is
+// merely a cache miss.
+//
+// Safe for concurrent access.
+type BlockCache struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	capacity int64
+
+	// The directory holding the blocks, or empty if they are held in memory.
+	dir string
+
+	// An identifier for the bucket and prefix whose objects are cached. An
+	// index written for a different scope is ignored, since object names (and
+	// maybe generations) mean something else there.
+	scope string
+
+	// Buffers of BlockSize bytes, for the contents of blocks held in memory and
+	// of those read from disk. Those of blocks evicted from memory are reused.
+	buffers *BufferPool
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu syncutil.InvariantMutex
+
+	// The cached blocks, most recently used first, of type *cachedBlock.
+	//
+	// INVARIANT: For each k, v in index, v.Value.(*cachedBlock).id == k
+	// INVARIANT: index contains all and only the elements of entries
+	// INVARIANT: size is the sum of the sizes of the elements of entries
+	// INVARIANT: size <= capacity || entries.Len() <= 1
+	// INVARIANT: For each element b, (b.data != nil) == (dir == "")
+	//
+	// GUARDED_BY(mu)
+	entries list.List
+	index   map[blockID]*list.Element
+	size    int64
+
+	// Set when entries has changed since the index was last saved.
+	//
+	// GUARDED_BY(mu)
+	indexDirty bool
+}
+
+type blockID struct {
+	name       string
+	generation int64
+	index      int64
+}
+
+type cachedBlock struct {
+	id   blockID
+	size int64
+
+	// The attributes of the generation to which the block belongs, shared by
+	// its other blocks, or nil if they weren't recorded in the index from which
+	// it was loaded.
+	object *gcs.Object
+
+	// The contents of the block, when held in memory.
+	data []byte
+
+	// The CRC32C of the block's contents, when held on disk.
+	crc uint32
+
+	// The number of reads of data under way, and whether the block has left
+	// the cache. Once both are so, data goes back to the cache's buffers.
+	//
+	// GUARDED_BY(BlockCache.mu)
+	readers int
+	removed bool
+}
+
+// NewBlockCache creates an empty cache holding at most capacity bytes (but at
+// least one block) in memory.
+func NewBlockCache(capacity int64) (bc *BlockCache) {
+	bc = newBlockCache(capacity, "", "")
+	return
+}
+
+// OpenBlockCache creates a cache holding at most capacity bytes (but at least
+// one block) in files in the given directory, which it must have to itself.
+// If the directory holds an index saved by SaveIndex for the same scope, the
+// blocks it lists are cached from the start. Files holding other blocks are
+// removed.
+func OpenBlockCache(
+	dir string,
+	capacity int64,
+	scope string) (bc *BlockCache, err error) {
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		err = fmt.Errorf("MkdirAll: %v", err)
+		return
+	}
+
+	bc = newBlockCache(capacity, dir, scope)
+
+	err = bc.loadIndex()
+	if err != nil {
+		err = fmt.Errorf("loadIndex: %v", err)
+		return
+	}
+
+	err = bc.removeUnindexed()
+	if err != nil {
+		err = fmt.Errorf("removeUnindexed: %v", err)
+		return
+	}
+
+	return
+}
+
+func newBlockCache(
+	capacity int64,
+	dir string,
+	scope string) (bc *BlockCache) {
+	if capacity < BlockSize {
+		capacity = BlockSize
+	}
+
+	bc = &BlockCache{
+		capacity: capacity,
+		dir:      dir,
+		scope:    scope,
+		buffers:  NewBufferPool(BlockSize),
+		index:    make(map[blockID]*list.Element),
+	}
+
+	bc.mu = syncutil.NewInvariantMutex(bc.checkInvariants)
+	return
+}
+
+// Return a copy of the cached contents of the given block, or nil if they
+// aren't cached.
+//
+// LOCKS_EXCLUDED(bc.mu)
+func (bc *BlockCache) LookUp(
+	name string,
+	generation int64,
+	index int64) (block []byte) {
+	bc.withBlock(blockID{name, generation, index}, func(data []byte) {
+		block = append([]byte{}, data...)
+	})
+
+	return
+}
+
+// ReadAt copies the cached contents of the given block, starting at offset
+// off within it, into p, returning the number of bytes copied. ok is false if
+// the block isn't cached. Unlike LookUp, this allocates nothing.
+//
+// LOCKS_EXCLUDED(bc.mu)
+func (bc *BlockCache) ReadAt(
+	name string,
+	generation int64,
+	index int64,
+	p []byte,
+	off int64) (n int, ok bool) {
+	ok = bc.withBlock(blockID{name, generation, index}, func(data []byte) {
+		if off < int64(len(data)) {
+			n = copy(p, data[off:])
+		}
+	})
+
+	return
+}
+
+// Report whether the given block is cached, without reading it or marking it
+// as recently used. A block on disk may yet turn out to be damaged when read.
+//
+// LOCKS_EXCLUDED(bc.mu)
+func (bc *BlockCache) Contains(
+	name string,
+	generation int64,
+	index int64) bool {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	return bc.index[blockID{name, generation, index}] != nil
+}
+
+// NewBlock returns a buffer for the contents of a block of the given size, to
+// be filled and passed to Insert, reusing that of an evicted block if there is
+// one.
+//
+// REQUIRES: size <= BlockSize
+func (bc *BlockCache) NewBlock(size int64) []byte {
+	return bc.buffers.Get()[:size]
+}
+
+// Cache the contents of the given block of the given object generation,
+// recording its attributes along with them. The caller must not modify the
+// attributes, or use the contents at all, afterward, since a buffer from
+// NewBlock may be reused. If the block can't be written to disk, it isn't
+// cached.
+//
+// LOCKS_EXCLUDED(bc.mu)
+func (bc *BlockCache) Insert(
+	o *gcs.Object,
+	index int64,
+	block []byte) {
+	id := blockID{o.Name, o.Generation, index}
+	b := &cachedBlock{
+		id:     id,
+		size:   int64(len(block)),
+		object: o,
+	}
+
+	if bc.dir == "" {
+		b.data = block
+	} else {
+		b.crc = crc32.Checksum(block, crc32cTable)
+		err := ioutil.WriteFile(bc.blockPath(id), block, 0600)
+		bc.buffers.Put(block)
+		if err != nil {
+			return
+		}
+	}
+
+	bc.mu.Lock()
+	if e := bc.index[id]; e != nil {
+		bc.remove(e)
+	}
+
+	bc.add(b)
+	evicted := bc.evict()
+	bc.mu.Unlock()
+
+	bc.removeFiles(evicted)
+}
+
+// Return the total size of the cached blocks.
+//
+// LOCKS_EXCLUDED(bc.mu)
+func (bc *BlockCache) Size() int64 {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	return bc.size
+}
+
+// Return the attributes of the latest generation of each object with cached
+// blocks, sorted by name. Generations cached by versions of gcsfuse that
+// didn't record their attributes are left out.
+//
+// LOCKS_EXCLUDED(bc.mu)
+func (bc *BlockCache) Objects() (objects []*gcs.Object) {
+	latest := make(map[string]*gcs.Object)
+
+	bc.mu.Lock()
+	for e := bc.entries.Front(); e != nil; e = e.Next() {
+		o := e.Value.(*cachedBlock).object
+		if o == nil {
+			continue
+		}
+
+		if l := latest[o.Name]; l == nil || l.Generation < o.Generation {
+			latest[o.Name] = o
+		}
+	}
+	bc.mu.Unlock()
+
+	for _, o := range latest {
+		objects = append(objects, o)
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+
+	return
+}
+
+// Forget every cached block.
+//
+// LOCKS_EXCLUDED(bc.mu)
+func (bc *BlockCache) Clear() {
+	var removed []blockID
+
+	bc.mu.Lock()
+	for e := bc.entries.Front(); e != nil; e = bc.entries.Front() {
+		bc.remove(e)
+		if bc.dir != "" {
+			removed = append(removed, e.Value.(*cachedBlock).id)
+		}
+	}
+	bc.mu.Unlock()
+
+	bc.removeFiles(removed)
+}
+
+// Write out an index of the blocks cached on disk, if it has changed since
+// the last call, for OpenBlockCache to read in a later process. Does nothing
+// for a cache held in memory.
+//
+// LOCKS_EXCLUDED(bc.mu)
+func (bc *BlockCache) SaveIndex() (err error) {
+	if bc.dir == "" {
+		return
+	}
+
+	bc.mu.Lock()
+	if !bc.indexDirty {
+		bc.mu.Unlock()
+		return
+	}
+
+	idx := bc.buildIndex()
+	bc.indexDirty = false
+	bc.mu.Unlock()
+
+	// Try again next time if this fails.
+	defer func() {
+		if err != nil {
+			bc.mu.Lock()
+			bc.indexDirty = true
+			bc.mu.Unlock()
+		}
+	}()
+
+	// Replace the old index atomically, so that a crash leaves one or the
+	// other.
+	buf, err := json.Marshal(idx)
+	if err != nil {
+		err = fmt.Errorf("json.Marshal: %v", err)
+		return
+	}
+
+	f, err := ioutil.TempFile(bc.dir, blockCacheIndexName)
+	if err != nil {
+		err = fmt.Errorf("TempFile: %v", err)
+		return
+	}
+
+	_, err = f.Write(buf)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		err = fmt.Errorf("Write: %v", err)
+		return
+	}
+
+	err = os.Rename(f.Name(), path.Join(bc.dir, blockCacheIndexName))
+	if err != nil {
+		err = fmt.Errorf("Rename: %v", err)
+		return
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_REQUIRED(bc.mu)
+func (bc *BlockCache) checkInvariants() {
+	// INVARIANT: For each k, v in index, v.Value.(*cachedBlock).id == k
+	for id, e := range bc.index {
+		if e.Value.(*cachedBlock).id != id {
+			panic(fmt.Sprintf("ID mismatch: %v vs. %v", e.Value.(*cachedBlock).id, id))
+		}
+	}
+
+	// INVARIANT: index contains all and only the elements of entries
+	if bc.entries.Len() != len(bc.index) {
+		panic(fmt.Sprintf(
+			"Length mismatch: %d vs. %d",
+			bc.entries.Len(),
+			len(bc.index)))
+	}
+
+	var size int64
+	for e := bc.entries.Front(); e != nil; e = e.Next() {
+		b := e.Value.(*cachedBlock)
+		if bc.index[b.id] != e {
+			panic(fmt.Sprintf("Unindexed block: %v", b.id))
+		}
+
+		// INVARIANT: For each element b, (b.data != nil) == (dir == "")
+		if (b.data != nil) != (bc.dir == "") {
+			panic(fmt.Sprintf("Block %v in the wrong place", b.id))
+		}
+
+		size += b.size
+	}
+
+	// INVARIANT: size is the sum of the sizes of the elements of entries
+	if size != bc.size {
+		panic(fmt.Sprintf("Size mismatch: %d vs. %d", size, bc.size))
+	}
+
+	// INVARIANT: size <= capacity || entries.Len() <= 1
+	if !(bc.size <= bc.capacity || bc.entries.Len() <= 1) {
+		panic(fmt.Sprintf("Size %d over capacity %d", bc.size, bc.capacity))
+	}
+}
+
+// The file holding the given block, when held on disk. The name of the object
+// is hashed, since it may be too long or contain slashes.
+func (bc *BlockCache) blockPath(id blockID) string {
+	return path.Join(
+		bc.dir,
+		fmt.Sprintf(
+			"%x.%d.%d%s",
+			sha1.Sum([]byte(id.name)),
+			id.generation,
+			id.index,
+			blockFileSuffix))
+}
+
+// Add the given block as the most recently used.
+//
+// LOCKS_REQUIRED(bc.mu)
+func (bc *BlockCache) add(b *cachedBlock) {
+	bc.index[b.id] = bc.entries.PushFront(b)
+	bc.size += b.size
+	bc.indexDirty = true
+}
+
+// LOCKS_REQUIRED(bc.mu)
+func (bc *BlockCache) remove(e *list.Element) {
+	b := bc.entries.Remove(e).(*cachedBlock)
+	delete(bc.index, b.id)
+	bc.size -= b.size
+	bc.indexDirty = true
+
+	b.removed = true
+	bc.recycle(b)
+}
+
+// Return the contents of a block held in memory to the buffers, if it has
+// left the cache and no reads of them are under way.
+//
+// LOCKS_REQUIRED(bc.mu)
+func (bc *BlockCache) recycle(b *cachedBlock) {
+	if b.removed && b.readers == 0 && b.data != nil {
+		bc.buffers.Put(b.data)
+		b.data = nil
+	}
+}
+
+// Call f with the contents of the given block, marking it as recently used,
+// and return true, or return false if the block isn't cached. The contents
+// may be reused once f returns.
+//
+// LOCKS_EXCLUDED(bc.mu)
+func (bc *BlockCache) withBlock(id blockID, f func(data []byte)) bool {
+	bc.mu.Lock()
+	e := bc.index[id]
+	if e == nil {
+		bc.mu.Unlock()
+		return false
+	}
+
+	bc.entries.MoveToFront(e)
+	b := e.Value.(*cachedBlock)
+
+	// Keep the contents of a block held in memory from being reused until
+	// we're done with them.
+	if bc.dir == "" {
+		data := b.data
+		b.readers++
+		bc.mu.Unlock()
+
+		f(data)
+
+		bc.mu.Lock()
+		b.readers--
+		bc.recycle(b)
+		bc.mu.Unlock()
+
+		return true
+	}
+
+	size := b.size
+	crc := b.crc
+	bc.mu.Unlock()
+
+	// Read the block from disk, forgetting it if it has gone missing or been
+	// damaged.
+	buf := bc.buffers.Get()
+	defer bc.buffers.Put(buf)
+
+	data := buf[:size]
+	err := readBlockFile(bc.blockPath(id), data)
+	if err != nil || crc32.Checksum(data, crc32cTable) != crc {
+		bc.mu.Lock()
+		if bc.index[id] == e {
+			bc.remove(e)
+		}
+		bc.mu.Unlock()
+
+		os.Remove(bc.blockPath(id))
+		return false
+	}
+
+	f(data)
+	return true
+}
+
+// Read the whole of the named file into p, failing if it isn't exactly as
+// long.
+func readBlockFile(name string, p []byte) (err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	if fi.Size() != int64(len(p)) {
+		err = fmt.Errorf("Unexpected size %d", fi.Size())
+		return
+	}
+
+	_, err = io.ReadFull(f, p)
+	return
+}
+
+// Evict least recently used blocks until within capacity, returning those
+// whose files must be removed.
+//
+// LOCKS_REQUIRED(bc.mu)
+func (bc *BlockCache) evict() (evicted []blockID) {
+	for bc.size > bc.capacity && bc.entries.Len() > 1 {
+		e := bc.entries.Back()
+		bc.remove(e)
+
+		if bc.dir != "" {
+			evicted = append(evicted, e.Value.(*cachedBlock).id)
+		}
+	}
+
+	return
+}
+
+// LOCKS_EXCLUDED(bc.mu)
+func (bc *BlockCache) removeFiles(ids []blockID) {
+	for _, id := range ids {
+		os.Remove(bc.blockPath(id))
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Index
+////////////////////////////////////////////////////////////////////////
+
+// The contents of the index file written by SaveIndex.
+type blockCacheIndex struct {
+	Version int
+	Scope   string
+
+	// Most recently used first.
+	Objects []indexedObject
+}
+
+// The blocks cached for an object generation.
+type indexedObject struct {
+	Name       string
+	Generation int64
+	Size       uint64
+
+	// A bitmap of the cached blocks: block i is cached if bit i%8 of byte i/8
+	// is set.
+	Blocks []byte
+
+	// The CRC32C of each cached block, in order of block index.
+	Checksums []uint32
+
+	// The attributes of the generation, if known. Indexes written before these
+	// were recorded lack them.
+	Object *gcs.Object `json:",omitempty"`
+}
+
+// Return an index of the cached blocks, grouped by object in order of each
+// object's most recently used block. The size of each object is that implied
+// by its last cached block, which is enough to tell the sizes of the others.
+//
+// LOCKS_REQUIRED(bc.mu)
+func (bc *BlockCache) buildIndex() (idx blockCacheIndex) {
+	idx.Version = blockCacheIndexVersion
+	idx.Scope = bc.scope
+
+	type objectKey struct {
+		name       string
+		generation int64
+	}
+
+	blocks := make(map[objectKey][]*cachedBlock)
+	var order []objectKey
+	for e := bc.entries.Front(); e != nil; e = e.Next() {
+		b := e.Value.(*cachedBlock)
+		k := objectKey{b.id.name, b.id.generation}
+		if blocks[k] == nil {
+			order = append(order, k)
+		}
+
+		blocks[k] = append(blocks[k], b)
+	}
+
+	for _, k := range order {
+		o := indexedObject{
+			Name:       k.name,
+			Generation: k.generation,
+		}
+
+		crcs := make(map[int64]uint32)
+		var last int64
+		for _, b := range blocks[k] {
+			crcs[b.id.index] = b.crc
+			if b.object != nil {
+				o.Object = b.object
+			}
+
+			if b.id.index >= last {
+				last = b.id.index
+				o.Size = uint64(b.id.index*BlockSize + b.size)
+			}
+		}
+
+		o.Blocks = make([]byte, last/8+1)
+		for i := int64(0); i <= last; i++ {
+			if crc, ok := crcs[i]; ok {
+				o.Blocks[i/8] |= 1 << uint(i%8)
+				o.Checksums = append(o.Checksums, crc)
+			}
+		}
+
+		idx.Objects = append(idx.Objects, o)
+	}
+
+	return
+}
+
+// Add the blocks listed in the index file, if there is one for our scope,
+// whose files are present and of the right size. Their contents are checked
+// when they are read.
+//
+// LOCKS_EXCLUDED(bc.mu)
+func (bc *BlockCache) loadIndex() (err error) {
+	buf, err := ioutil.ReadFile(path.Join(bc.dir, blockCacheIndexName))
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("ReadFile: %v", err)
+		return
+	}
+
+	// An index we can't make sense of is no worse than having none.
+	var idx blockCacheIndex
+	if json.Unmarshal(buf, &idx) != nil ||
+		idx.Version != blockCacheIndexVersion ||
+		idx.Scope != bc.scope {
+		return
+	}
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	// Add the least recently used objects first, so that the most recently
+	// used end up at the front.
+	for i := len(idx.Objects) - 1; i >= 0; i-- {
+		o := idx.Objects[i]
+		checksums := o.Checksums
+		if o.Object != nil &&
+			(o.Object.Name != o.Name || o.Object.Generation != o.Generation) {
+			o.Object = nil
+		}
+
+		for j := int64(0); j < int64(len(o.Blocks))*8; j++ {
+			if o.Blocks[j/8]&(1<<uint(j%8)) == 0 {
+				continue
+			}
+
+			// Each cached block has a checksum.
+			if len(checksums) == 0 {
+				break
+			}
+
+			crc := checksums[0]
+			checksums = checksums[1:]
+
+			b := &cachedBlock{
+				id:     blockID{o.Name, o.Generation, j},
+				size:   int64(o.Size) - j*BlockSize,
+				crc:    crc,
+				object: o.Object,
+			}
+
+			if b.size > BlockSize {
+				b.size = BlockSize
+			}
+
+			if b.size <= 0 || bc.index[b.id] != nil {
+				continue
+			}
+
+			fi, statErr := os.Stat(bc.blockPath(b.id))
+			if statErr != nil || fi.Size() != b.size {
+				continue
+			}
+
+			bc.add(b)
+		}
+	}
+
+	// Leave the excess to removeUnindexed, and what we found to the next save.
+	bc.evict()
+	bc.indexDirty = true
+
+	return
+}
+
+// Remove files in the directory holding blocks that aren't cached.
+//
+// LOCKS_EXCLUDED(bc.mu)
+func (bc *BlockCache) removeUnindexed() (err error) {
+	entries, err := ioutil.ReadDir(bc.dir)
+	if err != nil {
+		err = fmt.Errorf("ReadDir: %v", err)
+		return
+	}
+
+	keep := make(map[string]bool)
+	bc.mu.Lock()
+	for id := range bc.index {
+		keep[path.Base(bc.blockPath(id))] = true
+	}
+	bc.mu.Unlock()
+
+	for _, fi := range entries {
+		name := fi.Name()
+		if !strings.HasSuffix(name, blockFileSuffix) || keep[name] {
+			continue
+		}
+
+		err = os.Remove(path.Join(bc.dir, name))
+		if err != nil {
+			err = fmt.Errorf("Remove: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Caching reader
+////////////////////////////////////////////////////////////////////////
+
+// NewCachingReader wraps a random reader so that reads are served from the
+// supplied cache where possible. Blocks missing from the cache are read in
+// full through the wrapped reader and added to it, so sequential misses still
+// stream from a single GCS request.
+func NewCachingReader(
+	wrapped RandomReader,
+	cache *BlockCache) (rr RandomReader) {
+	rr = &cachingReader{
+		wrapped: wrapped,
+		cache:   cache,
+	}
+
+	return
+}
+
+type cachingReader struct {
+	wrapped RandomReader
+	cache   *BlockCache
+}
+
+func (cr *cachingReader) CheckInvariants() {
+	cr.wrapped.CheckInvariants()
+}
+
+func (cr *cachingReader) ReadAt(
+	ctx context.Context,
+	p []byte,
+	offset int64) (n int, err error) {
+	o := cr.wrapped.Object()
+	for len(p) > 0 {
+		if offset >= int64(o.Size) {
+			err = io.EOF
+			return
+		}
+
+		index := offset / BlockSize
+		off := offset - index*BlockSize
+
+		tmp, ok := cr.cache.ReadAt(o.Name, o.Generation, index, p, off)
+		if !ok {
+			tmp, err = cr.fetchBlock(ctx, o, index, p, off)
+			if err != nil {
+				return
+			}
+		}
+
+		n += tmp
+		p = p[tmp:]
+		offset += int64(tmp)
+	}
+
+	return
+}
+
+func (cr *cachingReader) Object() (o *gcs.Object) {
+	o = cr.wrapped.Object()
+	return
+}
+
+func (cr *cachingReader) SetHint(h ReadHint) {
+	cr.wrapped.SetHint(h)
+}
+
+func (cr *cachingReader) Destroy() {
+	cr.wrapped.Destroy()
+}
+
+// Read the given block of o through the wrapped reader, copying its contents
+// from offset off within it into p, and add it to the cache. Errors from the
+// wrapped reader are returned unchanged, so that the caller sees a
+// *gcs.NotFoundError if the generation has gone away.
+func (cr *cachingReader) fetchBlock(
+	ctx context.Context,
+	o *gcs.Object,
+	index int64,
+	p []byte,
+	off int64) (n int, err error) {
+	start := index * BlockSize
+	size := int64(o.Size) - start
+	if size > BlockSize {
+		size = BlockSize
+	}
+
+	block := cr.cache.NewBlock(size)
+	_, err = cr.wrapped.ReadAt(ctx, block, start)
+	if err != nil {
+		cr.cache.buffers.Put(block)
+		return
+	}
+
+	n = copy(p, block[off:])
+	cr.cache.Insert(o, index, block)
+	return
+}
@@ -0,0 +1,435 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/syncutil"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestBlockCache(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that counts the read requests it sees.
+type readCountingBucket struct {
+	gcs.Bucket
+	reads int
+}
+
+func (b *readCountingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (io.ReadCloser, error) {
+	b.reads++
+	return b.Bucket.NewReader(ctx, req)
+}
+
+type BlockCacheTest struct {
+	ctx      context.Context
+	dir      string
+	bucket   readCountingBucket
+	cache    *gcsx.BlockCache
+	contents []byte
+	object   *gcs.Object
+}
+
+var _ SetUpInterface = &BlockCacheTest{}
+var _ TearDownInterface = &BlockCacheTest{}
+
+func init() { RegisterTestSuite(&BlockCacheTest{}) }
+
+func (t *BlockCacheTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.bucket.Bucket = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+	t.cache = gcsx.NewBlockCache(4 * gcsx.BlockSize)
+
+	// Two and a half blocks of distinguishable bytes.
+	t.contents = make([]byte, 5*gcsx.BlockSize/2)
+	for i := range t.contents {
+		t.contents[i] = byte(i % 251)
+	}
+
+	t.object, err = gcsutil.CreateObject(t.ctx, &t.bucket, "foo", t.contents)
+	AssertEq(nil, err)
+
+	t.dir, err = ioutil.TempDir("", "block_cache_test")
+	AssertEq(nil, err)
+}
+
+func (t *BlockCacheTest) TearDown() {
+	os.RemoveAll(t.dir)
+}
+
+// Replace the cache with one kept on disk in t.dir for the given scope.
+func (t *BlockCacheTest) open(scope string) {
+	var err error
+	t.cache, err = gcsx.OpenBlockCache(t.dir, 4*gcsx.BlockSize, scope)
+	AssertEq(nil, err)
+}
+
+// Return the names of the files in t.dir holding blocks.
+func (t *BlockCacheTest) blockFiles() (names []string) {
+	entries, err := ioutil.ReadDir(t.dir)
+	AssertEq(nil, err)
+
+	for _, fi := range entries {
+		if path.Ext(fi.Name()) == ".block" {
+			names = append(names, fi.Name())
+		}
+	}
+
+	return
+}
+
+// Read [offset, offset+size) of the object through a new caching reader.
+func (t *BlockCacheTest) read(
+	o *gcs.Object,
+	offset int64,
+	size int) (p []byte, err error) {
+	rr, err := gcsx.NewRandomReader(o, &t.bucket, nil)
+	AssertEq(nil, err)
+
+	rr = gcsx.NewCachingReader(rr, t.cache)
+	defer rr.Destroy()
+
+	p = make([]byte, size)
+	n, err := rr.ReadAt(t.ctx, p, offset)
+	p = p[:n]
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *BlockCacheTest) ReadsAcrossBlocks() {
+	offset := int64(gcsx.BlockSize - 10)
+	p, err := t.read(t.object, offset, gcsx.BlockSize)
+
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(t.contents[offset:offset+gcsx.BlockSize], p))
+}
+
+func (t *BlockCacheTest) ReadsLastBlock() {
+	offset := int64(len(t.contents) - 10)
+	p, err := t.read(t.object, offset, 20)
+
+	ExpectEq(io.EOF, err)
+	ExpectTrue(bytes.Equal(t.contents[offset:], p))
+}
+
+func (t *BlockCacheTest) SharedAcrossReaders() {
+	_, err := t.read(t.object, 0, len(t.contents))
+	AssertEq(nil, err)
+	reads := t.bucket.reads
+
+	// Another reader for the same generation is served from the cache.
+	p, err := t.read(t.object, 17, gcsx.BlockSize)
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(t.contents[17:17+gcsx.BlockSize], p))
+	ExpectEq(reads, t.bucket.reads)
+}
+
+func (t *BlockCacheTest) KeyedByGeneration() {
+	_, err := t.read(t.object, 0, 10)
+	AssertEq(nil, err)
+
+	// Replace the object. Reading the new generation goes to GCS.
+	o, err := gcsutil.CreateObject(t.ctx, &t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+	reads := t.bucket.reads
+
+	p, err := t.read(o, 0, 4)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(p))
+	ExpectEq(reads+1, t.bucket.reads)
+}
+
+func (t *BlockCacheTest) EvictsLeastRecentlyUsed() {
+	t.cache = gcsx.NewBlockCache(2 * gcsx.BlockSize)
+
+	// Fill the cache with blocks 0 and 1, then use block 0 again.
+	_, err := t.read(t.object, 0, 2*gcsx.BlockSize)
+	AssertEq(nil, err)
+
+	_, err = t.read(t.object, 0, 1)
+	AssertEq(nil, err)
+
+	// Reading block 2 evicts block 1.
+	_, err = t.read(t.object, 2*gcsx.BlockSize, 1)
+	AssertEq(nil, err)
+
+	ExpectNe(nil, t.cache.LookUp("foo", t.object.Generation, 0))
+	ExpectEq(nil, t.cache.LookUp("foo", t.object.Generation, 1))
+	ExpectNe(nil, t.cache.LookUp("foo", t.object.Generation, 2))
+}
+
+func (t *BlockCacheTest) GenerationGone() {
+	err := t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	_, err = t.read(t.object, 0, 10)
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+	ExpectEq(nil, t.cache.LookUp("foo", t.object.Generation, 0))
+}
+
+func (t *BlockCacheTest) Objects() {
+	_, err := t.read(t.object, 0, 10)
+	AssertEq(nil, err)
+
+	// Cache a newer generation of foo, and another object.
+	foo, err := gcsutil.CreateObject(t.ctx, &t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	bar, err := gcsutil.CreateObject(t.ctx, &t.bucket, "bar", []byte("burrito"))
+	AssertEq(nil, err)
+
+	_, err = t.read(foo, 0, 4)
+	AssertEq(nil, err)
+
+	_, err = t.read(bar, 0, 7)
+	AssertEq(nil, err)
+
+	ExpectThat(t.cache.Objects(), ElementsAre(bar, foo))
+}
+
+func (t *BlockCacheTest) Clear() {
+	_, err := t.read(t.object, 0, len(t.contents))
+	AssertEq(nil, err)
+	ExpectEq(len(t.contents), t.cache.Size())
+
+	t.cache.Clear()
+	ExpectEq(0, t.cache.Size())
+	ExpectEq(nil, t.cache.LookUp("foo", t.object.Generation, 0))
+}
+
+func (t *BlockCacheTest) ReadAt() {
+	_, err := t.read(t.object, 0, 10)
+	AssertEq(nil, err)
+
+	p := make([]byte, 20)
+	n, ok := t.cache.ReadAt("foo", t.object.Generation, 0, p, 17)
+	AssertTrue(ok)
+	ExpectEq(20, n)
+	ExpectTrue(bytes.Equal(t.contents[17:37], p))
+
+	// Only what's left of the block is copied.
+	n, ok = t.cache.ReadAt("foo", t.object.Generation, 0, p, gcsx.BlockSize-5)
+	AssertTrue(ok)
+	ExpectEq(5, n)
+	ExpectTrue(bytes.Equal(t.contents[gcsx.BlockSize-5:gcsx.BlockSize], p[:5]))
+
+	_, ok = t.cache.ReadAt("foo", t.object.Generation, 1, p, 0)
+	ExpectFalse(ok)
+}
+
+func (t *BlockCacheTest) ConcurrentReadsWhileEvicting() {
+	// Room for only one block, so that blocks are evicted, and their buffers
+	// reused, while other readers may be copying from them.
+	t.cache = gcsx.NewBlockCache(gcsx.BlockSize)
+
+	const readers = 8
+	b := syncutil.NewBundle(t.ctx)
+	for i := 0; i < readers; i++ {
+		i := i
+		b.Add(func(ctx context.Context) (err error) {
+			for j := 0; j < 10; j++ {
+				offset := int64((i+j)%3)*gcsx.BlockSize + 17
+
+				var rr gcsx.RandomReader
+				rr, err = gcsx.NewRandomReader(t.object, t.bucket.Bucket, nil)
+				if err != nil {
+					return
+				}
+
+				rr = gcsx.NewCachingReader(rr, t.cache)
+				p := make([]byte, 1000)
+				_, err = rr.ReadAt(ctx, p, offset)
+				rr.Destroy()
+
+				if err != nil {
+					return
+				}
+
+				if !bytes.Equal(t.contents[offset:offset+1000], p) {
+					err = fmt.Errorf("Wrong contents at %d", offset)
+					return
+				}
+			}
+
+			return
+		})
+	}
+
+	ExpectEq(nil, b.Join())
+}
+
+func (t *BlockCacheTest) Disk_ReadsThroughFiles() {
+	t.open("some_bucket")
+
+	_, err := t.read(t.object, 0, len(t.contents))
+	AssertEq(nil, err)
+	ExpectEq(3, len(t.blockFiles()))
+	reads := t.bucket.reads
+
+	p, err := t.read(t.object, 17, gcsx.BlockSize)
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(t.contents[17:17+gcsx.BlockSize], p))
+	ExpectEq(reads, t.bucket.reads)
+}
+
+func (t *BlockCacheTest) Disk_ClearRemovesFiles() {
+	t.open("some_bucket")
+
+	_, err := t.read(t.object, 0, len(t.contents))
+	AssertEq(nil, err)
+
+	t.cache.Clear()
+	ExpectThat(t.blockFiles(), ElementsAre())
+}
+
+func (t *BlockCacheTest) Disk_PersistsAcrossOpens() {
+	t.open("some_bucket")
+
+	_, err := t.read(t.object, 0, len(t.contents))
+	AssertEq(nil, err)
+
+	err = t.cache.SaveIndex()
+	AssertEq(nil, err)
+
+	// A new cache in the same directory has the same blocks.
+	t.open("some_bucket")
+	reads := t.bucket.reads
+
+	p, err := t.read(t.object, 0, len(t.contents))
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(t.contents, p))
+	ExpectEq(reads, t.bucket.reads)
+}
+
+func (t *BlockCacheTest) Disk_IgnoresIndexForOtherScope() {
+	t.open("some_bucket")
+
+	_, err := t.read(t.object, 0, 10)
+	AssertEq(nil, err)
+
+	err = t.cache.SaveIndex()
+	AssertEq(nil, err)
+
+	t.open("other_bucket")
+	ExpectEq(nil, t.cache.LookUp("foo", t.object.Generation, 0))
+	ExpectThat(t.blockFiles(), ElementsAre())
+}
+
+func (t *BlockCacheTest) Disk_RemovesUnindexedFiles() {
+	t.open("some_bucket")
+
+	_, err := t.read(t.object, 0, 10)
+	AssertEq(nil, err)
+
+	err = t.cache.SaveIndex()
+	AssertEq(nil, err)
+
+	// This block is cached after the index was saved, as if we then crashed.
+	_, err = t.read(t.object, gcsx.BlockSize, 10)
+	AssertEq(nil, err)
+	ExpectEq(2, len(t.blockFiles()))
+
+	t.open("some_bucket")
+	ExpectNe(nil, t.cache.LookUp("foo", t.object.Generation, 0))
+	ExpectEq(nil, t.cache.LookUp("foo", t.object.Generation, 1))
+	ExpectEq(1, len(t.blockFiles()))
+}
+
+func (t *BlockCacheTest) Disk_DamagedBlockIsMiss() {
+	t.open("some_bucket")
+
+	_, err := t.read(t.object, 0, 10)
+	AssertEq(nil, err)
+
+	err = t.cache.SaveIndex()
+	AssertEq(nil, err)
+
+	// Flip a byte in the block's file.
+	files := t.blockFiles()
+	AssertEq(1, len(files))
+
+	p := path.Join(t.dir, files[0])
+	contents, err := ioutil.ReadFile(p)
+	AssertEq(nil, err)
+
+	contents[17]++
+	err = ioutil.WriteFile(p, contents, 0600)
+	AssertEq(nil, err)
+
+	// The damage is noticed, whether or not the cache is reopened.
+	ExpectEq(nil, t.cache.LookUp("foo", t.object.Generation, 0))
+
+	err = ioutil.WriteFile(p, contents, 0600)
+	AssertEq(nil, err)
+
+	t.open("some_bucket")
+	ExpectEq(nil, t.cache.LookUp("foo", t.object.Generation, 0))
+
+	// Reading fetches the block again.
+	reads := t.bucket.reads
+	b, err := t.read(t.object, 0, 10)
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(t.contents[:10], b))
+	ExpectEq(reads+1, t.bucket.reads)
+}
+
+func (t *BlockCacheTest) Disk_PersistsAttributes() {
+	t.open("some_bucket")
+
+	// Cache only the first block, so that the size can't be told from the
+	// blocks.
+	_, err := t.read(t.object, 0, 10)
+	AssertEq(nil, err)
+
+	err = t.cache.SaveIndex()
+	AssertEq(nil, err)
+
+	t.open("some_bucket")
+	objects := t.cache.Objects()
+	AssertEq(1, len(objects))
+
+	o := objects[0]
+	ExpectEq("foo", o.Name)
+	ExpectEq(t.object.Generation, o.Generation)
+	ExpectEq(len(t.contents), o.Size)
+	ExpectTrue(o.Updated.Equal(t.object.Updated), "%v", o.Updated)
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import "sync"
+
+// A BufferPool hands out buffers of a fixed size, reusing those returned to
+// it, so that the read path needn't allocate a large buffer for each request
+// and leave the garbage collector to clean up after it. Unused buffers are
+// freed by the garbage collector in time.
+//
+// Safe for concurrent access.
+type BufferPool struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	size int
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	// Holds values of type []byte with capacity size.
+	pool sync.Pool
+}
+
+// NewBufferPool creates a pool of buffers of the given size.
+func NewBufferPool(size int) (bp *BufferPool) {
+	bp = &BufferPool{
+		size: size,
+	}
+
+	bp.pool.New = func() interface{} {
+		return make([]byte, size)
+	}
+
+	return
+}
+
+// Size returns the size of the pool's buffers.
+func (bp *BufferPool) Size() int {
+	return bp.size
+}
+
+// Get returns a buffer of length Size, with undefined contents.
+func (bp *BufferPool) Get() (b []byte) {
+	b = bp.pool.Get().([]byte)
+	b = b[:bp.size]
+	return
+}
+
+// Put returns a buffer obtained from Get, or a slice of one, to the pool. The
+// caller must not use it afterward. Buffers of other capacities are left to
+// the garbage collector.
+func (bp *BufferPool) Put(b []byte) {
+	if cap(b) != bp.size {
+		return
+	}
+
+	bp.pool.Put(b[:0])
+}
@@ -0,0 +1,68 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestBufferPool(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type BufferPoolTest struct {
+	pool *gcsx.BufferPool
+}
+
+var _ SetUpInterface = &BufferPoolTest{}
+
+func init() { RegisterTestSuite(&BufferPoolTest{}) }
+
+func (t *BufferPoolTest) SetUp(ti *TestInfo) {
+	t.pool = gcsx.NewBufferPool(1024)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *BufferPoolTest) Size() {
+	ExpectEq(1024, t.pool.Size())
+}
+
+func (t *BufferPoolTest) BuffersHaveFullLength() {
+	b := t.pool.Get()
+	ExpectEq(1024, len(b))
+	ExpectEq(1024, cap(b))
+
+	// A slice of a buffer comes back whole.
+	t.pool.Put(b[:17])
+
+	b = t.pool.Get()
+	ExpectEq(1024, len(b))
+}
+
+func (t *BufferPoolTest) OtherSizesIgnored() {
+	// A buffer of another size is never handed out.
+	for i := 0; i < 10; i++ {
+		t.pool.Put(make([]byte, 17))
+		ExpectEq(1024, cap(t.pool.Get()))
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// CircuitOpenError is returned by a bucket from NewCircuitBreakerBucket for a
+// request that was failed without being sent, because GCS appears to be down.
+type CircuitOpenError struct {
+	// The error that most recently confirmed that GCS is down.
+	Cause error
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("GCS unavailable, not sending request: %v", e.Cause)
+}
+
+// NewCircuitBreakerBucket wraps a bucket such that once threshold requests in
+// a row have failed in a way that suggests GCS is unavailable, rather than
+// that something is wrong with the particular request, further requests fail
+// straight away with *CircuitOpenError instead of each waiting out its own
+// retries and timeouts. Every probeInterval, one request is let through to
+// probe for recovery; the first request to succeed restores normal service.
+//
+// The failures that count are server errors, rate limiting, network errors,
+// and timeouts, but not those of requests whose contexts were cancelled by
+// their callers. Errors like not found don't count either way. Caches in front
+// of the bucket carry on serving what they hold while requests are being
+// failed, and since *CircuitOpenError has no errno, the file system reports
+// everything else as EIO. Transitions are logged to logger.
+//
+// REQUIRES: threshold > 0
+func NewCircuitBreakerBucket(
+	wrapped gcs.Bucket,
+	threshold int,
+	probeInterval time.Duration,
+	clock timeutil.Clock,
+	logger *log.Logger) (b gcs.Bucket) {
+	b = &circuitBreakerBucket{
+		wrapped:       wrapped,
+		threshold:     threshold,
+		probeInterval: probeInterval,
+		clock:         clock,
+		logger:        logger,
+	}
+
+	return
+}
+
+type circuitBreakerBucket struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	wrapped gcs.Bucket
+	clock   timeutil.Clock
+	logger  *log.Logger
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	threshold     int
+	probeInterval time.Duration
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The number of requests in a row that have failed, while closed.
+	//
+	// GUARDED_BY(mu)
+	failures int
+
+	// Set while requests are being failed without being sent, along with the
+	// error that last confirmed that GCS is down.
+	//
+	// INVARIANT: open == (cause != nil)
+	//
+	// GUARDED_BY(mu)
+	open  bool
+	cause error
+
+	// While open, the time at which the next probe may be sent, and whether one
+	// is in flight.
+	//
+	// GUARDED_BY(mu)
+	probeTime time.Time
+	probing   bool
+}
+
+// Decide whether a request may be sent, returning an error if not. If probe is
+// true, the request is probing for recovery.
+func (b *circuitBreakerBucket) begin() (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return
+	}
+
+	if b.probing || b.clock.Now().Before(b.probeTime) {
+		err = &CircuitOpenError{Cause: b.cause}
+		return
+	}
+
+	b.probing = true
+	probe = true
+	return
+}
+
+// Record the outcome of a request for which begin returned the given value of
+// probe.
+func (b *circuitBreakerBucket) end(
+	ctx context.Context,
+	probe bool,
+	err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing = false
+	}
+
+	// A request abandoned by its caller tells us nothing. If it was a probe,
+	// let the next request probe instead.
+	if ctx.Err() != nil {
+		return
+	}
+
+	if err == nil || !isOutage(err) {
+		b.failures = 0
+		if b.open {
+			b.open = false
+			b.cause = nil
+			b.logger.Printf("GCS is reachable again; sending requests as usual.")
+		}
+
+		return
+	}
+
+	b.failures++
+	switch {
+	case probe:
+		b.cause = err
+		b.probeTime = b.clock.Now().Add(b.probeInterval)
+
+	case !b.open && b.failures >= b.threshold:
+		b.open = true
+		b.cause = err
+		b.probeTime = b.clock.Now().Add(b.probeInterval)
+		b.logger.Printf(
+			"%d GCS requests in a row have failed; failing requests without "+
+				"sending them, except for a probe every %v. Latest error: %v",
+			b.failures,
+			b.probeInterval,
+			err)
+	}
+}
+
+// Does the error suggest that GCS is unavailable, rather than that something
+// is wrong with the request? These are roughly the errors that package gcs
+// retries.
+func isOutage(err error) bool {
+	switch typed := err.(type) {
+	case *CircuitOpenError:
+		return true
+
+	case *googleapi.Error:
+		return typed.Code >= 500 || typed.Code == http.StatusTooManyRequests
+
+	case *url.Error:
+		return isOutage(typed.Err)
+
+	case net.Error:
+		return true
+	}
+
+	return err == io.ErrUnexpectedEOF || err == context.DeadlineExceeded
+}
+
+func (b *circuitBreakerBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *circuitBreakerBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	probe, err := b.begin()
+	if err != nil {
+		return
+	}
+
+	rc, err = b.wrapped.NewReader(ctx, req)
+	b.end(ctx, probe, err)
+	return
+}
+
+func (b *circuitBreakerBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	probe, err := b.begin()
+	if err != nil {
+		return
+	}
+
+	o, err = b.wrapped.CreateObject(ctx, req)
+	b.end(ctx, probe, err)
+	return
+}
+
+func (b *circuitBreakerBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	probe, err := b.begin()
+	if err != nil {
+		return
+	}
+
+	o, err = b.wrapped.CopyObject(ctx, req)
+	b.end(ctx, probe, err)
+	return
+}
+
+func (b *circuitBreakerBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	probe, err := b.begin()
+	if err != nil {
+		return
+	}
+
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	b.end(ctx, probe, err)
+	return
+}
+
+func (b *circuitBreakerBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	probe, err := b.begin()
+	if err != nil {
+		return
+	}
+
+	o, err = b.wrapped.StatObject(ctx, req)
+	b.end(ctx, probe, err)
+	return
+}
+
+func (b *circuitBreakerBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	probe, err := b.begin()
+	if err != nil {
+		return
+	}
+
+	l, err = b.wrapped.ListObjects(ctx, req)
+	b.end(ctx, probe, err)
+	return
+}
+
+func (b *circuitBreakerBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	probe, err := b.begin()
+	if err != nil {
+		return
+	}
+
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	b.end(ctx, probe, err)
+	return
+}
+
+func (b *circuitBreakerBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	probe, err := b.begin()
+	if err != nil {
+		return
+	}
+
+	err = b.wrapped.DeleteObject(ctx, req)
+	b.end(ctx, probe, err)
+	return
+}
@@ -0,0 +1,221 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestCircuitBreakerBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const (
+	breakerThreshold     = 3
+	breakerProbeInterval = 5 * time.Second
+)
+
+// A bucket whose StatObject requests fail with a configurable error.
+type failingStatBucket struct {
+	gcs.Bucket
+
+	err   error
+	calls int
+}
+
+func (b *failingStatBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	b.calls++
+	if b.err != nil {
+		err = b.err
+		return
+	}
+
+	o, err = b.Bucket.StatObject(ctx, req)
+	return
+}
+
+type CircuitBreakerBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	wrapped *failingStatBucket
+	bucket  gcs.Bucket
+}
+
+var _ SetUpInterface = &CircuitBreakerBucketTest{}
+
+func init() { RegisterTestSuite(&CircuitBreakerBucketTest{}) }
+
+func (t *CircuitBreakerBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2016, 1, 1, 0, 0, 0, 0, time.Local))
+	t.wrapped = &failingStatBucket{
+		Bucket: gcsfake.NewFakeBucket(&t.clock, "some_bucket"),
+	}
+
+	t.bucket = gcsx.NewCircuitBreakerBucket(
+		t.wrapped,
+		breakerThreshold,
+		breakerProbeInterval,
+		&t.clock,
+		log.New(ioutil.Discard, "", 0))
+
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped, "foo", []byte("taco"))
+	AssertEq(nil, err)
+}
+
+func (t *CircuitBreakerBucketTest) stat() (err error) {
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	return
+}
+
+// Make enough requests fail to open the breaker.
+func (t *CircuitBreakerBucketTest) trip() {
+	t.wrapped.err = &googleapi.Error{Code: 503}
+	for i := 0; i < breakerThreshold; i++ {
+		AssertThat(t.stat(), Error(HasSubstr("503")))
+	}
+
+	t.wrapped.calls = 0
+}
+
+func isCircuitOpen(err error) bool {
+	_, ok := err.(*gcsx.CircuitOpenError)
+	return ok
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *CircuitBreakerBucketTest) OpensAfterThreshold() {
+	t.trip()
+
+	err := t.stat()
+	ExpectTrue(isCircuitOpen(err), "%v", err)
+	ExpectThat(err, Error(HasSubstr("503")))
+	ExpectEq(0, t.wrapped.calls)
+
+	// Other kinds of request are failed too.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "bar", []byte("burrito"))
+	ExpectTrue(isCircuitOpen(err), "%v", err)
+
+	// And the failures have no errno, so they become EIO.
+	_, ok := gcsx.Errno(err)
+	ExpectFalse(ok)
+}
+
+func (t *CircuitBreakerBucketTest) SuccessResetsCount() {
+	t.wrapped.err = &googleapi.Error{Code: 503}
+	for i := 0; i < breakerThreshold-1; i++ {
+		t.stat()
+	}
+
+	t.wrapped.err = nil
+	AssertEq(nil, t.stat())
+
+	t.wrapped.err = &googleapi.Error{Code: 503}
+	for i := 0; i < breakerThreshold-1; i++ {
+		t.stat()
+	}
+
+	t.wrapped.calls = 0
+	t.stat()
+	ExpectEq(1, t.wrapped.calls)
+}
+
+func (t *CircuitBreakerBucketTest) RequestSpecificErrorsDontCount() {
+	t.wrapped.err = &gcs.NotFoundError{}
+	for i := 0; i < 2*breakerThreshold; i++ {
+		t.stat()
+	}
+
+	t.wrapped.err = &googleapi.Error{Code: 400}
+	for i := 0; i < 2*breakerThreshold; i++ {
+		t.stat()
+	}
+
+	t.wrapped.calls = 0
+	err := t.stat()
+	ExpectFalse(isCircuitOpen(err), "%v", err)
+	ExpectEq(1, t.wrapped.calls)
+}
+
+func (t *CircuitBreakerBucketTest) CancelledRequestsDontCount() {
+	ctx, cancel := context.WithCancel(t.ctx)
+	cancel()
+
+	t.wrapped.err = &googleapi.Error{Code: 503}
+	for i := 0; i < 2*breakerThreshold; i++ {
+		t.bucket.StatObject(ctx, &gcs.StatObjectRequest{Name: "foo"})
+	}
+
+	t.wrapped.calls = 0
+	err := t.stat()
+	ExpectFalse(isCircuitOpen(err), "%v", err)
+	ExpectEq(1, t.wrapped.calls)
+}
+
+func (t *CircuitBreakerBucketTest) SuccessfulProbeCloses() {
+	t.trip()
+	t.wrapped.err = nil
+
+	// Not yet time to probe.
+	t.clock.AdvanceTime(breakerProbeInterval - time.Millisecond)
+	ExpectTrue(isCircuitOpen(t.stat()))
+	ExpectEq(0, t.wrapped.calls)
+
+	// Now the probe goes through, and so does everything after it.
+	t.clock.AdvanceTime(time.Millisecond)
+	ExpectEq(nil, t.stat())
+	ExpectEq(nil, t.stat())
+	ExpectEq(2, t.wrapped.calls)
+}
+
+func (t *CircuitBreakerBucketTest) FailedProbeStaysOpen() {
+	t.trip()
+
+	t.clock.AdvanceTime(breakerProbeInterval)
+	err := t.stat()
+	ExpectFalse(isCircuitOpen(err), "%v", err)
+	ExpectEq(1, t.wrapped.calls)
+
+	// The next probe waits for another interval.
+	t.wrapped.err = nil
+	t.clock.AdvanceTime(breakerProbeInterval - time.Millisecond)
+	ExpectTrue(isCircuitOpen(t.stat()))
+	ExpectEq(1, t.wrapped.calls)
+
+	t.clock.AdvanceTime(time.Millisecond)
+	ExpectEq(nil, t.stat())
+	ExpectEq(2, t.wrapped.calls)
+}
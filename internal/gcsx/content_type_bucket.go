@@ -15,21 +15,34 @@
 package gcsx
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"mime"
+	"net/http"
 	"path"
 
 	"github.com/jacobsa/gcloud/gcs"
 	"golang.org/x/net/context"
 )
 
+// The number of leading bytes that http.DetectContentType considers.
+const sniffLen = 512
+
 // NewContentTypeBucket creates a wrapper bucket that guesses MIME types for
 // newly created or composed objects when an explicit type is not already set.
-func NewContentTypeBucket(b gcs.Bucket) gcs.Bucket {
-	return contentTypeBucket{b}
+// Guesses are based on the name's extension. If sniff is set and that fails,
+// created objects' types are guessed from their first few bytes instead.
+func NewContentTypeBucket(b gcs.Bucket, sniff bool) gcs.Bucket {
+	return contentTypeBucket{
+		Bucket: b,
+		sniff:  sniff,
+	}
 }
 
 type contentTypeBucket struct {
 	gcs.Bucket
+	sniff bool
 }
 
 func (b contentTypeBucket) CreateObject(
@@ -40,6 +53,13 @@ func (b contentTypeBucket) CreateObject(
 		req.ContentType = mime.TypeByExtension(path.Ext(req.Name))
 	}
 
+	if req.ContentType == "" && b.sniff {
+		err = sniffContentType(req)
+		if err != nil {
+			return
+		}
+	}
+
 	// Pass on the request.
 	o, err = b.Bucket.CreateObject(ctx, req)
 	return
@@ -57,3 +77,33 @@ func (b contentTypeBucket) ComposeObjects(
 	o, err = b.Bucket.ComposeObjects(ctx, req)
 	return
 }
+
+// Set the request's content type based on the start of its contents, leaving
+// it empty if nothing more specific than GCS's default is detected. The
+// contents are replaced with a reader that includes the bytes consumed.
+func sniffContentType(req *gcs.CreateObjectRequest) (err error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(req.Contents, head)
+	switch err {
+	case nil, io.EOF, io.ErrUnexpectedEOF:
+		err = nil
+
+	default:
+		err = fmt.Errorf("ReadFull: %v", err)
+		return
+	}
+
+	head = head[:n]
+	req.Contents = io.MultiReader(bytes.NewReader(head), req.Contents)
+
+	// Empty contents tell us nothing.
+	if n == 0 {
+		return
+	}
+
+	if t := http.DetectContentType(head); t != "application/octet-stream" {
+		req.ContentType = t
+	}
+
+	return
+}
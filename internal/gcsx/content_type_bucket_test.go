@@ -15,6 +15,7 @@
 package gcsx_test
 
 import (
+	"io/ioutil"
 	"strings"
 	"testing"
 
@@ -83,7 +84,8 @@ func TestContentTypeBucket_CreateObject(t *testing.T) {
 	for i, tc := range contentTypeBucketTestCases {
 		// Set up a bucket.
 		bucket := gcsx.NewContentTypeBucket(
-			gcsfake.NewFakeBucket(timeutil.RealClock(), ""))
+			gcsfake.NewFakeBucket(timeutil.RealClock(), ""),
+			false)
 
 		// Create the object.
 		req := &gcs.CreateObjectRequest{
@@ -111,7 +113,8 @@ func TestContentTypeBucket_ComposeObjects(t *testing.T) {
 	for i, tc := range contentTypeBucketTestCases {
 		// Set up a bucket.
 		bucket := gcsx.NewContentTypeBucket(
-			gcsfake.NewFakeBucket(timeutil.RealClock(), ""))
+			gcsfake.NewFakeBucket(timeutil.RealClock(), ""),
+			false)
 
 		// Create a source object.
 		const srcName = "some_src"
@@ -142,3 +145,95 @@ func TestContentTypeBucket_ComposeObjects(t *testing.T) {
 		}
 	}
 }
+
+var contentTypeBucketSniffingTestCases = []struct {
+	name     string
+	request  string // ContentType in request
+	contents string
+	expected string // Expected final type
+}{
+	// An extension wins.
+	0: {
+		name:     "foo/bar.jpg",
+		contents: "<html></html>",
+		expected: "image/jpeg",
+	},
+
+	// So does an explicit type.
+	1: {
+		name:     "foo/bar",
+		request:  "image/jpeg",
+		contents: "<html></html>",
+		expected: "image/jpeg",
+	},
+
+	// Sniffed types.
+	2: {
+		name:     "foo/bar",
+		contents: "<html></html>",
+		expected: "text/html; charset=utf-8",
+	},
+
+	3: {
+		name:     "foo/bar.asdf",
+		contents: "\x89PNG\x0d\x0a\x1a\x0a" + strings.Repeat("\x00", 1000),
+		expected: "image/png",
+	},
+
+	// Nothing useful to go on.
+	4: {
+		name:     "foo/bar",
+		contents: "",
+		expected: "",
+	},
+
+	5: {
+		name:     "foo/bar",
+		contents: "\x00\x01\x02\x03",
+		expected: "",
+	},
+}
+
+func TestContentTypeBucket_Sniffing(t *testing.T) {
+	ctx := context.Background()
+
+	for i, tc := range contentTypeBucketSniffingTestCases {
+		// Set up a bucket.
+		bucket := gcsx.NewContentTypeBucket(
+			gcsfake.NewFakeBucket(timeutil.RealClock(), ""),
+			true)
+
+		// Create the object.
+		req := &gcs.CreateObjectRequest{
+			Name:        tc.name,
+			ContentType: tc.request,
+			Contents:    strings.NewReader(tc.contents),
+		}
+
+		o, err := bucket.CreateObject(ctx, req)
+		if err != nil {
+			t.Fatalf("Test case %d: CreateObject: %v", i, err)
+		}
+
+		// Check the content type.
+		if got, want := o.ContentType, tc.expected; got != want {
+			t.Errorf("Test case %d: o.ContentType is %q, want %q", i, got, want)
+		}
+
+		// The contents should be intact.
+		rc, err := bucket.NewReader(ctx, &gcs.ReadObjectRequest{Name: tc.name})
+		if err != nil {
+			t.Fatalf("Test case %d: NewReader: %v", i, err)
+		}
+
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("Test case %d: ReadAll: %v", i, err)
+		}
+
+		if got, want := string(b), tc.contents; got != want {
+			t.Errorf("Test case %d: contents are %q, want %q", i, got, want)
+		}
+	}
+}
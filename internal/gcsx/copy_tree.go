@@ -0,0 +1,103 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/jacobsa/syncutil"
+	"golang.org/x/net/context"
+)
+
+// CopyTree copies every object whose name begins with srcPrefix to the same
+// name with dstPrefix in its place, using server-side copies so that no
+// contents pass through this process, with up to parallelism copies in
+// flight. Each object is copied as of the generation seen when listing it.
+// The prefixes must both be empty or end in a slash, and neither may contain
+// the other. Returns the number of objects copied, even on error.
+func CopyTree(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	srcPrefix string,
+	dstPrefix string,
+	parallelism int) (n int, err error) {
+	for _, p := range []string{srcPrefix, dstPrefix} {
+		if p != "" && !strings.HasSuffix(p, "/") {
+			err = fmt.Errorf("Illegal prefix %q", p)
+			return
+		}
+	}
+
+	// Otherwise we may copy our own copies, or overwrite what we're copying.
+	if strings.HasPrefix(srcPrefix, dstPrefix) ||
+		strings.HasPrefix(dstPrefix, srcPrefix) {
+		err = fmt.Errorf("%q and %q overlap", srcPrefix, dstPrefix)
+		return
+	}
+
+	if parallelism < 1 {
+		err = fmt.Errorf("Illegal parallelism: %d", parallelism)
+		return
+	}
+
+	b := syncutil.NewBundle(ctx)
+
+	// List the source objects.
+	objects := make(chan *gcs.Object, 100)
+	b.Add(func(ctx context.Context) (err error) {
+		defer close(objects)
+		err = gcsutil.ListPrefix(ctx, bucket, srcPrefix, objects)
+		if err != nil {
+			err = fmt.Errorf("ListPrefix: %v", err)
+			return
+		}
+
+		return
+	})
+
+	// Copy them.
+	var copied int64
+	for i := 0; i < parallelism; i++ {
+		b.Add(func(ctx context.Context) (err error) {
+			for o := range objects {
+				dstName := dstPrefix + strings.TrimPrefix(o.Name, srcPrefix)
+				_, err = bucket.CopyObject(
+					ctx,
+					&gcs.CopyObjectRequest{
+						SrcName:       o.Name,
+						DstName:       dstName,
+						SrcGeneration: o.Generation,
+					})
+
+				if err != nil {
+					err = fmt.Errorf("CopyObject(%q): %v", o.Name, err)
+					return
+				}
+
+				atomic.AddInt64(&copied, 1)
+			}
+
+			return
+		})
+	}
+
+	err = b.Join()
+	n = int(atomic.LoadInt64(&copied))
+	return
+}
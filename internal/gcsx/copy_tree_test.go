@@ -0,0 +1,158 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestCopyTree(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type CopyTreeTest struct {
+	ctx    context.Context
+	bucket gcs.Bucket
+}
+
+var _ SetUpInterface = &CopyTreeTest{}
+
+func init() { RegisterTestSuite(&CopyTreeTest{}) }
+
+func (t *CopyTreeTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.bucket = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+
+	err := gcsutil.CreateObjects(
+		t.ctx,
+		t.bucket,
+		map[string][]byte{
+			"foo/":        []byte(""),
+			"foo/bar":     []byte("taco"),
+			"foo/baz/":    []byte(""),
+			"foo/baz/qux": []byte("burrito"),
+			"foobar":      []byte("enchilada"),
+			"other/thing": []byte("queso"),
+		})
+
+	AssertEq(nil, err)
+}
+
+// Return the contents of the objects under the given prefix, by name.
+func (t *CopyTreeTest) contents(prefix string) (m map[string]string) {
+	m = make(map[string]string)
+
+	objects, _, err := gcsutil.ListAll(
+		t.ctx,
+		t.bucket,
+		&gcs.ListObjectsRequest{Prefix: prefix})
+
+	AssertEq(nil, err)
+
+	for _, o := range objects {
+		var b []byte
+		b, err = gcsutil.ReadObject(t.ctx, t.bucket, o.Name)
+		AssertEq(nil, err)
+		m[o.Name] = string(b)
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *CopyTreeTest) CopiesEverythingUnderPrefix() {
+	n, err := gcsx.CopyTree(t.ctx, t.bucket, "foo/", "dst/", 2)
+	AssertEq(nil, err)
+	ExpectEq(4, n)
+
+	ExpectThat(
+		t.contents("dst/"),
+		DeepEquals(map[string]string{
+			"dst/":        "",
+			"dst/bar":     "taco",
+			"dst/baz/":    "",
+			"dst/baz/qux": "burrito",
+		}))
+
+	// The sources are untouched.
+	ExpectEq(4, len(t.contents("foo/")))
+}
+
+func (t *CopyTreeTest) NestedDestination() {
+	n, err := gcsx.CopyTree(t.ctx, t.bucket, "foo/baz/", "other/copy/", 1)
+	AssertEq(nil, err)
+	ExpectEq(2, n)
+
+	ExpectThat(
+		t.contents("other/"),
+		DeepEquals(map[string]string{
+			"other/copy/":    "",
+			"other/copy/qux": "burrito",
+			"other/thing":    "queso",
+		}))
+}
+
+func (t *CopyTreeTest) NothingToCopy() {
+	n, err := gcsx.CopyTree(t.ctx, t.bucket, "missing/", "dst/", 4)
+	AssertEq(nil, err)
+	ExpectEq(0, n)
+	ExpectEq(0, len(t.contents("dst/")))
+}
+
+func (t *CopyTreeTest) PrefixWithoutSlash() {
+	_, err := gcsx.CopyTree(t.ctx, t.bucket, "foo", "dst/", 1)
+	ExpectThat(err, Error(HasSubstr("Illegal prefix")))
+
+	_, err = gcsx.CopyTree(t.ctx, t.bucket, "foo/", "dst", 1)
+	ExpectThat(err, Error(HasSubstr("Illegal prefix")))
+}
+
+func (t *CopyTreeTest) OverlappingPrefixes() {
+	cases := [][2]string{
+		{"foo/", "foo/"},
+		{"foo/", "foo/copy/"},
+		{"foo/baz/", "foo/"},
+		{"", "dst/"},
+		{"foo/", ""},
+	}
+
+	for _, c := range cases {
+		_, err := gcsx.CopyTree(t.ctx, t.bucket, c[0], c[1], 1)
+		ExpectThat(err, Error(HasSubstr("overlap")), "%q", c)
+	}
+
+	// Nothing was copied.
+	ExpectEq(4, len(t.contents("foo/")))
+}
+
+func (t *CopyTreeTest) IllegalParallelism() {
+	_, err := gcsx.CopyTree(t.ctx, t.bucket, "foo/", "dst/", 0)
+	ExpectThat(err, Error(HasSubstr("parallelism")))
+}
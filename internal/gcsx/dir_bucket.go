@@ -0,0 +1,686 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+// The subdirectories of the directory of a bucket from OpenDirBucket. The
+// first holds each object's attributes as JSON, in a file named for a hash of
+// its name, and the second its contents, in a file named for its generation.
+const (
+	dirBucketAttributes = "attributes"
+	dirBucketContents   = "contents"
+)
+
+// OpenDirBucket creates a bucket with the given name whose objects are kept in
+// files in the given directory, which it must have to itself, so that they
+// outlast the process. Objects left there by an earlier process are in the
+// bucket from the start.
+//
+// Each change takes effect by renaming a single file into place, so a crash
+// leaves either the old or the new version of an object. Listings are
+// returned in one piece, and noncurrent generations aren't kept.
+func OpenDirBucket(
+	name string,
+	dir string,
+	clock timeutil.Clock) (b gcs.Bucket, err error) {
+	db := &dirBucket{
+		name:    name,
+		dir:     dir,
+		clock:   clock,
+		objects: make(map[string]*gcs.Object),
+	}
+
+	for _, sub := range []string{dirBucketAttributes, dirBucketContents} {
+		err = os.MkdirAll(path.Join(dir, sub), 0700)
+		if err != nil {
+			err = fmt.Errorf("MkdirAll: %v", err)
+			return
+		}
+	}
+
+	err = db.load()
+	if err != nil {
+		err = fmt.Errorf("load: %v", err)
+		return
+	}
+
+	b = db
+	return
+}
+
+type dirBucket struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	name  string
+	dir   string
+	clock timeutil.Clock
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The current objects by name, and their names in order. The objects are
+	// never modified once added, so they may be handed out.
+	//
+	// INVARIANT: names is sorted and holds exactly the keys of objects
+	// INVARIANT: For each o in objects, o's files exist
+	//
+	// GUARDED_BY(mu)
+	objects map[string]*gcs.Object
+	names   []string
+
+	// The generation most recently given to an object.
+	//
+	// GUARDED_BY(mu)
+	prevGeneration int64
+}
+
+func (b *dirBucket) attributesPath(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return path.Join(b.dir, dirBucketAttributes, hex.EncodeToString(sum[:]))
+}
+
+func (b *dirBucket) contentsPath(generation int64) string {
+	return path.Join(
+		b.dir,
+		dirBucketContents,
+		strconv.FormatInt(generation, 10))
+}
+
+// Read the attributes of the objects in the directory, removing the files
+// that an interrupted change left behind.
+func (b *dirBucket) load() (err error) {
+	dir := path.Join(b.dir, dirBucketAttributes)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		err = fmt.Errorf("ReadDir: %v", err)
+		return
+	}
+
+	referenced := make(map[string]bool)
+	for _, fi := range entries {
+		p := path.Join(dir, fi.Name())
+
+		var buf []byte
+		buf, err = ioutil.ReadFile(p)
+		if err != nil {
+			err = fmt.Errorf("ReadFile: %v", err)
+			return
+		}
+
+		// A temporary file never renamed into place is under another name.
+		var o *gcs.Object
+		if json.Unmarshal(buf, &o) != nil || o == nil ||
+			b.attributesPath(o.Name) != p {
+			os.Remove(p)
+			continue
+		}
+
+		b.objects[o.Name] = o
+		b.names = append(b.names, o.Name)
+		referenced[strconv.FormatInt(o.Generation, 10)] = true
+		if o.Generation > b.prevGeneration {
+			b.prevGeneration = o.Generation
+		}
+	}
+
+	sort.Strings(b.names)
+
+	// Remove contents not yet committed or already replaced.
+	dir = path.Join(b.dir, dirBucketContents)
+	entries, err = ioutil.ReadDir(dir)
+	if err != nil {
+		err = fmt.Errorf("ReadDir: %v", err)
+		return
+	}
+
+	for _, fi := range entries {
+		if !referenced[fi.Name()] {
+			os.Remove(path.Join(dir, fi.Name()))
+		}
+	}
+
+	return
+}
+
+// Write the supplied contents to a temporary file, returning its path and an
+// object recording their size and checksums.
+func (b *dirBucket) writeContents(
+	r io.Reader) (tmp string, o *gcs.Object, err error) {
+	f, err := ioutil.TempFile(path.Join(b.dir, dirBucketContents), "tmp")
+	if err != nil {
+		err = fmt.Errorf("TempFile: %v", err)
+		return
+	}
+
+	crc := crc32.New(crc32cTable)
+	md5Hash := md5.New()
+	n, err := io.Copy(io.MultiWriter(f, crc, md5Hash), r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		err = fmt.Errorf("Copy: %v", err)
+		return
+	}
+
+	var md5Sum [md5.Size]byte
+	copy(md5Sum[:], md5Hash.Sum(nil))
+
+	tmp = f.Name()
+	o = &gcs.Object{
+		Size:           uint64(n),
+		CRC32C:         crc.Sum32(),
+		MD5:            &md5Sum,
+		ComponentCount: 1,
+	}
+
+	return
+}
+
+// Replace the attributes file for the supplied object.
+func (b *dirBucket) writeAttributes(o *gcs.Object) (err error) {
+	buf, err := json.Marshal(o)
+	if err != nil {
+		err = fmt.Errorf("json.Marshal: %v", err)
+		return
+	}
+
+	f, err := ioutil.TempFile(path.Join(b.dir, dirBucketAttributes), "tmp")
+	if err != nil {
+		err = fmt.Errorf("TempFile: %v", err)
+		return
+	}
+
+	_, err = f.Write(buf)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		err = fmt.Errorf("Write: %v", err)
+		return
+	}
+
+	err = os.Rename(f.Name(), b.attributesPath(o.Name))
+	if err != nil {
+		os.Remove(f.Name())
+		err = fmt.Errorf("Rename: %v", err)
+		return
+	}
+
+	return
+}
+
+// Open the contents of the current object with the given name, which must
+// have the given generation unless it is zero.
+func (b *dirBucket) open(
+	name string,
+	generation int64) (o *gcs.Object, f *os.File, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	o = b.objects[name]
+	if o == nil || (generation != 0 && generation != o.Generation) {
+		err = notFound(name)
+		return
+	}
+
+	f, err = os.Open(b.contentsPath(o.Generation))
+	if err != nil {
+		err = fmt.Errorf("Open: %v", err)
+		return
+	}
+
+	return
+}
+
+// LOCKS_REQUIRED(b.mu)
+func (b *dirBucket) checkPreconditions(
+	name string,
+	generation *int64,
+	metaGeneration *int64) (err error) {
+	o := b.objects[name]
+	if generation != nil {
+		var current int64
+		if o != nil {
+			current = o.Generation
+		}
+
+		if current != *generation {
+			err = preconditionFailed(name)
+			return
+		}
+	}
+
+	if metaGeneration != nil && (o == nil || o.MetaGeneration != *metaGeneration) {
+		err = preconditionFailed(name)
+		return
+	}
+
+	return
+}
+
+// Give the supplied object, whose contents are in the given temporary file, a
+// new generation, and make it the current object with its name.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *dirBucket) commit(o *gcs.Object, tmp string) (err error) {
+	now := b.clock.Now()
+	generation := now.UnixNano()
+	if generation <= b.prevGeneration {
+		generation = b.prevGeneration + 1
+	}
+
+	b.prevGeneration = generation
+
+	o.Generation = generation
+	o.MetaGeneration = 1
+	o.Created = now
+	o.Updated = now
+
+	err = os.Rename(tmp, b.contentsPath(generation))
+	if err != nil {
+		os.Remove(tmp)
+		err = fmt.Errorf("Rename: %v", err)
+		return
+	}
+
+	err = b.writeAttributes(o)
+	if err != nil {
+		os.Remove(b.contentsPath(generation))
+		err = fmt.Errorf("writeAttributes: %v", err)
+		return
+	}
+
+	prev := b.objects[o.Name]
+	b.set(o)
+
+	if prev != nil {
+		os.Remove(b.contentsPath(prev.Generation))
+	}
+
+	return
+}
+
+// Make the supplied object the current one with its name in memory.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *dirBucket) set(o *gcs.Object) {
+	if b.objects[o.Name] == nil {
+		i := sort.SearchStrings(b.names, o.Name)
+		b.names = append(b.names, "")
+		copy(b.names[i+1:], b.names[i:])
+		b.names[i] = o.Name
+	}
+
+	b.objects[o.Name] = o
+}
+
+func copyMetadata(m map[string]string) (c map[string]string) {
+	if m == nil {
+		return
+	}
+
+	c = make(map[string]string)
+	for k, v := range m {
+		c[k] = v
+	}
+
+	return
+}
+
+func (b *dirBucket) Name() string {
+	return b.name
+}
+
+func (b *dirBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	o, f, err := b.open(req.Name, req.Generation)
+	if err != nil {
+		return
+	}
+
+	if req.Range == nil {
+		rc = f
+		return
+	}
+
+	// Clip the range to the object, as GCS does.
+	start, limit := req.Range.Start, req.Range.Limit
+	if limit > o.Size {
+		limit = o.Size
+	}
+
+	if start > limit {
+		start = limit
+	}
+
+	_, err = f.Seek(int64(start), 0)
+	if err != nil {
+		f.Close()
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	rc = &limitedFile{
+		Reader: io.LimitReader(f, int64(limit-start)),
+		Closer: f,
+	}
+
+	return
+}
+
+// A reader for part of a file, which closes the file.
+type limitedFile struct {
+	io.Reader
+	io.Closer
+}
+
+func (b *dirBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	tmp, o, err := b.writeContents(req.Contents)
+	if err != nil {
+		err = fmt.Errorf("writeContents: %v", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+
+	if req.CRC32C != nil && *req.CRC32C != o.CRC32C {
+		err = fmt.Errorf(
+			"CRC32C mismatch: got 0x%08x, expected 0x%08x",
+			o.CRC32C,
+			*req.CRC32C)
+
+		return
+	}
+
+	if req.MD5 != nil && *req.MD5 != *o.MD5 {
+		err = fmt.Errorf(
+			"MD5 mismatch: got %s, expected %s",
+			hex.EncodeToString(o.MD5[:]),
+			hex.EncodeToString(req.MD5[:]))
+
+		return
+	}
+
+	o.Name = req.Name
+	o.ContentType = req.ContentType
+	o.ContentLanguage = req.ContentLanguage
+	o.ContentEncoding = req.ContentEncoding
+	o.CacheControl = req.CacheControl
+	o.Metadata = copyMetadata(req.Metadata)
+	o.StorageClass = req.StorageClass
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err = b.checkPreconditions(
+		req.Name,
+		req.GenerationPrecondition,
+		req.MetaGenerationPrecondition)
+
+	if err != nil {
+		return
+	}
+
+	err = b.commit(o, tmp)
+	return
+}
+
+func (b *dirBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	src, f, err := b.open(req.SrcName, req.SrcGeneration)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	if req.SrcMetaGenerationPrecondition != nil &&
+		*req.SrcMetaGenerationPrecondition != src.MetaGeneration {
+		err = preconditionFailed(req.SrcName)
+		return
+	}
+
+	tmp, _, err := b.writeContents(f)
+	if err != nil {
+		err = fmt.Errorf("writeContents: %v", err)
+		return
+	}
+
+	dst := *src
+	dst.Name = req.DstName
+	o = &dst
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err = b.checkPreconditions(req.DstName, req.DstGenerationPrecondition, nil)
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	err = b.commit(o, tmp)
+	return
+}
+
+func (b *dirBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	var readers []io.Reader
+	var componentCount int64
+	for _, src := range req.Sources {
+		var srcObject *gcs.Object
+		var f *os.File
+		srcObject, f, err = b.open(src.Name, src.Generation)
+		if err != nil {
+			return
+		}
+
+		defer f.Close()
+
+		readers = append(readers, f)
+		componentCount += srcObject.ComponentCount
+	}
+
+	tmp, o, err := b.writeContents(io.MultiReader(readers...))
+	if err != nil {
+		err = fmt.Errorf("writeContents: %v", err)
+		return
+	}
+
+	// Composite objects have no MD5.
+	o.Name = req.DstName
+	o.ContentType = req.ContentType
+	o.Metadata = copyMetadata(req.Metadata)
+	o.StorageClass = req.StorageClass
+	o.ComponentCount = componentCount
+	o.MD5 = nil
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err = b.checkPreconditions(
+		req.DstName,
+		req.DstGenerationPrecondition,
+		req.DstMetaGenerationPrecondition)
+
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	err = b.commit(o, tmp)
+	return
+}
+
+func (b *dirBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	o = b.objects[req.Name]
+	if o == nil {
+		err = notFound(req.Name)
+		return
+	}
+
+	return
+}
+
+func (b *dirBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	listing = listSorted(b.names, b.objects, req)
+	return
+}
+
+func (b *dirBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current := b.objects[req.Name]
+	if current == nil ||
+		(req.Generation != 0 && req.Generation != current.Generation) {
+		err = notFound(req.Name)
+		return
+	}
+
+	if req.MetaGenerationPrecondition != nil &&
+		*req.MetaGenerationPrecondition != current.MetaGeneration {
+		err = preconditionFailed(req.Name)
+		return
+	}
+
+	updated := *current
+	if req.ContentType != nil {
+		updated.ContentType = *req.ContentType
+	}
+
+	if req.ContentEncoding != nil {
+		updated.ContentEncoding = *req.ContentEncoding
+	}
+
+	if req.ContentLanguage != nil {
+		updated.ContentLanguage = *req.ContentLanguage
+	}
+
+	if req.CacheControl != nil {
+		updated.CacheControl = *req.CacheControl
+	}
+
+	if len(req.Metadata) > 0 {
+		updated.Metadata = make(map[string]string)
+		for k, v := range current.Metadata {
+			updated.Metadata[k] = v
+		}
+
+		for k, v := range req.Metadata {
+			if v == nil {
+				delete(updated.Metadata, k)
+				continue
+			}
+
+			updated.Metadata[k] = *v
+		}
+	}
+
+	updated.MetaGeneration++
+	updated.Updated = b.clock.Now()
+
+	err = b.writeAttributes(&updated)
+	if err != nil {
+		err = fmt.Errorf("writeAttributes: %v", err)
+		return
+	}
+
+	b.set(&updated)
+	o = &updated
+	return
+}
+
+func (b *dirBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	o := b.objects[req.Name]
+	if o == nil || (req.Generation != 0 && req.Generation != o.Generation) {
+		return
+	}
+
+	if req.MetaGenerationPrecondition != nil &&
+		*req.MetaGenerationPrecondition != o.MetaGeneration {
+		err = preconditionFailed(req.Name)
+		return
+	}
+
+	err = os.Remove(b.attributesPath(req.Name))
+	if err != nil {
+		err = fmt.Errorf("Remove: %v", err)
+		return
+	}
+
+	os.Remove(b.contentsPath(o.Generation))
+
+	delete(b.objects, req.Name)
+	i := sort.SearchStrings(b.names, req.Name)
+	b.names = append(b.names[:i], b.names[i+1:]...)
+
+	return
+}
@@ -0,0 +1,332 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestDirBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type DirBucketTest struct {
+	ctx    context.Context
+	dir    string
+	bucket gcs.Bucket
+}
+
+var _ SetUpInterface = &DirBucketTest{}
+var _ TearDownInterface = &DirBucketTest{}
+
+func init() { RegisterTestSuite(&DirBucketTest{}) }
+
+func (t *DirBucketTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.dir, err = ioutil.TempDir("", "dir_bucket_test")
+	AssertEq(nil, err)
+
+	t.reopen()
+}
+
+func (t *DirBucketTest) TearDown() {
+	os.RemoveAll(t.dir)
+}
+
+func (t *DirBucketTest) reopen() {
+	var err error
+	t.bucket, err = gcsx.OpenDirBucket("some_bucket", t.dir, timeutil.RealClock())
+	AssertEq(nil, err)
+}
+
+func (t *DirBucketTest) create(name string, contents string) (o *gcs.Object) {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, name, []byte(contents))
+	AssertEq(nil, err)
+	return
+}
+
+func (t *DirBucketTest) read(name string) (contents string, err error) {
+	b, err := gcsutil.ReadObject(t.ctx, t.bucket, name)
+	contents = string(b)
+	return
+}
+
+func (t *DirBucketTest) files(sub string) (names []string) {
+	entries, err := ioutil.ReadDir(path.Join(t.dir, sub))
+	AssertEq(nil, err)
+
+	for _, fi := range entries {
+		names = append(names, fi.Name())
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DirBucketTest) CreateAndRead() {
+	o := t.create("foo/bar", "taco")
+	ExpectEq("foo/bar", o.Name)
+	ExpectEq(4, o.Size)
+	ExpectNe(0, o.Generation)
+	ExpectEq(1, o.MetaGeneration)
+
+	contents, err := t.read("foo/bar")
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+
+	stat, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "foo/bar"})
+
+	AssertEq(nil, err)
+	ExpectEq(o.Generation, stat.Generation)
+	ExpectEq(o.CRC32C, stat.CRC32C)
+
+	_, err = t.read("foo")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *DirBucketTest) ReadRange() {
+	o := t.create("foo", "tacoburrito")
+
+	for _, r := range []struct {
+		start, limit uint64
+		want         string
+	}{
+		{4, 8, "burr"},
+		{8, 100, "ito"},
+		{100, 200, ""},
+	} {
+		rc, err := t.bucket.NewReader(
+			t.ctx,
+			&gcs.ReadObjectRequest{
+				Name:       "foo",
+				Generation: o.Generation,
+				Range:      &gcs.ByteRange{Start: r.start, Limit: r.limit},
+			})
+
+		AssertEq(nil, err)
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+
+		AssertEq(nil, err)
+		ExpectEq(r.want, string(b))
+	}
+
+	_, err := t.bucket.NewReader(
+		t.ctx,
+		&gcs.ReadObjectRequest{Name: "foo", Generation: o.Generation + 1})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *DirBucketTest) Preconditions() {
+	o := t.create("foo", "taco")
+
+	var zero int64
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:                   "foo",
+			Contents:               strings.NewReader("burrito"),
+			GenerationPrecondition: &zero,
+		})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+
+	replaced, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:                   "foo",
+			Contents:               strings.NewReader("burrito"),
+			GenerationPrecondition: &o.Generation,
+		})
+
+	AssertEq(nil, err)
+	ExpectGt(replaced.Generation, o.Generation)
+
+	contents, err := t.read("foo")
+	AssertEq(nil, err)
+	ExpectEq("burrito", contents)
+
+	// The old contents are gone.
+	ExpectThat(t.files("contents"), ElementsAre(Any()))
+}
+
+func (t *DirBucketTest) List() {
+	t.create("a/b/c", "")
+	t.create("a/d", "")
+	t.create("e", "")
+
+	listing, err := t.bucket.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{Prefix: "a/", Delimiter: "/"})
+
+	AssertEq(nil, err)
+	AssertEq(1, len(listing.Objects))
+	ExpectEq("a/d", listing.Objects[0].Name)
+	ExpectThat(listing.CollapsedRuns, ElementsAre("a/b/"))
+}
+
+func (t *DirBucketTest) Update() {
+	o := t.create("foo", "taco")
+
+	contentType := "text/plain"
+	value := "bar"
+	updated, err := t.bucket.UpdateObject(
+		t.ctx,
+		&gcs.UpdateObjectRequest{
+			Name:                       "foo",
+			Generation:                 o.Generation,
+			MetaGenerationPrecondition: &o.MetaGeneration,
+			ContentType:                &contentType,
+			Metadata:                   map[string]*string{"foo": &value},
+		})
+
+	AssertEq(nil, err)
+	ExpectEq(o.Generation, updated.Generation)
+	ExpectEq(2, updated.MetaGeneration)
+	ExpectEq("text/plain", updated.ContentType)
+	ExpectEq("bar", updated.Metadata["foo"])
+
+	_, err = t.bucket.UpdateObject(
+		t.ctx,
+		&gcs.UpdateObjectRequest{
+			Name:                       "foo",
+			MetaGenerationPrecondition: &o.MetaGeneration,
+			ContentType:                &contentType,
+		})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+}
+
+func (t *DirBucketTest) CopyAndCompose() {
+	foo := t.create("foo", "taco")
+	bar := t.create("bar", "burrito")
+
+	_, err := t.bucket.CopyObject(
+		t.ctx,
+		&gcs.CopyObjectRequest{
+			SrcName:       "foo",
+			SrcGeneration: foo.Generation,
+			DstName:       "baz",
+		})
+
+	AssertEq(nil, err)
+
+	o, err := t.bucket.ComposeObjects(
+		t.ctx,
+		&gcs.ComposeObjectsRequest{
+			DstName: "baz",
+			Sources: []gcs.ComposeSource{
+				{Name: "baz"},
+				{Name: "bar", Generation: bar.Generation},
+			},
+		})
+
+	AssertEq(nil, err)
+	ExpectEq(2, o.ComponentCount)
+
+	contents, err := t.read("baz")
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", contents)
+}
+
+func (t *DirBucketTest) Delete() {
+	o := t.create("foo", "taco")
+
+	wrong := o.MetaGeneration + 1
+	err := t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{
+			Name:                       "foo",
+			MetaGenerationPrecondition: &wrong,
+		})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	_, err = t.read("foo")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+	ExpectThat(t.files("attributes"), ElementsAre())
+	ExpectThat(t.files("contents"), ElementsAre())
+
+	// Deleting what isn't there is fine.
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	ExpectEq(nil, err)
+}
+
+func (t *DirBucketTest) Persists() {
+	o := t.create("foo", "taco")
+	t.create("bar", "burrito")
+
+	t.reopen()
+
+	stat, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq(o.Generation, stat.Generation)
+	ExpectEq(o.CRC32C, stat.CRC32C)
+
+	contents, err := t.read("bar")
+	AssertEq(nil, err)
+	ExpectEq("burrito", contents)
+
+	// Later generations are still newer.
+	replaced := t.create("foo", "enchilada")
+	ExpectGt(replaced.Generation, o.Generation)
+}
+
+func (t *DirBucketTest) LeftoversRemoved() {
+	t.create("foo", "taco")
+
+	for _, sub := range []string{"attributes", "contents"} {
+		err := ioutil.WriteFile(path.Join(t.dir, sub, "tmp123"), []byte("{}"), 0600)
+		AssertEq(nil, err)
+	}
+
+	err := ioutil.WriteFile(path.Join(t.dir, "contents", "17"), nil, 0600)
+	AssertEq(nil, err)
+
+	t.reopen()
+
+	ExpectEq(1, len(t.files("attributes")))
+	ExpectEq(1, len(t.files("contents")))
+
+	contents, err := t.read("foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+}
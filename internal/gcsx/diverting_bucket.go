@@ -0,0 +1,373 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	"golang.org/x/net/context"
+)
+
+// DeniedError is returned by a bucket from NewDivertingBucket for a request
+// to create an object whose name it has nowhere to divert.
+type DeniedError struct {
+	Name string
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("Creating %q is not permitted", e.Name)
+}
+
+// NewDivertingBucket wraps a bucket such that objects whose names match any
+// of the supplied patterns, with the syntax of NewFilterBucket, are kept in
+// the local bucket instead, e.g. to keep editors' temporary files out of GCS.
+// Those in the wrapped bucket can't be seen. If local is nil, such objects
+// can't be created, failing with *DeniedError.
+//
+// Copying and composing across the two buckets reads the sources and creates
+// the destination. Listings of names beneath a prefix under which the local
+// bucket holds objects are returned in one piece.
+func NewDivertingBucket(
+	wrapped gcs.Bucket,
+	local gcs.Bucket,
+	patterns []string) (b gcs.Bucket, err error) {
+	db := &divertingBucket{
+		Bucket: wrapped,
+		local:  local,
+	}
+
+	db.patterns, err = parseNamePatterns(patterns)
+	if err != nil {
+		return
+	}
+
+	b = db
+	return
+}
+
+type divertingBucket struct {
+	gcs.Bucket
+
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	local gcs.Bucket
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	patterns []namePattern
+}
+
+func (b *divertingBucket) diverted(name string) bool {
+	segments := splitName(name)
+	for _, p := range b.patterns {
+		if p.matches(segments) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return the bucket that holds objects with the given name, or nil if there
+// is none.
+func (b *divertingBucket) route(name string) gcs.Bucket {
+	if b.diverted(name) {
+		return b.local
+	}
+
+	return b.Bucket
+}
+
+// Leave out the diverted names from a listing of the wrapped bucket.
+func (b *divertingBucket) hideDiverted(listing *gcs.Listing) *gcs.Listing {
+	filtered := &gcs.Listing{ContinuationToken: listing.ContinuationToken}
+	for _, o := range listing.Objects {
+		if !b.diverted(o.Name) {
+			filtered.Objects = append(filtered.Objects, o)
+		}
+	}
+
+	for _, run := range listing.CollapsedRuns {
+		if !b.diverted(run) {
+			filtered.CollapsedRuns = append(filtered.CollapsedRuns, run)
+		}
+	}
+
+	return filtered
+}
+
+func (b *divertingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	bucket := b.route(req.Name)
+	if bucket == nil {
+		err = notFound(req.Name)
+		return
+	}
+
+	rc, err = bucket.NewReader(ctx, req)
+	return
+}
+
+func (b *divertingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	bucket := b.route(req.Name)
+	if bucket == nil {
+		err = &DeniedError{Name: req.Name}
+		return
+	}
+
+	o, err = bucket.CreateObject(ctx, req)
+	return
+}
+
+func (b *divertingBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	src := b.route(req.SrcName)
+	dst := b.route(req.DstName)
+
+	switch {
+	case src == nil:
+		err = notFound(req.SrcName)
+		return
+
+	case dst == nil:
+		err = &DeniedError{Name: req.DstName}
+		return
+
+	case src == dst:
+		o, err = dst.CopyObject(ctx, req)
+		return
+	}
+
+	srcObject, err := src.StatObject(
+		ctx,
+		&gcs.StatObjectRequest{Name: req.SrcName})
+
+	if err != nil {
+		return
+	}
+
+	if req.SrcGeneration != 0 && req.SrcGeneration != srcObject.Generation {
+		err = notFound(req.SrcName)
+		return
+	}
+
+	if req.SrcMetaGenerationPrecondition != nil &&
+		*req.SrcMetaGenerationPrecondition != srcObject.MetaGeneration {
+		err = preconditionFailed(req.SrcName)
+		return
+	}
+
+	rc, err := src.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:       req.SrcName,
+			Generation: srcObject.Generation,
+		})
+
+	if err != nil {
+		return
+	}
+
+	defer rc.Close()
+
+	o, err = dst.CreateObject(
+		ctx,
+		&gcs.CreateObjectRequest{
+			Name:                   req.DstName,
+			ContentType:            srcObject.ContentType,
+			ContentLanguage:        srcObject.ContentLanguage,
+			ContentEncoding:        srcObject.ContentEncoding,
+			CacheControl:           srcObject.CacheControl,
+			Metadata:               srcObject.Metadata,
+			Contents:               rc,
+			GenerationPrecondition: req.DstGenerationPrecondition,
+		})
+
+	return
+}
+
+func (b *divertingBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	dst := b.route(req.DstName)
+	if dst == nil {
+		err = &DeniedError{Name: req.DstName}
+		return
+	}
+
+	across := false
+	for _, src := range req.Sources {
+		across = across || b.route(src.Name) != dst
+	}
+
+	if !across {
+		o, err = dst.ComposeObjects(ctx, req)
+		return
+	}
+
+	var readers []io.Reader
+	for _, src := range req.Sources {
+		bucket := b.route(src.Name)
+		if bucket == nil {
+			err = notFound(src.Name)
+			return
+		}
+
+		var rc io.ReadCloser
+		rc, err = bucket.NewReader(
+			ctx,
+			&gcs.ReadObjectRequest{
+				Name:       src.Name,
+				Generation: src.Generation,
+			})
+
+		if err != nil {
+			return
+		}
+
+		defer rc.Close()
+		readers = append(readers, rc)
+	}
+
+	o, err = dst.CreateObject(
+		ctx,
+		&gcs.CreateObjectRequest{
+			Name:                       req.DstName,
+			ContentType:                req.ContentType,
+			Metadata:                   req.Metadata,
+			StorageClass:               req.StorageClass,
+			Contents:                   io.MultiReader(readers...),
+			GenerationPrecondition:     req.DstGenerationPrecondition,
+			MetaGenerationPrecondition: req.DstMetaGenerationPrecondition,
+		})
+
+	return
+}
+
+func (b *divertingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	bucket := b.route(req.Name)
+	if bucket == nil {
+		err = notFound(req.Name)
+		return
+	}
+
+	o, err = bucket.StatObject(ctx, req)
+	return
+}
+
+func (b *divertingBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	// Is there anything local to merge? Pages of the wrapped bucket are in
+	// order, so local objects can't be slipped in among them.
+	var localObjects []*gcs.Object
+	var localRuns []string
+	if b.local != nil && req.ContinuationToken == "" && !req.Versions {
+		localObjects, localRuns, err = gcsutil.ListAll(
+			ctx,
+			b.local,
+			&gcs.ListObjectsRequest{
+				Prefix:    req.Prefix,
+				Delimiter: req.Delimiter,
+			})
+
+		if err != nil {
+			err = fmt.Errorf("ListAll: %v", err)
+			return
+		}
+	}
+
+	if len(localObjects) == 0 && len(localRuns) == 0 {
+		listing, err = b.Bucket.ListObjects(ctx, req)
+		if err != nil {
+			return
+		}
+
+		listing = b.hideDiverted(listing)
+		return
+	}
+
+	all := *req
+	all.MaxResults = 0
+
+	objects, runs, err := gcsutil.ListAll(ctx, b.Bucket, &all)
+	if err != nil {
+		err = fmt.Errorf("ListAll: %v", err)
+		return
+	}
+
+	listing = b.hideDiverted(&gcs.Listing{
+		Objects:       objects,
+		CollapsedRuns: runs,
+	})
+
+	listing.Objects = append(listing.Objects, localObjects...)
+	sort.Slice(listing.Objects, func(i, j int) bool {
+		return listing.Objects[i].Name < listing.Objects[j].Name
+	})
+
+	seen := make(map[string]bool)
+	for _, run := range listing.CollapsedRuns {
+		seen[run] = true
+	}
+
+	for _, run := range localRuns {
+		if !seen[run] {
+			listing.CollapsedRuns = append(listing.CollapsedRuns, run)
+		}
+	}
+
+	sort.Strings(listing.CollapsedRuns)
+	return
+}
+
+func (b *divertingBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	bucket := b.route(req.Name)
+	if bucket == nil {
+		err = notFound(req.Name)
+		return
+	}
+
+	o, err = bucket.UpdateObject(ctx, req)
+	return
+}
+
+func (b *divertingBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	bucket := b.route(req.Name)
+	if bucket == nil {
+		return
+	}
+
+	err = bucket.DeleteObject(ctx, req)
+	return
+}
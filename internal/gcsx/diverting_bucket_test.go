@@ -0,0 +1,233 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestDivertingBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type DivertingBucketTest struct {
+	ctx     context.Context
+	wrapped gcs.Bucket
+	local   gcs.Bucket
+	bucket  gcs.Bucket
+}
+
+var _ SetUpInterface = &DivertingBucketTest{}
+
+func init() { RegisterTestSuite(&DivertingBucketTest{}) }
+
+func (t *DivertingBucketTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.wrapped = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+	t.local = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+
+	t.bucket, err = gcsx.NewDivertingBucket(
+		t.wrapped,
+		t.local,
+		[]string{"*.swp", "*~"})
+
+	AssertEq(nil, err)
+}
+
+func (t *DivertingBucketTest) create(b gcs.Bucket, name string, contents string) {
+	_, err := gcsutil.CreateObject(t.ctx, b, name, []byte(contents))
+	AssertEq(nil, err)
+}
+
+func (t *DivertingBucketTest) read(b gcs.Bucket, name string) (contents string, err error) {
+	c, err := gcsutil.ReadObject(t.ctx, b, name)
+	contents = string(c)
+	return
+}
+
+// List the names of the objects and runs in the given directory.
+func (t *DivertingBucketTest) list(prefix string) (names []string) {
+	objects, runs, err := gcsutil.ListAll(
+		t.ctx,
+		t.bucket,
+		&gcs.ListObjectsRequest{Prefix: prefix, Delimiter: "/"})
+
+	AssertEq(nil, err)
+	for _, o := range objects {
+		names = append(names, o.Name)
+	}
+
+	names = append(names, runs...)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DivertingBucketTest) InvalidPatterns() {
+	_, err := gcsx.NewDivertingBucket(t.wrapped, nil, []string{"[a-"})
+	ExpectThat(err, Error(HasSubstr("[a-")))
+}
+
+func (t *DivertingBucketTest) MatchingNamesKeptLocally() {
+	t.create(t.bucket, "dir/.foo.swp", "taco")
+	t.create(t.bucket, "foo", "burrito")
+
+	_, err := t.read(t.wrapped, "dir/.foo.swp")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	contents, err := t.read(t.local, "dir/.foo.swp")
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+
+	contents, err = t.read(t.bucket, "dir/.foo.swp")
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+
+	contents, err = t.read(t.wrapped, "foo")
+	AssertEq(nil, err)
+	ExpectEq("burrito", contents)
+}
+
+func (t *DivertingBucketTest) MatchingNamesInWrappedBucketHidden() {
+	t.create(t.wrapped, "foo~", "taco")
+
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo~"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+	ExpectThat(t.list(""), ElementsAre())
+}
+
+func (t *DivertingBucketTest) CreationDenied() {
+	b, err := gcsx.NewDivertingBucket(t.wrapped, nil, []string{"*.swp"})
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, b, "foo.swp", []byte("taco"))
+	ExpectThat(err, HasSameTypeAs(&gcsx.DeniedError{}))
+	ExpectThat(err, Error(HasSubstr("foo.swp")))
+
+	_, err = b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo.swp"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	// Deleting what can't exist succeeds.
+	err = b.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo.swp"})
+	ExpectEq(nil, err)
+}
+
+func (t *DivertingBucketTest) CopyAcrossBuckets() {
+	t.create(t.bucket, "foo", "taco")
+
+	// Renaming a file to a backup, as some editors do before saving.
+	_, err := t.bucket.CopyObject(
+		t.ctx,
+		&gcs.CopyObjectRequest{SrcName: "foo", DstName: "foo~"})
+
+	AssertEq(nil, err)
+
+	contents, err := t.read(t.local, "foo~")
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+
+	// And back again.
+	_, err = t.bucket.CopyObject(
+		t.ctx,
+		&gcs.CopyObjectRequest{SrcName: "foo~", DstName: "bar"})
+
+	AssertEq(nil, err)
+
+	contents, err = t.read(t.wrapped, "bar")
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+}
+
+func (t *DivertingBucketTest) CopyOfMissingGeneration() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = t.bucket.CopyObject(
+		t.ctx,
+		&gcs.CopyObjectRequest{
+			SrcName:       "foo",
+			SrcGeneration: o.Generation + 1,
+			DstName:       "foo~",
+		})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *DivertingBucketTest) ComposeAcrossBuckets() {
+	t.create(t.bucket, "foo.swp", "taco")
+	t.create(t.bucket, "tmp", "burrito")
+
+	_, err := t.bucket.ComposeObjects(
+		t.ctx,
+		&gcs.ComposeObjectsRequest{
+			DstName: "foo.swp",
+			Sources: []gcs.ComposeSource{
+				{Name: "foo.swp"},
+				{Name: "tmp"},
+			},
+		})
+
+	AssertEq(nil, err)
+
+	contents, err := t.read(t.local, "foo.swp")
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", contents)
+}
+
+func (t *DivertingBucketTest) ListingsMerged() {
+	t.create(t.wrapped, "dir/a", "")
+	t.create(t.wrapped, "dir/c~", "")
+	t.create(t.wrapped, "dir/d/e", "")
+	t.create(t.bucket, "dir/b.swp", "")
+	t.create(t.bucket, "dir/d/f~", "")
+	t.create(t.bucket, "dir/g.swp/h", "")
+
+	ExpectThat(t.list("dir/"), ElementsAre("dir/a", "dir/b.swp", "dir/d/", "dir/g.swp/"))
+	ExpectThat(t.list("dir/d/"), ElementsAre("dir/d/e", "dir/d/f~"))
+}
+
+func (t *DivertingBucketTest) Deletion() {
+	t.create(t.bucket, "foo~", "taco")
+	t.create(t.wrapped, "foo.swp", "burrito")
+
+	err := t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo~"})
+	AssertEq(nil, err)
+
+	_, err = t.read(t.local, "foo~")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	// Hidden objects in the wrapped bucket are left alone.
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo.swp"})
+	AssertEq(nil, err)
+
+	_, err = t.read(t.wrapped, "foo.swp")
+	ExpectEq(nil, err)
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"io"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// NewEncryptionKeyBucket creates a wrapper bucket that encrypts newly created,
+// composed, or copied objects with the supplied customer-supplied AES-256 key,
+// and supplies the key when reading or copying objects encrypted with it.
+//
+// GCS refuses a key for an object that isn't encrypted with it, so reads and
+// copies stat the object first to find out, which is normally answered by the
+// stat cache.
+func NewEncryptionKeyBucket(b gcs.Bucket, key []byte) gcs.Bucket {
+	return encryptionKeyBucket{
+		Bucket:    b,
+		key:       key,
+		keySHA256: gcs.CustomerKeySHA256(key),
+	}
+}
+
+type encryptionKeyBucket struct {
+	gcs.Bucket
+	key       []byte
+	keySHA256 string
+}
+
+// Return the key to supply for the named object: ours if it is encrypted with
+// it, and otherwise nil.
+func (b encryptionKeyBucket) keyFor(
+	ctx context.Context,
+	name string) (key []byte, err error) {
+	o, err := b.Bucket.StatObject(ctx, &gcs.StatObjectRequest{Name: name})
+	if err != nil {
+		return
+	}
+
+	if o.CustomerKeySHA256 == b.keySHA256 {
+		key = b.key
+	}
+
+	return
+}
+
+func (b encryptionKeyBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	if req.EncryptionKey == nil {
+		req.EncryptionKey, err = b.keyFor(ctx, req.Name)
+		if err != nil {
+			return
+		}
+	}
+
+	rc, err = b.Bucket.NewReader(ctx, req)
+	return
+}
+
+func (b encryptionKeyBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if req.EncryptionKey == nil {
+		req.EncryptionKey = b.key
+	}
+
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+func (b encryptionKeyBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	// GCS requires the sources to be encrypted with the key too.
+	if req.EncryptionKey == nil {
+		req.EncryptionKey = b.key
+	}
+
+	o, err = b.Bucket.ComposeObjects(ctx, req)
+	return
+}
+
+func (b encryptionKeyBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	if req.SrcEncryptionKey == nil {
+		req.SrcEncryptionKey, err = b.keyFor(ctx, req.SrcName)
+		if err != nil {
+			return
+		}
+	}
+
+	if req.DstEncryptionKey == nil {
+		req.DstEncryptionKey = b.key
+	}
+
+	o, err = b.Bucket.CopyObject(ctx, req)
+	return
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestEncryptionKeyBucket(t *testing.T) {
+	ctx := context.Background()
+	key := bytes.Repeat([]byte{0x17}, 32)
+
+	fake := gcsfake.NewFakeBucket(timeutil.RealClock(), "")
+	bucket := gcsx.NewEncryptionKeyBucket(fake, key)
+
+	// Create an unencrypted object directly, and an encrypted one through the
+	// wrapper.
+	_, err := gcsutil.CreateObject(ctx, fake, "plain", []byte("taco"))
+	if err != nil {
+		t.Fatalf("CreateObject: %v", err)
+	}
+
+	o, err := bucket.CreateObject(ctx, &gcs.CreateObjectRequest{
+		Name:     "secret",
+		Contents: strings.NewReader("burrito"),
+	})
+
+	if err != nil {
+		t.Fatalf("CreateObject: %v", err)
+	}
+
+	if got, want := o.CustomerKeySHA256, gcs.CustomerKeySHA256(key); got != want {
+		t.Errorf("o.CustomerKeySHA256 is %q, want %q", got, want)
+	}
+
+	// The encrypted object can't be read without the key, but both can be read
+	// through the wrapper.
+	if _, err = gcsutil.ReadObject(ctx, fake, "secret"); err == nil {
+		t.Errorf("Read secret object without the key")
+	}
+
+	for name, want := range map[string]string{"plain": "taco", "secret": "burrito"} {
+		contents, err := gcsutil.ReadObject(ctx, bucket, name)
+		if err != nil {
+			t.Fatalf("ReadObject(%q): %v", name, err)
+		}
+
+		if got := string(contents); got != want {
+			t.Errorf("Contents of %q are %q, want %q", name, got, want)
+		}
+	}
+
+	// Copies of either and composites are encrypted.
+	for _, name := range []string{"plain", "secret"} {
+		o, err = bucket.CopyObject(ctx, &gcs.CopyObjectRequest{
+			SrcName: name,
+			DstName: name + "_copy",
+		})
+
+		if err != nil {
+			t.Fatalf("CopyObject(%q): %v", name, err)
+		}
+
+		if o.CustomerKeySHA256 == "" {
+			t.Errorf("Copy of %q is not encrypted", name)
+		}
+	}
+
+	o, err = bucket.ComposeObjects(ctx, &gcs.ComposeObjectsRequest{
+		DstName: "composite",
+		Sources: []gcs.ComposeSource{{Name: "secret"}, {Name: "plain_copy"}},
+	})
+
+	if err != nil {
+		t.Fatalf("ComposeObjects: %v", err)
+	}
+
+	if o.CustomerKeySHA256 == "" {
+		t.Errorf("Composite is not encrypted")
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/jacobsa/gcloud/httputil"
+)
+
+// The host to which package gcs sends all requests.
+const defaultGCSHost = "www.googleapis.com"
+
+// ParseEndpoint parses a GCS endpoint such as "https://restricted.googleapis.com"
+// or "localhost:4443". If no scheme is given, defaultScheme is used.
+func ParseEndpoint(s string, defaultScheme string) (u *url.URL, err error) {
+	if !strings.Contains(s, "://") {
+		s = defaultScheme + "://" + s
+	}
+
+	u, err = url.Parse(s)
+	if err != nil {
+		err = fmt.Errorf("url.Parse: %v", err)
+		return
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		err = fmt.Errorf("Unsupported scheme %q in endpoint %q", u.Scheme, s)
+		return
+	}
+
+	if u.Host == "" {
+		err = fmt.Errorf("No host in endpoint %q", s)
+		return
+	}
+
+	if u.RawQuery != "" || u.Fragment != "" {
+		err = fmt.Errorf("Endpoint %q may not have a query or fragment", s)
+		return
+	}
+
+	return
+}
+
+// NewEndpointTransport wraps a transport such that requests for the GCS JSON
+// API are sent to the supplied endpoint instead, e.g. a GCS emulator or an
+// endpoint reachable from a VPC Service Controls perimeter. Any path in the
+// endpoint is prepended to request paths.
+func NewEndpointTransport(
+	endpoint *url.URL,
+	wrapped httputil.CancellableRoundTripper) (
+	t httputil.CancellableRoundTripper) {
+	t = &endpointTransport{
+		scheme:     endpoint.Scheme,
+		host:       endpoint.Host,
+		pathPrefix: strings.TrimSuffix(endpoint.Path, "/"),
+		wrapped:    wrapped,
+		modified:   make(map[*http.Request]*http.Request),
+	}
+
+	return
+}
+
+type endpointTransport struct {
+	scheme     string
+	host       string
+	pathPrefix string
+	wrapped    httputil.CancellableRoundTripper
+
+	mu sync.Mutex
+
+	// The rewritten request for each request in flight, so that we can cancel
+	// the right one.
+	//
+	// GUARDED_BY(mu)
+	modified map[*http.Request]*http.Request
+}
+
+func (t *endpointTransport) RoundTrip(
+	req *http.Request) (resp *http.Response, err error) {
+	if req.URL.Host != defaultGCSHost {
+		resp, err = t.wrapped.RoundTrip(req)
+		return
+	}
+
+	// Rewrite the URL. Package gcs puts the path in the Opaque field so that
+	// escaping is preserved, in the form "//host/path".
+	u := *req.URL
+	u.Scheme = t.scheme
+	u.Host = t.host
+
+	if strings.HasPrefix(u.Opaque, "//"+defaultGCSHost+"/") {
+		u.Opaque = "//" + t.host + t.pathPrefix +
+			strings.TrimPrefix(u.Opaque, "//"+defaultGCSHost)
+	} else if u.Opaque == "" {
+		u.Path = t.pathPrefix + u.Path
+		if u.RawPath != "" {
+			u.RawPath = t.pathPrefix + u.RawPath
+		}
+	}
+
+	// Don't modify the caller's request, per the RoundTripper contract.
+	modified := new(http.Request)
+	*modified = *req
+	modified.URL = &u
+	modified.Host = t.host
+
+	t.mu.Lock()
+	t.modified[req] = modified
+	t.mu.Unlock()
+
+	resp, err = t.wrapped.RoundTrip(modified)
+	if err != nil {
+		t.forget(req)
+		return
+	}
+
+	resp.Body = &forgettingReadCloser{
+		ReadCloser: resp.Body,
+		forget:     func() { t.forget(req) },
+	}
+
+	return
+}
+
+func (t *endpointTransport) CancelRequest(req *http.Request) {
+	t.mu.Lock()
+	modified := t.modified[req]
+	t.mu.Unlock()
+
+	if modified == nil {
+		modified = req
+	}
+
+	t.wrapped.CancelRequest(modified)
+}
+
+func (t *endpointTransport) forget(req *http.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.modified, req)
+}
+
+// A response body that calls a function when it is closed.
+type forgettingReadCloser struct {
+	io.ReadCloser
+	forget func()
+}
+
+func (rc *forgettingReadCloser) Close() (err error) {
+	err = rc.ReadCloser.Close()
+	rc.forget()
+	return
+}
@@ -0,0 +1,140 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/httputil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestEndpointTransport(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type EndpointTransportTest struct {
+	ctx    context.Context
+	server *httptest.Server
+
+	// The request URI and Host header seen by the server. Package gcs's use of
+	// URL.Opaque causes requests to be sent in absolute form.
+	requestURI string
+	host       string
+}
+
+var _ SetUpInterface = &EndpointTransportTest{}
+var _ TearDownInterface = &EndpointTransportTest{}
+
+func init() { RegisterTestSuite(&EndpointTransportTest{}) }
+
+func (t *EndpointTransportTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			t.requestURI = r.RequestURI
+			t.host = r.Host
+			w.Write([]byte("taco"))
+		}))
+}
+
+func (t *EndpointTransportTest) TearDown() {
+	t.server.Close()
+}
+
+// Send a request of the form made by package gcs through a transport for the
+// given endpoint, returning the response body.
+func (t *EndpointTransportTest) get(endpoint string, opaque string) string {
+	u, err := gcsx.ParseEndpoint(endpoint, "http")
+	AssertEq(nil, err)
+
+	transport := gcsx.NewEndpointTransport(
+		u,
+		http.DefaultTransport.(httputil.CancellableRoundTripper))
+
+	req, err := httputil.NewRequest(
+		t.ctx,
+		"GET",
+		&url.URL{
+			Scheme: "https",
+			Host:   "www.googleapis.com",
+			Opaque: opaque,
+		},
+		nil,
+		0,
+		"some-user-agent")
+
+	AssertEq(nil, err)
+
+	resp, err := transport.RoundTrip(req)
+	AssertEq(nil, err)
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	AssertEq(nil, err)
+
+	// The caller's request should be untouched.
+	ExpectEq("www.googleapis.com", req.URL.Host)
+	ExpectEq("www.googleapis.com", req.Host)
+
+	return string(b)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *EndpointTransportTest) RewritesHost() {
+	body := t.get(t.server.URL, "//www.googleapis.com/storage/v1/b/foo/o/a%2Fb")
+
+	ExpectEq("taco", body)
+	ExpectEq(t.server.URL+"/storage/v1/b/foo/o/a%2Fb", t.requestURI)
+	ExpectEq(strings.TrimPrefix(t.server.URL, "http://"), t.host)
+}
+
+func (t *EndpointTransportTest) PathPrefix() {
+	t.get(t.server.URL+"/emulator/", "//www.googleapis.com/storage/v1/b/foo/o")
+	ExpectEq(t.server.URL+"/emulator/storage/v1/b/foo/o", t.requestURI)
+}
+
+func (t *EndpointTransportTest) DefaultScheme() {
+	hostPort := strings.TrimPrefix(t.server.URL, "http://")
+	body := t.get(hostPort, "//www.googleapis.com/storage/v1/b/foo/o")
+	ExpectEq("taco", body)
+}
+
+func (t *EndpointTransportTest) BadEndpoints() {
+	var err error
+
+	_, err = gcsx.ParseEndpoint("ftp://foo", "https")
+	ExpectThat(err, Error(HasSubstr("scheme")))
+
+	_, err = gcsx.ParseEndpoint("https://", "https")
+	ExpectThat(err, Error(HasSubstr("No host")))
+
+	_, err = gcsx.ParseEndpoint("https://foo?bar=baz", "https")
+	ExpectThat(err, Error(HasSubstr("query")))
+}
@@ -0,0 +1,87 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcscaching"
+)
+
+// ErasableStatCache wraps a gcscaching.StatCache with a lock of its own, so
+// that entries may be erased by others than the bucket using it, e.g. when
+// told that an object has changed.
+//
+// Safe for concurrent access.
+type ErasableStatCache struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	wrapped gcscaching.StatCache
+}
+
+var _ gcscaching.StatCache = &ErasableStatCache{}
+
+// NewErasableStatCache wraps the supplied cache, which must not be used
+// directly afterward.
+func NewErasableStatCache(wrapped gcscaching.StatCache) (sc *ErasableStatCache) {
+	sc = &ErasableStatCache{
+		wrapped: wrapped,
+	}
+
+	return
+}
+
+func (sc *ErasableStatCache) Insert(o *gcs.Object, expiration time.Time) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.wrapped.Insert(o, expiration)
+}
+
+func (sc *ErasableStatCache) AddNegativeEntry(
+	name string,
+	expiration time.Time) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.wrapped.AddNegativeEntry(name, expiration)
+}
+
+func (sc *ErasableStatCache) Erase(name string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.wrapped.Erase(name)
+}
+
+func (sc *ErasableStatCache) LookUp(
+	name string,
+	now time.Time) (hit bool, o *gcs.Object) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	hit, o = sc.wrapped.LookUp(name, now)
+	return
+}
+
+func (sc *ErasableStatCache) CheckInvariants() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.wrapped.CheckInvariants()
+}
@@ -0,0 +1,242 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+// Reasons given by GCS for refusing a request that mean some quota has been
+// used up, rather than that the caller lacks permission.
+var quotaReasons = map[string]bool{
+	"quotaExceeded":        true,
+	"storageQuotaExceeded": true,
+	"dailyLimitExceeded":   true,
+}
+
+// Errno returns the errno that best describes the supplied error returned by
+// a bucket, or false if there is none more specific than EIO. Errors that are
+// retried, such as HTTP 429 and 503, have no errno; by the time they are
+// returned, retrying has failed.
+func Errno(err error) (errno syscall.Errno, ok bool) {
+	switch typed := err.(type) {
+	case *gcs.NotFoundError:
+		errno, ok = syscall.ENOENT, true
+
+	case *gcs.PreconditionError:
+		errno, ok = syscall.ESTALE, true
+
+	case *DeniedError:
+		errno, ok = syscall.EPERM, true
+
+	case *url.Error:
+		errno, ok = Errno(typed.Err)
+
+	case *googleapi.Error:
+		for _, e := range typed.Errors {
+			if quotaReasons[e.Reason] {
+				errno, ok = syscall.EDQUOT, true
+				return
+			}
+		}
+
+		switch typed.Code {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			errno, ok = syscall.EACCES, true
+
+		case http.StatusNotFound:
+			errno, ok = syscall.ENOENT, true
+
+		case http.StatusConflict:
+			errno, ok = syscall.EAGAIN, true
+
+		case http.StatusPreconditionFailed:
+			errno, ok = syscall.ESTALE, true
+		}
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// ErrorRecorder
+////////////////////////////////////////////////////////////////////////
+
+// An ErrorRecorder collects the errors with an errno returned by buckets
+// wrapped with NewErrnoBucket, when called with a context carrying it. This
+// lets the errno be recovered from an error that wraps one of them in text,
+// as with fmt.Errorf("...: %v", err). Safe for concurrent access.
+type ErrorRecorder struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	errs []error
+}
+
+type errorRecorderKey struct{}
+
+// WithErrorRecorder returns a context carrying a new recorder.
+func WithErrorRecorder(
+	ctx context.Context) (newCtx context.Context, r *ErrorRecorder) {
+	r = &ErrorRecorder{}
+	newCtx = context.WithValue(ctx, errorRecorderKey{}, r)
+	return
+}
+
+// WithErrorRecorderFrom returns a copy of dst that carries the recorder from
+// src, if any. This is for work started on behalf of src whose lifetime
+// mustn't be tied to it, as with WithSpanFrom in package tracing.
+func WithErrorRecorderFrom(dst, src context.Context) context.Context {
+	r, _ := src.Value(errorRecorderKey{}).(*ErrorRecorder)
+	if r == nil {
+		return dst
+	}
+
+	return context.WithValue(dst, errorRecorderKey{}, r)
+}
+
+// Errno returns the errno for the most recently recorded error whose text
+// appears in err, or false if there is none.
+func (r *ErrorRecorder) Errno(err error) (errno syscall.Errno, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := err.Error()
+	for i := len(r.errs) - 1; i >= 0; i-- {
+		if strings.Contains(s, r.errs[i].Error()) {
+			errno, ok = Errno(r.errs[i])
+			return
+		}
+	}
+
+	return
+}
+
+// Record err with the recorder carried by ctx, if any, if it has an errno.
+func recordError(ctx context.Context, err error) {
+	if err == nil {
+		return
+	}
+
+	r, _ := ctx.Value(errorRecorderKey{}).(*ErrorRecorder)
+	if r == nil {
+		return
+	}
+
+	if _, ok := Errno(err); !ok {
+		return
+	}
+
+	r.mu.Lock()
+	r.errs = append(r.errs, err)
+	r.mu.Unlock()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket
+////////////////////////////////////////////////////////////////////////
+
+// NewErrnoBucket creates a bucket that records the errors with an errno that
+// the wrapped bucket returns, with the ErrorRecorder carried by the context
+// of the request, if any. The errors themselves are returned unchanged.
+func NewErrnoBucket(wrapped gcs.Bucket) (b gcs.Bucket) {
+	b = &errnoBucket{
+		wrapped: wrapped,
+	}
+
+	return
+}
+
+type errnoBucket struct {
+	wrapped gcs.Bucket
+}
+
+func (b *errnoBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *errnoBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	rc, err = b.wrapped.NewReader(ctx, req)
+	recordError(ctx, err)
+	return
+}
+
+func (b *errnoBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.CreateObject(ctx, req)
+	recordError(ctx, err)
+	return
+}
+
+func (b *errnoBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.CopyObject(ctx, req)
+	recordError(ctx, err)
+	return
+}
+
+func (b *errnoBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	recordError(ctx, err)
+	return
+}
+
+func (b *errnoBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.StatObject(ctx, req)
+	recordError(ctx, err)
+	return
+}
+
+func (b *errnoBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	l, err = b.wrapped.ListObjects(ctx, req)
+	recordError(ctx, err)
+	return
+}
+
+func (b *errnoBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	recordError(ctx, err)
+	return
+}
+
+func (b *errnoBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.wrapped.DeleteObject(ctx, req)
+	recordError(ctx, err)
+	return
+}
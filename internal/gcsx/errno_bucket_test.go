@@ -0,0 +1,105 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestErrnoBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ErrnoBucketTest struct {
+	ctx    context.Context
+	rec    *gcsx.ErrorRecorder
+	bucket gcs.Bucket
+}
+
+var _ SetUpInterface = &ErrnoBucketTest{}
+
+func init() { RegisterTestSuite(&ErrnoBucketTest{}) }
+
+func (t *ErrnoBucketTest) SetUp(ti *TestInfo) {
+	t.ctx, t.rec = gcsx.WithErrorRecorder(ti.Ctx)
+	t.bucket = gcsx.NewErrnoBucket(
+		gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket"))
+}
+
+// Return the errno for the supplied error, or zero if none.
+func errno(err error) syscall.Errno {
+	e, _ := gcsx.Errno(err)
+	return e
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ErrnoBucketTest) Errno() {
+	ExpectEq(syscall.ENOENT, errno(&gcs.NotFoundError{}))
+	ExpectEq(syscall.ESTALE, errno(&gcs.PreconditionError{}))
+	ExpectEq(syscall.EPERM, errno(&gcsx.DeniedError{}))
+	ExpectEq(syscall.EACCES, errno(&googleapi.Error{Code: 403}))
+	ExpectEq(syscall.ESTALE, errno(&googleapi.Error{Code: 412}))
+
+	quota := &googleapi.Error{
+		Code:   403,
+		Errors: []googleapi.ErrorItem{{Reason: "storageQuotaExceeded"}},
+	}
+
+	ExpectEq(syscall.EDQUOT, errno(quota))
+
+	// Errors that have been retried have no errno.
+	ExpectEq(0, errno(&googleapi.Error{Code: 429}))
+	ExpectEq(0, errno(&googleapi.Error{Code: 503}))
+	ExpectEq(0, errno(errors.New("taco")))
+}
+
+func (t *ErrnoBucketTest) RecordsErrors() {
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertNe(nil, err)
+
+	// The errno is found for an error wrapping the bucket's in text.
+	e, ok := t.rec.Errno(fmt.Errorf("lookUp: StatObject: %v", err))
+	ExpectTrue(ok)
+	ExpectEq(syscall.ENOENT, e)
+
+	// But not for some other error.
+	_, ok = t.rec.Errno(errors.New("taco"))
+	ExpectFalse(ok)
+}
+
+func (t *ErrnoBucketTest) NoRecorder() {
+	_, err := t.bucket.StatObject(
+		context.Background(),
+		&gcs.StatObjectRequest{Name: "foo"})
+
+	ExpectNe(nil, err)
+}
@@ -0,0 +1,256 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// NewFilterBucket wraps a bucket such that objects whose names don't match
+// any of the only patterns, if there are any, or that do match any of the
+// ignore patterns, can't be seen: lookups and reads fail with
+// *gcs.NotFoundError and listings leave them out, without asking the wrapped
+// bucket if it can be helped. Changes are passed through regardless, as are
+// requests concerning names beginning with exemptPrefix, unless it is empty.
+//
+// Patterns are matched against names a segment at a time, separated by
+// slashes, with the syntax of path.Match, except that a "**" segment matches
+// any number of segments. A pattern without a slash, other than a trailing
+// one, matches any segment of a name; otherwise a pattern is matched from the
+// start of the name, ignoring any leading slash. Either way, a pattern that
+// matches a directory matches everything beneath it. With only patterns, a
+// directory can be seen if it could hold something that matches, whether or
+// not it does.
+func NewFilterBucket(
+	wrapped gcs.Bucket,
+	only []string,
+	ignore []string,
+	exemptPrefix string) (b gcs.Bucket, err error) {
+	fb := &filterBucket{
+		Bucket:       wrapped,
+		exemptPrefix: exemptPrefix,
+	}
+
+	fb.only, err = parseNamePatterns(only)
+	if err != nil {
+		return
+	}
+
+	fb.ignore, err = parseNamePatterns(ignore)
+	if err != nil {
+		return
+	}
+
+	b = fb
+	return
+}
+
+type filterBucket struct {
+	gcs.Bucket
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	only         []namePattern
+	ignore       []namePattern
+	exemptPrefix string
+}
+
+// A pattern for NewFilterBucket, split into segments.
+type namePattern struct {
+	segments []string
+
+	// Set if the pattern has a single segment, which may match any segment of a
+	// name.
+	anyDepth bool
+}
+
+func parseNamePatterns(patterns []string) (parsed []namePattern, err error) {
+	for _, s := range patterns {
+		trimmed := strings.TrimSuffix(s, "/")
+		if trimmed == "" {
+			err = errors.New("Empty pattern")
+			return
+		}
+
+		p := namePattern{anyDepth: !strings.Contains(trimmed, "/")}
+		p.segments = strings.Split(strings.TrimPrefix(trimmed, "/"), "/")
+
+		for _, segment := range p.segments {
+			if _, err = path.Match(segment, ""); err != nil {
+				err = fmt.Errorf("Pattern %q: %v", s, err)
+				return
+			}
+		}
+
+		parsed = append(parsed, p)
+	}
+
+	return
+}
+
+// Split a name into segments, ignoring the trailing slash of a directory's.
+func splitName(name string) []string {
+	return strings.Split(strings.TrimSuffix(name, "/"), "/")
+}
+
+// Does the pattern match the name with the given segments or, if prefix is
+// set, some name beginning with them?
+func matchSegments(pattern []string, name []string, prefix bool) bool {
+	switch {
+	case len(name) == 0:
+		if prefix {
+			return true
+		}
+
+		for _, s := range pattern {
+			if s != "**" {
+				return false
+			}
+		}
+
+		return true
+
+	case len(pattern) == 0:
+		return false
+
+	case pattern[0] == "**":
+		return matchSegments(pattern[1:], name, prefix) ||
+			matchSegments(pattern, name[1:], prefix)
+	}
+
+	ok, _ := path.Match(pattern[0], name[0])
+	return ok && matchSegments(pattern[1:], name[1:], prefix)
+}
+
+// Does the pattern match the name with the given segments, or a directory
+// containing it?
+func (p namePattern) matches(name []string) bool {
+	if p.anyDepth {
+		for _, s := range name {
+			if matchSegments(p.segments, []string{s}, false) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for i := 1; i <= len(name); i++ {
+		if matchSegments(p.segments, name[:i], false) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Could the pattern match something in the directory with the given
+// segments?
+func (p namePattern) couldMatchWithin(dir []string) bool {
+	return p.anyDepth || matchSegments(p.segments, dir, true)
+}
+
+// Can the object or directory, whose name ends with a slash, with the given
+// name be seen?
+func (b *filterBucket) visible(name string) bool {
+	if b.exemptPrefix != "" && strings.HasPrefix(name, b.exemptPrefix) {
+		return true
+	}
+
+	isDir := strings.HasSuffix(name, "/")
+	segments := splitName(name)
+
+	for _, p := range b.ignore {
+		if p.matches(segments) {
+			return false
+		}
+	}
+
+	if len(b.only) == 0 {
+		return true
+	}
+
+	for _, p := range b.only {
+		if p.matches(segments) || (isDir && p.couldMatchWithin(segments)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *filterBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	if !b.visible(req.Name) {
+		err = notFound(req.Name)
+		return
+	}
+
+	rc, err = b.Bucket.NewReader(ctx, req)
+	return
+}
+
+func (b *filterBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	if !b.visible(req.Name) {
+		err = notFound(req.Name)
+		return
+	}
+
+	o, err = b.Bucket.StatObject(ctx, req)
+	return
+}
+
+func (b *filterBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	// There's nothing to see in a directory that can't be seen.
+	if strings.HasSuffix(req.Prefix, "/") && !b.visible(req.Prefix) {
+		listing = &gcs.Listing{}
+		return
+	}
+
+	listing, err = b.Bucket.ListObjects(ctx, req)
+	if err != nil {
+		return
+	}
+
+	filtered := &gcs.Listing{ContinuationToken: listing.ContinuationToken}
+	for _, o := range listing.Objects {
+		if b.visible(o.Name) {
+			filtered.Objects = append(filtered.Objects, o)
+		}
+	}
+
+	for _, run := range listing.CollapsedRuns {
+		if b.visible(run) {
+			filtered.CollapsedRuns = append(filtered.CollapsedRuns, run)
+		}
+	}
+
+	listing = filtered
+	return
+}
@@ -0,0 +1,193 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestFilterBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type FilterBucketTest struct {
+	ctx     context.Context
+	wrapped *failingStatBucket
+}
+
+var _ SetUpInterface = &FilterBucketTest{}
+
+func init() { RegisterTestSuite(&FilterBucketTest{}) }
+
+func (t *FilterBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.wrapped = &failingStatBucket{
+		Bucket: gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket"),
+	}
+
+	for _, name := range []string{
+		"a.parquet",
+		"b.csv",
+		"data/",
+		"data/c.parquet",
+		"data/d.csv",
+		"data/logs/e.parquet",
+		"logs/f.txt",
+		"other/g.csv",
+		"tmp/h",
+	} {
+		_, err := gcsutil.CreateObject(t.ctx, t.wrapped, name, []byte(""))
+		AssertEq(nil, err)
+	}
+}
+
+func (t *FilterBucketTest) bucket(only []string, ignore []string) gcs.Bucket {
+	b, err := gcsx.NewFilterBucket(t.wrapped, only, ignore, "tmp/")
+	AssertEq(nil, err)
+	return b
+}
+
+// List the names of the objects and runs in the given directory.
+func (t *FilterBucketTest) list(b gcs.Bucket, prefix string) (names []string) {
+	objects, runs, err := gcsutil.ListAll(
+		t.ctx,
+		b,
+		&gcs.ListObjectsRequest{Prefix: prefix, Delimiter: "/"})
+
+	AssertEq(nil, err)
+	for _, o := range objects {
+		names = append(names, o.Name)
+	}
+
+	names = append(names, runs...)
+	return
+}
+
+// Is the object with the given name visible through the bucket?
+func (t *FilterBucketTest) visible(b gcs.Bucket, name string) bool {
+	_, err := b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		return false
+	}
+
+	AssertEq(nil, err)
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FilterBucketTest) InvalidPatterns() {
+	_, err := gcsx.NewFilterBucket(t.wrapped, []string{"[a-"}, nil, "")
+	ExpectThat(err, Error(HasSubstr("[a-")))
+
+	_, err = gcsx.NewFilterBucket(t.wrapped, nil, []string{"/"}, "")
+	ExpectThat(err, Error(HasSubstr("Empty")))
+}
+
+func (t *FilterBucketTest) NoPatterns() {
+	b := t.bucket(nil, nil)
+	ExpectThat(
+		t.list(b, ""),
+		ElementsAre("a.parquet", "b.csv", "data/", "logs/", "other/", "tmp/"))
+}
+
+func (t *FilterBucketTest) IgnoreAnchored() {
+	b := t.bucket(nil, []string{"logs/**"})
+
+	ExpectThat(
+		t.list(b, ""),
+		ElementsAre("a.parquet", "b.csv", "data/", "other/", "tmp/"))
+
+	ExpectThat(t.list(b, "logs/"), ElementsAre())
+	ExpectThat(t.list(b, "data/logs/"), ElementsAre("data/logs/e.parquet"))
+	ExpectFalse(t.visible(b, "logs/f.txt"))
+}
+
+func (t *FilterBucketTest) IgnoreAtAnyDepth() {
+	b := t.bucket(nil, []string{"logs", "*.csv"})
+
+	ExpectThat(t.list(b, ""), ElementsAre("a.parquet", "data/", "other/", "tmp/"))
+	ExpectThat(t.list(b, "data/"), ElementsAre("data/", "data/c.parquet"))
+	ExpectFalse(t.visible(b, "data/logs/e.parquet"))
+	ExpectFalse(t.visible(b, "other/g.csv"))
+}
+
+func (t *FilterBucketTest) OnlyAtAnyDepth() {
+	b := t.bucket([]string{"*.parquet"}, nil)
+
+	// Every directory might hold a match.
+	ExpectThat(
+		t.list(b, ""),
+		ElementsAre("a.parquet", "data/", "logs/", "other/", "tmp/"))
+
+	ExpectThat(t.list(b, "data/"), ElementsAre("data/", "data/c.parquet", "data/logs/"))
+	ExpectTrue(t.visible(b, "data/logs/e.parquet"))
+	ExpectFalse(t.visible(b, "b.csv"))
+}
+
+func (t *FilterBucketTest) OnlyAnchored() {
+	b := t.bucket([]string{"data/*.parquet", "/other"}, nil)
+
+	ExpectThat(t.list(b, ""), ElementsAre("data/", "other/", "tmp/"))
+	ExpectThat(t.list(b, "data/"), ElementsAre("data/", "data/c.parquet"))
+	ExpectThat(t.list(b, "other/"), ElementsAre("other/g.csv"))
+	ExpectFalse(t.visible(b, "a.parquet"))
+}
+
+func (t *FilterBucketTest) IgnoreTakesPrecedence() {
+	b := t.bucket([]string{"*.parquet"}, []string{"data/logs"})
+
+	ExpectThat(t.list(b, "data/"), ElementsAre("data/", "data/c.parquet"))
+	ExpectFalse(t.visible(b, "data/logs/e.parquet"))
+}
+
+func (t *FilterBucketTest) ExemptPrefix() {
+	b := t.bucket([]string{"*.parquet"}, []string{"tmp"})
+	ExpectTrue(t.visible(b, "tmp/h"))
+}
+
+func (t *FilterBucketTest) HiddenNamesNotLookedUp() {
+	b := t.bucket(nil, []string{"logs"})
+
+	ExpectFalse(t.visible(b, "logs/f.txt"))
+	ExpectEq(0, t.wrapped.calls)
+
+	_, err := b.NewReader(t.ctx, &gcs.ReadObjectRequest{Name: "logs/f.txt"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *FilterBucketTest) ChangesPassedThrough() {
+	b := t.bucket(nil, []string{"logs"})
+
+	err := b.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "logs/f.txt"})
+	AssertEq(nil, err)
+
+	_, err = t.wrapped.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "logs/f.txt"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
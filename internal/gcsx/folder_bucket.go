@@ -0,0 +1,135 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// NewFolderBucket creates a wrapper around a bucket with hierarchical
+// namespace enabled that presents its folders as the placeholder objects the
+// file system expects for directories, so that creating, statting, deleting,
+// and listing names ending in a slash act on folders instead.
+//
+// Folders are presented as empty objects with no metadata. Their generation is
+// derived from their creation time, so that a folder deleted and recreated
+// under the same name looks like a new generation.
+func NewFolderBucket(b gcs.Bucket, folders Folders) gcs.Bucket {
+	return folderBucket{
+		Bucket:  b,
+		folders: folders,
+	}
+}
+
+type folderBucket struct {
+	gcs.Bucket
+	folders Folders
+}
+
+func isFolderName(name string) bool {
+	return strings.HasSuffix(name, "/")
+}
+
+func folderObject(f *Folder) *gcs.Object {
+	return &gcs.Object{
+		Name:           f.Name,
+		Generation:     f.CreateTime.UnixNano(),
+		MetaGeneration: f.MetaGeneration,
+		Updated:        f.UpdateTime,
+	}
+}
+
+func (b folderBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if !isFolderName(req.Name) {
+		o, err = b.Bucket.CreateObject(ctx, req)
+		return
+	}
+
+	// A folder has no contents, and there is no meaningful precondition to
+	// apply other than that it not already exist, which creation insists on
+	// anyway.
+	contents, err := ioutil.ReadAll(req.Contents)
+	if err != nil {
+		err = fmt.Errorf("ReadAll: %v", err)
+		return
+	}
+
+	if len(contents) != 0 {
+		err = fmt.Errorf("Folder %q can't have contents", req.Name)
+		return
+	}
+
+	f, err := b.folders.CreateFolder(ctx, req.Name)
+	if err != nil {
+		return
+	}
+
+	o = folderObject(f)
+	return
+}
+
+func (b folderBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	if !isFolderName(req.Name) {
+		o, err = b.Bucket.StatObject(ctx, req)
+		return
+	}
+
+	f, err := b.folders.GetFolder(ctx, req.Name)
+	if err != nil {
+		return
+	}
+
+	o = folderObject(f)
+	return
+}
+
+func (b folderBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	// Make sure empty folders show up as directories.
+	mReq := new(gcs.ListObjectsRequest)
+	*mReq = *req
+	mReq.IncludeFoldersAsPrefixes = req.Delimiter == "/"
+
+	l, err = b.Bucket.ListObjects(ctx, mReq)
+	return
+}
+
+func (b folderBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	if !isFolderName(req.Name) {
+		err = b.Bucket.DeleteObject(ctx, req)
+		return
+	}
+
+	err = b.folders.DeleteFolder(ctx, req.Name)
+
+	// Deleting something already gone succeeds, as for objects.
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		err = nil
+	}
+
+	return
+}
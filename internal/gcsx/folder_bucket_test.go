@@ -0,0 +1,175 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/jacobsa/gcloud/httputil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestFolderBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that records the last listing request it saw.
+type listRecordingBucket struct {
+	gcs.Bucket
+	lastList *gcs.ListObjectsRequest
+}
+
+func (b *listRecordingBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (*gcs.Listing, error) {
+	b.lastList = req
+	return b.Bucket.ListObjects(ctx, req)
+}
+
+type FolderBucketTest struct {
+	ctx     context.Context
+	fake    fakeFolderServer
+	server  *httptest.Server
+	folders gcsx.Folders
+	wrapped listRecordingBucket
+	bucket  gcs.Bucket
+}
+
+var _ SetUpInterface = &FolderBucketTest{}
+var _ TearDownInterface = &FolderBucketTest{}
+
+func init() { RegisterTestSuite(&FolderBucketTest{}) }
+
+func (t *FolderBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.fake.folders = make(map[string]bool)
+	t.server = httptest.NewServer(&t.fake)
+
+	endpoint, err := gcsx.ParseEndpoint(t.server.URL, "http")
+	AssertEq(nil, err)
+
+	client := &http.Client{
+		Transport: gcsx.NewEndpointTransport(
+			endpoint,
+			http.DefaultTransport.(httputil.CancellableRoundTripper)),
+	}
+
+	t.folders = gcsx.NewFolders(client, "some-bucket")
+	t.wrapped.Bucket = gcsfake.NewFakeBucket(timeutil.RealClock(), "some-bucket")
+	t.bucket = gcsx.NewFolderBucket(&t.wrapped, t.folders)
+}
+
+func (t *FolderBucketTest) TearDown() {
+	t.server.Close()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FolderBucketTest) CreateDirCreatesFolder() {
+	var precond int64
+	o, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:                   "foo/",
+			Contents:               strings.NewReader(""),
+			GenerationPrecondition: &precond,
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("foo/", o.Name)
+	ExpectLt(0, o.Generation)
+
+	_, err = t.folders.GetFolder(t.ctx, "foo/")
+	ExpectEq(nil, err)
+
+	// No placeholder object was created.
+	_, err = t.wrapped.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo/"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *FolderBucketTest) CreateDirWithContents() {
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "foo/",
+			Contents: strings.NewReader("taco"),
+		})
+
+	ExpectThat(err, Error(HasSubstr("contents")))
+}
+
+func (t *FolderBucketTest) StatDirStatsFolder() {
+	_, err := t.folders.CreateFolder(t.ctx, "foo/")
+	AssertEq(nil, err)
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo/"})
+	AssertEq(nil, err)
+	ExpectEq("foo/", o.Name)
+	ExpectEq(1, o.MetaGeneration)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "bar/"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *FolderBucketTest) DeleteDirDeletesFolder() {
+	_, err := t.folders.CreateFolder(t.ctx, "foo/")
+	AssertEq(nil, err)
+
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo/"})
+	AssertEq(nil, err)
+
+	_, err = t.folders.GetFolder(t.ctx, "foo/")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	// Deleting it again is fine.
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo/"})
+	ExpectEq(nil, err)
+}
+
+func (t *FolderBucketTest) FilesPassThrough() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo/bar", []byte("taco"))
+	AssertEq(nil, err)
+
+	o, err := t.wrapped.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo/bar"})
+	AssertEq(nil, err)
+	ExpectEq(4, o.Size)
+
+	ExpectEq(0, len(t.fake.folders))
+}
+
+func (t *FolderBucketTest) ListingIncludesFolders() {
+	_, err := t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{Delimiter: "/"})
+	AssertEq(nil, err)
+	ExpectTrue(t.wrapped.lastList.IncludeFoldersAsPrefixes)
+
+	_, err = t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+	ExpectFalse(t.wrapped.lastList.IncludeFoldersAsPrefixes)
+}
@@ -0,0 +1,386 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/httputil"
+	"google.golang.org/api/googleapi"
+)
+
+// A Folder is a directory in a bucket with hierarchical namespace enabled,
+// which exists in its own right rather than as a placeholder object.
+type Folder struct {
+	// The name of the folder, ending in a slash.
+	Name string
+
+	// Incremented each time the folder's metadata changes.
+	MetaGeneration int64
+
+	CreateTime time.Time
+	UpdateTime time.Time
+}
+
+// Folders is the interface to the folders of a bucket with hierarchical
+// namespace enabled. Methods return *gcs.NotFoundError if a folder doesn't
+// exist, and *gcs.PreconditionError if one already exists or a folder to be
+// deleted isn't empty.
+//
+// Official documentation:
+//     https://cloud.google.com/storage/docs/json_api/v1/folders
+type Folders interface {
+	GetFolder(ctx context.Context, name string) (f *Folder, err error)
+	CreateFolder(ctx context.Context, name string) (f *Folder, err error)
+	DeleteFolder(ctx context.Context, name string) (err error)
+
+	// Rename a folder and everything in it atomically, waiting until the
+	// operation has finished.
+	RenameFolder(ctx context.Context, src string, dst string) (err error)
+}
+
+// How often to check on a long-running rename.
+const folderOpPollInterval = 100 * time.Millisecond
+
+// NewFolders creates a Folders for the named bucket that sends requests with
+// the supplied client, which must add credentials to them. Requests are
+// addressed to the same host as those made by package gcs, so a transport from
+// NewEndpointTransport redirects them too.
+func NewFolders(client *http.Client, bucket string) Folders {
+	return &folders{
+		client: client,
+		bucket: bucket,
+	}
+}
+
+// HierarchicalNamespaceEnabled reports whether the named bucket has
+// hierarchical namespace enabled, using the supplied client as for NewFolders.
+func HierarchicalNamespaceEnabled(
+	ctx context.Context,
+	client *http.Client,
+	bucket string) (enabled bool, err error) {
+	f := &folders{
+		client: client,
+		bucket: bucket,
+	}
+
+	var resp struct {
+		HierarchicalNamespace struct {
+			Enabled bool `json:"enabled"`
+		} `json:"hierarchicalNamespace"`
+	}
+
+	err = f.call(ctx, "GET", "", "fields=hierarchicalNamespace", nil, &resp)
+	if err != nil {
+		return
+	}
+
+	enabled = resp.HierarchicalNamespace.Enabled
+	return
+}
+
+// NewPrefixFolders is to Folders what NewPrefixBucket is to gcs.Bucket.
+func NewPrefixFolders(prefix string, wrapped Folders) Folders {
+	return &prefixFolders{
+		prefix:  prefix,
+		wrapped: wrapped,
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// folders
+////////////////////////////////////////////////////////////////////////
+
+type folders struct {
+	client *http.Client
+	bucket string
+}
+
+func (f *folders) GetFolder(
+	ctx context.Context,
+	name string) (folder *Folder, err error) {
+	var resp folderResource
+	err = f.call(ctx, "GET", "/folders/"+httputil.EncodePathSegment(name), "", nil, &resp)
+	if err != nil {
+		return
+	}
+
+	folder, err = resp.toFolder()
+	return
+}
+
+func (f *folders) CreateFolder(
+	ctx context.Context,
+	name string) (folder *Folder, err error) {
+	var resp folderResource
+	err = f.call(ctx, "POST", "/folders", "", &folderResource{Name: name}, &resp)
+	if err != nil {
+		return
+	}
+
+	folder, err = resp.toFolder()
+	return
+}
+
+func (f *folders) DeleteFolder(
+	ctx context.Context,
+	name string) (err error) {
+	err = f.call(ctx, "DELETE", "/folders/"+httputil.EncodePathSegment(name), "", nil, nil)
+	return
+}
+
+func (f *folders) RenameFolder(
+	ctx context.Context,
+	src string,
+	dst string) (err error) {
+	path := fmt.Sprintf(
+		"/folders/%s/renameTo/folders/%s",
+		httputil.EncodePathSegment(src),
+		httputil.EncodePathSegment(dst))
+
+	var op operationResource
+	err = f.call(ctx, "POST", path, "", nil, &op)
+	if err != nil {
+		return
+	}
+
+	// Wait for the operation to finish. Its name ends with an ID by which to
+	// poll it.
+	id := op.Name[strings.LastIndex(op.Name, "/")+1:]
+	for !op.Done {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+
+		case <-time.After(folderOpPollInterval):
+		}
+
+		err = f.call(ctx, "GET", "/operations/"+httputil.EncodePathSegment(id), "", nil, &op)
+		if err != nil {
+			err = fmt.Errorf("Polling operation: %v", err)
+			return
+		}
+	}
+
+	if op.Error != nil {
+		err = convertFolderError(&googleapi.Error{
+			Code:    op.Error.HTTPCode(),
+			Message: op.Error.Message,
+		})
+
+		return
+	}
+
+	return
+}
+
+// Make a request about the bucket, encoding req as the body if non-nil and
+// decoding the response into resp if non-nil. path is relative to the bucket.
+func (f *folders) call(
+	ctx context.Context,
+	method string,
+	path string,
+	query string,
+	req interface{},
+	resp interface{}) (err error) {
+	u := &url.URL{
+		Scheme: "https",
+		Host:   defaultGCSHost,
+		Opaque: fmt.Sprintf(
+			"//%s/storage/v1/b/%s%s",
+			defaultGCSHost,
+			httputil.EncodePathSegment(f.bucket),
+			path),
+		RawQuery: query,
+	}
+
+	var body io.Reader
+	if req != nil {
+		var b []byte
+		b, err = json.Marshal(req)
+		if err != nil {
+			err = fmt.Errorf("Marshal: %v", err)
+			return
+		}
+
+		body = bytes.NewReader(b)
+	}
+
+	httpReq, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		err = fmt.Errorf("NewRequest: %v", err)
+		return
+	}
+
+	// Make sure the opaque path is sent as is.
+	httpReq.URL = u
+
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+
+	httpResp, err := ctxhttp.Do(ctx, f.client, httpReq)
+	if err != nil {
+		return
+	}
+
+	defer googleapi.CloseBody(httpResp)
+
+	if err = googleapi.CheckResponse(httpResp); err != nil {
+		err = convertFolderError(err)
+		return
+	}
+
+	if resp != nil {
+		err = json.NewDecoder(httpResp.Body).Decode(resp)
+		if err != nil {
+			err = fmt.Errorf("Decode: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
+// Convert the error from a failed request to the types documented for
+// Folders.
+func convertFolderError(err error) error {
+	if typed, ok := err.(*googleapi.Error); ok {
+		switch typed.Code {
+		case http.StatusNotFound:
+			return &gcs.NotFoundError{Err: err}
+
+		case http.StatusConflict, http.StatusPreconditionFailed:
+			return &gcs.PreconditionError{Err: err}
+		}
+	}
+
+	return err
+}
+
+type folderResource struct {
+	Name           string `json:"name"`
+	MetaGeneration int64  `json:"metageneration,string,omitempty"`
+	CreateTime     string `json:"createTime,omitempty"`
+	UpdateTime     string `json:"updateTime,omitempty"`
+}
+
+func (r *folderResource) toFolder() (f *Folder, err error) {
+	f = &Folder{
+		Name:           r.Name,
+		MetaGeneration: r.MetaGeneration,
+	}
+
+	f.CreateTime, err = time.Parse(time.RFC3339, r.CreateTime)
+	if err != nil {
+		err = fmt.Errorf("Parsing createTime: %v", err)
+		return
+	}
+
+	f.UpdateTime, err = time.Parse(time.RFC3339, r.UpdateTime)
+	if err != nil {
+		err = fmt.Errorf("Parsing updateTime: %v", err)
+		return
+	}
+
+	return
+}
+
+type operationResource struct {
+	Name  string          `json:"name"`
+	Done  bool            `json:"done"`
+	Error *operationError `json:"error"`
+}
+
+// A google.rpc.Status.
+type operationError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Translate the canonical error code to the HTTP status with which a request
+// failing in the same way would fail.
+func (e *operationError) HTTPCode() int {
+	switch e.Code {
+	case 5: // NOT_FOUND
+		return http.StatusNotFound
+
+	case 6: // ALREADY_EXISTS
+		return http.StatusConflict
+
+	case 9: // FAILED_PRECONDITION
+		return http.StatusPreconditionFailed
+	}
+
+	return http.StatusInternalServerError
+}
+
+////////////////////////////////////////////////////////////////////////
+// prefixFolders
+////////////////////////////////////////////////////////////////////////
+
+type prefixFolders struct {
+	prefix  string
+	wrapped Folders
+}
+
+func (f *prefixFolders) localize(folder *Folder) {
+	if folder != nil {
+		folder.Name = strings.TrimPrefix(folder.Name, f.prefix)
+	}
+}
+
+func (f *prefixFolders) GetFolder(
+	ctx context.Context,
+	name string) (folder *Folder, err error) {
+	folder, err = f.wrapped.GetFolder(ctx, f.prefix+name)
+	f.localize(folder)
+	return
+}
+
+func (f *prefixFolders) CreateFolder(
+	ctx context.Context,
+	name string) (folder *Folder, err error) {
+	folder, err = f.wrapped.CreateFolder(ctx, f.prefix+name)
+	f.localize(folder)
+	return
+}
+
+func (f *prefixFolders) DeleteFolder(
+	ctx context.Context,
+	name string) (err error) {
+	err = f.wrapped.DeleteFolder(ctx, f.prefix+name)
+	return
+}
+
+func (f *prefixFolders) RenameFolder(
+	ctx context.Context,
+	src string,
+	dst string) (err error) {
+	err = f.wrapped.RenameFolder(ctx, f.prefix+src, f.prefix+dst)
+	return
+}
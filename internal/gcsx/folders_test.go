@@ -0,0 +1,261 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/httputil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestFolders(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const folderTime = "2016-01-02T03:04:05.678Z"
+
+// A fake of the folder operations of the GCS JSON API for a single bucket
+// named "some-bucket". Renames finish on the second poll.
+type fakeFolderServer struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	folders map[string]bool
+	hns     bool
+	polls   int
+}
+
+func (f *fakeFolderServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Split the escaped path into segments after the bucket name.
+	const root = "/storage/v1/b/some-bucket"
+	p := r.URL.EscapedPath()
+	if !strings.HasPrefix(p, root) {
+		http.NotFound(w, r)
+		return
+	}
+
+	var segments []string
+	for _, s := range strings.Split(strings.TrimPrefix(p, root), "/")[1:] {
+		s, _ = url.PathUnescape(s)
+		segments = append(segments, s)
+	}
+
+	folder := func(name string) map[string]string {
+		return map[string]string{
+			"name":           name,
+			"metageneration": "1",
+			"createTime":     folderTime,
+			"updateTime":     folderTime,
+		}
+	}
+
+	var resp interface{}
+	switch {
+	case len(segments) == 0:
+		resp = map[string]interface{}{
+			"hierarchicalNamespace": map[string]bool{"enabled": f.hns},
+		}
+
+	case r.Method == "POST" && len(segments) == 1:
+		var req struct{ Name string }
+		json.NewDecoder(r.Body).Decode(&req)
+		if f.folders[req.Name] {
+			http.Error(w, "exists", http.StatusConflict)
+			return
+		}
+
+		f.folders[req.Name] = true
+		resp = folder(req.Name)
+
+	case r.Method == "GET" && len(segments) == 2 && segments[0] == "folders":
+		if !f.folders[segments[1]] {
+			http.NotFound(w, r)
+			return
+		}
+
+		resp = folder(segments[1])
+
+	case r.Method == "DELETE" && len(segments) == 2:
+		if !f.folders[segments[1]] {
+			http.NotFound(w, r)
+			return
+		}
+
+		delete(f.folders, segments[1])
+
+	case r.Method == "POST" && len(segments) == 5 && segments[2] == "renameTo":
+		src, dst := segments[1], segments[4]
+		op := map[string]interface{}{
+			"name": "projects/_/buckets/some-bucket/operations/17",
+		}
+
+		switch {
+		case !f.folders[src]:
+			op["done"] = true
+			op["error"] = map[string]interface{}{"code": 5, "message": "not found"}
+
+		default:
+			delete(f.folders, src)
+			f.folders[dst] = true
+		}
+
+		resp = op
+
+	case r.Method == "GET" && len(segments) == 2 && segments[0] == "operations":
+		f.polls++
+		resp = map[string]interface{}{
+			"name": "projects/_/buckets/some-bucket/operations/" + segments[1],
+			"done": f.polls >= 2,
+		}
+
+	default:
+		http.Error(w, fmt.Sprintf("unexpected %s %s", r.Method, p), 400)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+type FoldersTest struct {
+	ctx     context.Context
+	fake    fakeFolderServer
+	server  *httptest.Server
+	client  *http.Client
+	folders gcsx.Folders
+}
+
+var _ SetUpInterface = &FoldersTest{}
+var _ TearDownInterface = &FoldersTest{}
+
+func init() { RegisterTestSuite(&FoldersTest{}) }
+
+func (t *FoldersTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.fake.folders = make(map[string]bool)
+	t.server = httptest.NewServer(&t.fake)
+
+	endpoint, err := gcsx.ParseEndpoint(t.server.URL, "http")
+	AssertEq(nil, err)
+
+	t.client = &http.Client{
+		Transport: gcsx.NewEndpointTransport(
+			endpoint,
+			http.DefaultTransport.(httputil.CancellableRoundTripper)),
+	}
+
+	t.folders = gcsx.NewFolders(t.client, "some-bucket")
+}
+
+func (t *FoldersTest) TearDown() {
+	t.server.Close()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FoldersTest) HierarchicalNamespaceEnabled() {
+	enabled, err := gcsx.HierarchicalNamespaceEnabled(t.ctx, t.client, "some-bucket")
+	AssertEq(nil, err)
+	ExpectFalse(enabled)
+
+	t.fake.hns = true
+	enabled, err = gcsx.HierarchicalNamespaceEnabled(t.ctx, t.client, "some-bucket")
+	AssertEq(nil, err)
+	ExpectTrue(enabled)
+}
+
+func (t *FoldersTest) CreateAndGet() {
+	f, err := t.folders.CreateFolder(t.ctx, "foo/bar/")
+	AssertEq(nil, err)
+	ExpectEq("foo/bar/", f.Name)
+	ExpectEq(1, f.MetaGeneration)
+	ExpectEq(2016, f.CreateTime.Year())
+
+	f, err = t.folders.GetFolder(t.ctx, "foo/bar/")
+	AssertEq(nil, err)
+	ExpectEq("foo/bar/", f.Name)
+}
+
+func (t *FoldersTest) CreateExisting() {
+	_, err := t.folders.CreateFolder(t.ctx, "foo/")
+	AssertEq(nil, err)
+
+	_, err = t.folders.CreateFolder(t.ctx, "foo/")
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+}
+
+func (t *FoldersTest) GetMissing() {
+	_, err := t.folders.GetFolder(t.ctx, "foo/")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *FoldersTest) Delete() {
+	_, err := t.folders.CreateFolder(t.ctx, "foo/")
+	AssertEq(nil, err)
+
+	err = t.folders.DeleteFolder(t.ctx, "foo/")
+	AssertEq(nil, err)
+
+	_, err = t.folders.GetFolder(t.ctx, "foo/")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *FoldersTest) RenameWaitsForOperation() {
+	_, err := t.folders.CreateFolder(t.ctx, "foo/")
+	AssertEq(nil, err)
+
+	err = t.folders.RenameFolder(t.ctx, "foo/", "bar/")
+	AssertEq(nil, err)
+	ExpectEq(2, t.fake.polls)
+
+	_, err = t.folders.GetFolder(t.ctx, "bar/")
+	ExpectEq(nil, err)
+}
+
+func (t *FoldersTest) RenameFails() {
+	err := t.folders.RenameFolder(t.ctx, "foo/", "bar/")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *FoldersTest) Prefix() {
+	folders := gcsx.NewPrefixFolders("some/dir/", t.folders)
+
+	f, err := folders.CreateFolder(t.ctx, "foo/")
+	AssertEq(nil, err)
+	ExpectEq("foo/", f.Name)
+
+	_, err = t.folders.GetFolder(t.ctx, "some/dir/foo/")
+	ExpectEq(nil, err)
+}
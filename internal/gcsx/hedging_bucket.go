@@ -0,0 +1,261 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/monitor"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+const (
+	// The number of recent NewReader latencies from which the hedging delay is
+	// computed, and the number needed before any request is hedged.
+	hedgeWindow     = 1000
+	hedgeMinSamples = 20
+
+	// The number of new latencies recorded between recomputations of the
+	// delay, to keep the cost of sorting the window off most requests.
+	hedgeRecomputeInterval = 32
+
+	// The least delay before hedging, so that requests that are all fast don't
+	// have every little bit of jitter doubled.
+	hedgeMinDelay = 10 * time.Millisecond
+)
+
+// Values for the label of the counter passed to NewHedgingBucket.
+const (
+	HedgeSent = "sent"
+	HedgeWon  = "won"
+)
+
+// NewHedgingBucket wraps a bucket such that a NewReader request for a
+// particular generation that hasn't returned within the given percentile of
+// the latencies of recent such requests is duplicated. Whichever of the two
+// returns a reader first is used, and the other is cancelled. This trades a
+// few percent more requests for a shorter tail when GCS occasionally stalls a
+// single request for seconds.
+//
+// Requests for the latest generation are never hedged, since the two could
+// see different objects. If hedges is non-nil, it counts the duplicate
+// requests sent, under HedgeSent, and those that returned first, under
+// HedgeWon.
+//
+// REQUIRES: 0 < percentile < 100
+func NewHedgingBucket(
+	wrapped gcs.Bucket,
+	percentile float64,
+	hedges *monitor.Counter) (b gcs.Bucket) {
+	b = &hedgingBucket{
+		Bucket:     wrapped,
+		percentile: percentile,
+		hedges:     hedges,
+	}
+
+	return
+}
+
+type hedgingBucket struct {
+	gcs.Bucket
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	percentile float64
+	hedges     *monitor.Counter
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// A ring buffer of recent latencies, the index of the next to replace, and
+	// the number recorded since the delay was last computed.
+	//
+	// GUARDED_BY(mu)
+	latencies []time.Duration
+	next      int
+	stale     int
+
+	// The delay after which requests are hedged, or zero if there aren't yet
+	// enough latencies to tell.
+	//
+	// GUARDED_BY(mu)
+	delay time.Duration
+}
+
+// The outcome of one of the requests made for a call to NewReader, the first
+// having index zero and the hedge index one.
+type hedgedResult struct {
+	index int
+	start time.Time
+	rc    io.ReadCloser
+	err   error
+}
+
+func (b *hedgingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	if req.Generation == 0 {
+		rc, err = b.Bucket.NewReader(ctx, req)
+		return
+	}
+
+	b.mu.Lock()
+	delay := b.delay
+	b.mu.Unlock()
+
+	// Send the first request, and arrange to send a second if it is slow.
+	results := make(chan hedgedResult, 2)
+	cancels := []func(){b.send(ctx, req, 0, results)}
+	outstanding := 1
+
+	var timer <-chan time.Time
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		timer = t.C
+	}
+
+	// Wait for a reader. A failure is returned unless another request is in
+	// flight; retrying is left to the layers below.
+	var r hedgedResult
+	for {
+		select {
+		case <-timer:
+			timer = nil
+			cancels = append(cancels, b.send(ctx, req, 1, results))
+			outstanding++
+			if b.hedges != nil {
+				b.hedges.Add(HedgeSent, 1)
+			}
+
+			continue
+
+		case r = <-results:
+			outstanding--
+		}
+
+		if r.err == nil || outstanding == 0 {
+			break
+		}
+	}
+
+	// Cancel the other request, if any, closing the reader it returns if it
+	// beat the cancellation.
+	for i, cancel := range cancels {
+		if r.err != nil || i != r.index {
+			cancel()
+		}
+	}
+
+	if outstanding > 0 {
+		go func() {
+			if other := <-results; other.rc != nil {
+				other.rc.Close()
+			}
+		}()
+	}
+
+	if r.err != nil {
+		err = r.err
+		return
+	}
+
+	b.record(time.Since(r.start))
+	if r.index > 0 && b.hedges != nil {
+		b.hedges.Add(HedgeWon, 1)
+	}
+
+	rc = &hedgedReader{
+		ReadCloser: r.rc,
+		cancel:     cancels[r.index],
+	}
+
+	return
+}
+
+// Start a request in the background with a context of its own, so that it may
+// be cancelled independently with the returned function, delivering its
+// outcome to results.
+func (b *hedgingBucket) send(
+	parent context.Context,
+	req *gcs.ReadObjectRequest,
+	index int,
+	results chan<- hedgedResult) (cancel func()) {
+	ctx, cancel := context.WithCancel(parent)
+	r := hedgedResult{
+		index: index,
+		start: time.Now(),
+	}
+
+	reqCopy := *req
+	go func() {
+		r.rc, r.err = b.Bucket.NewReader(ctx, &reqCopy)
+		results <- r
+	}()
+
+	return
+}
+
+// Record the latency of a successful request, recomputing the delay if enough
+// have been recorded since it was last computed.
+func (b *hedgingBucket) record(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.latencies) < hedgeWindow {
+		b.latencies = append(b.latencies, d)
+	} else {
+		b.latencies[b.next] = d
+		b.next = (b.next + 1) % hedgeWindow
+	}
+
+	b.stale++
+	if len(b.latencies) < hedgeMinSamples ||
+		(b.delay != 0 && b.stale < hedgeRecomputeInterval) {
+		return
+	}
+
+	sorted := append([]time.Duration(nil), b.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	b.delay = sorted[int(float64(len(sorted))*b.percentile/100)]
+	if b.delay < hedgeMinDelay {
+		b.delay = hedgeMinDelay
+	}
+
+	b.stale = 0
+}
+
+// A reader that releases the context of the request that created it when
+// closed.
+type hedgedReader struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (r *hedgedReader) Close() (err error) {
+	err = r.ReadCloser.Close()
+	r.cancel()
+	return
+}
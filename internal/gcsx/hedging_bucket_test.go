@@ -0,0 +1,227 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/monitor"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestHedgingBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose next few NewReader requests hang until cancelled, or fail.
+type stallingBucket struct {
+	gcs.Bucket
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	stalls int
+	err    error
+	calls  int
+
+	// Receives the error returned by each stalled request once cancelled.
+	cancelled chan error
+}
+
+func (b *stallingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	b.mu.Lock()
+	b.calls++
+	stall := b.stalls > 0
+	if stall {
+		b.stalls--
+	}
+
+	err = b.err
+	b.mu.Unlock()
+
+	if stall {
+		<-ctx.Done()
+		err = ctx.Err()
+		b.cancelled <- err
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	rc, err = b.Bucket.NewReader(ctx, req)
+	return
+}
+
+type HedgingBucketTest struct {
+	ctx     context.Context
+	wrapped *stallingBucket
+	bucket  gcs.Bucket
+	o       *gcs.Object
+
+	// Counts before the test began, since the metrics are global.
+	initialHedges map[string]int64
+}
+
+var _ SetUpInterface = &HedgingBucketTest{}
+
+func init() { RegisterTestSuite(&HedgingBucketTest{}) }
+
+func (t *HedgingBucketTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+	t.wrapped = &stallingBucket{
+		Bucket:    gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket"),
+		cancelled: make(chan error, 10),
+	}
+
+	t.bucket = gcsx.NewHedgingBucket(t.wrapped, 95, monitor.GCSHedgedReads)
+	t.initialHedges = monitor.GCSHedgedReads.Snapshot()
+
+	t.o, err = gcsutil.CreateObject(t.ctx, t.wrapped, "foo", []byte("taco"))
+	AssertEq(nil, err)
+}
+
+func (t *HedgingBucketTest) hedges(outcome string) int64 {
+	return monitor.GCSHedgedReads.Value(outcome) - t.initialHedges[outcome]
+}
+
+func (t *HedgingBucketTest) setStalls(n int) {
+	t.wrapped.mu.Lock()
+	defer t.wrapped.mu.Unlock()
+
+	t.wrapped.stalls = n
+}
+
+func (t *HedgingBucketTest) read(
+	ctx context.Context,
+	generation int64) (contents string, err error) {
+	rc, err := t.bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{Name: "foo", Generation: generation})
+
+	if err != nil {
+		return
+	}
+
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	contents = string(b)
+	return
+}
+
+// Make enough fast reads for the bucket to start hedging.
+func (t *HedgingBucketTest) warmUp() {
+	for i := 0; i < 20; i++ {
+		_, err := t.read(t.ctx, t.o.Generation)
+		AssertEq(nil, err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *HedgingBucketTest) SlowReadHedged() {
+	t.warmUp()
+	t.setStalls(1)
+
+	contents, err := t.read(t.ctx, t.o.Generation)
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+
+	// The stalled request should have been cancelled.
+	select {
+	case err = <-t.wrapped.cancelled:
+		ExpectEq(context.Canceled, err)
+
+	case <-time.After(5 * time.Second):
+		AddFailure("Stalled request not cancelled")
+	}
+
+	ExpectEq(1, t.hedges(gcsx.HedgeSent))
+	ExpectEq(1, t.hedges(gcsx.HedgeWon))
+}
+
+func (t *HedgingBucketTest) NotHedgedWithoutHistory() {
+	t.setStalls(1)
+
+	ctx, cancel := context.WithTimeout(t.ctx, 50*time.Millisecond)
+	defer cancel()
+
+	_, err := t.read(ctx, t.o.Generation)
+	ExpectThat(err, Error(HasSubstr("deadline")))
+	ExpectEq(0, t.hedges(gcsx.HedgeSent))
+}
+
+func (t *HedgingBucketTest) LatestGenerationNotHedged() {
+	t.warmUp()
+	t.setStalls(1)
+
+	ctx, cancel := context.WithTimeout(t.ctx, 50*time.Millisecond)
+	defer cancel()
+
+	_, err := t.read(ctx, 0)
+	ExpectThat(err, Error(HasSubstr("deadline")))
+	ExpectEq(0, t.hedges(gcsx.HedgeSent))
+}
+
+func (t *HedgingBucketTest) FailureReturned() {
+	t.warmUp()
+
+	t.wrapped.mu.Lock()
+	t.wrapped.err = errors.New("taco")
+	t.wrapped.calls = 0
+	t.wrapped.mu.Unlock()
+
+	_, err := t.read(t.ctx, t.o.Generation)
+	ExpectThat(err, Error(Equals("taco")))
+
+	t.wrapped.mu.Lock()
+	defer t.wrapped.mu.Unlock()
+	ExpectEq(1, t.wrapped.calls)
+}
+
+func (t *HedgingBucketTest) HedgeFailsToo() {
+	t.warmUp()
+	t.setStalls(2)
+
+	ctx, cancel := context.WithTimeout(t.ctx, 100*time.Millisecond)
+	defer cancel()
+
+	_, err := t.read(ctx, t.o.Generation)
+	ExpectThat(err, Error(HasSubstr("deadline")))
+	ExpectEq(1, t.hedges(gcsx.HedgeSent))
+	ExpectEq(0, t.hedges(gcsx.HedgeWon))
+}
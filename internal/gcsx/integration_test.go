@@ -90,6 +90,9 @@ func (t *IntegrationTest) SetUp(ti *TestInfo) {
 	t.syncer = gcsx.NewSyncer(
 		appendThreshold,
 		tmpObjectPrefix,
+		false, // recordHoles
+		0,     // parallelUploads
+		0,     // parallelUploadThreshold
 		t.bucket)
 }
 
@@ -111,7 +114,7 @@ func (t *IntegrationTest) create(o *gcs.Object) {
 	AssertEq(nil, err)
 
 	// Use it to create the temp file.
-	t.tf, err = gcsx.NewTempFile(rc, "", &t.clock)
+	t.tf, err = gcsx.NewTempFile(rc, nil, &t.clock)
 	AssertEq(nil, err)
 
 	// Close it.
@@ -0,0 +1,71 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// NewKMSKeyBucket creates a wrapper bucket that encrypts newly created,
+// composed, or copied objects with the Cloud KMS key of the given name, of the
+// form "projects/p/locations/l/keyRings/r/cryptoKeys/k", when a request
+// doesn't already name a key.
+func NewKMSKeyBucket(b gcs.Bucket, keyName string) gcs.Bucket {
+	return kmsKeyBucket{
+		Bucket:  b,
+		keyName: keyName,
+	}
+}
+
+type kmsKeyBucket struct {
+	gcs.Bucket
+	keyName string
+}
+
+func (b kmsKeyBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if req.KmsKeyName == "" {
+		req.KmsKeyName = b.keyName
+	}
+
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+func (b kmsKeyBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	if req.KmsKeyName == "" {
+		req.KmsKeyName = b.keyName
+	}
+
+	o, err = b.Bucket.ComposeObjects(ctx, req)
+	return
+}
+
+func (b kmsKeyBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	// A copy is otherwise encrypted as the bucket's default says, whatever the
+	// source's key.
+	if req.DstKmsKeyName == "" {
+		req.DstKmsKeyName = b.keyName
+	}
+
+	o, err = b.Bucket.CopyObject(ctx, req)
+	return
+}
@@ -0,0 +1,91 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+const kmsKeyBucketKey = "projects/p/locations/l/keyRings/r/cryptoKeys/k"
+
+func TestKMSKeyBucket(t *testing.T) {
+	ctx := context.Background()
+	bucket := gcsx.NewKMSKeyBucket(
+		gcsfake.NewFakeBucket(timeutil.RealClock(), ""),
+		kmsKeyBucketKey)
+
+	// Create an object without a key, and one with another.
+	o, err := bucket.CreateObject(ctx, &gcs.CreateObjectRequest{
+		Name:     "foo",
+		Contents: strings.NewReader("taco"),
+	})
+
+	if err != nil {
+		t.Fatalf("CreateObject: %v", err)
+	}
+
+	if got, want := o.KmsKeyName, kmsKeyBucketKey; got != want {
+		t.Errorf("o.KmsKeyName is %q, want %q", got, want)
+	}
+
+	const otherKey = "projects/p/locations/l/keyRings/r/cryptoKeys/other"
+	o, err = bucket.CreateObject(ctx, &gcs.CreateObjectRequest{
+		Name:       "bar",
+		Contents:   strings.NewReader("burrito"),
+		KmsKeyName: otherKey,
+	})
+
+	if err != nil {
+		t.Fatalf("CreateObject: %v", err)
+	}
+
+	if got, want := o.KmsKeyName, otherKey; got != want {
+		t.Errorf("o.KmsKeyName is %q, want %q", got, want)
+	}
+
+	// Compose and copy.
+	o, err = bucket.ComposeObjects(ctx, &gcs.ComposeObjectsRequest{
+		DstName: "baz",
+		Sources: []gcs.ComposeSource{{Name: "bar"}},
+	})
+
+	if err != nil {
+		t.Fatalf("ComposeObjects: %v", err)
+	}
+
+	if got, want := o.KmsKeyName, kmsKeyBucketKey; got != want {
+		t.Errorf("Composed o.KmsKeyName is %q, want %q", got, want)
+	}
+
+	o, err = bucket.CopyObject(ctx, &gcs.CopyObjectRequest{
+		SrcName: "bar",
+		DstName: "qux",
+	})
+
+	if err != nil {
+		t.Fatalf("CopyObject: %v", err)
+	}
+
+	if got, want := o.KmsKeyName, kmsKeyBucketKey; got != want {
+		t.Errorf("Copied o.KmsKeyName is %q, want %q", got, want)
+	}
+}
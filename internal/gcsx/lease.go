@@ -0,0 +1,447 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+// The metadata keys under which a lease object records who holds it, and the
+// time in RFC 3339 format after which it may be taken over if not renewed.
+const (
+	LeaseHolderMetadataKey = "gcsfuse_lease_holder"
+	LeaseExpiryMetadataKey = "gcsfuse_lease_expiry"
+)
+
+// ErrLeaseHeld is returned by Leaser.Acquire when another holder has a lease
+// that hasn't expired.
+var ErrLeaseHeld = errors.New("Lease held elsewhere")
+
+// The longest a Leaser waits between attempts to take a lease held elsewhere.
+const maxLeasePollInterval = time.Second
+
+// A Leaser takes leases on names for as long as it has references to them,
+// so that processes sharing a bucket, on any machine, can hold something
+// exclusively. Each lease is an object named with the leaser's prefix
+// followed by the name, created with a generation precondition and recording
+// its holder and expiry time in metadata. The leaser renews each lease it
+// holds every third of its TTL, and others may take one over once it has
+// expired. Leases therefore exclude one another only as far as the clocks of
+// the machines involved agree, and a holder that can't renew a lease in time
+// may lose it to another without being able to stop using it.
+//
+// Safe for concurrent access.
+type Leaser interface {
+	// Take a reference to the lease on the given name, first taking the lease
+	// itself if there isn't one already. If another holder has the lease,
+	// return ErrLeaseHeld or, if wait is set, poll until it can be taken or
+	// the context is cancelled.
+	Acquire(ctx context.Context, name string, wait bool) (err error)
+
+	// Drop a reference taken by Acquire. Once there are none left, the lease is
+	// given up in the background by deleting its object.
+	Release(name string)
+
+	// Give up all leases, waiting for their objects to be deleted.
+	//
+	// REQUIRES: No call to Acquire is in progress.
+	Stop()
+}
+
+// NewLeaser creates a leaser that holds its leases as objects in the given
+// bucket named with the given prefix, for the given TTL according to the
+// clock. It identifies itself as a holder by the host name and a random ID.
+func NewLeaser(
+	bucket gcs.Bucket,
+	prefix string,
+	ttl time.Duration,
+	clock timeutil.Clock) (l Leaser, err error) {
+	var id [8]byte
+	_, err = io.ReadFull(rand.Reader, id[:])
+	if err != nil {
+		err = fmt.Errorf("ReadFull: %v", err)
+		return
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		err = fmt.Errorf("Hostname: %v", err)
+		return
+	}
+
+	l = &leaser{
+		bucket: bucket,
+		clock:  clock,
+		prefix: prefix,
+		ttl:    ttl,
+		holder: host + "/" + hex.EncodeToString(id[:]),
+		leases: make(map[string]*lease),
+	}
+
+	return
+}
+
+type leaser struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	bucket gcs.Bucket
+	clock  timeutil.Clock
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	prefix string
+	ttl    time.Duration
+	holder string
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The leases held or being taken, by name. A lease whose taking failed is
+	// removed before its ready channel is closed.
+	//
+	// GUARDED_BY(mu)
+	leases map[string]*lease
+
+	// Counts the goroutines renewing leases.
+	renewers sync.WaitGroup
+}
+
+type lease struct {
+	// Set by whoever started taking the lease, and constant: whether it is
+	// willing to wait for another holder to give the lease up.
+	waiting bool
+
+	// Closed once the lease has been taken or taking it has failed, after which
+	// err says which.
+	ready chan struct{}
+	err   error
+
+	// Closed to make the goroutine renewing the lease give it up.
+	stop chan struct{}
+
+	// The number of references to the lease.
+	//
+	// GUARDED_BY(leaser.mu)
+	refs int
+}
+
+func (l *leaser) Acquire(
+	ctx context.Context,
+	name string,
+	wait bool) (err error) {
+	for {
+		l.mu.Lock()
+		ls, joined := l.leases[name]
+		if !joined {
+			ls = &lease{
+				waiting: wait,
+				ready:   make(chan struct{}),
+				stop:    make(chan struct{}),
+			}
+
+			l.leases[name] = ls
+		}
+
+		// Don't wait behind somebody who is waiting for another holder.
+		if joined && ls.waiting && !wait {
+			select {
+			case <-ls.ready:
+			default:
+				l.mu.Unlock()
+				err = ErrLeaseHeld
+				return
+			}
+		}
+
+		ls.refs++
+		l.mu.Unlock()
+
+		if !joined {
+			l.take(ctx, name, ls)
+		}
+
+		select {
+		case <-ls.ready:
+
+		case <-ctx.Done():
+			l.drop(name, ls)
+			err = ctx.Err()
+			return
+		}
+
+		err = ls.err
+		if err == nil {
+			return
+		}
+
+		l.drop(name, ls)
+
+		// If somebody else failed to take the lease without waiting, try again
+		// ourselves.
+		if !(joined && wait && err == ErrLeaseHeld) {
+			return
+		}
+	}
+}
+
+func (l *leaser) Release(name string) {
+	l.mu.Lock()
+	ls := l.leases[name]
+	l.mu.Unlock()
+
+	l.drop(name, ls)
+}
+
+func (l *leaser) Stop() {
+	l.mu.Lock()
+	for name, ls := range l.leases {
+		// Any later references dropped are ignored.
+		delete(l.leases, name)
+		ls.refs = 0
+		if ls.err == nil {
+			close(ls.stop)
+		}
+	}
+
+	l.mu.Unlock()
+
+	l.renewers.Wait()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Drop a reference to the supplied lease on the given name, giving it up if
+// there are none left.
+func (l *leaser) drop(name string, ls *lease) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ls.refs--
+	if ls.refs != 0 {
+		return
+	}
+
+	// Taking the lease has finished, since whoever started it holds a
+	// reference until then.
+	if l.leases[name] == ls {
+		delete(l.leases, name)
+	}
+
+	if ls.err == nil {
+		close(ls.stop)
+	}
+}
+
+// Take the supplied lease, start renewing it if that succeeds, and mark it
+// ready.
+func (l *leaser) take(
+	ctx context.Context,
+	name string,
+	ls *lease) {
+	poll := l.ttl / 4
+	if poll > maxLeasePollInterval {
+		poll = maxLeasePollInterval
+	}
+
+	var o *gcs.Object
+	for {
+		o, ls.err = l.tryTake(ctx, name)
+		if ls.err != ErrLeaseHeld || !ls.waiting {
+			break
+		}
+
+		select {
+		case <-time.After(poll):
+			continue
+
+		case <-ctx.Done():
+			ls.err = ctx.Err()
+		}
+
+		break
+	}
+
+	if ls.err == nil {
+		l.renewers.Add(1)
+		go l.renew(name, o, ls.stop)
+	} else {
+		// Let later callers start afresh.
+		l.mu.Lock()
+		delete(l.leases, name)
+		l.mu.Unlock()
+	}
+
+	close(ls.ready)
+}
+
+// Make one attempt to take the lease on the given name, creating its object
+// or taking over one that has expired or is our own, returning the new
+// object.
+func (l *leaser) tryTake(
+	ctx context.Context,
+	name string) (o *gcs.Object, err error) {
+	objectName := l.prefix + name
+
+	// Start by assuming there is no lease object.
+	var precond int64
+	for {
+		expiry := l.clock.Now().Add(l.ttl).Format(time.RFC3339Nano)
+		o, err = l.bucket.CreateObject(
+			ctx,
+			&gcs.CreateObjectRequest{
+				Name:                   objectName,
+				Contents:               strings.NewReader(""),
+				GenerationPrecondition: &precond,
+				Metadata: map[string]string{
+					LeaseHolderMetadataKey: l.holder,
+					LeaseExpiryMetadataKey: expiry,
+				},
+			})
+
+		if _, ok := err.(*gcs.PreconditionError); !ok {
+			if err != nil {
+				err = fmt.Errorf("CreateObject: %v", err)
+			}
+
+			return
+		}
+
+		// Somebody got there first, or has changed the object since we looked.
+		// If they hold an unexpired lease, we're done.
+		var current *gcs.Object
+		current, err = l.bucket.StatObject(
+			ctx,
+			&gcs.StatObjectRequest{Name: objectName})
+
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			precond = 0
+			continue
+		}
+
+		if err != nil {
+			err = fmt.Errorf("StatObject: %v", err)
+			return
+		}
+
+		if current.Generation == precond || !l.canTakeOver(current) {
+			err = ErrLeaseHeld
+			return
+		}
+
+		precond = current.Generation
+	}
+}
+
+// Can we replace the supplied lease object? We can if it's ours, e.g. one we
+// are giving up in the background, if it has expired, or if it doesn't look
+// like a lease at all.
+func (l *leaser) canTakeOver(o *gcs.Object) bool {
+	if o.Metadata[LeaseHolderMetadataKey] == l.holder {
+		return true
+	}
+
+	expiry, err := time.Parse(time.RFC3339Nano, o.Metadata[LeaseExpiryMetadataKey])
+	if err != nil {
+		return true
+	}
+
+	return l.clock.Now().After(expiry)
+}
+
+// Renew the lease on the given name, currently held as the supplied object,
+// every third of the TTL until told to stop, then delete the object.
+func (l *leaser) renew(
+	name string,
+	o *gcs.Object,
+	stop chan struct{}) {
+	defer l.renewers.Done()
+	ctx := context.Background()
+
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	lost := false
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			if !lost {
+				err := l.bucket.DeleteObject(
+					ctx,
+					&gcs.DeleteObjectRequest{
+						Name:                       o.Name,
+						Generation:                 o.Generation,
+						MetaGenerationPrecondition: &o.MetaGeneration,
+					})
+
+				if _, ok := err.(*gcs.PreconditionError); err != nil && !ok {
+					log.Printf("Giving up lease on %q: %v", name, err)
+				}
+			}
+
+			return
+		}
+
+		if lost {
+			continue
+		}
+
+		expiry := l.clock.Now().Add(l.ttl).Format(time.RFC3339Nano)
+		updated, err := l.bucket.UpdateObject(
+			ctx,
+			&gcs.UpdateObjectRequest{
+				Name:                       o.Name,
+				Generation:                 o.Generation,
+				MetaGenerationPrecondition: &o.MetaGeneration,
+				Metadata: map[string]*string{
+					LeaseExpiryMetadataKey: &expiry,
+				},
+			})
+
+		switch err.(type) {
+		case nil:
+			o = updated
+
+		case *gcs.PreconditionError, *gcs.NotFoundError:
+			log.Printf("Lost lease on %q: %v", name, err)
+			lost = true
+
+		default:
+			log.Printf("Renewing lease on %q: %v", name, err)
+		}
+	}
+}
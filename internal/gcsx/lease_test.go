@@ -0,0 +1,189 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestLease(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const (
+	leasePrefix = ".gcsfuse_leases/"
+	leaseTTL    = 40 * time.Millisecond
+)
+
+type LeaseTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+
+	// Two leasers sharing the bucket, as if on different machines.
+	a gcsx.Leaser
+	b gcsx.Leaser
+}
+
+var _ SetUpInterface = &LeaseTest{}
+var _ TearDownInterface = &LeaseTest{}
+
+func init() { RegisterTestSuite(&LeaseTest{}) }
+
+func (t *LeaseTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2016, 1, 1, 0, 0, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	t.a, err = gcsx.NewLeaser(t.bucket, leasePrefix, leaseTTL, &t.clock)
+	AssertEq(nil, err)
+
+	t.b, err = gcsx.NewLeaser(t.bucket, leasePrefix, leaseTTL, &t.clock)
+	AssertEq(nil, err)
+}
+
+func (t *LeaseTest) TearDown() {
+	t.a.Stop()
+	t.b.Stop()
+}
+
+// Return the lease object for the given name, or nil if there is none.
+func (t *LeaseTest) leaseObject(name string) (o *gcs.Object) {
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: leasePrefix + name})
+
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		return nil
+	}
+
+	AssertEq(nil, err)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *LeaseTest) AcquireCreatesObject() {
+	err := t.a.Acquire(t.ctx, "foo", false)
+	AssertEq(nil, err)
+
+	o := t.leaseObject("foo")
+	AssertNe(nil, o)
+	ExpectNe("", o.Metadata[gcsx.LeaseHolderMetadataKey])
+	ExpectEq(
+		t.clock.Now().Add(leaseTTL).Format(time.RFC3339Nano),
+		o.Metadata[gcsx.LeaseExpiryMetadataKey])
+}
+
+func (t *LeaseTest) HeldElsewhere() {
+	AssertEq(nil, t.a.Acquire(t.ctx, "foo", false))
+
+	err := t.b.Acquire(t.ctx, "foo", false)
+	ExpectEq(gcsx.ErrLeaseHeld, err)
+
+	// Other names are independent.
+	ExpectEq(nil, t.b.Acquire(t.ctx, "bar", false))
+}
+
+func (t *LeaseTest) ReleasedWhenUnreferenced() {
+	AssertEq(nil, t.a.Acquire(t.ctx, "foo", false))
+	AssertEq(nil, t.a.Acquire(t.ctx, "foo", false))
+
+	// One reference remains.
+	t.a.Release("foo")
+	ExpectEq(gcsx.ErrLeaseHeld, t.b.Acquire(t.ctx, "foo", false))
+
+	// Dropping the last gives up the lease in the background.
+	t.a.Release("foo")
+	ExpectEq(nil, t.b.Acquire(t.ctx, "foo", true))
+}
+
+func (t *LeaseTest) StopGivesUpLeases() {
+	AssertEq(nil, t.a.Acquire(t.ctx, "foo", false))
+	t.a.Stop()
+
+	ExpectEq(nil, t.leaseObject("foo"))
+}
+
+func (t *LeaseTest) ExpiredLeaseTakenOver() {
+	AssertEq(nil, t.a.Acquire(t.ctx, "foo", false))
+	gen := t.leaseObject("foo").Generation
+
+	// The simulated clock doesn't move, so renewals don't extend the lease.
+	t.clock.AdvanceTime(leaseTTL + time.Millisecond)
+
+	AssertEq(nil, t.b.Acquire(t.ctx, "foo", false))
+	ExpectNe(gen, t.leaseObject("foo").Generation)
+}
+
+func (t *LeaseTest) WaitForRelease() {
+	AssertEq(nil, t.a.Acquire(t.ctx, "foo", false))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- t.b.Acquire(t.ctx, "foo", true)
+	}()
+
+	select {
+	case err := <-done:
+		AddFailure("Acquire returned early: %v", err)
+		return
+	case <-time.After(3 * leaseTTL):
+	}
+
+	t.a.Release("foo")
+	ExpectEq(nil, <-done)
+}
+
+func (t *LeaseTest) WaitCancelled() {
+	AssertEq(nil, t.a.Acquire(t.ctx, "foo", false))
+
+	ctx, cancel := context.WithTimeout(t.ctx, leaseTTL)
+	defer cancel()
+
+	err := t.b.Acquire(ctx, "foo", true)
+	ExpectTrue(err == context.DeadlineExceeded, "%v", err)
+}
+
+func (t *LeaseTest) RenewalKeepsLease() {
+	// Use a real clock, so that the lease would expire without renewal.
+	a, err := gcsx.NewLeaser(t.bucket, leasePrefix, leaseTTL, timeutil.RealClock())
+	AssertEq(nil, err)
+	defer a.Stop()
+
+	b, err := gcsx.NewLeaser(t.bucket, leasePrefix, leaseTTL, timeutil.RealClock())
+	AssertEq(nil, err)
+	defer b.Stop()
+
+	AssertEq(nil, a.Acquire(t.ctx, "foo", false))
+	time.Sleep(3 * leaseTTL)
+
+	ExpectEq(gcsx.ErrLeaseHeld, b.Acquire(t.ctx, "foo", false))
+}
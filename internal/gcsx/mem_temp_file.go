@@ -0,0 +1,303 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jacobsa/timeutil"
+)
+
+// A TempFile whose contents are kept in memory for as long as they fit within
+// the memory limit of its TempSpace. Once they grow past it they are moved to
+// a temp file on disk, to which all calls are then forwarded.
+type memTempFile struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	clock timeutil.Clock
+	space *TempSpace
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	destroyed bool
+
+	// The file on disk the contents were moved to, or nil if they are still in
+	// memory.
+	disk *tempFile
+
+	// While disk == nil, the contents and the seek position within them.
+	//
+	// INVARIANT: disk == nil => int64(len(contents)) <= space.MemoryLimit()
+	contents []byte
+	pos      int64
+
+	// While disk == nil, as with tempFile.
+	//
+	// INVARIANT: disk == nil => dirtyThreshold <= len(contents)
+	// INVARIANT: disk == nil && mtime == nil => dirtyThreshold == len(contents)
+	dirtyThreshold int64
+	mtime          *time.Time
+}
+
+func newMemTempFile(
+	contents []byte,
+	space *TempSpace,
+	clock timeutil.Clock) (tf *memTempFile) {
+	tf = &memTempFile{
+		clock:          clock,
+		space:          space,
+		contents:       contents,
+		dirtyThreshold: int64(len(contents)),
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Public interface
+////////////////////////////////////////////////////////////////////////
+
+func (tf *memTempFile) CheckInvariants() {
+	if tf.destroyed {
+		panic("Use of destroyed memTempFile object.")
+	}
+
+	if tf.disk != nil {
+		tf.disk.CheckInvariants()
+		return
+	}
+
+	size := int64(len(tf.contents))
+
+	// INVARIANT: disk == nil => int64(len(contents)) <= space.MemoryLimit()
+	if limit := tf.space.MemoryLimit(); size > limit {
+		panic(fmt.Sprintf("%d bytes in memory, limit %d", size, limit))
+	}
+
+	// INVARIANT: disk == nil => dirtyThreshold <= len(contents)
+	if !(tf.dirtyThreshold <= size) {
+		panic(fmt.Sprintf("Mismatch: %d vs. %d", tf.dirtyThreshold, size))
+	}
+
+	// INVARIANT: disk == nil && mtime == nil => dirtyThreshold == len(contents)
+	if tf.mtime == nil && tf.dirtyThreshold != size {
+		panic(fmt.Sprintf("Mismatch: %d vs. %d", tf.dirtyThreshold, size))
+	}
+}
+
+func (tf *memTempFile) Destroy() {
+	tf.destroyed = true
+
+	if tf.disk != nil {
+		tf.disk.Destroy()
+		tf.disk = nil
+	}
+
+	tf.contents = nil
+}
+
+func (tf *memTempFile) Read(p []byte) (n int, err error) {
+	if tf.disk != nil {
+		return tf.disk.Read(p)
+	}
+
+	n, err = tf.ReadAt(p, tf.pos)
+	tf.pos += int64(n)
+
+	// Unlike ReadAt, Read doesn't return io.EOF along with data.
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+
+	return
+}
+
+func (tf *memTempFile) Seek(offset int64, whence int) (pos int64, err error) {
+	if tf.disk != nil {
+		return tf.disk.Seek(offset, whence)
+	}
+
+	switch whence {
+	case 0:
+		pos = offset
+	case 1:
+		pos = tf.pos + offset
+	case 2:
+		pos = int64(len(tf.contents)) + offset
+	default:
+		err = fmt.Errorf("Invalid whence: %d", whence)
+		return
+	}
+
+	if pos < 0 {
+		err = errors.New("Negative position")
+		return
+	}
+
+	tf.pos = pos
+	return
+}
+
+func (tf *memTempFile) ReadAt(p []byte, offset int64) (n int, err error) {
+	if tf.disk != nil {
+		return tf.disk.ReadAt(p, offset)
+	}
+
+	if offset >= int64(len(tf.contents)) {
+		err = io.EOF
+		return
+	}
+
+	n = copy(p, tf.contents[offset:])
+	if n < len(p) {
+		err = io.EOF
+	}
+
+	return
+}
+
+func (tf *memTempFile) Stat() (sr StatResult, err error) {
+	if tf.disk != nil {
+		return tf.disk.Stat()
+	}
+
+	sr.Size = int64(len(tf.contents))
+	sr.DirtyThreshold = tf.dirtyThreshold
+	sr.Mtime = tf.mtime
+
+	return
+}
+
+func (tf *memTempFile) WriteAt(p []byte, offset int64) (n int, err error) {
+	// Move to disk if the contents are going to grow too large.
+	end := offset + int64(len(p))
+	if tf.disk == nil && end > tf.space.MemoryLimit() {
+		err = tf.spill()
+		if err != nil {
+			return
+		}
+	}
+
+	if tf.disk != nil {
+		return tf.disk.WriteAt(p, offset)
+	}
+
+	// Update our state regarding being dirty.
+	tf.dirtyThreshold = minInt64(tf.dirtyThreshold, offset)
+
+	newMtime := tf.clock.Now()
+	tf.mtime = &newMtime
+
+	// Extend with zeroes if necessary, then write.
+	if end > int64(len(tf.contents)) {
+		tf.contents = append(
+			tf.contents,
+			make([]byte, end-int64(len(tf.contents)))...)
+	}
+
+	n = copy(tf.contents[offset:], p)
+	return
+}
+
+func (tf *memTempFile) Truncate(n int64) (err error) {
+	// Move to disk if the contents are going to grow too large.
+	if tf.disk == nil && n > tf.space.MemoryLimit() {
+		err = tf.spill()
+		if err != nil {
+			return
+		}
+	}
+
+	if tf.disk != nil {
+		return tf.disk.Truncate(n)
+	}
+
+	// Update our state regarding being dirty.
+	tf.dirtyThreshold = minInt64(tf.dirtyThreshold, n)
+
+	newMtime := tf.clock.Now()
+	tf.mtime = &newMtime
+
+	// Shrink or extend with zeroes.
+	if n <= int64(len(tf.contents)) {
+		tf.contents = tf.contents[:n]
+	} else {
+		tf.contents = append(
+			tf.contents,
+			make([]byte, n-int64(len(tf.contents)))...)
+	}
+
+	return
+}
+
+func (tf *memTempFile) SeekData(offset int64, hole bool) (int64, error) {
+	if tf.disk != nil {
+		return tf.disk.SeekData(offset, hole)
+	}
+
+	return SeekExtents(
+		addExtent(nil, 0, int64(len(tf.contents))),
+		int64(len(tf.contents)),
+		offset,
+		hole)
+}
+
+func (tf *memTempFile) SetMtime(mtime time.Time) {
+	if tf.disk != nil {
+		tf.disk.SetMtime(mtime)
+		return
+	}
+
+	tf.mtime = &mtime
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Move the contents to a temp file on disk, keeping our other state.
+func (tf *memTempFile) spill() (err error) {
+	disk, err := newDiskTempFile(
+		bytes.NewReader(tf.contents),
+		tf.space,
+		tf.clock)
+
+	if err != nil {
+		return
+	}
+
+	disk.dirtyThreshold = tf.dirtyThreshold
+	disk.mtime = tf.mtime
+
+	_, err = disk.Seek(tf.pos, 0)
+	if err != nil {
+		disk.Destroy()
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	tf.disk = disk
+	tf.contents = nil
+
+	return
+}
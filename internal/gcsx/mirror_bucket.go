@@ -0,0 +1,265 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"hash/fnv"
+	"log"
+	"strings"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/monitor"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// Values for the label of the counter passed to NewMirrorBucket.
+const (
+	MirrorApplied = "applied"
+	MirrorFailed  = "failed"
+	MirrorDropped = "dropped"
+)
+
+// NewMirrorBucket wraps a bucket such that each change successfully made to
+// it is made to the mirror bucket too, in the background, so that the mirror
+// holds a backup. Objects written are read back from the wrapped bucket and
+// written to the mirror with the same names and attributes, and deletions and
+// changes of metadata are repeated. Objects whose names begin with skipPrefix,
+// such as the file system's temporary objects, are left out, unless it is
+// empty.
+//
+// Changes are shared among the given number of workers, with those to any one
+// name going to the same worker, so that they are repeated in order. Each
+// worker queues at most capacity changes, and drops any more, leaving the
+// mirror behind until the name is next changed. Failures are logged to logger
+// but not retried beyond the mirror bucket's own retries, and changes still
+// queued when the process exits are lost. If mirrored is non-nil, it counts
+// the changes under MirrorApplied, MirrorFailed, and MirrorDropped.
+//
+// REQUIRES: workers > 0
+// REQUIRES: capacity > 0
+func NewMirrorBucket(
+	wrapped gcs.Bucket,
+	mirror gcs.Bucket,
+	skipPrefix string,
+	workers int,
+	capacity int,
+	mirrored *monitor.Counter,
+	logger *log.Logger) gcs.Bucket {
+	b := &mirrorBucket{
+		Bucket:     wrapped,
+		mirror:     mirror,
+		mirrored:   mirrored,
+		logger:     logger,
+		skipPrefix: skipPrefix,
+	}
+
+	for i := 0; i < workers; i++ {
+		queue := make(chan mirrorChange, capacity)
+		b.queues = append(b.queues, queue)
+		go b.work(queue)
+	}
+
+	return b
+}
+
+type mirrorBucket struct {
+	gcs.Bucket
+
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	mirror   gcs.Bucket
+	mirrored *monitor.Counter
+	logger   *log.Logger
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	skipPrefix string
+
+	// The queue of each worker.
+	queues []chan mirrorChange
+}
+
+// A change to repeat in the mirror.
+type mirrorChange struct {
+	// The name changed.
+	name string
+
+	// The object written, or nil if the name was deleted.
+	o *gcs.Object
+
+	// If only the object's metadata was changed, the request that changed it.
+	update *gcs.UpdateObjectRequest
+}
+
+func (b *mirrorBucket) count(outcome string) {
+	if b.mirrored != nil {
+		b.mirrored.Add(outcome, 1)
+	}
+}
+
+// Queue the change for the worker responsible for its name, unless the name
+// is to be left out or the queue is full.
+func (b *mirrorBucket) enqueue(c mirrorChange) {
+	if b.skipPrefix != "" && strings.HasPrefix(c.name, b.skipPrefix) {
+		return
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(c.name))
+	queue := b.queues[h.Sum32()%uint32(len(b.queues))]
+
+	select {
+	case queue <- c:
+	default:
+		b.count(MirrorDropped)
+		b.logger.Printf("Mirror queue full; not mirroring change to %q.", c.name)
+	}
+}
+
+func (b *mirrorBucket) work(queue chan mirrorChange) {
+	for c := range queue {
+		err := b.apply(context.Background(), c)
+		if err != nil {
+			b.count(MirrorFailed)
+			b.logger.Printf("Mirroring change to %q: %v", c.name, err)
+			continue
+		}
+
+		b.count(MirrorApplied)
+	}
+}
+
+func (b *mirrorBucket) apply(ctx context.Context, c mirrorChange) (err error) {
+	switch {
+	case c.o == nil:
+		err = b.mirror.DeleteObject(ctx, &gcs.DeleteObjectRequest{Name: c.name})
+
+	case c.update != nil:
+		req := *c.update
+		req.Generation = 0
+		req.MetaGenerationPrecondition = nil
+
+		// The object may not have made it to the mirror yet.
+		_, err = b.mirror.UpdateObject(ctx, &req)
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			err = b.copy(ctx, c.o)
+		}
+
+	default:
+		err = b.copy(ctx, c.o)
+	}
+
+	return
+}
+
+// Copy the supplied object from the wrapped bucket to the mirror.
+func (b *mirrorBucket) copy(ctx context.Context, o *gcs.Object) (err error) {
+	rc, err := b.Bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{Name: o.Name, Generation: o.Generation})
+
+	// If the object has since been replaced or deleted, a later change will
+	// take care of it.
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	defer rc.Close()
+
+	req := &gcs.CreateObjectRequest{
+		Name:            o.Name,
+		ContentType:     o.ContentType,
+		ContentLanguage: o.ContentLanguage,
+		ContentEncoding: o.ContentEncoding,
+		CacheControl:    o.CacheControl,
+		Metadata:        o.Metadata,
+		Contents:        rc,
+	}
+
+	// Encoded objects may be decoded when read, so their checksums needn't
+	// match what is read.
+	if o.ContentEncoding == "" {
+		crc32c := o.CRC32C
+		req.CRC32C = &crc32c
+	}
+
+	_, err = b.mirror.CreateObject(ctx, req)
+	return
+}
+
+func (b *mirrorBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.CreateObject(ctx, req)
+	if err == nil {
+		b.enqueue(mirrorChange{name: o.Name, o: o})
+	}
+
+	return
+}
+
+func (b *mirrorBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.CopyObject(ctx, req)
+	if err == nil {
+		b.enqueue(mirrorChange{name: o.Name, o: o})
+	}
+
+	return
+}
+
+func (b *mirrorBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.ComposeObjects(ctx, req)
+	if err == nil {
+		b.enqueue(mirrorChange{name: o.Name, o: o})
+	}
+
+	return
+}
+
+func (b *mirrorBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.UpdateObject(ctx, req)
+	if err == nil {
+		update := *req
+		b.enqueue(mirrorChange{name: o.Name, o: o, update: &update})
+	}
+
+	return
+}
+
+func (b *mirrorBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.Bucket.DeleteObject(ctx, req)
+	if err == nil {
+		b.enqueue(mirrorChange{name: req.Name})
+	}
+
+	return
+}
@@ -0,0 +1,216 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/monitor"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestMirrorBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose CreateObject requests wait for a value on a channel, and
+// then fail if it's non-nil.
+type gatedCreateBucket struct {
+	gcs.Bucket
+	gate chan error
+}
+
+func (b *gatedCreateBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	err = <-b.gate
+	if err != nil {
+		return
+	}
+
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+type MirrorBucketTest struct {
+	ctx    context.Context
+	mirror *gatedCreateBucket
+	bucket gcs.Bucket
+
+	// Counts before the test began, since the metrics are global.
+	initialChanges map[string]int64
+}
+
+var _ SetUpInterface = &MirrorBucketTest{}
+
+func init() { RegisterTestSuite(&MirrorBucketTest{}) }
+
+func (t *MirrorBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.mirror = &gatedCreateBucket{
+		Bucket: gcsfake.NewFakeBucket(timeutil.RealClock(), "some_mirror"),
+		gate:   make(chan error),
+	}
+
+	// A single worker with room for one change, so that the order in which
+	// changes are handled is predictable.
+	t.bucket = gcsx.NewMirrorBucket(
+		gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket"),
+		t.mirror,
+		"tmp/",
+		1,
+		1,
+		monitor.GCSMirrorChanges,
+		log.New(ioutil.Discard, "", 0))
+
+	t.initialChanges = monitor.GCSMirrorChanges.Snapshot()
+}
+
+func (t *MirrorBucketTest) changes(outcome string) int64 {
+	return monitor.GCSMirrorChanges.Value(outcome) - t.initialChanges[outcome]
+}
+
+// Wait for the given number of changes to have been handled.
+func (t *MirrorBucketTest) waitForChanges(n int64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for t.changes(gcsx.MirrorApplied)+t.changes(gcsx.MirrorFailed) < n {
+		AssertTrue(time.Now().Before(deadline), "Timed out")
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (t *MirrorBucketTest) create(name string, contents string) {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, name, []byte(contents))
+	AssertEq(nil, err)
+}
+
+func (t *MirrorBucketTest) readMirror(name string) (contents string, err error) {
+	b, err := gcsutil.ReadObject(t.ctx, t.mirror, name)
+	contents = string(b)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MirrorBucketTest) WritesMirrored() {
+	t.create("foo", "taco")
+	t.mirror.gate <- nil
+	t.waitForChanges(1)
+
+	contents, err := t.readMirror("foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+	ExpectEq(1, t.changes(gcsx.MirrorApplied))
+}
+
+func (t *MirrorBucketTest) MetadataChangesMirrored() {
+	t.create("foo", "taco")
+	t.mirror.gate <- nil
+	t.waitForChanges(1)
+
+	value := "bar"
+	_, err := t.bucket.UpdateObject(
+		t.ctx,
+		&gcs.UpdateObjectRequest{
+			Name:     "foo",
+			Metadata: map[string]*string{"baz": &value},
+		})
+
+	AssertEq(nil, err)
+	t.waitForChanges(2)
+
+	o, err := t.mirror.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq("bar", o.Metadata["baz"])
+}
+
+func (t *MirrorBucketTest) DeletionsMirrored() {
+	t.create("foo", "taco")
+	t.mirror.gate <- nil
+	t.waitForChanges(1)
+
+	err := t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	t.waitForChanges(2)
+
+	_, err = t.readMirror("foo")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *MirrorBucketTest) TemporaryObjectsSkipped() {
+	t.create("tmp/foo", "taco")
+	t.create("bar", "burrito")
+	t.mirror.gate <- nil
+	t.waitForChanges(1)
+
+	_, err := t.readMirror("tmp/foo")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	contents, err := t.readMirror("bar")
+	AssertEq(nil, err)
+	ExpectEq("burrito", contents)
+}
+
+func (t *MirrorBucketTest) FailuresCounted() {
+	t.create("foo", "taco")
+	t.mirror.gate <- errors.New("taco")
+	t.waitForChanges(1)
+
+	ExpectEq(1, t.changes(gcsx.MirrorFailed))
+	ExpectEq(0, t.changes(gcsx.MirrorApplied))
+}
+
+func (t *MirrorBucketTest) ChangesDroppedWhenQueueFull() {
+	// Once the worker is waiting on the gate with one change and another is
+	// queued, there's no room for more. The writes themselves succeed.
+	t.create("foo", "taco")
+	writes := int64(1)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for t.changes(gcsx.MirrorDropped) == 0 {
+		AssertTrue(time.Now().Before(deadline), "Timed out")
+		t.create("bar", "burrito")
+		writes++
+	}
+
+	applied := writes - t.changes(gcsx.MirrorDropped)
+	ExpectLe(applied, 2)
+
+	for i := int64(0); i < applied; i++ {
+		t.mirror.gate <- nil
+	}
+
+	t.waitForChanges(applied)
+
+	contents, err := t.readMirror("foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+}
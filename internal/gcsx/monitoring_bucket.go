@@ -0,0 +1,155 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"io"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/monitor"
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+// NewMonitoringBucket creates a bucket that counts the requests made to the
+// wrapped bucket by method name. If errors is non-nil, it counts the requests
+// that fail, not including those failing with *gcs.NotFoundError, which is a
+// normal result when looking up names. If latency is non-nil, it records the
+// time taken by each request. If processes is non-nil, it counts the requests
+// by the process on whose behalf they were made, as given by monitor.Process.
+func NewMonitoringBucket(
+	wrapped gcs.Bucket,
+	requests *monitor.Counter,
+	errors *monitor.Counter,
+	latency *monitor.Distribution,
+	processes *monitor.Counter) (b gcs.Bucket) {
+	b = &monitoringBucket{
+		wrapped:   wrapped,
+		requests:  requests,
+		errors:    errors,
+		latency:   latency,
+		processes: processes,
+	}
+
+	return
+}
+
+type monitoringBucket struct {
+	wrapped   gcs.Bucket
+	requests  *monitor.Counter
+	errors    *monitor.Counter
+	latency   *monitor.Distribution
+	processes *monitor.Counter
+}
+
+// Record the outcome of a request that began at the given time.
+func (b *monitoringBucket) record(
+	ctx context.Context,
+	method string,
+	start time.Time,
+	err error) {
+	b.requests.Add(method, 1)
+
+	if b.processes != nil {
+		b.processes.Add(monitor.Process(ctx), 1)
+	}
+
+	if b.latency != nil {
+		b.latency.Record(method, time.Since(start))
+	}
+
+	if b.errors != nil && err != nil {
+		if _, ok := err.(*gcs.NotFoundError); !ok {
+			b.errors.Add(method, 1)
+		}
+	}
+}
+
+func (b *monitoringBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *monitoringBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	start := time.Now()
+	rc, err = b.wrapped.NewReader(ctx, req)
+	b.record(ctx, "NewReader", start, err)
+	return
+}
+
+func (b *monitoringBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	start := time.Now()
+	o, err = b.wrapped.CreateObject(ctx, req)
+	b.record(ctx, "CreateObject", start, err)
+	return
+}
+
+func (b *monitoringBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	start := time.Now()
+	o, err = b.wrapped.CopyObject(ctx, req)
+	b.record(ctx, "CopyObject", start, err)
+	return
+}
+
+func (b *monitoringBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	start := time.Now()
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	b.record(ctx, "ComposeObjects", start, err)
+	return
+}
+
+func (b *monitoringBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	start := time.Now()
+	o, err = b.wrapped.StatObject(ctx, req)
+	b.record(ctx, "StatObject", start, err)
+	return
+}
+
+func (b *monitoringBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	start := time.Now()
+	l, err = b.wrapped.ListObjects(ctx, req)
+	b.record(ctx, "ListObjects", start, err)
+	return
+}
+
+func (b *monitoringBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	start := time.Now()
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	b.record(ctx, "UpdateObject", start, err)
+	return
+}
+
+func (b *monitoringBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	start := time.Now()
+	err = b.wrapped.DeleteObject(ctx, req)
+	b.record(ctx, "DeleteObject", start, err)
+	return
+}
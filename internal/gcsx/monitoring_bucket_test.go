@@ -0,0 +1,131 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/monitor"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestMonitoringBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type MonitoringBucketTest struct {
+	ctx     context.Context
+	wrapped gcs.Bucket
+	bucket  gcs.Bucket
+
+	// Counts before the test began, since the metrics are global.
+	initialRequests map[string]int64
+	initialErrors   map[string]int64
+}
+
+var _ SetUpInterface = &MonitoringBucketTest{}
+
+func init() { RegisterTestSuite(&MonitoringBucketTest{}) }
+
+func (t *MonitoringBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.wrapped = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+	t.bucket = gcsx.NewMonitoringBucket(
+		t.wrapped,
+		monitor.GCSRequests,
+		monitor.GCSRequestErrors,
+		nil,
+		monitor.GCSRequestsByProcess)
+
+	t.initialRequests = monitor.GCSRequests.Snapshot()
+	t.initialErrors = monitor.GCSRequestErrors.Snapshot()
+}
+
+func (t *MonitoringBucketTest) requests(method string) int64 {
+	return monitor.GCSRequests.Value(method) - t.initialRequests[method]
+}
+
+func (t *MonitoringBucketTest) errors(method string) int64 {
+	return monitor.GCSRequestErrors.Value(method) - t.initialErrors[method]
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MonitoringBucketTest) CountsRequests() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	ExpectEq(1, t.requests("CreateObject"))
+	ExpectEq(2, t.requests("StatObject"))
+	ExpectEq(0, t.errors("StatObject"))
+}
+
+func (t *MonitoringBucketTest) NotFoundIsNotAnError() {
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertNe(nil, err)
+
+	ExpectEq(1, t.requests("StatObject"))
+	ExpectEq(0, t.errors("StatObject"))
+}
+
+func (t *MonitoringBucketTest) CountsErrors() {
+	// Fail a precondition.
+	var gen int64 = 17
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:                   "foo",
+			Contents:               strings.NewReader(""),
+			GenerationPrecondition: &gen,
+		})
+
+	AssertNe(nil, err)
+
+	ExpectEq(1, t.requests("CreateObject"))
+	ExpectEq(1, t.errors("CreateObject"))
+}
+
+func (t *MonitoringBucketTest) CountsByProcess() {
+	initial := monitor.GCSRequestsByProcess.Snapshot()
+	ctx := monitor.WithProcess(t.ctx, "MonitoringBucketTest")
+
+	_, err := gcsutil.CreateObject(ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	counts := monitor.GCSRequestsByProcess.Snapshot()
+	ExpectEq(1, counts["MonitoringBucketTest"]-initial["MonitoringBucketTest"])
+	ExpectEq(1, counts[monitor.SelfProcess]-initial[monitor.SelfProcess])
+}
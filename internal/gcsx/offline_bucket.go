@@ -0,0 +1,185 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+var errOffline = errors.New("The bucket is mounted offline")
+
+// NewOfflineBucket creates a read-only bucket with the given name that holds
+// the supplied objects, such as those returned by BlockCache.Objects, without
+// contacting GCS. Each object's contents must be read from the cache: reading
+// them through the bucket fails.
+//
+// A directory placeholder object is made up for each directory in which an
+// object lies, so that the directories can be found without implicit
+// directories being enabled. Listings are returned in one piece, and never
+// include noncurrent generations. Requests that would modify the bucket fail.
+func NewOfflineBucket(name string, objects []*gcs.Object) gcs.Bucket {
+	b := &offlineBucket{
+		name:    name,
+		objects: make(map[string]*gcs.Object),
+	}
+
+	for _, o := range objects {
+		b.objects[o.Name] = o
+
+		// Add placeholders for the directories containing the object.
+		i := strings.LastIndex(o.Name, "/")
+		for ; i >= 0; i = strings.LastIndex(o.Name[:i], "/") {
+			dir := o.Name[:i+1]
+			if _, ok := b.objects[dir]; !ok {
+				b.objects[dir] = &gcs.Object{
+					Name:           dir,
+					Generation:     1,
+					MetaGeneration: 1,
+					Updated:        o.Updated,
+				}
+			}
+		}
+	}
+
+	for name := range b.objects {
+		b.names = append(b.names, name)
+	}
+
+	sort.Strings(b.names)
+	return b
+}
+
+type offlineBucket struct {
+	name string
+
+	// The objects in the bucket by name, including the directory placeholders,
+	// and their names in order.
+	objects map[string]*gcs.Object
+	names   []string
+}
+
+func (b *offlineBucket) Name() string {
+	return b.name
+}
+
+func (b *offlineBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	if b.objects[req.Name] == nil {
+		err = &gcs.NotFoundError{
+			Err: fmt.Errorf("Object %q not found", req.Name),
+		}
+
+		return
+	}
+
+	err = fmt.Errorf("The contents of %q aren't cached: %v", req.Name, errOffline)
+	return
+}
+
+func (b *offlineBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	err = errOffline
+	return
+}
+
+func (b *offlineBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	err = errOffline
+	return
+}
+
+func (b *offlineBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	err = errOffline
+	return
+}
+
+func (b *offlineBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o = b.objects[req.Name]
+	if o == nil {
+		err = &gcs.NotFoundError{
+			Err: fmt.Errorf("Object %q not found", req.Name),
+		}
+	}
+
+	return
+}
+
+func (b *offlineBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	listing = listSorted(b.names, b.objects, req)
+	return
+}
+
+// List in one piece the objects with the given names, in order, that match
+// the request.
+func listSorted(
+	names []string,
+	objects map[string]*gcs.Object,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing) {
+	listing = &gcs.Listing{}
+
+	i := sort.SearchStrings(names, req.Prefix)
+	for ; i < len(names) && strings.HasPrefix(names[i], req.Prefix); i++ {
+		name := names[i]
+
+		// Collapse each run of names sharing a prefix up to the delimiter. The
+		// names in a run are adjacent, since they are sorted.
+		if req.Delimiter != "" {
+			rest := name[len(req.Prefix):]
+			if j := strings.Index(rest, req.Delimiter); j >= 0 {
+				run := name[:len(req.Prefix)+j+len(req.Delimiter)]
+				n := len(listing.CollapsedRuns)
+				if n == 0 || listing.CollapsedRuns[n-1] != run {
+					listing.CollapsedRuns = append(listing.CollapsedRuns, run)
+				}
+
+				continue
+			}
+		}
+
+		listing.Objects = append(listing.Objects, objects[name])
+	}
+
+	return
+}
+
+func (b *offlineBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	err = errOffline
+	return
+}
+
+func (b *offlineBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = errOffline
+	return
+}
@@ -0,0 +1,130 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestOfflineBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type OfflineBucketTest struct {
+	ctx    context.Context
+	bucket gcs.Bucket
+}
+
+var _ SetUpInterface = &OfflineBucketTest{}
+
+func init() { RegisterTestSuite(&OfflineBucketTest{}) }
+
+func (t *OfflineBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.bucket = gcsx.NewOfflineBucket(
+		"some_bucket",
+		[]*gcs.Object{
+			{Name: "a/b/c", Generation: 17, Size: 4},
+			{Name: "a/d", Generation: 19, Size: 5},
+			{Name: "e", Generation: 23, Size: 6},
+		})
+}
+
+func (t *OfflineBucketTest) list(
+	prefix string,
+	delimiter string) (objects []string, runs []string) {
+	listing, err := t.bucket.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{
+			Prefix:    prefix,
+			Delimiter: delimiter,
+		})
+
+	AssertEq(nil, err)
+	AssertEq("", listing.ContinuationToken)
+
+	for _, o := range listing.Objects {
+		objects = append(objects, o.Name)
+	}
+
+	runs = listing.CollapsedRuns
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *OfflineBucketTest) StatObject() {
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "a/d"})
+	AssertEq(nil, err)
+	ExpectEq(19, o.Generation)
+	ExpectEq(5, o.Size)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "f"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *OfflineBucketTest) DirectoryPlaceholders() {
+	for _, name := range []string{"a/", "a/b/"} {
+		o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+		AssertEq(nil, err, "%s", name)
+		ExpectEq(0, o.Size, "%s", name)
+	}
+
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "e/"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *OfflineBucketTest) ListWithDelimiter() {
+	objects, runs := t.list("", "/")
+	ExpectThat(objects, ElementsAre("e"))
+	ExpectThat(runs, ElementsAre("a/"))
+
+	objects, runs = t.list("a/", "/")
+	ExpectThat(objects, ElementsAre("a/", "a/d"))
+	ExpectThat(runs, ElementsAre("a/b/"))
+}
+
+func (t *OfflineBucketTest) ListWithoutDelimiter() {
+	objects, runs := t.list("a/", "")
+	ExpectThat(objects, ElementsAre("a/", "a/b/", "a/b/c", "a/d"))
+	ExpectThat(runs, ElementsAre())
+}
+
+func (t *OfflineBucketTest) ContentsNotServed() {
+	_, err := t.bucket.NewReader(t.ctx, &gcs.ReadObjectRequest{Name: "e"})
+	ExpectThat(err, Error(HasSubstr("aren't cached")))
+
+	_, err = t.bucket.NewReader(t.ctx, &gcs.ReadObjectRequest{Name: "f"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *OfflineBucketTest) ModificationsFail() {
+	_, err := t.bucket.UpdateObject(t.ctx, &gcs.UpdateObjectRequest{Name: "e"})
+	ExpectThat(err, Error(HasSubstr("offline")))
+
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "e"})
+	ExpectThat(err, Error(HasSubstr("offline")))
+}
@@ -0,0 +1,52 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// MaxListPageSize is the largest number of results GCS returns in a page of a
+// listing, whatever is asked for.
+const MaxListPageSize = 1000
+
+// NewPageSizeBucket wraps a bucket such that listings that leave the number of
+// results per page to the wrapped bucket ask for the given number instead.
+// Listings that ask for a number of their own are passed through unchanged.
+func NewPageSizeBucket(wrapped gcs.Bucket, size int) gcs.Bucket {
+	return &pageSizeBucket{
+		Bucket: wrapped,
+		size:   size,
+	}
+}
+
+type pageSizeBucket struct {
+	gcs.Bucket
+	size int
+}
+
+func (b *pageSizeBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	if req.MaxResults == 0 {
+		sized := *req
+		sized.MaxResults = b.size
+		req = &sized
+	}
+
+	listing, err = b.Bucket.ListObjects(ctx, req)
+	return
+}
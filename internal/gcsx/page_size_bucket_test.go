@@ -0,0 +1,83 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestPageSizeBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type PageSizeBucketTest struct {
+	ctx    context.Context
+	bucket gcs.Bucket
+}
+
+var _ SetUpInterface = &PageSizeBucketTest{}
+
+func init() { RegisterTestSuite(&PageSizeBucketTest{}) }
+
+func (t *PageSizeBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+
+	wrapped := gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		_, err := gcsutil.CreateObject(t.ctx, wrapped, name, []byte(""))
+		AssertEq(nil, err)
+	}
+
+	t.bucket = gcsx.NewPageSizeBucket(wrapped, 2)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *PageSizeBucketTest) DefaultPageSizeReplaced() {
+	listing, err := t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+
+	ExpectEq(2, len(listing.Objects))
+	ExpectNe("", listing.ContinuationToken)
+}
+
+func (t *PageSizeBucketTest) ExplicitPageSizeKept() {
+	req := &gcs.ListObjectsRequest{MaxResults: 4}
+	listing, err := t.bucket.ListObjects(t.ctx, req)
+	AssertEq(nil, err)
+
+	ExpectEq(4, len(listing.Objects))
+	ExpectEq(4, req.MaxResults)
+}
+
+func (t *PageSizeBucketTest) ListingsComplete() {
+	objects, _, err := gcsutil.ListAll(t.ctx, t.bucket, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+	ExpectEq(5, len(objects))
+	ExpectEq("e", objects[4].Name)
+}
@@ -0,0 +1,231 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/syncutil"
+	"golang.org/x/net/context"
+)
+
+// Create an objectCreator that accepts a source object and the full contents
+// with which it should be overwritten, like fullCreator, but that uploads
+// contents of at least threshold bytes in the given number of parts
+// concurrently, as temporary objects using the supplied prefix, and then
+// composes the parts over the source object. Other contents are passed to
+// fullCreator, as are those of objects with a content encoding, which
+// composing would lose, and those that can't be read at random.
+//
+// As for the append creator, Create attempts to remove the temporary objects
+// but may fail to do so, and guarantees to return *gcs.PreconditionError when
+// the source object has been clobbered.
+//
+// REQUIRES: 2 <= parts <= gcs.MaxSourcesPerComposeRequest
+func newParallelObjectCreator(
+	prefix string,
+	parts int,
+	threshold int64,
+	fullCreator *fullObjectCreator,
+	bucket gcs.Bucket) (oc objectCreator) {
+	oc = &parallelObjectCreator{
+		prefix:      prefix,
+		parts:       parts,
+		threshold:   threshold,
+		fullCreator: fullCreator,
+		bucket:      bucket,
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Implementation
+////////////////////////////////////////////////////////////////////////
+
+type parallelObjectCreator struct {
+	prefix      string
+	parts       int
+	threshold   int64
+	fullCreator *fullObjectCreator
+	bucket      gcs.Bucket
+}
+
+func (oc *parallelObjectCreator) Create(
+	ctx context.Context,
+	srcObject *gcs.Object,
+	mtime time.Time,
+	r io.Reader) (o *gcs.Object, err error) {
+	tf, ok := r.(TempFile)
+	if !ok || srcObject.ContentEncoding != "" {
+		o, err = oc.fullCreator.Create(ctx, srcObject, mtime, r)
+		return
+	}
+
+	// Stat may move the seek position, from which fullCreator reads.
+	sr, err := tf.Stat()
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	_, err = tf.Seek(0, 0)
+	if err != nil {
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	if sr.Size < oc.threshold {
+		o, err = oc.fullCreator.Create(ctx, srcObject, mtime, r)
+		return
+	}
+
+	metadata, err := oc.fullCreator.metadata(srcObject, mtime, tf)
+	if err != nil {
+		return
+	}
+
+	// Upload the parts, remembering each one created so that it can be deleted
+	// however we finish.
+	tmps := make([]*gcs.Object, oc.parts)
+	defer oc.deleteParts(ctx, tmps, &err)
+
+	err = oc.uploadParts(ctx, tf, sr.Size, tmps)
+	if err != nil {
+		return
+	}
+
+	// Compose the parts over the source object.
+	var sources []gcs.ComposeSource
+	for _, tmp := range tmps {
+		sources = append(sources, gcs.ComposeSource{
+			Name:       tmp.Name,
+			Generation: tmp.Generation,
+		})
+	}
+
+	o, err = oc.bucket.ComposeObjects(
+		ctx,
+		&gcs.ComposeObjectsRequest{
+			DstName:                       srcObject.Name,
+			DstGenerationPrecondition:     &srcObject.Generation,
+			DstMetaGenerationPrecondition: &srcObject.MetaGeneration,
+			Sources:                       sources,
+			Metadata:                      metadata,
+		})
+
+	switch typed := err.(type) {
+	case nil:
+
+	case *gcs.PreconditionError:
+		err = &gcs.PreconditionError{
+			Err: fmt.Errorf("ComposeObjects: %v", typed.Err),
+		}
+		return
+
+	default:
+		err = fmt.Errorf("ComposeObjects: %v", err)
+		return
+	}
+
+	return
+}
+
+// Upload the supplied contents as len(tmps) temporary objects of about the
+// same size, recording each in tmps as it is created.
+func (oc *parallelObjectCreator) uploadParts(
+	ctx context.Context,
+	tf TempFile,
+	size int64,
+	tmps []*gcs.Object) (err error) {
+	b := syncutil.NewBundle(ctx)
+
+	partSize := (size + int64(len(tmps)) - 1) / int64(len(tmps))
+	for i := range tmps {
+		i := i
+		start := int64(i) * partSize
+		limit := start + partSize
+		if limit > size {
+			limit = size
+		}
+
+		if start > limit {
+			start = limit
+		}
+
+		b.Add(func(ctx context.Context) (err error) {
+			name, err := chooseTmpObjectName(oc.prefix)
+			if err != nil {
+				err = fmt.Errorf("chooseTmpObjectName: %v", err)
+				return
+			}
+
+			var zero int64
+			tmps[i], err = oc.bucket.CreateObject(
+				ctx,
+				&gcs.CreateObjectRequest{
+					Name:                   name,
+					GenerationPrecondition: &zero,
+					Contents:               io.NewSectionReader(tf, start, limit-start),
+				})
+
+			if err != nil {
+				err = fmt.Errorf("CreateObject(part %d): %v", i, err)
+				return
+			}
+
+			return
+		})
+	}
+
+	err = b.Join()
+	return
+}
+
+// Delete the temporary objects recorded in tmps, setting *err if it is nil and
+// any deletion fails.
+func (oc *parallelObjectCreator) deleteParts(
+	ctx context.Context,
+	tmps []*gcs.Object,
+	err *error) {
+	b := syncutil.NewBundle(ctx)
+	for _, tmp := range tmps {
+		if tmp == nil {
+			continue
+		}
+
+		name := tmp.Name
+		b.Add(func(ctx context.Context) (err error) {
+			err = oc.bucket.DeleteObject(
+				ctx,
+				&gcs.DeleteObjectRequest{Name: name})
+
+			if err != nil {
+				err = fmt.Errorf("DeleteObject: %v", err)
+				return
+			}
+
+			return
+		})
+	}
+
+	deleteErr := b.Join()
+	if *err == nil && deleteErr != nil {
+		*err = deleteErr
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+const parallelTestContents = "tacoburritoenchilada"
+
+// Set up a bucket holding "foo" with some custom metadata, a creator that
+// uploads contents of at least threshold bytes in three parts, and a temp
+// file holding parallelTestContents.
+func setUpParallelTest(
+	t *testing.T,
+	threshold int64) (
+	bucket gcs.Bucket,
+	src *gcs.Object,
+	oc objectCreator,
+	tf TempFile) {
+	ctx := context.Background()
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC))
+	bucket = gcsfake.NewFakeBucket(&clock, "some_bucket")
+
+	src, err := bucket.CreateObject(
+		ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "foo",
+			Contents: strings.NewReader("taco"),
+			Metadata: map[string]string{"bar": "baz"},
+		})
+
+	if err != nil {
+		t.Fatalf("CreateObject: %v", err)
+	}
+
+	oc = newParallelObjectCreator(
+		".gcsfuse_tmp/",
+		3,
+		threshold,
+		&fullObjectCreator{bucket: bucket},
+		bucket)
+
+	tf, err = NewTempFile(strings.NewReader(parallelTestContents), nil, &clock)
+	if err != nil {
+		t.Fatalf("NewTempFile: %v", err)
+	}
+
+	// The syncer hands over the contents positioned at the start.
+	_, err = tf.Seek(0, 0)
+	if err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+
+	return
+}
+
+// Return the names of the temporary objects left in the bucket.
+func leftoverParts(t *testing.T, bucket gcs.Bucket) (names []string) {
+	objects, _, err := gcsutil.ListAll(
+		context.Background(),
+		bucket,
+		&gcs.ListObjectsRequest{Prefix: ".gcsfuse_tmp/"})
+
+	if err != nil {
+		t.Fatalf("ListAll: %v", err)
+	}
+
+	for _, o := range objects {
+		names = append(names, o.Name)
+	}
+
+	return
+}
+
+func TestParallelObjectCreator(t *testing.T) {
+	ctx := context.Background()
+	bucket, src, oc, tf := setUpParallelTest(t, 1)
+	defer tf.Destroy()
+
+	mtime := time.Date(2016, 2, 3, 4, 5, 6, 0, time.UTC)
+	o, err := oc.Create(ctx, src, mtime, tf)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	if o.ComponentCount != 3 {
+		t.Errorf("ComponentCount is %d, want 3", o.ComponentCount)
+	}
+
+	if got, want := o.Metadata["bar"], "baz"; got != want {
+		t.Errorf("Metadata[bar] is %q, want %q", got, want)
+	}
+
+	if got, want := o.Metadata[MtimeMetadataKey], mtime.Format(time.RFC3339Nano); got != want {
+		t.Errorf("Metadata[%s] is %q, want %q", MtimeMetadataKey, got, want)
+	}
+
+	contents, err := gcsutil.ReadObject(ctx, bucket, "foo")
+	if err != nil {
+		t.Fatalf("ReadObject: %v", err)
+	}
+
+	if got := string(contents); got != parallelTestContents {
+		t.Errorf("Contents are %q, want %q", got, parallelTestContents)
+	}
+
+	if names := leftoverParts(t, bucket); len(names) != 0 {
+		t.Errorf("Temporary objects left behind: %q", names)
+	}
+}
+
+func TestParallelObjectCreatorBelowThreshold(t *testing.T) {
+	ctx := context.Background()
+	bucket, src, oc, tf := setUpParallelTest(
+		t,
+		int64(len(parallelTestContents)+1))
+
+	defer tf.Destroy()
+
+	o, err := oc.Create(ctx, src, time.Now(), tf)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	// The contents should have been uploaded whole.
+	if o.ComponentCount > 1 {
+		t.Errorf("ComponentCount is %d, want at most 1", o.ComponentCount)
+	}
+
+	contents, err := gcsutil.ReadObject(ctx, bucket, "foo")
+	if err != nil {
+		t.Fatalf("ReadObject: %v", err)
+	}
+
+	if got := string(contents); got != parallelTestContents {
+		t.Errorf("Contents are %q, want %q", got, parallelTestContents)
+	}
+}
+
+func TestParallelObjectCreatorClobbered(t *testing.T) {
+	ctx := context.Background()
+	bucket, src, oc, tf := setUpParallelTest(t, 1)
+	defer tf.Destroy()
+
+	_, err := gcsutil.CreateObject(ctx, bucket, "foo", []byte("queso"))
+	if err != nil {
+		t.Fatalf("CreateObject: %v", err)
+	}
+
+	_, err = oc.Create(ctx, src, time.Now(), tf)
+	if _, ok := err.(*gcs.PreconditionError); !ok {
+		t.Errorf("Create returned %v, want PreconditionError", err)
+	}
+
+	if names := leftoverParts(t, bucket); len(names) != 0 {
+		t.Errorf("Temporary objects left behind: %q", names)
+	}
+}
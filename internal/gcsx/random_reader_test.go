@@ -154,8 +154,8 @@ func (t *RandomReaderTest) SetUp(ti *TestInfo) {
 	// Create the bucket.
 	t.bucket = gcs.NewMockBucket(ti.MockController, "bucket")
 
-	// Set up the reader.
-	rr, err := NewRandomReader(t.object, t.bucket)
+	// Set up the reader, keeping up to four skipped bytes.
+	rr, err := NewRandomReader(t.object, t.bucket, NewBufferPool(4))
 	AssertEq(nil, err)
 	t.rr.wrapped = rr.(*randomReader)
 }
@@ -217,6 +217,104 @@ func (t *RandomReaderTest) ExistingReader_WrongOffset() {
 	t.rr.ReadAt(buf, 0)
 }
 
+func (t *RandomReaderTest) ExistingReader_SkipsForward() {
+	// Simulate an existing reader that yields a byte at a time, as a network
+	// connection may.
+	t.rr.wrapped.reader = ioutil.NopCloser(
+		iotest.OneByteReader(strings.NewReader("abcdef")))
+	t.rr.wrapped.cancel = func() {}
+	t.rr.wrapped.start = 2
+	t.rr.wrapped.limit = 8
+
+	// Reading a little way ahead should consume the reader rather than set up a
+	// new one.
+	buf := make([]byte, 2)
+	n, err := t.rr.ReadAt(buf, 5)
+
+	AssertEq(nil, err)
+	ExpectEq("de", string(buf[:n]))
+	ExpectEq(7, t.rr.wrapped.start)
+}
+
+func (t *RandomReaderTest) ExistingReader_KeepsSkippedBytes() {
+	t.rr.wrapped.reader = ioutil.NopCloser(
+		iotest.OneByteReader(strings.NewReader("abcdef")))
+	t.rr.wrapped.cancel = func() {}
+	t.rr.wrapped.start = 2
+	t.rr.wrapped.limit = 8
+
+	buf := make([]byte, 2)
+	n, err := t.rr.ReadAt(buf, 5)
+
+	AssertEq(nil, err)
+	ExpectEq("de", string(buf[:n]))
+
+	// A read overtaken by the one above should be served from what it skipped,
+	// without a new request to GCS, and leave the reader where it was.
+	buf = make([]byte, 3)
+	n, err = t.rr.ReadAt(buf, 2)
+
+	AssertEq(nil, err)
+	ExpectEq("abc", string(buf[:n]))
+	ExpectEq(7, t.rr.wrapped.start)
+
+	// The reader should still be usable.
+	buf = make([]byte, 1)
+	n, err = t.rr.ReadAt(buf, 7)
+
+	AssertEq(nil, err)
+	ExpectEq("f", string(buf[:n]))
+}
+
+func (t *RandomReaderTest) ExistingReader_ReleasesSkippedBytesOnceRead() {
+	t.rr.wrapped.reader = ioutil.NopCloser(strings.NewReader("abcdef"))
+	t.rr.wrapped.cancel = func() {}
+	t.rr.wrapped.start = 2
+	t.rr.wrapped.limit = 8
+
+	buf := make([]byte, 2)
+	_, err := t.rr.ReadAt(buf, 5)
+	AssertEq(nil, err)
+
+	// Reading some of the skipped bytes shouldn't give up the rest.
+	buf = make([]byte, 1)
+	n, err := t.rr.ReadAt(buf, 3)
+
+	AssertEq(nil, err)
+	ExpectEq("b", string(buf[:n]))
+	ExpectNe(nil, t.rr.wrapped.skipped)
+
+	buf = make([]byte, 1)
+	n, err = t.rr.ReadAt(buf, 2)
+
+	AssertEq(nil, err)
+	ExpectEq("a", string(buf[:n]))
+	ExpectNe(nil, t.rr.wrapped.skipped)
+
+	// Once they have all been read, the buffer should go back to the pool.
+	buf = make([]byte, 1)
+	n, err = t.rr.ReadAt(buf, 4)
+
+	AssertEq(nil, err)
+	ExpectEq("c", string(buf[:n]))
+	ExpectEq(nil, t.rr.wrapped.skipped)
+}
+
+func (t *RandomReaderTest) ExistingReader_DiscardsSkippedBytesThatDontFit() {
+	t.rr.wrapped.reader = ioutil.NopCloser(strings.NewReader("abcdef"))
+	t.rr.wrapped.cancel = func() {}
+	t.rr.wrapped.start = 2
+	t.rr.wrapped.limit = 8
+
+	// Skipping five bytes is more than the pool's buffers hold.
+	buf := make([]byte, 1)
+	n, err := t.rr.ReadAt(buf, 7)
+
+	AssertEq(nil, err)
+	ExpectEq("f", string(buf[:n]))
+	ExpectEq(nil, t.rr.wrapped.skipped)
+}
+
 func (t *RandomReaderTest) NewReaderReturnsError() {
 	ExpectCall(t.bucket, "NewReader")(Any(), Any()).
 		WillOnce(Return(nil, errors.New("taco")))
@@ -228,6 +326,17 @@ func (t *RandomReaderTest) NewReaderReturnsError() {
 	ExpectThat(err, Error(HasSubstr("taco")))
 }
 
+func (t *RandomReaderTest) NewReaderReturnsNotFound() {
+	notFound := &gcs.NotFoundError{Err: errors.New("taco")}
+	ExpectCall(t.bucket, "NewReader")(Any(), Any()).
+		WillOnce(Return(nil, notFound))
+
+	buf := make([]byte, 1)
+	_, err := t.rr.ReadAt(buf, 0)
+
+	ExpectEq(notFound, err)
+}
+
 func (t *RandomReaderTest) ReaderFails() {
 	// Bucket
 	r := iotest.OneByteReader(iotest.TimeoutReader(strings.NewReader("xxx")))
@@ -378,6 +487,71 @@ func (t *RandomReaderTest) PropagatesCancellation() {
 	<-readReturned
 }
 
+func (t *RandomReaderTest) PropagatesCancellationToNewReader() {
+	// Have the bucket block until the request's context is cancelled.
+	ExpectCall(t.bucket, "NewReader")(Any(), Any()).
+		WillOnce(Invoke(func(
+			ctx context.Context,
+			req *gcs.ReadObjectRequest) (io.ReadCloser, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}))
+
+	// Start a read in the background using a context that we control.
+	readErr := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		buf := make([]byte, 2)
+		_, err := t.rr.wrapped.ReadAt(ctx, buf, 0)
+		readErr <- err
+	}()
+
+	// Cancelling our context should cause the request to give up.
+	cancel()
+
+	select {
+	case err := <-readErr:
+		ExpectThat(err, Error(HasSubstr("NewReader")))
+		ExpectEq(nil, t.rr.wrapped.reader)
+		ExpectEq(nil, t.rr.wrapped.cancel)
+
+	case <-time.After(time.Second):
+		AddFailure("Read didn't return after cancellation.")
+		AbortTest()
+	}
+}
+
+func (t *RandomReaderTest) DiscardsReaderAfterCancellation() {
+	// Set up a reader that will block until we tell it to return.
+	finishRead := make(chan struct{})
+	rc := &countingCloser{Reader: &blockingReader{finishRead}}
+
+	t.rr.wrapped.reader = rc
+	t.rr.wrapped.start = 1
+	t.rr.wrapped.limit = 4
+
+	// When the read is cancelled, have the reader give up.
+	t.rr.wrapped.cancel = func() { close(finishRead) }
+
+	// Read using a context that we then cancel.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	buf := make([]byte, 2)
+	_, err := t.rr.wrapped.ReadAt(ctx, buf, 1)
+	ExpectThat(err, Error(HasSubstr("readFull")))
+
+	// The reader should have been thrown away rather than kept for the next
+	// read, which would otherwise fail in the same way.
+	ExpectEq(1, rc.closeCount)
+	ExpectEq(nil, t.rr.wrapped.reader)
+	ExpectEq(nil, t.rr.wrapped.cancel)
+}
+
 func (t *RandomReaderTest) DoesntPropagateCancellationAfterReturning() {
 	// Set up a reader that will return three bytes.
 	t.rr.wrapped.reader = ioutil.NopCloser(strings.NewReader("xxx"))
@@ -523,3 +697,109 @@ func (t *RandomReaderTest) UpgradesSequentialReads_NoExistingReader() {
 	ExpectEq(1+readSize, t.rr.wrapped.start)
 	ExpectEq(t.object.Size, t.rr.wrapped.limit)
 }
+
+func (t *RandomReaderTest) UpgradesSequentialReads_AfterSeeks() {
+	t.object.Size = 1 << 40
+	const readSize = 10
+
+	// Simulate a history of seeks that triggered random reads, the last of
+	// which ended at the offset from which we read below.
+	t.rr.wrapped.seeks = minSeeksForRandom
+	t.rr.wrapped.totalReadBytes = readSize
+	t.rr.wrapped.start = 1
+	t.rr.wrapped.limit = 1
+
+	// The bucket should be asked to read up to the end of the object.
+	r := strings.NewReader(strings.Repeat("x", readSize))
+	rc := ioutil.NopCloser(r)
+
+	ExpectCall(t.bucket, "NewReader")(
+		Any(),
+		AllOf(rangeStartIs(1), rangeLimitIs(t.object.Size))).
+		WillOnce(Return(rc, nil))
+
+	// Call through.
+	buf := make([]byte, readSize)
+	t.rr.ReadAt(buf, 1)
+
+	// Check the state now.
+	ExpectEq(1+readSize, t.rr.wrapped.start)
+	ExpectEq(t.object.Size, t.rr.wrapped.limit)
+}
+
+func (t *RandomReaderTest) RandomHint_Sequential() {
+	t.object.Size = 1 << 40
+	const readSize = 10
+
+	// Even when carrying on from the previous request, the hint wins.
+	t.rr.wrapped.SetHint(ReadHintRandom)
+	t.rr.wrapped.start = 1
+	t.rr.wrapped.limit = 1
+
+	r := strings.NewReader(strings.Repeat("x", minReadSize))
+	rc := ioutil.NopCloser(r)
+
+	ExpectCall(t.bucket, "NewReader")(
+		Any(),
+		AllOf(rangeStartIs(1), rangeLimitIs(1+minReadSize))).
+		WillOnce(Return(rc, nil))
+
+	// Call through.
+	buf := make([]byte, readSize)
+	t.rr.ReadAt(buf, 1)
+
+	// Check the state now.
+	ExpectEq(1+minReadSize, t.rr.wrapped.limit)
+}
+
+func (t *RandomReaderTest) RandomHint() {
+	t.object.Size = 1 << 40
+	const readSize = 10
+
+	// Even without having observed any seeks, the bucket should be asked for
+	// only minReadSize bytes.
+	t.rr.wrapped.SetHint(ReadHintRandom)
+
+	r := strings.NewReader(strings.Repeat("x", minReadSize))
+	rc := ioutil.NopCloser(r)
+
+	ExpectCall(t.bucket, "NewReader")(
+		Any(),
+		AllOf(rangeStartIs(1), rangeLimitIs(1+minReadSize))).
+		WillOnce(Return(rc, nil))
+
+	// Call through.
+	buf := make([]byte, readSize)
+	t.rr.ReadAt(buf, 1)
+
+	// Check the state now.
+	ExpectEq(1+readSize, t.rr.wrapped.start)
+	ExpectEq(1+minReadSize, t.rr.wrapped.limit)
+}
+
+func (t *RandomReaderTest) SequentialHint() {
+	t.object.Size = 1 << 40
+	const readSize = 10
+
+	// Simulate a history of seeks that would normally trigger random reads.
+	t.rr.wrapped.seeks = minSeeksForRandom
+	t.rr.wrapped.totalReadBytes = readSize
+	t.rr.wrapped.SetHint(ReadHintSequential)
+
+	// The bucket should be asked to read up to the end of the object anyway.
+	r := strings.NewReader(strings.Repeat("x", readSize))
+	rc := ioutil.NopCloser(r)
+
+	ExpectCall(t.bucket, "NewReader")(
+		Any(),
+		AllOf(rangeStartIs(1), rangeLimitIs(t.object.Size))).
+		WillOnce(Return(rc, nil))
+
+	// Call through.
+	buf := make([]byte, readSize)
+	t.rr.ReadAt(buf, 1)
+
+	// Check the state now.
+	ExpectEq(1+readSize, t.rr.wrapped.start)
+	ExpectEq(t.object.Size, t.rr.wrapped.limit)
+}
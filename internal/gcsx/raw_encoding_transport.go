@@ -0,0 +1,103 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/jacobsa/gcloud/httputil"
+)
+
+// NewRawEncodingTransport wraps a transport such that objects stored with a
+// Content-Encoding such as gzip are downloaded exactly as stored.
+//
+// Otherwise GCS decompresses such objects on the fly when the request doesn't
+// accept gzip, ignoring any Range header, and package http asks for gzip and
+// decompresses the response itself when there is no Range header. Either way
+// the bytes read don't match the object's size or checksum.
+func NewRawEncodingTransport(
+	wrapped httputil.CancellableRoundTripper) (
+	t httputil.CancellableRoundTripper) {
+	t = &rawEncodingTransport{
+		wrapped:  wrapped,
+		modified: make(map[*http.Request]*http.Request),
+	}
+
+	return
+}
+
+type rawEncodingTransport struct {
+	wrapped httputil.CancellableRoundTripper
+
+	mu sync.Mutex
+
+	// The modified request for each request in flight, so that we can cancel
+	// the right one.
+	//
+	// GUARDED_BY(mu)
+	modified map[*http.Request]*http.Request
+}
+
+func (t *rawEncodingTransport) RoundTrip(
+	req *http.Request) (resp *http.Response, err error) {
+	// Don't modify the caller's request, per the RoundTripper contract.
+	modified := new(http.Request)
+	*modified = *req
+	modified.Header = make(http.Header)
+	for k, v := range req.Header {
+		modified.Header[k] = v
+	}
+
+	// Setting this explicitly also stops package http from decompressing the
+	// response.
+	modified.Header.Set("Accept-Encoding", "gzip")
+
+	t.mu.Lock()
+	t.modified[req] = modified
+	t.mu.Unlock()
+
+	resp, err = t.wrapped.RoundTrip(modified)
+	if err != nil {
+		t.forget(req)
+		return
+	}
+
+	resp.Body = &forgettingReadCloser{
+		ReadCloser: resp.Body,
+		forget:     func() { t.forget(req) },
+	}
+
+	return
+}
+
+func (t *rawEncodingTransport) CancelRequest(req *http.Request) {
+	t.mu.Lock()
+	modified := t.modified[req]
+	t.mu.Unlock()
+
+	if modified == nil {
+		modified = req
+	}
+
+	t.wrapped.CancelRequest(modified)
+}
+
+func (t *rawEncodingTransport) forget(req *http.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.modified, req)
+}
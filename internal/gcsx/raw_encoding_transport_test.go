@@ -0,0 +1,94 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/httputil"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestRawEncodingTransport(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type RawEncodingTransportTest struct {
+	server *httptest.Server
+
+	// The gzipped contents served for every request.
+	compressed []byte
+
+	// The Accept-Encoding header seen by the server.
+	acceptEncoding string
+}
+
+var _ SetUpInterface = &RawEncodingTransportTest{}
+var _ TearDownInterface = &RawEncodingTransportTest{}
+
+func init() { RegisterTestSuite(&RawEncodingTransportTest{}) }
+
+func (t *RawEncodingTransportTest) SetUp(ti *TestInfo) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write([]byte("taco"))
+	AssertEq(nil, err)
+	AssertEq(nil, w.Close())
+	t.compressed = buf.Bytes()
+
+	t.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			t.acceptEncoding = r.Header.Get("Accept-Encoding")
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(t.compressed)
+		}))
+}
+
+func (t *RawEncodingTransportTest) TearDown() {
+	t.server.Close()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RawEncodingTransportTest) ServesStoredBytes() {
+	transport := gcsx.NewRawEncodingTransport(
+		http.DefaultTransport.(httputil.CancellableRoundTripper))
+
+	req, err := http.NewRequest("GET", t.server.URL, nil)
+	AssertEq(nil, err)
+
+	resp, err := transport.RoundTrip(req)
+	AssertEq(nil, err)
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	AssertEq(nil, err)
+
+	ExpectEq("gzip", t.acceptEncoding)
+	ExpectTrue(bytes.Equal(t.compressed, b), "%q", b)
+
+	// The caller's request should be untouched.
+	ExpectEq("", req.Header.Get("Accept-Encoding"))
+}
@@ -0,0 +1,227 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/monitor"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/util/lrucache"
+	"golang.org/x/net/context"
+)
+
+// The number of object generations whose checksums a bucket from
+// NewReplicaBucket remembers, so that it can tell whether the replica holds
+// the same contents.
+const replicaChecksumCapacity = 1 << 16
+
+// Values for the label of the counter passed to NewReplicaBucket.
+const (
+	ReplicaServed = "served"
+	ReplicaStale  = "stale"
+	ReplicaFailed = "failed"
+)
+
+// NewReplicaBucket wraps a bucket such that a read of a particular generation
+// that fails in a way that suggests GCS is unavailable, as for
+// NewCircuitBreakerBucket, is retried against the latest generation of the
+// same name in the replica bucket, so long as that has the same size and
+// CRC32C. Since generation numbers differ between buckets, the checksums of
+// the generations seen in the results of other requests are remembered for
+// the comparison. A read of a generation that hasn't been seen isn't retried.
+//
+// Everything else, including every change to the bucket, goes to the wrapped
+// bucket alone. If replicaReads is non-nil, it counts the reads retried under
+// ReplicaServed, ReplicaStale, and ReplicaFailed.
+func NewReplicaBucket(
+	wrapped gcs.Bucket,
+	replica gcs.Bucket,
+	replicaReads *monitor.Counter) gcs.Bucket {
+	return &replicaBucket{
+		Bucket:       wrapped,
+		replica:      replica,
+		replicaReads: replicaReads,
+		checksums:    lrucache.New(replicaChecksumCapacity),
+	}
+}
+
+type replicaBucket struct {
+	gcs.Bucket
+
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	replica      gcs.Bucket
+	replicaReads *monitor.Counter
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The contents of recently seen generations, by checksumKey.
+	//
+	// INVARIANT: checksums.CheckInvariants() does not panic
+	// INVARIANT: Each value is of type replicaChecksum
+	//
+	// GUARDED_BY(mu)
+	checksums lrucache.Cache
+}
+
+// What a generation in the replica must match to be read in place of a
+// generation in the wrapped bucket.
+type replicaChecksum struct {
+	size   uint64
+	crc32c uint32
+}
+
+func checksumKey(name string, generation int64) string {
+	return fmt.Sprintf("%d/%s", generation, name)
+}
+
+// Remember the checksums of the given generations.
+func (b *replicaBucket) remember(objects ...*gcs.Object) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, o := range objects {
+		b.checksums.Insert(
+			checksumKey(o.Name, o.Generation),
+			replicaChecksum{o.Size, o.CRC32C})
+	}
+}
+
+func (b *replicaBucket) count(outcome string) {
+	if b.replicaReads != nil {
+		b.replicaReads.Add(outcome, 1)
+	}
+}
+
+func (b *replicaBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	rc, err = b.Bucket.NewReader(ctx, req)
+	if err == nil || !isOutage(err) || ctx.Err() != nil || req.Generation == 0 {
+		return
+	}
+
+	key := checksumKey(req.Name, req.Generation)
+	b.mu.Lock()
+	want, ok := b.checksums.LookUp(key).(replicaChecksum)
+	b.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	// Return the original error if the replica can't help.
+	o, replicaErr := b.replica.StatObject(
+		ctx,
+		&gcs.StatObjectRequest{Name: req.Name})
+
+	if replicaErr != nil {
+		b.count(ReplicaFailed)
+		return
+	}
+
+	if (replicaChecksum{o.Size, o.CRC32C}) != want {
+		b.count(ReplicaStale)
+		return
+	}
+
+	replicaReq := *req
+	replicaReq.Generation = o.Generation
+
+	replicaRC, replicaErr := b.replica.NewReader(ctx, &replicaReq)
+	if replicaErr != nil {
+		b.count(ReplicaFailed)
+		return
+	}
+
+	b.count(ReplicaServed)
+	rc, err = replicaRC, nil
+	return
+}
+
+func (b *replicaBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.CreateObject(ctx, req)
+	if err == nil {
+		b.remember(o)
+	}
+
+	return
+}
+
+func (b *replicaBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.CopyObject(ctx, req)
+	if err == nil {
+		b.remember(o)
+	}
+
+	return
+}
+
+func (b *replicaBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.ComposeObjects(ctx, req)
+	if err == nil {
+		b.remember(o)
+	}
+
+	return
+}
+
+func (b *replicaBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.StatObject(ctx, req)
+	if err == nil {
+		b.remember(o)
+	}
+
+	return
+}
+
+func (b *replicaBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	listing, err = b.Bucket.ListObjects(ctx, req)
+	if err == nil {
+		b.remember(listing.Objects...)
+	}
+
+	return
+}
+
+func (b *replicaBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.UpdateObject(ctx, req)
+	if err == nil {
+		b.remember(o)
+	}
+
+	return
+}
@@ -0,0 +1,203 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/monitor"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestReplicaBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose NewReader requests fail with a configurable error.
+type failingReadBucket struct {
+	gcs.Bucket
+	err error
+}
+
+func (b *failingReadBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	if b.err != nil {
+		err = b.err
+		return
+	}
+
+	rc, err = b.Bucket.NewReader(ctx, req)
+	return
+}
+
+type ReplicaBucketTest struct {
+	ctx     context.Context
+	primary *failingReadBucket
+	replica gcs.Bucket
+	bucket  gcs.Bucket
+
+	// Counts before the test began, since the metrics are global.
+	initialReads map[string]int64
+}
+
+var _ SetUpInterface = &ReplicaBucketTest{}
+
+func init() { RegisterTestSuite(&ReplicaBucketTest{}) }
+
+func (t *ReplicaBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.primary = &failingReadBucket{
+		Bucket: gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket"),
+	}
+
+	t.replica = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_replica")
+	t.bucket = gcsx.NewReplicaBucket(
+		t.primary,
+		t.replica,
+		monitor.GCSReplicaReads)
+
+	t.initialReads = monitor.GCSReplicaReads.Snapshot()
+}
+
+func (t *ReplicaBucketTest) replicaReads(outcome string) int64 {
+	return monitor.GCSReplicaReads.Value(outcome) - t.initialReads[outcome]
+}
+
+// Create an object with the given contents in both buckets, returning the
+// primary's generation as seen through the bucket under test.
+func (t *ReplicaBucketTest) create(
+	name string,
+	primary string,
+	replica string) (o *gcs.Object) {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, name, []byte(primary))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.replica, name, []byte(replica))
+	AssertEq(nil, err)
+
+	return
+}
+
+func (t *ReplicaBucketTest) read(o *gcs.Object) (contents string, err error) {
+	rc, err := t.bucket.NewReader(
+		t.ctx,
+		&gcs.ReadObjectRequest{Name: o.Name, Generation: o.Generation})
+
+	if err != nil {
+		return
+	}
+
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	contents = string(b)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ReplicaBucketTest) PrimaryServesWhenAvailable() {
+	o := t.create("foo", "taco", "taco")
+
+	contents, err := t.read(o)
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+	ExpectEq(0, t.replicaReads(gcsx.ReplicaServed))
+}
+
+func (t *ReplicaBucketTest) ReplicaServesOutage() {
+	o := t.create("foo", "taco", "taco")
+	t.primary.err = &googleapi.Error{Code: 503}
+
+	contents, err := t.read(o)
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+	ExpectEq(1, t.replicaReads(gcsx.ReplicaServed))
+}
+
+func (t *ReplicaBucketTest) ReplicaServesOpenCircuit() {
+	o := t.create("foo", "taco", "taco")
+	t.primary.err = &gcsx.CircuitOpenError{Cause: &googleapi.Error{Code: 503}}
+
+	contents, err := t.read(o)
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+}
+
+func (t *ReplicaBucketTest) StaleReplicaNotRead() {
+	o := t.create("foo", "taco", "burrito")
+	t.primary.err = &googleapi.Error{Code: 503}
+
+	_, err := t.read(o)
+	ExpectThat(err, Error(HasSubstr("503")))
+	ExpectEq(1, t.replicaReads(gcsx.ReplicaStale))
+	ExpectEq(0, t.replicaReads(gcsx.ReplicaServed))
+}
+
+func (t *ReplicaBucketTest) MissingFromReplica() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+	t.primary.err = &googleapi.Error{Code: 503}
+
+	_, err = t.read(o)
+	ExpectThat(err, Error(HasSubstr("503")))
+	ExpectEq(1, t.replicaReads(gcsx.ReplicaFailed))
+}
+
+func (t *ReplicaBucketTest) UnseenGenerationNotRetried() {
+	// Created behind the back of the bucket under test.
+	o, err := gcsutil.CreateObject(t.ctx, t.primary, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.replica, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	t.primary.err = &googleapi.Error{Code: 503}
+	_, err = t.read(o)
+	ExpectThat(err, Error(HasSubstr("503")))
+
+	// Once seen in a listing, it is.
+	_, err = t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+
+	contents, err := t.read(o)
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+}
+
+func (t *ReplicaBucketTest) RequestErrorsNotRetried() {
+	o := t.create("foo", "taco", "taco")
+	t.primary.err = &gcs.NotFoundError{}
+
+	_, err := t.read(o)
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+	ExpectEq(0, t.replicaReads(gcsx.ReplicaServed))
+}
@@ -0,0 +1,142 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+// SizeProbe keeps an estimate of the total size of the objects in a bucket,
+// measured by listing all of them, for reporting to statfs(2). Since a listing
+// may take a long time for a large bucket, the estimate is refreshed in the
+// background and callers are never made to wait for one.
+type SizeProbe interface {
+	// Return the latest estimate in bytes, or false if there isn't one yet. If
+	// the estimate is missing or older than the probe's TTL, start a refresh in
+	// the background.
+	Size() (n uint64, ok bool)
+
+	// Measure the size of the bucket now, updating the estimate.
+	Refresh(ctx context.Context) (err error)
+}
+
+// NewSizeProbe creates a size probe for the supplied bucket that considers its
+// estimate fresh for the given TTL, according to the clock.
+func NewSizeProbe(
+	bucket gcs.Bucket,
+	ttl time.Duration,
+	clock timeutil.Clock) SizeProbe {
+	return &sizeProbe{
+		bucket: bucket,
+		ttl:    ttl,
+		clock:  clock,
+	}
+}
+
+type sizeProbe struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	bucket gcs.Bucket
+	clock  timeutil.Clock
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	ttl time.Duration
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The latest estimate and when it stops being fresh, if valid.
+	//
+	// GUARDED_BY(mu)
+	size       uint64
+	valid      bool
+	expiration time.Time
+
+	// Whether a background refresh is in progress.
+	//
+	// GUARDED_BY(mu)
+	refreshing bool
+}
+
+func (p *sizeProbe) Size() (n uint64, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.refreshing && (!p.valid || !p.clock.Now().Before(p.expiration)) {
+		p.refreshing = true
+		go p.refreshInBackground()
+	}
+
+	n = p.size
+	ok = p.valid
+	return
+}
+
+func (p *sizeProbe) Refresh(ctx context.Context) (err error) {
+	var n uint64
+	req := &gcs.ListObjectsRequest{}
+	for {
+		var listing *gcs.Listing
+		listing, err = p.bucket.ListObjects(ctx, req)
+		if err != nil {
+			err = fmt.Errorf("ListObjects: %v", err)
+			return
+		}
+
+		for _, o := range listing.Objects {
+			n += o.Size
+		}
+
+		if listing.ContinuationToken == "" {
+			break
+		}
+
+		req.ContinuationToken = listing.ContinuationToken
+	}
+
+	p.mu.Lock()
+	p.size = n
+	p.valid = true
+	p.expiration = p.clock.Now().Add(p.ttl)
+	p.mu.Unlock()
+
+	return
+}
+
+func (p *sizeProbe) refreshInBackground() {
+	err := p.Refresh(context.Background())
+	if err != nil {
+		log.Printf("Measuring bucket size: %v", err)
+	}
+
+	p.mu.Lock()
+	p.refreshing = false
+	p.mu.Unlock()
+}
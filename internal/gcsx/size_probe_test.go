@@ -0,0 +1,99 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestSizeProbe(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const sizeProbeTTL = time.Minute
+
+type SizeProbeTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	probe  gcsx.SizeProbe
+}
+
+var _ SetUpInterface = &SizeProbeTest{}
+
+func init() { RegisterTestSuite(&SizeProbeTest{}) }
+
+func (t *SizeProbeTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2016, 1, 1, 0, 0, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.probe = gcsx.NewSizeProbe(t.bucket, sizeProbeTTL, &t.clock)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *SizeProbeTest) EmptyBucket() {
+	err := t.probe.Refresh(t.ctx)
+	AssertEq(nil, err)
+
+	n, ok := t.probe.Size()
+	ExpectTrue(ok)
+	ExpectEq(0, n)
+}
+
+func (t *SizeProbeTest) SumsAllObjects() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "bar/baz", []byte("burrito"))
+	AssertEq(nil, err)
+
+	err = t.probe.Refresh(t.ctx)
+	AssertEq(nil, err)
+
+	n, ok := t.probe.Size()
+	ExpectTrue(ok)
+	ExpectEq(len("taco")+len("burrito"), n)
+}
+
+func (t *SizeProbeTest) StaleEstimateStillReturned() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	err = t.probe.Refresh(t.ctx)
+	AssertEq(nil, err)
+
+	// Past the TTL, the old estimate is still better than nothing while a new
+	// one is being made.
+	t.clock.AdvanceTime(sizeProbeTTL + time.Second)
+
+	n, ok := t.probe.Size()
+	ExpectTrue(ok)
+	ExpectEq(len("taco"), n)
+}
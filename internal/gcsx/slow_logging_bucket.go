@@ -0,0 +1,197 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+// NewSlowLoggingBucket creates a bucket that logs each request to the wrapped
+// bucket that takes longer than threshold, with the object and byte range it
+// concerns, the number of times it was retried by the retrying bucket inside
+// the wrapped one, and its outcome. For NewReader, the time is that taken to
+// begin the read, but the retries counted include those made while reading
+// until the request is logged.
+func NewSlowLoggingBucket(
+	wrapped gcs.Bucket,
+	threshold time.Duration,
+	logger *log.Logger) (b gcs.Bucket) {
+	b = &slowLoggingBucket{
+		wrapped:   wrapped,
+		threshold: threshold,
+		logger:    logger,
+	}
+
+	return
+}
+
+type slowLoggingBucket struct {
+	wrapped   gcs.Bucket
+	threshold time.Duration
+	logger    *log.Logger
+}
+
+// A request in progress.
+type slowRequest struct {
+	b       *slowLoggingBucket
+	start   time.Time
+	retries *gcs.RetryCounter
+}
+
+func (b *slowLoggingBucket) start(
+	ctx context.Context) (newCtx context.Context, r *slowRequest) {
+	r = &slowRequest{
+		b:     b,
+		start: time.Now(),
+	}
+
+	newCtx, r.retries = gcs.WithRetryCounter(ctx)
+	return
+}
+
+// Log the request if it was slow. desc is called only if so.
+func (r *slowRequest) finish(desc func() string, err error) {
+	d := time.Since(r.start)
+	if d <= r.b.threshold {
+		return
+	}
+
+	outcome := "OK"
+	if err != nil {
+		outcome = err.Error()
+	}
+
+	r.b.logger.Printf(
+		"Slow GCS request: %s took %v with %d retries: %s",
+		desc(),
+		d,
+		r.retries.Count(),
+		outcome)
+}
+
+func (b *slowLoggingBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *slowLoggingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	ctx, r := b.start(ctx)
+	rc, err = b.wrapped.NewReader(ctx, req)
+	r.finish(func() string {
+		s := fmt.Sprintf("NewReader(%q, %d", req.Name, req.Generation)
+		if req.Range != nil {
+			s += fmt.Sprintf(", [%d, %d)", req.Range.Start, req.Range.Limit)
+		}
+
+		return s + ")"
+	}, err)
+
+	return
+}
+
+func (b *slowLoggingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	ctx, r := b.start(ctx)
+	o, err = b.wrapped.CreateObject(ctx, req)
+	r.finish(func() string {
+		return fmt.Sprintf("CreateObject(%q)", req.Name)
+	}, err)
+
+	return
+}
+
+func (b *slowLoggingBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	ctx, r := b.start(ctx)
+	o, err = b.wrapped.CopyObject(ctx, req)
+	r.finish(func() string {
+		return fmt.Sprintf("CopyObject(%q, %q)", req.SrcName, req.DstName)
+	}, err)
+
+	return
+}
+
+func (b *slowLoggingBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	ctx, r := b.start(ctx)
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	r.finish(func() string {
+		return fmt.Sprintf(
+			"ComposeObjects(%q, %d sources)",
+			req.DstName,
+			len(req.Sources))
+	}, err)
+
+	return
+}
+
+func (b *slowLoggingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	ctx, r := b.start(ctx)
+	o, err = b.wrapped.StatObject(ctx, req)
+	r.finish(func() string {
+		return fmt.Sprintf("StatObject(%q)", req.Name)
+	}, err)
+
+	return
+}
+
+func (b *slowLoggingBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	ctx, r := b.start(ctx)
+	l, err = b.wrapped.ListObjects(ctx, req)
+	r.finish(func() string {
+		return fmt.Sprintf("ListObjects(%q)", req.Prefix)
+	}, err)
+
+	return
+}
+
+func (b *slowLoggingBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	ctx, r := b.start(ctx)
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	r.finish(func() string {
+		return fmt.Sprintf("UpdateObject(%q)", req.Name)
+	}, err)
+
+	return
+}
+
+func (b *slowLoggingBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	ctx, r := b.start(ctx)
+	err = b.wrapped.DeleteObject(ctx, req)
+	r.finish(func() string {
+		return fmt.Sprintf("DeleteObject(%q)", req.Name)
+	}, err)
+
+	return
+}
@@ -0,0 +1,108 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"log"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestSlowLoggingBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const slowThreshold = 10 * time.Millisecond
+
+// A bucket whose reads take longer than slowThreshold to start.
+type slowReadBucket struct {
+	gcs.Bucket
+}
+
+func (b *slowReadBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	time.Sleep(2 * slowThreshold)
+	o, err = b.Bucket.StatObject(ctx, req)
+	return
+}
+
+type SlowLoggingBucketTest struct {
+	ctx    context.Context
+	log    bytes.Buffer
+	bucket gcs.Bucket
+}
+
+var _ SetUpInterface = &SlowLoggingBucketTest{}
+
+func init() { RegisterTestSuite(&SlowLoggingBucketTest{}) }
+
+func (t *SlowLoggingBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.bucket = gcsx.NewSlowLoggingBucket(
+		&slowReadBucket{
+			Bucket: gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket"),
+		},
+		slowThreshold,
+		log.New(&t.log, "", 0))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *SlowLoggingBucketTest) FastRequestsNotLogged() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+
+	ExpectEq("", t.log.String())
+}
+
+func (t *SlowLoggingBucketTest) SlowRequestLogged() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	ExpectThat(
+		t.log.String(),
+		MatchesRegexp(`^Slow GCS request: StatObject\("foo"\) took .+ with 0 retries: OK\n$`))
+}
+
+func (t *SlowLoggingBucketTest) SlowFailureLogged() {
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertNe(nil, err)
+
+	ExpectThat(
+		t.log.String(),
+		MatchesRegexp(`^Slow GCS request: StatObject\("foo"\) took .+: .*not found`))
+}
@@ -0,0 +1,282 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/syncutil"
+	"golang.org/x/net/context"
+)
+
+// NewSnapshotBucket creates a read-only view of the supplied versioned bucket
+// as it was at the given time, in which each name resolves to the generation
+// that was live then, if any. Listings that ask for every generation are
+// passed through unchanged. Requests that would modify the bucket fail.
+//
+// A generation is live from when it was written until it was overwritten or
+// deleted, so this sees only what the bucket's versioning has kept.
+func NewSnapshotBucket(b gcs.Bucket, t time.Time) gcs.Bucket {
+	return &snapshotBucket{
+		Bucket: b,
+		t:      t,
+	}
+}
+
+// The number of runs in a page of a listing whose generations are listed at
+// once.
+const snapshotListWorkers = 16
+
+var errSnapshotReadOnly = errors.New("The bucket is mounted as a read-only snapshot")
+
+type snapshotBucket struct {
+	gcs.Bucket
+	t time.Time
+}
+
+// Was the supplied generation live at the snapshot time?
+func (b *snapshotBucket) live(o *gcs.Object) bool {
+	return !o.Created.After(b.t) && (o.Deleted.IsZero() || o.Deleted.After(b.t))
+}
+
+// Does any object whose name begins with the given prefix have a generation
+// that was live at the snapshot time?
+func (b *snapshotBucket) anyLive(
+	ctx context.Context,
+	prefix string) (found bool, err error) {
+	req := &gcs.ListObjectsRequest{
+		Prefix:   prefix,
+		Versions: true,
+	}
+
+	for {
+		var listing *gcs.Listing
+		listing, err = b.Bucket.ListObjects(ctx, req)
+		if err != nil {
+			return
+		}
+
+		for _, o := range listing.Objects {
+			if b.live(o) {
+				found = true
+				return
+			}
+		}
+
+		if listing.ContinuationToken == "" {
+			return
+		}
+
+		req.ContinuationToken = listing.ContinuationToken
+	}
+}
+
+// Return the page of the live listing at the snapshot time that starts from
+// the supplied request's position. A name's generations may be split across
+// pages of the underlying listing, but at most one of them was live at any
+// time, so each page can be filtered on its own.
+func (b *snapshotBucket) listPage(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	versioned := *req
+	versioned.Versions = true
+
+	raw, err := b.Bucket.ListObjects(ctx, &versioned)
+	if err != nil {
+		return
+	}
+
+	listing = &gcs.Listing{
+		ContinuationToken: raw.ContinuationToken,
+	}
+
+	for _, o := range raw.Objects {
+		if b.live(o) {
+			listing.Objects = append(listing.Objects, o)
+		}
+	}
+
+	// A run may hold only generations written later, or deleted before. Check
+	// them with some parallelism, since a wide directory has many.
+	runs := make(chan int, len(raw.CollapsedRuns))
+	for i := range raw.CollapsedRuns {
+		runs <- i
+	}
+
+	close(runs)
+
+	found := make([]bool, len(raw.CollapsedRuns))
+	bundle := syncutil.NewBundle(ctx)
+	for w := 0; w < snapshotListWorkers && w < len(raw.CollapsedRuns); w++ {
+		bundle.Add(func(ctx context.Context) (err error) {
+			for i := range runs {
+				found[i], err = b.anyLive(ctx, raw.CollapsedRuns[i])
+				if err != nil {
+					err = fmt.Errorf("anyLive: %v", err)
+					return
+				}
+			}
+
+			return
+		})
+	}
+
+	err = bundle.Join()
+	if err != nil {
+		return
+	}
+
+	for i, r := range raw.CollapsedRuns {
+		if found[i] {
+			listing.CollapsedRuns = append(listing.CollapsedRuns, r)
+		}
+	}
+
+	return
+}
+
+func (b *snapshotBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	if req.Versions {
+		listing, err = b.Bucket.ListObjects(ctx, req)
+		return
+	}
+
+	// Don't return an empty page while there are more to come, since callers
+	// asking for a single result take that to mean there are none.
+	pageReq := *req
+	for {
+		listing, err = b.listPage(ctx, &pageReq)
+		if err != nil {
+			return
+		}
+
+		if len(listing.Objects) > 0 ||
+			len(listing.CollapsedRuns) > 0 ||
+			listing.ContinuationToken == "" {
+			return
+		}
+
+		pageReq.ContinuationToken = listing.ContinuationToken
+	}
+}
+
+func (b *snapshotBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	// The name's generations come first in a listing by that prefix, before
+	// any longer names.
+	listReq := &gcs.ListObjectsRequest{
+		Prefix:    req.Name,
+		Delimiter: "/",
+		Versions:  true,
+	}
+
+	for {
+		var listing *gcs.Listing
+		listing, err = b.Bucket.ListObjects(ctx, listReq)
+		if err != nil {
+			return
+		}
+
+		for _, g := range listing.Objects {
+			if g.Name != req.Name {
+				break
+			}
+
+			if b.live(g) {
+				o = g
+				return
+			}
+		}
+
+		done := len(listing.CollapsedRuns) > 0 ||
+			listing.ContinuationToken == "" ||
+			(len(listing.Objects) > 0 &&
+				listing.Objects[len(listing.Objects)-1].Name != req.Name)
+
+		if done {
+			break
+		}
+
+		listReq.ContinuationToken = listing.ContinuationToken
+	}
+
+	err = &gcs.NotFoundError{
+		Err: fmt.Errorf("Object %q didn't exist at %v", req.Name, b.t),
+	}
+
+	return
+}
+
+func (b *snapshotBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	// Reading the live generation would read one from after the snapshot.
+	if req.Generation == 0 {
+		var o *gcs.Object
+		o, err = b.StatObject(ctx, &gcs.StatObjectRequest{Name: req.Name})
+		if err != nil {
+			return
+		}
+
+		r := *req
+		r.Generation = o.Generation
+		req = &r
+	}
+
+	rc, err = b.Bucket.NewReader(ctx, req)
+	return
+}
+
+func (b *snapshotBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	err = errSnapshotReadOnly
+	return
+}
+
+func (b *snapshotBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	err = errSnapshotReadOnly
+	return
+}
+
+func (b *snapshotBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	err = errSnapshotReadOnly
+	return
+}
+
+func (b *snapshotBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	err = errSnapshotReadOnly
+	return
+}
+
+func (b *snapshotBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = errSnapshotReadOnly
+	return
+}
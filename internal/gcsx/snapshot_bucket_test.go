@@ -0,0 +1,226 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+// Set up a versioned bucket in which "foo" and "dir/baz" are written at t0,
+// "foo" is overwritten and "bar" written an hour later, and "dir/baz" is
+// deleted an hour after that.
+func makeSnapshotTestBucket(t *testing.T) (b gcs.Bucket, t0 time.Time) {
+	ctx := context.Background()
+	var clock timeutil.SimulatedClock
+	t0 = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock.SetTime(t0)
+	b = gcsfake.NewVersionedFakeBucket(&clock, "")
+
+	create := func(name string, contents string) {
+		_, err := gcsutil.CreateObject(ctx, b, name, []byte(contents))
+		if err != nil {
+			t.Fatalf("CreateObject(%q): %v", name, err)
+		}
+	}
+
+	create("foo", "taco")
+	create("dir/baz", "")
+
+	clock.AdvanceTime(time.Hour)
+	create("foo", "burrito")
+	create("bar", "")
+
+	clock.AdvanceTime(time.Hour)
+	err := b.DeleteObject(ctx, &gcs.DeleteObjectRequest{Name: "dir/baz"})
+	if err != nil {
+		t.Fatalf("DeleteObject: %v", err)
+	}
+
+	return
+}
+
+// List the names of the objects and runs in the root of the bucket.
+func snapshotListing(t *testing.T, b gcs.Bucket) (names []string) {
+	listing, err := b.ListObjects(
+		context.Background(),
+		&gcs.ListObjectsRequest{Delimiter: "/"})
+
+	if err != nil {
+		t.Fatalf("ListObjects: %v", err)
+	}
+
+	for _, o := range listing.Objects {
+		names = append(names, o.Name)
+	}
+
+	names = append(names, listing.CollapsedRuns...)
+	return
+}
+
+func TestSnapshotBucket(t *testing.T) {
+	ctx := context.Background()
+	b, t0 := makeSnapshotTestBucket(t)
+
+	testCases := []struct {
+		at      time.Time
+		listing []string
+		foo     string
+	}{
+		{t0.Add(30 * time.Minute), []string{"foo", "dir/"}, "taco"},
+		{t0.Add(90 * time.Minute), []string{"bar", "foo", "dir/"}, "burrito"},
+		{t0.Add(3 * time.Hour), []string{"bar", "foo"}, "burrito"},
+	}
+
+	for _, tc := range testCases {
+		snapshot := gcsx.NewSnapshotBucket(b, tc.at)
+
+		if got := snapshotListing(t, snapshot); !reflect.DeepEqual(got, tc.listing) {
+			t.Errorf("At %v, listing is %q, want %q", tc.at, got, tc.listing)
+		}
+
+		o, err := snapshot.StatObject(ctx, &gcs.StatObjectRequest{Name: "foo"})
+		if err != nil {
+			t.Fatalf("StatObject: %v", err)
+		}
+
+		rc, err := snapshot.NewReader(ctx, &gcs.ReadObjectRequest{Name: "foo"})
+		if err != nil {
+			t.Fatalf("NewReader: %v", err)
+		}
+
+		contents, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+
+		if got := string(contents); got != tc.foo {
+			t.Errorf("At %v, foo contains %q, want %q", tc.at, got, tc.foo)
+		}
+
+		if got, want := o.Size, uint64(len(tc.foo)); got != want {
+			t.Errorf("At %v, foo has size %d, want %d", tc.at, got, want)
+		}
+	}
+}
+
+func TestSnapshotBucketMissingNames(t *testing.T) {
+	ctx := context.Background()
+	b, t0 := makeSnapshotTestBucket(t)
+	snapshot := gcsx.NewSnapshotBucket(b, t0.Add(30*time.Minute))
+
+	// Written later.
+	_, err := snapshot.StatObject(ctx, &gcs.StatObjectRequest{Name: "bar"})
+	if _, ok := err.(*gcs.NotFoundError); !ok {
+		t.Errorf("StatObject(bar) returned %v, want NotFoundError", err)
+	}
+
+	// Written before, but only the prefix of another name.
+	_, err = snapshot.StatObject(ctx, &gcs.StatObjectRequest{Name: "fo"})
+	if _, ok := err.(*gcs.NotFoundError); !ok {
+		t.Errorf("StatObject(fo) returned %v, want NotFoundError", err)
+	}
+
+	// Deleted before.
+	snapshot = gcsx.NewSnapshotBucket(b, t0.Add(3*time.Hour))
+	_, err = snapshot.StatObject(ctx, &gcs.StatObjectRequest{Name: "dir/baz"})
+	if _, ok := err.(*gcs.NotFoundError); !ok {
+		t.Errorf("StatObject(dir/baz) returned %v, want NotFoundError", err)
+	}
+}
+
+func TestSnapshotBucketIsReadOnly(t *testing.T) {
+	ctx := context.Background()
+	b, t0 := makeSnapshotTestBucket(t)
+	snapshot := gcsx.NewSnapshotBucket(b, t0.Add(3*time.Hour))
+
+	_, err := snapshot.CreateObject(ctx, &gcs.CreateObjectRequest{
+		Name:     "qux",
+		Contents: strings.NewReader(""),
+	})
+
+	if err == nil {
+		t.Errorf("CreateObject succeeded")
+	}
+
+	err = snapshot.DeleteObject(ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	if err == nil {
+		t.Errorf("DeleteObject succeeded")
+	}
+
+	if _, err := b.StatObject(ctx, &gcs.StatObjectRequest{Name: "foo"}); err != nil {
+		t.Errorf("StatObject(foo): %v", err)
+	}
+}
+
+func TestSnapshotBucketChecksRunsConcurrently(t *testing.T) {
+	ctx := context.Background()
+	b := gcsfake.NewVersionedFakeBucket(timeutil.RealClock(), "")
+	for _, name := range []string{"a/x", "b/x", "c/x"} {
+		if _, err := gcsutil.CreateObject(ctx, b, name, []byte("")); err != nil {
+			t.Fatalf("CreateObject(%q): %v", name, err)
+		}
+	}
+
+	// Block the listings of the generations beneath each run.
+	started := make(chan struct{}, 100)
+	release := make(chan struct{})
+	snapshot := gcsx.NewSnapshotBucket(
+		&listingBarrierBucket{
+			Bucket: b,
+			blocks: func(req *gcs.ListObjectsRequest) bool {
+				return req.Prefix != ""
+			},
+			started: started,
+			release: release,
+		},
+		time.Now().Add(time.Hour))
+
+	listed := make(chan *gcs.Listing, 1)
+	go func() {
+		listing, _ := snapshot.ListObjects(
+			ctx,
+			&gcs.ListObjectsRequest{Delimiter: "/"})
+
+		listed <- listing
+	}()
+
+	ok := waitForListings(started, 3)
+	close(release)
+	if !ok {
+		t.Fatalf("Timed out waiting for the runs to be listed concurrently")
+	}
+
+	listing := <-listed
+	if listing == nil {
+		t.Fatalf("ListObjects failed")
+	}
+
+	want := []string{"a/", "b/", "c/"}
+	if !reflect.DeepEqual(listing.CollapsedRuns, want) {
+		t.Errorf("CollapsedRuns: got %q, want %q", listing.CollapsedRuns, want)
+	}
+}
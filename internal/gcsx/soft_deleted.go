@@ -0,0 +1,250 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/jacobsa/gcloud/httputil"
+)
+
+// A SoftDeletedObject is a generation of an object that was deleted from a
+// bucket with a soft delete policy, and can be restored until its hard delete
+// time.
+type SoftDeletedObject struct {
+	Name       string
+	Generation int64
+	Size       uint64
+
+	// The time at which the generation was written.
+	Updated time.Time
+
+	// The times at which it was deleted, and after which it can no longer be
+	// restored.
+	SoftDeleteTime time.Time
+	HardDeleteTime time.Time
+}
+
+// SoftDeletedObjects is the interface to the soft-deleted objects of a
+// bucket, which gcs.Bucket doesn't see.
+//
+// Official documentation:
+//     https://cloud.google.com/storage/docs/soft-delete
+type SoftDeletedObjects interface {
+	// List the soft-deleted objects whose names begin with the given prefix,
+	// across every page of results. If delimiter is non-empty, names
+	// containing it after the prefix are collapsed into runs as for
+	// gcs.ListObjectsRequest.
+	ListSoftDeleted(
+		ctx context.Context,
+		prefix string,
+		delimiter string) (objects []*SoftDeletedObject, runs []string, err error)
+
+	// Make the given soft-deleted generation of the named object live again.
+	// If mustNotExist is set, fail with *gcs.PreconditionError if the object
+	// has a live generation, rather than replacing it. Return
+	// *gcs.NotFoundError if there is no such soft-deleted generation.
+	RestoreObject(
+		ctx context.Context,
+		name string,
+		generation int64,
+		mustNotExist bool) (err error)
+}
+
+// NewSoftDeletedObjects creates a SoftDeletedObjects for the named bucket
+// that sends requests with the supplied client, as for NewFolders.
+func NewSoftDeletedObjects(
+	client *http.Client,
+	bucket string) SoftDeletedObjects {
+	return &softDeletedObjects{
+		api: folders{
+			client: client,
+			bucket: bucket,
+		},
+	}
+}
+
+// NewPrefixSoftDeletedObjects is to SoftDeletedObjects what NewPrefixBucket
+// is to gcs.Bucket.
+func NewPrefixSoftDeletedObjects(
+	prefix string,
+	wrapped SoftDeletedObjects) SoftDeletedObjects {
+	return &prefixSoftDeletedObjects{
+		prefix:  prefix,
+		wrapped: wrapped,
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// softDeletedObjects
+////////////////////////////////////////////////////////////////////////
+
+type softDeletedObjects struct {
+	// Requests are made just as they are for folders.
+	api folders
+}
+
+type softDeletedListing struct {
+	Items         []softDeletedResource `json:"items"`
+	Prefixes      []string              `json:"prefixes"`
+	NextPageToken string                `json:"nextPageToken"`
+}
+
+type softDeletedResource struct {
+	Name           string `json:"name"`
+	Generation     int64  `json:"generation,string"`
+	Size           uint64 `json:"size,string"`
+	Updated        string `json:"updated"`
+	SoftDeleteTime string `json:"softDeleteTime"`
+	HardDeleteTime string `json:"hardDeleteTime"`
+}
+
+func (r *softDeletedResource) toSoftDeletedObject() (
+	o *SoftDeletedObject,
+	err error) {
+	o = &SoftDeletedObject{
+		Name:       r.Name,
+		Generation: r.Generation,
+		Size:       r.Size,
+	}
+
+	times := []struct {
+		name string
+		s    string
+		t    *time.Time
+	}{
+		{"updated", r.Updated, &o.Updated},
+		{"softDeleteTime", r.SoftDeleteTime, &o.SoftDeleteTime},
+		{"hardDeleteTime", r.HardDeleteTime, &o.HardDeleteTime},
+	}
+
+	for _, t := range times {
+		*t.t, err = time.Parse(time.RFC3339, t.s)
+		if err != nil {
+			err = fmt.Errorf("Parsing %s: %v", t.name, err)
+			return
+		}
+	}
+
+	return
+}
+
+func (s *softDeletedObjects) ListSoftDeleted(
+	ctx context.Context,
+	prefix string,
+	delimiter string) (objects []*SoftDeletedObject, runs []string, err error) {
+	query := make(url.Values)
+	query.Set("softDeleted", "true")
+	query.Set("prefix", prefix)
+	query.Set(
+		"fields",
+		"items(name,generation,size,updated,softDeleteTime,hardDeleteTime),"+
+			"prefixes,nextPageToken")
+
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+
+	for {
+		var resp softDeletedListing
+		err = s.api.call(ctx, "GET", "/o", query.Encode(), nil, &resp)
+		if err != nil {
+			return
+		}
+
+		for i := range resp.Items {
+			var o *SoftDeletedObject
+			o, err = resp.Items[i].toSoftDeletedObject()
+			if err != nil {
+				return
+			}
+
+			objects = append(objects, o)
+		}
+
+		runs = append(runs, resp.Prefixes...)
+
+		if resp.NextPageToken == "" {
+			return
+		}
+
+		query.Set("pageToken", resp.NextPageToken)
+	}
+}
+
+func (s *softDeletedObjects) RestoreObject(
+	ctx context.Context,
+	name string,
+	generation int64,
+	mustNotExist bool) (err error) {
+	query := make(url.Values)
+	query.Set("generation", fmt.Sprint(generation))
+	query.Set("fields", "name")
+
+	if mustNotExist {
+		query.Set("ifGenerationMatch", "0")
+	}
+
+	err = s.api.call(
+		ctx,
+		"POST",
+		"/o/"+httputil.EncodePathSegment(name)+"/restore",
+		query.Encode(),
+		nil,
+		nil)
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// prefixSoftDeletedObjects
+////////////////////////////////////////////////////////////////////////
+
+type prefixSoftDeletedObjects struct {
+	prefix  string
+	wrapped SoftDeletedObjects
+}
+
+func (s *prefixSoftDeletedObjects) ListSoftDeleted(
+	ctx context.Context,
+	prefix string,
+	delimiter string) (objects []*SoftDeletedObject, runs []string, err error) {
+	objects, runs, err = s.wrapped.ListSoftDeleted(ctx, s.prefix+prefix, delimiter)
+
+	for _, o := range objects {
+		o.Name = strings.TrimPrefix(o.Name, s.prefix)
+	}
+
+	for i, r := range runs {
+		runs[i] = strings.TrimPrefix(r, s.prefix)
+	}
+
+	return
+}
+
+func (s *prefixSoftDeletedObjects) RestoreObject(
+	ctx context.Context,
+	name string,
+	generation int64,
+	mustNotExist bool) (err error) {
+	err = s.wrapped.RestoreObject(ctx, s.prefix+name, generation, mustNotExist)
+	return
+}
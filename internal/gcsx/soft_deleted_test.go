@@ -0,0 +1,242 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/httputil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestSoftDeleted(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A fake of the soft delete operations of the GCS JSON API for a single
+// bucket named "some-bucket", holding soft-deleted generations by name and
+// the names of live objects. Listings return one object per page.
+type fakeSoftDeleteServer struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	deleted map[string]int64
+	live    map[string]bool
+}
+
+func (f *fakeSoftDeleteServer) ServeHTTP(
+	w http.ResponseWriter,
+	r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	const root = "/storage/v1/b/some-bucket/o"
+	p := r.URL.EscapedPath()
+	q := r.URL.Query()
+
+	var resp interface{}
+	switch {
+	case r.Method == "GET" && p == root && q.Get("softDeleted") == "true":
+		var names []string
+		var runs []string
+		seen := make(map[string]bool)
+		for n := range f.deleted {
+			if !strings.HasPrefix(n, q.Get("prefix")) {
+				continue
+			}
+
+			rest := n[len(q.Get("prefix")):]
+			if d := q.Get("delimiter"); d != "" && strings.Contains(rest, d) {
+				run := n[:len(n)-len(rest)] + rest[:strings.Index(rest, d)+1]
+				if !seen[run] {
+					seen[run] = true
+					runs = append(runs, run)
+				}
+
+				continue
+			}
+
+			names = append(names, n)
+		}
+
+		sort.Strings(names)
+		listing := map[string]interface{}{"prefixes": runs}
+
+		var i int
+		fmt.Sscan(q.Get("pageToken"), &i)
+		if i < len(names) {
+			n := names[i]
+			listing["items"] = []map[string]string{
+				{
+					"name":           n,
+					"generation":     fmt.Sprint(f.deleted[n]),
+					"size":           "17",
+					"updated":        folderTime,
+					"softDeleteTime": folderTime,
+					"hardDeleteTime": "2016-01-09T03:04:05.678Z",
+				},
+			}
+		}
+
+		if i+1 < len(names) {
+			listing["nextPageToken"] = fmt.Sprint(i + 1)
+		}
+
+		resp = listing
+
+	case r.Method == "POST" &&
+		strings.HasPrefix(p, root+"/") &&
+		strings.HasSuffix(p, "/restore"):
+		name, _ := url.PathUnescape(
+			strings.TrimSuffix(strings.TrimPrefix(p, root+"/"), "/restore"))
+
+		if fmt.Sprint(f.deleted[name]) != q.Get("generation") {
+			http.NotFound(w, r)
+			return
+		}
+
+		if f.live[name] && q.Get("ifGenerationMatch") == "0" {
+			http.Error(w, "exists", http.StatusPreconditionFailed)
+			return
+		}
+
+		delete(f.deleted, name)
+		f.live[name] = true
+		resp = map[string]string{"name": name}
+
+	default:
+		http.Error(w, fmt.Sprintf("unexpected %s %s", r.Method, p), 400)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+type SoftDeletedTest struct {
+	ctx     context.Context
+	fake    fakeSoftDeleteServer
+	server  *httptest.Server
+	deleted gcsx.SoftDeletedObjects
+}
+
+var _ SetUpInterface = &SoftDeletedTest{}
+var _ TearDownInterface = &SoftDeletedTest{}
+
+func init() { RegisterTestSuite(&SoftDeletedTest{}) }
+
+func (t *SoftDeletedTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.fake.deleted = make(map[string]int64)
+	t.fake.live = make(map[string]bool)
+	t.server = httptest.NewServer(&t.fake)
+
+	endpoint, err := gcsx.ParseEndpoint(t.server.URL, "http")
+	AssertEq(nil, err)
+
+	client := &http.Client{
+		Transport: gcsx.NewEndpointTransport(
+			endpoint,
+			http.DefaultTransport.(httputil.CancellableRoundTripper)),
+	}
+
+	t.deleted = gcsx.NewSoftDeletedObjects(client, "some-bucket")
+}
+
+func (t *SoftDeletedTest) TearDown() {
+	t.server.Close()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *SoftDeletedTest) ListFollowsPages() {
+	t.fake.deleted["foo"] = 17
+	t.fake.deleted["bar"] = 19
+	t.fake.deleted["baz/qux"] = 23
+
+	objects, runs, err := t.deleted.ListSoftDeleted(t.ctx, "", "/")
+	AssertEq(nil, err)
+	AssertEq(2, len(objects))
+
+	ExpectEq("bar", objects[0].Name)
+	ExpectEq(19, objects[0].Generation)
+	ExpectEq(17, objects[0].Size)
+	ExpectEq(2016, objects[0].Updated.Year())
+	ExpectEq(2, objects[0].SoftDeleteTime.Day())
+	ExpectEq(9, objects[0].HardDeleteTime.Day())
+	ExpectEq("foo", objects[1].Name)
+
+	ExpectThat(runs, Contains("baz/"))
+}
+
+func (t *SoftDeletedTest) Restore() {
+	t.fake.deleted["foo"] = 17
+
+	err := t.deleted.RestoreObject(t.ctx, "foo", 17, true)
+	AssertEq(nil, err)
+	ExpectTrue(t.fake.live["foo"])
+
+	objects, _, err := t.deleted.ListSoftDeleted(t.ctx, "", "")
+	AssertEq(nil, err)
+	ExpectEq(0, len(objects))
+}
+
+func (t *SoftDeletedTest) RestoreMissing() {
+	err := t.deleted.RestoreObject(t.ctx, "foo", 17, false)
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *SoftDeletedTest) RestoreOverLiveObject() {
+	t.fake.deleted["foo"] = 17
+	t.fake.live["foo"] = true
+
+	err := t.deleted.RestoreObject(t.ctx, "foo", 17, true)
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+
+	err = t.deleted.RestoreObject(t.ctx, "foo", 17, false)
+	ExpectEq(nil, err)
+}
+
+func (t *SoftDeletedTest) Prefix() {
+	t.fake.deleted["some/dir/foo"] = 17
+	t.fake.deleted["other"] = 19
+	deleted := gcsx.NewPrefixSoftDeletedObjects("some/dir/", t.deleted)
+
+	objects, _, err := deleted.ListSoftDeleted(t.ctx, "", "")
+	AssertEq(nil, err)
+	AssertEq(1, len(objects))
+	ExpectEq("foo", objects[0].Name)
+
+	err = deleted.RestoreObject(t.ctx, "foo", 17, true)
+	AssertEq(nil, err)
+	ExpectTrue(t.fake.live["some/dir/foo"])
+}
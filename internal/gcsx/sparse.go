@@ -0,0 +1,534 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fsutil"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+// SparseExtentsMetadataKey objects may be created by Syncer.SyncObject with a
+// metadata field with this key, listing ranges of the content known to be
+// zero ("holes") as comma-separated "offset+length" pairs in decimal. The
+// object's contents include the zeros as usual; the list only allows readers
+// to skip fetching and storing them.
+const SparseExtentsMetadataKey = "gcsfuse_sparse_extents"
+
+// The shortest run of zeros worth recording, and the granularity at which runs
+// are found.
+const (
+	MinSparseHole   = 1 << 20
+	sparseChunkSize = 1 << 16
+)
+
+// The most holes we record, keeping the metadata well within GCS's limit of
+// 8 KiB for all custom metadata.
+const maxSparseHoles = 256
+
+// An Extent is a range of bytes [Offset, Offset+Length) within some content.
+type Extent struct {
+	Offset int64
+	Length int64
+}
+
+// FindHoles returns the runs of zeros at least MinSparseHole bytes long in the
+// first size bytes of r, in order. If there are too many to record, only the
+// longest are returned.
+func FindHoles(r io.ReaderAt, size int64) (holes []Extent, err error) {
+	buf := make([]byte, sparseChunkSize)
+
+	// The start of the run of zero chunks ending at the current offset, or -1.
+	runStart := int64(-1)
+	endRun := func(end int64) {
+		if runStart >= 0 && end-runStart >= MinSparseHole {
+			holes = append(holes, Extent{runStart, end - runStart})
+		}
+
+		runStart = -1
+	}
+
+	for off := int64(0); off < size; off += sparseChunkSize {
+		n := size - off
+		if n > sparseChunkSize {
+			n = sparseChunkSize
+		}
+
+		_, err = r.ReadAt(buf[:n], off)
+		if err == io.EOF {
+			err = nil
+		}
+
+		if err != nil {
+			err = fmt.Errorf("ReadAt: %v", err)
+			return
+		}
+
+		if isZero(buf[:n]) {
+			if runStart < 0 {
+				runStart = off
+			}
+		} else {
+			endRun(off)
+		}
+	}
+
+	endRun(size)
+
+	// Keep the longest holes if there are too many, then restore the order.
+	if len(holes) > maxSparseHoles {
+		sort.Sort(byLengthDescending(holes))
+		holes = holes[:maxSparseHoles]
+		sort.Sort(byOffset(holes))
+	}
+
+	return
+}
+
+// FormatExtents formats extents for SparseExtentsMetadataKey.
+func FormatExtents(extents []Extent) string {
+	var parts []string
+	for _, e := range extents {
+		parts = append(parts, fmt.Sprintf("%d+%d", e.Offset, e.Length))
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// ParseExtents parses the value of SparseExtentsMetadataKey for an object of
+// the given size, returning an error if the extents are malformed, out of
+// order, overlapping, or extend beyond the object.
+func ParseExtents(s string, size int64) (extents []Extent, err error) {
+	if s == "" {
+		return
+	}
+
+	var prevEnd int64
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.Split(part, "+")
+		if len(fields) != 2 {
+			err = fmt.Errorf("Malformed extent %q", part)
+			return
+		}
+
+		var e Extent
+		e.Offset, err = strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			err = fmt.Errorf("Malformed extent %q: %v", part, err)
+			return
+		}
+
+		e.Length, err = strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			err = fmt.Errorf("Malformed extent %q: %v", part, err)
+			return
+		}
+
+		if e.Offset < prevEnd || e.Length <= 0 || e.Length > size-e.Offset {
+			err = fmt.Errorf("Illegal extent %q for size %d", part, size)
+			return
+		}
+
+		prevEnd = e.Offset + e.Length
+		extents = append(extents, e)
+	}
+
+	return
+}
+
+// DataExtents returns the ranges of content of the given size that lie outside
+// the supplied holes, which must be in order and not overlap.
+func DataExtents(holes []Extent, size int64) (data []Extent) {
+	var start int64
+	for _, h := range holes {
+		if h.Offset > start {
+			data = append(data, Extent{start, h.Offset - start})
+		}
+
+		start = h.Offset + h.Length
+	}
+
+	if size > start {
+		data = append(data, Extent{start, size - start})
+	}
+
+	return
+}
+
+// SeekExtents finds the next data or hole at or after offset in content of the
+// given size whose data lies in the supplied extents, which must be in order
+// and neither overlap nor adjoin. It has the semantics of TempFile.SeekData.
+func SeekExtents(
+	data []Extent,
+	size int64,
+	offset int64,
+	hole bool) (off int64, err error) {
+	if offset < 0 || offset >= size {
+		err = syscall.ENXIO
+		return
+	}
+
+	for _, e := range data {
+		end := e.Offset + e.Length
+		if end <= offset {
+			continue
+		}
+
+		// Data runs from the start of the extent, or from the offset if that is
+		// within it, until its end, where there must be a hole.
+		switch {
+		case hole && e.Offset > offset:
+			off = offset
+
+		case hole:
+			off = minInt64(end, size)
+
+		default:
+			if e.Offset > offset {
+				offset = e.Offset
+			}
+
+			if offset >= size {
+				err = syscall.ENXIO
+				return
+			}
+
+			off = offset
+		}
+
+		return
+	}
+
+	// There is nothing but hole from the offset to the end.
+	if !hole {
+		err = syscall.ENXIO
+		return
+	}
+
+	off = offset
+	return
+}
+
+// Add [start, limit) to the supplied extents, in the form SeekExtents
+// requires, merging it with any that overlap or adjoin it.
+func addExtent(extents []Extent, start int64, limit int64) []Extent {
+	if start >= limit {
+		return extents
+	}
+
+	// Writing sequentially extends or follows the last extent.
+	if n := len(extents); n > 0 {
+		last := &extents[n-1]
+		end := last.Offset + last.Length
+		switch {
+		case start > end:
+			return append(extents, Extent{start, limit - start})
+
+		case start >= last.Offset:
+			if limit > end {
+				last.Length = limit - last.Offset
+			}
+
+			return extents
+		}
+	}
+
+	var result []Extent
+	for _, e := range extents {
+		end := e.Offset + e.Length
+		switch {
+		case end < start || e.Offset > limit:
+			result = append(result, e)
+
+		default:
+			start = minInt64(start, e.Offset)
+			if end > limit {
+				limit = end
+			}
+		}
+	}
+
+	// Insert the merged extent in order.
+	i := sort.Search(len(result), func(i int) bool {
+		return result[i].Offset > start
+	})
+
+	result = append(result, Extent{})
+	copy(result[i+1:], result[i:])
+	result[i] = Extent{start, limit - start}
+
+	return result
+}
+
+// Drop the parts of the supplied extents at or beyond n.
+func clipExtents(extents []Extent, n int64) []Extent {
+	for i, e := range extents {
+		if e.Offset >= n {
+			return extents[:i]
+		}
+
+		if e.Offset+e.Length > n {
+			extents[i].Length = n - e.Offset
+			return extents[:i+1]
+		}
+	}
+
+	return extents
+}
+
+// NewSparseTempFile creates a temp file with the contents of the given object
+// generation, which are known to be zero within the given holes (as returned
+// by ParseExtents). Only the other ranges are read from the bucket, and the
+// holes are left unallocated in the local file, though space is reserved for
+// the file's full size as with NewTempFile.
+func NewSparseTempFile(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	o *gcs.Object,
+	holes []Extent,
+	space *TempSpace,
+	clock timeutil.Clock) (tf TempFile, err error) {
+	size := int64(o.Size)
+	err = space.Reserve(size)
+	if err != nil {
+		return
+	}
+
+	f, err := fsutil.AnonymousFile(space.Dir())
+	if err != nil {
+		space.Release(size)
+		err = fmt.Errorf("AnonymousFile: %v", err)
+		return
+	}
+
+	// Clean up if we fail below.
+	defer func() {
+		if err != nil {
+			f.Close()
+			space.Release(size)
+		}
+	}()
+
+	err = f.Truncate(size)
+	if err != nil {
+		err = fmt.Errorf("Truncate: %v", err)
+		return
+	}
+
+	// Fill in the data between the holes.
+	var start int64
+	for _, h := range holes {
+		if h.Offset > start {
+			err = readRange(ctx, bucket, o, start, h.Offset, f)
+			if err != nil {
+				return
+			}
+		}
+
+		start = h.Offset + h.Length
+	}
+
+	if size > start {
+		err = readRange(ctx, bucket, o, start, size, f)
+		if err != nil {
+			return
+		}
+	}
+
+	tf = &tempFile{
+		clock:          clock,
+		space:          space,
+		f:              f,
+		reserved:       size,
+		dirtyThreshold: size,
+		data:           DataExtents(holes, size),
+	}
+
+	return
+}
+
+// Copy [start, limit) of the object generation to the same range of w.
+func readRange(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	o *gcs.Object,
+	start int64,
+	limit int64,
+	w io.WriteSeeker) (err error) {
+	rc, err := bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:       o.Name,
+			Generation: o.Generation,
+			Range: &gcs.ByteRange{
+				Start: uint64(start),
+				Limit: uint64(limit),
+			},
+		})
+
+	if err != nil {
+		err = fmt.Errorf("NewReader: %v", err)
+		return
+	}
+
+	defer rc.Close()
+
+	_, err = w.Seek(start, 0)
+	if err != nil {
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	n, err := io.Copy(w, rc)
+	if err != nil {
+		err = fmt.Errorf("Copy: %v", err)
+		return
+	}
+
+	if n != limit-start {
+		err = fmt.Errorf("Read %d bytes for range [%d, %d)", n, start, limit)
+		return
+	}
+
+	return
+}
+
+// NewSparseReader wraps a random reader for an object known to be zero within
+// the given holes (as returned by ParseExtents), so that reads within them are
+// served as zeros without contacting GCS.
+func NewSparseReader(
+	wrapped RandomReader,
+	holes []Extent) (rr RandomReader) {
+	rr = &sparseReader{
+		wrapped: wrapped,
+		holes:   holes,
+	}
+
+	return
+}
+
+type sparseReader struct {
+	wrapped RandomReader
+	holes   []Extent
+}
+
+func (sr *sparseReader) CheckInvariants() {
+	sr.wrapped.CheckInvariants()
+}
+
+func (sr *sparseReader) ReadAt(
+	ctx context.Context,
+	p []byte,
+	offset int64) (n int, err error) {
+	size := int64(sr.wrapped.Object().Size)
+	for len(p) > 0 {
+		if offset >= size {
+			err = io.EOF
+			return
+		}
+
+		// Find the hole containing the offset, or else the next one.
+		i := sort.Search(len(sr.holes), func(i int) bool {
+			return sr.holes[i].Offset+sr.holes[i].Length > offset
+		})
+
+		limit := size
+		if i < len(sr.holes) {
+			limit = sr.holes[i].Offset
+		}
+
+		// Serve zeros up to the end of a hole, or else read up to the start of
+		// the next.
+		var tmp int
+		if limit <= offset {
+			h := sr.holes[i]
+			tmp = len(p)
+			if int64(tmp) > h.Offset+h.Length-offset {
+				tmp = int(h.Offset + h.Length - offset)
+			}
+
+			for j := range p[:tmp] {
+				p[j] = 0
+			}
+		} else {
+			if int64(len(p)) > limit-offset {
+				tmp, err = sr.wrapped.ReadAt(ctx, p[:limit-offset], offset)
+			} else {
+				tmp, err = sr.wrapped.ReadAt(ctx, p, offset)
+			}
+
+			// Carry on past the end of the range read.
+			if err == io.EOF && offset+int64(tmp) < size {
+				err = io.ErrUnexpectedEOF
+			}
+
+			if err != nil && err != io.EOF {
+				n += tmp
+				return
+			}
+
+			err = nil
+		}
+
+		n += tmp
+		p = p[tmp:]
+		offset += int64(tmp)
+	}
+
+	return
+}
+
+func (sr *sparseReader) Object() (o *gcs.Object) {
+	o = sr.wrapped.Object()
+	return
+}
+
+func (sr *sparseReader) SetHint(h ReadHint) {
+	sr.wrapped.SetHint(h)
+}
+
+func (sr *sparseReader) Destroy() {
+	sr.wrapped.Destroy()
+}
+
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+type byOffset []Extent
+
+func (p byOffset) Len() int           { return len(p) }
+func (p byOffset) Less(i, j int) bool { return p[i].Offset < p[j].Offset }
+func (p byOffset) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+type byLengthDescending []Extent
+
+func (p byLengthDescending) Len() int           { return len(p) }
+func (p byLengthDescending) Less(i, j int) bool { return p[i].Length > p[j].Length }
+func (p byLengthDescending) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
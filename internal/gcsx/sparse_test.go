@@ -0,0 +1,321 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestSparse(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const chunk = 1 << 16
+
+type SparseTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+}
+
+var _ SetUpInterface = &SparseTest{}
+
+func init() { RegisterTestSuite(&SparseTest{}) }
+
+func (t *SparseTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+}
+
+// Return content of the given size that is zero except for a non-zero byte at
+// each of the given offsets.
+func sparseContent(size int, nonZero ...int) (b []byte) {
+	b = make([]byte, size)
+	for _, off := range nonZero {
+		b[off] = 'x'
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *SparseTest) FindHoles_NoHoles() {
+	b := randBytes(4 * chunk)
+
+	holes, err := gcsx.FindHoles(bytes.NewReader(b), int64(len(b)))
+	AssertEq(nil, err)
+	ExpectEq(0, len(holes))
+}
+
+func (t *SparseTest) FindHoles_ShortRun() {
+	// A run of zeros shorter than the minimum isn't recorded.
+	b := sparseContent(gcsx.MinSparseHole, 0, gcsx.MinSparseHole-1)
+
+	holes, err := gcsx.FindHoles(bytes.NewReader(b), int64(len(b)))
+	AssertEq(nil, err)
+	ExpectEq(0, len(holes))
+}
+
+func (t *SparseTest) FindHoles_Middle() {
+	const size = 3 << 20
+	b := sparseContent(size, 17, size-chunk+17)
+
+	holes, err := gcsx.FindHoles(bytes.NewReader(b), size)
+	AssertEq(nil, err)
+	AssertEq(1, len(holes))
+	ExpectTrue(holes[0] == gcsx.Extent{chunk, size - 2*chunk}, "%v", holes)
+}
+
+func (t *SparseTest) FindHoles_Trailing() {
+	// The file size needn't be a multiple of the chunk size.
+	const size = 2<<20 + 17
+	b := sparseContent(size, 0)
+
+	holes, err := gcsx.FindHoles(bytes.NewReader(b), size)
+	AssertEq(nil, err)
+	AssertEq(1, len(holes))
+	ExpectTrue(holes[0] == gcsx.Extent{chunk, size - chunk}, "%v", holes)
+}
+
+func (t *SparseTest) FormatAndParse() {
+	extents := []gcsx.Extent{
+		{0, 1 << 20},
+		{3 << 20, 1 << 21},
+	}
+
+	s := gcsx.FormatExtents(extents)
+	ExpectEq("0+1048576,3145728+2097152", s)
+
+	parsed, err := gcsx.ParseExtents(s, 5<<20)
+	AssertEq(nil, err)
+	ExpectThat(parsed, DeepEquals(extents))
+}
+
+func (t *SparseTest) ParseEmpty() {
+	extents, err := gcsx.ParseExtents("", 17)
+	AssertEq(nil, err)
+	ExpectEq(0, len(extents))
+}
+
+func (t *SparseTest) ParseIllegal() {
+	testCases := []struct {
+		s   string
+		err string
+	}{
+		{"taco", "Malformed"},
+		{"1+2+3", "Malformed"},
+		{"a+2", "Malformed"},
+		{"1+b", "Malformed"},
+		{"-1+2", "Illegal"},
+		{"1+0", "Illegal"},
+		{"10+11", "Illegal"},
+		{"0+5,4+2", "Illegal"},
+		{"5+2,0+2", "Illegal"},
+	}
+
+	for _, tc := range testCases {
+		_, err := gcsx.ParseExtents(tc.s, 20)
+		ExpectThat(err, Error(HasSubstr(tc.err)), "%q", tc.s)
+	}
+}
+
+func (t *SparseTest) SeekExtents() {
+	// Data at [10, 20) and [30, 40) of 50 bytes.
+	data := gcsx.DataExtents([]gcsx.Extent{{0, 10}, {20, 10}, {40, 10}}, 50)
+	AssertThat(data, DeepEquals([]gcsx.Extent{{10, 10}, {30, 10}}))
+
+	testCases := []struct {
+		offset int64
+		hole   bool
+		off    int64
+		err    error
+	}{
+		{0, false, 10, nil},
+		{15, false, 15, nil},
+		{20, false, 30, nil},
+		{40, false, 0, syscall.ENXIO},
+		{50, false, 0, syscall.ENXIO},
+		{0, true, 0, nil},
+		{15, true, 20, nil},
+		{35, true, 40, nil},
+		{45, true, 45, nil},
+		{50, true, 0, syscall.ENXIO},
+		{-1, true, 0, syscall.ENXIO},
+	}
+
+	for _, tc := range testCases {
+		off, err := gcsx.SeekExtents(data, 50, tc.offset, tc.hole)
+		ExpectEq(tc.err, err, "%d %v", tc.offset, tc.hole)
+		if err == nil {
+			ExpectEq(tc.off, off, "%d %v", tc.offset, tc.hole)
+		}
+	}
+
+	// Data running to the end is followed by a hole there.
+	off, err := gcsx.SeekExtents(gcsx.DataExtents(nil, 50), 50, 5, true)
+	AssertEq(nil, err)
+	ExpectEq(50, off)
+}
+
+func (t *SparseTest) SparseReader() {
+	const size = 3 * chunk
+	contents := randBytes(size)
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", contents)
+	AssertEq(nil, err)
+
+	rr, err := gcsx.NewRandomReader(o, t.bucket, nil)
+	AssertEq(nil, err)
+
+	// The recorded hole is trusted, so reads within it return zeros rather than
+	// what the object holds.
+	rr = gcsx.NewSparseReader(rr, []gcsx.Extent{{chunk, chunk}})
+	defer rr.Destroy()
+
+	expected := append([]byte{}, contents...)
+	copy(expected[chunk:2*chunk], make([]byte, chunk))
+
+	actual := make([]byte, size)
+	n, err := rr.ReadAt(t.ctx, actual, 0)
+	AssertEq(nil, err)
+	AssertEq(size, n)
+	ExpectTrue(bytes.Equal(expected, actual))
+
+	// Within the hole and straddling its end.
+	n, err = rr.ReadAt(t.ctx, actual[:chunk], chunk+1)
+	AssertEq(nil, err)
+	AssertEq(chunk, n)
+	ExpectTrue(bytes.Equal(expected[chunk+1:2*chunk+1], actual[:chunk]))
+
+	// Past the end.
+	n, err = rr.ReadAt(t.ctx, actual[:2], size-1)
+	ExpectEq(io.EOF, err)
+	ExpectEq(1, n)
+	ExpectEq(contents[size-1], actual[0])
+}
+
+func (t *SparseTest) NewSparseTempFile() {
+	const size = 3<<20 + 17
+	contents := sparseContent(size, 0, 1<<20+3, size-1)
+	copy(contents[2<<20:], randBytes(chunk))
+
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", contents)
+	AssertEq(nil, err)
+
+	holes := []gcsx.Extent{
+		{chunk, 1<<20 - chunk},
+		{2<<20 + chunk, 1<<20 - chunk},
+	}
+
+	tf, err := gcsx.NewSparseTempFile(t.ctx, t.bucket, o, holes, nil, &t.clock)
+	AssertEq(nil, err)
+	defer tf.Destroy()
+
+	// The contents should be intact and clean.
+	sr, err := tf.Stat()
+	AssertEq(nil, err)
+	ExpectEq(size, sr.Size)
+	ExpectEq(size, sr.DirtyThreshold)
+	ExpectEq(nil, sr.Mtime)
+
+	actual := make([]byte, size)
+	_, err = tf.ReadAt(actual, 0)
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(contents, actual))
+
+	// The holes should be reported as such.
+	off, err := tf.SeekData(chunk, true)
+	AssertEq(nil, err)
+	ExpectEq(chunk, off)
+
+	off, err = tf.SeekData(chunk, false)
+	AssertEq(nil, err)
+	ExpectEq(1<<20, off)
+
+	off, err = tf.SeekData(2<<20+chunk, false)
+	AssertEq(nil, err)
+	ExpectEq(3<<20, off)
+}
+
+func (t *SparseTest) NewSparseTempFile_ObjectChanged() {
+	contents := sparseContent(2<<20, 0)
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", contents)
+	AssertEq(nil, err)
+
+	// Replace the object. Reading the old generation should fail.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", contents)
+	AssertEq(nil, err)
+
+	holes := []gcsx.Extent{{chunk, 1 << 20}}
+	_, err = gcsx.NewSparseTempFile(t.ctx, t.bucket, o, holes, nil, &t.clock)
+	ExpectThat(err, Error(HasSubstr("not found")))
+}
+
+func (t *SparseTest) SyncerRecordsHoles() {
+	const size = 3 << 20
+
+	// Make sure the contents are written in full, rather than appended.
+	const appendThreshold = 1 << 30
+	syncer := gcsx.NewSyncer(appendThreshold, ".gcsfuse_tmp/", true, 0, 0, t.bucket)
+
+	// Create a source object and a dirty temp file whose contents have a hole.
+	src, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	tf, err := gcsx.NewTempFile(
+		bytes.NewReader([]byte("taco")), nil, &t.clock)
+
+	AssertEq(nil, err)
+	defer tf.Destroy()
+
+	err = tf.Truncate(size)
+	AssertEq(nil, err)
+
+	_, err = tf.WriteAt([]byte("burrito"), size-7)
+	AssertEq(nil, err)
+
+	// Sync. The hole should be recorded, and the contents written in full.
+	o, err := syncer.SyncObject(t.ctx, src, tf)
+	AssertEq(nil, err)
+	ExpectEq(size, o.Size)
+	ExpectEq(
+		gcsx.FormatExtents([]gcsx.Extent{{chunk, size - 2*chunk}}),
+		o.Metadata[gcsx.SparseExtentsMetadataKey])
+
+	actual, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(actual[:4]))
+	ExpectTrue(bytes.Equal(sparseContent(size-11), actual[4:size-7]))
+	ExpectEq("burrito", string(actual[size-7:]))
+}
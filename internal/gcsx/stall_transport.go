@@ -0,0 +1,157 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jacobsa/gcloud/httputil"
+	"golang.org/x/net/context"
+)
+
+// NewStallDetectingTransport wraps a transport such that a response body that
+// yields no bytes for the given time while being read is aborted, cancelling
+// the request to tear down its connection. The read fails with a
+// *net.OpError, which package gcs treats like a connection dropped by the
+// server: it retries, resuming an object read from the byte at which it
+// stopped. Time between reads doesn't count.
+//
+// This catches connections that have died without either end noticing, which
+// would otherwise leave a read blocked until the kernel gives up on them,
+// often many minutes later.
+func NewStallDetectingTransport(
+	wrapped httputil.CancellableRoundTripper,
+	timeout time.Duration) (t httputil.CancellableRoundTripper) {
+	t = &stallDetectingTransport{
+		wrapped:  wrapped,
+		timeout:  timeout,
+		modified: make(map[*http.Request]*http.Request),
+	}
+
+	return
+}
+
+type stallDetectingTransport struct {
+	wrapped httputil.CancellableRoundTripper
+	timeout time.Duration
+
+	mu sync.Mutex
+
+	// The modified request for each request in flight, so that we can cancel
+	// the right one.
+	//
+	// GUARDED_BY(mu)
+	modified map[*http.Request]*http.Request
+}
+
+func (t *stallDetectingTransport) RoundTrip(
+	req *http.Request) (resp *http.Response, err error) {
+	// Give the request a context of its own that we can cancel, without
+	// modifying the caller's request, per the RoundTripper contract.
+	ctx, cancel := context.WithCancel(req.Context())
+	modified := req.WithContext(ctx)
+
+	t.mu.Lock()
+	t.modified[req] = modified
+	t.mu.Unlock()
+
+	resp, err = t.wrapped.RoundTrip(modified)
+	if err != nil {
+		t.forget(req)
+		cancel()
+		return
+	}
+
+	body := &stallDetectingBody{
+		wrapped: resp.Body,
+		timeout: t.timeout,
+		cancel:  cancel,
+		forget:  func() { t.forget(req) },
+	}
+
+	body.timer = time.AfterFunc(t.timeout, func() {
+		atomic.StoreInt32(&body.stalled, 1)
+		cancel()
+	})
+
+	body.timer.Stop()
+	resp.Body = body
+
+	return
+}
+
+func (t *stallDetectingTransport) CancelRequest(req *http.Request) {
+	t.mu.Lock()
+	modified := t.modified[req]
+	t.mu.Unlock()
+
+	if modified == nil {
+		modified = req
+	}
+
+	t.wrapped.CancelRequest(modified)
+}
+
+func (t *stallDetectingTransport) forget(req *http.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.modified, req)
+}
+
+// A response body whose request is cancelled if a read takes too long.
+type stallDetectingBody struct {
+	wrapped io.ReadCloser
+	timeout time.Duration
+	cancel  func()
+	forget  func()
+	timer   *time.Timer
+
+	// Set to one when a read has stalled.
+	//
+	// Accessed atomically.
+	stalled int32
+}
+
+func (b *stallDetectingBody) Read(p []byte) (n int, err error) {
+	b.timer.Reset(b.timeout)
+	n, err = b.wrapped.Read(p)
+	b.timer.Stop()
+
+	// Package gcs retries network errors.
+	if err != nil && err != io.EOF && atomic.LoadInt32(&b.stalled) != 0 {
+		err = &net.OpError{
+			Op:  "read",
+			Net: "tcp",
+			Err: fmt.Errorf("no data received for %v", b.timeout),
+		}
+	}
+
+	return
+}
+
+func (b *stallDetectingBody) Close() (err error) {
+	b.timer.Stop()
+	err = b.wrapped.Close()
+	b.cancel()
+	b.forget()
+	return
+}
@@ -0,0 +1,144 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestStallDetectingTransport(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const stallTimeout = 50 * time.Millisecond
+
+type StallDetectingTransportTest struct {
+	server *httptest.Server
+	client *http.Client
+
+	// The handler for the server's requests.
+	handle func(w http.ResponseWriter, r *http.Request)
+}
+
+var _ SetUpInterface = &StallDetectingTransportTest{}
+var _ TearDownInterface = &StallDetectingTransportTest{}
+
+func init() { RegisterTestSuite(&StallDetectingTransportTest{}) }
+
+func (t *StallDetectingTransportTest) SetUp(ti *TestInfo) {
+	t.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			t.handle(w, r)
+		}))
+
+	t.client = &http.Client{
+		Transport: gcsx.NewStallDetectingTransport(
+			&http.Transport{},
+			stallTimeout),
+	}
+}
+
+func (t *StallDetectingTransportTest) TearDown() {
+	t.server.Close()
+}
+
+// Write the given chunks to the response, pausing for the given time before
+// each.
+func writeSlowly(
+	w http.ResponseWriter,
+	pause time.Duration,
+	chunks ...string) {
+	for _, c := range chunks {
+		time.Sleep(pause)
+		io.WriteString(w, c)
+		w.(http.Flusher).Flush()
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StallDetectingTransportTest) StalledBody() {
+	t.handle = func(w http.ResponseWriter, r *http.Request) {
+		writeSlowly(w, 0, "taco")
+
+		// Hang until the client gives up.
+		<-r.Context().Done()
+	}
+
+	resp, err := t.client.Get(t.server.URL)
+	AssertEq(nil, err)
+	defer resp.Body.Close()
+
+	p := make([]byte, 4)
+	_, err = io.ReadFull(resp.Body, p)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(p))
+
+	start := time.Now()
+	_, err = resp.Body.Read(p)
+	ExpectThat(err, Error(HasSubstr("no data received for 50ms")))
+	ExpectThat(time.Since(start), LessThan(5*time.Second))
+
+	_, ok := err.(*net.OpError)
+	ExpectTrue(ok)
+}
+
+func (t *StallDetectingTransportTest) SlowButSteadyBody() {
+	t.handle = func(w http.ResponseWriter, r *http.Request) {
+		writeSlowly(w, stallTimeout/2, "ta", "co", "s")
+	}
+
+	resp, err := t.client.Get(t.server.URL)
+	AssertEq(nil, err)
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	AssertEq(nil, err)
+	ExpectEq("tacos", string(contents))
+}
+
+func (t *StallDetectingTransportTest) TimeBetweenReadsDoesntCount() {
+	t.handle = func(w http.ResponseWriter, r *http.Request) {
+		writeSlowly(w, 0, "taco", "s")
+	}
+
+	resp, err := t.client.Get(t.server.URL)
+	AssertEq(nil, err)
+	defer resp.Body.Close()
+
+	p := make([]byte, 1)
+	_, err = io.ReadFull(resp.Body, p)
+	AssertEq(nil, err)
+
+	time.Sleep(2 * stallTimeout)
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	AssertEq(nil, err)
+	ExpectEq("acos", string(contents))
+}
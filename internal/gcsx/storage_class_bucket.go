@@ -0,0 +1,83 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"strings"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// NewStorageClassBucket creates a wrapper bucket that sets the storage class
+// of newly created or composed objects when one is not already set. An object
+// whose name starts with a key of prefixClasses gets the class for the longest
+// such key, and any other gets defaultClass, which may be empty to leave the
+// choice to the bucket.
+func NewStorageClassBucket(
+	b gcs.Bucket,
+	defaultClass string,
+	prefixClasses map[string]string) gcs.Bucket {
+	return storageClassBucket{
+		Bucket:        b,
+		defaultClass:  defaultClass,
+		prefixClasses: prefixClasses,
+	}
+}
+
+type storageClassBucket struct {
+	gcs.Bucket
+	defaultClass  string
+	prefixClasses map[string]string
+}
+
+// Return the storage class for new objects with the given name.
+func (b storageClassBucket) class(name string) (class string) {
+	class = b.defaultClass
+
+	var longest string
+	for prefix, c := range b.prefixClasses {
+		if strings.HasPrefix(name, prefix) && len(prefix) >= len(longest) {
+			longest = prefix
+			class = c
+		}
+	}
+
+	return
+}
+
+func (b storageClassBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if req.StorageClass == "" {
+		req.StorageClass = b.class(req.Name)
+	}
+
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+func (b storageClassBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	// GCS gives a composite object the bucket's default class unless told
+	// otherwise, even when composing over an object of another class.
+	if req.StorageClass == "" {
+		req.StorageClass = b.class(req.DstName)
+	}
+
+	o, err = b.Bucket.ComposeObjects(ctx, req)
+	return
+}
@@ -0,0 +1,149 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+var storageClassBucketPrefixes = map[string]string{
+	"archive/":     "ARCHIVE",
+	"archive/hot/": "STANDARD",
+	"logs/":        "COLDLINE",
+}
+
+var storageClassBucketTestCases = []struct {
+	name         string
+	defaultClass string
+	request      string // StorageClass in request
+	expected     string // Expected final class
+}{
+	/////////////////
+	// No default
+	/////////////////
+
+	0: {
+		name:     "foo",
+		expected: "STANDARD",
+	},
+
+	1: {
+		name:     "logs/foo",
+		expected: "COLDLINE",
+	},
+
+	/////////////////
+	// Default
+	/////////////////
+
+	2: {
+		name:         "foo",
+		defaultClass: "NEARLINE",
+		expected:     "NEARLINE",
+	},
+
+	3: {
+		name:         "archive/foo",
+		defaultClass: "NEARLINE",
+		expected:     "ARCHIVE",
+	},
+
+	4: {
+		name:         "archive/hot/foo",
+		defaultClass: "NEARLINE",
+		expected:     "STANDARD",
+	},
+
+	5: {
+		name:         "foo",
+		defaultClass: "NEARLINE",
+		request:      "COLDLINE",
+		expected:     "COLDLINE",
+	},
+}
+
+func TestStorageClassBucket_CreateObject(t *testing.T) {
+	for i, tc := range storageClassBucketTestCases {
+		// Set up a bucket.
+		bucket := gcsx.NewStorageClassBucket(
+			gcsfake.NewFakeBucket(timeutil.RealClock(), ""),
+			tc.defaultClass,
+			storageClassBucketPrefixes)
+
+		// Create the object.
+		req := &gcs.CreateObjectRequest{
+			Name:         tc.name,
+			StorageClass: tc.request,
+			Contents:     strings.NewReader(""),
+		}
+
+		o, err := bucket.CreateObject(context.Background(), req)
+		if err != nil {
+			t.Fatalf("Test case %d: CreateObject: %v", i, err)
+		}
+
+		// Check the storage class.
+		if got, want := o.StorageClass, tc.expected; got != want {
+			t.Errorf("Test case %d: o.StorageClass is %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestStorageClassBucket_ComposeObjects(t *testing.T) {
+	ctx := context.Background()
+
+	for i, tc := range storageClassBucketTestCases {
+		// Set up a bucket, and a source object created directly in it.
+		fake := gcsfake.NewFakeBucket(timeutil.RealClock(), "")
+		bucket := gcsx.NewStorageClassBucket(
+			fake,
+			tc.defaultClass,
+			storageClassBucketPrefixes)
+
+		const srcName = "some_src"
+		_, err := fake.CreateObject(ctx, &gcs.CreateObjectRequest{
+			Name:     srcName,
+			Contents: strings.NewReader(""),
+		})
+
+		if err != nil {
+			t.Fatalf("Test case %d: CreateObject: %v", i, err)
+		}
+
+		// Compose.
+		req := &gcs.ComposeObjectsRequest{
+			DstName:      tc.name,
+			StorageClass: tc.request,
+			Sources:      []gcs.ComposeSource{{Name: srcName}},
+		}
+
+		o, err := bucket.ComposeObjects(ctx, req)
+		if err != nil {
+			t.Fatalf("Test case %d: ComposeObjects: %v", i, err)
+		}
+
+		// Check the storage class.
+		if got, want := o.StorageClass, tc.expected; got != want {
+			t.Errorf("Test case %d: o.StorageClass is %q, want %q", i, got, want)
+		}
+	}
+}
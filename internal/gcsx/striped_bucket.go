@@ -0,0 +1,172 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+// NewStripedConn creates a connection whose buckets spread their requests
+// across buckets opened with each of the supplied connections, as described
+// for NewStripedBucket. This is useful when each connection has its own HTTP
+// transport, since a single transport's connection limits can cap throughput
+// on hosts with very fast networks.
+func NewStripedConn(conns []gcs.Conn) (c gcs.Conn, err error) {
+	if len(conns) == 0 {
+		err = errors.New("At least one connection is required")
+		return
+	}
+
+	c = &stripedConn{
+		conns: conns,
+	}
+
+	return
+}
+
+type stripedConn struct {
+	conns []gcs.Conn
+}
+
+func (c *stripedConn) OpenBucket(
+	ctx context.Context,
+	options *gcs.OpenBucketOptions) (b gcs.Bucket, err error) {
+	var buckets []gcs.Bucket
+	for i, conn := range c.conns {
+		var bucket gcs.Bucket
+		bucket, err = conn.OpenBucket(ctx, options)
+		if err != nil {
+			err = fmt.Errorf("OpenBucket (connection %d): %v", i, err)
+			return
+		}
+
+		buckets = append(buckets, bucket)
+	}
+
+	b, err = NewStripedBucket(buckets)
+	return
+}
+
+// NewStripedBucket creates a bucket that sends each request to the next of the
+// supplied buckets in turn. The buckets must all refer to the same GCS bucket.
+func NewStripedBucket(buckets []gcs.Bucket) (b gcs.Bucket, err error) {
+	if len(buckets) == 0 {
+		err = errors.New("At least one bucket is required")
+		return
+	}
+
+	// There's no point in striping across a single bucket.
+	if len(buckets) == 1 {
+		b = buckets[0]
+		return
+	}
+
+	for _, bucket := range buckets[1:] {
+		if bucket.Name() != buckets[0].Name() {
+			err = fmt.Errorf(
+				"Bucket names differ: %q vs. %q",
+				bucket.Name(),
+				buckets[0].Name())
+
+			return
+		}
+	}
+
+	b = &stripedBucket{
+		buckets: buckets,
+	}
+
+	return
+}
+
+type stripedBucket struct {
+	buckets []gcs.Bucket
+
+	// The number of requests dispatched so far. Accessed atomically.
+	next uint64
+}
+
+// Choose the bucket for the next request.
+func (b *stripedBucket) pick() gcs.Bucket {
+	n := atomic.AddUint64(&b.next, 1) - 1
+	return b.buckets[n%uint64(len(b.buckets))]
+}
+
+func (b *stripedBucket) Name() string {
+	return b.buckets[0].Name()
+}
+
+func (b *stripedBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	rc, err = b.pick().NewReader(ctx, req)
+	return
+}
+
+func (b *stripedBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.pick().CreateObject(ctx, req)
+	return
+}
+
+func (b *stripedBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.pick().CopyObject(ctx, req)
+	return
+}
+
+func (b *stripedBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	o, err = b.pick().ComposeObjects(ctx, req)
+	return
+}
+
+func (b *stripedBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.pick().StatObject(ctx, req)
+	return
+}
+
+func (b *stripedBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	l, err = b.pick().ListObjects(ctx, req)
+	return
+}
+
+func (b *stripedBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.pick().UpdateObject(ctx, req)
+	return
+}
+
+func (b *stripedBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.pick().DeleteObject(ctx, req)
+	return
+}
@@ -0,0 +1,107 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestStripedBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type StripedBucketTest struct {
+	ctx     context.Context
+	buckets []gcs.Bucket
+	bucket  gcs.Bucket
+}
+
+var _ SetUpInterface = &StripedBucketTest{}
+
+func init() { RegisterTestSuite(&StripedBucketTest{}) }
+
+func (t *StripedBucketTest) SetUp(ti *TestInfo) {
+	var err error
+
+	// Use independent fake buckets, so that we can tell where each request
+	// went.
+	t.ctx = ti.Ctx
+	t.buckets = []gcs.Bucket{
+		gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket"),
+		gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket"),
+	}
+
+	t.bucket, err = gcsx.NewStripedBucket(t.buckets)
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StripedBucketTest) Name() {
+	ExpectEq("some_bucket", t.bucket.Name())
+}
+
+func (t *StripedBucketTest) RoundRobin() {
+	var err error
+
+	// The first request goes to the first bucket.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = t.buckets[0].StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectEq(nil, err)
+
+	// The next goes to the second, and then back to the first.
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectEq(nil, err)
+}
+
+func (t *StripedBucketTest) SingleBucket() {
+	b, err := gcsx.NewStripedBucket(t.buckets[:1])
+	AssertEq(nil, err)
+	ExpectEq(t.buckets[0], b)
+}
+
+func (t *StripedBucketTest) NoBuckets() {
+	_, err := gcsx.NewStripedBucket(nil)
+	ExpectThat(err, Error(HasSubstr("At least one")))
+}
+
+func (t *StripedBucketTest) MismatchedNames() {
+	buckets := []gcs.Bucket{
+		t.buckets[0],
+		gcsfake.NewFakeBucket(timeutil.RealClock(), "other_bucket"),
+	}
+
+	_, err := gcsx.NewStripedBucket(buckets)
+	ExpectThat(err, Error(HasSubstr("names differ")))
+}
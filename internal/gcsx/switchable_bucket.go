@@ -0,0 +1,128 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"io"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+// A SwitchableBucket forwards requests to a bucket that may be replaced at any
+// time, e.g. to change the stat caching or rate limiting wrapped around some
+// underlying bucket without remounting. Requests already in flight continue
+// against the bucket that was current when they began.
+//
+// All buckets switched between must have the same name.
+type SwitchableBucket interface {
+	gcs.Bucket
+
+	// Send future requests to the supplied bucket.
+	Switch(b gcs.Bucket)
+}
+
+// NewSwitchableBucket creates a switchable bucket initially forwarding to the
+// supplied bucket.
+func NewSwitchableBucket(initial gcs.Bucket) (b SwitchableBucket) {
+	b = &switchableBucket{
+		current: initial,
+	}
+
+	return
+}
+
+type switchableBucket struct {
+	mu sync.RWMutex
+
+	// GUARDED_BY(mu)
+	current gcs.Bucket
+}
+
+func (b *switchableBucket) Switch(next gcs.Bucket) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.current = next
+}
+
+func (b *switchableBucket) get() gcs.Bucket {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.current
+}
+
+func (b *switchableBucket) Name() string {
+	return b.get().Name()
+}
+
+func (b *switchableBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	rc, err = b.get().NewReader(ctx, req)
+	return
+}
+
+func (b *switchableBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.get().CreateObject(ctx, req)
+	return
+}
+
+func (b *switchableBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.get().CopyObject(ctx, req)
+	return
+}
+
+func (b *switchableBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	o, err = b.get().ComposeObjects(ctx, req)
+	return
+}
+
+func (b *switchableBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.get().StatObject(ctx, req)
+	return
+}
+
+func (b *switchableBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	l, err = b.get().ListObjects(ctx, req)
+	return
+}
+
+func (b *switchableBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.get().UpdateObject(ctx, req)
+	return
+}
+
+func (b *switchableBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.get().DeleteObject(ctx, req)
+	return
+}
@@ -0,0 +1,87 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestSwitchableBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type SwitchableBucketTest struct {
+	ctx    context.Context
+	first  gcs.Bucket
+	second gcs.Bucket
+	bucket gcsx.SwitchableBucket
+}
+
+var _ SetUpInterface = &SwitchableBucketTest{}
+
+func init() { RegisterTestSuite(&SwitchableBucketTest{}) }
+
+func (t *SwitchableBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.first = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+	t.second = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+	t.bucket = gcsx.NewSwitchableBucket(t.first)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *SwitchableBucketTest) Name() {
+	ExpectEq("some_bucket", t.bucket.Name())
+}
+
+func (t *SwitchableBucketTest) ForwardsToCurrent() {
+	var err error
+
+	// Create an object through the switchable bucket.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = t.first.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectEq(nil, err)
+
+	// Switch, and the second bucket should be the one consulted.
+	t.bucket.Switch(t.second)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "bar", []byte("burrito"))
+	AssertEq(nil, err)
+
+	_, err = t.second.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "bar"})
+	ExpectEq(nil, err)
+
+	_, err = t.first.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "bar"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
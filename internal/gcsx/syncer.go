@@ -17,6 +17,7 @@ package gcsx
 import (
 	"fmt"
 	"io"
+	"strings"
 	"time"
 
 	"github.com/jacobsa/gcloud/gcs"
@@ -44,6 +45,16 @@ type Syncer interface {
 		ctx context.Context,
 		srcObject *gcs.Object,
 		content TempFile) (o *gcs.Object, err error)
+
+	// RewriteObject is like SyncObject, except that it always writes out the
+	// full content rather than composing new bytes onto the source object, for
+	// callers whose content doesn't begin with the source object's bytes. The
+	// new generation is still conditional on the source generation being
+	// current.
+	RewriteObject(
+		ctx context.Context,
+		srcObject *gcs.Object,
+		content TempFile) (o *gcs.Object, err error)
 }
 
 // NewSyncer creates a syncer that syncs into the supplied bucket.
@@ -55,13 +66,37 @@ type Syncer interface {
 // Temporary blobs have names beginning with tmpObjectPrefix. We make an effort
 // to delete them, but if we are interrupted for some reason we may not be able
 // to do so. Therefore the user should arrange for garbage collection.
+//
+// If recordHoles is set, objects written in full record their long runs of
+// zeros under SparseExtentsMetadataKey.
+//
+// If parallelUploads is at least two, contents of at least
+// parallelUploadThreshold bytes written in full are uploaded in that many
+// parts concurrently, as temporary blobs, which are then composed into the
+// new generation.
+//
+// REQUIRES: parallelUploads <= gcs.MaxSourcesPerComposeRequest
 func NewSyncer(
 	appendThreshold int64,
 	tmpObjectPrefix string,
+	recordHoles bool,
+	parallelUploads int,
+	parallelUploadThreshold int64,
 	bucket gcs.Bucket) (os Syncer) {
 	// Create the object creators.
-	fullCreator := &fullObjectCreator{
-		bucket: bucket,
+	full := &fullObjectCreator{
+		bucket:      bucket,
+		recordHoles: recordHoles,
+	}
+
+	var fullCreator objectCreator = full
+	if parallelUploads >= 2 {
+		fullCreator = newParallelObjectCreator(
+			tmpObjectPrefix,
+			parallelUploads,
+			parallelUploadThreshold,
+			full,
+			bucket)
 	}
 
 	appendCreator := newAppendObjectCreator(
@@ -79,7 +114,8 @@ func NewSyncer(
 ////////////////////////////////////////////////////////////////////////
 
 type fullObjectCreator struct {
-	bucket gcs.Bucket
+	bucket      gcs.Bucket
+	recordHoles bool
 }
 
 func (oc *fullObjectCreator) Create(
@@ -92,9 +128,12 @@ func (oc *fullObjectCreator) Create(
 		GenerationPrecondition:     &srcObject.Generation,
 		MetaGenerationPrecondition: &srcObject.MetaGeneration,
 		Contents:                   r,
-		Metadata: map[string]string{
-			MtimeMetadataKey: mtime.Format(time.RFC3339Nano),
-		},
+		ContentEncoding:            srcObject.ContentEncoding,
+	}
+
+	req.Metadata, err = oc.metadata(srcObject, mtime, r)
+	if err != nil {
+		return
 	}
 
 	o, err = oc.bucket.CreateObject(ctx, req)
@@ -111,6 +150,79 @@ func (oc *fullObjectCreator) Create(
 	return
 }
 
+// Return the custom metadata for a new generation of the source object with
+// the supplied contents.
+func (oc *fullObjectCreator) metadata(
+	srcObject *gcs.Object,
+	mtime time.Time,
+	r io.Reader) (m map[string]string, err error) {
+	m = preservedMetadata(srcObject)
+	m[MtimeMetadataKey] = mtime.Format(time.RFC3339Nano)
+
+	// Record runs of zeros, if requested. This requires random access to the
+	// contents, as a TempFile provides.
+	if tf, ok := r.(TempFile); ok && oc.recordHoles {
+		var holes []Extent
+		holes, err = findTempFileHoles(tf)
+		if err != nil {
+			err = fmt.Errorf("findTempFileHoles: %v", err)
+			return
+		}
+
+		if len(holes) > 0 {
+			m[SparseExtentsMetadataKey] = FormatExtents(holes)
+		}
+	}
+
+	return
+}
+
+// Return a copy of the custom metadata of the source object that should
+// survive a change to its contents: everything except the keys that gcsfuse
+// and gsutil use to describe the contents themselves, such as mtimes.
+func preservedMetadata(srcObject *gcs.Object) (m map[string]string) {
+	m = make(map[string]string)
+	for k, v := range srcObject.Metadata {
+		if !IsContentMetadataKey(k) {
+			m[k] = v
+		}
+	}
+
+	return
+}
+
+// IsContentMetadataKey returns true if the given custom metadata key is one
+// that gcsfuse or gsutil maintains to describe an object's contents, rather
+// than the file as a whole.
+func IsContentMetadataKey(k string) bool {
+	return k == MtimeMetadataKey ||
+		k == SparseExtentsMetadataKey ||
+		strings.HasPrefix(k, "goog-reserved-")
+}
+
+// Find the holes in the supplied temp file, leaving its seek position at the
+// start.
+func findTempFileHoles(tf TempFile) (holes []Extent, err error) {
+	sr, err := tf.Stat()
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	holes, err = FindHoles(tf, sr.Size)
+	if err != nil {
+		return
+	}
+
+	_, err = tf.Seek(0, 0)
+	if err != nil {
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	return
+}
+
 ////////////////////////////////////////////////////////////////////////
 // syncer
 ////////////////////////////////////////////////////////////////////////
@@ -160,6 +272,25 @@ func (os *syncer) SyncObject(
 	ctx context.Context,
 	srcObject *gcs.Object,
 	content TempFile) (o *gcs.Object, err error) {
+	o, err = os.sync(ctx, srcObject, content, true)
+	return
+}
+
+func (os *syncer) RewriteObject(
+	ctx context.Context,
+	srcObject *gcs.Object,
+	content TempFile) (o *gcs.Object, err error) {
+	o, err = os.sync(ctx, srcObject, content, false)
+	return
+}
+
+// Write out a new generation for the content if it has been dirtied, composing
+// new bytes onto the source object only if allowAppend is set.
+func (os *syncer) sync(
+	ctx context.Context,
+	srcObject *gcs.Object,
+	content TempFile,
+	allowAppend bool) (o *gcs.Object, err error) {
 	// Stat the content.
 	sr, err := content.Stat()
 	if err != nil {
@@ -197,10 +328,27 @@ func (os *syncer) SyncObject(
 
 	// Otherwise, we need to create a new generation. If the source object is
 	// long enough, hasn't been dirtied, and has a low enough component count,
-	// then we can make the optimization of not rewriting its contents.
-	if srcSize >= os.appendThreshold &&
+	// then we can make the optimization of not rewriting its contents. Not so
+	// for an object with a content encoding, which composing would lose.
+	canAppend := allowAppend &&
 		sr.DirtyThreshold == srcSize &&
-		srcObject.ComponentCount < gcs.MaxComponentCount {
+		srcObject.ComponentCount < gcs.MaxComponentCount &&
+		srcObject.ContentEncoding == ""
+
+	// Content from NewAppendTempFile doesn't hold the source object's contents,
+	// so must be appended whatever the object's size.
+	appendOnly := AppendBase(content) > 0
+	if appendOnly && (AppendBase(content) != srcSize || !canAppend) {
+		err = fmt.Errorf(
+			"Can't append to %q with %d components from offset %d",
+			srcObject.Name,
+			srcObject.ComponentCount,
+			AppendBase(content))
+
+		return
+	}
+
+	if canAppend && (srcSize >= os.appendThreshold || appendOnly) {
 		_, err = content.Seek(srcSize, 0)
 		if err != nil {
 			err = fmt.Errorf("Seek: %v", err)
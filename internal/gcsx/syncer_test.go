@@ -122,7 +122,7 @@ func (t *SyncerTest) SetUp(ti *TestInfo) {
 	// Wrap a TempFile around it.
 	t.content, err = NewTempFile(
 		strings.NewReader(srcObjectContents),
-		"",
+		nil, // Temp space
 		&t.clock)
 
 	AssertEq(nil, err)
@@ -252,6 +252,65 @@ func (t *SyncerTest) LargerThanSource_ThresholdAtEndOfSource() {
 	ExpectTrue(t.appendCreator.called)
 }
 
+func (t *SyncerTest) LargerThanSource_Rewrite() {
+	var err error
+
+	// Extend the length of the content.
+	err = t.content.Truncate(int64(len(srcObjectContents) + 1))
+	AssertEq(nil, err)
+
+	// The full creator should be called, though appending would do.
+	_, err = t.syncer.RewriteObject(t.ctx, t.srcObject, t.content)
+
+	ExpectTrue(t.fullCreator.called)
+	ExpectFalse(t.appendCreator.called)
+}
+
+func (t *SyncerTest) AppendOnlyContent_SourceTooShortForAppend() {
+	var err error
+
+	// Recreate the syncer with a higher append threshold.
+	t.syncer = newSyncer(
+		int64(len(srcObjectContents)+1),
+		&t.fullCreator,
+		&t.appendCreator)
+
+	// Hold only appended contents.
+	t.content, err = NewAppendTempFile(int64(t.srcObject.Size), nil, &t.clock)
+	AssertEq(nil, err)
+
+	_, err = t.content.WriteAt([]byte("burrito"), int64(t.srcObject.Size))
+	AssertEq(nil, err)
+
+	// The append creator should be called anyway.
+	t.call()
+
+	ExpectFalse(t.fullCreator.called)
+	AssertTrue(t.appendCreator.called)
+	ExpectEq("burrito", string(t.appendCreator.contents))
+}
+
+func (t *SyncerTest) AppendOnlyContent_SourceComponentCountTooHigh() {
+	var err error
+
+	// Simulate a large component count.
+	t.srcObject.ComponentCount = gcs.MaxComponentCount
+
+	// Hold only appended contents.
+	t.content, err = NewAppendTempFile(int64(t.srcObject.Size), nil, &t.clock)
+	AssertEq(nil, err)
+
+	_, err = t.content.WriteAt([]byte("burrito"), int64(t.srcObject.Size))
+	AssertEq(nil, err)
+
+	// Neither creator can be called.
+	_, err = t.call()
+
+	ExpectThat(err, Error(HasSubstr("append")))
+	ExpectFalse(t.fullCreator.called)
+	ExpectFalse(t.appendCreator.called)
+}
+
 func (t *SyncerTest) CallsFullCreator() {
 	var err error
 	AssertLt(2, t.srcObject.Size)
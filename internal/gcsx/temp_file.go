@@ -15,15 +15,25 @@
 package gcsx
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"syscall"
 	"time"
 
 	"github.com/jacobsa/fuse/fsutil"
 	"github.com/jacobsa/timeutil"
 )
 
+// The largest run of adjacent or overlapping writes that a temp file on disk
+// holds in memory, to be written out with a single system call. The kernel
+// sends writes of at most 128 KiB, and usually of a page or a few, so that
+// writing each out as it arrives costs a lot of system calls for a file
+// written sequentially.
+const writeCoalesceLimit = 1 << 20
+
 // TempFile is a temporary file that keeps track of the lowest offset at which
 // it has been modified.
 //
@@ -46,6 +56,15 @@ type TempFile interface {
 	// until another method that modifies the file is called.
 	SetMtime(mtime time.Time)
 
+	// Return the offset of the first byte at or after offset that has been
+	// written, or if hole is set the first that hasn't, with the semantics of
+	// lseek(2) with SEEK_DATA or SEEK_HOLE: the end of the file counts as the
+	// start of a hole, and syscall.ENXIO is returned if offset is at or beyond
+	// the end of the file or there is no data after it. Ranges left by
+	// truncating upward or by writing beyond the end are holes, though they
+	// read as zeros; contents kept in memory are all data.
+	SeekData(offset int64, hole bool) (off int64, err error)
+
 	// Throw away the resources used by the temporary file. The object must not
 	// be used again.
 	Destroy()
@@ -71,31 +90,70 @@ type StatResult struct {
 }
 
 // NewTempFile creates a temp file whose initial contents are given by the
-// supplied reader. dir is a directory on whose file system the inode will live,
-// or the system default temporary location if empty.
+// supplied reader. The file lives in space's directory, and the space it takes
+// up is reserved there; if that is refused, syscall.ENOSPC is returned
+// unwrapped. Contents no larger than space's memory limit are instead kept in
+// memory until they grow past it.
 func NewTempFile(
 	content io.Reader,
-	dir string,
+	space *TempSpace,
 	clock timeutil.Clock) (tf TempFile, err error) {
+	// Read up to one byte more than may be kept in memory, to find out whether
+	// they all can be.
+	if max := space.MemoryLimit(); max > 0 {
+		var buf []byte
+		buf, err = ioutil.ReadAll(io.LimitReader(content, max+1))
+		if err != nil {
+			err = fmt.Errorf("ReadAll: %v", err)
+			return
+		}
+
+		if int64(len(buf)) <= max {
+			tf = newMemTempFile(buf, space, clock)
+			return
+		}
+
+		content = io.MultiReader(bytes.NewReader(buf), content)
+	}
+
+	tf, err = newDiskTempFile(content, space, clock)
+	return
+}
+
+// Create a temp file on disk, as with NewTempFile.
+func newDiskTempFile(
+	content io.Reader,
+	space *TempSpace,
+	clock timeutil.Clock) (tf *tempFile, err error) {
 	// Create an anonymous file to wrap. When we close it, its resources will be
 	// magically cleaned up.
-	f, err := fsutil.AnonymousFile(dir)
+	f, err := fsutil.AnonymousFile(space.Dir())
 	if err != nil {
 		err = fmt.Errorf("AnonymousFile: %v", err)
 		return
 	}
 
-	// Copy into the file.
-	size, err := io.Copy(f, content)
+	// Copy into the file, reserving space as we go.
+	w := &reservingWriter{w: f, space: space}
+	size, err := io.Copy(w, content)
 	if err != nil {
-		err = fmt.Errorf("copy: %v", err)
+		f.Close()
+		space.Release(w.reserved)
+
+		if err != syscall.ENOSPC {
+			err = fmt.Errorf("copy: %v", err)
+		}
+
 		return
 	}
 
 	tf = &tempFile{
 		clock:          clock,
+		space:          space,
 		f:              f,
+		reserved:       size,
 		dirtyThreshold: size,
+		data:           addExtent(nil, 0, size),
 	}
 
 	return
@@ -107,6 +165,7 @@ type tempFile struct {
 	/////////////////////////
 
 	clock timeutil.Clock
+	space *TempSpace
 
 	/////////////////////////
 	// Mutable state
@@ -117,6 +176,24 @@ type tempFile struct {
 	// A file containing our current contents.
 	f *os.File
 
+	// The number of bytes reserved in space for the file, which is its size
+	// including any pending write.
+	reserved int64
+
+	// A write not yet made to the file, of the contents of pending at offset
+	// pendingOff. Adjacent and overlapping writes are merged into it, and it is
+	// written out before anything else reads or changes the file.
+	//
+	// INVARIANT: len(pending) <= writeCoalesceLimit
+	// INVARIANT: pendingOff + len(pending) <= reserved
+	pending    []byte
+	pendingOff int64
+
+	// The ranges of the file that hold data rather than holes, in order.
+	//
+	// INVARIANT: Extents neither overlap nor adjoin, and end by reserved
+	data []Extent
+
 	// The lowest byte index that has been modified from the initial contents.
 	//
 	// INVARIANT: Stat().DirtyThreshold <= Stat().Size
@@ -138,18 +215,33 @@ func (tf *tempFile) CheckInvariants() {
 		panic("Use of destroyed tempFile object.")
 	}
 
-	// Restore the seek position after using Stat below.
-	pos, err := tf.Seek(0, 1)
-	if err != nil {
-		panic(fmt.Sprintf("Seek: %v", err))
+	// INVARIANT: len(pending) <= writeCoalesceLimit
+	if len(tf.pending) > writeCoalesceLimit {
+		panic(fmt.Sprintf("Pending write of %d bytes", len(tf.pending)))
 	}
 
-	defer func() {
-		_, err := tf.Seek(pos, 0)
-		if err != nil {
-			panic(fmt.Sprintf("Seek: %v", err))
+	// INVARIANT: pendingOff + len(pending) <= reserved
+	if tf.pendingOff+int64(len(tf.pending)) > tf.reserved {
+		panic(fmt.Sprintf(
+			"Pending write [%d, %d) beyond size %d",
+			tf.pendingOff,
+			tf.pendingOff+int64(len(tf.pending)),
+			tf.reserved))
+	}
+
+	// INVARIANT: Extents neither overlap nor adjoin, and end by reserved
+	prevEnd := int64(-1)
+	for _, e := range tf.data {
+		if e.Offset <= prevEnd || e.Length <= 0 {
+			panic(fmt.Sprintf("Illegal data extents: %v", tf.data))
 		}
-	}()
+
+		prevEnd = e.Offset + e.Length
+	}
+
+	if prevEnd > tf.reserved {
+		panic(fmt.Sprintf("Data extents %v beyond size %d", tf.data, tf.reserved))
+	}
 
 	// INVARIANT: Stat().DirtyThreshold <= Stat().Size
 	sr, err := tf.Stat()
@@ -169,60 +261,118 @@ func (tf *tempFile) CheckInvariants() {
 
 func (tf *tempFile) Destroy() {
 	tf.destroyed = true
+	tf.pending = nil
 
 	// Throw away the file.
 	tf.f.Close()
 	tf.f = nil
+	tf.space.Release(tf.reserved)
 }
 
 func (tf *tempFile) Read(p []byte) (int, error) {
+	err := tf.flush()
+	if err != nil {
+		return 0, err
+	}
+
 	return tf.f.Read(p)
 }
 
 func (tf *tempFile) Seek(offset int64, whence int) (int64, error) {
+	err := tf.flush()
+	if err != nil {
+		return 0, err
+	}
+
 	return tf.f.Seek(offset, whence)
 }
 
 func (tf *tempFile) ReadAt(p []byte, offset int64) (int, error) {
+	err := tf.flush()
+	if err != nil {
+		return 0, err
+	}
+
 	return tf.f.ReadAt(p, offset)
 }
 
 func (tf *tempFile) Stat() (sr StatResult, err error) {
 	sr.DirtyThreshold = tf.dirtyThreshold
 	sr.Mtime = tf.mtime
-
-	// Get the size from the file.
-	sr.Size, err = tf.f.Seek(0, 2)
-	if err != nil {
-		err = fmt.Errorf("Seek: %v", err)
-		return
-	}
+	sr.Size = tf.reserved
 
 	return
 }
 
 func (tf *tempFile) WriteAt(p []byte, offset int64) (int, error) {
+	// Make sure there's room for the file to grow, so that running out is
+	// reported now rather than when the write is made.
+	err := tf.grow(offset + int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+
 	// Update our state regarding being dirty.
 	tf.dirtyThreshold = minInt64(tf.dirtyThreshold, offset)
 
 	newMtime := tf.clock.Now()
 	tf.mtime = &newMtime
 
-	// Call through.
-	return tf.f.WriteAt(p, offset)
+	tf.data = addExtent(tf.data, offset, offset+int64(len(p)))
+
+	// Merge the write into the pending one if we can.
+	if tf.coalesce(p, offset) {
+		return len(p), nil
+	}
+
+	err = tf.flush()
+	if err != nil {
+		return 0, err
+	}
+
+	// Hold on to the write if there's room, or else call through.
+	if len(p) >= writeCoalesceLimit {
+		return tf.f.WriteAt(p, offset)
+	}
+
+	tf.pending = append([]byte(nil), p...)
+	tf.pendingOff = offset
+
+	return len(p), nil
 }
 
 func (tf *tempFile) Truncate(n int64) error {
+	err := tf.flush()
+	if err != nil {
+		return err
+	}
+
+	if n < tf.reserved {
+		tf.space.Release(tf.reserved - n)
+		tf.reserved = n
+	}
+
+	err = tf.grow(n)
+	if err != nil {
+		return err
+	}
+
 	// Update our state regarding being dirty.
 	tf.dirtyThreshold = minInt64(tf.dirtyThreshold, n)
 
 	newMtime := tf.clock.Now()
 	tf.mtime = &newMtime
 
+	tf.data = clipExtents(tf.data, n)
+
 	// Call through.
 	return tf.f.Truncate(n)
 }
 
+func (tf *tempFile) SeekData(offset int64, hole bool) (int64, error) {
+	return SeekExtents(tf.data, tf.reserved, offset, hole)
+}
+
 func (tf *tempFile) SetMtime(mtime time.Time) {
 	tf.mtime = &mtime
 }
@@ -231,6 +381,92 @@ func (tf *tempFile) SetMtime(mtime time.Time) {
 // Helpers
 ////////////////////////////////////////////////////////////////////////
 
+// Merge a write into the pending one, returning false if it neither overlaps
+// nor adjoins it or the result would be too large.
+func (tf *tempFile) coalesce(p []byte, offset int64) bool {
+	if len(tf.pending) == 0 {
+		return false
+	}
+
+	start := tf.pendingOff
+	end := start + int64(len(tf.pending))
+	pEnd := offset + int64(len(p))
+	if pEnd < start || offset > end {
+		return false
+	}
+
+	newStart := minInt64(start, offset)
+	newEnd := end
+	if pEnd > newEnd {
+		newEnd = pEnd
+	}
+
+	if newEnd-newStart > writeCoalesceLimit {
+		return false
+	}
+
+	// Make room before and after the pending contents as necessary, then lay the
+	// write over them.
+	if newStart < start {
+		merged := make([]byte, newEnd-newStart)
+		copy(merged[start-newStart:], tf.pending)
+		tf.pending = merged
+		tf.pendingOff = newStart
+	} else if newEnd > end {
+		tf.pending = append(tf.pending, make([]byte, newEnd-end)...)
+	}
+
+	copy(tf.pending[offset-newStart:], p)
+	return true
+}
+
+// Write out the pending write, if any.
+func (tf *tempFile) flush() (err error) {
+	if len(tf.pending) == 0 {
+		return
+	}
+
+	// Let go of the buffer, which most files will not need again before they
+	// are synced.
+	_, err = tf.f.WriteAt(tf.pending, tf.pendingOff)
+	tf.pending = nil
+
+	return
+}
+
+// Make sure that space is reserved for the file to be at least n bytes long.
+func (tf *tempFile) grow(n int64) (err error) {
+	if n <= tf.reserved {
+		return
+	}
+
+	err = tf.space.Reserve(n - tf.reserved)
+	if err != nil {
+		return
+	}
+
+	tf.reserved = n
+	return
+}
+
+// A writer that reserves space for what it writes.
+type reservingWriter struct {
+	w        io.Writer
+	space    *TempSpace
+	reserved int64
+}
+
+func (w *reservingWriter) Write(p []byte) (n int, err error) {
+	err = w.space.Reserve(int64(len(p)))
+	if err != nil {
+		return
+	}
+
+	w.reserved += int64(len(p))
+	n, err = w.w.Write(p)
+	return
+}
+
 func minInt64(a int64, b int64) int64 {
 	if a < b {
 		return a
@@ -19,6 +19,7 @@ import (
 	"io"
 	"io/ioutil"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -97,6 +98,12 @@ func (tf *checkingTempFile) Truncate(n int64) error {
 	return tf.wrapped.Truncate(n)
 }
 
+func (tf *checkingTempFile) SeekData(o int64, hole bool) (int64, error) {
+	tf.wrapped.CheckInvariants()
+	defer tf.wrapped.CheckInvariants()
+	return tf.wrapped.SeekData(o, hole)
+}
+
 func (tf *checkingTempFile) SetMtime(mtime time.Time) {
 	tf.wrapped.CheckInvariants()
 	defer tf.wrapped.CheckInvariants()
@@ -137,7 +144,7 @@ func (t *TempFileTest) SetUp(ti *TestInfo) {
 	// And the temp file.
 	t.tf.wrapped, err = gcsx.NewTempFile(
 		strings.NewReader(initialContent),
-		"",
+		nil, // Temp space
 		&t.clock)
 
 	AssertEq(nil, err)
@@ -234,3 +241,208 @@ func (t *TempFileTest) SetMtime() {
 	AssertEq(nil, err)
 	ExpectThat(sr.Mtime, Pointee(timeutil.TimeEq(mtime)))
 }
+
+////////////////////////////////////////////////////////////////////////
+// In memory
+////////////////////////////////////////////////////////////////////////
+
+// The same tests, for a temp file kept in memory.
+type MemTempFileTest struct {
+	TempFileTest
+}
+
+func init() { RegisterTestSuite(&MemTempFileTest{}) }
+
+// Enough room for the initial contents and a little more.
+const memTempFileLimit = int64(initialContentSize + 4)
+
+func (t *MemTempFileTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
+
+	t.tf.wrapped, err = gcsx.NewTempFile(
+		strings.NewReader(initialContent),
+		gcsx.NewTempSpace("", 0, memTempFileLimit),
+		&t.clock)
+
+	AssertEq(nil, err)
+}
+
+func (t *MemTempFileTest) GrowsWithinMemory() {
+	// No disk space is allowed, so this must stay in memory.
+	_, err := t.tf.WriteAt([]byte("queso"), 10)
+	AssertEq(nil, err)
+
+	actual, err := readAll(&t.tf)
+	AssertEq(nil, err)
+	ExpectEq("tacoburritqueso", string(actual))
+}
+
+func (t *MemTempFileTest) GrowsPastMemoryLimit() {
+	// No disk space is allowed, so moving to disk fails.
+	_, err := t.tf.WriteAt([]byte("enchilada"), 10)
+	ExpectEq(syscall.ENOSPC, err)
+
+	actual, err := readAll(&t.tf)
+	AssertEq(nil, err)
+	ExpectEq(initialContent, string(actual))
+}
+
+func (t *MemTempFileTest) MovesToDisk() {
+	space := gcsx.NewTempSpace("", -1, memTempFileLimit)
+	wrapped, err := gcsx.NewTempFile(
+		strings.NewReader(initialContent),
+		space,
+		&t.clock)
+
+	AssertEq(nil, err)
+	t.tf.wrapped = wrapped
+
+	_, err = t.tf.WriteAt([]byte("enchilada"), 10)
+	AssertEq(nil, err)
+	ExpectEq(len("tacoburritenchilada"), space.Used())
+
+	// State carries over.
+	sr, err := t.tf.Stat()
+	AssertEq(nil, err)
+	ExpectEq(len("tacoburritenchilada"), sr.Size)
+	ExpectEq(10, sr.DirtyThreshold)
+	ExpectThat(sr.Mtime, Pointee(timeutil.TimeEq(t.clock.Now())))
+
+	actual, err := readAll(&t.tf)
+	AssertEq(nil, err)
+	ExpectEq("tacoburritenchilada", string(actual))
+
+	t.tf.Destroy()
+	ExpectEq(0, space.Used())
+}
+
+////////////////////////////////////////////////////////////////////////
+// On disk
+////////////////////////////////////////////////////////////////////////
+
+// Tests for a temp file on disk, which holds writes back in order to merge
+// them.
+type DiskTempFileTest struct {
+	clock timeutil.SimulatedClock
+
+	tf checkingTempFile
+}
+
+func init() { RegisterTestSuite(&DiskTempFileTest{}) }
+
+func (t *DiskTempFileTest) SetUp(ti *TestInfo) {
+	var err error
+	t.clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
+
+	t.tf.wrapped, err = gcsx.NewTempFile(
+		strings.NewReader(initialContent),
+		nil, // Temp space
+		&t.clock)
+
+	AssertEq(nil, err)
+}
+
+func (t *DiskTempFileTest) CoalescedWrites() {
+	var err error
+
+	// Adjacent, overlapping, overlapping from before, and separate writes, some
+	// of them growing the file.
+	_, err = t.tf.WriteAt([]byte("queso"), 11)
+	AssertEq(nil, err)
+
+	_, err = t.tf.WriteAt([]byte("sal"), 16)
+	AssertEq(nil, err)
+
+	_, err = t.tf.WriteAt([]byte("SOS"), 14)
+	AssertEq(nil, err)
+
+	_, err = t.tf.WriteAt([]byte("ritoQ"), 7)
+	AssertEq(nil, err)
+
+	_, err = t.tf.WriteAt([]byte("T"), 0)
+	AssertEq(nil, err)
+
+	// Stat should reflect all of them.
+	sr, err := t.tf.Stat()
+
+	AssertEq(nil, err)
+	ExpectEq(len("tacoburritoquesosal"), sr.Size)
+	ExpectEq(0, sr.DirtyThreshold)
+
+	// As should reads.
+	buf := make([]byte, 4)
+	n, err := t.tf.ReadAt(buf, 10)
+
+	AssertEq(nil, err)
+	ExpectEq("oQue", string(buf[:n]))
+
+	actual, err := readAll(&t.tf)
+	AssertEq(nil, err)
+	ExpectEq("TacoburritoQueSOSal", string(actual))
+}
+
+func (t *DiskTempFileTest) TruncateBelowPendingWrite() {
+	var err error
+
+	_, err = t.tf.WriteAt([]byte("queso"), 11)
+	AssertEq(nil, err)
+
+	err = t.tf.Truncate(13)
+	AssertEq(nil, err)
+
+	_, err = t.tf.WriteAt([]byte("enchilada"), 20)
+	AssertEq(nil, err)
+
+	// Check Stat.
+	sr, err := t.tf.Stat()
+
+	AssertEq(nil, err)
+	ExpectEq(29, sr.Size)
+
+	// Read back.
+	actual, err := readAll(&t.tf)
+	AssertEq(nil, err)
+	ExpectEq("tacoburritoqu\x00\x00\x00\x00\x00\x00\x00enchilada", string(actual))
+}
+
+func (t *DiskTempFileTest) SeekData() {
+	var err error
+
+	// Leave holes by truncating upward and writing beyond the end.
+	err = t.tf.Truncate(20)
+	AssertEq(nil, err)
+
+	_, err = t.tf.WriteAt([]byte("queso"), 30)
+	AssertEq(nil, err)
+
+	testCases := []struct {
+		offset int64
+		hole   bool
+		off    int64
+	}{
+		{0, false, 0},
+		{0, true, int64(initialContentSize)},
+		{15, false, 30},
+		{15, true, 15},
+		{32, true, 35},
+	}
+
+	for _, tc := range testCases {
+		off, err := t.tf.SeekData(tc.offset, tc.hole)
+		AssertEq(nil, err, "%d %v", tc.offset, tc.hole)
+		ExpectEq(tc.off, off, "%d %v", tc.offset, tc.hole)
+	}
+
+	_, err = t.tf.SeekData(35, false)
+	ExpectEq(syscall.ENXIO, err)
+
+	// Shrinking drops the data beyond the new end.
+	err = t.tf.Truncate(32)
+	AssertEq(nil, err)
+
+	off, err := t.tf.SeekData(30, true)
+	AssertEq(nil, err)
+	ExpectEq(32, off)
+}
@@ -0,0 +1,209 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// The amount of free space that temp files may not eat into on the file
+// system holding them, so that the host doesn't grind to a halt when they
+// grow.
+const tempSpaceHeadroom = 64 << 20
+
+// How many bytes may be reserved between checks of the file system's free
+// space.
+const tempSpaceCheckInterval = 1 << 20
+
+// TempSpace accounts for the disk space used by the temp files in a
+// directory, refusing to let them grow past a limit or into the last
+// tempSpaceHeadroom bytes of the file system.
+//
+// Temp files no larger than a given size may also be kept in memory instead,
+// where they take up no space in the directory.
+//
+// A nil *TempSpace is valid, and stands for the system default temporary
+// directory without any limit, and no temp files in memory.
+//
+// Safe for concurrent access.
+type TempSpace struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	dir      string
+	limit    int64
+	memLimit int64
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The number of bytes currently reserved.
+	//
+	// GUARDED_BY(mu)
+	used int64
+
+	// The free space on the file system when we last checked, and the number
+	// of bytes reserved since.
+	//
+	// GUARDED_BY(mu)
+	free      int64
+	unchecked int64
+	checked   bool
+
+	// Whether the last reservation was refused, so that we log only when that
+	// changes.
+	//
+	// GUARDED_BY(mu)
+	refusing bool
+}
+
+// NewTempSpace creates a TempSpace for temp files in the given directory, or
+// the system default if empty, allowing them to use at most limit bytes in
+// total, or any amount if limit is negative. Temp files of up to memLimit
+// bytes are kept in memory.
+func NewTempSpace(dir string, limit int64, memLimit int64) (s *TempSpace) {
+	s = &TempSpace{
+		dir:      dir,
+		limit:    limit,
+		memLimit: memLimit,
+	}
+
+	return
+}
+
+// Dir returns the directory in which temp files should be created.
+func (s *TempSpace) Dir() string {
+	if s == nil {
+		return ""
+	}
+
+	return s.dir
+}
+
+// MemoryLimit returns the size up to which temp files are kept in memory, or
+// zero if they never are.
+func (s *TempSpace) MemoryLimit() int64 {
+	if s == nil {
+		return 0
+	}
+
+	return s.memLimit
+}
+
+// Used returns the number of bytes currently reserved.
+func (s *TempSpace) Used() (n int64) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	n = s.used
+	s.mu.Unlock()
+
+	return
+}
+
+// Reserve n more bytes for temp files, returning syscall.ENOSPC if that would
+// take them over the limit or leave too little space on the file system.
+func (s *TempSpace) Reserve(n int64) (err error) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = s.admit(n)
+	if err != nil {
+		if !s.refusing {
+			log.Printf("Refusing to grow temp files in %q: %v", s.path(), err)
+			s.refusing = true
+		}
+
+		err = syscall.ENOSPC
+		return
+	}
+
+	if s.refusing {
+		log.Printf("Temp files in %q may grow again.", s.path())
+		s.refusing = false
+	}
+
+	s.used += n
+	s.unchecked += n
+
+	return
+}
+
+// Release n bytes previously reserved.
+func (s *TempSpace) Release(n int64) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.used -= n
+	s.unchecked -= n
+	s.mu.Unlock()
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *TempSpace) admit(n int64) (err error) {
+	if s.limit >= 0 && s.used+n > s.limit {
+		err = fmt.Errorf("%d bytes in use, limit is %d", s.used, s.limit)
+		return
+	}
+
+	// Find out how much space is left, if we haven't recently.
+	if !s.checked || s.unchecked+n >= tempSpaceCheckInterval {
+		var st syscall.Statfs_t
+		err = syscall.Statfs(s.path(), &st)
+		if err != nil {
+			err = fmt.Errorf("Statfs: %v", err)
+			return
+		}
+
+		s.free = int64(uint64(st.Bavail) * uint64(st.Bsize))
+		s.unchecked = 0
+		s.checked = true
+	}
+
+	if s.free-s.unchecked-n < tempSpaceHeadroom {
+		err = fmt.Errorf(
+			"%d bytes free on disk, keeping %d in reserve",
+			s.free-s.unchecked,
+			tempSpaceHeadroom)
+		return
+	}
+
+	return
+}
+
+// Return the directory that temp files actually go in.
+func (s *TempSpace) path() string {
+	if s.dir == "" {
+		return os.TempDir()
+	}
+
+	return s.dir
+}
@@ -0,0 +1,146 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestTempSpace(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const tempSpaceLimit = 10
+
+type TempSpaceTest struct {
+	clock timeutil.SimulatedClock
+	space *gcsx.TempSpace
+}
+
+var _ SetUpInterface = &TempSpaceTest{}
+
+func init() { RegisterTestSuite(&TempSpaceTest{}) }
+
+func (t *TempSpaceTest) SetUp(ti *TestInfo) {
+	t.space = gcsx.NewTempSpace("", tempSpaceLimit, 0)
+}
+
+func (t *TempSpaceTest) newTempFile(contents string) (gcsx.TempFile, error) {
+	return gcsx.NewTempFile(strings.NewReader(contents), t.space, &t.clock)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *TempSpaceTest) InitialContentsCounted() {
+	tf, err := t.newTempFile("taco")
+	AssertEq(nil, err)
+	ExpectEq(len("taco"), t.space.Used())
+
+	tf.Destroy()
+	ExpectEq(0, t.space.Used())
+}
+
+func (t *TempSpaceTest) InitialContentsTooLarge() {
+	_, err := t.newTempFile("enchilada burrito")
+	ExpectEq(syscall.ENOSPC, err)
+	ExpectEq(0, t.space.Used())
+}
+
+func (t *TempSpaceTest) WritesWithinFile() {
+	tf, err := t.newTempFile("0123456789")
+	AssertEq(nil, err)
+	defer tf.Destroy()
+
+	// Overwriting existing contents takes no more space.
+	_, err = tf.WriteAt([]byte("taco"), 2)
+	AssertEq(nil, err)
+	ExpectEq(tempSpaceLimit, t.space.Used())
+}
+
+func (t *TempSpaceTest) WritesExtendingFile() {
+	tf, err := t.newTempFile("taco")
+	AssertEq(nil, err)
+	defer tf.Destroy()
+
+	_, err = tf.WriteAt([]byte("burrito"), 2)
+	AssertEq(nil, err)
+	ExpectEq(len("taburrito"), t.space.Used())
+
+	// Going past the limit fails, and leaves the file alone.
+	_, err = tf.WriteAt([]byte("enchilada"), 4)
+	ExpectEq(syscall.ENOSPC, err)
+	ExpectEq(len("taburrito"), t.space.Used())
+
+	sr, err := tf.Stat()
+	AssertEq(nil, err)
+	ExpectEq(len("taburrito"), sr.Size)
+}
+
+func (t *TempSpaceTest) Truncate() {
+	tf, err := t.newTempFile("taco")
+	AssertEq(nil, err)
+	defer tf.Destroy()
+
+	err = tf.Truncate(1)
+	AssertEq(nil, err)
+	ExpectEq(1, t.space.Used())
+
+	err = tf.Truncate(tempSpaceLimit)
+	AssertEq(nil, err)
+	ExpectEq(tempSpaceLimit, t.space.Used())
+
+	err = tf.Truncate(tempSpaceLimit + 1)
+	ExpectEq(syscall.ENOSPC, err)
+	ExpectEq(tempSpaceLimit, t.space.Used())
+}
+
+func (t *TempSpaceTest) SharedBetweenFiles() {
+	tf0, err := t.newTempFile("taco")
+	AssertEq(nil, err)
+	defer tf0.Destroy()
+
+	tf1, err := t.newTempFile("burrito")
+	ExpectEq(syscall.ENOSPC, err)
+
+	tf1, err = t.newTempFile("queso")
+	AssertEq(nil, err)
+	ExpectEq(len("taco")+len("queso"), t.space.Used())
+
+	tf1.Destroy()
+	ExpectEq(len("taco"), t.space.Used())
+}
+
+func (t *TempSpaceTest) NilSpace() {
+	tf, err := gcsx.NewTempFile(
+		strings.NewReader("enchilada burrito"),
+		nil,
+		&t.clock)
+
+	AssertEq(nil, err)
+	defer tf.Destroy()
+
+	_, err = tf.WriteAt([]byte("queso"), 1<<20)
+	ExpectEq(nil, err)
+}
@@ -0,0 +1,312 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+// Timeouts configures NewTimeoutBucket. A zero duration means no timeout.
+type Timeouts struct {
+	// The time allowed for a request that transfers no contents through us,
+	// i.e. anything but NewReader and CreateObject. This includes any retries
+	// made by package gcs.
+	Metadata time.Duration
+
+	// The time that a NewReader request, or a read from the resulting reader,
+	// may go without returning. Time between reads doesn't count, so a reader
+	// may be kept open indefinitely.
+	Read time.Duration
+
+	// The time that a CreateObject request may go without consuming any of the
+	// contents to be uploaded, or, once all have been consumed, without a
+	// response.
+	Upload time.Duration
+}
+
+// TimeoutError is returned by a bucket from NewTimeoutBucket when a request
+// was cancelled for taking too long.
+type TimeoutError struct {
+	Method  string
+	Timeout time.Duration
+
+	// The error returned by the wrapped bucket once cancelled.
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %v: %v", e.Method, e.Timeout, e.Err)
+}
+
+// NewTimeoutBucket wraps a bucket such that requests that stall for longer
+// than allowed by the supplied timeouts are cancelled, via their contexts,
+// and fail with *TimeoutError rather than blocking their callers
+// indefinitely.
+func NewTimeoutBucket(
+	wrapped gcs.Bucket,
+	timeouts Timeouts) (b gcs.Bucket) {
+	b = &timeoutBucket{
+		wrapped:  wrapped,
+		timeouts: timeouts,
+	}
+
+	return
+}
+
+type timeoutBucket struct {
+	wrapped  gcs.Bucket
+	timeouts Timeouts
+}
+
+func (b *timeoutBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *timeoutBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	ctx, w := newWatchdog(ctx, "NewReader", b.timeouts.Read)
+	rc, err = b.wrapped.NewReader(ctx, req)
+	if err != nil {
+		w.Stop()
+		err = w.Check(err)
+		return
+	}
+
+	if w == nil {
+		return
+	}
+
+	// The clock runs only while a read is in progress.
+	w.Pause()
+	rc = &timeoutReader{
+		wrapped: rc,
+		w:       w,
+	}
+
+	return
+}
+
+func (b *timeoutBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	ctx, w := newWatchdog(ctx, "CreateObject", b.timeouts.Upload)
+	defer w.Stop()
+
+	// Reset the clock each time some contents are consumed.
+	if w != nil {
+		reqCopy := *req
+		reqCopy.Contents = &kickingReader{
+			wrapped: req.Contents,
+			w:       w,
+		}
+
+		req = &reqCopy
+	}
+
+	o, err = b.wrapped.CreateObject(ctx, req)
+	err = w.Check(err)
+	return
+}
+
+func (b *timeoutBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	ctx, w := newWatchdog(ctx, "CopyObject", b.timeouts.Metadata)
+	defer w.Stop()
+
+	o, err = b.wrapped.CopyObject(ctx, req)
+	err = w.Check(err)
+	return
+}
+
+func (b *timeoutBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	ctx, w := newWatchdog(ctx, "ComposeObjects", b.timeouts.Metadata)
+	defer w.Stop()
+
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	err = w.Check(err)
+	return
+}
+
+func (b *timeoutBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	ctx, w := newWatchdog(ctx, "StatObject", b.timeouts.Metadata)
+	defer w.Stop()
+
+	o, err = b.wrapped.StatObject(ctx, req)
+	err = w.Check(err)
+	return
+}
+
+func (b *timeoutBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	ctx, w := newWatchdog(ctx, "ListObjects", b.timeouts.Metadata)
+	defer w.Stop()
+
+	l, err = b.wrapped.ListObjects(ctx, req)
+	err = w.Check(err)
+	return
+}
+
+func (b *timeoutBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	ctx, w := newWatchdog(ctx, "UpdateObject", b.timeouts.Metadata)
+	defer w.Stop()
+
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	err = w.Check(err)
+	return
+}
+
+func (b *timeoutBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	ctx, w := newWatchdog(ctx, "DeleteObject", b.timeouts.Metadata)
+	defer w.Stop()
+
+	err = b.wrapped.DeleteObject(ctx, req)
+	err = w.Check(err)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// watchdog
+////////////////////////////////////////////////////////////////////////
+
+// A watchdog cancels a context when its clock runs out, unless it is kicked
+// first. A nil *watchdog, for a zero timeout, does nothing.
+type watchdog struct {
+	method  string
+	timeout time.Duration
+	cancel  func()
+	timer   *time.Timer
+
+	// Set to one when the clock has run out.
+	//
+	// Accessed atomically.
+	fired int32
+}
+
+// Return a context derived from the supplied one that is cancelled once the
+// new watchdog's clock runs out, which it starts doing immediately.
+func newWatchdog(
+	parent context.Context,
+	method string,
+	timeout time.Duration) (ctx context.Context, w *watchdog) {
+	if timeout <= 0 {
+		ctx = parent
+		return
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	w = &watchdog{
+		method:  method,
+		timeout: timeout,
+		cancel:  cancel,
+	}
+
+	w.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&w.fired, 1)
+		cancel()
+	})
+
+	return
+}
+
+// Restart the clock from the full timeout.
+func (w *watchdog) Kick() {
+	if w != nil {
+		w.timer.Reset(w.timeout)
+	}
+}
+
+// Stop the clock until the next call to Kick.
+func (w *watchdog) Pause() {
+	if w != nil {
+		w.timer.Stop()
+	}
+}
+
+// Stop the clock for good and release the context's resources.
+func (w *watchdog) Stop() {
+	if w != nil {
+		w.timer.Stop()
+		w.cancel()
+	}
+}
+
+// Return the supplied error, replaced with a *TimeoutError if non-nil and the
+// clock has run out.
+func (w *watchdog) Check(err error) error {
+	if w == nil || err == nil || atomic.LoadInt32(&w.fired) == 0 {
+		return err
+	}
+
+	return &TimeoutError{
+		Method:  w.method,
+		Timeout: w.timeout,
+		Err:     err,
+	}
+}
+
+// A reader that runs the watchdog's clock during each read. The clock has
+// already been paused.
+type timeoutReader struct {
+	wrapped io.ReadCloser
+	w       *watchdog
+}
+
+func (r *timeoutReader) Read(p []byte) (n int, err error) {
+	r.w.Kick()
+	n, err = r.wrapped.Read(p)
+	r.w.Pause()
+
+	if err != io.EOF {
+		err = r.w.Check(err)
+	}
+
+	return
+}
+
+func (r *timeoutReader) Close() (err error) {
+	err = r.wrapped.Close()
+	r.w.Stop()
+	return
+}
+
+// A reader that kicks the watchdog each time it is read from.
+type kickingReader struct {
+	wrapped io.Reader
+	w       *watchdog
+}
+
+func (r *kickingReader) Read(p []byte) (n int, err error) {
+	n, err = r.wrapped.Read(p)
+	r.w.Kick()
+	return
+}
@@ -0,0 +1,263 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestTimeoutBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const testTimeout = 50 * time.Millisecond
+
+// A bucket whose requests hang until cancelled while hang is set, and whose
+// readers do the same.
+type hangingBucket struct {
+	gcs.Bucket
+	hang bool
+}
+
+func (b *hangingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	if b.hang {
+		<-ctx.Done()
+		err = ctx.Err()
+		return
+	}
+
+	o, err = b.Bucket.StatObject(ctx, req)
+	return
+}
+
+// Like a real bucket, give up on reading the contents if cancelled.
+func (b *hangingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	var contents []byte
+	read := make(chan error, 1)
+	go func() {
+		var readErr error
+		contents, readErr = ioutil.ReadAll(req.Contents)
+		read <- readErr
+	}()
+
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+
+	case err = <-read:
+		if err != nil {
+			return
+		}
+	}
+
+	reqCopy := *req
+	reqCopy.Contents = bytes.NewReader(contents)
+	o, err = b.Bucket.CreateObject(ctx, &reqCopy)
+	return
+}
+
+func (b *hangingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	rc, err = b.Bucket.NewReader(ctx, req)
+	if err != nil {
+		return
+	}
+
+	rc = &hangingReader{ReadCloser: rc, ctx: ctx, b: b}
+	return
+}
+
+type hangingReader struct {
+	io.ReadCloser
+	ctx context.Context
+	b   *hangingBucket
+}
+
+func (r *hangingReader) Read(p []byte) (n int, err error) {
+	if r.b.hang {
+		<-r.ctx.Done()
+		err = r.ctx.Err()
+		return
+	}
+
+	n, err = r.ReadCloser.Read(p)
+	return
+}
+
+// A reader that hangs forever, as if the uploader were stuck.
+type hangingContents struct {
+	done chan struct{}
+}
+
+func (r *hangingContents) Read(p []byte) (n int, err error) {
+	<-r.done
+	err = io.EOF
+	return
+}
+
+type TimeoutBucketTest struct {
+	ctx     context.Context
+	wrapped *hangingBucket
+	bucket  gcs.Bucket
+}
+
+var _ SetUpInterface = &TimeoutBucketTest{}
+
+func init() { RegisterTestSuite(&TimeoutBucketTest{}) }
+
+func (t *TimeoutBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.wrapped = &hangingBucket{
+		Bucket: gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket"),
+	}
+
+	t.bucket = gcsx.NewTimeoutBucket(
+		t.wrapped,
+		gcsx.Timeouts{
+			Metadata: testTimeout,
+			Read:     testTimeout,
+			Upload:   testTimeout,
+		})
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *TimeoutBucketTest) MetadataRequestSucceeds() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq(4, o.Size)
+}
+
+func (t *TimeoutBucketTest) OtherErrorsPassThrough() {
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+
+	_, ok := err.(*gcs.NotFoundError)
+	ExpectTrue(ok, "%v", err)
+}
+
+func (t *TimeoutBucketTest) MetadataRequestHangs() {
+	t.wrapped.hang = true
+
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+
+	ExpectThat(err, Error(HasSubstr("StatObject timed out")))
+	_, ok := err.(*gcsx.TimeoutError)
+	ExpectTrue(ok, "%T", err)
+}
+
+func (t *TimeoutBucketTest) ReaderMayIdle() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	rc, err := t.bucket.NewReader(t.ctx, &gcs.ReadObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	defer rc.Close()
+
+	// Time between reads doesn't count.
+	time.Sleep(2 * testTimeout)
+
+	b, err := ioutil.ReadAll(rc)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(b))
+}
+
+func (t *TimeoutBucketTest) ReadHangs() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	rc, err := t.bucket.NewReader(t.ctx, &gcs.ReadObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	defer rc.Close()
+
+	t.wrapped.hang = true
+	_, err = rc.Read(make([]byte, 4))
+
+	ExpectThat(err, Error(HasSubstr("NewReader timed out")))
+}
+
+func (t *TimeoutBucketTest) UploadHangs() {
+	contents := &hangingContents{done: make(chan struct{})}
+	defer close(contents.done)
+
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "foo",
+			Contents: contents,
+		})
+
+	ExpectThat(err, Error(HasSubstr("CreateObject timed out")))
+}
+
+func (t *TimeoutBucketTest) SlowUploadMakingProgress() {
+	// Each read takes a good fraction of the timeout, but altogether they take
+	// much longer.
+	r := &slowReader{
+		wrapped: strings.NewReader("taco"),
+		delay:   testTimeout / 2,
+	}
+
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "foo",
+			Contents: r,
+		})
+
+	AssertEq(nil, err)
+}
+
+type slowReader struct {
+	wrapped io.Reader
+	delay   time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (n int, err error) {
+	time.Sleep(r.delay)
+	if len(p) > 1 {
+		p = p[:1]
+	}
+
+	n, err = r.wrapped.Read(p)
+	return
+}
@@ -0,0 +1,200 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"io"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/tracing"
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+// NewTracingBucket creates a bucket that records a span for each request made
+// to the wrapped bucket, as a child of the span (if any) carried by the
+// request's context. The span for NewReader lasts until the reader is closed.
+func NewTracingBucket(wrapped gcs.Bucket) (b gcs.Bucket) {
+	b = &tracingBucket{
+		wrapped: wrapped,
+	}
+
+	return
+}
+
+type tracingBucket struct {
+	wrapped gcs.Bucket
+}
+
+func (b *tracingBucket) startSpan(
+	ctx context.Context,
+	method string) (context.Context, *tracing.Span) {
+	ctx, span := tracing.StartSpan(ctx, "gcs."+method, tracing.SpanKindClient)
+	span.SetAttribute("gcs.bucket", b.wrapped.Name())
+	return ctx, span
+}
+
+func (b *tracingBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *tracingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	ctx, span := b.startSpan(ctx, "NewReader")
+	span.SetAttribute("gcs.object", req.Name)
+	if req.Range != nil {
+		span.SetAttribute("gcs.range_start", req.Range.Start)
+		span.SetAttribute("gcs.range_limit", req.Range.Limit)
+	}
+
+	rc, err = b.wrapped.NewReader(ctx, req)
+	if err != nil {
+		span.End(err)
+		return
+	}
+
+	rc = &tracingReader{
+		wrapped: rc,
+		span:    span,
+	}
+
+	return
+}
+
+func (b *tracingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	ctx, span := b.startSpan(ctx, "CreateObject")
+	defer span.EndWithError(&err)
+	span.SetAttribute("gcs.object", req.Name)
+
+	o, err = b.wrapped.CreateObject(ctx, req)
+	if o != nil {
+		span.SetAttribute("gcs.size", o.Size)
+	}
+
+	return
+}
+
+func (b *tracingBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	ctx, span := b.startSpan(ctx, "CopyObject")
+	defer span.EndWithError(&err)
+	span.SetAttribute("gcs.src_object", req.SrcName)
+	span.SetAttribute("gcs.object", req.DstName)
+
+	o, err = b.wrapped.CopyObject(ctx, req)
+	return
+}
+
+func (b *tracingBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	ctx, span := b.startSpan(ctx, "ComposeObjects")
+	defer span.EndWithError(&err)
+	span.SetAttribute("gcs.object", req.DstName)
+	span.SetAttribute("gcs.sources", len(req.Sources))
+
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	return
+}
+
+func (b *tracingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	ctx, span := b.startSpan(ctx, "StatObject")
+	defer span.EndWithError(&err)
+	span.SetAttribute("gcs.object", req.Name)
+
+	o, err = b.wrapped.StatObject(ctx, req)
+	return
+}
+
+func (b *tracingBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (l *gcs.Listing, err error) {
+	ctx, span := b.startSpan(ctx, "ListObjects")
+	defer span.EndWithError(&err)
+	span.SetAttribute("gcs.prefix", req.Prefix)
+	span.SetAttribute("gcs.delimiter", req.Delimiter)
+
+	l, err = b.wrapped.ListObjects(ctx, req)
+	if l != nil {
+		span.SetAttribute("gcs.objects", len(l.Objects))
+		span.SetAttribute("gcs.collapsed_runs", len(l.CollapsedRuns))
+	}
+
+	return
+}
+
+func (b *tracingBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	ctx, span := b.startSpan(ctx, "UpdateObject")
+	defer span.EndWithError(&err)
+	span.SetAttribute("gcs.object", req.Name)
+
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	return
+}
+
+func (b *tracingBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	ctx, span := b.startSpan(ctx, "DeleteObject")
+	defer span.EndWithError(&err)
+	span.SetAttribute("gcs.object", req.Name)
+
+	err = b.wrapped.DeleteObject(ctx, req)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// tracingReader
+////////////////////////////////////////////////////////////////////////
+
+// A reader that ends its span when closed, recording how much was read.
+type tracingReader struct {
+	wrapped io.ReadCloser
+	span    *tracing.Span
+
+	bytesRead int64
+	readErr   error
+}
+
+func (r *tracingReader) Read(p []byte) (n int, err error) {
+	n, err = r.wrapped.Read(p)
+	r.bytesRead += int64(n)
+	if err != nil && err != io.EOF {
+		r.readErr = err
+	}
+
+	return
+}
+
+func (r *tracingReader) Close() (err error) {
+	err = r.wrapped.Close()
+
+	r.span.SetAttribute("gcs.bytes_read", r.bytesRead)
+	if r.readErr != nil {
+		r.span.End(r.readErr)
+	} else {
+		r.span.End(err)
+	}
+
+	return
+}
@@ -0,0 +1,200 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/tracing"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestTracingBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type tracedSpan struct {
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Attributes   []struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+			IntValue    string `json:"intValue"`
+		} `json:"value"`
+	} `json:"attributes"`
+	Status struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+func (s *tracedSpan) attr(key string) string {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			return a.Value.StringValue + a.Value.IntValue
+		}
+	}
+
+	return ""
+}
+
+type TracingBucketTest struct {
+	ctx      context.Context
+	wrapped  gcs.Bucket
+	bucket   gcs.Bucket
+	server   *httptest.Server
+	exporter *tracing.Exporter
+
+	mu    sync.Mutex
+	spans []tracedSpan
+}
+
+var _ SetUpInterface = &TracingBucketTest{}
+var _ TearDownInterface = &TracingBucketTest{}
+
+func init() { RegisterTestSuite(&TracingBucketTest{}) }
+
+func (t *TracingBucketTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.server = httptest.NewServer(http.HandlerFunc(t.handle))
+
+	t.exporter, err = tracing.NewExporter(t.server.URL, nil, nil, nil)
+	AssertEq(nil, err)
+	tracing.Enable(t.exporter)
+
+	t.wrapped = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+	t.bucket = gcsx.NewTracingBucket(t.wrapped)
+}
+
+func (t *TracingBucketTest) TearDown() {
+	tracing.Enable(nil)
+	t.server.Close()
+}
+
+func (t *TracingBucketTest) handle(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []tracedSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			t.spans = append(t.spans, ss.Spans...)
+		}
+	}
+}
+
+func (t *TracingBucketTest) flush() []tracedSpan {
+	t.exporter.Stop()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.spans
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *TracingBucketTest) ListObjects() {
+	ctx, parent := tracing.StartSpan(
+		t.ctx,
+		"fuse.LookUpInode",
+		tracing.SpanKindServer)
+
+	_, err := t.bucket.ListObjects(ctx, &gcs.ListObjectsRequest{Prefix: "foo/"})
+	AssertEq(nil, err)
+	parent.End(nil)
+
+	spans := t.flush()
+	AssertEq(2, len(spans))
+
+	s := spans[0]
+	ExpectEq("gcs.ListObjects", s.Name)
+	ExpectEq(spans[1].SpanID, s.ParentSpanID)
+	ExpectEq("foo/", s.attr("gcs.prefix"))
+	ExpectEq("some_bucket", s.attr("gcs.bucket"))
+	ExpectEq(0, s.Status.Code)
+}
+
+func (t *TracingBucketTest) NewReader() {
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	rc, err := t.bucket.NewReader(
+		t.ctx,
+		&gcs.ReadObjectRequest{
+			Name:  "foo",
+			Range: &gcs.ByteRange{Start: 1, Limit: 3},
+		})
+
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadAll(rc)
+	AssertEq(nil, err)
+	ExpectEq("ac", string(contents))
+
+	AssertEq(nil, rc.Close())
+
+	spans := t.flush()
+	AssertEq(1, len(spans))
+
+	s := spans[0]
+	ExpectEq("gcs.NewReader", s.Name)
+	ExpectEq("foo", s.attr("gcs.object"))
+	ExpectEq("1", s.attr("gcs.range_start"))
+	ExpectEq("3", s.attr("gcs.range_limit"))
+	ExpectEq("2", s.attr("gcs.bytes_read"))
+}
+
+func (t *TracingBucketTest) StatObject_Error() {
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	spans := t.flush()
+	AssertEq(1, len(spans))
+	ExpectEq("gcs.StatObject", spans[0].Name)
+	ExpectEq(2, spans[0].Status.Code)
+}
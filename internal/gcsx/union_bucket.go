@@ -0,0 +1,660 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/jacobsa/syncutil"
+	"golang.org/x/net/context"
+)
+
+// The prefix of the objects in the upper layer of a union bucket that record
+// the names deleted from the layers below. Each name is escaped so that it
+// contains no slashes, keeping the records out of the way of listings with a
+// delimiter, while a prefix of a name still escapes to a prefix of its record.
+const unionWhiteoutPrefix = ".gcsfuse_whiteouts/"
+
+var (
+	whiteoutEscaper   = strings.NewReplacer("%", "%25", "/", "%2F")
+	whiteoutUnescaper = strings.NewReplacer("%2F", "/", "%25", "%")
+)
+
+// NewUnionBucket creates a bucket that layers the upper bucket over the lower
+// buckets, which are given highest precedence first. Each name resolves to
+// the object with that name in the first layer that has one, unless it has
+// been deleted, and listings merge those of the layers.
+//
+// Every change is made in the upper layer, and the lower layers are never
+// modified. Changing an object that resolves to a lower layer copies it up
+// first, and deleting one records the name in the upper layer, hiding it in
+// every lower layer until an object of that name is created again.
+// Preconditions refer to the generations of the objects that names resolve
+// to, whichever layer they are in.
+//
+// Since the layers may each need to be asked, lookups of missing names and
+// listings cost a request per layer, and listings are returned in one piece.
+// Listings of noncurrent generations see only the upper layer.
+func NewUnionBucket(upper gcs.Bucket, lowers []gcs.Bucket) gcs.Bucket {
+	return &unionBucket{
+		layers: append([]gcs.Bucket{upper}, lowers...),
+	}
+}
+
+type unionBucket struct {
+	// The upper layer, followed by the lower layers in order of precedence.
+	layers []gcs.Bucket
+}
+
+func whiteoutName(name string) string {
+	return unionWhiteoutPrefix + whiteoutEscaper.Replace(name)
+}
+
+func isNotFound(err error) bool {
+	_, ok := err.(*gcs.NotFoundError)
+	return ok
+}
+
+func notFound(name string) error {
+	return &gcs.NotFoundError{
+		Err: fmt.Errorf("Object %q not found", name),
+	}
+}
+
+func preconditionFailed(name string) error {
+	return &gcs.PreconditionError{
+		Err: fmt.Errorf("Precondition failed for %q", name),
+	}
+}
+
+// Find the object to which the given name resolves, and the index of its
+// layer. Returns a *gcs.NotFoundError if there is none.
+func (b *unionBucket) resolve(
+	ctx context.Context,
+	name string) (o *gcs.Object, layer int, err error) {
+	if strings.HasPrefix(name, unionWhiteoutPrefix) {
+		err = notFound(name)
+		return
+	}
+
+	o, err = b.layers[0].StatObject(ctx, &gcs.StatObjectRequest{Name: name})
+	if !isNotFound(err) || len(b.layers) == 1 {
+		return
+	}
+
+	// Has the name been deleted from the lower layers?
+	_, err = b.layers[0].StatObject(
+		ctx,
+		&gcs.StatObjectRequest{Name: whiteoutName(name)})
+
+	switch {
+	case err == nil:
+		err = notFound(name)
+		return
+
+	case !isNotFound(err):
+		err = fmt.Errorf("StatObject: %v", err)
+		return
+	}
+
+	for layer = 1; layer < len(b.layers); layer++ {
+		o, err = b.layers[layer].StatObject(ctx, &gcs.StatObjectRequest{Name: name})
+		if !isNotFound(err) {
+			return
+		}
+	}
+
+	return
+}
+
+// Check the given preconditions on the generation and metageneration of the
+// object to which the given name resolves, returning those to apply in the
+// upper layer instead.
+func (b *unionBucket) translatePreconditions(
+	ctx context.Context,
+	name string,
+	generation *int64,
+	metaGeneration *int64) (upperGeneration, upperMetaGeneration *int64, err error) {
+	if generation == nil && metaGeneration == nil {
+		return
+	}
+
+	o, layer, err := b.resolve(ctx, name)
+	if isNotFound(err) {
+		o, err = nil, nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	if o == nil {
+		if metaGeneration != nil || (generation != nil && *generation != 0) {
+			err = preconditionFailed(name)
+			return
+		}
+
+		upperGeneration = generation
+		return
+	}
+
+	if (generation != nil && *generation != o.Generation) ||
+		(metaGeneration != nil && *metaGeneration != o.MetaGeneration) {
+		err = preconditionFailed(name)
+		return
+	}
+
+	// Make sure that the object hasn't changed by the time the change is made.
+	// A name that resolves to a lower layer has nothing in the upper layer.
+	if layer == 0 {
+		upperGeneration, upperMetaGeneration = generation, metaGeneration
+		return
+	}
+
+	var zero int64
+	upperGeneration = &zero
+	return
+}
+
+// Copy the given object from the given lower layer into the upper layer,
+// where its name must not exist.
+func (b *unionBucket) copyUp(
+	ctx context.Context,
+	o *gcs.Object,
+	layer int) (upper *gcs.Object, err error) {
+	rc, err := b.layers[layer].NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{Name: o.Name, Generation: o.Generation})
+
+	if err != nil {
+		err = fmt.Errorf("NewReader: %v", err)
+		return
+	}
+
+	defer rc.Close()
+
+	var zero int64
+	upper, err = b.layers[0].CreateObject(
+		ctx,
+		&gcs.CreateObjectRequest{
+			Name:                   o.Name,
+			ContentType:            o.ContentType,
+			ContentLanguage:        o.ContentLanguage,
+			ContentEncoding:        o.ContentEncoding,
+			CacheControl:           o.CacheControl,
+			Metadata:               o.Metadata,
+			Contents:               rc,
+			GenerationPrecondition: &zero,
+		})
+
+	if err != nil {
+		err = fmt.Errorf("CreateObject: %v", err)
+		return
+	}
+
+	return
+}
+
+// Find the given generation of an object, and the index of its layer.
+func (b *unionBucket) find(
+	ctx context.Context,
+	name string,
+	generation int64) (o *gcs.Object, layer int, err error) {
+	if generation == 0 {
+		o, layer, err = b.resolve(ctx, name)
+		return
+	}
+
+	for layer = range b.layers {
+		o, err = b.layers[layer].StatObject(ctx, &gcs.StatObjectRequest{Name: name})
+		if err == nil && o.Generation == generation {
+			return
+		}
+
+		if err != nil && !isNotFound(err) {
+			return
+		}
+	}
+
+	o = nil
+	err = notFound(name)
+	return
+}
+
+func (b *unionBucket) Name() string {
+	return b.layers[0].Name()
+}
+
+func (b *unionBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	if req.Generation == 0 {
+		var o *gcs.Object
+		var layer int
+		o, layer, err = b.resolve(ctx, req.Name)
+		if err != nil {
+			return
+		}
+
+		reqCopy := *req
+		reqCopy.Generation = o.Generation
+		rc, err = b.layers[layer].NewReader(ctx, &reqCopy)
+		return
+	}
+
+	// Generations are unique enough to try each layer in turn.
+	for _, layer := range b.layers {
+		rc, err = layer.NewReader(ctx, req)
+		if !isNotFound(err) {
+			return
+		}
+	}
+
+	return
+}
+
+func (b *unionBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if strings.HasPrefix(req.Name, unionWhiteoutPrefix) {
+		err = fmt.Errorf("%q is reserved for recording deletions", unionWhiteoutPrefix)
+		return
+	}
+
+	reqCopy := *req
+	reqCopy.GenerationPrecondition, reqCopy.MetaGenerationPrecondition, err =
+		b.translatePreconditions(
+			ctx,
+			req.Name,
+			req.GenerationPrecondition,
+			req.MetaGenerationPrecondition)
+
+	if err != nil {
+		return
+	}
+
+	o, err = b.layers[0].CreateObject(ctx, &reqCopy)
+	return
+}
+
+func (b *unionBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	src, layer, err := b.find(ctx, req.SrcName, req.SrcGeneration)
+	if err != nil {
+		return
+	}
+
+	if req.SrcMetaGenerationPrecondition != nil &&
+		*req.SrcMetaGenerationPrecondition != src.MetaGeneration {
+		err = preconditionFailed(req.SrcName)
+		return
+	}
+
+	dstGeneration, _, err := b.translatePreconditions(
+		ctx,
+		req.DstName,
+		req.DstGenerationPrecondition,
+		nil)
+
+	if err != nil {
+		return
+	}
+
+	if layer == 0 {
+		reqCopy := *req
+		reqCopy.SrcGeneration = src.Generation
+		reqCopy.DstGenerationPrecondition = dstGeneration
+		o, err = b.layers[0].CopyObject(ctx, &reqCopy)
+		return
+	}
+
+	// The source is in a lower layer, so copy it through us.
+	rc, err := b.layers[layer].NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:          src.Name,
+			Generation:    src.Generation,
+			EncryptionKey: req.SrcEncryptionKey,
+		})
+
+	if err != nil {
+		return
+	}
+
+	defer rc.Close()
+
+	o, err = b.layers[0].CreateObject(
+		ctx,
+		&gcs.CreateObjectRequest{
+			Name:                   req.DstName,
+			ContentType:            src.ContentType,
+			ContentLanguage:        src.ContentLanguage,
+			ContentEncoding:        src.ContentEncoding,
+			CacheControl:           src.CacheControl,
+			Metadata:               src.Metadata,
+			KmsKeyName:             req.DstKmsKeyName,
+			EncryptionKey:          req.DstEncryptionKey,
+			Contents:               rc,
+			GenerationPrecondition: dstGeneration,
+		})
+
+	return
+}
+
+func (b *unionBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	reqCopy := *req
+	reqCopy.DstGenerationPrecondition, reqCopy.DstMetaGenerationPrecondition, err =
+		b.translatePreconditions(
+			ctx,
+			req.DstName,
+			req.DstGenerationPrecondition,
+			req.DstMetaGenerationPrecondition)
+
+	if err != nil {
+		return
+	}
+
+	// Copy up sources in lower layers, as when appending to an object there.
+	// Only a source that the destination's name resolves to can be, since
+	// nothing else may be overwritten.
+	reqCopy.Sources = append([]gcs.ComposeSource(nil), req.Sources...)
+	for i, s := range reqCopy.Sources {
+		// Leave it to the upper layer to report a missing source.
+		src, layer, findErr := b.find(ctx, s.Name, s.Generation)
+		if findErr != nil || layer == 0 {
+			continue
+		}
+
+		if s.Name != req.DstName {
+			err = fmt.Errorf(
+				"Can't compose %q from %q in a lower layer",
+				req.DstName,
+				s.Name)
+			return
+		}
+
+		var copied *gcs.Object
+		copied, err = b.copyUp(ctx, src, layer)
+		if err != nil {
+			err = fmt.Errorf("copyUp: %v", err)
+			return
+		}
+
+		reqCopy.Sources[i].Generation = copied.Generation
+		reqCopy.DstGenerationPrecondition = &copied.Generation
+		reqCopy.DstMetaGenerationPrecondition = nil
+	}
+
+	o, err = b.layers[0].ComposeObjects(ctx, &reqCopy)
+	return
+}
+
+func (b *unionBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, _, err = b.resolve(ctx, req.Name)
+	return
+}
+
+func (b *unionBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	listing = &gcs.Listing{}
+	if req.Versions {
+		listing, err = b.layers[0].ListObjects(ctx, req)
+		if err != nil {
+			return
+		}
+
+		listing = hideWhiteouts(listing)
+		return
+	}
+
+	// List the names deleted from the lower layers and each layer at once,
+	// since none of the listings depends on another.
+	bundle := syncutil.NewBundle(ctx)
+
+	whiteouts := make(map[string]bool)
+	if len(b.layers) > 1 {
+		bundle.Add(func(ctx context.Context) (err error) {
+			objects, _, err := gcsutil.ListAll(
+				ctx,
+				b.layers[0],
+				&gcs.ListObjectsRequest{Prefix: whiteoutName(req.Prefix)})
+
+			if err != nil {
+				err = fmt.Errorf("ListAll: %v", err)
+				return
+			}
+
+			for _, o := range objects {
+				name := strings.TrimPrefix(o.Name, unionWhiteoutPrefix)
+				whiteouts[whiteoutUnescaper.Replace(name)] = true
+			}
+
+			return
+		})
+	}
+
+	layerObjects := make([][]*gcs.Object, len(b.layers))
+	layerRuns := make([][]string, len(b.layers))
+	for i := range b.layers {
+		i := i
+		bundle.Add(func(ctx context.Context) (err error) {
+			reqCopy := *req
+			reqCopy.ContinuationToken = ""
+
+			layerObjects[i], layerRuns[i], err = gcsutil.ListAll(
+				ctx,
+				b.layers[i],
+				&reqCopy)
+
+			if err != nil {
+				err = fmt.Errorf("ListAll: %v", err)
+			}
+
+			return
+		})
+	}
+
+	err = bundle.Join()
+	if err != nil {
+		return
+	}
+
+	// Take each name from the first layer that has it.
+	objects := make(map[string]*gcs.Object)
+	runs := make(map[string]bool)
+	for i := range b.layers {
+		for _, o := range layerObjects[i] {
+			if objects[o.Name] == nil && (i == 0 || !whiteouts[o.Name]) {
+				objects[o.Name] = o
+			}
+		}
+
+		for _, r := range layerRuns[i] {
+			if i == 0 || !whiteouts[r] {
+				runs[r] = true
+			}
+		}
+	}
+
+	for _, o := range objects {
+		listing.Objects = append(listing.Objects, o)
+	}
+
+	for r := range runs {
+		listing.CollapsedRuns = append(listing.CollapsedRuns, r)
+	}
+
+	sort.Slice(listing.Objects, func(i, j int) bool {
+		return listing.Objects[i].Name < listing.Objects[j].Name
+	})
+
+	sort.Strings(listing.CollapsedRuns)
+	listing = hideWhiteouts(listing)
+	return
+}
+
+// Return a copy of the listing without the records of deleted names.
+func hideWhiteouts(listing *gcs.Listing) (filtered *gcs.Listing) {
+	filtered = &gcs.Listing{
+		ContinuationToken: listing.ContinuationToken,
+	}
+
+	for _, o := range listing.Objects {
+		if !strings.HasPrefix(o.Name, unionWhiteoutPrefix) {
+			filtered.Objects = append(filtered.Objects, o)
+		}
+	}
+
+	for _, r := range listing.CollapsedRuns {
+		if !strings.HasPrefix(r, unionWhiteoutPrefix) {
+			filtered.CollapsedRuns = append(filtered.CollapsedRuns, r)
+		}
+	}
+
+	return
+}
+
+func (b *unionBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	current, layer, err := b.resolve(ctx, req.Name)
+	if err != nil {
+		return
+	}
+
+	if req.Generation != 0 && req.Generation != current.Generation {
+		err = notFound(req.Name)
+		return
+	}
+
+	reqCopy := *req
+	if layer != 0 {
+		if req.MetaGenerationPrecondition != nil &&
+			*req.MetaGenerationPrecondition != current.MetaGeneration {
+			err = preconditionFailed(req.Name)
+			return
+		}
+
+		current, err = b.copyUp(ctx, current, layer)
+		if err != nil {
+			err = fmt.Errorf("copyUp: %v", err)
+			return
+		}
+
+		reqCopy.Generation = current.Generation
+		reqCopy.MetaGenerationPrecondition = nil
+	}
+
+	o, err = b.layers[0].UpdateObject(ctx, &reqCopy)
+	return
+}
+
+func (b *unionBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	current, layer, err := b.resolve(ctx, req.Name)
+	if err != nil {
+		return
+	}
+
+	if req.Generation != 0 && req.Generation != current.Generation {
+		err = notFound(req.Name)
+		return
+	}
+
+	if req.MetaGenerationPrecondition != nil &&
+		*req.MetaGenerationPrecondition != current.MetaGeneration {
+		err = preconditionFailed(req.Name)
+		return
+	}
+
+	if layer == 0 {
+		err = b.layers[0].DeleteObject(ctx, req)
+		if err != nil {
+			return
+		}
+	}
+
+	// Hide the name in the lower layers, if any has it. A directory
+	// placeholder's name also stands for the implicit directory of any
+	// objects beneath it.
+	hide := layer != 0
+	for i := 1; i < len(b.layers) && !hide; i++ {
+		hide, err = b.hasName(ctx, b.layers[i], req.Name)
+		if err != nil {
+			return
+		}
+	}
+
+	if !hide {
+		return
+	}
+
+	_, err = b.layers[0].CreateObject(
+		ctx,
+		&gcs.CreateObjectRequest{
+			Name:     whiteoutName(req.Name),
+			Contents: strings.NewReader(""),
+		})
+
+	if err != nil {
+		err = fmt.Errorf("CreateObject: %v", err)
+		return
+	}
+
+	return
+}
+
+// Does the given layer have an object with the given name, or, if it is that
+// of a directory, beneath it?
+func (b *unionBucket) hasName(
+	ctx context.Context,
+	layer gcs.Bucket,
+	name string) (found bool, err error) {
+	if !strings.HasSuffix(name, "/") {
+		_, err = layer.StatObject(ctx, &gcs.StatObjectRequest{Name: name})
+		found = err == nil
+		if isNotFound(err) {
+			err = nil
+		}
+
+		return
+	}
+
+	listing, err := layer.ListObjects(
+		ctx,
+		&gcs.ListObjectsRequest{
+			Prefix:     name,
+			MaxResults: 1,
+		})
+
+	if err != nil {
+		return
+	}
+
+	found = len(listing.Objects) > 0
+	return
+}
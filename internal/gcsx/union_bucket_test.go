@@ -0,0 +1,389 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestUnionBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose listings, for which blocks returns true if it is non-nil,
+// announce that they have started and then wait for release to be closed.
+type listingBarrierBucket struct {
+	gcs.Bucket
+	blocks  func(req *gcs.ListObjectsRequest) bool
+	started chan<- struct{}
+	release <-chan struct{}
+}
+
+func (b *listingBarrierBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	if b.blocks == nil || b.blocks(req) {
+		b.started <- struct{}{}
+		<-b.release
+	}
+
+	listing, err = b.Bucket.ListObjects(ctx, req)
+	return
+}
+
+// Wait for n listings to have started on the channel, returning false if they
+// don't within a few seconds.
+func waitForListings(started <-chan struct{}, n int) bool {
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < n; i++ {
+		select {
+		case <-started:
+		case <-timeout:
+			return false
+		}
+	}
+
+	return true
+}
+
+type UnionBucketTest struct {
+	ctx    context.Context
+	upper  gcs.Bucket
+	lower  gcs.Bucket
+	lowest gcs.Bucket
+	bucket gcs.Bucket
+}
+
+var _ SetUpInterface = &UnionBucketTest{}
+
+func init() { RegisterTestSuite(&UnionBucketTest{}) }
+
+func (t *UnionBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.upper = gcsfake.NewFakeBucket(timeutil.RealClock(), "upper")
+	t.lower = gcsfake.NewFakeBucket(timeutil.RealClock(), "lower")
+	t.lowest = gcsfake.NewFakeBucket(timeutil.RealClock(), "lowest")
+	t.bucket = gcsx.NewUnionBucket(t.upper, []gcs.Bucket{t.lower, t.lowest})
+}
+
+func (t *UnionBucketTest) create(b gcs.Bucket, name string, contents string) {
+	_, err := gcsutil.CreateObject(t.ctx, b, name, []byte(contents))
+	AssertEq(nil, err)
+}
+
+func (t *UnionBucketTest) read(name string) (contents string, err error) {
+	b, err := gcsutil.ReadObject(t.ctx, t.bucket, name)
+	contents = string(b)
+	return
+}
+
+func (t *UnionBucketTest) stat(name string) (o *gcs.Object, err error) {
+	o, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	return
+}
+
+func (t *UnionBucketTest) list(prefix string) (names []string) {
+	objects, runs, err := gcsutil.ListAll(
+		t.ctx,
+		t.bucket,
+		&gcs.ListObjectsRequest{Prefix: prefix, Delimiter: "/"})
+
+	AssertEq(nil, err)
+	for _, o := range objects {
+		names = append(names, o.Name)
+	}
+
+	names = append(names, runs...)
+	return
+}
+
+func (t *UnionBucketTest) delete(name string) {
+	err := t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: name})
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *UnionBucketTest) LayersShowThrough() {
+	t.create(t.upper, "foo", "taco")
+	t.create(t.lower, "bar", "burrito")
+	t.create(t.lowest, "baz", "enchilada")
+
+	for name, want := range map[string]string{
+		"foo": "taco",
+		"bar": "burrito",
+		"baz": "enchilada",
+	} {
+		contents, err := t.read(name)
+		AssertEq(nil, err, "%s", name)
+		ExpectEq(want, contents)
+	}
+
+	_, err := t.read("qux")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *UnionBucketTest) Precedence() {
+	t.create(t.lowest, "foo", "enchilada")
+	t.create(t.lower, "foo", "burrito")
+
+	contents, err := t.read("foo")
+	AssertEq(nil, err)
+	ExpectEq("burrito", contents)
+
+	t.create(t.upper, "foo", "taco")
+	contents, err = t.read("foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+}
+
+func (t *UnionBucketTest) ListingsMerge() {
+	t.create(t.upper, "foo", "")
+	t.create(t.upper, "dir/a", "")
+	t.create(t.lower, "bar", "")
+	t.create(t.lower, "dir/b", "")
+	t.create(t.lowest, "foo", "")
+	t.create(t.lowest, "other/c", "")
+
+	ExpectThat(t.list(""), ElementsAre("bar", "foo", "dir/", "other/"))
+	ExpectThat(t.list("dir/"), ElementsAre("dir/a", "dir/b"))
+}
+
+func (t *UnionBucketTest) DeletingFromLowerLayerHides() {
+	t.create(t.lower, "foo", "burrito")
+	t.create(t.lowest, "foo", "enchilada")
+	t.create(t.lower, "bar", "")
+
+	t.delete("foo")
+
+	_, err := t.stat("foo")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+	ExpectThat(t.list(""), ElementsAre("bar"))
+
+	// The lower layers are untouched.
+	_, err = t.lower.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectEq(nil, err)
+
+	// Creating it again shows the new object, and deleting that hides the
+	// lower layers again.
+	t.create(t.bucket, "foo", "taco")
+	contents, err := t.read("foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+
+	t.delete("foo")
+	_, err = t.stat("foo")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *UnionBucketTest) DeletingUpperRevealsNothingBeneath() {
+	t.create(t.upper, "foo", "taco")
+	t.create(t.lower, "foo", "burrito")
+
+	t.delete("foo")
+
+	_, err := t.stat("foo")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *UnionBucketTest) DeletingDirectoryHidesRun() {
+	t.create(t.lower, "dir/", "")
+	t.create(t.lower, "dir/a", "")
+
+	t.delete("dir/a")
+	t.delete("dir/")
+
+	ExpectThat(t.list(""), ElementsAre())
+}
+
+func (t *UnionBucketTest) RecordsOfDeletionsHidden() {
+	t.create(t.lower, "dir/foo", "")
+	t.delete("dir/foo")
+
+	ExpectThat(t.list(""), ElementsAre("dir/"))
+	ExpectThat(t.list("dir/"), ElementsAre())
+
+	_, err := t.stat(".gcsfuse_whiteouts/dir%2Ffoo")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	_, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		".gcsfuse_whiteouts/bar",
+		[]byte(""))
+
+	ExpectThat(err, Error(HasSubstr("reserved")))
+}
+
+func (t *UnionBucketTest) OverwritingLowerLayer() {
+	t.create(t.lower, "foo", "burrito")
+	o, err := t.stat("foo")
+	AssertEq(nil, err)
+
+	// A precondition on the lower layer's generation is honored.
+	wrong := o.Generation + 1
+	_, err = t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:                   "foo",
+			Contents:               strings.NewReader("taco"),
+			GenerationPrecondition: &wrong,
+		})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+
+	_, err = t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:                   "foo",
+			Contents:               strings.NewReader("taco"),
+			GenerationPrecondition: &o.Generation,
+		})
+
+	AssertEq(nil, err)
+
+	contents, err := t.read("foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+
+	b, err := gcsutil.ReadObject(t.ctx, t.lower, "foo")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(b))
+}
+
+func (t *UnionBucketTest) UpdatingLowerLayerCopiesUp() {
+	t.create(t.lower, "foo", "burrito")
+	o, err := t.stat("foo")
+	AssertEq(nil, err)
+
+	value := "bar"
+	updated, err := t.bucket.UpdateObject(
+		t.ctx,
+		&gcs.UpdateObjectRequest{
+			Name:                       "foo",
+			Generation:                 o.Generation,
+			MetaGenerationPrecondition: &o.MetaGeneration,
+			Metadata:                   map[string]*string{"foo": &value},
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("bar", updated.Metadata["foo"])
+
+	// The copy is in the upper layer.
+	b, err := gcsutil.ReadObject(t.ctx, t.upper, "foo")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(b))
+}
+
+func (t *UnionBucketTest) AppendingToLowerLayer() {
+	t.create(t.lower, "foo", "taco")
+	t.create(t.bucket, "tmp", "burrito")
+
+	foo, err := t.stat("foo")
+	AssertEq(nil, err)
+
+	tmp, err := t.stat("tmp")
+	AssertEq(nil, err)
+
+	_, err = t.bucket.ComposeObjects(
+		t.ctx,
+		&gcs.ComposeObjectsRequest{
+			DstName:                   "foo",
+			DstGenerationPrecondition: &foo.Generation,
+			Sources: []gcs.ComposeSource{
+				{Name: "foo", Generation: foo.Generation},
+				{Name: "tmp", Generation: tmp.Generation},
+			},
+		})
+
+	AssertEq(nil, err)
+
+	contents, err := t.read("foo")
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", contents)
+}
+
+func (t *UnionBucketTest) CopyingFromLowerLayer() {
+	t.create(t.lower, "foo", "taco")
+	foo, err := t.stat("foo")
+	AssertEq(nil, err)
+
+	_, err = t.bucket.CopyObject(
+		t.ctx,
+		&gcs.CopyObjectRequest{
+			SrcName:       "foo",
+			SrcGeneration: foo.Generation,
+			DstName:       "bar",
+		})
+
+	AssertEq(nil, err)
+
+	b, err := gcsutil.ReadObject(t.ctx, t.upper, "bar")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(b))
+}
+
+func (t *UnionBucketTest) LayersListedConcurrently() {
+	t.create(t.upper, "foo", "")
+	t.create(t.lower, "bar", "")
+	t.create(t.lowest, "baz", "")
+
+	started := make(chan struct{}, 100)
+	release := make(chan struct{})
+	barrier := func(b gcs.Bucket) gcs.Bucket {
+		return &listingBarrierBucket{
+			Bucket:  b,
+			started: started,
+			release: release,
+		}
+	}
+
+	bucket := gcsx.NewUnionBucket(
+		barrier(t.upper),
+		[]gcs.Bucket{barrier(t.lower), barrier(t.lowest)})
+
+	listed := make(chan []*gcs.Object, 1)
+	go func() {
+		objects, _, _ := gcsutil.ListAll(t.ctx, bucket, &gcs.ListObjectsRequest{})
+		listed <- objects
+	}()
+
+	// The deleted names and each of the three layers.
+	ok := waitForListings(started, 4)
+	close(release)
+	AssertTrue(ok, "Timed out")
+
+	objects := <-listed
+	AssertEq(3, len(objects))
+	ExpectEq("bar", objects[0].Name)
+	ExpectEq("baz", objects[1].Name)
+	ExpectEq("foo", objects[2].Name)
+}
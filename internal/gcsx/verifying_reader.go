@@ -0,0 +1,135 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// IntegrityError is returned when the contents read for an object don't match
+// the CRC32C recorded by GCS.
+type IntegrityError struct {
+	Name       string
+	Generation int64
+
+	Expected uint32
+	Actual   uint32
+
+	// The number of bytes read, which may differ from the object's size if the
+	// response was cut short or overran.
+	Size uint64
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf(
+		"CRC32C mismatch for %q generation %d: expected 0x%08x, got 0x%08x "+
+			"over %d bytes",
+		e.Name,
+		e.Generation,
+		e.Expected,
+		e.Actual,
+		e.Size)
+}
+
+// NewVerifyingReader wraps a reader for the entire contents of the supplied
+// object, computing their CRC32C as they are read. Once the final byte has
+// been read (or the wrapped reader ends early), the checksum is compared with
+// the object's. On a mismatch the final read returns no data and an
+// *IntegrityError, which is logged, as does every read after it.
+//
+// Data returned before the final read can't be retracted, so callers that
+// must never expose corrupted data should read to the end before using any
+// of it.
+//
+// If the record lacks the object's checksum, as GCS leaves it out for objects
+// encrypted with a customer-supplied key when the key isn't supplied, rc is
+// returned as it is.
+func NewVerifyingReader(
+	rc io.ReadCloser,
+	o *gcs.Object) io.ReadCloser {
+	if o.CustomerKeySHA256 != "" && o.CRC32C == 0 && o.MD5 == nil {
+		return rc
+	}
+
+	return &verifyingReader{
+		wrapped: rc,
+		object:  o,
+	}
+}
+
+type verifyingReader struct {
+	wrapped io.ReadCloser
+	object  *gcs.Object
+
+	crc   uint32
+	count uint64
+
+	// Set once the checksum has been compared.
+	verified bool
+
+	// The integrity error to keep returning, if any.
+	err error
+}
+
+func (r *verifyingReader) Read(p []byte) (n int, err error) {
+	if r.err != nil {
+		err = r.err
+		return
+	}
+
+	n, err = r.wrapped.Read(p)
+	if r.verified {
+		return
+	}
+
+	r.crc = crc32.Update(r.crc, crc32cTable, p[:n])
+	r.count += uint64(n)
+
+	// Wait until we've seen all of the object, or as much as we're going to.
+	if r.count < r.object.Size && err != io.EOF {
+		return
+	}
+
+	r.verified = true
+	if r.crc == r.object.CRC32C && r.count == r.object.Size {
+		return
+	}
+
+	r.err = &IntegrityError{
+		Name:       r.object.Name,
+		Generation: r.object.Generation,
+		Expected:   r.object.CRC32C,
+		Actual:     r.crc,
+		Size:       r.count,
+	}
+
+	log.Printf("Integrity error: %v", r.err)
+
+	n = 0
+	err = r.err
+	return
+}
+
+func (r *verifyingReader) Close() (err error) {
+	err = r.wrapped.Close()
+	return
+}
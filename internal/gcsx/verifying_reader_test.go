@@ -0,0 +1,201 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestVerifyingReader(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type VerifyingReaderTest struct {
+	ctx    context.Context
+	bucket gcs.Bucket
+
+	// A record for an object containing "taco burrito".
+	object *gcs.Object
+}
+
+var _ SetUpInterface = &VerifyingReaderTest{}
+
+func init() { RegisterTestSuite(&VerifyingReaderTest{}) }
+
+func (t *VerifyingReaderTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.bucket = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+
+	t.object, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		"foo",
+		[]byte("taco burrito"))
+
+	AssertEq(nil, err)
+}
+
+// Read the whole of the object described by the supplied record through a
+// verifying reader.
+func (t *VerifyingReaderTest) readAll(o *gcs.Object) (s string, err error) {
+	rc, err := t.bucket.NewReader(
+		t.ctx,
+		&gcs.ReadObjectRequest{
+			Name:       o.Name,
+			Generation: o.Generation,
+		})
+
+	AssertEq(nil, err)
+
+	vr := gcsx.NewVerifyingReader(rc, o)
+	defer vr.Close()
+
+	b, err := ioutil.ReadAll(vr)
+	s = string(b)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *VerifyingReaderTest) ChecksumMatches() {
+	s, err := t.readAll(t.object)
+
+	AssertEq(nil, err)
+	ExpectEq("taco burrito", s)
+}
+
+func (t *VerifyingReaderTest) EmptyObject() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "bar", []byte{})
+	AssertEq(nil, err)
+
+	s, err := t.readAll(o)
+
+	AssertEq(nil, err)
+	ExpectEq("", s)
+}
+
+func (t *VerifyingReaderTest) ChecksumDoesntMatch() {
+	o := *t.object
+	o.CRC32C++
+
+	_, err := t.readAll(&o)
+
+	ExpectThat(err, Error(HasSubstr("CRC32C mismatch")))
+	integrityErr, ok := err.(*gcsx.IntegrityError)
+	AssertTrue(ok, "%T", err)
+	ExpectEq(t.object.CRC32C, integrityErr.Actual)
+	ExpectEq(o.CRC32C, integrityErr.Expected)
+}
+
+func (t *VerifyingReaderTest) ChecksumUnknown() {
+	// A record for an object encrypted with a customer-supplied key, statted
+	// without the key.
+	o := *t.object
+	o.CustomerKeySHA256 = "taco"
+	o.CRC32C = 0
+	o.MD5 = nil
+
+	s, err := t.readAll(&o)
+
+	AssertEq(nil, err)
+	ExpectEq("taco burrito", s)
+}
+
+func (t *VerifyingReaderTest) ContentsTooShort() {
+	// Claim the object is larger than it is.
+	o := *t.object
+	o.Size++
+
+	_, err := t.readAll(&o)
+
+	integrityErr, ok := err.(*gcsx.IntegrityError)
+	AssertTrue(ok, "%T", err)
+	ExpectEq(t.object.Size, integrityErr.Size)
+}
+
+func (t *VerifyingReaderTest) ErrorIsSticky() {
+	o := *t.object
+	o.CRC32C++
+
+	rc, err := t.bucket.NewReader(
+		t.ctx,
+		&gcs.ReadObjectRequest{Name: o.Name})
+
+	AssertEq(nil, err)
+
+	vr := gcsx.NewVerifyingReader(rc, &o)
+	defer vr.Close()
+
+	// The final read yields no data.
+	buf := make([]byte, 1024)
+	n, err := vr.Read(buf)
+
+	ExpectEq(0, n)
+	ExpectThat(err, Error(HasSubstr("CRC32C mismatch")))
+
+	// Nor does any read after it.
+	n, err = vr.Read(buf)
+
+	ExpectEq(0, n)
+	ExpectThat(err, Error(HasSubstr("CRC32C mismatch")))
+}
+
+func (t *VerifyingReaderTest) RandomReader_FullRead() {
+	o := *t.object
+	o.CRC32C++
+
+	rr, err := gcsx.NewRandomReader(&o, t.bucket, nil)
+	AssertEq(nil, err)
+	defer rr.Destroy()
+
+	buf := make([]byte, o.Size)
+	_, err = rr.ReadAt(t.ctx, buf, 0)
+
+	ExpectThat(err, Error(HasSubstr("CRC32C mismatch")))
+}
+
+func (t *VerifyingReaderTest) RandomReader_PartialRead() {
+	// Reads that don't start at the beginning can't be verified, so are served
+	// as is.
+	o := *t.object
+	o.CRC32C++
+
+	rr, err := gcsx.NewRandomReader(&o, t.bucket, nil)
+	AssertEq(nil, err)
+	defer rr.Destroy()
+
+	buf := make([]byte, 7)
+	n, err := rr.ReadAt(t.ctx, buf, 5)
+
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(buf[:n]))
+}
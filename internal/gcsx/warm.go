@@ -0,0 +1,128 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/jacobsa/syncutil"
+	"golang.org/x/net/context"
+)
+
+// Warm reads every object whose name begins with prefix into the supplied
+// cache, as of the generation seen when listing it, reading up to parallelism
+// objects at once. Blocks already cached are not read again. Returns the
+// number of objects warmed and the number of bytes read from GCS, even on
+// error.
+//
+// Objects that don't fit in the cache together push each other out, so the
+// total size of those under prefix should be well within its capacity.
+func Warm(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	cache *BlockCache,
+	prefix string,
+	parallelism int) (n int, bytes int64, err error) {
+	if parallelism < 1 {
+		err = fmt.Errorf("Illegal parallelism: %d", parallelism)
+		return
+	}
+
+	b := syncutil.NewBundle(ctx)
+
+	// List the objects.
+	objects := make(chan *gcs.Object, 100)
+	b.Add(func(ctx context.Context) (err error) {
+		defer close(objects)
+		err = gcsutil.ListPrefix(ctx, bucket, prefix, objects)
+		if err != nil {
+			err = fmt.Errorf("ListPrefix: %v", err)
+			return
+		}
+
+		return
+	})
+
+	// Read them.
+	var warmed, read int64
+	for i := 0; i < parallelism; i++ {
+		b.Add(func(ctx context.Context) (err error) {
+			for o := range objects {
+				var tmp int64
+				tmp, err = warmObject(ctx, bucket, cache, o)
+				atomic.AddInt64(&read, tmp)
+
+				if err != nil {
+					err = fmt.Errorf("warmObject(%q): %v", o.Name, err)
+					return
+				}
+
+				atomic.AddInt64(&warmed, 1)
+			}
+
+			return
+		})
+	}
+
+	err = b.Join()
+	n = int(atomic.LoadInt64(&warmed))
+	bytes = atomic.LoadInt64(&read)
+	return
+}
+
+// Read the blocks of o that are missing from the cache into it, returning the
+// number of bytes read.
+func warmObject(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	cache *BlockCache,
+	o *gcs.Object) (bytes int64, err error) {
+	rr, err := NewRandomReader(o, bucket, nil)
+	if err != nil {
+		err = fmt.Errorf("NewRandomReader: %v", err)
+		return
+	}
+
+	defer rr.Destroy()
+	rr.SetHint(ReadHintSequential)
+
+	// Read one byte of each missing block, which brings in the whole block.
+	// Reading them in order lets consecutive misses share a request.
+	cr := NewCachingReader(rr, cache)
+	var p [1]byte
+	for start := int64(0); start < int64(o.Size); start += BlockSize {
+		if cache.Contains(o.Name, o.Generation, start/BlockSize) {
+			continue
+		}
+
+		_, err = cr.ReadAt(ctx, p[:], start)
+		if err != nil {
+			err = fmt.Errorf("ReadAt: %v", err)
+			return
+		}
+
+		size := int64(o.Size) - start
+		if size > BlockSize {
+			size = BlockSize
+		}
+
+		bytes += size
+	}
+
+	return
+}
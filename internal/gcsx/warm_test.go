@@ -0,0 +1,103 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestWarm(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type WarmTest struct {
+	ctx     context.Context
+	bucket  gcs.Bucket
+	cache   *gcsx.BlockCache
+	objects map[string]*gcs.Object
+}
+
+var _ SetUpInterface = &WarmTest{}
+
+func init() { RegisterTestSuite(&WarmTest{}) }
+
+func (t *WarmTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.bucket = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+	t.cache = gcsx.NewBlockCache(16 * gcsx.BlockSize)
+	t.objects = make(map[string]*gcs.Object)
+
+	contents := map[string][]byte{
+		"foo/":        []byte(""),
+		"foo/bar":     []byte("taco"),
+		"foo/baz/qux": make([]byte, 3*gcsx.BlockSize/2),
+		"other/thing": []byte("queso"),
+	}
+
+	for name, c := range contents {
+		o, err := gcsutil.CreateObject(t.ctx, t.bucket, name, c)
+		AssertEq(nil, err)
+		t.objects[name] = o
+	}
+}
+
+// Is the given block of the named object cached?
+func (t *WarmTest) cached(name string, index int64) bool {
+	return t.cache.Contains(name, t.objects[name].Generation, index)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *WarmTest) WarmsPrefix() {
+	n, bytes, err := gcsx.Warm(t.ctx, t.bucket, t.cache, "foo/", 2)
+
+	AssertEq(nil, err)
+	ExpectEq(3, n)
+	ExpectEq(4+3*gcsx.BlockSize/2, bytes)
+
+	ExpectTrue(t.cached("foo/bar", 0))
+	ExpectTrue(t.cached("foo/baz/qux", 0))
+	ExpectTrue(t.cached("foo/baz/qux", 1))
+	ExpectFalse(t.cached("other/thing", 0))
+}
+
+func (t *WarmTest) SkipsCachedBlocks() {
+	_, _, err := gcsx.Warm(t.ctx, t.bucket, t.cache, "foo/bar", 1)
+	AssertEq(nil, err)
+
+	n, bytes, err := gcsx.Warm(t.ctx, t.bucket, t.cache, "", 4)
+	AssertEq(nil, err)
+	ExpectEq(4, n)
+	ExpectEq(5+3*gcsx.BlockSize/2, bytes)
+}
+
+func (t *WarmTest) IllegalParallelism() {
+	_, _, err := gcsx.Warm(t.ctx, t.bucket, t.cache, "foo/", 0)
+	ExpectThat(err, Error(HasSubstr("parallelism")))
+}
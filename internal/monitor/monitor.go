@@ -0,0 +1,285 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package monitor keeps process-wide metrics about file system operations,
+// GCS requests, and caching, and can export them to Google Cloud Monitoring.
+//
+// Metrics are recorded only by the wrappers that are installed when Enabled
+// returns true at mount time, so there is no cost when monitoring is off.
+package monitor
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+var enabled bool
+var enabledMu sync.RWMutex
+
+// Enable the recording of metrics. This must be called before the file system
+// and bucket are set up in order to have an effect.
+func Enable() {
+	enabledMu.Lock()
+	defer enabledMu.Unlock()
+
+	enabled = true
+}
+
+// Enabled returns true iff Enable has been called.
+func Enabled() bool {
+	enabledMu.RLock()
+	defer enabledMu.RUnlock()
+
+	return enabled
+}
+
+////////////////////////////////////////////////////////////////////////
+// Metrics
+////////////////////////////////////////////////////////////////////////
+
+var (
+	// The number of fuse ops handled, by op name (e.g. "LookUpInode"), and the
+	// number of those that returned an error.
+	FSOps      = newCounter("fs/ops_count", "op")
+	FSOpErrors = newCounter("fs/ops_error_count", "op")
+
+	// The time taken to handle fuse ops, by op name.
+	FSOpLatency = newDistribution("fs/ops_latency", "op")
+
+	// The number of requests sent to GCS, by bucket method name (e.g.
+	// "StatObject"), and the number of those that failed for reasons other than
+	// an object not being found.
+	GCSRequests      = newCounter("gcs/request_count", "method")
+	GCSRequestErrors = newCounter("gcs/request_error_count", "method")
+
+	// The time taken by requests to GCS, by method name. For NewReader this
+	// covers only the time to the first byte.
+	GCSRequestLatency = newDistribution("gcs/request_latency", "method")
+
+	// The number of duplicate reads sent to GCS when the first was slow to
+	// start, under "sent", and the number of those that started first, under
+	// "won". See gcsx.NewHedgingBucket.
+	GCSHedgedReads = newCounter("gcs/hedged_read_count", "outcome")
+
+	// The number of reads that failed in the primary bucket and were retried
+	// against the replica bucket, by whether the replica served them ("served"),
+	// held a different version of the object ("stale"), or failed too
+	// ("failed"). See gcsx.NewReplicaBucket.
+	GCSReplicaReads = newCounter("gcs/replica_read_count", "outcome")
+
+	// The number of changes repeated in the mirror bucket, by whether they
+	// were applied ("applied"), failed ("failed"), or were dropped because too
+	// many were queued ("dropped"). See gcsx.NewMirrorBucket.
+	GCSMirrorChanges = newCounter("gcs/mirror_change_count", "outcome")
+
+	// The number of bucket requests made by the file system, before any caching
+	// is applied. Requests that don't show up in GCSRequests were served from a
+	// cache.
+	BucketRequests = newCounter("bucket/request_count", "method")
+
+	// The number of fuse ops handled and of requests sent to GCS, by the
+	// command name of the process on whose behalf they were made (e.g.
+	// "python3"; see Process), and the number of fuse ops by the UID of that
+	// process.
+	FSOpsByProcess       = newCounter("fs/ops_by_process_count", "process")
+	FSOpsByUser          = newCounter("fs/ops_by_user_count", "uid")
+	GCSRequestsByProcess = newCounter("gcs/request_by_process_count", "process")
+)
+
+// A Counter is a cumulative count, broken down by the value of a single label.
+type Counter struct {
+	Name  string
+	Label string
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	values map[string]int64
+}
+
+var allCounters []*Counter
+
+func newCounter(name string, label string) (c *Counter) {
+	c = &Counter{
+		Name:   name,
+		Label:  label,
+		values: make(map[string]int64),
+	}
+
+	allCounters = append(allCounters, c)
+	return
+}
+
+// Add n to the count for the given label value.
+func (c *Counter) Add(labelValue string, n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[labelValue] += n
+}
+
+// Value returns the current count for the given label value.
+func (c *Counter) Value(labelValue string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.values[labelValue]
+}
+
+// Total returns the sum of the counts for all label values.
+func (c *Counter) Total() (n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, v := range c.values {
+		n += v
+	}
+
+	return
+}
+
+// Snapshot returns the current counts, keyed by label value.
+func (c *Counter) Snapshot() (m map[string]int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m = make(map[string]int64)
+	for k, v := range c.values {
+		m[k] = v
+	}
+
+	return
+}
+
+// StatCacheHits returns the number of stat requests made by the file system
+// that were served by the stat cache rather than being sent to GCS.
+func StatCacheHits() (n int64) {
+	n = BucketRequests.Value("StatObject") - GCSRequests.Value("StatObject")
+	if n < 0 {
+		n = 0
+	}
+
+	return
+}
+
+// Distribution bucketing, in milliseconds: an underflow bucket for values
+// below 1 ms, then buckets doubling in width up to about 17 minutes, then an
+// overflow bucket.
+const (
+	DistributionScale      = 1.0
+	DistributionGrowth     = 2.0
+	DistributionNumBuckets = 20
+)
+
+// DistributionValue summarizes the values recorded for one label value.
+type DistributionValue struct {
+	Count int64
+
+	// The sum of the values, in milliseconds.
+	Sum float64
+
+	// Counts for DistributionNumBuckets+2 buckets, as described above.
+	Buckets []int64
+}
+
+// Mean returns the mean of the recorded values, in milliseconds.
+func (dv *DistributionValue) Mean() float64 {
+	if dv.Count == 0 {
+		return 0
+	}
+
+	return dv.Sum / float64(dv.Count)
+}
+
+// A Distribution records a histogram of durations, broken down by the value of
+// a single label.
+type Distribution struct {
+	Name  string
+	Label string
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	values map[string]*DistributionValue
+}
+
+var allDistributions []*Distribution
+
+func newDistribution(name string, label string) (d *Distribution) {
+	d = &Distribution{
+		Name:   name,
+		Label:  label,
+		values: make(map[string]*DistributionValue),
+	}
+
+	allDistributions = append(allDistributions, d)
+	return
+}
+
+// Record a duration for the given label value.
+func (d *Distribution) Record(labelValue string, v time.Duration) {
+	ms := float64(v) / float64(time.Millisecond)
+
+	// Find the appropriate bucket.
+	bucket := 0
+	for bound := DistributionScale; ms >= bound; bound *= DistributionGrowth {
+		bucket++
+		if bucket == DistributionNumBuckets+1 {
+			break
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	dv := d.values[labelValue]
+	if dv == nil {
+		dv = &DistributionValue{
+			Buckets: make([]int64, DistributionNumBuckets+2),
+		}
+
+		d.values[labelValue] = dv
+	}
+
+	dv.Count++
+	dv.Sum += ms
+	dv.Buckets[bucket]++
+}
+
+// Snapshot returns a copy of the current distributions, keyed by label value.
+func (d *Distribution) Snapshot() (m map[string]DistributionValue) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	m = make(map[string]DistributionValue)
+	for k, v := range d.values {
+		c := *v
+		c.Buckets = append([]int64(nil), v.Buckets...)
+		m[k] = c
+	}
+
+	return
+}
+
+// Return the keys of the map in sorted order, so that exports are
+// deterministic.
+func sortedKeys(m map[string]int64) (keys []string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return
+}
@@ -0,0 +1,220 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/monitor"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestMonitor(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Metrics
+////////////////////////////////////////////////////////////////////////
+
+type MetricsTest struct {
+}
+
+func init() { RegisterTestSuite(&MetricsTest{}) }
+
+func (t *MetricsTest) Counter() {
+	monitor.FSOps.Add("MetricsTest.Counter", 1)
+	monitor.FSOps.Add("MetricsTest.Counter", 2)
+
+	ExpectEq(3, monitor.FSOps.Value("MetricsTest.Counter"))
+	ExpectEq(3, monitor.FSOps.Snapshot()["MetricsTest.Counter"])
+	ExpectEq(0, monitor.FSOps.Value("MetricsTest.Other"))
+}
+
+func (t *MetricsTest) DistributionBuckets() {
+	const label = "MetricsTest.DistributionBuckets"
+	d := monitor.FSOpLatency
+
+	d.Record(label, 500*time.Microsecond)
+	d.Record(label, time.Millisecond)
+	d.Record(label, 3*time.Millisecond)
+	d.Record(label, 24*time.Hour)
+
+	dv := d.Snapshot()[label]
+	ExpectEq(4, dv.Count)
+	AssertEq(monitor.DistributionNumBuckets+2, len(dv.Buckets))
+
+	// Underflow, [1, 2), [2, 4), and overflow.
+	ExpectEq(1, dv.Buckets[0])
+	ExpectEq(1, dv.Buckets[1])
+	ExpectEq(1, dv.Buckets[2])
+	ExpectEq(1, dv.Buckets[monitor.DistributionNumBuckets+1])
+
+	ExpectThat(dv.Mean(), GreaterThan(float64(time.Hour/time.Millisecond)))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Stackdriver export
+////////////////////////////////////////////////////////////////////////
+
+type timeSeries struct {
+	Metric struct {
+		Type   string            `json:"type"`
+		Labels map[string]string `json:"labels"`
+	} `json:"metric"`
+	Resource struct {
+		Type   string            `json:"type"`
+		Labels map[string]string `json:"labels"`
+	} `json:"resource"`
+	MetricKind string `json:"metricKind"`
+	ValueType  string `json:"valueType"`
+	Points     []struct {
+		Value struct {
+			Int64Value        string `json:"int64Value"`
+			DistributionValue *struct {
+				Count        string   `json:"count"`
+				BucketCounts []string `json:"bucketCounts"`
+			} `json:"distributionValue"`
+		} `json:"value"`
+	} `json:"points"`
+}
+
+type StackdriverTest struct {
+	server *httptest.Server
+
+	mu     sync.Mutex
+	paths  []string
+	series []timeSeries
+}
+
+var _ SetUpInterface = &StackdriverTest{}
+var _ TearDownInterface = &StackdriverTest{}
+
+func init() { RegisterTestSuite(&StackdriverTest{}) }
+
+func (t *StackdriverTest) SetUp(ti *TestInfo) {
+	t.server = httptest.NewServer(http.HandlerFunc(t.handle))
+}
+
+func (t *StackdriverTest) TearDown() {
+	t.server.Close()
+}
+
+func (t *StackdriverTest) handle(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		TimeSeries []timeSeries `json:"timeSeries"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.paths = append(t.paths, r.URL.Path)
+	t.series = append(t.series, req.TimeSeries...)
+}
+
+// Run an exporter until it has written once, and return the series for the
+// given metric type suffix and label value.
+func (t *StackdriverTest) export(
+	metricType string,
+	labelValue string) (found []timeSeries) {
+	e, err := monitor.NewStackdriverExporter(monitor.StackdriverConfig{
+		Client:   http.DefaultClient,
+		Project:  "some-project",
+		Labels:   map[string]string{"bucket": "some-bucket"},
+		Interval: time.Hour,
+		Endpoint: t.server.URL + "/v3/",
+	})
+
+	AssertEq(nil, err)
+	e.Stop()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, s := range t.series {
+		if s.Metric.Type != "custom.googleapis.com/gcsfuse/"+metricType {
+			continue
+		}
+
+		for _, v := range s.Metric.Labels {
+			if v == labelValue {
+				found = append(found, s)
+				break
+			}
+		}
+	}
+
+	return
+}
+
+func (t *StackdriverTest) MissingProject() {
+	_, err := monitor.NewStackdriverExporter(monitor.StackdriverConfig{
+		Client: http.DefaultClient,
+	})
+
+	ExpectThat(err, Error(HasSubstr("Project")))
+}
+
+func (t *StackdriverTest) Counter() {
+	monitor.GCSRequests.Add("StackdriverTest.Counter", 17)
+
+	series := t.export("gcs/request_count", "StackdriverTest.Counter")
+	AssertEq(1, len(series))
+	s := series[0]
+
+	ExpectThat(t.paths, Contains("/v3/projects/some-project/timeSeries"))
+	ExpectEq("StackdriverTest.Counter", s.Metric.Labels["method"])
+	ExpectEq("some-bucket", s.Metric.Labels["bucket"])
+	ExpectEq("global", s.Resource.Type)
+	ExpectEq("some-project", s.Resource.Labels["project_id"])
+	ExpectEq("CUMULATIVE", s.MetricKind)
+	ExpectEq("INT64", s.ValueType)
+
+	AssertEq(1, len(s.Points))
+	ExpectEq("17", s.Points[0].Value.Int64Value)
+}
+
+func (t *StackdriverTest) Distribution() {
+	monitor.GCSRequestLatency.Record(
+		"StackdriverTest.Distribution",
+		3*time.Millisecond)
+
+	series := t.export("gcs/request_latency", "StackdriverTest.Distribution")
+	AssertEq(1, len(series))
+	s := series[0]
+
+	ExpectEq("DISTRIBUTION", s.ValueType)
+	AssertEq(1, len(s.Points))
+
+	dv := s.Points[0].Value.DistributionValue
+	AssertNe(nil, dv)
+	ExpectEq("1", dv.Count)
+	AssertEq(monitor.DistributionNumBuckets+2, len(dv.BucketCounts))
+	ExpectEq("1", dv.BucketCounts[2])
+}
+
+func (t *StackdriverTest) StatCacheHits() {
+	series := t.export("stat_cache/hit_count", "stat")
+	ExpectEq(1, len(series))
+}
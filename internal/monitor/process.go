@@ -0,0 +1,41 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"golang.org/x/net/context"
+)
+
+// The process label given to work that gcsfuse does on its own behalf, such
+// as writing back dirty files in the background.
+const SelfProcess = "gcsfuse"
+
+type processKey struct{}
+
+// WithProcess returns a context that attributes the requests made with it to
+// the named process, for the metrics labelled by process.
+func WithProcess(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, processKey{}, name)
+}
+
+// Process returns the name of the process given to WithProcess for the
+// supplied context, or SelfProcess if there is none.
+func Process(ctx context.Context) string {
+	if name, ok := ctx.Value(processKey{}).(string); ok {
+		return name
+	}
+
+	return SelfProcess
+}
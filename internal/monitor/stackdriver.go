@@ -0,0 +1,351 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The OAuth scope required for writing time series.
+const MonitoringWriteScope = "https://www.googleapis.com/auth/monitoring.write"
+
+const (
+	// The Cloud Monitoring API root.
+	defaultEndpoint = "https://monitoring.googleapis.com/v3/"
+
+	// The prefix for the metric types we write.
+	metricTypePrefix = "custom.googleapis.com/gcsfuse/"
+
+	// How often we write points. Cloud Monitoring rejects writes to a time
+	// series more often than every few seconds, so this shouldn't be too small.
+	defaultExportInterval = time.Minute
+
+	// The maximum number of time series in a single CreateTimeSeries request.
+	maxSeriesPerRequest = 200
+)
+
+type StackdriverConfig struct {
+	// An HTTP client that adds credentials with MonitoringWriteScope to its
+	// requests. Required.
+	Client *http.Client
+
+	// The project to which metrics are written. Required.
+	Project string
+
+	// Labels attached to every time series, e.g. the bucket name and mount
+	// point.
+	Labels map[string]string
+
+	// The period between writes. Defaults to one minute.
+	Interval time.Duration
+
+	// The API root. Defaults to the public Cloud Monitoring endpoint.
+	Endpoint string
+
+	// If non-nil, where to log errors writing metrics.
+	Logger *log.Logger
+}
+
+// A StackdriverExporter periodically writes the current value of all metrics
+// in this package to Google Cloud Monitoring as custom metrics.
+type StackdriverExporter struct {
+	cfg   StackdriverConfig
+	start time.Time
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// NewStackdriverExporter starts a goroutine that exports metrics according to
+// the supplied config. The caller must call Stop when finished, which writes a
+// final set of points.
+func NewStackdriverExporter(
+	cfg StackdriverConfig) (e *StackdriverExporter, err error) {
+	if cfg.Client == nil {
+		err = errors.New("Client must be set")
+		return
+	}
+
+	if cfg.Project == "" {
+		err = errors.New("Project must be set")
+		return
+	}
+
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultExportInterval
+	}
+
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = defaultEndpoint
+	}
+
+	e = &StackdriverExporter{
+		cfg:     cfg,
+		start:   time.Now(),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	go e.loop()
+	return
+}
+
+// Stop writes the final values of all metrics and shuts down the exporter.
+func (e *StackdriverExporter) Stop() {
+	close(e.stop)
+	<-e.stopped
+}
+
+func (e *StackdriverExporter) loop() {
+	defer close(e.stopped)
+
+	ticker := time.NewTicker(e.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.exportAndLog()
+
+		case <-e.stop:
+			e.exportAndLog()
+			return
+		}
+	}
+}
+
+func (e *StackdriverExporter) exportAndLog() {
+	err := e.export(time.Now())
+	if err != nil && e.cfg.Logger != nil {
+		e.cfg.Logger.Printf("Exporting metrics: %v", err)
+	}
+}
+
+// Write the current value of each metric.
+func (e *StackdriverExporter) export(now time.Time) (err error) {
+	series := e.makeTimeSeries(now)
+
+	for len(series) > 0 {
+		n := len(series)
+		if n > maxSeriesPerRequest {
+			n = maxSeriesPerRequest
+		}
+
+		err = e.write(series[:n])
+		if err != nil {
+			return
+		}
+
+		series = series[n:]
+	}
+
+	return
+}
+
+func (e *StackdriverExporter) write(series []sdTimeSeries) (err error) {
+	body, err := json.Marshal(&sdCreateTimeSeriesRequest{TimeSeries: series})
+	if err != nil {
+		err = fmt.Errorf("Marshal: %v", err)
+		return
+	}
+
+	url := fmt.Sprintf("%sprojects/%s/timeSeries", e.cfg.Endpoint, e.cfg.Project)
+	resp, err := e.cfg.Client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		err = fmt.Errorf("Post: %v", err)
+		return
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		err = fmt.Errorf("CreateTimeSeries returned %s: %s", resp.Status, msg)
+		return
+	}
+
+	return
+}
+
+func (e *StackdriverExporter) makeTimeSeries(
+	now time.Time) (series []sdTimeSeries) {
+	interval := sdInterval{
+		StartTime: e.start.UTC().Format(time.RFC3339Nano),
+		EndTime:   now.UTC().Format(time.RFC3339Nano),
+	}
+
+	resource := sdResource{
+		Type:   "global",
+		Labels: map[string]string{"project_id": e.cfg.Project},
+	}
+
+	metric := func(name string, label string, value string) sdMetric {
+		labels := map[string]string{label: value}
+		for k, v := range e.cfg.Labels {
+			labels[k] = v
+		}
+
+		return sdMetric{
+			Type:   metricTypePrefix + name,
+			Labels: labels,
+		}
+	}
+
+	for _, c := range allCounters {
+		values := c.Snapshot()
+		for _, k := range sortedKeys(values) {
+			s := strconv.FormatInt(values[k], 10)
+			series = append(series, sdTimeSeries{
+				Metric:     metric(c.Name, c.Label, k),
+				Resource:   resource,
+				MetricKind: "CUMULATIVE",
+				ValueType:  "INT64",
+				Points: []sdPoint{
+					{Interval: interval, Value: sdValue{Int64Value: &s}},
+				},
+			})
+		}
+	}
+
+	// Stat cache hits aren't counted directly; see StatCacheHits.
+	{
+		s := strconv.FormatInt(StatCacheHits(), 10)
+		series = append(series, sdTimeSeries{
+			Metric:     metric("stat_cache/hit_count", "cache", "stat"),
+			Resource:   resource,
+			MetricKind: "CUMULATIVE",
+			ValueType:  "INT64",
+			Points: []sdPoint{
+				{Interval: interval, Value: sdValue{Int64Value: &s}},
+			},
+		})
+	}
+
+	for _, d := range allDistributions {
+		values := d.Snapshot()
+
+		var keys []string
+		for k := range values {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			dv := values[k]
+			var counts []string
+			for _, c := range dv.Buckets {
+				counts = append(counts, strconv.FormatInt(c, 10))
+			}
+
+			series = append(series, sdTimeSeries{
+				Metric:     metric(d.Name, d.Label, k),
+				Resource:   resource,
+				MetricKind: "CUMULATIVE",
+				ValueType:  "DISTRIBUTION",
+				Unit:       "ms",
+				Points: []sdPoint{
+					{
+						Interval: interval,
+						Value: sdValue{
+							DistributionValue: &sdDistribution{
+								Count: strconv.FormatInt(dv.Count, 10),
+								Mean:  dv.Mean(),
+								BucketOptions: sdBucketOptions{
+									ExponentialBuckets: sdExponentialBuckets{
+										NumFiniteBuckets: DistributionNumBuckets,
+										GrowthFactor:     DistributionGrowth,
+										Scale:            DistributionScale,
+									},
+								},
+								BucketCounts: counts,
+							},
+						},
+					},
+				},
+			})
+		}
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Cloud Monitoring JSON encoding
+////////////////////////////////////////////////////////////////////////
+
+type sdCreateTimeSeriesRequest struct {
+	TimeSeries []sdTimeSeries `json:"timeSeries"`
+}
+
+type sdTimeSeries struct {
+	Metric     sdMetric   `json:"metric"`
+	Resource   sdResource `json:"resource"`
+	MetricKind string     `json:"metricKind"`
+	ValueType  string     `json:"valueType"`
+	Unit       string     `json:"unit,omitempty"`
+	Points     []sdPoint  `json:"points"`
+}
+
+type sdMetric struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type sdResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels"`
+}
+
+type sdPoint struct {
+	Interval sdInterval `json:"interval"`
+	Value    sdValue    `json:"value"`
+}
+
+type sdInterval struct {
+	StartTime string `json:"startTime"`
+	EndTime   string `json:"endTime"`
+}
+
+type sdValue struct {
+	Int64Value        *string         `json:"int64Value,omitempty"`
+	DistributionValue *sdDistribution `json:"distributionValue,omitempty"`
+}
+
+type sdDistribution struct {
+	Count         string          `json:"count"`
+	Mean          float64         `json:"mean"`
+	BucketOptions sdBucketOptions `json:"bucketOptions"`
+	BucketCounts  []string        `json:"bucketCounts"`
+}
+
+type sdBucketOptions struct {
+	ExponentialBuckets sdExponentialBuckets `json:"exponentialBuckets"`
+}
+
+type sdExponentialBuckets struct {
+	NumFiniteBuckets int     `json:"numFiniteBuckets"`
+	GrowthFactor     float64 `json:"growthFactor"`
+	Scale            float64 `json:"scale"`
+}
@@ -0,0 +1,368 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package profile supports named sets of tuning settings ("profiles") read
+// from a config file, one of which is active at a time and which may be
+// switched between while the file system is mounted.
+//
+// A config file is JSON of the following form, where each profile sets any
+// subset of the tunable settings and the rest take their values from flags:
+//
+//     {
+//       "profile": "interactive",
+//       "debug": ["gcs"],
+//       "storage_classes": {"archive/": "COLDLINE"},
+//       "profiles": {
+//         "training": {
+//           "stat_cache_ttl": "1h",
+//           "type_cache_ttl": "1h",
+//           "limit_ops_per_sec": -1
+//         },
+//         "interactive": {
+//           "stat_cache_ttl": "0s",
+//           "type_cache_ttl": "0s"
+//         }
+//       }
+//     }
+package profile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The name of the profile consisting of the settings given by flags alone.
+const DefaultProfileName = "default"
+
+// Settings are the tunables that may be changed by switching profiles.
+type Settings struct {
+	// How long to cache StatObject results and inode attributes. Zero gives the
+	// strongest consistency.
+	StatCacheTTL time.Duration
+
+	// How many entries the stat cache may hold.
+	StatCacheCapacity int
+
+	// How long to cache name -> file/dir mappings in directory inodes.
+	TypeCacheTTL time.Duration
+
+	// Limits on GCS request rate and egress bandwidth, as for the corresponding
+	// flags. Negative values mean no limit.
+	OpRateLimitHz                      float64
+	EgressBandwidthLimitBytesPerSecond float64
+
+	// The window over which those limits are enforced, which bounds bursts.
+	RateLimitWindow time.Duration
+}
+
+// A Duration is a time.Duration that is represented in JSON as a string
+// understood by time.ParseDuration, e.g. "1m30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) (err error) {
+	var s string
+	err = json.Unmarshal(b, &s)
+	if err != nil {
+		err = fmt.Errorf("Durations must be strings like \"1m\": %v", err)
+		return
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return
+	}
+
+	*d = Duration(parsed)
+	return
+}
+
+// A Profile overrides some subset of the settings. Nil fields are left alone.
+type Profile struct {
+	StatCacheTTL                       *Duration `json:"stat_cache_ttl"`
+	StatCacheCapacity                  *int      `json:"stat_cache_capacity"`
+	TypeCacheTTL                       *Duration `json:"type_cache_ttl"`
+	OpRateLimitHz                      *float64  `json:"limit_ops_per_sec"`
+	EgressBandwidthLimitBytesPerSecond *float64  `json:"limit_bytes_per_sec"`
+	RateLimitWindow                    *Duration `json:"limit_window"`
+}
+
+// Apply returns the supplied settings with the overrides in the profile
+// applied.
+func (p *Profile) Apply(s Settings) Settings {
+	if p.StatCacheTTL != nil {
+		s.StatCacheTTL = time.Duration(*p.StatCacheTTL)
+	}
+
+	if p.StatCacheCapacity != nil {
+		s.StatCacheCapacity = *p.StatCacheCapacity
+	}
+
+	if p.TypeCacheTTL != nil {
+		s.TypeCacheTTL = time.Duration(*p.TypeCacheTTL)
+	}
+
+	if p.OpRateLimitHz != nil {
+		s.OpRateLimitHz = *p.OpRateLimitHz
+	}
+
+	if p.EgressBandwidthLimitBytesPerSecond != nil {
+		s.EgressBandwidthLimitBytesPerSecond = *p.EgressBandwidthLimitBytesPerSecond
+	}
+
+	if p.RateLimitWindow != nil {
+		s.RateLimitWindow = time.Duration(*p.RateLimitWindow)
+	}
+
+	return s
+}
+
+// Config is the contents of a config file.
+type Config struct {
+	// The profile active at mount time, or once the config is reloaded. If
+	// empty, the default profile.
+	Profile string `json:"profile"`
+
+	// If non-nil, the names of the debug loggers (e.g. "fuse" and "gcs") that
+	// are to be on, with the rest off. Not interpreted by this package.
+	Debug []string `json:"debug"`
+
+	Profiles map[string]*Profile `json:"profiles"`
+
+	// Storage classes for new objects whose names, relative to the root of the
+	// mount, start with the given prefixes, overriding --storage-class. Read
+	// only at mount time, and not interpreted by this package.
+	StorageClasses map[string]string `json:"storage_classes"`
+}
+
+// ReadConfig parses the config file at the given path.
+func ReadConfig(path string) (cfg *Config, err error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("ReadFile: %v", err)
+		return
+	}
+
+	cfg = new(Config)
+	err = json.Unmarshal(contents, cfg)
+	if err != nil {
+		err = fmt.Errorf("Parsing %s: %v", path, err)
+		return
+	}
+
+	if _, ok := cfg.Profiles[DefaultProfileName]; ok {
+		err = fmt.Errorf("The profile name %q is reserved", DefaultProfileName)
+		return
+	}
+
+	for name, p := range cfg.Profiles {
+		if p == nil {
+			err = fmt.Errorf("Profile %q is null", name)
+			return
+		}
+	}
+
+	if cfg.Profile != "" && cfg.Profiles[cfg.Profile] == nil {
+		err = fmt.Errorf("Unknown active profile %q", cfg.Profile)
+		return
+	}
+
+	return
+}
+
+// A Manager keeps track of the active profile and tells subscribers when it
+// changes. Safe for concurrent access.
+type Manager struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	base Settings
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	// Held while switching or reloading, so that subscribers see changes one at
+	// a time and in order.
+	switchMu sync.Mutex
+
+	mu sync.Mutex
+
+	// Replaced, not modified, by Reload.
+	//
+	// GUARDED_BY(mu)
+	profiles map[string]*Profile
+
+	// GUARDED_BY(mu)
+	active string
+
+	// GUARDED_BY(mu)
+	current Settings
+
+	// GUARDED_BY(mu)
+	subscribers []func(Settings)
+}
+
+// NewManager creates a manager for the profiles in the supplied config, which
+// may be nil, applied on top of the given base settings. The active profile is
+// initially the one named by the config.
+func NewManager(base Settings, cfg *Config) (m *Manager, err error) {
+	m = &Manager{
+		base:     base,
+		profiles: make(map[string]*Profile),
+		active:   DefaultProfileName,
+		current:  base,
+	}
+
+	if cfg == nil {
+		return
+	}
+
+	for name, p := range cfg.Profiles {
+		m.profiles[name] = p
+	}
+
+	if cfg.Profile != "" {
+		p := m.profiles[cfg.Profile]
+		if p == nil {
+			err = fmt.Errorf("Unknown profile %q", cfg.Profile)
+			return
+		}
+
+		m.active = cfg.Profile
+		m.current = p.Apply(base)
+	}
+
+	return
+}
+
+// Current returns the settings of the active profile.
+func (m *Manager) Current() Settings {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.current
+}
+
+// Active returns the name of the active profile.
+func (m *Manager) Active() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.active
+}
+
+// Names returns the names of all profiles, including the default, in sorted
+// order.
+func (m *Manager) Names() (names []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names = append(names, DefaultProfileName)
+	for name := range m.profiles {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return
+}
+
+// Subscribe arranges for f to be called with the new settings each time the
+// active profile is switched or the config reloaded. f must not call Switch
+// or Reload.
+func (m *Manager) Subscribe(f func(Settings)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.subscribers = append(m.subscribers, f)
+}
+
+// Switch makes the named profile active, returning once all subscribers have
+// been told of the new settings.
+func (m *Manager) Switch(name string) (err error) {
+	m.switchMu.Lock()
+	defer m.switchMu.Unlock()
+
+	m.mu.Lock()
+	profiles := m.profiles
+	m.mu.Unlock()
+
+	err = m.activate(profiles, name)
+	return
+}
+
+// Reload replaces the profiles with those of the supplied config, and makes
+// active the profile it names, as at mount time, returning once all
+// subscribers have been told of the new settings. The base settings are
+// unchanged. On error, nothing changes.
+func (m *Manager) Reload(cfg *Config) (err error) {
+	profiles := make(map[string]*Profile)
+	for name, p := range cfg.Profiles {
+		profiles[name] = p
+	}
+
+	name := cfg.Profile
+	if name == "" {
+		name = DefaultProfileName
+	}
+
+	m.switchMu.Lock()
+	defer m.switchMu.Unlock()
+
+	err = m.activate(profiles, name)
+	return
+}
+
+// Make the named profile among the supplied ones active, and tell the
+// subscribers.
+//
+// LOCKS_REQUIRED(m.switchMu)
+// LOCKS_EXCLUDED(m.mu)
+func (m *Manager) activate(
+	profiles map[string]*Profile,
+	name string) (err error) {
+	s := m.base
+	if name != DefaultProfileName {
+		p := profiles[name]
+		if p == nil {
+			err = fmt.Errorf("Unknown profile %q", name)
+			return
+		}
+
+		s = p.Apply(m.base)
+	}
+
+	if s.StatCacheCapacity <= 0 && s.StatCacheTTL != 0 {
+		err = errors.New("stat_cache_capacity must be positive")
+		return
+	}
+
+	m.mu.Lock()
+	m.profiles = profiles
+	m.active = name
+	m.current = s
+	subscribers := m.subscribers
+	m.mu.Unlock()
+
+	for _, f := range subscribers {
+		f(s)
+	}
+
+	return
+}
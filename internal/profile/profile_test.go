@@ -0,0 +1,238 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/profile"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestProfile(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+var base = profile.Settings{
+	StatCacheTTL:                       time.Minute,
+	StatCacheCapacity:                  4096,
+	TypeCacheTTL:                       time.Minute,
+	OpRateLimitHz:                      -1,
+	EgressBandwidthLimitBytesPerSecond: -1,
+}
+
+const configContents = `
+{
+  "profile": "training",
+  "profiles": {
+    "training": {
+      "stat_cache_ttl": "1h",
+      "type_cache_ttl": "2h",
+      "limit_ops_per_sec": 100
+    },
+    "interactive": {
+      "stat_cache_ttl": "0s"
+    }
+  }
+}
+`
+
+type ProfileTest struct {
+	files []string
+}
+
+var _ TearDownInterface = &ProfileTest{}
+
+func init() { RegisterTestSuite(&ProfileTest{}) }
+
+func (t *ProfileTest) TearDown() {
+	for _, f := range t.files {
+		os.Remove(f)
+	}
+}
+
+// Write the contents to a temporary file and read a config from it.
+func (t *ProfileTest) readConfig(contents string) (
+	cfg *profile.Config,
+	err error) {
+	f, err := ioutil.TempFile("", "profile_test")
+	AssertEq(nil, err)
+	t.files = append(t.files, f.Name())
+
+	_, err = f.Write([]byte(contents))
+	AssertEq(nil, err)
+	AssertEq(nil, f.Close())
+
+	cfg, err = profile.ReadConfig(f.Name())
+	return
+}
+
+func (t *ProfileTest) newManager() (m *profile.Manager) {
+	cfg, err := t.readConfig(configContents)
+	AssertEq(nil, err)
+
+	m, err = profile.NewManager(base, cfg)
+	AssertEq(nil, err)
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ProfileTest) NoConfig() {
+	m, err := profile.NewManager(base, nil)
+	AssertEq(nil, err)
+
+	ExpectEq(profile.DefaultProfileName, m.Active())
+	ExpectTrue(m.Current() == base)
+	ExpectThat(m.Names(), ElementsAre(profile.DefaultProfileName))
+}
+
+func (t *ProfileTest) InitialProfile() {
+	m := t.newManager()
+
+	ExpectEq("training", m.Active())
+	ExpectThat(m.Names(), ElementsAre("default", "interactive", "training"))
+
+	s := m.Current()
+	ExpectEq(time.Hour, s.StatCacheTTL)
+	ExpectEq(2*time.Hour, s.TypeCacheTTL)
+	ExpectEq(100, s.OpRateLimitHz)
+
+	// Unset fields come from the base settings.
+	ExpectEq(4096, s.StatCacheCapacity)
+	ExpectEq(-1, s.EgressBandwidthLimitBytesPerSecond)
+}
+
+func (t *ProfileTest) Switch() {
+	m := t.newManager()
+
+	var seen []profile.Settings
+	m.Subscribe(func(s profile.Settings) { seen = append(seen, s) })
+
+	// Switch to another profile. Overrides are relative to the base settings,
+	// not the previous profile.
+	err := m.Switch("interactive")
+	AssertEq(nil, err)
+
+	ExpectEq("interactive", m.Active())
+	AssertEq(1, len(seen))
+	ExpectEq(0, seen[0].StatCacheTTL)
+	ExpectEq(time.Minute, seen[0].TypeCacheTTL)
+	ExpectEq(-1, seen[0].OpRateLimitHz)
+	ExpectTrue(m.Current() == seen[0])
+
+	// And back to the default.
+	err = m.Switch(profile.DefaultProfileName)
+	AssertEq(nil, err)
+
+	AssertEq(2, len(seen))
+	ExpectTrue(seen[1] == base)
+}
+
+func (t *ProfileTest) SwitchToUnknownProfile() {
+	m := t.newManager()
+
+	called := false
+	m.Subscribe(func(s profile.Settings) { called = true })
+
+	err := m.Switch("taco")
+	ExpectThat(err, Error(HasSubstr("Unknown profile")))
+	ExpectEq("training", m.Active())
+	ExpectFalse(called)
+}
+
+func (t *ProfileTest) Reload() {
+	m := t.newManager()
+
+	var seen []profile.Settings
+	m.Subscribe(func(s profile.Settings) { seen = append(seen, s) })
+
+	// The new config's profile becomes active, with its new settings.
+	cfg, err := t.readConfig(`
+{
+  "profile": "interactive",
+  "profiles": {
+    "interactive": {"type_cache_ttl": "5s"},
+    "batch": {}
+  }
+}`)
+	AssertEq(nil, err)
+
+	err = m.Reload(cfg)
+	AssertEq(nil, err)
+
+	ExpectEq("interactive", m.Active())
+	ExpectThat(m.Names(), ElementsAre("batch", "default", "interactive"))
+
+	AssertEq(1, len(seen))
+	ExpectEq(time.Minute, seen[0].StatCacheTTL)
+	ExpectEq(5*time.Second, seen[0].TypeCacheTTL)
+
+	// Without a profile named, the default profile becomes active.
+	cfg, err = t.readConfig(`{"profiles": {}}`)
+	AssertEq(nil, err)
+
+	err = m.Reload(cfg)
+	AssertEq(nil, err)
+
+	ExpectEq(profile.DefaultProfileName, m.Active())
+	AssertEq(2, len(seen))
+	ExpectTrue(seen[1] == base)
+}
+
+func (t *ProfileTest) ReloadBadSettings() {
+	m := t.newManager()
+
+	cfg, err := t.readConfig(`
+{
+  "profile": "p",
+  "profiles": {"p": {"stat_cache_capacity": 0}}
+}`)
+	AssertEq(nil, err)
+
+	err = m.Reload(cfg)
+	ExpectThat(err, Error(HasSubstr("stat_cache_capacity")))
+
+	// Nothing changed.
+	ExpectEq("training", m.Active())
+	ExpectThat(m.Names(), ElementsAre("default", "interactive", "training"))
+}
+
+func (t *ProfileTest) BadDuration() {
+	_, err := t.readConfig(`{"profiles": {"p": {"stat_cache_ttl": 17}}}`)
+	ExpectThat(err, Error(HasSubstr("Durations must be strings")))
+
+	_, err = t.readConfig(`{"profiles": {"p": {"stat_cache_ttl": "taco"}}}`)
+	ExpectThat(err, Error(HasSubstr("duration")))
+}
+
+func (t *ProfileTest) UnknownActiveProfile() {
+	_, err := t.readConfig(`{"profile": "taco", "profiles": {}}`)
+	ExpectThat(err, Error(HasSubstr("Unknown active profile")))
+}
+
+func (t *ProfileTest) ReservedName() {
+	_, err := t.readConfig(`{"profiles": {"default": {}}}`)
+	ExpectThat(err, Error(HasSubstr("reserved")))
+}
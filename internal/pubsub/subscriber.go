@@ -0,0 +1,330 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pubsub receives the notifications that GCS publishes to Cloud
+// Pub/Sub when objects in a bucket change, so that caches of them can be
+// invalidated.
+//
+// See https://cloud.google.com/storage/docs/pubsub-notifications for how to
+// have a bucket publish notifications to a topic. The subscriber pulls them
+// from a subscription to that topic, which should not be shared with other
+// consumers.
+package pubsub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// The OAuth scope required for pulling from a subscription.
+const Scope = "https://www.googleapis.com/auth/pubsub"
+
+const (
+	// The Cloud Pub/Sub API root.
+	defaultEndpoint = "https://pubsub.googleapis.com/v1/"
+
+	// The most messages to ask for in one pull.
+	maxMessagesPerPull = 1000
+
+	// The bounds on how long to wait before pulling again after an error.
+	minRetryDelay = time.Second
+	maxRetryDelay = time.Minute
+)
+
+// A Change describes a notification that an object was created, deleted, or
+// had its metadata updated.
+type Change struct {
+	// The name of the object, relative to Config.Prefix.
+	Name string
+
+	// The generation the notification is about.
+	Generation int64
+
+	// Whether the generation was deleted or archived, rather than created or
+	// updated.
+	Removed bool
+}
+
+type Config struct {
+	// An HTTP client that adds credentials with Scope to its requests.
+	// Required.
+	Client *http.Client
+
+	// The full name of the subscription from which to pull, of the form
+	// "projects/<project>/subscriptions/<name>". Required.
+	Subscription string
+
+	// The bucket whose notifications to pass on. Those about other buckets are
+	// acknowledged and ignored. Required.
+	Bucket string
+
+	// If non-empty, only notifications about objects whose names begin with
+	// this prefix are passed on, with the prefix removed.
+	Prefix string
+
+	// The API root. Defaults to the public Cloud Pub/Sub endpoint.
+	Endpoint string
+
+	// If non-nil, where to log errors pulling notifications.
+	Logger *log.Logger
+}
+
+// A Subscriber pulls GCS notifications from a Cloud Pub/Sub subscription and
+// hands the changes they describe to each function subscribed.
+type Subscriber struct {
+	cfg Config
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	handlers []func(Change)
+
+	cancel  func()
+	stopped chan struct{}
+}
+
+// NewSubscriber creates a subscriber according to the supplied config. It
+// does nothing until Start is called.
+func NewSubscriber(cfg Config) (s *Subscriber, err error) {
+	if cfg.Client == nil {
+		err = errors.New("Client must be set")
+		return
+	}
+
+	if cfg.Subscription == "" {
+		err = errors.New("Subscription must be set")
+		return
+	}
+
+	if cfg.Bucket == "" {
+		err = errors.New("Bucket must be set")
+		return
+	}
+
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = defaultEndpoint
+	}
+
+	s = &Subscriber{
+		cfg:     cfg,
+		stopped: make(chan struct{}),
+	}
+
+	return
+}
+
+// Subscribe arranges for f to be called with each change received, in the
+// order received. It must be called before Start, and f must not block for
+// long.
+func (s *Subscriber) Subscribe(f func(Change)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handlers = append(s.handlers, f)
+}
+
+// Start pulling notifications in the background. The caller must call Stop
+// when finished.
+func (s *Subscriber) Start() {
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(context.Background())
+	go s.loop(ctx)
+}
+
+// Stop pulling notifications, waiting for any handlers in progress to return.
+func (s *Subscriber) Stop() {
+	s.cancel()
+	<-s.stopped
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func (s *Subscriber) loop(ctx context.Context) {
+	defer close(s.stopped)
+
+	delay := minRetryDelay
+	for {
+		err := s.pullOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err == nil {
+			delay = minRetryDelay
+			continue
+		}
+
+		if s.cfg.Logger != nil {
+			s.cfg.Logger.Printf("Pulling notifications: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// Pull a batch of notifications, hand on the changes they describe, and
+// acknowledge them.
+func (s *Subscriber) pullOnce(ctx context.Context) (err error) {
+	var resp pullResponse
+	err = s.call(ctx, "pull", &pullRequest{MaxMessages: maxMessagesPerPull}, &resp)
+	if err != nil {
+		return
+	}
+
+	if len(resp.ReceivedMessages) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	handlers := s.handlers
+	s.mu.Unlock()
+
+	var ackIDs []string
+	for _, m := range resp.ReceivedMessages {
+		ackIDs = append(ackIDs, m.AckID)
+
+		c, ok := s.change(m.Message.Attributes)
+		if !ok {
+			continue
+		}
+
+		for _, h := range handlers {
+			h(c)
+		}
+	}
+
+	err = s.call(ctx, "acknowledge", &acknowledgeRequest{AckIDs: ackIDs}, nil)
+	return
+}
+
+// Convert the attributes of a GCS notification to the change it describes,
+// returning false if it doesn't concern an object we care about.
+func (s *Subscriber) change(attrs map[string]string) (c Change, ok bool) {
+	if attrs["bucketId"] != s.cfg.Bucket {
+		return
+	}
+
+	name := attrs["objectId"]
+	if !strings.HasPrefix(name, s.cfg.Prefix) || name == s.cfg.Prefix {
+		return
+	}
+
+	c.Name = strings.TrimPrefix(name, s.cfg.Prefix)
+	c.Generation, _ = strconv.ParseInt(attrs["objectGeneration"], 10, 64)
+
+	switch attrs["eventType"] {
+	case "OBJECT_FINALIZE", "OBJECT_METADATA_UPDATE":
+	case "OBJECT_DELETE", "OBJECT_ARCHIVE":
+		c.Removed = true
+	default:
+		return
+	}
+
+	ok = true
+	return
+}
+
+// Call a method on the subscription, decoding the response into resp if
+// non-nil.
+func (s *Subscriber) call(
+	ctx context.Context,
+	method string,
+	req interface{},
+	resp interface{}) (err error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		err = fmt.Errorf("Marshal: %v", err)
+		return
+	}
+
+	url := fmt.Sprintf("%s%s:%s", s.cfg.Endpoint, s.cfg.Subscription, method)
+	httpResp, err := ctxhttp.Post(
+		ctx,
+		s.cfg.Client,
+		url,
+		"application/json",
+		bytes.NewReader(body))
+
+	if err != nil {
+		err = fmt.Errorf("Post: %v", err)
+		return
+	}
+
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(httpResp.Body)
+		err = fmt.Errorf("%s returned %s: %s", method, httpResp.Status, msg)
+		return
+	}
+
+	if resp != nil {
+		err = json.NewDecoder(httpResp.Body).Decode(resp)
+		if err != nil {
+			err = fmt.Errorf("Decode: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// API types
+////////////////////////////////////////////////////////////////////////
+
+type pullRequest struct {
+	MaxMessages int `json:"maxMessages"`
+}
+
+type pullResponse struct {
+	ReceivedMessages []receivedMessage `json:"receivedMessages"`
+}
+
+type receivedMessage struct {
+	AckID   string        `json:"ackId"`
+	Message pubsubMessage `json:"message"`
+}
+
+type pubsubMessage struct {
+	Attributes map[string]string `json:"attributes"`
+}
+
+type acknowledgeRequest struct {
+	AckIDs []string `json:"ackIds"`
+}
@@ -0,0 +1,204 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pubsub_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/pubsub"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestSubscriber(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const subscription = "projects/p/subscriptions/s"
+
+type message struct {
+	ackID string
+	attrs map[string]string
+}
+
+// A fake Pub/Sub server that hands out a canned batch of messages on the
+// first pull, and nothing after.
+type fakeServer struct {
+	messages []message
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	pulled bool
+	acked  []string
+
+	// Closed once the batch has been acknowledged.
+	done chan struct{}
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/" + subscription + ":pull":
+		type msg struct {
+			AckID   string `json:"ackId"`
+			Message struct {
+				Attributes map[string]string `json:"attributes"`
+			} `json:"message"`
+		}
+
+		var resp struct {
+			ReceivedMessages []msg `json:"receivedMessages"`
+		}
+
+		if !f.pulled {
+			for _, m := range f.messages {
+				var rm msg
+				rm.AckID = m.ackID
+				rm.Message.Attributes = m.attrs
+				resp.ReceivedMessages = append(resp.ReceivedMessages, rm)
+			}
+
+			f.pulled = true
+		}
+
+		json.NewEncoder(w).Encode(&resp)
+
+	case "/" + subscription + ":acknowledge":
+		var req struct {
+			AckIDs []string `json:"ackIds"`
+		}
+
+		json.NewDecoder(r.Body).Decode(&req)
+		f.acked = append(f.acked, req.AckIDs...)
+		close(f.done)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type SubscriberTest struct {
+	fake    fakeServer
+	server  *httptest.Server
+	changes []pubsub.Change
+}
+
+var _ TearDownInterface = &SubscriberTest{}
+
+func init() { RegisterTestSuite(&SubscriberTest{}) }
+
+func (t *SubscriberTest) TearDown() {
+	if t.server != nil {
+		t.server.Close()
+	}
+}
+
+// Pull the supplied messages, recording the changes passed on in t.changes.
+func (t *SubscriberTest) run(prefix string, messages ...message) {
+	t.fake.messages = messages
+	t.fake.done = make(chan struct{})
+	t.server = httptest.NewServer(&t.fake)
+
+	s, err := pubsub.NewSubscriber(pubsub.Config{
+		Client:       http.DefaultClient,
+		Subscription: subscription,
+		Bucket:       "some-bucket",
+		Prefix:       prefix,
+		Endpoint:     t.server.URL + "/",
+	})
+
+	AssertEq(nil, err)
+
+	s.Subscribe(func(c pubsub.Change) {
+		t.changes = append(t.changes, c)
+	})
+
+	s.Start()
+	<-t.fake.done
+	s.Stop()
+}
+
+func notification(
+	ackID string,
+	bucket string,
+	eventType string,
+	name string) message {
+	return message{
+		ackID: ackID,
+		attrs: map[string]string{
+			"bucketId":         bucket,
+			"eventType":        eventType,
+			"objectId":         name,
+			"objectGeneration": "17",
+		},
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *SubscriberTest) MissingConfig() {
+	_, err := pubsub.NewSubscriber(pubsub.Config{})
+	ExpectThat(err, Error(HasSubstr("Client")))
+
+	_, err = pubsub.NewSubscriber(pubsub.Config{Client: http.DefaultClient})
+	ExpectThat(err, Error(HasSubstr("Subscription")))
+}
+
+func (t *SubscriberTest) PassesOnChanges() {
+	t.run(
+		"",
+		notification("0", "some-bucket", "OBJECT_FINALIZE", "foo"),
+		notification("1", "some-bucket", "OBJECT_DELETE", "bar/baz"),
+		notification("2", "some-bucket", "OBJECT_METADATA_UPDATE", "qux"))
+
+	ExpectThat(
+		t.changes,
+		DeepEquals([]pubsub.Change{
+			{Name: "foo", Generation: 17},
+			{Name: "bar/baz", Generation: 17, Removed: true},
+			{Name: "qux", Generation: 17},
+		}))
+
+	ExpectThat(t.fake.acked, ElementsAre("0", "1", "2"))
+}
+
+func (t *SubscriberTest) IgnoresOtherBucketsAndPrefixes() {
+	t.run(
+		"dir/",
+		notification("0", "other-bucket", "OBJECT_FINALIZE", "dir/foo"),
+		notification("1", "some-bucket", "OBJECT_FINALIZE", "foo"),
+		notification("2", "some-bucket", "OBJECT_FINALIZE", "dir/"),
+		notification("3", "some-bucket", "OBJECT_ARCHIVE", "dir/bar"))
+
+	ExpectThat(
+		t.changes,
+		DeepEquals([]pubsub.Change{
+			{Name: "bar", Generation: 17, Removed: true},
+		}))
+
+	// Everything is acknowledged regardless.
+	ExpectThat(t.fake.acked, ElementsAre("0", "1", "2", "3"))
+}
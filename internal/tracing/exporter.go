@@ -0,0 +1,354 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// The maximum number of spans sent in a single request to the collector.
+	maxBatchSize = 512
+
+	// The longest we wait before sending a non-empty batch.
+	batchDelay = 5 * time.Second
+
+	// The number of finished spans that may be waiting for export before we
+	// start dropping them, so that a slow collector can't hold up file system
+	// operations.
+	queueSize = 4096
+)
+
+// An Exporter sends finished spans to an OpenTelemetry collector using OTLP
+// over HTTP with JSON encoding. Spans are batched and sent in the background.
+type Exporter struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	client *http.Client
+	logger *log.Logger
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	url      string
+	resource []otlpKeyValue
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	spans   chan *SpanData
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// NewExporter creates an exporter that sends spans to the OTLP/HTTP collector
+// at the given endpoint, e.g. "http://localhost:4318". If the endpoint has no
+// path, the standard "/v1/traces" is used. The resource attributes (e.g.
+// service.name) are attached to every exported span. Errors are logged to the
+// supplied logger, which may be nil.
+//
+// The caller must call Stop to flush any remaining spans.
+func NewExporter(
+	endpoint string,
+	resource map[string]string,
+	client *http.Client,
+	logger *log.Logger) (e *Exporter, err error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		err = fmt.Errorf("Parsing endpoint: %v", err)
+		return
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		err = fmt.Errorf("Unsupported endpoint scheme: %q", u.Scheme)
+		return
+	}
+
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	e = &Exporter{
+		client:   client,
+		logger:   logger,
+		url:      u.String(),
+		resource: makeAttributes(stringMap(resource)),
+		spans:    make(chan *SpanData, queueSize),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	go e.loop()
+	return
+}
+
+// Stop sends any spans that have not yet been exported and shuts down the
+// exporter. Spans that finish after Stop is called are dropped.
+func (e *Exporter) Stop() {
+	close(e.stop)
+	<-e.stopped
+}
+
+// Queue the span for export, dropping it if the queue is full.
+func (e *Exporter) export(sd *SpanData) {
+	select {
+	case <-e.stop:
+	case e.spans <- sd:
+	default:
+	}
+}
+
+func (e *Exporter) loop() {
+	defer close(e.stopped)
+
+	var batch []*SpanData
+	ticker := time.NewTicker(batchDelay)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case sd := <-e.spans:
+			batch = append(batch, sd)
+			if len(batch) >= maxBatchSize {
+				e.send(batch)
+				batch = nil
+			}
+
+		case <-ticker.C:
+			if len(batch) > 0 {
+				e.send(batch)
+				batch = nil
+			}
+
+		case <-e.stop:
+			// Drain whatever is already queued.
+			for {
+				select {
+				case sd := <-e.spans:
+					batch = append(batch, sd)
+					continue
+				default:
+				}
+
+				break
+			}
+
+			for len(batch) > 0 {
+				n := len(batch)
+				if n > maxBatchSize {
+					n = maxBatchSize
+				}
+
+				e.send(batch[:n])
+				batch = batch[n:]
+			}
+
+			return
+		}
+	}
+}
+
+func (e *Exporter) send(batch []*SpanData) {
+	err := e.post(batch)
+	if err != nil && e.logger != nil {
+		e.logger.Printf("Exporting %d spans: %v", len(batch), err)
+	}
+}
+
+func (e *Exporter) post(batch []*SpanData) (err error) {
+	req := otlpRequest{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: otlpResource{Attributes: e.resource},
+				ScopeSpans: []otlpScopeSpans{
+					{
+						Scope: otlpScope{Name: "gcsfuse"},
+						Spans: makeSpans(batch),
+					},
+				},
+			},
+		},
+	}
+
+	body, err := json.Marshal(&req)
+	if err != nil {
+		err = fmt.Errorf("Marshal: %v", err)
+		return
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		err = fmt.Errorf("Post: %v", err)
+		return
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("Collector returned status %s", resp.Status)
+		return
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// OTLP JSON encoding
+////////////////////////////////////////////////////////////////////////
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	// 0 is unset, 2 is error.
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+
+	// The OTLP JSON mapping encodes 64-bit integers as strings.
+	IntValue *string `json:"intValue,omitempty"`
+}
+
+func stringMap(m map[string]string) (res map[string]interface{}) {
+	res = make(map[string]interface{})
+	for k, v := range m {
+		res[k] = v
+	}
+
+	return
+}
+
+func makeAttributes(m map[string]interface{}) (kvs []otlpKeyValue) {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var v otlpValue
+		switch x := m[k].(type) {
+		case string:
+			v.StringValue = &x
+
+		case bool:
+			v.BoolValue = &x
+
+		case int:
+			s := strconv.FormatInt(int64(x), 10)
+			v.IntValue = &s
+
+		case int64:
+			s := strconv.FormatInt(x, 10)
+			v.IntValue = &s
+
+		case uint64:
+			s := strconv.FormatUint(x, 10)
+			v.IntValue = &s
+
+		default:
+			s := fmt.Sprintf("%v", x)
+			v.StringValue = &s
+		}
+
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: v})
+	}
+
+	return
+}
+
+func makeSpans(batch []*SpanData) (spans []otlpSpan) {
+	for _, sd := range batch {
+		s := otlpSpan{
+			TraceID:           sd.TraceID.String(),
+			SpanID:            sd.SpanID.String(),
+			Name:              sd.Name,
+			Kind:              int(sd.Kind),
+			StartTimeUnixNano: strconv.FormatInt(sd.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(sd.End.UnixNano(), 10),
+			Attributes:        makeAttributes(sd.Attributes),
+		}
+
+		if sd.ParentID != (SpanID{}) {
+			s.ParentSpanID = sd.ParentID.String()
+		}
+
+		if sd.Err != nil {
+			s.Status.Code = 2
+			s.Status.Message = sd.Err.Error()
+		}
+
+		spans = append(spans, s)
+	}
+
+	return
+}
@@ -0,0 +1,272 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing records spans for fuse operations and the GCS requests that
+// they cause, so that users can see which kernel operations trigger which
+// backend calls. Finished spans are exported using the OpenTelemetry protocol
+// (OTLP); see NewExporter.
+//
+// Tracing is disabled until Enable is called, in which case StartSpan is
+// cheap and returns a nil span, on which all methods are no-ops.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// The exporter to which finished spans are sent, or nil if tracing is
+// disabled.
+//
+// GUARDED_BY(exporterMu)
+var exporter *Exporter
+var exporterMu sync.RWMutex
+
+// Enable tracing for the process, sending finished spans to the supplied
+// exporter. Passing nil disables tracing again.
+func Enable(e *Exporter) {
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+
+	exporter = e
+}
+
+// Enabled returns true iff Enable has been called with a non-nil exporter.
+func Enabled() bool {
+	return currentExporter() != nil
+}
+
+func currentExporter() *Exporter {
+	exporterMu.RLock()
+	defer exporterMu.RUnlock()
+
+	return exporter
+}
+
+// The kind of a span, matching the OpenTelemetry SpanKind enumeration.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// A TraceID identifies a tree of spans caused by a single root operation.
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// A SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// A Span records the timing and outcome of a single logical operation. A nil
+// *Span is valid and ignores all calls.
+type Span struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	exporter *Exporter
+	traceID  TraceID
+	spanID   SpanID
+	parentID SpanID
+	name     string
+	kind     SpanKind
+	start    time.Time
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	attrs map[string]interface{}
+
+	// GUARDED_BY(mu)
+	ended bool
+}
+
+// SpanData is an immutable snapshot of a finished span, as handed to the
+// exporter.
+type SpanData struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	ParentID   SpanID
+	Name       string
+	Kind       SpanKind
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+
+	// The error with which the operation finished, or nil if it was
+	// successful.
+	Err error
+}
+
+type contextKey int
+
+const spanKey contextKey = 0
+
+// FromContext returns the span associated with the supplied context, or nil if
+// none.
+func FromContext(ctx context.Context) (s *Span) {
+	s, _ = ctx.Value(spanKey).(*Span)
+	return
+}
+
+// WithSpanFrom returns a context derived from dst that carries the span (if
+// any) associated with src. This is useful for work that must outlive or
+// ignore the cancellation of the context that caused it, but that should still
+// be attributed to the operation that caused it.
+func WithSpanFrom(dst context.Context, src context.Context) context.Context {
+	s := FromContext(src)
+	if s == nil {
+		return dst
+	}
+
+	return context.WithValue(dst, spanKey, s)
+}
+
+// StartSpan begins a span with the given name and kind. If the context
+// carries a span, the new span is its child; otherwise it is the root of a new
+// trace. The returned context carries the new span and should be used for the
+// work that the span covers. The caller must arrange for End to be called.
+//
+// If tracing is disabled this returns the input context and a nil span.
+func StartSpan(
+	ctx context.Context,
+	name string,
+	kind SpanKind) (newCtx context.Context, s *Span) {
+	newCtx = ctx
+
+	e := currentExporter()
+	if e == nil {
+		return
+	}
+
+	s = &Span{
+		exporter: e,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+		spanID:   newSpanID(),
+	}
+
+	if parent := FromContext(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		s.traceID = newTraceID()
+	}
+
+	newCtx = context.WithValue(ctx, spanKey, s)
+	return
+}
+
+// SetAttribute records a key/value pair describing the span. Values should be
+// strings, bools, or integers; other types are formatted with fmt.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+
+	s.attrs[key] = value
+}
+
+// End finishes the span with the supplied outcome and hands it to the
+// exporter. Calls after the first are ignored.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+
+	s.ended = true
+	sd := &SpanData{
+		TraceID:    s.traceID,
+		SpanID:     s.spanID,
+		ParentID:   s.parentID,
+		Name:       s.name,
+		Kind:       s.kind,
+		Start:      s.start,
+		End:        time.Now(),
+		Attributes: s.attrs,
+		Err:        err,
+	}
+	s.mu.Unlock()
+
+	s.exporter.export(sd)
+}
+
+// EndWithError is a convenience for use in a defer statement within a function
+// using a named error return parameter:
+//
+//     ctx, span := tracing.StartSpan(ctx, "DoSomething", tracing.SpanKindInternal)
+//     defer span.EndWithError(&err)
+//
+// io.EOF is not treated as an error.
+func (s *Span) EndWithError(err *error) {
+	if *err == io.EOF {
+		s.End(nil)
+		return
+	}
+
+	s.End(*err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func newTraceID() (id TraceID) {
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		panic(fmt.Sprintf("ReadFull: %v", err))
+	}
+
+	return
+}
+
+func newSpanID() (id SpanID) {
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		panic(fmt.Sprintf("ReadFull: %v", err))
+	}
+
+	return
+}
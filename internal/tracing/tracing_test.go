@@ -0,0 +1,265 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/tracing"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestTracing(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+type exportedSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Attributes   []struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+			IntValue    string `json:"intValue"`
+		} `json:"value"`
+	} `json:"attributes"`
+	Status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+type exportRequest struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []struct {
+				Key   string `json:"key"`
+				Value struct {
+					StringValue string `json:"stringValue"`
+				} `json:"value"`
+			} `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Spans []exportedSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type TracingTest struct {
+	ctx    context.Context
+	server *httptest.Server
+
+	mu       sync.Mutex
+	paths    []string
+	requests []exportRequest
+
+	exporter *tracing.Exporter
+}
+
+var _ SetUpInterface = &TracingTest{}
+var _ TearDownInterface = &TracingTest{}
+
+func init() { RegisterTestSuite(&TracingTest{}) }
+
+func (t *TracingTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.server = httptest.NewServer(http.HandlerFunc(t.handle))
+
+	t.exporter, err = tracing.NewExporter(
+		t.server.URL,
+		map[string]string{"service.name": "gcsfuse"},
+		nil,
+		nil)
+
+	AssertEq(nil, err)
+	tracing.Enable(t.exporter)
+}
+
+func (t *TracingTest) TearDown() {
+	tracing.Enable(nil)
+	t.server.Close()
+}
+
+func (t *TracingTest) handle(w http.ResponseWriter, r *http.Request) {
+	var req exportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.paths = append(t.paths, r.URL.Path)
+	t.requests = append(t.requests, req)
+}
+
+// Stop the exporter and return all of the spans it sent.
+func (t *TracingTest) flush() (spans []exportedSpan) {
+	t.exporter.Stop()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, req := range t.requests {
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *TracingTest) Disabled() {
+	tracing.Enable(nil)
+	ExpectFalse(tracing.Enabled())
+
+	ctx, span := tracing.StartSpan(t.ctx, "foo", tracing.SpanKindServer)
+	ExpectEq(nil, span)
+	ExpectTrue(ctx == t.ctx)
+
+	// Methods on the nil span should be no-ops.
+	span.SetAttribute("foo", "bar")
+	span.End(nil)
+
+	ExpectEq(0, len(t.flush()))
+}
+
+func (t *TracingTest) BadEndpoint() {
+	_, err := tracing.NewExporter("ftp://foo", nil, nil, nil)
+	ExpectThat(err, Error(HasSubstr("scheme")))
+}
+
+func (t *TracingTest) DefaultPath() {
+	_, span := tracing.StartSpan(t.ctx, "foo", tracing.SpanKindServer)
+	span.End(nil)
+
+	AssertEq(1, len(t.flush()))
+	ExpectThat(t.paths, ElementsAre("/v1/traces"))
+}
+
+func (t *TracingTest) ResourceAttributes() {
+	_, span := tracing.StartSpan(t.ctx, "foo", tracing.SpanKindServer)
+	span.End(nil)
+	t.flush()
+
+	AssertEq(1, len(t.requests))
+	AssertEq(1, len(t.requests[0].ResourceSpans))
+
+	attrs := t.requests[0].ResourceSpans[0].Resource.Attributes
+	AssertEq(1, len(attrs))
+	ExpectEq("service.name", attrs[0].Key)
+	ExpectEq("gcsfuse", attrs[0].Value.StringValue)
+}
+
+func (t *TracingTest) ParentAndChild() {
+	ctx, parent := tracing.StartSpan(t.ctx, "parent", tracing.SpanKindServer)
+	_, child := tracing.StartSpan(ctx, "child", tracing.SpanKindClient)
+	child.End(nil)
+	parent.End(nil)
+
+	spans := t.flush()
+	AssertEq(2, len(spans))
+
+	c := spans[0]
+	p := spans[1]
+
+	ExpectEq("child", c.Name)
+	ExpectEq(3, c.Kind)
+	ExpectEq("parent", p.Name)
+	ExpectEq(2, p.Kind)
+
+	ExpectEq(32, len(p.TraceID))
+	ExpectEq(16, len(p.SpanID))
+	ExpectEq("", p.ParentSpanID)
+
+	ExpectEq(p.TraceID, c.TraceID)
+	ExpectEq(p.SpanID, c.ParentSpanID)
+	ExpectNe(p.SpanID, c.SpanID)
+}
+
+func (t *TracingTest) SeparateTraces() {
+	_, s0 := tracing.StartSpan(t.ctx, "foo", tracing.SpanKindServer)
+	_, s1 := tracing.StartSpan(t.ctx, "bar", tracing.SpanKindServer)
+	s0.End(nil)
+	s1.End(nil)
+
+	spans := t.flush()
+	AssertEq(2, len(spans))
+	ExpectNe(spans[0].TraceID, spans[1].TraceID)
+}
+
+func (t *TracingTest) WithSpanFrom() {
+	ctx, parent := tracing.StartSpan(t.ctx, "parent", tracing.SpanKindServer)
+
+	detached := tracing.WithSpanFrom(context.Background(), ctx)
+	ExpectEq(parent, tracing.FromContext(detached))
+
+	_, child := tracing.StartSpan(detached, "child", tracing.SpanKindClient)
+	child.End(nil)
+	parent.End(nil)
+
+	spans := t.flush()
+	AssertEq(2, len(spans))
+	ExpectEq(spans[1].SpanID, spans[0].ParentSpanID)
+}
+
+func (t *TracingTest) AttributesAndStatus() {
+	_, span := tracing.StartSpan(t.ctx, "foo", tracing.SpanKindServer)
+	span.SetAttribute("name", "taco")
+	span.SetAttribute("offset", int64(17))
+	span.End(errors.New("burrito"))
+
+	// Ending a second time should have no effect.
+	span.End(nil)
+
+	spans := t.flush()
+	AssertEq(1, len(spans))
+	s := spans[0]
+
+	AssertEq(2, len(s.Attributes))
+	ExpectEq("name", s.Attributes[0].Key)
+	ExpectEq("taco", s.Attributes[0].Value.StringValue)
+	ExpectEq("offset", s.Attributes[1].Key)
+	ExpectEq("17", s.Attributes[1].Value.IntValue)
+
+	ExpectEq(2, s.Status.Code)
+	ExpectEq("burrito", s.Status.Message)
+}
@@ -0,0 +1,364 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package verify compares the tree visible through a gcsfuse mount with the
+// tree that gcsfuse should show for a direct listing of the bucket, to catch
+// discrepancies introduced by caching. Only names and attributes are
+// compared; file contents are never read.
+package verify
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/syncutil"
+)
+
+// EntryType is the type of an entry in a tree.
+type EntryType int
+
+const (
+	File EntryType = iota
+	Directory
+	Symlink
+	Other
+)
+
+func (t EntryType) String() string {
+	switch t {
+	case File:
+		return "file"
+	case Directory:
+		return "directory"
+	case Symlink:
+		return "symlink"
+	default:
+		return "other"
+	}
+}
+
+// An Entry describes a name in a tree.
+type Entry struct {
+	Type EntryType
+
+	// For files, the size in bytes.
+	Size int64
+
+	// For symlinks, the target.
+	Target string
+}
+
+func (e Entry) String() string {
+	switch e.Type {
+	case File:
+		return fmt.Sprintf("file of %d bytes", e.Size)
+	case Symlink:
+		return fmt.Sprintf("symlink to %q", e.Target)
+	default:
+		return e.Type.String()
+	}
+}
+
+// A Tree maps slash-separated names relative to some root directory, which is
+// not itself included, to their entries.
+type Tree map[string]Entry
+
+// ListBucket lists the supplied bucket and returns the tree that gcsfuse
+// should show for it, with or without implicit directories. Objects hidden
+// by gcsfuse, such as those beneath a directory with no placeholder object
+// when implicit directories are disabled, are left out. Files that conflict
+// with directories are named with the supplied suffix, or with
+// inode.ConflictingFileNameSuffix if it is empty, and names are in the
+// supplied normalization form.
+func ListBucket(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	implicitDirs bool,
+	conflictSuffix string,
+	normalization inode.Normalization) (t Tree, err error) {
+	if conflictSuffix == "" {
+		conflictSuffix = inode.ConflictingFileNameSuffix
+	}
+
+	// List all the objects.
+	var objects []*gcs.Object
+	req := &gcs.ListObjectsRequest{}
+	for {
+		var listing *gcs.Listing
+		listing, err = bucket.ListObjects(ctx, req)
+		if err != nil {
+			err = fmt.Errorf("ListObjects: %v", err)
+			return
+		}
+
+		objects = append(objects, listing.Objects...)
+		if listing.ContinuationToken == "" {
+			break
+		}
+
+		req.ContinuationToken = listing.ContinuationToken
+	}
+
+	// Record the directories first, so that we know which are explicit.
+	t = make(Tree)
+	for _, o := range objects {
+		if strings.HasSuffix(o.Name, "/") {
+			t[localName(o.Name, normalization)] = Entry{Type: Directory}
+		}
+	}
+
+	// Then the other objects. An empty name is the root directory itself, when
+	// listing a prefix.
+	files := make(map[string]Entry)
+	for _, o := range objects {
+		if o.Name == "" || strings.HasSuffix(o.Name, "/") {
+			continue
+		}
+
+		switch {
+		case inode.IsSymlink(o):
+			files[localName(o.Name, normalization)] = Entry{
+				Type:   Symlink,
+				Target: o.Metadata[inode.SymlinkMetadataKey],
+			}
+
+		default:
+			files[localName(o.Name, normalization)] = Entry{
+				Type: File,
+				Size: int64(o.Size),
+			}
+		}
+	}
+
+	// With implicit directories, every object defines its ancestors. Otherwise
+	// hide whatever lacks them.
+	if implicitDirs {
+		for _, o := range objects {
+			name := localName(o.Name, normalization)
+			for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+				t[dir] = Entry{Type: Directory}
+			}
+		}
+	}
+
+	for name := range t {
+		if !visible(t, name) {
+			delete(t, name)
+		}
+	}
+
+	// gcsfuse shows a file whose name is also that of a directory with a suffix.
+	for name, e := range files {
+		if !visible(t, name) {
+			continue
+		}
+
+		if _, ok := t[name]; ok {
+			name += conflictSuffix
+		}
+
+		t[name] = e
+	}
+
+	return
+}
+
+// Return the name relative to the root that gcsfuse shows for the supplied
+// object name, normalizing and escaping each part as inode.DirInode does.
+func localName(objectName string, normalization inode.Normalization) string {
+	parts := strings.Split(strings.TrimSuffix(objectName, "/"), "/")
+	for i, p := range parts {
+		parts[i] = inode.EscapeName(normalization.Apply(p))
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// Is every ancestor directory of the given name present in the tree?
+func visible(t Tree, name string) bool {
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if _, ok := t[dir]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// WalkMount walks the directory tree rooted at dir, without following
+// symlinks or reading file contents.
+func WalkMount(dir string) (t Tree, err error) {
+	t = make(Tree)
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if p == dir {
+			return nil
+		}
+
+		name, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		name = filepath.ToSlash(name)
+
+		switch {
+		case fi.IsDir():
+			t[name] = Entry{Type: Directory}
+
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+
+			t[name] = Entry{Type: Symlink, Target: target}
+
+		case fi.Mode().IsRegular():
+			t[name] = Entry{Type: File, Size: fi.Size()}
+
+		default:
+			t[name] = Entry{Type: Other}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		err = fmt.Errorf("Walk: %v", err)
+		return
+	}
+
+	return
+}
+
+// A Discrepancy is a name whose entry differs between the mounted tree and
+// the bucket listing.
+type Discrepancy struct {
+	Name string
+
+	// The entries seen in each tree, nil if absent.
+	Mounted *Entry
+	Listed  *Entry
+}
+
+func (d Discrepancy) String() string {
+	switch {
+	case d.Mounted == nil:
+		return fmt.Sprintf("%q: missing from mount; bucket has %v", d.Name, d.Listed)
+
+	case d.Listed == nil:
+		return fmt.Sprintf("%q: not in bucket; mount has %v", d.Name, d.Mounted)
+
+	default:
+		return fmt.Sprintf(
+			"%q: mount has %v; bucket has %v",
+			d.Name,
+			d.Mounted,
+			d.Listed)
+	}
+}
+
+// Compare returns the discrepancies between the supplied trees, sorted by
+// name.
+func Compare(mounted Tree, listed Tree) (ds []Discrepancy) {
+	for name, m := range mounted {
+		m := m
+		l, ok := listed[name]
+		switch {
+		case !ok:
+			ds = append(ds, Discrepancy{Name: name, Mounted: &m})
+
+		case l != m:
+			ds = append(ds, Discrepancy{Name: name, Mounted: &m, Listed: &l})
+		}
+	}
+
+	for name, l := range listed {
+		l := l
+		if _, ok := mounted[name]; !ok {
+			ds = append(ds, Discrepancy{Name: name, Listed: &l})
+		}
+	}
+
+	sort.Sort(byName(ds))
+	return
+}
+
+// Verify walks the tree mounted at dir and lists the bucket concurrently, and
+// returns the discrepancies between them. The bucket should be the one
+// mounted, with any prefix for --only-dir applied. Objects modified while
+// verifying may show up as discrepancies, so results are only meaningful
+// when the bucket is quiescent. The conflict suffix and normalization are as
+// for ListBucket.
+func Verify(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	implicitDirs bool,
+	conflictSuffix string,
+	normalization inode.Normalization,
+	dir string) (ds []Discrepancy, err error) {
+	var mounted, listed Tree
+	b := syncutil.NewBundle(ctx)
+
+	b.Add(func(ctx context.Context) (err error) {
+		mounted, err = WalkMount(dir)
+		if err != nil {
+			err = fmt.Errorf("WalkMount: %v", err)
+			return
+		}
+
+		return
+	})
+
+	b.Add(func(ctx context.Context) (err error) {
+		listed, err = ListBucket(
+			ctx,
+			bucket,
+			implicitDirs,
+			conflictSuffix,
+			normalization)
+		if err != nil {
+			err = fmt.Errorf("ListBucket: %v", err)
+			return
+		}
+
+		return
+	})
+
+	err = b.Join()
+	if err != nil {
+		return
+	}
+
+	ds = Compare(mounted, listed)
+	return
+}
+
+type byName []Discrepancy
+
+func (p byName) Len() int           { return len(p) }
+func (p byName) Less(i, j int) bool { return p[i].Name < p[j].Name }
+func (p byName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
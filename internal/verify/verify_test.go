@@ -0,0 +1,264 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/internal/verify"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestVerify(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type VerifyTest struct {
+	ctx    context.Context
+	bucket gcs.Bucket
+	dir    string
+}
+
+var _ SetUpInterface = &VerifyTest{}
+var _ TearDownInterface = &VerifyTest{}
+
+func init() { RegisterTestSuite(&VerifyTest{}) }
+
+func (t *VerifyTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.bucket = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+
+	// Set up a local directory to stand in for the mount.
+	t.dir, err = ioutil.TempDir("", "verify_test")
+	AssertEq(nil, err)
+}
+
+func (t *VerifyTest) TearDown() {
+	os.RemoveAll(t.dir)
+}
+
+func (t *VerifyTest) createObjects(contents map[string]string) {
+	m := make(map[string][]byte)
+	for name, c := range contents {
+		m[name] = []byte(c)
+	}
+
+	err := gcsutil.CreateObjects(t.ctx, t.bucket, m)
+	AssertEq(nil, err)
+}
+
+func (t *VerifyTest) createSymlinkObject(name string, target string) {
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     name,
+			Contents: strings.NewReader(""),
+			Metadata: map[string]string{
+				inode.SymlinkMetadataKey: target,
+			},
+		})
+
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *VerifyTest) ListBucket_ExplicitDirs() {
+	t.createObjects(map[string]string{
+		"a/":    "",
+		"a/b":   "taco",
+		"c/d":   "burrito",
+		"c/e/":  "",
+		"c/e/f": "",
+	})
+
+	t.createSymlinkObject("a/g", "../c/d")
+
+	tree, err := verify.ListBucket(t.ctx, t.bucket, false, "", inode.NormalizeOff)
+	AssertEq(nil, err)
+
+	ExpectThat(tree, DeepEquals(verify.Tree{
+		"a":   verify.Entry{Type: verify.Directory},
+		"a/b": verify.Entry{Type: verify.File, Size: 4},
+		"a/g": verify.Entry{Type: verify.Symlink, Target: "../c/d"},
+	}))
+}
+
+func (t *VerifyTest) ListBucket_ImplicitDirs() {
+	t.createObjects(map[string]string{
+		"a/b":  "taco",
+		"c/d/": "",
+	})
+
+	tree, err := verify.ListBucket(t.ctx, t.bucket, true, "", inode.NormalizeOff)
+	AssertEq(nil, err)
+
+	ExpectThat(tree, DeepEquals(verify.Tree{
+		"a":   verify.Entry{Type: verify.Directory},
+		"a/b": verify.Entry{Type: verify.File, Size: 4},
+		"c":   verify.Entry{Type: verify.Directory},
+		"c/d": verify.Entry{Type: verify.Directory},
+	}))
+}
+
+func (t *VerifyTest) ListBucket_ConflictingNames() {
+	t.createObjects(map[string]string{
+		"foo":  "taco",
+		"foo/": "",
+	})
+
+	tree, err := verify.ListBucket(t.ctx, t.bucket, false, "", inode.NormalizeOff)
+	AssertEq(nil, err)
+
+	ExpectThat(tree, DeepEquals(verify.Tree{
+		"foo":   verify.Entry{Type: verify.Directory},
+		"foo\n": verify.Entry{Type: verify.File, Size: 4},
+	}))
+}
+
+func (t *VerifyTest) ListBucket_ConflictingNamesWithCustomSuffix() {
+	t.createObjects(map[string]string{
+		"foo":  "taco",
+		"foo/": "",
+	})
+
+	tree, err := verify.ListBucket(t.ctx, t.bucket, false, ".file", inode.NormalizeOff)
+	AssertEq(nil, err)
+
+	ExpectThat(tree, DeepEquals(verify.Tree{
+		"foo":      verify.Entry{Type: verify.Directory},
+		"foo.file": verify.Entry{Type: verify.File, Size: 4},
+	}))
+}
+
+func (t *VerifyTest) ListBucket_UnrepresentableNames() {
+	t.createObjects(map[string]string{
+		"foo/":    "",
+		"foo//":   "",
+		"foo//..": "taco",
+	})
+
+	tree, err := verify.ListBucket(t.ctx, t.bucket, false, "", inode.NormalizeOff)
+	AssertEq(nil, err)
+
+	ExpectThat(tree, DeepEquals(verify.Tree{
+		"foo":         verify.Entry{Type: verify.Directory},
+		"foo/\r":      verify.Entry{Type: verify.Directory},
+		"foo/\r/..\r": verify.Entry{Type: verify.File, Size: 4},
+	}))
+}
+
+func (t *VerifyTest) ListBucket_Normalization() {
+	t.createObjects(map[string]string{
+		"cafe\u0301/":            "",
+		"cafe\u0301/nai\u0308ve": "taco",
+	})
+
+	tree, err := verify.ListBucket(t.ctx, t.bucket, false, "", inode.NormalizeNFC)
+	AssertEq(nil, err)
+
+	ExpectThat(tree, DeepEquals(verify.Tree{
+		"caf\u00e9":            verify.Entry{Type: verify.Directory},
+		"caf\u00e9/na\u00efve": verify.Entry{Type: verify.File, Size: 4},
+	}))
+}
+
+func (t *VerifyTest) WalkMount() {
+	var err error
+
+	err = os.Mkdir(path.Join(t.dir, "a"), 0700)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.dir, "a/b"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = os.Symlink("../c/d", path.Join(t.dir, "a/g"))
+	AssertEq(nil, err)
+
+	tree, err := verify.WalkMount(t.dir)
+	AssertEq(nil, err)
+
+	ExpectThat(tree, DeepEquals(verify.Tree{
+		"a":   verify.Entry{Type: verify.Directory},
+		"a/b": verify.Entry{Type: verify.File, Size: 4},
+		"a/g": verify.Entry{Type: verify.Symlink, Target: "../c/d"},
+	}))
+}
+
+func (t *VerifyTest) Compare() {
+	mounted := verify.Tree{
+		"a": verify.Entry{Type: verify.Directory},
+		"b": verify.Entry{Type: verify.File, Size: 4},
+		"c": verify.Entry{Type: verify.File, Size: 4},
+		"d": verify.Entry{Type: verify.File, Size: 4},
+	}
+
+	listed := verify.Tree{
+		"a": verify.Entry{Type: verify.Directory},
+		"b": verify.Entry{Type: verify.File, Size: 7},
+		"c": verify.Entry{Type: verify.Directory},
+		"e": verify.Entry{Type: verify.File, Size: 4},
+	}
+
+	ds := verify.Compare(mounted, listed)
+	AssertEq(4, len(ds))
+
+	ExpectEq(`"b": mount has file of 4 bytes; bucket has file of 7 bytes`, ds[0].String())
+	ExpectEq(`"c": mount has file of 4 bytes; bucket has directory`, ds[1].String())
+	ExpectEq(`"d": not in bucket; mount has file of 4 bytes`, ds[2].String())
+	ExpectEq(`"e": missing from mount; bucket has file of 4 bytes`, ds[3].String())
+}
+
+func (t *VerifyTest) Verify() {
+	var err error
+
+	t.createObjects(map[string]string{
+		"a/":  "",
+		"a/b": "taco",
+		"c":   "burrito",
+	})
+
+	err = os.Mkdir(path.Join(t.dir, "a"), 0700)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.dir, "a/b"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.dir, "c"), []byte("enchilada"), 0600)
+	AssertEq(nil, err)
+
+	ds, err := verify.Verify(t.ctx, t.bucket, false, "", inode.NormalizeOff, t.dir)
+	AssertEq(nil, err)
+	AssertEq(1, len(ds))
+	ExpectEq("c", ds[0].Name)
+}
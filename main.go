@@ -21,15 +21,20 @@
 package main
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path"
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"strings"
 	"syscall"
 	"time"
 
@@ -38,11 +43,21 @@ import (
 	"golang.org/x/oauth2/google"
 
 	"github.com/codegangsta/cli"
+	"github.com/googlecloudplatform/gcsfuse/gcsconn"
+	"github.com/googlecloudplatform/gcsfuse/internal/audit"
 	"github.com/googlecloudplatform/gcsfuse/internal/canned"
+	"github.com/googlecloudplatform/gcsfuse/internal/control"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/monitor"
+	"github.com/googlecloudplatform/gcsfuse/internal/profile"
+	"github.com/googlecloudplatform/gcsfuse/internal/pubsub"
+	"github.com/googlecloudplatform/gcsfuse/internal/tracing"
 	"github.com/jacobsa/daemonize"
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/syncutil"
+	"github.com/jacobsa/timeutil"
 	"github.com/kardianos/osext"
 )
 
@@ -50,22 +65,123 @@ import (
 // Helpers
 ////////////////////////////////////////////////////////////////////////
 
-func registerSIGINTHandler(mountPoint string) {
-	// Register for SIGINT.
+// On SIGINT or SIGTERM, stop the file system being modified, write out every
+// file with modifications and finish any background deletions, taking no
+// longer than the grace period, and unmount. If unmounting fails, e.g. because
+// a file is open, the file system stays mounted but refuses modifications, and
+// the next signal tries again.
+func registerShutdownHandler(
+	mountPoint string,
+	admin *fs.Admin,
+	deletes gcsx.BackgroundDeleteBucket,
+	gracePeriod time.Duration) {
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
 
-	// Start a goroutine that will unmount when the signal is received.
 	go func() {
 		for {
-			<-signalChan
-			log.Println("Received SIGINT, attempting to unmount...")
+			sig := <-signalChan
+			log.Printf("Received %v, attempting to unmount...", sig)
+
+			ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+			drainAndFlush(ctx, admin, deletes)
+			cancel()
 
 			err := fuse.Unmount(mountPoint)
 			if err != nil {
-				log.Printf("Failed to unmount in response to SIGINT: %v", err)
+				log.Printf("Failed to unmount in response to %v: %v", sig, err)
 			} else {
-				log.Printf("Successfully unmounted in response to SIGINT.")
+				log.Printf("Successfully unmounted in response to %v.", sig)
+				return
+			}
+		}
+	}()
+}
+
+// On SIGHUP, reload the config file, as the control socket's "reload" command
+// does.
+func registerSIGHUPHandler(
+	flags *flagStorage,
+	profiles *profile.Manager) {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGHUP)
+
+	go func() {
+		for range signalChan {
+			err := reloadConfig(flags, profiles)
+			if err != nil {
+				log.Printf("Failed to reload in response to SIGHUP: %v", err)
+			}
+		}
+	}()
+}
+
+// Stop the file system being modified, write out the files that have been and
+// wait for the background deletions, if any, logging the outcome.
+func drainAndFlush(
+	ctx context.Context,
+	admin *fs.Admin,
+	deletes gcsx.BackgroundDeleteBucket) {
+	err := admin.Drain(ctx)
+	if err != nil {
+		log.Printf("Waiting for modifications to finish: %v", err)
+	}
+
+	n, err := admin.FlushAll(ctx)
+	if err != nil {
+		log.Printf("Flushed %d files before failing: %v", n, err)
+	} else {
+		log.Printf("Flushed %d files.", n)
+	}
+
+	waitForDeletes(ctx, deletes)
+}
+
+// Wait for the background deletions, if any, logging it if ctx is done first.
+func waitForDeletes(ctx context.Context, deletes gcsx.BackgroundDeleteBucket) {
+	if deletes == nil {
+		return
+	}
+
+	err := deletes.Wait(ctx)
+	if err != nil {
+		log.Printf("Waiting for background deletions: %v", err)
+	}
+}
+
+// Unmount the file system once it has handled no ops for the given timeout,
+// first stopping it being modified and writing out the files that have been,
+// as on SIGINT or SIGTERM. The kernel refuses while any file is open (and
+// gcsfuse writes out each file when it is closed), in which case we let it be
+// modified again and try again after another timeout.
+func unmountWhenIdle(
+	mountPoint string,
+	admin *fs.Admin,
+	deletes gcsx.BackgroundDeleteBucket,
+	activity *fs.ActivityTracker,
+	timeout time.Duration,
+	gracePeriod time.Duration) {
+	go func() {
+		for {
+			idle := activity.IdleFor()
+			if idle < timeout {
+				time.Sleep(timeout - idle)
+				continue
+			}
+
+			log.Printf("Idle for %v, attempting to unmount...", idle)
+
+			ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+			drainAndFlush(ctx, admin, deletes)
+			cancel()
+
+			err := fuse.Unmount(mountPoint)
+			if err != nil {
+				log.Printf("Failed to unmount when idle: %v", err)
+				admin.Resume()
+				time.Sleep(timeout)
+			} else {
+				log.Printf("Successfully unmounted when idle.")
 				return
 			}
 		}
@@ -158,65 +274,350 @@ func handleMemoryProfileSignals() {
 	}
 }
 
-// Create token source from the JSON file at the supplide path.
-func newTokenSourceFromPath(
-	path string,
+// Create a token source for the given scope, using the key file specified by
+// the user or else the default credentials, and impersonating a service
+// account if requested.
+func getTokenSource(
+	flags *flagStorage,
 	scope string) (ts oauth2.TokenSource, err error) {
-	// Read the file.
-	contents, err := ioutil.ReadFile(path)
-	if err != nil {
-		err = fmt.Errorf("ReadFile(%q): %v", path, err)
+	// Impersonation requires broader credentials than the final token.
+	baseScope := scope
+	if flags.ImpersonateServiceAccount != "" {
+		baseScope = gcsconn.ImpersonationScope
+	}
+
+	if flags.KeyFile != "" {
+		ts, err = gcsconn.KeyFileTokenSource(flags.KeyFile, baseScope)
+		if err != nil {
+			err = fmt.Errorf("KeyFileTokenSource: %v", err)
+			return
+		}
+	} else {
+		ts, err = google.DefaultTokenSource(context.Background(), baseScope)
+		if err != nil {
+			err = fmt.Errorf("DefaultTokenSource: %v", err)
+			return
+		}
+	}
+
+	if flags.ImpersonateServiceAccount != "" {
+		ts = gcsconn.ImpersonatedTokenSource(
+			ts,
+			flags.ImpersonateServiceAccount,
+			[]string{scope})
+	}
+
+	return
+}
+
+// Choose the endpoint to which to send GCS requests, if not the default. The
+// --endpoint flag takes precedence over the STORAGE_EMULATOR_HOST environment
+// variable used by other GCS clients. The emulator needs no credentials.
+func getEndpoint(flags *flagStorage) (u *url.URL, emulator bool, err error) {
+	switch {
+	case flags.Endpoint != "":
+		u, err = gcsx.ParseEndpoint(flags.Endpoint, "https")
+		if err != nil {
+			err = fmt.Errorf("ParseEndpoint: %v", err)
+			return
+		}
+
+	case os.Getenv("STORAGE_EMULATOR_HOST") != "":
+		emulator = true
+		u, err = gcsx.ParseEndpoint(os.Getenv("STORAGE_EMULATOR_HOST"), "http")
+		if err != nil {
+			err = fmt.Errorf("STORAGE_EMULATOR_HOST: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
+// Load the customer-supplied encryption key, if any. The --encryption-key-file
+// flag takes precedence over the GCSFUSE_ENCRYPTION_KEY environment variable.
+// Either holds the base64 encoding of a 256-bit key.
+func getEncryptionKey(flags *flagStorage) (key []byte, err error) {
+	var encoded string
+	switch {
+	case flags.EncryptionKeyFile != "":
+		var contents []byte
+		contents, err = ioutil.ReadFile(flags.EncryptionKeyFile)
+		if err != nil {
+			err = fmt.Errorf("ReadFile: %v", err)
+			return
+		}
+
+		encoded = strings.TrimSpace(string(contents))
+
+	case os.Getenv("GCSFUSE_ENCRYPTION_KEY") != "":
+		encoded = os.Getenv("GCSFUSE_ENCRYPTION_KEY")
+
+	default:
 		return
 	}
 
-	// Create a config struct based on its contents.
-	jwtConfig, err := google.JWTConfigFromJSON(contents, scope)
+	key, err = base64.StdEncoding.DecodeString(encoded)
 	if err != nil {
-		err = fmt.Errorf("JWTConfigFromJSON: %v", err)
+		err = fmt.Errorf("Decoding encryption key: %v", err)
 		return
 	}
 
-	// Create the token source.
-	ts = jwtConfig.TokenSource(context.Background())
+	if len(key) != 32 {
+		err = fmt.Errorf("Encryption key is %d bytes long, want 32", len(key))
+		return
+	}
 
 	return
 }
 
-func getConn(flags *flagStorage) (c gcs.Conn, err error) {
-	// Create the oauth2 token source.
-	const scope = gcs.Scope_FullControl
+// Create a connection to GCS according to the supplied flags, along with an
+// HTTP client set up the same way for requests that the connection can't make.
+func getConn(flags *flagStorage) (
+	c gcs.Conn,
+	client *http.Client,
+	err error) {
+	endpoint, emulator, err := getEndpoint(flags)
+	if err != nil {
+		return
+	}
+
+	if flags.AnonymousAccess &&
+		(flags.KeyFile != "" || flags.ImpersonateServiceAccount != "") {
+		err = fmt.Errorf(
+			"--anonymous-access can't be combined with --key-file or " +
+				"--impersonate-service-account")
+		return
+	}
 
+	// Create the oauth2 token source, unless we need none.
 	var tokenSrc oauth2.TokenSource
-	if flags.KeyFile != "" {
-		tokenSrc, err = newTokenSourceFromPath(flags.KeyFile, scope)
-		if err != nil {
-			err = fmt.Errorf("newTokenSourceFromPath: %v", err)
-			return
-		}
-	} else {
-		tokenSrc, err = google.DefaultTokenSource(context.Background(), scope)
+	switch {
+	case flags.AnonymousAccess:
+
+	case emulator:
+		tokenSrc = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "emulator"})
+
+	default:
+		tokenSrc, err = getTokenSource(flags, gcs.Scope_FullControl)
 		if err != nil {
-			err = fmt.Errorf("DefaultTokenSource: %v", err)
 			return
 		}
 	}
 
-	// Create the connection.
-	const userAgent = "gcsfuse/0.0"
-	cfg := &gcs.ConnConfig{
-		TokenSource: tokenSrc,
-		UserAgent:   userAgent,
+	if flags.HTTPClients < 1 {
+		err = fmt.Errorf("Illegal number of HTTP clients: %d", flags.HTTPClients)
+		return
+	}
+
+	var disableHTTP2 bool
+	switch flags.HTTPProtocol {
+	case "http2":
+	case "http1":
+		disableHTTP2 = true
+	default:
+		err = fmt.Errorf("Unknown --http-protocol: %q", flags.HTTPProtocol)
+		return
 	}
 
+	// Connect, striping requests across the requested number of HTTP clients.
+	cfg := &gcsconn.Config{
+		TokenSource:         tokenSrc,
+		Anonymous:           flags.AnonymousAccess,
+		Endpoint:            endpoint,
+		HTTPClients:         flags.HTTPClients,
+		MaxConnsPerHost:     flags.MaxConnsPerHost,
+		MaxIdleConnsPerHost: flags.MaxIdleConnsPerHost,
+		IdleConnTimeout:     flags.HTTPIdleConnTimeout,
+		DisableHTTP2:        disableHTTP2,
+		MaxBackoffSleep:     flags.MaxRetrySleep,
+		StallTimeout:        flags.ReadStallTimeout,
+		UserAgent:           "gcsfuse/0.0",
+	}
+
+	// The logger writes nowhere unless turned on; see debug.go.
+	cfg.GCSDebugLogger = debugLoggers["gcs"]
+
 	if flags.DebugHTTP {
 		cfg.HTTPDebugLogger = log.New(os.Stdout, "http: ", 0)
 	}
 
-	if flags.DebugGCS {
-		cfg.GCSDebugLogger = log.New(os.Stdout, "gcs: ", log.Flags())
+	c, err = gcsconn.NewConn(cfg)
+	if err != nil {
+		err = fmt.Errorf("gcsconn.NewConn: %v", err)
+		return
+	}
+
+	client, err = gcsconn.NewHTTPClient(cfg)
+	if err != nil {
+		err = fmt.Errorf("gcsconn.NewHTTPClient: %v", err)
+		return
+	}
+
+	return
+}
+
+// Return an interface to the folders of the named bucket if it has
+// hierarchical namespace enabled, or nil if not. Failing to find out, e.g.
+// for lack of permission to get the bucket's metadata, is logged and treated
+// as the bucket being flat.
+func getFolders(
+	ctx context.Context,
+	client *http.Client,
+	bucketName string) (folders gcsx.Folders) {
+	enabled, err := gcsx.HierarchicalNamespaceEnabled(ctx, client, bucketName)
+	if err != nil {
+		log.Printf(
+			"Treating bucket as flat; couldn't tell whether it has a "+
+				"hierarchical namespace: %v",
+			err)
+
+		return
 	}
 
-	return gcs.NewConn(cfg)
+	if enabled {
+		folders = gcsx.NewFolders(client, bucketName)
+	}
+
+	return
+}
+
+// Create a subscriber for the object change notifications of the given
+// bucket, limited to the directory mounted if any.
+func newSubscriber(
+	flags *flagStorage,
+	bucketName string) (s *pubsub.Subscriber, err error) {
+	tokenSrc, err := getTokenSource(flags, pubsub.Scope)
+	if err != nil {
+		return
+	}
+
+	var prefix string
+	if flags.OnlyDir != "" {
+		prefix = path.Clean(flags.OnlyDir) + "/"
+	}
+
+	s, err = pubsub.NewSubscriber(pubsub.Config{
+		Client:       oauth2.NewClient(context.Background(), tokenSrc),
+		Subscription: flags.NotificationSubscription,
+		Bucket:       bucketName,
+		Prefix:       prefix,
+		Logger:       log.New(os.Stderr, "notifications: ", log.LstdFlags),
+	})
+
+	if err != nil {
+		err = fmt.Errorf("pubsub.NewSubscriber: %v", err)
+		return
+	}
+
+	return
+}
+
+// Create the cache of file contents that flags ask for, if any.
+func newContentCache(
+	flags *flagStorage,
+	bucketName string) (cache *gcsx.BlockCache, err error) {
+	// An offline mount can serve only what earlier mounts left on disk.
+	if flags.Offline && flags.ContentCacheDir == "" {
+		err = errors.New("--offline requires --content-cache-dir")
+		return
+	}
+
+	if flags.ContentCacheMB <= 0 {
+		if flags.ContentCacheDir != "" {
+			err = errors.New("--content-cache-dir requires --content-cache-mb")
+		}
+
+		return
+	}
+
+	capacity := int64(flags.ContentCacheMB) << 20
+	if flags.ContentCacheDir == "" {
+		cache = gcsx.NewBlockCache(capacity)
+		return
+	}
+
+	// Blocks are cached by object name, which is relative to --only-dir.
+	scope := bucketName
+	if flags.OnlyDir != "" {
+		scope += "/" + path.Clean(flags.OnlyDir)
+	}
+
+	cache, err = gcsx.OpenBlockCache(flags.ContentCacheDir, capacity, scope)
+	if err != nil {
+		err = fmt.Errorf("OpenBlockCache: %v", err)
+		return
+	}
+
+	return
+}
+
+// Save the index of the given content cache at the given interval, so that
+// a mount after a crash can reuse most of what was cached.
+func saveIndexPeriodically(
+	cache *gcsx.BlockCache,
+	interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := cache.SaveIndex(); err != nil {
+				log.Printf("Saving content cache index: %v", err)
+			}
+		}
+	}()
+}
+
+// Open the audit logs that flags ask for, returning nil if none.
+func newAuditLog(
+	flags *flagStorage,
+	bucketName string,
+	mountPoint string) (l audit.Log, err error) {
+	var logs []audit.Log
+	if flags.AuditLog != "" {
+		var fl audit.Log
+		fl, err = audit.NewFileLog(flags.AuditLog)
+		if err != nil {
+			err = fmt.Errorf("audit.NewFileLog: %v", err)
+			return
+		}
+
+		logs = append(logs, fl)
+	}
+
+	if flags.AuditLogProject != "" {
+		var tokenSrc oauth2.TokenSource
+		tokenSrc, err = getTokenSource(flags, audit.LoggingWriteScope)
+		if err != nil {
+			return
+		}
+
+		var cl audit.Log
+		cl, err = audit.NewCloudLog(audit.CloudConfig{
+			Client:  oauth2.NewClient(context.Background(), tokenSrc),
+			Project: flags.AuditLogProject,
+			Labels: map[string]string{
+				"bucket":      bucketName,
+				"mount_point": mountPoint,
+			},
+			Logger: log.New(os.Stderr, "audit: ", log.LstdFlags),
+		})
+
+		if err != nil {
+			err = fmt.Errorf("audit.NewCloudLog: %v", err)
+			return
+		}
+
+		logs = append(logs, cl)
+	}
+
+	switch len(logs) {
+	case 0:
+	case 1:
+		l = logs[0]
+	default:
+		l = audit.Multi(logs...)
+	}
+
+	return
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -228,7 +629,18 @@ func mountWithArgs(
 	bucketName string,
 	mountPoint string,
 	flags *flagStorage,
-	mountStatus *log.Logger) (mfs *fuse.MountedFileSystem, err error) {
+	cfg *profile.Config,
+	profiles *profile.Manager,
+	activity *fs.ActivityTracker,
+	changes *pubsub.Subscriber,
+	contentCache *gcsx.BlockCache,
+	admin *fs.Admin,
+	auditLog audit.Log,
+	mountStatus *log.Logger) (
+	mfs *fuse.MountedFileSystem,
+	bucket gcs.Bucket,
+	deletes gcsx.BackgroundDeleteBucket,
+	err error) {
 	// Enable invariant checking if requested.
 	if flags.DebugInvariants {
 		syncutil.EnableInvariantChecking()
@@ -236,26 +648,46 @@ func mountWithArgs(
 
 	// Grab the connection.
 	//
-	// Special case: if we're mounting the fake bucket, we don't need an actual
-	// connection.
+	// Special case: if we're mounting the fake bucket, or serving the content
+	// cache offline, we don't need an actual connection.
 	var conn gcs.Conn
-	if bucketName != canned.FakeBucketName {
+	var folders gcsx.Folders
+	var deleted gcsx.SoftDeletedObjects
+	if bucketName != canned.FakeBucketName && !flags.Offline {
 		mountStatus.Println("Opening GCS connection...")
 
-		conn, err = getConn(flags)
+		var client *http.Client
+		conn, client, err = getConn(flags)
 		if err != nil {
 			err = fmt.Errorf("getConn: %v", err)
 			return
 		}
+
+		if !flags.AnonymousAccess {
+			folders = getFolders(context.Background(), client, bucketName)
+		}
+
+		if flags.TrashDir {
+			deleted = gcsx.NewSoftDeletedObjects(client, bucketName)
+		}
 	}
 
 	// Mount the file system.
-	mfs, err = mountWithConn(
+	mfs, bucket, deletes, err = mountWithConn(
 		context.Background(),
 		bucketName,
 		mountPoint,
 		flags,
+		cfg,
+		profiles,
+		activity,
+		changes,
+		contentCache,
+		admin,
+		auditLog,
 		conn,
+		folders,
+		deleted,
 		mountStatus)
 
 	if err != nil {
@@ -325,6 +757,16 @@ func runCLIApp(c *cli.Context) (err error) {
 			env = append(env, fmt.Sprintf("http_proxy=%s", p))
 		}
 
+		// Likewise for the address of a GCS emulator.
+		if p, ok := os.LookupEnv("STORAGE_EMULATOR_HOST"); ok {
+			env = append(env, fmt.Sprintf("STORAGE_EMULATOR_HOST=%s", p))
+		}
+
+		// And for an encryption key.
+		if p, ok := os.LookupEnv("GCSFUSE_ENCRYPTION_KEY"); ok {
+			env = append(env, fmt.Sprintf("GCSFUSE_ENCRYPTION_KEY=%s", p))
+		}
+
 		// Run.
 		err = daemonize.Run(path, args, env, os.Stdout)
 		if err != nil {
@@ -335,12 +777,169 @@ func runCLIApp(c *cli.Context) (err error) {
 		return
 	}
 
+	// Start exporting traces before mounting, so that the file system and
+	// bucket are wrapped appropriately.
+	if flags.OTLPEndpoint != "" {
+		var exporter *tracing.Exporter
+		exporter, err = tracing.NewExporter(
+			flags.OTLPEndpoint,
+			map[string]string{
+				"service.name": "gcsfuse",
+				"gcs.bucket":   bucketName,
+			},
+			nil,
+			log.New(os.Stderr, "tracing: ", log.LstdFlags))
+
+		if err != nil {
+			err = fmt.Errorf("tracing.NewExporter: %v", err)
+			return
+		}
+
+		tracing.Enable(exporter)
+		defer exporter.Stop()
+	}
+
+	// Likewise for exporting metrics to Cloud Monitoring.
+	if flags.MonitoringProject != "" {
+		var tokenSrc oauth2.TokenSource
+		tokenSrc, err = getTokenSource(flags, monitor.MonitoringWriteScope)
+		if err != nil {
+			return
+		}
+
+		var exporter *monitor.StackdriverExporter
+		exporter, err = monitor.NewStackdriverExporter(monitor.StackdriverConfig{
+			Client:  oauth2.NewClient(context.Background(), tokenSrc),
+			Project: flags.MonitoringProject,
+			Labels: map[string]string{
+				"bucket":      bucketName,
+				"mount_point": mountPoint,
+			},
+			Logger: log.New(os.Stderr, "monitoring: ", log.LstdFlags),
+		})
+
+		if err != nil {
+			err = fmt.Errorf("monitor.NewStackdriverExporter: %v", err)
+			return
+		}
+
+		monitor.Enable()
+		defer exporter.Stop()
+	}
+
+	// The status file reports the same metrics, as does the control socket.
+	if flags.StatusFile != "" || flags.ControlSocket != "" {
+		monitor.Enable()
+	}
+
+	// Load the tuning profiles, so that a bad config file is reported before
+	// mounting.
+	cfg, err := readConfig(flags)
+	if err != nil {
+		err = fmt.Errorf("readConfig: %v", err)
+		return
+	}
+
+	profiles, err := newProfileManager(flags, cfg)
+	if err != nil {
+		err = fmt.Errorf("newProfileManager: %v", err)
+		return
+	}
+
+	// Turn on debug logging as requested by the flags, unless the config file
+	// says otherwise.
+	setDebugLogging("fuse", flags.DebugFuse)
+	setDebugLogging("gcs", flags.DebugGCS)
+	if cfg != nil && cfg.Debug != nil {
+		err = setEnabledDebugLogging(cfg.Debug)
+		if err != nil {
+			err = fmt.Errorf("setEnabledDebugLogging: %v", err)
+			return
+		}
+	}
+
+	// Serve profiles, if requested. Do this before mounting, so that a mount
+	// that hangs on the way up can be looked into too.
+	if flags.DebugPprofPort != 0 {
+		err = startPprofServer(flags.DebugPprofPort)
+		if err != nil {
+			err = fmt.Errorf("startPprofServer: %v", err)
+			return
+		}
+	}
+
+	// Track activity if we are to unmount when idle.
+	var activity *fs.ActivityTracker
+	if flags.IdleTimeout > 0 {
+		activity = fs.NewActivityTracker(timeutil.RealClock())
+	}
+
+	// Follow object change notifications, if requested.
+	var changes *pubsub.Subscriber
+	if flags.NotificationSubscription != "" {
+		changes, err = newSubscriber(flags, bucketName)
+		if err != nil {
+			err = fmt.Errorf("newSubscriber: %v", err)
+			return
+		}
+	}
+
+	// Set up the content cache, if requested. A cache kept on disk is reused
+	// by the next mount, so save its index as we go and once unmounted.
+	contentCache, err := newContentCache(flags, bucketName)
+	if err != nil {
+		err = fmt.Errorf("newContentCache: %v", err)
+		return
+	}
+
+	if contentCache != nil && flags.ContentCacheDir != "" {
+		saveIndexPeriodically(contentCache, time.Minute)
+		defer func() {
+			if err := contentCache.SaveIndex(); err != nil {
+				log.Printf("Saving content cache index: %v", err)
+			}
+		}()
+	}
+
+	// Open the audit log, if requested. It is closed once unmounted, when
+	// nothing more can be recorded.
+	auditLog, err := newAuditLog(flags, bucketName, mountPoint)
+	if err != nil {
+		err = fmt.Errorf("newAuditLog: %v", err)
+		return
+	}
+
+	if auditLog != nil {
+		defer func() {
+			if err := auditLog.Close(); err != nil {
+				log.Printf("Closing audit log: %v", err)
+			}
+		}()
+	}
+
+	// Give ourselves a way into the file system, for shutting down and for the
+	// control socket.
+	admin := fs.NewAdmin()
+
 	// Mount, writing information about our progress to the writer that package
 	// daemonize gives us and telling it about the outcome.
 	var mfs *fuse.MountedFileSystem
+	var bucket gcs.Bucket
+	var deletes gcsx.BackgroundDeleteBucket
 	{
 		mountStatus := log.New(daemonize.StatusWriter, "", 0)
-		mfs, err = mountWithArgs(bucketName, mountPoint, flags, mountStatus)
+		mfs, bucket, deletes, err = mountWithArgs(
+			bucketName,
+			mountPoint,
+			flags,
+			cfg,
+			profiles,
+			activity,
+			changes,
+			contentCache,
+			admin,
+			auditLog,
+			mountStatus)
 
 		if err == nil {
 			mountStatus.Println("File system has been successfully mounted.")
@@ -352,8 +951,69 @@ func runCLIApp(c *cli.Context) (err error) {
 		}
 	}
 
-	// Let the user unmount with Ctrl-C (SIGINT).
-	registerSIGINTHandler(mfs.Dir())
+	// Start following notifications now that the file system has subscribed.
+	if changes != nil {
+		changes.Start()
+		defer changes.Stop()
+	}
+
+	// Start reporting on the mount, if requested.
+	if flags.StatusFile != "" {
+		var w *statusFileWriter
+		w, err = newStatusFileWriter(
+			flags.StatusFile,
+			bucketName,
+			mountPoint,
+			flags,
+			profiles)
+
+		if err != nil {
+			err = fmt.Errorf("newStatusFileWriter: %v", err)
+			return
+		}
+
+		defer w.Stop()
+	}
+
+	// Accept administrative commands, if requested.
+	if flags.ControlSocket != "" {
+		var s *control.Server
+		s, err = startControlServer(
+			flags.ControlSocket,
+			flags,
+			profiles,
+			bucket,
+			contentCache,
+			admin)
+		if err != nil {
+			err = fmt.Errorf("startControlServer: %v", err)
+			return
+		}
+
+		defer s.Close()
+	}
+
+	// Let the user unmount with Ctrl-C (SIGINT), and the system with SIGTERM,
+	// without losing modifications.
+	registerShutdownHandler(
+		mfs.Dir(),
+		admin,
+		deletes,
+		flags.ShutdownGracePeriod)
+
+	// Reload the config file on SIGHUP.
+	registerSIGHUPHandler(flags, profiles)
+
+	// Unmount ourselves when idle, if requested.
+	if activity != nil {
+		unmountWhenIdle(
+			mfs.Dir(),
+			admin,
+			deletes,
+			activity,
+			flags.IdleTimeout,
+			flags.ShutdownGracePeriod)
+	}
 
 	// Wait for the file system to be unmounted.
 	err = mfs.Join(context.Background())
@@ -362,6 +1022,17 @@ func runCLIApp(c *cli.Context) (err error) {
 		return
 	}
 
+	// Unmounting doesn't wait for background deletions, e.g. when done with
+	// fusermount, so finish them before exiting.
+	{
+		ctx, cancel := context.WithTimeout(
+			context.Background(),
+			flags.ShutdownGracePeriod)
+
+		waitForDeletes(ctx, deletes)
+		cancel()
+	}
+
 	return
 }
 
@@ -18,26 +18,61 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/googlecloudplatform/gcsfuse/internal/audit"
 	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
 	"github.com/googlecloudplatform/gcsfuse/internal/perms"
+	"github.com/googlecloudplatform/gcsfuse/internal/profile"
+	"github.com/googlecloudplatform/gcsfuse/internal/pubsub"
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fsutil"
 	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/timeutil"
 )
 
+// The prefix of the names of the objects the file system creates temporarily
+// while writing files, relative to --only-dir.
+const tmpObjectPrefix = ".gcsfuse_tmp/"
+
 // Mount the file system based on the supplied arguments, returning a
-// fuse.MountedFileSystem that can be joined to wait for unmounting.
+// fuse.MountedFileSystem that can be joined to wait for unmounting and the
+// bucket as the file system sees it, before content type inference. cfg holds
+// the contents of the config file, and may be nil. Cache and rate limit
+// settings are taken from the active profile, and follow it when it is
+// switched. If activity is non-nil, ops are reported to it. If changes is
+// non-nil, caches forget the objects it reports as changed. If folders is
+// non-nil, the bucket has a hierarchical namespace and directories are its
+// folders. If deleted is non-nil, the trash directory serves the bucket's
+// soft-deleted objects. If admin is non-nil, it is attached to the file
+// system, and the debug directory is served if requested. If auditLog is
+// non-nil, changes to objects are recorded in it. If objects are deleted in
+// the background, deletes is non-nil and must be waited for before exiting.
 func mountWithConn(
 	ctx context.Context,
 	bucketName string,
 	mountPoint string,
 	flags *flagStorage,
+	cfg *profile.Config,
+	profiles *profile.Manager,
+	activity *fs.ActivityTracker,
+	changes *pubsub.Subscriber,
+	contentCache *gcsx.BlockCache,
+	admin *fs.Admin,
+	auditLog audit.Log,
 	conn gcs.Conn,
-	status *log.Logger) (mfs *fuse.MountedFileSystem, err error) {
+	folders gcsx.Folders,
+	deleted gcsx.SoftDeletedObjects,
+	status *log.Logger) (
+	mfs *fuse.MountedFileSystem,
+	bucket gcs.Bucket,
+	deletes gcsx.BackgroundDeleteBucket,
+	err error) {
 	// Sanity check: make sure the temporary directory exists and is writable
 	// currently. This gives a better user experience than harder to debug EIO
 	// errors when reading files in the future.
@@ -55,6 +90,151 @@ func mountWithConn(
 		}
 	}
 
+	// Convert the limits on temporary files and dirty data to bytes. Zero or
+	// less means none.
+	maxTempBytes := int64(flags.MaxTempUsageMB)
+	if maxTempBytes > 0 {
+		maxTempBytes <<= 20
+	}
+
+	maxDirtyBytes := int64(flags.MaxDirtyMB)
+	if maxDirtyBytes > 0 {
+		maxDirtyBytes <<= 20
+	}
+
+	// A suffix containing a slash would make the file's name a path.
+	if strings.Contains(flags.ConflictSuffix, "/") {
+		err = fmt.Errorf("Invalid --conflict-suffix: %q", flags.ConflictSuffix)
+		return
+	}
+
+	if flags.KMSKey != "" &&
+		!(strings.HasPrefix(flags.KMSKey, "projects/") &&
+			strings.Contains(flags.KMSKey, "/cryptoKeys/")) {
+		err = fmt.Errorf("Invalid --kms-key: %q", flags.KMSKey)
+		return
+	}
+
+	// Each part of a parallel upload is one source of a compose request.
+	if flags.ParallelUploads < 0 ||
+		flags.ParallelUploads > gcs.MaxSourcesPerComposeRequest {
+		err = fmt.Errorf("Invalid --parallel-uploads: %d", flags.ParallelUploads)
+		return
+	}
+
+	// The kernel deals in whole pages, and accepts no more than 256 of them.
+	if flags.MaxReadKB < 4 || flags.MaxReadKB > 1024 || flags.MaxReadKB%4 != 0 {
+		err = fmt.Errorf("Invalid --max-read-kb: %d", flags.MaxReadKB)
+		return
+	}
+
+	if flags.MaxWriteKB < 4 || flags.MaxWriteKB > 1024 || flags.MaxWriteKB%4 != 0 {
+		err = fmt.Errorf("Invalid --max-write-kb: %d", flags.MaxWriteKB)
+		return
+	}
+
+	encryptionKey, err := getEncryptionKey(flags)
+	if err != nil {
+		err = fmt.Errorf("getEncryptionKey: %v", err)
+		return
+	}
+
+	// Choose how to normalize the names of files and directories.
+	var normalization inode.Normalization
+	switch flags.NormalizeNames {
+	case "off":
+		normalization = inode.NormalizeOff
+	case "nfc":
+		normalization = inode.NormalizeNFC
+	case "nfd":
+		normalization = inode.NormalizeNFD
+	default:
+		err = fmt.Errorf("Unknown --normalize-names mode: %q", flags.NormalizeNames)
+		return
+	}
+
+	// Choose the link count reported for directories.
+	var countSubdirs bool
+	switch flags.DirNlink {
+	case "unknown":
+	case "count":
+		countSubdirs = true
+	default:
+		err = fmt.Errorf("Unknown --dir-nlink mode: %q", flags.DirNlink)
+		return
+	}
+
+	// Choose how to present objects stored with gzip content encoding.
+	var decompressGzip bool
+	switch flags.GzipObjects {
+	case "raw":
+	case "decompress":
+		decompressGzip = true
+	default:
+		err = fmt.Errorf("Unknown --gzip-objects mode: %q", flags.GzipObjects)
+		return
+	}
+
+	// Choose how the kernel may cache file contents.
+	var dropPageCache, directIO bool
+	switch flags.PageCache {
+	case "keep":
+	case "drop":
+		dropPageCache = true
+	case "direct":
+		directIO = true
+	default:
+		err = fmt.Errorf("Unknown --page-cache mode: %q", flags.PageCache)
+		return
+	}
+
+	// Choose whether opens must see the latest generation in GCS. If so,
+	// setUpBucket leaves out the stat cache.
+	var revalidateOnOpen bool
+	switch flags.Consistency {
+	case "ttl":
+	case "close-to-open":
+		revalidateOnOpen = true
+	default:
+		err = fmt.Errorf("Unknown --consistency mode: %q", flags.Consistency)
+		return
+	}
+
+	// Choose how to serve advisory locks.
+	var rejectFileLocks bool
+	var lockLeaseTTL time.Duration
+	switch flags.FileLocks {
+	case "local":
+	case "lease":
+		if flags.LockLeaseTTL <= 0 {
+			err = fmt.Errorf("Illegal --lock-lease-ttl: %v", flags.LockLeaseTTL)
+			return
+		}
+
+		lockLeaseTTL = flags.LockLeaseTTL
+	case "reject":
+		rejectFileLocks = true
+	default:
+		err = fmt.Errorf("Unknown --file-locks mode: %q", flags.FileLocks)
+		return
+	}
+
+	// Choose what flushes do on finding the object replaced.
+	var writeConflictPolicy inode.WriteConflictPolicy
+	switch flags.WriteConflictPolicy {
+	case "fail":
+		writeConflictPolicy = inode.WriteConflictFail
+	case "overwrite":
+		writeConflictPolicy = inode.WriteConflictOverwrite
+	case "newest-wins":
+		writeConflictPolicy = inode.WriteConflictNewestWins
+	default:
+		err = fmt.Errorf(
+			"Unknown --write-conflict-policy: %q",
+			flags.WriteConflictPolicy)
+		return
+	}
+
 	// Find the current process's UID and GID. If it was invoked as root and the
 	// user hasn't explicitly overridden --uid, everything is going to be owned
 	// by root. This is probably not what the user wants, so print a warning.
@@ -84,10 +264,15 @@ be interacting with the file system.
 	// Set up the bucket.
 	status.Println("Opening bucket...")
 
-	bucket, err := setUpBucket(
+	bucket, folders, deleted, deletes, err = setUpBucket(
 		ctx,
 		flags,
+		profiles,
+		changes,
+		contentCache,
 		conn,
+		folders,
+		deleted,
 		bucketName)
 
 	if err != nil {
@@ -95,21 +280,86 @@ be interacting with the file system.
 		return
 	}
 
+	// Choose storage classes for new objects.
+	var storageClasses map[string]string
+	if cfg != nil {
+		storageClasses = cfg.StorageClasses
+	}
+
 	// Create a file system server.
+	settings := profiles.Current()
 	serverCfg := &fs.ServerConfig{
 		CacheClock:             timeutil.RealClock(),
 		Bucket:                 bucket,
 		TempDir:                flags.TempDir,
+		MaxTempBytes:           maxTempBytes,
+		MemoryStagingBytes:     int64(flags.MemoryStagingKB) << 10,
+		MaxDirtyBytes:          maxDirtyBytes,
+		UploadWorkers:          flags.UploadWorkers,
+		ContentCache:           contentCache,
+		MaxReadSize:            flags.MaxReadKB << 10,
 		ImplicitDirectories:    flags.ImplicitDirs,
-		InodeAttributeCacheTTL: flags.StatCacheTTL,
-		DirTypeCacheTTL:        flags.TypeCacheTTL,
+		ConflictSuffix:         flags.ConflictSuffix,
+		NameNormalization:      normalization,
+		CountSubdirs:           countSubdirs,
+		InodeAttributeCacheTTL: settings.StatCacheTTL,
+		DirTypeCacheTTL:        settings.TypeCacheTTL,
+		LookupBurst:            flags.LookupBurst,
+		EntryCacheTTL:          flags.KernelEntryTTL,
+		KernelListCacheTTL:     flags.KernelListCacheTTL,
 		Uid:                    uid,
 		Gid:                    gid,
 		FilePerms:              os.FileMode(flags.FileMode),
 		DirPerms:               os.FileMode(flags.DirMode),
+		PersistPermissions:     flags.PersistPermissions,
+		VersionsDir:            flags.VersionsDir,
+
+		AppendThreshold:     1 << 21, // 2 MiB, a total guess.
+		TmpObjectPrefix:     tmpObjectPrefix,
+		ParallelUploads:     flags.ParallelUploads,
+		ParallelThreshold:   int64(flags.ParallelThresholdMB) << 20,
+		SparseFiles:         flags.SparseFiles,
+		AppendWrites:        flags.AppendWrites,
+		SniffContentTypes:   flags.SniffContentTypes,
+		StorageClass:        flags.StorageClass,
+		StorageClasses:      storageClasses,
+		KMSKey:              flags.KMSKey,
+		EncryptionKey:       encryptionKey,
+		DecompressGzip:      decompressGzip,
+		DropPageCache:       dropPageCache,
+		DirectIO:            directIO,
+		RevalidateOnOpen:    revalidateOnOpen,
+		StaleErrors:         flags.StaleErrors,
+		WriteConflictPolicy: writeConflictPolicy,
+		LinkCopies:          flags.LinkCopies,
+		RejectFileLocks:     rejectFileLocks,
+		LockLeaseTTL:        lockLeaseTTL,
+		LeaseObjectPrefix:   ".gcsfuse_leases/",
+		BucketSizeTTL:       flags.BucketSizeTTL,
+		Profiles:            profiles,
+		Folders:             folders,
+		SoftDeletedObjects:  deleted,
+		Changes:             changes,
+		Activity:            activity,
+		AuditLog:            auditLog,
+		Admin:               admin,
+		SlowOpThreshold:     flags.SlowOpThreshold,
+		SlowOpLogger:        log.New(os.Stderr, "", log.LstdFlags),
+	}
 
-		AppendThreshold: 1 << 21, // 2 MiB, a total guess.
-		TmpObjectPrefix: ".gcsfuse_tmp/",
+	if flags.DebugDir && admin != nil {
+		serverCfg.DebugFiles = debugDirFiles(
+			bucketName,
+			flags,
+			profiles,
+			contentCache,
+			admin)
+	}
+
+	// Let the user decouple the kernel's attribute cache from the stat cache.
+	if flags.KernelAttrTTL >= 0 {
+		serverCfg.InodeAttributeCacheTTL = flags.KernelAttrTTL
+		serverCfg.FixedInodeAttributeCacheTTL = true
 	}
 
 	server, err := fs.NewServer(serverCfg)
@@ -122,14 +372,19 @@ be interacting with the file system.
 	status.Println("Mounting file system...")
 
 	mountCfg := &fuse.MountConfig{
-		FSName:      bucket.Name(),
-		VolumeName:  bucket.Name(),
-		Options:     flags.MountOptions,
-		ErrorLogger: log.New(os.Stderr, "fuse: ", log.Flags()),
-	}
+		FSName:                  bucket.Name(),
+		VolumeName:              bucket.Name(),
+		Options:                 flags.MountOptions,
+		ErrorLogger:             log.New(os.Stderr, "fuse: ", log.Flags()),
+		DebugLogger:             debugLoggers["fuse"],
+		DisableWritebackCaching: flags.DisableWritebackCache,
+		EnableFileLocks:         true,
+		MaxReadSize:             flags.MaxReadKB << 10,
+		MaxWriteSize:            flags.MaxWriteKB << 10,
+		EnableAsyncReads:        flags.AsyncRead,
 
-	if flags.DebugFuse {
-		mountCfg.DebugLogger = log.New(os.Stdout, "fuse_debug: ", log.Flags())
+		// Neither a snapshot of the past nor the content cache can be changed.
+		ReadOnly: flags.SnapshotTime != "" || flags.Offline,
 	}
 
 	mfs, err = fuse.Mount(mountPoint, server, mountCfg)
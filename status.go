@@ -0,0 +1,264 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/monitor"
+	"github.com/googlecloudplatform/gcsfuse/internal/profile"
+)
+
+// How often the status file is rewritten.
+const statusFileInterval = 10 * time.Second
+
+// The contents of the file written by a statusFileWriter. Field names are part
+// of the file format, so should not be changed once released.
+type statusFileContents struct {
+	// "mounted" while the file system is serving, then "unmounted" once it has
+	// been unmounted.
+	State string `json:"state"`
+
+	// "ok", or "degraded" if some GCS requests have failed since the previous
+	// update and none have succeeded.
+	Health string `json:"health"`
+
+	Pid        int       `json:"pid"`
+	Version    string    `json:"version"`
+	Bucket     string    `json:"bucket"`
+	MountPoint string    `json:"mount_point"`
+	MountedAt  time.Time `json:"mounted_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+
+	// A hash of the flags with which gcsfuse was invoked, so that monitoring can
+	// tell when the configuration of a fleet diverges.
+	ConfigHash string `json:"config_hash"`
+
+	// The name of the active tuning profile, from which the cache settings
+	// below are taken.
+	Profile string `json:"profile"`
+
+	Caches struct {
+		StatCacheCapacity int           `json:"stat_cache_capacity"`
+		StatCacheTTL      time.Duration `json:"stat_cache_ttl_ns"`
+		StatCacheHits     int64         `json:"stat_cache_hits"`
+		TypeCacheTTL      time.Duration `json:"type_cache_ttl_ns"`
+	} `json:"caches"`
+
+	Counters struct {
+		FSOps            int64 `json:"fs_ops"`
+		FSOpErrors       int64 `json:"fs_op_errors"`
+		GCSRequests      int64 `json:"gcs_requests"`
+		GCSRequestErrors int64 `json:"gcs_request_errors"`
+
+		// GCS requests by the command name of the process on whose behalf they
+		// were made, or "gcsfuse" for those made in the background.
+		GCSRequestsByProcess map[string]int64 `json:"gcs_requests_by_process"`
+	} `json:"counters"`
+}
+
+// A statusFileWriter periodically writes a statusFileContents record as JSON
+// to a file, for consumption by monitoring agents. The file is replaced
+// atomically, so readers never see partial contents.
+type statusFileWriter struct {
+	path     string
+	profiles *profile.Manager
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	status statusFileContents
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// Write the initial status to the given path, returning an error if that's
+// not possible, then continue updating it in the background until Stop is
+// called.
+//
+// REQUIRES: monitor.Enabled()
+func newStatusFileWriter(
+	path string,
+	bucketName string,
+	mountPoint string,
+	flags *flagStorage,
+	profiles *profile.Manager) (w *statusFileWriter, err error) {
+	w = &statusFileWriter{
+		path:     path,
+		profiles: profiles,
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	s := &w.status
+	s.State = "mounted"
+	s.Health = "ok"
+	s.Pid = os.Getpid()
+	s.Version = getVersion()
+	s.Bucket = bucketName
+	s.MountPoint = mountPoint
+	s.MountedAt = time.Now()
+
+	s.ConfigHash, err = hashFlags(flags)
+	if err != nil {
+		err = fmt.Errorf("hashFlags: %v", err)
+		return
+	}
+
+	err = w.update()
+	if err != nil {
+		return
+	}
+
+	go w.loop()
+	return
+}
+
+// Stop updating the file, recording that the file system has been unmounted.
+func (w *statusFileWriter) Stop() {
+	close(w.stop)
+	<-w.stopped
+
+	w.mu.Lock()
+	w.status.State = "unmounted"
+	w.mu.Unlock()
+
+	if err := w.update(); err != nil {
+		log.Printf("Writing status file: %v", err)
+	}
+}
+
+func (w *statusFileWriter) loop() {
+	defer close(w.stopped)
+
+	ticker := time.NewTicker(statusFileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.update(); err != nil {
+				log.Printf("Writing status file: %v", err)
+			}
+
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// Refresh the status from the current metrics and write it out.
+func (w *statusFileWriter) update() (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	s := &w.status
+	prevRequests := s.Counters.GCSRequests
+	prevErrors := s.Counters.GCSRequestErrors
+
+	settings := w.profiles.Current()
+	s.Profile = w.profiles.Active()
+	s.Caches.StatCacheCapacity = settings.StatCacheCapacity
+	s.Caches.StatCacheTTL = settings.StatCacheTTL
+	s.Caches.TypeCacheTTL = settings.TypeCacheTTL
+
+	s.UpdatedAt = time.Now()
+	s.Caches.StatCacheHits = monitor.StatCacheHits()
+	s.Counters.FSOps = monitor.FSOps.Total()
+	s.Counters.FSOpErrors = monitor.FSOpErrors.Total()
+	s.Counters.GCSRequests = monitor.GCSRequests.Total()
+	s.Counters.GCSRequestErrors = monitor.GCSRequestErrors.Total()
+	s.Counters.GCSRequestsByProcess = monitor.GCSRequestsByProcess.Snapshot()
+
+	newRequests := s.Counters.GCSRequests - prevRequests
+	newErrors := s.Counters.GCSRequestErrors - prevErrors
+	if newErrors > 0 && newErrors == newRequests {
+		s.Health = "degraded"
+	} else {
+		s.Health = "ok"
+	}
+
+	contents, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		err = fmt.Errorf("MarshalIndent: %v", err)
+		return
+	}
+
+	err = writeFileAtomically(w.path, append(contents, '\n'))
+	return
+}
+
+// Hash the user's configuration, as given by the flags. Flags are hashed in
+// their parsed form, so that equivalent spellings hash the same.
+func hashFlags(flags *flagStorage) (h string, err error) {
+	contents, err := json.Marshal(flags)
+	if err != nil {
+		err = fmt.Errorf("Marshal: %v", err)
+		return
+	}
+
+	sum := sha256.Sum256(contents)
+	h = hex.EncodeToString(sum[:])
+	return
+}
+
+// Replace the file at the given path with the supplied contents, such that
+// concurrent readers see either the old or the new contents.
+func writeFileAtomically(path string, contents []byte) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		err = fmt.Errorf("TempFile: %v", err)
+		return
+	}
+
+	_, err = f.Write(contents)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		err = fmt.Errorf("Write: %v", err)
+		return
+	}
+
+	// TempFile uses mode 0600; let monitoring agents running as other users
+	// read the file.
+	err = os.Chmod(f.Name(), 0644)
+	if err != nil {
+		os.Remove(f.Name())
+		err = fmt.Errorf("Chmod: %v", err)
+		return
+	}
+
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		os.Remove(f.Name())
+		err = fmt.Errorf("Rename: %v", err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,161 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/monitor"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestStatusFile(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type StatusFileTest struct {
+	dir  string
+	path string
+}
+
+var _ SetUpInterface = &StatusFileTest{}
+var _ TearDownInterface = &StatusFileTest{}
+
+func init() { RegisterTestSuite(&StatusFileTest{}) }
+
+func (t *StatusFileTest) SetUp(ti *TestInfo) {
+	var err error
+	t.dir, err = ioutil.TempDir("", "status_file_test")
+	AssertEq(nil, err)
+
+	t.path = path.Join(t.dir, "status.json")
+}
+
+func (t *StatusFileTest) TearDown() {
+	os.RemoveAll(t.dir)
+}
+
+func (t *StatusFileTest) read() (s statusFileContents) {
+	contents, err := ioutil.ReadFile(t.path)
+	AssertEq(nil, err)
+
+	err = json.Unmarshal(contents, &s)
+	AssertEq(nil, err)
+
+	return
+}
+
+// Create a writer for the file at the given path, with the given flags.
+func (t *StatusFileTest) newWriter(
+	p string,
+	args []string) (w *statusFileWriter, err error) {
+	flags := parseArgs(args)
+	cfg, err := readConfig(flags)
+	AssertEq(nil, err)
+
+	profiles, err := newProfileManager(flags, cfg)
+	AssertEq(nil, err)
+
+	w, err = newStatusFileWriter(p, "foo", "/mnt/foo", flags, profiles)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StatusFileTest) WritesInitialStatus() {
+	monitor.FSOps.Add("StatusFileTest", 3)
+	monitor.GCSRequestsByProcess.Add("StatusFileTest", 2)
+
+	w, err := t.newWriter(t.path, nil)
+	AssertEq(nil, err)
+	defer w.Stop()
+
+	s := t.read()
+	ExpectEq("mounted", s.State)
+	ExpectEq("ok", s.Health)
+	ExpectEq(os.Getpid(), s.Pid)
+	ExpectEq("foo", s.Bucket)
+	ExpectEq("/mnt/foo", s.MountPoint)
+	ExpectEq("default", s.Profile)
+	ExpectEq(4096, s.Caches.StatCacheCapacity)
+	ExpectEq(monitor.FSOps.Total(), s.Counters.FSOps)
+	ExpectEq(2, s.Counters.GCSRequestsByProcess["StatusFileTest"])
+	ExpectEq(64, len(s.ConfigHash))
+
+	fi, err := os.Stat(t.path)
+	AssertEq(nil, err)
+	ExpectEq(os.FileMode(0644), fi.Mode())
+}
+
+func (t *StatusFileTest) Stop() {
+	w, err := t.newWriter(t.path, nil)
+	AssertEq(nil, err)
+
+	w.Stop()
+	ExpectEq("unmounted", t.read().State)
+
+	// No temporary files should be left behind.
+	entries, err := ioutil.ReadDir(t.dir)
+	AssertEq(nil, err)
+	ExpectEq(1, len(entries))
+}
+
+func (t *StatusFileTest) ActiveProfile() {
+	configPath := path.Join(t.dir, "config.json")
+	err := ioutil.WriteFile(
+		configPath,
+		[]byte(`{"profile": "fast", "profiles": {"fast": {"stat_cache_ttl": "1h"}}}`),
+		0644)
+
+	AssertEq(nil, err)
+
+	w, err := t.newWriter(t.path, []string{"--config-file", configPath})
+	AssertEq(nil, err)
+	defer w.Stop()
+
+	s := t.read()
+	ExpectEq("fast", s.Profile)
+	ExpectEq(time.Hour, s.Caches.StatCacheTTL)
+	ExpectEq(time.Minute, s.Caches.TypeCacheTTL)
+}
+
+func (t *StatusFileTest) ConfigHash() {
+	h0, err := hashFlags(parseArgs(nil))
+	AssertEq(nil, err)
+
+	h1, err := hashFlags(parseArgs([]string{"--implicit-dirs"}))
+	AssertEq(nil, err)
+
+	h2, err := hashFlags(parseArgs([]string{"--implicit-dirs=true"}))
+	AssertEq(nil, err)
+
+	ExpectNe(h0, h1)
+	ExpectEq(h1, h2)
+}
+
+func (t *StatusFileTest) UnwritableDirectory() {
+	_, err := t.newWriter(path.Join(t.dir, "missing", "status.json"), nil)
+
+	ExpectNe(nil, err)
+}
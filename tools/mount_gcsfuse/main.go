@@ -80,14 +80,14 @@ func makeGcsfuseArgs(
 		case "user", "nouser", "auto", "noauto", "_netdev", "no_netdev":
 
 		// Special case: support mount-like formatting for gcsfuse bool flags.
-		case "implicit_dirs":
+		case "implicit_dirs", "persist_permissions", "versions_dir", "trash_dir", "link_copies", "sparse_files", "append_writes", "anonymous_access", "sniff_content_types", "stale_errors", "disable_writeback_cache", "async_read", "offline", "debug_dir":
 			args = append(
 				args,
 				"--"+strings.Replace(name, "_", "-", -1),
 			)
 
 			// Special case: support mount-like formatting for gcsfuse string flags.
-		case "dir_mode", "file_mode", "key_file", "temp_dir", "gid", "uid", "only_dir", "limit_ops_per_sec", "limit_bytes_per_sec", "stat_cache_ttl", "type_cache_ttl", "billing_project":
+		case "dir_mode", "file_mode", "key_file", "temp_dir", "gid", "uid", "only_dir", "lower_layer", "local_overlay", "only_patterns", "ignore_patterns", "editor_temp_files", "editor_temp_patterns", "conflict_suffix", "normalize_names", "dir_nlink", "snapshot_time", "storage_class", "kms_key", "encryption_key_file", "limit_ops_per_sec", "limit_bytes_per_sec", "limit_window", "stat_cache_ttl", "type_cache_ttl", "billing_project", "endpoint", "http_clients", "max_retry_sleep", "otlp_endpoint", "monitoring_project", "status_file", "audit_log", "audit_log_project", "config_file", "control_socket", "slow_op_threshold", "idle_timeout", "shutdown_grace_period", "impersonate_service_account", "gzip_objects", "max_conns_per_host", "max_idle_conns_per_host", "http_idle_conn_timeout", "http_protocol", "metadata_timeout", "read_timeout", "read_stall_timeout", "upload_timeout", "hedge_reads_percentile", "circuit_breaker_threshold", "replica_bucket", "mirror_bucket", "kernel_entry_ttl", "kernel_list_cache_ttl", "kernel_attr_ttl", "page_cache", "bucket_size_ttl", "max_temp_usage_mb", "memory_staging_kb", "max_dirty_mb", "upload_workers", "delete_workers", "list_page_size", "lookup_burst", "max_read_kb", "max_write_kb", "parallel_uploads", "parallel_upload_threshold_mb", "content_cache_mb", "content_cache_dir", "consistency", "file_locks", "lock_lease_ttl", "write_conflict_policy", "notification_subscription", "debug_pprof_port":
 			args = append(
 				args,
 				"--"+strings.Replace(name, "_", "-", -1),
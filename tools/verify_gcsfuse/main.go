@@ -0,0 +1,177 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A tool that checks a gcsfuse mount against a direct listing of its bucket,
+// reporting names missing from either side and mismatched types, sizes, and
+// symlink targets. Only the tree is walked; file contents are never read and
+// nothing is modified.
+//
+// Usage:
+//
+//     verify_gcsfuse [flags] bucket mount_point
+//
+// Pass the same --implicit_dirs and --only_dir settings the bucket was
+// mounted with. Exits with status 1 if any discrepancies are found.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsconn"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/verify"
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+var fKeyFile = flag.String("key_file", "", "Path to a JSON key file. (default: application default credentials)")
+var fImplicitDirs = flag.Bool("implicit_dirs", false, "Whether the bucket was mounted with --implicit-dirs.")
+var fConflictSuffix = flag.String("conflict_suffix", "", "The --conflict-suffix with which the bucket was mounted, if any.")
+var fNormalizeNames = flag.String("normalize_names", "off", "The --normalize-names with which the bucket was mounted.")
+var fOnlyDir = flag.String("only_dir", "", "The --only-dir with which the bucket was mounted, if any.")
+var fEndpoint = flag.String("endpoint", "", "The --endpoint with which the bucket was mounted, if any.")
+
+func getBucket(ctx context.Context, name string) (b gcs.Bucket, err error) {
+	// Create the token source. Listing needs only read access.
+	var ts oauth2.TokenSource
+	if *fKeyFile != "" {
+		ts, err = gcsconn.KeyFileTokenSource(*fKeyFile, gcs.Scope_ReadOnly)
+		if err != nil {
+			err = fmt.Errorf("KeyFileTokenSource: %v", err)
+			return
+		}
+	} else {
+		ts, err = google.DefaultTokenSource(ctx, gcs.Scope_ReadOnly)
+		if err != nil {
+			err = fmt.Errorf("DefaultTokenSource: %v", err)
+			return
+		}
+	}
+
+	cfg := &gcsconn.Config{
+		TokenSource: ts,
+		UserAgent:   "verify_gcsfuse",
+	}
+
+	if *fEndpoint != "" {
+		cfg.Endpoint, err = gcsconn.ParseEndpoint(*fEndpoint, "https")
+		if err != nil {
+			err = fmt.Errorf("ParseEndpoint: %v", err)
+			return
+		}
+	}
+
+	conn, err := gcsconn.NewConn(cfg)
+	if err != nil {
+		err = fmt.Errorf("NewConn: %v", err)
+		return
+	}
+
+	b, err = conn.OpenBucket(ctx, &gcs.OpenBucketOptions{Name: name})
+	if err != nil {
+		err = fmt.Errorf("OpenBucket: %v", err)
+		return
+	}
+
+	// Look at the same part of the bucket as the mount.
+	if *fOnlyDir != "" {
+		b, err = gcsx.NewPrefixBucket(path.Clean(*fOnlyDir)+"/", b)
+		if err != nil {
+			err = fmt.Errorf("NewPrefixBucket: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
+func run(bucketName string, mountPoint string) (n int, err error) {
+	ctx := context.Background()
+
+	bucket, err := getBucket(ctx, bucketName)
+	if err != nil {
+		err = fmt.Errorf("getBucket: %v", err)
+		return
+	}
+
+	var normalization inode.Normalization
+	switch *fNormalizeNames {
+	case "off":
+		normalization = inode.NormalizeOff
+	case "nfc":
+		normalization = inode.NormalizeNFC
+	case "nfd":
+		normalization = inode.NormalizeNFD
+	default:
+		err = fmt.Errorf("Unknown --normalize_names mode: %q", *fNormalizeNames)
+		return
+	}
+
+	ds, err := verify.Verify(
+		ctx,
+		bucket,
+		*fImplicitDirs,
+		*fConflictSuffix,
+		normalization,
+		mountPoint)
+	if err != nil {
+		err = fmt.Errorf("Verify: %v", err)
+		return
+	}
+
+	for _, d := range ds {
+		fmt.Println(d)
+	}
+
+	n = len(ds)
+	return
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] bucket mount_point\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	n, err := run(flag.Arg(0), flag.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if n > 0 {
+		fmt.Fprintf(
+			os.Stderr,
+			"%d discrepancies found. Note that objects modified while verifying "+
+				"also show up.\n",
+			n)
+
+		os.Exit(1)
+	}
+
+	fmt.Fprintln(os.Stderr, "No discrepancies found.")
+}